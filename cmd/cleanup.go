@@ -75,7 +75,7 @@ func cleanup(cmd *cobra.Command, args []string) {
 		LogFunc:                   lf,
 	}
 
-	cleaner.Clean()
+	cleaner.Clean(ctx)
 
 	ci, err := metahelm.NewChartInstaller(nil, dl, nil, nil, k8sConfig.GroupBindings, k8sConfig.PrivilegedRepoWhitelist, k8sConfig.SecretInjections, k8sClientConfig.JWTPath, true, helmClientConfig)
 	if err != nil {
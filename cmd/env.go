@@ -0,0 +1,232 @@
+package cmd
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"os"
+	"os/signal"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/dollarshaveclub/acyl/pkg/api"
+	"github.com/dollarshaveclub/acyl/pkg/nitro/metahelm"
+	"github.com/spf13/cobra"
+)
+
+// envCmd represents the env command
+var envCmd = &cobra.Command{
+	Use:   "env",
+	Short: "Interact with running environments",
+	Long:  `env and subcommands are client tools for working with environments via the acyl server API, authenticated with a user API key`,
+}
+
+var envPortForwardCmd = &cobra.Command{
+	Use:   "port-forward ENV_NAME SERVICE [LOCAL_PORT:]PORT",
+	Short: "forward a local port to a service in an environment",
+	Long: `Listens on a local port and proxies HTTP and WebSocket traffic to the named Service and port within the
+environment namespace, through the acyl server. PORT may be a port number or a named Service port. If LOCAL_PORT is omitted
+and PORT is a number, the same port number is used locally.
+
+No cluster credentials are required. The API key (--api-key or ACYL_API_KEY) must have write permission
+and belong to the user that owns the environment.`,
+	Args: cobra.ExactArgs(3),
+	Run:  envPortForward,
+}
+
+var envCloneCmd = &cobra.Command{
+	Use:   "clone ENV_NAME",
+	Short: "create a new environment that reproduces an existing one",
+	Long: `Creates a new manual environment with the same triggering repo and the same dependency branches and commits as the named
+environment, which may belong to another user. Individual repos may be moved to a different branch with --ref-override (the
+head of that branch is used). The new environment is owned by the user of the API key (--api-key or ACYL_API_KEY), which must
+have write permission.`,
+	Args: cobra.ExactArgs(1),
+	Run:  envClone,
+}
+
+type envOptions struct {
+	host         string
+	apiKey       string
+	ignorecert   bool
+	disableHTTPS bool
+	address      string
+	refOverrides []string
+	ttl          string
+	user         string
+}
+
+var envOpts = &envOptions{}
+
+func init() {
+	envCmd.PersistentFlags().StringVar(&envOpts.host, "acyl-host", os.Getenv("ACYL_HOST"), "Acyl hostname:port")
+	envCmd.PersistentFlags().StringVar(&envOpts.apiKey, "api-key", os.Getenv("ACYL_API_KEY"), "Acyl user API key")
+	envCmd.PersistentFlags().BoolVar(&envOpts.ignorecert, "ignore-cert", false, "Ignore TLS certificate validity (INSECURE)")
+	envCmd.PersistentFlags().BoolVar(&envOpts.disableHTTPS, "disable-https", false, "Use HTTP instead of HTTPS to connect to the acyl server")
+	envPortForwardCmd.Flags().StringVar(&envOpts.address, "address", "127.0.0.1", "Local address to listen on")
+	envCloneCmd.Flags().StringSliceVar(&envOpts.refOverrides, "ref-override", []string{}, "Use a different branch for a repo than the source environment (REPO=BRANCH, may be repeated)")
+	envCloneCmd.Flags().StringVar(&envOpts.ttl, "ttl", "", "Environment lifetime (eg, 48h), defaults to the server setting for manual environments")
+	envCloneCmd.Flags().StringVar(&envOpts.user, "user", "", "Owner of the new environment (admin API keys only)")
+	envCmd.AddCommand(envPortForwardCmd)
+	envCmd.AddCommand(envCloneCmd)
+	RootCmd.AddCommand(envCmd)
+}
+
+// envAPIURL returns the base URL of the acyl server API from the env options
+func envAPIURL() *url.URL {
+	if envOpts.host == "" {
+		clierr("acyl host is required (--acyl-host or ACYL_HOST)")
+	}
+	if envOpts.apiKey == "" {
+		clierr("api key is required (--api-key or ACYL_API_KEY)")
+	}
+	scheme := "https"
+	if envOpts.disableHTTPS {
+		scheme = "http"
+	}
+	acylURL, err := url.Parse(scheme + "://" + envOpts.host)
+	if err != nil {
+		clierr("error parsing acyl host: %v", err)
+	}
+	return acylURL
+}
+
+// parseRefOverrides parses a list of REPO=BRANCH ref overrides
+func parseRefOverrides(overrides []string) (map[string]string, error) {
+	out := make(map[string]string, len(overrides))
+	for _, o := range overrides {
+		parts := strings.SplitN(o, "=", 2)
+		if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+			return nil, fmt.Errorf("invalid ref override (expected REPO=BRANCH): %v", o)
+		}
+		out[parts[0]] = parts[1]
+	}
+	return out, nil
+}
+
+// parsePortForwardPorts parses a port spec of the form [LOCAL_PORT:]PORT. LOCAL_PORT may be 0 to pick a random free port.
+func parsePortForwardPorts(spec string) (local, remote string, err error) {
+	parts := strings.Split(spec, ":")
+	switch len(parts) {
+	case 1:
+		local, remote = parts[0], parts[0]
+	case 2:
+		local, remote = parts[0], parts[1]
+	default:
+		return "", "", fmt.Errorf("invalid port spec (expected [LOCAL_PORT:]PORT): %v", spec)
+	}
+	if n, err := strconv.Atoi(local); err != nil || n < 0 || n > 65535 {
+		return "", "", fmt.Errorf("invalid local port (a local port number is required if PORT is named): %v", spec)
+	}
+	return local, remote, nil
+}
+
+// newEnvPortForwardProxy returns a reverse proxy that sends all requests to the service proxy endpoint for the env service and port
+func newEnvPortForwardProxy(acylURL *url.URL, apiKey, envName, service, port string, ignorecert bool) *httputil.ReverseProxy {
+	prefix := strings.TrimSuffix(acylURL.Path, "/") + "/v2/envs/" + url.PathEscape(envName) + "/services/" + service + "/ports/" + port + "/proxy"
+	return &httputil.ReverseProxy{
+		Director: func(r *http.Request) {
+			r.URL.Scheme = acylURL.Scheme
+			r.URL.Host = acylURL.Host
+			r.URL.Path = prefix + "/" + strings.TrimPrefix(r.URL.Path, "/")
+			r.URL.RawPath = ""
+			r.Host = acylURL.Host
+			r.Header.Set("API-Key", apiKey)
+		},
+		Transport: &http.Transport{
+			Proxy:           http.ProxyFromEnvironment,
+			TLSClientConfig: &tls.Config{InsecureSkipVerify: ignorecert},
+		},
+	}
+}
+
+func envPortForward(cmd *cobra.Command, args []string) {
+	envName, service := args[0], args[1]
+	local, remote, err := parsePortForwardPorts(args[2])
+	if err != nil {
+		clierr("%v", err)
+	}
+	if err := metahelm.ValidateServiceProxyTarget(service, remote); err != nil {
+		clierr("%v", err)
+	}
+	acylURL := envAPIURL()
+
+	l, err := net.Listen("tcp", net.JoinHostPort(envOpts.address, local))
+	if err != nil {
+		clierr("error listening on local port: %v", err)
+	}
+	srv := &http.Server{
+		Handler: newEnvPortForwardProxy(acylURL, envOpts.apiKey, envName, service, remote, envOpts.ignorecert),
+	}
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		sigs := make(chan os.Signal, 1)
+		signal.Notify(sigs, os.Interrupt, syscall.SIGTERM)
+		<-sigs
+		ctx, cf := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cf()
+		srv.Shutdown(ctx)
+	}()
+
+	log.Printf("forwarding http://%v -> %v/%v:%v (ctrl-c to stop)", l.Addr(), envName, service, remote)
+	if err := srv.Serve(l); err != nil && err != http.ErrServerClosed {
+		clierr("error serving: %v", err)
+	}
+	<-done
+}
+
+func envClone(cmd *cobra.Command, args []string) {
+	overrides, err := parseRefOverrides(envOpts.refOverrides)
+	if err != nil {
+		clierr("%v", err)
+	}
+	acylURL := envAPIURL()
+	body, err := json.Marshal(&api.V2CloneEnvRequest{
+		RefOverrides: overrides,
+		TTL:          envOpts.ttl,
+		User:         envOpts.user,
+	})
+	if err != nil {
+		clierr("error marshaling request: %v", err)
+	}
+	acylURL.Path = strings.TrimSuffix(acylURL.Path, "/") + "/v2/envs/" + url.PathEscape(args[0]) + "/actions/clone"
+	req, err := http.NewRequest("POST", acylURL.String(), bytes.NewBuffer(body))
+	if err != nil {
+		clierr("error creating request: %v", err)
+	}
+	req.Header.Set("API-Key", envOpts.apiKey)
+	req.Header.Set("Content-Type", "application/json")
+	hc := &http.Client{
+		Timeout: 30 * time.Second,
+		Transport: &http.Transport{
+			Proxy:           http.ProxyFromEnvironment,
+			TLSClientConfig: &tls.Config{InsecureSkipVerify: envOpts.ignorecert},
+		},
+	}
+	resp, err := hc.Do(req)
+	if err != nil {
+		clierr("error performing request: %v", err)
+	}
+	defer resp.Body.Close()
+	rb, _ := ioutil.ReadAll(resp.Body)
+	if resp.StatusCode != http.StatusCreated {
+		clierr("clone failed: %v: %v", resp.Status, strings.TrimSpace(string(rb)))
+	}
+	out := api.V2ManualEnvResponse{}
+	if err := json.Unmarshal(rb, &out); err != nil {
+		clierr("error unmarshaling response: %v", err)
+	}
+	log.Printf("creating environment %v (clone of %v), event log: %v", out.EnvName, args[0], out.EventID)
+}
@@ -0,0 +1,180 @@
+package cmd
+
+import (
+	"bytes"
+	"crypto/tls"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/dollarshaveclub/acyl/pkg/api"
+	"github.com/dollarshaveclub/acyl/pkg/locker"
+	"github.com/spf13/cobra"
+)
+
+// locksCmd represents the locks command
+var locksCmd = &cobra.Command{
+	Use:   "locks",
+	Short: "Inspect and release environment locks",
+	Long: `locks and subcommands are admin client tools for inspecting the locks that serialize operations on each environment
+and force-releasing locks that are stuck, via the acyl server API. The API key (--api-key or ACYL_API_KEY) must have admin permission.`,
+}
+
+var locksListCmd = &cobra.Command{
+	Use:   "list",
+	Short: "list environment locks and the operations holding and waiting for them",
+	Long: `Lists the environment locks that are held or waited for, with the event (operation) of each request, its state
+(held, waiting or preempted) and when it was requested and acquired.`,
+	Args: cobra.NoArgs,
+	Run:  locksList,
+}
+
+var locksReleaseCmd = &cobra.Command{
+	Use:   "release REPO PR",
+	Short: "force-release a stuck environment lock",
+	Long: `Forcibly releases the environment lock for REPO and pull request PR. The holder is signalled that it was preempted,
+but the lock is released without waiting for it, so the next waiting operation proceeds immediately. This should only be
+used if the holder is stuck. An audit record of the release is kept with the API key user and --reason (required).`,
+	Args: cobra.ExactArgs(2),
+	Run:  locksRelease,
+}
+
+var locksReleasesCmd = &cobra.Command{
+	Use:   "releases",
+	Short: "list the most recent forced releases of environment locks",
+	Args:  cobra.NoArgs,
+	Run:   locksReleases,
+}
+
+var locksOpts struct {
+	reason string
+	limit  uint
+}
+
+func init() {
+	locksCmd.PersistentFlags().StringVar(&envOpts.host, "acyl-host", os.Getenv("ACYL_HOST"), "Acyl hostname:port")
+	locksCmd.PersistentFlags().StringVar(&envOpts.apiKey, "api-key", os.Getenv("ACYL_API_KEY"), "Acyl admin API key")
+	locksCmd.PersistentFlags().BoolVar(&envOpts.ignorecert, "ignore-cert", false, "Ignore TLS certificate validity (INSECURE)")
+	locksCmd.PersistentFlags().BoolVar(&envOpts.disableHTTPS, "disable-https", false, "Use HTTP instead of HTTPS to connect to the acyl server")
+	locksReleaseCmd.Flags().StringVar(&locksOpts.reason, "reason", "", "Reason for the release, recorded in the audit record (required)")
+	locksReleasesCmd.Flags().UintVar(&locksOpts.limit, "limit", 20, "Maximum number of releases to list")
+	locksCmd.AddCommand(locksListCmd)
+	locksCmd.AddCommand(locksReleaseCmd)
+	locksCmd.AddCommand(locksReleasesCmd)
+	RootCmd.AddCommand(locksCmd)
+}
+
+// locksStatusErrors are the errors for the lock API error statuses
+var locksStatusErrors = map[int]string{
+	http.StatusConflict:       "lock is not held",
+	http.StatusNotImplemented: "lock inspection is not supported by the lock provider of the acyl server",
+}
+
+// adminAPIRequest performs an API request against the acyl server and unmarshals the JSON response into out, exiting
+// with the error in statusErrs for the response status if it isn't OK
+func adminAPIRequest(method, path string, body interface{}, out interface{}, statusErrs map[int]string) {
+	acylURL := envAPIURL()
+	var rb io.Reader
+	if body != nil {
+		b, err := json.Marshal(body)
+		if err != nil {
+			clierr("error marshaling request: %v", err)
+		}
+		rb = bytes.NewBuffer(b)
+	}
+	acylURL.Path = strings.TrimSuffix(acylURL.Path, "/") + path
+	req, err := http.NewRequest(method, acylURL.String(), rb)
+	if err != nil {
+		clierr("error creating request: %v", err)
+	}
+	req.Header.Set("API-Key", envOpts.apiKey)
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	hc := &http.Client{
+		Timeout: 30 * time.Second,
+		Transport: &http.Transport{
+			Proxy:           http.ProxyFromEnvironment,
+			TLSClientConfig: &tls.Config{InsecureSkipVerify: envOpts.ignorecert},
+		},
+	}
+	resp, err := hc.Do(req)
+	if err != nil {
+		clierr("error performing request: %v", err)
+	}
+	defer resp.Body.Close()
+	b, _ := ioutil.ReadAll(resp.Body)
+	if resp.StatusCode != http.StatusOK {
+		if msg, ok := statusErrs[resp.StatusCode]; ok {
+			clierr(msg)
+		}
+		clierr("request failed: %v: %v", resp.Status, strings.TrimSpace(string(b)))
+	}
+	if err := json.Unmarshal(b, out); err != nil {
+		clierr("error unmarshaling response: %v", err)
+	}
+}
+
+// formatLockTime formats t for display, or returns "-" if it's zero
+func formatLockTime(t time.Time) string {
+	if t.IsZero() {
+		return "-"
+	}
+	return t.Local().Format(time.RFC3339)
+}
+
+func locksList(cmd *cobra.Command, args []string) {
+	locks := []locker.EnvLock{}
+	adminAPIRequest("GET", "/v2/locks", nil, &locks, locksStatusErrors)
+	if len(locks) == 0 {
+		fmt.Println("no locks are held or waited for")
+		return
+	}
+	tw := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "REPO\tPR\tSTATE\tEVENT\tREQUESTED\tACQUIRED\tPREEMPTED BY")
+	for _, el := range locks {
+		for _, lr := range el.Requests {
+			preemptedBy := "-"
+			if !lr.Preempted.IsZero() {
+				preemptedBy = fmt.Sprintf("%v (%v)", lr.PreemptedBy, formatLockTime(lr.Preempted))
+			}
+			fmt.Fprintf(tw, "%v\t%v\t%v\t%v\t%v\t%v\t%v\n", el.Repo, el.PullRequest, lr.State, lr.Event, formatLockTime(lr.Requested), formatLockTime(lr.Acquired), preemptedBy)
+		}
+	}
+	tw.Flush()
+}
+
+func locksRelease(cmd *cobra.Command, args []string) {
+	pr, err := strconv.ParseUint(args[1], 10, 32)
+	if err != nil || pr == 0 {
+		clierr("invalid pull request number: %v", args[1])
+	}
+	if locksOpts.reason == "" {
+		clierr("reason is required (--reason)")
+	}
+	lfr := locker.LockForceRelease{}
+	adminAPIRequest("POST", "/v2/locks/release", &api.V2LockReleaseRequest{
+		Repo:        args[0],
+		PullRequest: uint(pr),
+		Reason:      locksOpts.reason,
+	}, &lfr, locksStatusErrors)
+	fmt.Printf("released lock for %v/%v held by %q (audit record: %v)\n", lfr.Repo, lfr.PullRequest, lfr.HolderEvent, lfr.ID)
+}
+
+func locksReleases(cmd *cobra.Command, args []string) {
+	releases := []locker.LockForceRelease{}
+	adminAPIRequest("GET", fmt.Sprintf("/v2/locks/releases?limit=%v", locksOpts.limit), nil, &releases, locksStatusErrors)
+	tw := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "RELEASED\tUSER\tREPO\tPR\tHOLDER\tREASON")
+	for _, lfr := range releases {
+		fmt.Fprintf(tw, "%v\t%v\t%v\t%v\t%v\t%v\n", formatLockTime(lfr.Created), lfr.User, lfr.Repo, lfr.PullRequest, lfr.HolderEvent, lfr.Reason)
+	}
+	tw.Flush()
+}
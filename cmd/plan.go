@@ -0,0 +1,246 @@
+package cmd
+
+import (
+	"bytes"
+	"crypto/tls"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/dollarshaveclub/acyl/pkg/api"
+	"github.com/dollarshaveclub/acyl/pkg/ghclient"
+	"github.com/dollarshaveclub/acyl/pkg/models"
+	nitroenv "github.com/dollarshaveclub/acyl/pkg/nitro/env"
+	"github.com/dollarshaveclub/acyl/pkg/nitro/metahelm"
+	"github.com/dollarshaveclub/acyl/pkg/nitro/metrics"
+	"github.com/dollarshaveclub/acyl/pkg/persistence"
+	"github.com/spf13/afero"
+	"github.com/spf13/cobra"
+	"gopkg.in/src-d/go-billy.v4/osfs"
+)
+
+var configPlanCmd = &cobra.Command{
+	Use:   "plan",
+	Short: "show what acyl would do with an acyl.yml without building or deploying anything",
+	Long: `Processes the acyl.yml in the current directory exactly as an environment create would (branch matching, chart generation
+and value merging) and displays the plan: the resolved refs, chart install order and the final values of each chart.
+No images are built and the Kubernetes cluster is not accessed.
+
+By default the plan is calculated locally, using the working tree and local repos in the same way as "config info" (see --search-paths).
+
+With --remote, the plan is calculated by the acyl server (--acyl-host or ACYL_HOST, authenticated with --api-key or ACYL_API_KEY) using
+the currently checked-out branch, which must be pushed to GitHub. The server plan includes a diff against the current environment: the
+environment for the pull request in --pr if set, or the environment named by --env. Local working tree changes are not included.`,
+	Run: configPlan,
+}
+
+type planOptions struct {
+	remote     bool
+	envName    string
+	pr         uint
+	jsonOutput bool
+}
+
+var planOpts planOptions
+
+func init() {
+	configPlanCmd.Flags().BoolVar(&planOpts.remote, "remote", false, "Calculate the plan on the acyl server, including a diff against the current environment")
+	configPlanCmd.Flags().StringVar(&planOpts.envName, "env", "", "Compare against the named environment (implies --remote)")
+	configPlanCmd.Flags().UintVar(&planOpts.pr, "pr", 0, "Compare against the environment for this pull request (implies --remote)")
+	configPlanCmd.Flags().BoolVar(&planOpts.jsonOutput, "json", false, "Output the plan as JSON")
+	configPlanCmd.Flags().StringVar(&envOpts.host, "acyl-host", os.Getenv("ACYL_HOST"), "Acyl hostname:port (--remote only)")
+	configPlanCmd.Flags().StringVar(&envOpts.apiKey, "api-key", os.Getenv("ACYL_API_KEY"), "Acyl user API key (--remote only)")
+	configPlanCmd.Flags().BoolVar(&envOpts.ignorecert, "ignore-cert", false, "Ignore TLS certificate validity (INSECURE, --remote only)")
+	configPlanCmd.Flags().BoolVar(&envOpts.disableHTTPS, "disable-https", false, "Use HTTP instead of HTTPS to connect to the acyl server (--remote only)")
+	configCmd.AddCommand(configPlanCmd)
+}
+
+func configPlan(cmd *cobra.Command, args []string) {
+	var plan *models.EnvironmentPlan
+	if planOpts.remote || planOpts.envName != "" || planOpts.pr != 0 {
+		plan = remotePlan()
+	} else {
+		plan = localPlan()
+	}
+	if planOpts.jsonOutput {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		if err := enc.Encode(plan); err != nil {
+			clierr("error marshaling plan: %v", err)
+		}
+		return
+	}
+	displayPlan(os.Stdout, plan)
+}
+
+// localPlan calculates the plan for the working tree of the current directory
+func localPlan() *models.EnvironmentPlan {
+	mg, ri, wd, ctx := generateLocalMetaGetter(persistence.NewFakeDataLayer(), nil)
+	rrd := models.RepoRevisionData{
+		PullRequest:  999,
+		Repo:         ri.GitHubRepoName,
+		BaseBranch:   baseBranch,
+		SourceBranch: ri.HeadBranch,
+		SourceSHA:    ri.HeadSHA,
+		User:         "john.doe",
+	}
+	logger.Printf("processing %v", filepath.Join(wd, "acyl.yml"))
+	rc, err := mg.Get(ctx, rrd)
+	if err != nil {
+		clierr("error processing config: %v", err)
+	}
+	tempd, err := ioutil.TempDir("", "acyl-config-plan")
+	if err != nil {
+		clierr("error creating temp dir: %v", err)
+	}
+	defer os.RemoveAll(tempd)
+	cl, err := mg.FetchCharts(ctx, rc, tempd)
+	if err != nil {
+		clierr("error fetching charts: %v", err)
+	}
+	mcloc := metahelm.ChartLocations{}
+	for k, v := range cl {
+		mcloc[k] = metahelm.ChartLocation{
+			ChartPath:   v.ChartPath,
+			VarFilePath: v.VarFilePath,
+		}
+	}
+	env := &models.QAEnvironment{Name: nitroenv.PlanEnvNamePlaceholder, Repo: rc.Application.Repo}
+	plan, err := metahelm.NewChartPlanner(osfs.New(""), &metrics.FakeCollector{}).PlanCharts(ctx, nitroenv.PlanNamespacePlaceholder, &metahelm.EnvInfo{RC: rc, Env: env}, mcloc)
+	if err != nil {
+		clierr("error planning charts: %v", err)
+	}
+	plan.Diff(nil, nil, nil, rc.ConfigSignature())
+	return plan
+}
+
+// remotePlan requests the plan for the pushed head of the current branch from the acyl server
+func remotePlan() *models.EnvironmentPlan {
+	wd, err := os.Getwd()
+	if err != nil {
+		clierr("error getting working directory: %v", err)
+	}
+	ri, err := ghclient.RepoInfo(afero.NewOsFs(), wd, githubHostname)
+	if err != nil {
+		clierr("error getting repo info for current directory: %v", err)
+	}
+	acylURL := envAPIURL()
+	method, body := "GET", []byte{}
+	if planOpts.envName != "" {
+		acylURL.Path = strings.TrimSuffix(acylURL.Path, "/") + "/v2/envs/" + url.PathEscape(planOpts.envName) + "/plan"
+		acylURL.RawQuery = url.Values{"ref": []string{ri.HeadBranch}}.Encode()
+	} else {
+		method = "POST"
+		body, err = json.Marshal(&api.V2PlanRequest{
+			Repo:        ri.GitHubRepoName,
+			Ref:         ri.HeadBranch,
+			BaseRef:     baseBranch,
+			PullRequest: planOpts.pr,
+		})
+		if err != nil {
+			clierr("error marshaling request: %v", err)
+		}
+		acylURL.Path = strings.TrimSuffix(acylURL.Path, "/") + "/v2/plan"
+	}
+	req, err := http.NewRequest(method, acylURL.String(), bytes.NewBuffer(body))
+	if err != nil {
+		clierr("error creating request: %v", err)
+	}
+	req.Header.Set("API-Key", envOpts.apiKey)
+	req.Header.Set("Content-Type", "application/json")
+	hc := &http.Client{
+		Timeout: 5 * time.Minute,
+		Transport: &http.Transport{
+			Proxy:           http.ProxyFromEnvironment,
+			TLSClientConfig: &tls.Config{InsecureSkipVerify: envOpts.ignorecert},
+		},
+	}
+	log.Printf("requesting plan for %v@%v", ri.GitHubRepoName, ri.HeadBranch)
+	resp, err := hc.Do(req)
+	if err != nil {
+		clierr("error performing request: %v", err)
+	}
+	defer resp.Body.Close()
+	rb, _ := ioutil.ReadAll(resp.Body)
+	if resp.StatusCode != http.StatusOK {
+		clierr("plan failed: %v: %v", resp.Status, strings.TrimSpace(string(rb)))
+	}
+	plan := &models.EnvironmentPlan{}
+	if err := json.Unmarshal(rb, plan); err != nil {
+		clierr("error unmarshaling response: %v", err)
+	}
+	return plan
+}
+
+// displayPlan writes a human-readable plan to w
+func displayPlan(w io.Writer, plan *models.EnvironmentPlan) {
+	switch {
+	case plan.EnvName == "":
+		fmt.Fprintf(w, "Operation: %v\n", plan.Operation)
+	case plan.ConfigSignatureChanged:
+		fmt.Fprintf(w, "Operation: %v (environment: %v, configuration changed)\n", plan.Operation, plan.EnvName)
+	default:
+		fmt.Fprintf(w, "Operation: %v (environment: %v)\n", plan.Operation, plan.EnvName)
+	}
+	fmt.Fprintf(w, "\nRefs:\n")
+	repos := make([]string, 0, len(plan.RefMap))
+	for repo := range plan.RefMap {
+		repos = append(repos, repo)
+	}
+	sort.Strings(repos)
+	for _, repo := range repos {
+		fmt.Fprintf(w, "  %v: %v (%v)\n", repo, plan.RefMap[repo], plan.CommitSHAMap[repo])
+	}
+	if len(plan.RefChanges) > 0 {
+		fmt.Fprintf(w, "\nRef changes:\n")
+		for _, rc := range plan.RefChanges {
+			fmt.Fprintf(w, "  %v: %v (%v) => %v (%v)\n", rc.Repo, planValue(rc.CurrentRef), planValue(rc.CurrentSHA), planValue(rc.Ref), planValue(rc.SHA))
+		}
+	}
+	fmt.Fprintf(w, "\nInstall order:\n")
+	for i, stage := range plan.InstallOrder {
+		fmt.Fprintf(w, "  %v: %v\n", i+1, strings.Join(stage, ", "))
+	}
+	if len(plan.RemovedReleases) > 0 {
+		fmt.Fprintf(w, "\nReleases deleted: %v\n", strings.Join(plan.RemovedReleases, ", "))
+	}
+	for _, c := range plan.Charts {
+		fmt.Fprintf(w, "\nChart: %v\n", c.Name)
+		if c.Repo != "" {
+			fmt.Fprintf(w, "  Repo: %v\n", c.Repo)
+		}
+		if c.Release != "" {
+			fmt.Fprintf(w, "  Action: %v (release: %v)\n", c.Action, c.Release)
+		} else {
+			fmt.Fprintf(w, "  Action: %v\n", c.Action)
+		}
+		if c.Changed && c.CurrentRevisionSHA != "" {
+			fmt.Fprintf(w, "  Revision: %v => %v\n", c.CurrentRevisionSHA, c.RevisionSHA)
+		} else {
+			fmt.Fprintf(w, "  Revision: %v\n", c.RevisionSHA)
+		}
+		if len(c.Requires) > 0 {
+			fmt.Fprintf(w, "  Requires: %v\n", strings.Join(c.Requires, ", "))
+		}
+		fmt.Fprintf(w, "  Values:\n")
+		for _, l := range strings.Split(strings.TrimRight(c.Values, "\n"), "\n") {
+			fmt.Fprintf(w, "    %v\n", l)
+		}
+	}
+}
+
+func planValue(v string) string {
+	if v == "" {
+		return "<none>"
+	}
+	return v
+}
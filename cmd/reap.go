@@ -0,0 +1,60 @@
+package cmd
+
+import (
+	"fmt"
+	"net/http"
+	"os"
+	"text/tabwriter"
+
+	"github.com/dollarshaveclub/acyl/pkg/models"
+	"github.com/spf13/cobra"
+)
+
+// reapCmd represents the reap command
+var reapCmd = &cobra.Command{
+	Use:   "reap",
+	Short: "show what the reaper would destroy and prune",
+	Long: `reap is an admin client tool for the reaper, which is run periodically by the elected leader among the acyl server
+replicas. With --dry-run, it prints the environments the reaper would destroy and the destroyed environment records it
+would prune if it ran now, and why, according to the reaper policies of the server and acyl.yml, without changing anything.
+The API key (--api-key or ACYL_API_KEY) must have admin permission.`,
+	Args: cobra.NoArgs,
+	Run:  reapRun,
+}
+
+var reapOpts struct {
+	dryRun bool
+}
+
+func init() {
+	reapCmd.Flags().StringVar(&envOpts.host, "acyl-host", os.Getenv("ACYL_HOST"), "Acyl hostname:port")
+	reapCmd.Flags().StringVar(&envOpts.apiKey, "api-key", os.Getenv("ACYL_API_KEY"), "Acyl admin API key")
+	reapCmd.Flags().BoolVar(&envOpts.ignorecert, "ignore-cert", false, "Ignore TLS certificate validity (INSECURE)")
+	reapCmd.Flags().BoolVar(&envOpts.disableHTTPS, "disable-https", false, "Use HTTP instead of HTTPS to connect to the acyl server")
+	reapCmd.Flags().BoolVar(&reapOpts.dryRun, "dry-run", false, "Print what would be destroyed and pruned, and why")
+	RootCmd.AddCommand(reapCmd)
+}
+
+func reapRun(cmd *cobra.Command, args []string) {
+	if !reapOpts.dryRun {
+		clierr("the reaper is run periodically by the acyl server, only --dry-run is supported")
+	}
+	actions := []models.ReapAction{}
+	adminAPIRequest("GET", "/v2/reap/dry-run", nil, &actions, map[int]string{
+		http.StatusNotImplemented: "the reaper is disabled in the acyl server",
+	})
+	if len(actions) == 0 {
+		fmt.Println("nothing would be destroyed or pruned")
+		return
+	}
+	tw := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "ACTION\tENV\tREPO\tPR\tSTATUS\tREASON\tDETAIL")
+	for _, ra := range actions {
+		reason := ra.Reason
+		if reason == "" {
+			reason = "-"
+		}
+		fmt.Fprintf(tw, "%v\t%v\t%v\t%v\t%v\t%v\t%v\n", ra.Action, ra.EnvName, ra.Repo, ra.PullRequest, ra.Status, reason, ra.Detail)
+	}
+	tw.Flush()
+}
@@ -46,6 +46,7 @@ func init() {
 	RootCmd.PersistentFlags().StringVar(&k8sClientConfig.JWTPath, "k8s-jwt-path", "/var/run/secrets/kubernetes.io/serviceaccount/token", "Path to the JWT used to authenticate the k8s client to the API server")
 	RootCmd.PersistentFlags().StringVar(&helmClientConfig.HelmDriver, "helm-driver", os.Getenv("HELM_DRIVER"), "Sets helm driver (default: secrets)")
 	RootCmd.PersistentFlags().StringVar(&helmClientConfig.KubeContext, "kubectx", "", "Sets kubernetes context (overrides current context)")
+	RootCmd.PersistentFlags().StringVar(&helmClientConfig.PostRenderDefaultsJSON, "helm-post-render-defaults-json", "", "JSON-encoded post-render transforms applied to every chart release (same format as acyl.yml post_render, which may only add to or tighten them)")
 }
 
 func clierr(msg string, params ...interface{}) {
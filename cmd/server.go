@@ -4,21 +4,22 @@ package cmd
 
 import (
 	"context"
-	"crypto/rand"
 	"crypto/tls"
 	"encoding/json"
 	"fmt"
+	"io/ioutil"
 	"log"
-	"math/big"
 	"net/http"
 	"os"
 	"os/signal"
+	"strconv"
 	"strings"
 	"syscall"
 	"time"
 
 	"github.com/dollarshaveclub/acyl/pkg/api"
 	"github.com/dollarshaveclub/acyl/pkg/config"
+	"github.com/dollarshaveclub/acyl/pkg/ghapp"
 	"github.com/dollarshaveclub/acyl/pkg/ghclient"
 	"github.com/dollarshaveclub/acyl/pkg/ghevent"
 	"github.com/dollarshaveclub/acyl/pkg/locker"
@@ -27,10 +28,12 @@ import (
 	"github.com/dollarshaveclub/acyl/pkg/namegen"
 	nitroenv "github.com/dollarshaveclub/acyl/pkg/nitro/env"
 	"github.com/dollarshaveclub/acyl/pkg/nitro/images"
+	"github.com/dollarshaveclub/acyl/pkg/nitro/leader"
 	"github.com/dollarshaveclub/acyl/pkg/nitro/meta"
 	"github.com/dollarshaveclub/acyl/pkg/nitro/metahelm"
 	nitrometrics "github.com/dollarshaveclub/acyl/pkg/nitro/metrics"
 	"github.com/dollarshaveclub/acyl/pkg/nitro/notifier"
+	"github.com/dollarshaveclub/acyl/pkg/nitro/worker"
 	"github.com/dollarshaveclub/acyl/pkg/persistence"
 	"github.com/dollarshaveclub/acyl/pkg/reap"
 	"github.com/dollarshaveclub/acyl/pkg/slacknotifier"
@@ -52,6 +55,7 @@ var logger *log.Logger
 var dogstatsdAddr, dogstatsdTags string
 var datadogServiceName, datadogTracingAgentAddr string
 var reaperLockKey int64
+var debounceWindowsStrs []string
 
 // serverCmd represents the server command
 var serverCmd = &cobra.Command{
@@ -69,40 +73,78 @@ func init() {
 	serverCmd.PersistentFlags().UintVar(&serverConfig.HTTPSPort, "https-port", 4000, "REST HTTP(S) TCP port")
 	serverCmd.PersistentFlags().StringVar(&serverConfig.HTTPSAddr, "https-addr", "0.0.0.0", "REST HTTP(S) listen address")
 	serverCmd.PersistentFlags().BoolVar(&serverConfig.DisableTLS, "disable-tls", false, "Disable TLS for the REST HTTP(S) server")
-	serverCmd.PersistentFlags().StringVar(&githubConfig.TypePath, "repo-type-path", "acyl.yml", "Relative path within the target repo to look for the type definition")
-	serverCmd.PersistentFlags().StringVar(&serverConfig.WordnetPath, "wordnet-path", "/opt/words.json.gz", "Path to gzip-compressed JSON wordnet file")
-	serverCmd.PersistentFlags().StringSliceVar(&serverConfig.FuranAddrs, "furan-addrs", []string{}, "Furan hosts")
-	serverCmd.PersistentFlags().BoolVar(&serverConfig.EnableFuran2, "use-furan2", false, "Enable Furan 2 image builder")
-	serverCmd.PersistentFlags().BoolVar(&serverConfig.Furan2SkipVerifyTLS, "furan2-disable-tls-verification", false, "Disable Furan 2 TLS verification (FOR TESTING PURPOSES ONLY)")
-	serverCmd.PersistentFlags().StringVar(&serverConfig.Furan2Addr, "furan2-addr", "", "Furan2 host:port")
-	serverCmd.PersistentFlags().StringVar(&slackConfig.Channel, "slack-channel", "dyn-qa-notifications", "Slack channel for notifications")
-	serverCmd.PersistentFlags().StringVar(&slackConfig.Username, "slack-username", "Acyl Environment Notifier", "Slack username for notifications")
-	serverCmd.PersistentFlags().StringVar(&slackConfig.IconURL, "slack-icon-url", "https://picsum.photos/48/48", "Slack user avatar icon for notifications")
-	serverCmd.PersistentFlags().StringVar(&slackConfig.MapperRepo, "slack-mapper-repo", "dollarshaveclub/dqa-dev-tools", "Github repo containing github -> slack username map")
-	serverCmd.PersistentFlags().StringVar(&slackConfig.MapperRepoRef, "slack-mapper-repo-ref", "master", "Ref for username map Github repo")
-	serverCmd.PersistentFlags().StringVar(&slackConfig.MapperMapPath, "slack-mapper-map-path", "lib/user_map.json", "Path to username map JSON within the Github repo")
-	serverCmd.PersistentFlags().UintVar(&slackConfig.MapperUpdateIntervalSeconds, "slack-mapper-update-interval-seconds", 60, "Username map update interval")
 	serverCmd.PersistentFlags().UintVar(&serverConfig.ReaperIntervalSecs, "cleanup-interval", 600, "Approximate interval between cleanup runs in seconds (set to 0 to disable)")
 	serverCmd.PersistentFlags().UintVar(&serverConfig.EventRateLimitPerSecond, "event-rate-limit", 25, "Event rate limit in events per second (any in excess will be dropped)")
-	serverCmd.PersistentFlags().UintVar(&serverConfig.GlobalEnvironmentLimit, "global-environment-limit", 0, "Maximum number of running environments (set to zero for no limit)")
+	serverCmd.PersistentFlags().DurationVar(&serverConfig.EnvironmentTTLWarning, "environment-ttl-warning", 24*time.Hour, "Send an expiration warning notification this long before an environment expires")
+	serverCmd.PersistentFlags().DurationVar(&serverConfig.HibernationIdleDuration, "hibernation-idle-duration", 0, "Hibernate (scale to zero) environments with no activity for this long (ex: 12h, set to zero to disable)")
+	serverCmd.PersistentFlags().StringVar(&serverConfig.HibernationWindow, "hibernation-window", "", "Daily off-hours window during which environments are hibernated in HH:MM-HH:MM format, may span midnight (ex: 20:00-07:00, empty to disable)")
+	serverCmd.PersistentFlags().BoolVar(&serverConfig.HibernationWeekends, "hibernation-weekends", false, "Hibernate environments on Saturdays and Sundays")
+	serverCmd.PersistentFlags().StringVar(&serverConfig.HibernationTimezone, "hibernation-timezone", "UTC", "Time zone for the hibernation window and weekends (ex: America/Los_Angeles)")
 	serverCmd.PersistentFlags().StringVar(&serverConfig.HostnameTemplate, "hostname-template", "{{ .Name }}.qa.shave.io", "Environment hostname")
 	serverCmd.PersistentFlags().BoolVar(&serverConfig.DebugEndpoints, "debug-endpoints", false, "Enable debugging HTTP endpoints (pprof)")
 	serverCmd.PersistentFlags().StringArrayVar(&serverConfig.DebugEndpointsIPWhitelists, "debug-endpoints-ip-whitelists", []string{"10.10.0.0/16", "127.0.0.1/32"}, "IP CIDR ranges to allow access to debug endpoints")
-	serverCmd.PersistentFlags().StringVar(&serverConfig.NotificationsDefaultsJSON, "nitro-notifications-defaults-json", "{}", "JSON-encoded notifications defaults for Nitro")
-	serverCmd.PersistentFlags().StringVar(&k8sGroupBindingsStr, "k8s-group-bindings", "", "optional k8s RBAC group bindings (comma-separated) for new environment namespaces in GROUP1=CLUSTER_ROLE1,GROUP2=CLUSTER_ROLE2 format (ex: users=edit) (Nitro)")
-	serverCmd.PersistentFlags().StringVar(&k8sSecretsStr, "k8s-secret-injections", "", "optional k8s secret injections (comma-separated) for new environment namespaces in SECRET_NAME=VAULT_ID (Vault path using secrets mapping) format. Secret value in Vault must be a JSON-encoded object with two keys: 'data' (map of string to base64-encoded bytes), 'type' (string). (Nitro)")
-	serverCmd.PersistentFlags().StringVar(&k8sPrivilegedReposStr, "k8s-privileged-repo-whitelist", "dollarshaveclub/acyl", "optional comma-separated whitelist of GitHub repositories whose environment service accounts will be allowed cluster-admin privileges (Nitro)")
-	serverCmd.PersistentFlags().StringVarP(&dogstatsdAddr, "dogstatsd-addr", "q", "127.0.0.1:8125", "Address of dogstatsd for metrics (set to empty string to disable)")
-	serverCmd.PersistentFlags().StringVar(&dogstatsdTags, "dogstatsd-tags", "", "Comma-separated list of tags to add to dogstatsd metrics (TAG:VALUE)")
-	serverCmd.PersistentFlags().StringVar(&datadogTracingAgentAddr, "datadog-tracing-agent-addr", "127.0.0.1:8126", "Address of datadog tracing agent (set to empty string to disable)")
-	serverCmd.PersistentFlags().StringVar(&datadogServiceName, "datadog-service-name", "acyl", "Default service name to be used for Datadog APM")
-	serverCmd.PersistentFlags().DurationVar(&serverConfig.OperationTimeoutOverride, "operation-timeout-override", 0, "Override for operation timeout (ex: 10m)")
+	serverCmd.PersistentFlags().BoolVar(&serverConfig.DurableOperationQueue, "durable-queue", true, "Persist accepted webhook events and operations requested via the API to a queue in the database that is processed by workers, so that operations in progress are resumed after a crash or restart (if false, events are processed in memory and lost on crash)")
+	serverCmd.PersistentFlags().DurationVar(&serverConfig.DebounceWindow, "debounce-window", 0, "Delay updates triggered by pushes to a PR by up to this long, so that only the latest push within the window is deployed and the superseded pushes are marked as coalesced (ex: 30s, set to zero to disable) (only used with --durable-queue)")
+	serverCmd.PersistentFlags().StringSliceVar(&debounceWindowsStrs, "debounce-window-repo", []string{}, "Per-repo overrides of --debounce-window in <repo>=<duration> format (ex: acme/api=1m,acme/web=0s)")
+	serverCmd.PersistentFlags().BoolVar(&serverConfig.DisableWorker, "disable-worker", false, "Don't process queued operations in the server process, so that it only accepts webhooks and serves the API/UI while separate 'acyl worker' processes run the environment operations (only used with --durable-queue). Operations started by API requests are queued for the workers as well.")
 	serverCmd.PersistentFlags().Int64Var(&reaperLockKey, "reaper-lock-key", 0, "Lock key that the reaper process should attempt to obtain")
+	serverCmd.PersistentFlags().StringVar(&serverConfig.ReplicaID, "replica-id", "", "ID of this replica in leader election, which must be unique among replicas (defaults to <hostname>-<pid>)")
+	serverCmd.PersistentFlags().DurationVar(&serverConfig.LeaderLeaseDuration, "leader-lease-duration", 30*time.Second, "Duration of the lease held by the replica elected to run periodic maintenance (the reaper and data cleanup), renewed at a third of the duration. If the leader crashes, another replica takes over after the lease expires.")
+	serverCmd.PersistentFlags().DurationVar(&serverConfig.LeaderRetryPeriod, "leader-retry-period", 10*time.Second, "Interval between attempts to acquire the leader lease by replicas that aren't leader")
+	serverCmd.PersistentFlags().DurationVar(&serverConfig.DataCleanupInterval, "data-cleanup-interval", 0, "Interval between data cleanup runs (pruning of old DB records and orphaned k8s objects) by the leader replica (set to zero to disable and run 'acyl cleanup' as a cronjob instead)")
+	serverCmd.PersistentFlags().DurationVar(&k8sMaxage, "k8s-objs-max-age", 14*24*time.Hour, "Maximum age for orphaned k8s objects, including unused lock Leases (only used with --data-cleanup-interval)")
+	serverCmd.PersistentFlags().DurationVar(&destroyedenvsMaxage, "destroyed-envs-max-age", 30*24*time.Hour, "Maximum age for destroyed environment DB records (only used with --data-cleanup-interval)")
+	serverCmd.PersistentFlags().DurationVar(&eventlogsMaxage, "event-logs-max-age", 30*24*time.Hour, "Maximum age for event log DB records (only used with --data-cleanup-interval)")
+	addNitroFlags(serverCmd)
 
 	addUIFlags(serverCmd)
 	RootCmd.AddCommand(serverCmd)
 }
 
+// addNitroFlags adds the flags for the environment operation dependencies shared by the server and worker commands to cmd
+func addNitroFlags(cmd *cobra.Command) {
+	cmd.PersistentFlags().StringVar(&githubConfig.TypePath, "repo-type-path", "acyl.yml", "Relative path within the target repo to look for the type definition")
+	cmd.PersistentFlags().StringVar(&serverConfig.WordnetPath, "wordnet-path", "/opt/words.json.gz", "Path to gzip-compressed JSON wordnet file")
+	cmd.PersistentFlags().StringSliceVar(&serverConfig.FuranAddrs, "furan-addrs", []string{}, "Furan hosts")
+	cmd.PersistentFlags().BoolVar(&serverConfig.EnableFuran2, "use-furan2", false, "Enable Furan 2 image builder")
+	cmd.PersistentFlags().BoolVar(&serverConfig.Furan2SkipVerifyTLS, "furan2-disable-tls-verification", false, "Disable Furan 2 TLS verification (FOR TESTING PURPOSES ONLY)")
+	cmd.PersistentFlags().StringVar(&serverConfig.Furan2Addr, "furan2-addr", "", "Furan2 host:port")
+	cmd.PersistentFlags().StringVar(&slackConfig.Channel, "slack-channel", "dyn-qa-notifications", "Slack channel for notifications")
+	cmd.PersistentFlags().StringVar(&slackConfig.Username, "slack-username", "Acyl Environment Notifier", "Slack username for notifications")
+	cmd.PersistentFlags().StringVar(&slackConfig.IconURL, "slack-icon-url", "https://picsum.photos/48/48", "Slack user avatar icon for notifications")
+	cmd.PersistentFlags().StringVar(&slackConfig.MapperRepo, "slack-mapper-repo", "dollarshaveclub/dqa-dev-tools", "Github repo containing github -> slack username map")
+	cmd.PersistentFlags().StringVar(&slackConfig.MapperRepoRef, "slack-mapper-repo-ref", "master", "Ref for username map Github repo")
+	cmd.PersistentFlags().StringVar(&slackConfig.MapperMapPath, "slack-mapper-map-path", "lib/user_map.json", "Path to username map JSON within the Github repo")
+	cmd.PersistentFlags().UintVar(&slackConfig.MapperUpdateIntervalSeconds, "slack-mapper-update-interval-seconds", 60, "Username map update interval")
+	cmd.PersistentFlags().UintVar(&serverConfig.GlobalEnvironmentLimit, "global-environment-limit", 0, "Maximum number of running environments (set to zero for no limit)")
+	cmd.PersistentFlags().StringVar(&serverConfig.GlobalLimitPolicy, "global-limit-policy", "evict", "What happens to new environments when the global environment limit is reached: 'evict' (destroy the oldest environments) or 'queue' (wait in a prioritized queue until capacity is available)")
+	cmd.PersistentFlags().StringSliceVar(&serverConfig.QueuePriorities, "queue-priority", []string{}, "Create queue priority rules in <repo|label|user>:<value>=<priority> format, higher priorities are created first and the highest matching rule wins (ex: label:urgent=10,repo:acme/api=5) (only used with --global-limit-policy=queue)")
+	cmd.PersistentFlags().DurationVar(&serverConfig.EnvironmentTTL, "environment-ttl", 0, "Default environment lifetime after creation, after which it is destroyed (ex: 72h, set to zero for no expiration). May be overridden by ttl in acyl.yml.")
+	cmd.PersistentFlags().DurationVar(&serverConfig.ManualEnvironmentTTL, "manual-environment-ttl", 72*time.Hour, "Lifetime of manual (non-PR) environments created via the API if neither the request nor acyl.yml set ttl (set to zero to use --environment-ttl)")
+	cmd.PersistentFlags().UintVar(&serverConfig.MaxPinnedPerRepo, "max-pinned-per-repo", 2, "Maximum number of pinned environments (protected from global limit enforcement and age-based reaping) per repo (set to zero for no limit)")
+	cmd.PersistentFlags().StringVar(&serverConfig.QuotasJSON, "quotas-json", "{}", `JSON-encoded environment quotas by repo, GitHub org, GitHub team ("org/team-slug") and GitHub user (ex: {"repos": {"acme/api": {"max_running": 5, "max_building": 2}}, "orgs": {...}, "teams": {"acme/backend": {...}}, "users": {...}}). Creates over quota fail, or are queued with --global-limit-policy=queue. Updates that would exceed max_building fail. Team quotas require the GitHub token or app to have read access to org members.`)
+	cmd.PersistentFlags().StringVar(&serverConfig.ReaperPoliciesJSON, "reaper-policies-json", "{}", `JSON-encoded reaper policies: the default and per-repo max_age, max_failure (time in Failure), max_building (time in Spawned or Updating) and prune_delay (time destroyed records are kept), and the min/max bounds for overrides in acyl.yml (ex: {"default": {"max_age": "336h"}, "repos": {"acme/api": {"max_failure": "4h"}}, "min": {"max_failure": "30m"}, "max": {"max_age": "720h"}})`)
+	cmd.PersistentFlags().StringVar(&serverConfig.NotificationsDefaultsJSON, "nitro-notifications-defaults-json", "{}", "JSON-encoded notifications defaults for Nitro")
+	cmd.PersistentFlags().StringVar(&k8sGroupBindingsStr, "k8s-group-bindings", "", "optional k8s RBAC group bindings (comma-separated) for new environment namespaces in GROUP1=CLUSTER_ROLE1,GROUP2=CLUSTER_ROLE2 format (ex: users=edit) (Nitro)")
+	cmd.PersistentFlags().StringVar(&k8sSecretsStr, "k8s-secret-injections", "", "optional k8s secret injections (comma-separated) for new environment namespaces in SECRET_NAME=VAULT_ID (Vault path using secrets mapping) format. Secret value in Vault must be a JSON-encoded object with two keys: 'data' (map of string to base64-encoded bytes), 'type' (string). (Nitro)")
+	cmd.PersistentFlags().StringVar(&k8sPrivilegedReposStr, "k8s-privileged-repo-whitelist", "dollarshaveclub/acyl", "optional comma-separated whitelist of GitHub repositories whose environment service accounts will be allowed cluster-admin privileges (Nitro)")
+	cmd.PersistentFlags().StringVarP(&dogstatsdAddr, "dogstatsd-addr", "q", "127.0.0.1:8125", "Address of dogstatsd for metrics (set to empty string to disable)")
+	cmd.PersistentFlags().StringVar(&dogstatsdTags, "dogstatsd-tags", "", "Comma-separated list of tags to add to dogstatsd metrics (TAG:VALUE)")
+	cmd.PersistentFlags().StringVar(&datadogTracingAgentAddr, "datadog-tracing-agent-addr", "127.0.0.1:8126", "Address of datadog tracing agent (set to empty string to disable)")
+	cmd.PersistentFlags().StringVar(&datadogServiceName, "datadog-service-name", "acyl", "Default service name to be used for Datadog APM")
+	cmd.PersistentFlags().DurationVar(&serverConfig.OperationTimeoutOverride, "operation-timeout-override", 0, "Override for operation timeout (ex: 10m)")
+	cmd.PersistentFlags().UintVar(&serverConfig.RetryMaxAttempts, "retry-max-attempts", 3, "Maximum number of attempts of environment creates and updates that fail with system errors such as API server timeouts, registry errors or GitHub rate limits, including the first (set to 1 to disable retries). User errors are never retried.")
+	cmd.PersistentFlags().DurationVar(&serverConfig.RetryBackoff, "retry-backoff", 30*time.Second, "Delay before the first automatic retry of a failed create or update, doubled for each subsequent retry")
+	cmd.PersistentFlags().DurationVar(&serverConfig.RetryMaxBackoff, "retry-max-backoff", 5*time.Minute, "Maximum delay between automatic retries of a failed create or update (set to zero for no maximum)")
+	cmd.PersistentFlags().UintVar(&serverConfig.WorkerConcurrency, "worker-concurrency", 10, "Maximum number of queued operations processed simultaneously by this process (only used with --durable-queue)")
+	cmd.PersistentFlags().DurationVar(&serverConfig.WorkerLeaseDuration, "worker-lease-duration", 2*time.Minute, "Lease duration of queued operations, which is renewed while an operation runs. Operations of a crashed process are resumed after the lease expires.")
+	cmd.PersistentFlags().UintVar(&serverConfig.WorkerMaxAttempts, "worker-max-attempts", 3, "Maximum number of attempts of a queued operation that fails with a system error or is interrupted by a crash, after which it is dead-lettered. Creates and updates that already failed after --retry-max-attempts attempts are dead-lettered without being retried by the worker.")
+	cmd.PersistentFlags().DurationVar(&serverConfig.WorkerRetryBackoff, "worker-retry-backoff", time.Minute, "Delay before the first retry of a failed queued operation, doubled for each subsequent retry")
+	cmd.PersistentFlags().StringVar(&serverConfig.LockProvider, "lock-provider", "postgres", "Backend of the locks that serialize operations on each environment: 'postgres' (advisory locks, requires session pooling if connecting through a pooler) or 'kubernetes' (coordination.k8s.io Leases, requires RBAC permissions for leases in --lock-namespace)")
+	cmd.PersistentFlags().StringVar(&serverConfig.LockNamespace, "lock-namespace", "", "Namespace of the Leases used for environment locks (only used with --lock-provider=kubernetes, defaults to the namespace of the pod)")
+	cmd.PersistentFlags().DurationVar(&serverConfig.LockLeaseDuration, "lock-lease-duration", 15*time.Second, "Duration of the Lease held for an environment lock, which is renewed by the holder. Locks of a crashed process are released after the Lease expires. (only used with --lock-provider=kubernetes)")
+}
+
 func setupServerLogger() {
 	logger = log.New(os.Stderr, "", log.LstdFlags)
 }
@@ -127,15 +169,7 @@ func startDatadogTracer() {
 func server(cmd *cobra.Command, args []string) {
 	var err error
 
-	var mc metrics.Collector
-	if dogstatsdAddr == "" {
-		mc = &metrics.FakeCollector{}
-	} else {
-		mc, err = metrics.NewDatadogCollector(dogstatsdAddr, logger)
-		if err != nil {
-			log.Fatalf("instantiating datadog: %v", err)
-		}
-	}
+	mc, nmc := newMetricsCollectors()
 
 	if datadogTracingAgentAddr != "" {
 		pgConfig.DatadogServiceName = datadogServiceName + ".postgres"
@@ -148,24 +182,181 @@ func server(cmd *cobra.Command, args []string) {
 	}
 	defer dl.Close()
 
+	if err := serverConfig.ProcessDebounceWindows(debounceWindowsStrs); err != nil {
+		log.Fatalf("error in debounce windows: %v", err)
+	}
+
 	rc := ghclient.NewGitHubClient(githubConfig.Token)
-	ng, err := namegen.NewWordnetNameGenerator(serverConfig.WordnetPath, logger)
-	if err != nil {
-		log.Fatalf("error opening wordnet file: %v", err)
+	nitromgr, ci, lp := newNitroManager(dl, rc, mc, nmc)
+	ge := ghevent.NewGitHubEventWebhook(rc, githubConfig.HookSecret, githubConfig.TypePath, dl)
+
+	var reaper *reap.Reaper
+	if serverConfig.ReaperIntervalSecs > 0 {
+		hp := reap.HibernationPolicy{
+			IdleDuration: serverConfig.HibernationIdleDuration,
+			OffHours:     serverConfig.HibernationWindow,
+			Weekends:     serverConfig.HibernationWeekends,
+		}
+		hp.Location, err = time.LoadLocation(serverConfig.HibernationTimezone)
+		if err != nil {
+			log.Fatalf("error loading hibernation timezone: %v", err)
+		}
+		if err := hp.Validate(); err != nil {
+			log.Fatalf("invalid hibernation policy: %v", err)
+		}
+		reaperLimit := serverConfig.GlobalEnvironmentLimit
+		if nitromgr.GlobalLimitPolicy == nitroenv.QueuePolicy {
+			// creates wait for capacity rather than evicting, so the reaper only needs to start queued creates
+			reaperLimit = 0
+		}
+		reaper = reap.NewReaper(lp, dl, nitromgr, rc, mc, reaperLimit, serverConfig.EnvironmentTTLWarning, hp, nitromgr.ReaperPolicies, logger, reaperLockKey)
+	} else {
+		log.Printf("reaper disabled")
+	}
+	electorCtx, stopElector := context.WithCancel(context.Background())
+	defer stopElector()
+	electorDone := make(chan struct{})
+	var elector *leader.Elector
+	if reaper != nil || serverConfig.DataCleanupInterval > 0 {
+		elector, err = newMaintenanceElector(dl, nmc, reaper, ci, lp)
+		if err != nil {
+			log.Fatalf("error creating leader elector: %v", err)
+		}
+		go func() {
+			elector.Run(electorCtx)
+			close(electorDone)
+		}()
+	} else {
+		close(electorDone)
+	}
+	workerCtx, stopWorker := context.WithCancel(context.Background())
+	defer stopWorker()
+	workerDone := make(chan struct{})
+	if serverConfig.DurableOperationQueue && !serverConfig.DisableWorker {
+		w, err := newWorker(dl, nitromgr, nmc)
+		if err != nil {
+			log.Fatalf("error creating worker: %v", err)
+		}
+		go func() {
+			w.Run(workerCtx)
+			close(workerDone)
+		}()
+	} else {
+		if serverConfig.DurableOperationQueue {
+			log.Printf("worker disabled, queued operations must be processed by acyl worker processes")
+		}
+		close(workerDone)
 	}
 
-	lp, err := locker.NewLockProvider(locker.PostgresLockProviderKind, locker.WithPostgresBackend(pgConfig.PostgresURI, datadogServiceName+".postgres_locker"))
-	if err != nil {
-		log.Fatalf("error creating Postgres lock provider: %v", err)
+	stop := make(chan os.Signal, 1)
+	signal.Notify(stop, syscall.SIGTERM) //non-portable outside of POSIX systems
+	signal.Notify(stop, os.Interrupt)
+
+	var tlsconfig *tls.Config
+	if !serverConfig.DisableTLS {
+		tlsconfig = &tls.Config{
+			MinVersion:   tls.VersionTLS10,
+			Certificates: []tls.Certificate{serverConfig.TLSCert},
+			NextProtos:   []string{"http/1.1"},
+		}
 	}
+	addr := fmt.Sprintf("%v:%v", serverConfig.HTTPSAddr, serverConfig.HTTPSPort)
+	server := &http.Server{Addr: addr, TLSConfig: tlsconfig}
 
-	plf, err := locker.NewPreemptiveLockerFactory(lp, locker.WithAPMServiceName(datadogServiceName+".postgres_locker"))
-	if err != nil {
-		log.Fatalf("error creating preemptive locker factory: %v", err)
+	var branding config.UIBrandingConfig
+	if err := json.Unmarshal([]byte(serverConfig.UIBrandingJSON), &branding); err != nil {
+		log.Fatalf("error unmarshaling branding config: %v", err)
 	}
 
-	slackapi := slack.New(slackConfig.Token)
-	mapper := slacknotifier.NewRepoBackedSlackUsernameMapper(rc, slackConfig.MapperRepo, slackConfig.MapperMapPath, slackConfig.MapperRepoRef, time.Duration(slackConfig.MapperUpdateIntervalSeconds)*time.Second)
+	httpapi := api.NewDispatcher(server)
+	apiServiceName := strings.Join([]string{datadogServiceName, "http"}, ".")
+	deps := &api.Dependencies{
+		DataLayer:          dl,
+		GitHubEventWebhook: ge,
+		EnvironmentSpawner: nitromgr,
+		RepoClient:         rc,
+		ServerConfig:       serverConfig,
+		Logger:             logger,
+		DatadogServiceName: apiServiceName,
+		KubernetesReporter: ci,
+	}
+	if li, ok := lp.(locker.LockInspector); ok {
+		deps.LockInspector = li
+	}
+	if elector != nil {
+		deps.LeaderElector = elector
+	}
+	if reaper != nil {
+		deps.ReapPlanner = reaper
+	}
+	regops := []api.RegisterOption{
+		api.WithAPIKeys(serverConfig.APIKeys),
+		api.WithUIBaseURL(serverConfig.UIBaseURL),
+		api.WithUIAssetsPath(serverConfig.UIPath),
+		api.WithUIRoutePrefix(serverConfig.UIBaseRoute),
+		api.WithUIBranding(branding),
+		api.WithGitHubConfig(githubConfig),
+	}
+	if serverConfig.DebugEndpoints {
+		regops = append(regops,
+			api.WithDebugEndpoints(),
+			api.WithIPWhitelist(serverConfig.DebugEndpointsIPWhitelists),
+		)
+	}
+	if !githubConfig.OAuth.Enforce {
+		regops = append(regops, api.WithUIDummySessionUser(mockUser))
+	}
+
+	if err := httpapi.RegisterVersions(deps, regops...); err != nil {
+		log.Fatalf("error registering api versions: %v", err)
+	}
+	go func() {
+		for _ = range stop {
+			ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+			server.Shutdown(ctx)
+			cancel()
+		}
+	}()
+	defer httpapi.Stop()
+
+	stype := "HTTPS"
+	if serverConfig.DisableTLS {
+		stype = "HTTP"
+	}
+
+	startDatadogTracer()
+	defer tracer.Stop()
+	logger.Printf("%v REST listening on: %v", stype, addr)
+	if serverConfig.DisableTLS {
+		logger.Println(server.ListenAndServe())
+	} else {
+		logger.Println(server.ListenAndServeTLS("", ""))
+	}
+	logger.Printf("waiting for handlers to finish...")
+	httpapi.WaitForHandlers()
+	logger.Printf("waiting for async goroutines to finish...")
+	httpapi.WaitForAsync()
+	logger.Printf("waiting for queued operations in progress to finish...")
+	stopWorker()
+	<-workerDone
+	logger.Printf("waiting for maintenance to finish and releasing leadership...")
+	stopElector()
+	<-electorDone
+	logger.Printf("done, terminating")
+}
+
+// newMetricsCollectors returns the metrics collectors configured by the dogstatsd flags
+func newMetricsCollectors() (metrics.Collector, nitrometrics.Collector) {
+	var err error
+	var mc metrics.Collector
+	if dogstatsdAddr == "" {
+		mc = &metrics.FakeCollector{}
+	} else {
+		mc, err = metrics.NewDatadogCollector(dogstatsdAddr, logger)
+		if err != nil {
+			log.Fatalf("instantiating datadog: %v", err)
+		}
+	}
 
 	var nmc nitrometrics.Collector
 	if dogstatsdAddr == "" {
@@ -176,6 +367,60 @@ func server(cmd *cobra.Command, args []string) {
 			log.Fatalf("error setting up nitro metrics collector: %v", err)
 		}
 	}
+	return mc, nmc
+}
+
+// serviceAccountNamespacePath is the path of the file containing the namespace of the pod
+const serviceAccountNamespacePath = "/var/run/secrets/kubernetes.io/serviceaccount/namespace"
+
+// newLockProvider returns the lock provider configured by the flags and its APM service name
+func newLockProvider() (locker.LockProvider, string) {
+	switch serverConfig.LockProvider {
+	case "postgres":
+		lp, err := locker.NewLockProvider(locker.PostgresLockProviderKind, locker.WithPostgresBackend(pgConfig.PostgresURI, datadogServiceName+".postgres_locker"))
+		if err != nil {
+			log.Fatalf("error creating Postgres lock provider: %v", err)
+		}
+		return lp, datadogServiceName + ".postgres_locker"
+	case "kubernetes":
+		ns := serverConfig.LockNamespace
+		if ns == "" {
+			b, err := ioutil.ReadFile(serviceAccountNamespacePath)
+			if err != nil {
+				log.Fatalf("lock namespace is required if not running in a pod: %v", err)
+			}
+			ns = strings.TrimSpace(string(b))
+		}
+		kc, _, err := metahelm.NewInClusterK8sClientset(k8sClientConfig.JWTPath, true)
+		if err != nil {
+			log.Fatalf("error getting k8s client for lock provider: %v", err)
+		}
+		lp, err := locker.NewLockProvider(locker.KubernetesLockProviderKind, locker.WithKubernetesBackend(kc, ns), locker.WithLeaseDuration(serverConfig.LockLeaseDuration))
+		if err != nil {
+			log.Fatalf("error creating Kubernetes lock provider: %v", err)
+		}
+		return lp, datadogServiceName + ".kubernetes_locker"
+	default:
+		log.Fatalf("unknown lock provider: %v", serverConfig.LockProvider)
+	}
+	return nil, ""
+}
+
+// newNitroManager returns the environment manager and its chart installer and lock provider configured by the flags
+func newNitroManager(dl *persistence.PGLayer, rc *ghclient.GitHubClient, mc metrics.Collector, nmc nitrometrics.Collector) (*nitroenv.Manager, *metahelm.ChartInstaller, locker.LockProvider) {
+	ng, err := namegen.NewWordnetNameGenerator(serverConfig.WordnetPath, logger)
+	if err != nil {
+		log.Fatalf("error opening wordnet file: %v", err)
+	}
+
+	lp, apmServiceName := newLockProvider()
+	plf, err := locker.NewPreemptiveLockerFactory(lp, locker.WithAPMServiceName(apmServiceName))
+	if err != nil {
+		log.Fatalf("error creating preemptive locker factory: %v", err)
+	}
+
+	slackapi := slack.New(slackConfig.Token)
+	mapper := slacknotifier.NewRepoBackedSlackUsernameMapper(rc, slackConfig.MapperRepo, slackConfig.MapperMapPath, slackConfig.MapperRepoRef, time.Duration(slackConfig.MapperUpdateIntervalSeconds)*time.Second)
 
 	// Furan vs Furan 2
 	var ibb images.BuilderBackend
@@ -234,6 +479,22 @@ func server(cmd *cobra.Command, args []string) {
 	}
 	ncfg.FillMissingTemplates()
 	ncfg.Slack.Channels = &[]string{slackConfig.Channel}
+	glpolicy, err := nitroenv.GlobalLimitPolicyFromString(serverConfig.GlobalLimitPolicy)
+	if err != nil {
+		log.Fatalf("error in global limit policy: %v", err)
+	}
+	qprios, err := nitroenv.ParseQueuePriorities(serverConfig.QueuePriorities)
+	if err != nil {
+		log.Fatalf("error in queue priorities: %v", err)
+	}
+	quotas := models.Quotas{}
+	if err := json.Unmarshal([]byte(serverConfig.QuotasJSON), &quotas); err != nil {
+		log.Fatalf("error unmarshaling quotas: %v", err)
+	}
+	rpolicies, err := models.ParseReaperPolicies(serverConfig.ReaperPoliciesJSON)
+	if err != nil {
+		log.Fatalf("error in reaper policies: %v", err)
+	}
 	nitromgr := &nitroenv.Manager{
 		NF: func(lf func(string, ...interface{}), notifications models.Notifications, user string) notifier.Router {
 			if notifications.Slack.Channels == nil {
@@ -267,117 +528,125 @@ func server(cmd *cobra.Command, args []string) {
 		CI:                   ci,
 		PLF:                  plf,
 		GlobalLimit:          serverConfig.GlobalEnvironmentLimit,
-		UIBaseURL:            serverConfig.UIBaseURL,
+		GlobalLimitPolicy:    glpolicy,
+		QueuePriorities:      qprios,
+		DefaultTTL:           serverConfig.EnvironmentTTL,
+		ManualTTL:            serverConfig.ManualEnvironmentTTL,
+		MaxPinnedPerRepo:     serverConfig.MaxPinnedPerRepo,
+		Quotas:               quotas,
+		ReaperPolicies:       rpolicies,
+		RetryPolicy: nitroenv.RetryPolicy{
+			MaxAttempts: serverConfig.RetryMaxAttempts,
+			Backoff:     serverConfig.RetryBackoff,
+			MaxBackoff:  serverConfig.RetryMaxBackoff,
+		},
+		DurableQueue: serverConfig.DurableOperationQueue,
+		UIBaseURL:    serverConfig.UIBaseURL,
 	}
 	nitromgr.OperationTimeout = serverConfig.OperationTimeoutOverride // Zero means use default defined in pkg/nitro/env
-	ge := ghevent.NewGitHubEventWebhook(rc, githubConfig.HookSecret, githubConfig.TypePath, dl)
+	return nitromgr, ci, lp
+}
 
-	if serverConfig.ReaperIntervalSecs > 0 {
-		log.Printf("starting reaper: %v sec interval", serverConfig.ReaperIntervalSecs)
-		reaper := reap.NewReaper(lp, dl, nitromgr, rc, mc, serverConfig.GlobalEnvironmentLimit, logger, reaperLockKey)
-		ticker := time.NewTicker(time.Duration(serverConfig.ReaperIntervalSecs) * time.Second)
-		go func() {
-			var delta int64
-			for {
-				select {
-				case <-ticker.C:
-					delta, _ = randomRange(21)
-					time.Sleep(time.Duration(delta) * time.Second)
-					reaper.Reap()
-				}
-			}
-		}()
-	} else {
-		log.Printf("reaper disabled")
+// newWorker returns a worker that processes the durable operation queue with es
+func newWorker(dl persistence.DataLayer, es *nitroenv.Manager, mc nitrometrics.Collector) (*worker.Worker, error) {
+	ghcf, err := ghapp.NewClientFactory(githubConfig.PrivateKeyPEM, githubConfig.AppID)
+	if err != nil {
+		return nil, fmt.Errorf("error creating GitHub app client factory: %w", err)
 	}
-	stop := make(chan os.Signal, 1)
-	signal.Notify(stop, syscall.SIGTERM) //non-portable outside of POSIX systems
-	signal.Notify(stop, os.Interrupt)
-
-	var tlsconfig *tls.Config
-	if !serverConfig.DisableTLS {
-		tlsconfig = &tls.Config{
-			MinVersion:   tls.VersionTLS10,
-			Certificates: []tls.Certificate{serverConfig.TLSCert},
-			NextProtos:   []string{"http/1.1"},
-		}
+	id, err := processID()
+	if err != nil {
+		return nil, err
 	}
-	addr := fmt.Sprintf("%v:%v", serverConfig.HTTPSAddr, serverConfig.HTTPSPort)
-	server := &http.Server{Addr: addr, TLSConfig: tlsconfig}
+	return &worker.Worker{
+		DL:               dl,
+		ES:               es,
+		MC:               mc,
+		GHCF:             ghcf,
+		ID:               id,
+		Concurrency:      serverConfig.WorkerConcurrency,
+		LeaseDuration:    serverConfig.WorkerLeaseDuration,
+		MaxAttempts:      serverConfig.WorkerMaxAttempts,
+		RetryBackoff:     serverConfig.WorkerRetryBackoff,
+		OperationTimeout: api.MaxAsyncActionTimeout,
+		LogFunc:          logger.Printf,
+	}, nil
+}
 
-	var branding config.UIBrandingConfig
-	if err := json.Unmarshal([]byte(serverConfig.UIBrandingJSON), &branding); err != nil {
-		log.Fatalf("error unmarshaling branding config: %v", err)
+// processID returns an ID for this process that is unique among the server and worker processes
+func processID() (string, error) {
+	hostname, err := os.Hostname()
+	if err != nil {
+		return "", fmt.Errorf("error getting hostname: %w", err)
 	}
+	return hostname + "-" + strconv.Itoa(os.Getpid()), nil
+}
 
-	httpapi := api.NewDispatcher(server)
-	apiServiceName := strings.Join([]string{datadogServiceName, "http"}, ".")
-	deps := &api.Dependencies{
-		DataLayer:          dl,
-		GitHubEventWebhook: ge,
-		EnvironmentSpawner: nitromgr,
-		RepoClient:         rc,
-		ServerConfig:       serverConfig,
-		Logger:             logger,
-		DatadogServiceName: apiServiceName,
-		KubernetesReporter: ci,
-	}
-	regops := []api.RegisterOption{
-		api.WithAPIKeys(serverConfig.APIKeys),
-		api.WithUIBaseURL(serverConfig.UIBaseURL),
-		api.WithUIAssetsPath(serverConfig.UIPath),
-		api.WithUIRoutePrefix(serverConfig.UIBaseRoute),
-		api.WithUIBranding(branding),
-		api.WithGitHubConfig(githubConfig),
-	}
-	if serverConfig.DebugEndpoints {
-		regops = append(regops,
-			api.WithDebugEndpoints(),
-			api.WithIPWhitelist(serverConfig.DebugEndpointsIPWhitelists),
-		)
-	}
-	if !githubConfig.OAuth.Enforce {
-		regops = append(regops, api.WithUIDummySessionUser(mockUser))
-	}
+// maintenanceLeaseName is the name of the leader lease of the replica that runs periodic maintenance
+const maintenanceLeaseName = "maintenance"
 
-	if err := httpapi.RegisterVersions(deps, regops...); err != nil {
-		log.Fatalf("error registering api versions: %v", err)
-	}
-	go func() {
-		for _ = range stop {
-			ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
-			server.Shutdown(ctx)
-			cancel()
+// newMaintenanceElector returns a leader elector that runs the periodic maintenance (the reaper, if not nil, and data
+// cleanup, if enabled) on the replica that is elected leader
+func newMaintenanceElector(dl *persistence.PGLayer, mc nitrometrics.Collector, reaper *reap.Reaper, ci *metahelm.ChartInstaller, lp locker.LockProvider) (*leader.Elector, error) {
+	id := serverConfig.ReplicaID
+	if id == "" {
+		var err error
+		id, err = processID()
+		if err != nil {
+			return nil, err
 		}
-	}()
-	defer httpapi.Stop()
-
-	stype := "HTTPS"
-	if serverConfig.DisableTLS {
-		stype = "HTTP"
 	}
-
-	startDatadogTracer()
-	defer tracer.Stop()
-	logger.Printf("%v REST listening on: %v", stype, addr)
-	if serverConfig.DisableTLS {
-		logger.Println(server.ListenAndServe())
-	} else {
-		logger.Println(server.ListenAndServeTLS("", ""))
-	}
-	logger.Printf("waiting for handlers to finish...")
-	httpapi.WaitForHandlers()
-	logger.Printf("waiting for async goroutines to finish...")
-	httpapi.WaitForAsync()
-	logger.Printf("done, terminating")
+	return &leader.Elector{
+		DL:            dl,
+		MC:            mc,
+		Name:          maintenanceLeaseName,
+		ID:            id,
+		LeaseDuration: serverConfig.LeaderLeaseDuration,
+		RetryPeriod:   serverConfig.LeaderRetryPeriod,
+		OnStartedLeading: func(ctx context.Context) {
+			runMaintenance(ctx, dl, reaper, ci, lp)
+		},
+		LogFunc: logger.Printf,
+	}, nil
 }
 
-// randomRange returns a random integer (using rand.Reader as the entropy source) between 0 and max
-func randomRange(max int64) (int64, error) {
-	maxBig := *big.NewInt(max)
-	n, err := rand.Int(rand.Reader, &maxBig)
-	if err != nil {
-		return 0, err
+// runMaintenance runs the reaper and data cleanup at their intervals until ctx is cancelled
+func runMaintenance(ctx context.Context, dl *persistence.PGLayer, reaper *reap.Reaper, ci *metahelm.ChartInstaller, lp locker.LockProvider) {
+	var reapC, cleanupC <-chan time.Time
+	if reaper != nil {
+		logger.Printf("starting reaper: %v sec interval", serverConfig.ReaperIntervalSecs)
+		ticker := time.NewTicker(time.Duration(serverConfig.ReaperIntervalSecs) * time.Second)
+		defer ticker.Stop()
+		reapC = ticker.C
+	}
+	if serverConfig.DataCleanupInterval > 0 {
+		logger.Printf("starting data cleanup: %v interval", serverConfig.DataCleanupInterval)
+		ticker := time.NewTicker(serverConfig.DataCleanupInterval)
+		defer ticker.Stop()
+		cleanupC = ticker.C
+	}
+	for {
+		select {
+		case <-ctx.Done():
+			logger.Printf("stopping maintenance")
+			return
+		case <-reapC:
+			reaper.Reap(ctx)
+		case <-cleanupC:
+			cleaner := &persistence.Cleaner{
+				DB:                        dl.DB(),
+				DestroyedEnvRecordsMaxAge: destroyedenvsMaxage,
+				EventLogsMaxAge:           eventlogsMaxage,
+				LogFunc:                   logger.Printf,
+			}
+			cleaner.Clean(ctx)
+			ci.Cleanup(ctx, k8sMaxage)
+			if lgc, ok := lp.(locker.LockGarbageCollector); ok {
+				n, err := lgc.CollectGarbage(ctx, k8sMaxage)
+				if err != nil {
+					logger.Printf("error collecting lock garbage: %v", err)
+				}
+				logger.Printf("deleted %v unused lock objects", n)
+			}
+		}
 	}
-	return n.Int64(), nil
 }
@@ -0,0 +1,78 @@
+// +build linux darwin freebsd netbsd openbsd
+
+package cmd
+
+import (
+	"context"
+	"log"
+	"os"
+	"os/signal"
+	"syscall"
+
+	"github.com/dollarshaveclub/acyl/pkg/ghclient"
+	"github.com/dollarshaveclub/acyl/pkg/persistence"
+	"github.com/spf13/cobra"
+	"gopkg.in/DataDog/dd-trace-go.v1/ddtrace/tracer"
+)
+
+// workerCmd represents the worker command
+var workerCmd = &cobra.Command{
+	Use:   "worker",
+	Short: "Run acyl worker",
+	Long: `Run an acyl worker that processes environment operations from the durable operation queue in the database.
+
+Servers accept webhooks and API requests and enqueue operations, which are processed by any worker (including servers that aren't run with --disable-worker).
+Workers coordinate with servers and each other through the database: each queued operation is leased by a single worker, and operations on the same environment are serialized by the Postgres locker.
+On SIGTERM or SIGINT the worker stops leasing new operations and exits once the operations in progress have finished.`,
+	Run: runWorker,
+	PreRun: func(cmd *cobra.Command, args []string) {
+		getSecrets()
+		setupServerLogger()
+	},
+}
+
+func init() {
+	workerCmd.PersistentFlags().StringVar(&serverConfig.UIBaseURL, "ui-base-url", "", "External base URL (https://somedomain.com) for UI links")
+	addNitroFlags(workerCmd)
+	RootCmd.AddCommand(workerCmd)
+}
+
+func runWorker(cmd *cobra.Command, args []string) {
+	mc, nmc := newMetricsCollectors()
+
+	if datadogTracingAgentAddr != "" {
+		pgConfig.DatadogServiceName = datadogServiceName + ".postgres"
+		pgConfig.EnableTracing = true
+	}
+
+	dl, err := persistence.NewPGLayer(&pgConfig, logger)
+	if err != nil {
+		log.Fatalf("error opening PG database: %v", err)
+	}
+	defer dl.Close()
+
+	rc := ghclient.NewGitHubClient(githubConfig.Token)
+	nitromgr, _, _ := newNitroManager(dl, rc, mc, nmc)
+	// workers only run with the durable queue, so creates they dequeue from the environment queue are processed by workers too
+	nitromgr.DurableQueue = true
+	w, err := newWorker(dl, nitromgr, nmc)
+	if err != nil {
+		log.Fatalf("error creating worker: %v", err)
+	}
+
+	ctx, cf := context.WithCancel(context.Background())
+	defer cf()
+	stop := make(chan os.Signal, 1)
+	signal.Notify(stop, syscall.SIGTERM) //non-portable outside of POSIX systems
+	signal.Notify(stop, os.Interrupt)
+	go func() {
+		<-stop
+		logger.Printf("stopping, waiting for operations in progress to finish...")
+		cf()
+	}()
+
+	startDatadogTracer()
+	defer tracer.Stop()
+	w.Run(ctx)
+	logger.Printf("done, terminating")
+}
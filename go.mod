@@ -46,6 +46,7 @@ require (
 	github.com/palantir/go-githubapp v0.9.2-0.20210830144646-08ca97a77f90
 	github.com/pierrec/lz4 v2.6.0+incompatible // indirect
 	github.com/pkg/errors v0.9.1
+	github.com/pmezard/go-difflib v1.0.0
 	github.com/rivo/tview v0.0.0-20190113120821-e5e361b9d790
 	github.com/rs/zerolog v1.18.0
 	github.com/sergi/go-diff v1.2.0 // indirect
@@ -72,6 +73,7 @@ require (
 	k8s.io/apimachinery v0.22.1
 	k8s.io/cli-runtime v0.22.1
 	k8s.io/client-go v0.22.1
+	sigs.k8s.io/kustomize/api v0.8.11
 	sigs.k8s.io/kustomize/kyaml v0.11.0
 )
 
@@ -0,0 +1,4 @@
+DROP INDEX IF EXISTS idx_qa_environments_expires_at;
+
+ALTER TABLE qa_environments DROP COLUMN IF EXISTS expiration_warned;
+ALTER TABLE qa_environments DROP COLUMN IF EXISTS expires_at;
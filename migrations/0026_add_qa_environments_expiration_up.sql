@@ -0,0 +1,4 @@
+ALTER TABLE qa_environments ADD COLUMN expires_at timestamptz;
+ALTER TABLE qa_environments ADD COLUMN expiration_warned boolean NOT NULL DEFAULT false;
+
+CREATE INDEX IF NOT EXISTS idx_qa_environments_expires_at ON qa_environments (expires_at);
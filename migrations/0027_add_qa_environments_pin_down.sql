@@ -0,0 +1,3 @@
+ALTER TABLE qa_environments DROP COLUMN IF EXISTS pinned_until;
+ALTER TABLE qa_environments DROP COLUMN IF EXISTS pin_reason;
+ALTER TABLE qa_environments DROP COLUMN IF EXISTS pinned;
@@ -0,0 +1,3 @@
+ALTER TABLE qa_environments ADD COLUMN pinned boolean NOT NULL DEFAULT false;
+ALTER TABLE qa_environments ADD COLUMN pin_reason text NOT NULL DEFAULT '';
+ALTER TABLE qa_environments ADD COLUMN pinned_until timestamptz;
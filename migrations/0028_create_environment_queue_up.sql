@@ -0,0 +1,9 @@
+CREATE TABLE environment_queue (
+    env_name text PRIMARY KEY REFERENCES qa_environments (name) ON UPDATE CASCADE ON DELETE CASCADE,
+    enqueued timestamptz NOT NULL DEFAULT NOW(),
+    priority integer NOT NULL DEFAULT 0,
+    repo_revision_data jsonb NOT NULL,
+    event_id uuid NOT NULL
+);
+
+CREATE INDEX environment_queue_order_idx ON environment_queue (priority DESC, enqueued ASC);
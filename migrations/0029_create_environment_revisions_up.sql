@@ -0,0 +1,12 @@
+CREATE TABLE environment_revisions (
+    id bigserial PRIMARY KEY,
+    env_name text NOT NULL REFERENCES qa_environments (name) ON UPDATE CASCADE ON DELETE CASCADE,
+    created timestamptz NOT NULL DEFAULT NOW(),
+    k8s_namespace text NOT NULL,
+    ref_map jsonb NOT NULL,
+    commit_sha_map jsonb NOT NULL,
+    config_signature bytea NOT NULL,
+    helm_releases jsonb NOT NULL
+);
+
+CREATE INDEX environment_revisions_env_name_idx ON environment_revisions (env_name, created DESC);
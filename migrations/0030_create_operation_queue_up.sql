@@ -0,0 +1,17 @@
+CREATE TABLE operation_queue (
+    id uuid PRIMARY KEY,
+    created timestamptz NOT NULL DEFAULT NOW(),
+    action text NOT NULL,
+    repo_revision_data jsonb NOT NULL,
+    event_id uuid NOT NULL,
+    installation_id bigint NOT NULL DEFAULT 0,
+    status text NOT NULL,
+    attempts integer NOT NULL DEFAULT 0,
+    not_before timestamptz NOT NULL DEFAULT NOW(),
+    lease_owner text NOT NULL DEFAULT '',
+    lease_expires timestamptz,
+    last_error text NOT NULL DEFAULT '',
+    completed timestamptz
+);
+
+CREATE INDEX operation_queue_lease_idx ON operation_queue (status, not_before, created);
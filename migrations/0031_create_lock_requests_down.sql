@@ -0,0 +1,2 @@
+DROP TABLE lock_force_releases;
+DROP TABLE lock_requests;
@@ -0,0 +1,24 @@
+CREATE TABLE lock_requests (
+    id uuid PRIMARY KEY,
+    lock_key bigint NOT NULL,
+    event text NOT NULL DEFAULT '',
+    pid integer NOT NULL,
+    requested timestamptz NOT NULL DEFAULT NOW(),
+    acquired timestamptz,
+    preempted timestamptz,
+    preempted_by text NOT NULL DEFAULT ''
+);
+
+CREATE INDEX lock_requests_lock_key_pid_idx ON lock_requests (lock_key, pid);
+
+CREATE TABLE lock_force_releases (
+    id uuid PRIMARY KEY,
+    created timestamptz NOT NULL DEFAULT NOW(),
+    lock_key bigint NOT NULL,
+    repo text NOT NULL,
+    pull_request integer NOT NULL,
+    holder_event text NOT NULL DEFAULT '',
+    holder_pid integer NOT NULL,
+    username text NOT NULL,
+    reason text NOT NULL DEFAULT ''
+);
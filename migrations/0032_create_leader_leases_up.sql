@@ -0,0 +1,7 @@
+CREATE TABLE leader_leases (
+    name text PRIMARY KEY,
+    holder text NOT NULL,
+    acquired timestamptz NOT NULL DEFAULT NOW(),
+    renewed timestamptz NOT NULL DEFAULT NOW(),
+    expires timestamptz NOT NULL
+);
@@ -0,0 +1 @@
+ALTER TABLE qa_environments DROP COLUMN IF EXISTS reaper_policy;
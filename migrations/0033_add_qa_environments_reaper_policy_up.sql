@@ -0,0 +1 @@
+ALTER TABLE qa_environments ADD COLUMN reaper_policy jsonb NOT NULL DEFAULT '{}';
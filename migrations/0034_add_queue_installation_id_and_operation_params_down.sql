@@ -0,0 +1,2 @@
+ALTER TABLE environment_queue DROP COLUMN IF EXISTS installation_id;
+ALTER TABLE operation_queue DROP COLUMN IF EXISTS params;
@@ -0,0 +1,2 @@
+ALTER TABLE environment_queue ADD COLUMN installation_id bigint NOT NULL DEFAULT 0;
+ALTER TABLE operation_queue ADD COLUMN params jsonb NOT NULL DEFAULT '{}';
@@ -1,16 +1,19 @@
 package api
 
 import (
+	"context"
 	"fmt"
 	"log"
 	"net"
 	"net/http"
 	"os"
 	"sync"
+	"time"
 
 	"github.com/dollarshaveclub/acyl/pkg/config"
 	"github.com/dollarshaveclub/acyl/pkg/ghclient"
 	"github.com/dollarshaveclub/acyl/pkg/ghevent"
+	"github.com/dollarshaveclub/acyl/pkg/locker"
 	"github.com/dollarshaveclub/acyl/pkg/models"
 	"github.com/dollarshaveclub/acyl/pkg/nitro/metahelm"
 	"github.com/dollarshaveclub/acyl/pkg/persistence"
@@ -21,9 +24,13 @@ import (
 
 const (
 	DefaultPodContainerLogLines = 100
-	MinAPIKeyPermissionLevel    = models.ReadOnlyPermission
-	MaxAPIKeyPermissionLevel    = models.WritePermission
-	MaxAPIKeysLimit             = 10
+	// MaxPodLogStreamDuration is the maximum amount of time a pod log stream is kept open before the server closes it
+	MaxPodLogStreamDuration = 30 * time.Minute
+	// PodLogStreamKeepaliveInterval is how often a comment is sent on an idle pod log stream to keep intermediate proxies from closing it
+	PodLogStreamKeepaliveInterval = 15 * time.Second
+	MinAPIKeyPermissionLevel      = models.ReadOnlyPermission
+	MaxAPIKeyPermissionLevel      = models.WritePermission
+	MaxAPIKeysLimit               = 10
 )
 
 type apiBase struct {
@@ -86,6 +93,25 @@ type Dependencies struct {
 	DatadogServiceName string
 	Logger             *log.Logger
 	KubernetesReporter metahelm.KubernetesReporter
+	// LockInspector is used by the admin endpoints to inspect and force-release env locks (optional)
+	LockInspector locker.LockInspector
+	// LeaderElector reports the replica elected to run periodic maintenance, in the health check (optional)
+	LeaderElector LeaderElector
+	// ReapPlanner reports what the reaper would do, for the admin dry run endpoint (optional)
+	ReapPlanner ReapPlanner
+}
+
+// LeaderElector describes an object that reports the replica that is the elected leader among the server replicas
+type LeaderElector interface {
+	// Replica returns the ID of this replica
+	Replica() string
+	// Leader returns the ID of the leader replica, or the empty string if there is no leader
+	Leader(ctx context.Context) (string, error)
+}
+
+// ReapPlanner describes an object that returns the actions the reaper would take without taking them
+type ReapPlanner interface {
+	DryRun(ctx context.Context) ([]models.ReapAction, error)
 }
 
 // Manager describes an object capable of registering API versions and waiting on requests
@@ -243,6 +269,9 @@ func (d *Dispatcher) RegisterVersions(deps *Dependencies, ro ...RegisterOption)
 
 	authMiddleware.apiKeys = ropts.apiKeys
 	authMiddleware.DL = deps.DataLayer
+	if rpc, ok := deps.RepoClient.(ghclient.RepoPermissionsClient); ok {
+		authMiddleware.rpc = rpc
+	}
 	ipWhitelistMiddleware.ipwl = ropts.ipWhitelist
 	sessionAuthMiddleware.OAuth = oauthcfg
 	sessionAuthMiddleware.CookieStore = newSessionsCookieStore(oauthcfg)
@@ -282,6 +311,15 @@ func (d *Dispatcher) RegisterVersions(deps *Dependencies, ro ...RegisterOption)
 	if err != nil {
 		return fmt.Errorf("error creating api v2: %v", err)
 	}
+	apiv2.li = deps.LockInspector
+	apiv2.le = deps.LeaderElector
+	apiv2.rp = deps.ReapPlanner
+	if rpc, ok := deps.RepoClient.(ghclient.RepoPermissionsClient); ok {
+		apiv2.rpc = rpc
+	}
+	if tmc, ok := deps.RepoClient.(ghclient.TeamMembersClient); ok {
+		apiv2.tmc = tmc
+	}
 	err = apiv2.register(r)
 	if err != nil {
 		return fmt.Errorf("error registering api v2: %v", err)
@@ -210,6 +210,12 @@ func (api *v0api) processWebhook(ctx context.Context, action string, rrd models.
 		span.Finish(tracer.WithError(err))
 	}
 
+	if api.sc.DurableOperationQueue {
+		err = api.enqueueOperation(ctx, action, rrd)
+		finishWithError()
+		return err
+	}
+
 	switch action {
 	case "reopened":
 		fallthrough
@@ -268,6 +274,98 @@ func (api *v0api) processWebhook(ctx context.Context, action string, rrd models.
 	return nil
 }
 
+// enqueueOperation persists the operation for the webhook action so that it is processed by a worker, surviving crashes and restarts
+func (api *v0api) enqueueOperation(ctx context.Context, action string, rrd models.RepoRevisionData) error {
+	log := eventlogger.GetLogger(ctx).Printf
+	switch action {
+	case "opened", "reopened", "synchronize", "closed":
+	default:
+		log("unknown action type: %v", action)
+		return fmt.Errorf("unknown action type: %v (event_log_id: %v)", action, eventlogger.GetLogger(ctx).ID.String())
+	}
+	id, err := uuid.NewRandom()
+	if err != nil {
+		return errors.Wrap(err, "error getting random UUID")
+	}
+	// the installation ID is missing (zero) for legacy webhooks
+	iid, _, _ := ghapp.GetGitHubClientValuesFromContext(ctx)
+	op := &models.QueuedOperation{
+		ID:               id,
+		Action:           action,
+		RepoRevisionData: rrd,
+		EventID:          eventlogger.GetLogger(ctx).ID,
+		InstallationID:   iid,
+	}
+	var superseded []models.QueuedOperation
+	switch action {
+	case persistence.SupersededOperationAction, "closed":
+		// pushes that haven't started processing yet are superseded by a newer push or by closing the PR
+		var debounce time.Duration
+		if action == persistence.SupersededOperationAction {
+			debounce = api.sc.DebounceWindowForRepo(rrd.Repo)
+		}
+		superseded, err = api.dl.EnqueueSupersedingOperation(ctx, op, debounce)
+	default:
+		err = api.dl.EnqueueOperation(ctx, op)
+	}
+	if err != nil {
+		log("error enqueueing operation: %v", err)
+		return errors.Wrap(err, "error enqueueing operation")
+	}
+	if op.NotBefore.After(op.Created) {
+		log("queued %v for processing by a worker after %v unless superseded by a newer push (debounce) (operation: %v)", action, op.NotBefore.Format(time.RFC3339), op.ID)
+	} else {
+		log("queued %v for processing by a worker (operation: %v)", action, op.ID)
+	}
+	for _, sop := range superseded {
+		api.setCoalesced(ctx, sop, *op)
+	}
+	return nil
+}
+
+// setCoalesced marks the event and commit of the queued operation sop, which was superseded by op before it was processed, as coalesced
+func (api *v0api) setCoalesced(ctx context.Context, sop, op models.QueuedOperation) {
+	log := eventlogger.GetLogger(ctx).Printf
+	log("coalesced pending %v for %v (operation: %v, event: %v)", sop.Action, sop.RepoRevisionData.SourceSHA, sop.ID, sop.EventID)
+	elog := &eventlogger.Logger{ID: sop.EventID, DL: api.dl, Sink: os.Stdout}
+	elog.Printf("coalesced: superseded by a newer %v for %v before processing started (event: %v)", op.Action, op.RepoRevisionData.SourceSHA, op.EventID)
+	elog.SetCompletedStatus(models.CoalescedStatus)
+	rd := sop.RepoRevisionData
+	cst := models.DefaultCommitStatusTemplates[models.CommitStatusCoalesced.Key()]
+	rcs, err := cst.Render(models.NotificationData{
+		Repo:         rd.Repo,
+		SourceBranch: rd.SourceBranch,
+		SourceSHA:    rd.SourceSHA,
+		BaseBranch:   rd.BaseBranch,
+		BaseSHA:      rd.BaseSHA,
+		User:         rd.User,
+		PullRequest:  rd.PullRequest,
+		SupersededBy: op.RepoRevisionData.SourceSHA,
+	})
+	if err != nil {
+		log("error rendering coalesced commit status: %v", err)
+		return
+	}
+	if err := api.dl.SetEventStatusRenderedStatus(sop.EventID, models.RenderedEventStatus{
+		Description:   rcs.Description,
+		LinkTargetURL: rcs.TargetURL,
+	}); err != nil {
+		log("error setting coalesced event rendered status: %v", err)
+	}
+	turl := rcs.TargetURL
+	if api.sc.UIBaseURL != "" {
+		turl = fmt.Sprintf("%v/ui/event/status?id=%v", api.sc.UIBaseURL, sop.EventID.String())
+	}
+	if err := api.rc.SetStatus(ctx, rd.Repo, rd.SourceSHA, &ghclient.CommitStatus{
+		Context:     "Acyl",
+		Status:      models.CommitStatusCoalesced.State(),
+		Description: rcs.Description,
+		TargetURL:   turl,
+	}); err != nil {
+		log("error setting coalesced commit status: %v", err)
+	}
+}
+
 // legacyGithubWebhookHandler serves the legacy (manually set up) GitHook webhook endpoint
 func (api *v0api) legacyGithubWebhookHandler(w http.ResponseWriter, r *http.Request) {
 	defer r.Body.Close()
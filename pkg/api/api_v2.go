@@ -13,9 +13,12 @@ import (
 
 	"github.com/dollarshaveclub/acyl/pkg/config"
 	"github.com/dollarshaveclub/acyl/pkg/eventlogger"
+	"github.com/dollarshaveclub/acyl/pkg/ghclient"
 	"github.com/dollarshaveclub/acyl/pkg/ghevent"
+	"github.com/dollarshaveclub/acyl/pkg/locker"
 	"github.com/dollarshaveclub/acyl/pkg/models"
 	ncontext "github.com/dollarshaveclub/acyl/pkg/nitro/context"
+	nitroerrors "github.com/dollarshaveclub/acyl/pkg/nitro/errors"
 	"github.com/dollarshaveclub/acyl/pkg/nitro/metahelm"
 	"github.com/dollarshaveclub/acyl/pkg/persistence"
 	"github.com/dollarshaveclub/acyl/pkg/spawner"
@@ -50,6 +53,10 @@ type v2QAEnvironment struct {
 	AminoServiceToPort       map[string]int64            `json:"amino_service_to_port"`
 	AminoKubernetesNamespace string                      `json:"amino_kubernetes_namespace"`
 	AminoEnvironmentID       int                         `json:"amino_environment_id"`
+	ExpiresAt                *time.Time                  `json:"expires_at"`
+	Pinned                   bool                        `json:"pinned"`
+	PinReason                string                      `json:"pin_reason"`
+	PinnedUntil              *time.Time                  `json:"pinned_until"`
 }
 
 func v2QAEnvironmentFromQAEnvironment(qae *models.QAEnvironment) *v2QAEnvironment {
@@ -74,6 +81,10 @@ func v2QAEnvironmentFromQAEnvironment(qae *models.QAEnvironment) *v2QAEnvironmen
 		AminoServiceToPort:       qae.AminoServiceToPort,
 		AminoKubernetesNamespace: qae.AminoKubernetesNamespace,
 		AminoEnvironmentID:       qae.AminoEnvironmentID,
+		ExpiresAt:                qae.ExpiresAt,
+		Pinned:                   qae.Pinned,
+		PinReason:                qae.PinReason,
+		PinnedUntil:              qae.PinnedUntil,
 	}
 }
 
@@ -135,6 +146,8 @@ func statusSummaryStatus(s models.EventStatus) string {
 		return "failed"
 	case models.CancelledStatus:
 		return "cancelled"
+	case models.CoalescedStatus:
+		return "coalesced"
 	default:
 		return "default"
 	}
@@ -179,6 +192,30 @@ type V2EventStatusSummaryConfig struct {
 	Started        *time.Time            `json:"started"`
 	Completed      *time.Time            `json:"completed"`
 	RefMap         map[string]string     `json:"ref_map"`
+	Retries        []V2EventStatusRetry  `json:"retries,omitempty"`
+}
+
+type V2EventStatusRetry struct {
+	Attempt uint      `json:"attempt"`
+	Error   string    `json:"error"`
+	Failed  time.Time `json:"failed"`
+	Backoff string    `json:"backoff"`
+}
+
+func v2EventStatusRetries(retries []models.EventStatusRetry) []V2EventStatusRetry {
+	if len(retries) == 0 {
+		return nil
+	}
+	out := make([]V2EventStatusRetry, len(retries))
+	for i, r := range retries {
+		out[i] = V2EventStatusRetry{
+			Attempt: r.Attempt,
+			Error:   r.Error,
+			Failed:  r.Failed,
+			Backoff: r.Backoff.String(),
+		}
+	}
+	return out
 }
 
 type V2EventStatusTreeNodeImage struct {
@@ -192,6 +229,7 @@ type V2EventStatusTreeNodeChart struct {
 	Status    string     `json:"status"`
 	Started   *time.Time `json:"started"`
 	Completed *time.Time `json:"completed"`
+	Diff      string     `json:"diff,omitempty"`
 }
 
 func statusImageOrNil(image models.EventStatusTreeNodeImage) *V2EventStatusTreeNodeImage {
@@ -227,6 +265,7 @@ func v2EventStatusTreeFromTree(tree map[string]models.EventStatusTreeNode) map[s
 				Status:    statusNodeChartStatus(v.Chart.Status),
 				Completed: timeOrNil(v.Chart.Completed),
 				Started:   timeOrNil(v.Chart.Started),
+				Diff:      v.Chart.Diff,
 			},
 		}
 	}
@@ -257,6 +296,7 @@ func V2EventStatusSummaryFromEventStatusSummary(sum *models.EventStatusSummary)
 			Started:        timeOrNil(sum.Config.Started),
 			Completed:      timeOrNil(sum.Config.Completed),
 			RefMap:         sum.Config.RefMap,
+			Retries:        v2EventStatusRetries(sum.Config.Retries),
 		},
 		Tree: v2EventStatusTreeFromTree(sum.Tree),
 	}
@@ -264,25 +304,43 @@ func V2EventStatusSummaryFromEventStatusSummary(sum *models.EventStatusSummary)
 
 type v2api struct {
 	apiBase
-	dl    persistence.DataLayer
-	ge    *ghevent.GitHubEventWebhook
-	es    spawner.EnvironmentSpawner
-	sc    config.ServerConfig
-	oauth OAuthConfig
-	kr    metahelm.KubernetesReporter
+	dl     persistence.DataLayer
+	ge     *ghevent.GitHubEventWebhook
+	es     spawner.EnvironmentSpawner
+	sc     config.ServerConfig
+	oauth  OAuthConfig
+	kr     metahelm.KubernetesReporter
+	quotas models.Quotas
+	// li is used to inspect and force-release env locks (optional)
+	li locker.LockInspector
+	// le reports the leader replica in the health check (optional)
+	le LeaderElector
+	// rp reports what the reaper would do (optional)
+	rp ReapPlanner
+	// rpc checks the repo permissions of the GitHub users of non-admin API keys (if missing, non-admin keys have no repo access)
+	rpc ghclient.RepoPermissionsClient
+	// tmc lists the members of the teams with quotas (required for team quotas)
+	tmc ghclient.TeamMembersClient
 }
 
 func newV2API(dl persistence.DataLayer, ge *ghevent.GitHubEventWebhook, es spawner.EnvironmentSpawner, sc config.ServerConfig, oauth OAuthConfig, logger *log.Logger, kr metahelm.KubernetesReporter) (*v2api, error) {
+	quotas := models.Quotas{}
+	if sc.QuotasJSON != "" {
+		if err := json.Unmarshal([]byte(sc.QuotasJSON), &quotas); err != nil {
+			return nil, fmt.Errorf("error unmarshaling quotas: %w", err)
+		}
+	}
 	return &v2api{
 		apiBase: apiBase{
 			logger: logger,
 		},
-		dl:    dl,
-		ge:    ge,
-		es:    es,
-		sc:    sc,
-		oauth: oauth,
-		kr:    kr,
+		dl:     dl,
+		ge:     ge,
+		es:     es,
+		sc:     sc,
+		oauth:  oauth,
+		kr:     kr,
+		quotas: quotas,
 	}, nil
 }
 
@@ -294,18 +352,57 @@ func (api *v2api) register(r *muxtrace.Router) error {
 
 	// API token
 	r.HandleFunc("/v2/envs/_search", middlewareChain(authMiddleware.tokenAuth(authMiddleware.authorize(api.envSearchHandler), models.ReadOnlyPermission))).Methods("GET")
+	r.HandleFunc("/v2/envs", middlewareChain(authMiddleware.tokenAuth(authMiddleware.authorize(api.envCreateHandler), models.WritePermission))).Methods("POST")
+	r.HandleFunc("/v2/envs/{name}", middlewareChain(authMiddleware.tokenAuth(authMiddleware.authorizeEnv(api.envDestroyHandler), models.WritePermission))).Methods("DELETE")
 	r.HandleFunc("/v2/envs/{name}", middlewareChain(authMiddleware.tokenAuth(authMiddleware.authorizeEnv(api.envDetailHandler), models.ReadOnlyPermission))).Methods("GET")
 	r.HandleFunc("/v2/eventlog/{id}", middlewareChain(authMiddleware.tokenAuth(authMiddleware.authorizeEventLog(api.eventLogHandler), models.ReadOnlyPermission))).Methods("GET")
+	r.HandleFunc("/v2/eventlog/{id}/cancel", middlewareChain(authMiddleware.tokenAuth(authMiddleware.authorizeEventLog(api.eventLogCancelHandler), models.WritePermission))).Methods("POST")
+	r.HandleFunc("/v2/envs/{name}/actions/hibernate", middlewareChain(authMiddleware.tokenAuth(authMiddleware.authorizeEnv(api.envActionsHibernateHandler), models.WritePermission))).Methods("POST")
+	r.HandleFunc("/v2/envs/{name}/actions/wake", middlewareChain(authMiddleware.tokenAuth(authMiddleware.authorizeEnv(api.envActionsWakeHandler), models.WritePermission))).Methods("POST")
+	r.HandleFunc("/v2/envs/{name}/actions/extend", middlewareChain(authMiddleware.tokenAuth(authMiddleware.authorizeEnv(api.envActionsExtendHandler), models.WritePermission))).Methods("POST")
+	r.HandleFunc("/v2/envs/{name}/actions/pin", middlewareChain(authMiddleware.tokenAuth(authMiddleware.authorizeEnv(api.envActionsPinHandler), models.WritePermission))).Methods("POST")
+	r.HandleFunc("/v2/envs/{name}/actions/unpin", middlewareChain(authMiddleware.tokenAuth(authMiddleware.authorizeEnv(api.envActionsUnpinHandler), models.WritePermission))).Methods("POST")
+	r.HandleFunc("/v2/envs/{name}/actions/rollback", middlewareChain(authMiddleware.tokenAuth(authMiddleware.authorizeEnv(api.envActionsRollbackHandler), models.WritePermission))).Methods("POST")
+	r.HandleFunc("/v2/envs/{name}/actions/retry", middlewareChain(authMiddleware.tokenAuth(authMiddleware.authorizeEnv(api.envActionsRetryHandler), models.WritePermission))).Methods("POST")
+	r.HandleFunc("/v2/envs/{name}/revisions", middlewareChain(authMiddleware.tokenAuth(authMiddleware.authorizeEnv(api.envRevisionsHandler), models.ReadOnlyPermission))).Methods("GET")
+	r.HandleFunc("/v2/envs/{name}/plan", middlewareChain(authMiddleware.tokenAuth(authMiddleware.authorizeEnv(api.envPlanHandler), models.ReadOnlyPermission))).Methods("GET")
+	r.HandleFunc("/v2/plan", middlewareChain(authMiddleware.tokenAuth(authMiddleware.authorize(api.planHandler), models.ReadOnlyPermission))).Methods("POST")
+	r.HandleFunc("/v2/envs/{name}/actions/clone", middlewareChain(authMiddleware.tokenAuth(authMiddleware.authorize(api.envActionsCloneHandler), models.WritePermission))).Methods("POST")
+	r.HandleFunc("/v2/envs/{name}/services/{service}/ports/{port}/proxy/{path:.*}", middlewareChain(authMiddleware.tokenAuth(authMiddleware.authorizeEnv(api.envServiceProxyHandler), models.WritePermission)))
+	r.HandleFunc("/v2/quotas", middlewareChain(authMiddleware.tokenAuth(api.quotasHandler, models.AdminPermission))).Methods("GET")
+	r.HandleFunc("/v2/locks", middlewareChain(authMiddleware.tokenAuth(api.locksHandler, models.AdminPermission))).Methods("GET")
+	r.HandleFunc("/v2/locks/release", middlewareChain(authMiddleware.tokenAuth(api.lockReleaseHandler, models.AdminPermission))).Methods("POST")
+	r.HandleFunc("/v2/locks/releases", middlewareChain(authMiddleware.tokenAuth(api.lockReleasesHandler, models.AdminPermission))).Methods("GET")
+	r.HandleFunc("/v2/reap/dry-run", middlewareChain(authMiddleware.tokenAuth(api.reapDryRunHandler, models.AdminPermission))).Methods("GET")
 
 	// Session auth
 	r.HandleFunc("/v2/event/{id}/status", middlewareChain(api.eventStatusHandler, sessionAuthMiddleware.sessionAuth)).Methods("GET")
 	r.HandleFunc("/v2/event/{id}/logs", middlewareChain(api.logsHandler, sessionAuthMiddleware.sessionAuth)).Methods("GET")
+	r.HandleFunc("/v2/event/{id}/cancel", middlewareChain(api.eventCancelHandler, sessionAuthMiddleware.sessionAuth)).Methods("POST")
 	r.HandleFunc("/v2/userenvs", middlewareChain(api.userEnvsHandler, sessionAuthMiddleware.sessionAuth)).Methods("GET")
+	r.HandleFunc("/v2/userenvs", middlewareChain(api.userEnvCreateHandler, sessionAuthMiddleware.sessionAuth)).Methods("POST")
 	r.HandleFunc("/v2/userenvs/{name}", middlewareChain(api.userEnvDetailHandler, sessionAuthMiddleware.sessionAuth)).Methods("GET")
 	r.HandleFunc("/v2/userenvs/{name}/actions/rebuild", middlewareChain(api.userEnvActionsRebuildHandler, sessionAuthMiddleware.sessionAuth)).Methods("POST")
+	r.HandleFunc("/v2/userenvs/{name}/actions/retry", middlewareChain(api.userEnvActionsRetryHandler, sessionAuthMiddleware.sessionAuth)).Methods("POST")
+	r.HandleFunc("/v2/userenvs/{name}/actions/hibernate", middlewareChain(api.userEnvActionsHibernateHandler, sessionAuthMiddleware.sessionAuth)).Methods("POST")
+	r.HandleFunc("/v2/userenvs/{name}/actions/wake", middlewareChain(api.userEnvActionsWakeHandler, sessionAuthMiddleware.sessionAuth)).Methods("POST")
+	r.HandleFunc("/v2/userenvs/{name}/actions/extend", middlewareChain(api.userEnvActionsExtendHandler, sessionAuthMiddleware.sessionAuth)).Methods("POST")
+	r.HandleFunc("/v2/userenvs/{name}/actions/pin", middlewareChain(api.userEnvActionsPinHandler, sessionAuthMiddleware.sessionAuth)).Methods("POST")
+	r.HandleFunc("/v2/userenvs/{name}/actions/unpin", middlewareChain(api.userEnvActionsUnpinHandler, sessionAuthMiddleware.sessionAuth)).Methods("POST")
+	r.HandleFunc("/v2/userenvs/{name}/actions/destroy", middlewareChain(api.userEnvActionsDestroyHandler, sessionAuthMiddleware.sessionAuth)).Methods("POST")
+	r.HandleFunc("/v2/userenvs/{name}/actions/rollback", middlewareChain(api.userEnvActionsRollbackHandler, sessionAuthMiddleware.sessionAuth)).Methods("POST")
+	r.HandleFunc("/v2/userenvs/{name}/actions/clone", middlewareChain(api.userEnvActionsCloneHandler, sessionAuthMiddleware.sessionAuth)).Methods("POST")
 	r.HandleFunc("/v2/userenvs/{name}/namespace/pods", middlewareChain(api.userEnvNamePodsHandler, sessionAuthMiddleware.sessionAuth)).Methods("GET")
 	r.HandleFunc("/v2/userenvs/{name}/namespace/pod/{pod}/containers", middlewareChain(api.userEnvPodContainersHandler, sessionAuthMiddleware.sessionAuth)).Methods("GET")
 	r.HandleFunc("/v2/userenvs/{name}/namespace/pod/{pod}/logs", middlewareChain(api.userEnvPodLogsHandler, sessionAuthMiddleware.sessionAuth)).Methods("GET")
+	r.HandleFunc("/v2/userenvs/{name}/namespace/pod/{pod}/logs/stream", middlewareChain(api.userEnvPodLogsStreamHandler, sessionAuthMiddleware.sessionAuth)).Methods("GET")
+	r.HandleFunc("/v2/userenvs/{name}/namespace/deployments", middlewareChain(api.userEnvDeploymentsHandler, sessionAuthMiddleware.sessionAuth)).Methods("GET")
+	r.HandleFunc("/v2/userenvs/{name}/namespace/statefulsets", middlewareChain(api.userEnvStatefulSetsHandler, sessionAuthMiddleware.sessionAuth)).Methods("GET")
+	r.HandleFunc("/v2/userenvs/{name}/namespace/services", middlewareChain(api.userEnvServicesHandler, sessionAuthMiddleware.sessionAuth)).Methods("GET")
+	r.HandleFunc("/v2/userenvs/{name}/namespace/ingresses", middlewareChain(api.userEnvIngressesHandler, sessionAuthMiddleware.sessionAuth)).Methods("GET")
+	r.HandleFunc("/v2/userenvs/{name}/namespace/jobs", middlewareChain(api.userEnvJobsHandler, sessionAuthMiddleware.sessionAuth)).Methods("GET")
+	r.HandleFunc("/v2/userenvs/{name}/namespace/events", middlewareChain(api.userEnvEventsHandler, sessionAuthMiddleware.sessionAuth)).Methods("GET")
+	r.HandleFunc("/v2/userenvs/{name}/namespace/service/{service}/port/{port}/proxy/{path:.*}", middlewareChain(api.userEnvServiceProxyHandler, sessionAuthMiddleware.sessionAuth))
 
 	// User tokens
 	r.HandleFunc("/v2/user/tokens", middlewareChain(api.apiKeysHandler, sessionAuthMiddleware.sessionAuth)).Methods("GET")
@@ -426,8 +523,21 @@ func (api *v2api) envSearchHandler(w http.ResponseWriter, r *http.Request) {
 }
 
 func (api *v2api) healthCheck(w http.ResponseWriter, r *http.Request) {
-	w.Header().Add("Content-Type", "application/json")
-	w.Write([]byte(`{ "message" : "Todo es bueno!" }`))
+	if api.le == nil {
+		w.Header().Add("Content-Type", "application/json")
+		w.Write([]byte(`{ "message" : "Todo es bueno!" }`))
+		return
+	}
+	// a replica is healthy regardless of leadership, so an error getting the leader is only logged
+	leader, err := api.le.Leader(r.Context())
+	if err != nil {
+		api.rlogger(r).Logf("error getting leader: %v", err)
+	}
+	api.writeJSON(w, r, map[string]string{
+		"message": "Todo es bueno!",
+		"replica": api.le.Replica(),
+		"leader":  leader,
+	})
 }
 
 func (api *v2api) eventLogHandler(w http.ResponseWriter, r *http.Request) {
@@ -470,6 +580,139 @@ func (api *v2api) eventStatusHandler(w http.ResponseWriter, r *http.Request) {
 	w.Write(j)
 }
 
+// cancelEvent cancels the operation of the pending event el, writing 202 if the cancellation was requested. An operation
+// that is still queued is cancelled before a worker processes it. If the event isn't pending (or has no environment, or its
+// operation isn't the one in progress), 409 is written.
+func (api *v2api) cancelEvent(w http.ResponseWriter, r *http.Request, el *models.EventLog, user string) {
+	es, err := api.dl.GetEventStatus(el.ID)
+	if err != nil {
+		api.internalError(w, errors.Wrap(err, "error fetching event status"))
+		return
+	}
+	if es == nil {
+		api.notfoundError(w)
+		return
+	}
+	if user == "" {
+		user = "api"
+	}
+	reason := "cancel requested by " + user
+	if es.Config.Status == models.PendingStatus {
+		op, err := api.es.CancelQueued(r.Context(), el.ID, reason)
+		if err != nil {
+			api.internalError(w, errors.Wrap(err, "error cancelling queued operation"))
+			return
+		}
+		if op != nil {
+			api.rlogger(r).Logf("queued operation %v of event %v cancelled by %v", op.ID, el.ID, user)
+			w.WriteHeader(http.StatusAccepted)
+			return
+		}
+	}
+	if es.Config.Status != models.PendingStatus || el.EnvName == "" {
+		api.rlogger(r).Logf("cannot cancel event with status %v (env: %q)", es.Config.Status, el.EnvName)
+		w.WriteHeader(http.StatusConflict)
+		return
+	}
+	if err := api.es.Cancel(r.Context(), el.EnvName, el.ID, reason); err != nil {
+		api.rlogger(r).Logf("error cancelling event: %v", err)
+		if nitroerrors.IsUserError(err) {
+			w.WriteHeader(http.StatusConflict)
+			return
+		}
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	api.rlogger(r).Logf("cancellation of event %v (env: %q) requested by %v", el.ID, el.EnvName, user)
+	w.WriteHeader(http.StatusAccepted)
+}
+
+func (api *v2api) eventLogCancelHandler(w http.ResponseWriter, r *http.Request) {
+	el, ok := r.Context().Value(eventLogCtxKey).(models.EventLog)
+	if !ok {
+		api.internalError(w, fmt.Errorf("unexpected event log type from context: %T", el))
+		return
+	}
+	apikey, ok := r.Context().Value(apiKeyCtxKey).(models.APIKey)
+	if !ok {
+		api.internalError(w, fmt.Errorf("unexpected api key type from context: %T", apikey))
+		return
+	}
+	api.cancelEvent(w, r, &el, apikey.GitHubUser)
+}
+
+// eventCancelHandler cancels the operation of a pending event from the UI
+func (api *v2api) eventCancelHandler(w http.ResponseWriter, r *http.Request) {
+	uis, err := getSessionFromContext(r.Context())
+	if err != nil {
+		api.rlogger(r).Logf("session missing from context")
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	id, err := uuid.Parse(mux.Vars(r)["id"])
+	if err != nil {
+		api.badRequestError(w, errors.Wrap(err, "error parsing id"))
+		return
+	}
+	el, err := api.dl.GetEventLogByID(id)
+	if err != nil {
+		api.internalError(w, errors.Wrap(err, "error fetching event log"))
+		return
+	}
+	if el == nil {
+		api.notfoundError(w)
+		return
+	}
+	if !api.userEventWritable(w, r, el) {
+		return
+	}
+	api.cancelEvent(w, r, el, uis.GitHubUser)
+}
+
+// userEventWritable checks that the session user may act on the event el, writing the error response and returning false otherwise.
+// If el has an environment, the user must have write access to the environment repo (see userEnvWritableByName). Events without
+// an environment (eg, a create waiting in the operation queue) are authorized by the event's user and repo instead.
+func (api *v2api) userEventWritable(w http.ResponseWriter, r *http.Request, el *models.EventLog) bool {
+	if el.EnvName != "" {
+		qae, err := api.dl.GetQAEnvironment(r.Context(), el.EnvName)
+		if err != nil {
+			api.rlogger(r).Logf("error getting qa env from db: %v", err)
+			w.WriteHeader(http.StatusInternalServerError)
+			return false
+		}
+		if qae != nil {
+			_, ok := api.userEnvWritableByName(w, r, el.EnvName)
+			return ok
+		}
+	}
+	uis, err := getSessionFromContext(r.Context())
+	if err != nil {
+		api.rlogger(r).Logf("session missing from context")
+		w.WriteHeader(http.StatusBadRequest)
+		return false
+	}
+	es, err := api.dl.GetEventStatus(el.ID)
+	if err != nil {
+		api.internalError(w, errors.Wrap(err, "error fetching event status"))
+		return false
+	}
+	if es != nil && es.Config.GitHubUser == uis.GitHubUser {
+		return true
+	}
+	repos, err := userPermissionsClient(api.oauth, el.Repo).GetUserWritableRepos(r.Context(), uis)
+	if err != nil {
+		api.rlogger(r).Logf("error getting user writable repos: %v", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return false
+	}
+	if _, ok := repos[el.Repo]; !ok || el.Repo == "" {
+		api.rlogger(r).Logf("user writable repo not found")
+		w.WriteHeader(http.StatusForbidden)
+		return false
+	}
+	return true
+}
+
 // logsHandler is an unauthenticated event log API endpoint for the UI that only returns event log lines
 // and not the full EventLog object
 // Instead of a global API token (like /v2/eventlog/{id}) it requires an event-scoped
@@ -521,11 +764,15 @@ func (api *v2api) logsHandler(w http.ResponseWriter, r *http.Request) {
 }
 
 type V2UserEnv struct {
-	Repo        string    `json:"repo"`
-	PullRequest uint      `json:"pull_request"`
-	EnvName     string    `json:"env_name"`
-	LastEvent   time.Time `json:"last_event"`
-	Status      string    `json:"status"`
+	Repo        string     `json:"repo"`
+	PullRequest uint       `json:"pull_request"`
+	EnvName     string     `json:"env_name"`
+	LastEvent   time.Time  `json:"last_event"`
+	Status      string     `json:"status"`
+	ExpiresAt   *time.Time `json:"expires_at"`
+	Pinned      bool       `json:"pinned"`
+	PinReason   string     `json:"pin_reason"`
+	PinnedUntil *time.Time `json:"pinned_until"`
 }
 
 func v2UserEnvFromQAEnvironment(qa models.QAEnvironment) V2UserEnv {
@@ -534,6 +781,12 @@ func v2UserEnvFromQAEnvironment(qa models.QAEnvironment) V2UserEnv {
 		PullRequest: qa.PullRequest,
 		EnvName:     qa.Name,
 		LastEvent:   qa.Created.Truncate(time.Second),
+		ExpiresAt:   qa.ExpiresAt,
+	}
+	if qa.IsPinned(time.Now().UTC()) {
+		out.Pinned = true
+		out.PinReason = qa.PinReason
+		out.PinnedUntil = qa.PinnedUntil
 	}
 	switch qa.Status {
 	case models.Destroyed:
@@ -542,6 +795,10 @@ func v2UserEnvFromQAEnvironment(qa models.QAEnvironment) V2UserEnv {
 		out.Status = "success"
 	case models.Failure:
 		out.Status = "failed"
+	case models.Hibernated:
+		out.Status = "hibernated"
+	case models.Queued:
+		out.Status = "queued"
 	case models.Spawned:
 		fallthrough
 	case models.Updating:
@@ -579,6 +836,8 @@ func (api *v2api) userEnvsHandler(w http.ResponseWriter, r *http.Request) {
 		models.Spawned,
 		models.Updating,
 		models.Failure,
+		models.Hibernated,
+		models.Queued,
 	}
 	if incd := r.URL.Query().Get("include_destroyed"); incd == "true" {
 		statuses = append(statuses, models.Destroyed)
@@ -827,7 +1086,46 @@ func (api *v2api) userEnvActionsRebuildHandler(w http.ResponseWriter, r *http.Re
 	}
 
 	// update environment
-	logger("starting async processing for %v rebuild update", messaging)
+	logger("starting %v rebuild update", messaging)
+	op := &models.QueuedOperation{
+		Action:           models.UpdateOperationAction,
+		RepoRevisionData: *rrd,
+		Params:           models.OperationParams{EnvName: qae.Name},
+	}
+	if err := api.startOperation(ctx, span, op, func(ctx context.Context) error {
+		_, err := api.es.Update(ctx, *rrd)
+		return err
+	}); err != nil {
+		api.internalError(w, err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(map[string]string{"event_id": id.String()})
+}
+
+// startOperation runs op, which is logged to the event log in ctx and traced by span, asynchronously. If the durable
+// operation queue is enabled, op is enqueued for processing by a worker so that it isn't interrupted by server restarts
+// and deploys. Otherwise af is run in the server process.
+func (api *v2api) startOperation(ctx context.Context, span tracer.Span, op *models.QueuedOperation, af func(ctx context.Context) error) error {
+	logger := eventlogger.GetLogger(ctx).Printf
+	op.EventID = eventlogger.GetLogger(ctx).ID
+	if api.sc.DurableOperationQueue {
+		id, err := uuid.NewRandom()
+		if err != nil {
+			span.Finish(tracer.WithError(err))
+			return errors.Wrap(err, "error getting random UUID")
+		}
+		op.ID = id
+		if err := api.dl.EnqueueOperation(ctx, op); err != nil {
+			span.Finish(tracer.WithError(err))
+			return errors.Wrap(err, "error enqueueing operation")
+		}
+		span.Finish()
+		logger("queued %v for processing by a worker (operation: %v)", op.Action, op.ID)
+		return nil
+	}
+	logger("starting async processing for %v", op.Action)
 	api.wg.Add(1)
 	go func() {
 		var err error
@@ -835,14 +1133,13 @@ func (api *v2api) userEnvActionsRebuildHandler(w http.ResponseWriter, r *http.Re
 		defer api.wg.Done()
 		ctx, cf := context.WithTimeout(ctx, MaxAsyncActionTimeout)
 		defer cf() // guarantee that any goroutines created with the ctx are cancelled
-		name, err := api.es.Update(ctx, *rrd)
-		if err != nil {
-			logger("finished processing %v update with error: %v", messaging, err)
+		if err = af(ctx); err != nil {
+			logger("finished processing %v with error: %v", op.Action, err)
 			return
 		}
-		logger("success processing %v update event (env: %q); done", messaging, name)
+		logger("success processing %v (env: %q); done", op.Action, op.Params.EnvName)
 	}()
-	w.WriteHeader(http.StatusCreated)
+	return nil
 }
 
 type V2EnvNamePods struct {
@@ -1092,134 +1389,554 @@ func (api *v2api) userEnvPodLogsHandler(w http.ResponseWriter, r *http.Request)
 	}
 }
 
-type v2CreateUserAPIKey struct {
-	Permission  models.PermissionLevel `json:"permission"`
-	Description string                 `json:"description"`
-}
-
-type V2UserAPIKeyResponse struct {
-	User  string    `json:"user"`
-	Token uuid.UUID `json:"token"`
+// userEnvK8sEnv returns the k8s environment for the env name in the request route if the session user has visibility
+// to the env repo. If no k8s environment exists yet, k8senv is nil and ok is true.
+// If ok is false, an error status code has already been written to w.
+func (api *v2api) userEnvK8sEnv(w http.ResponseWriter, r *http.Request) (k8senv *models.KubernetesEnvironment, ok bool) {
+	return api.userEnvK8sEnvWithAccess(w, r, false)
 }
 
-func (api *v2api) apiKeyCreateHandler(w http.ResponseWriter, r *http.Request) {
+// userEnvK8sEnvWithAccess is userEnvK8sEnv but requires the session user to have write access to the env repo if writable is true
+func (api *v2api) userEnvK8sEnvWithAccess(w http.ResponseWriter, r *http.Request, writable bool) (k8senv *models.KubernetesEnvironment, ok bool) {
 	uis, err := getSessionFromContext(r.Context())
 	if err != nil {
 		api.rlogger(r).Logf("session missing from context")
 		w.WriteHeader(http.StatusBadRequest)
-		return
+		return nil, false
 	}
-	existingKeys, err := api.dl.GetAPIKeysByGithubUser(r.Context(), uis.GitHubUser)
+	envname := mux.Vars(r)["name"]
+	if envname == "" {
+		w.WriteHeader(http.StatusBadRequest)
+		return nil, false
+	}
+	qae, err := api.dl.GetQAEnvironment(r.Context(), envname)
 	if err != nil {
-		api.rlogger(r).Logf("error getting api keys from db: %v", err)
+		api.rlogger(r).Logf("error getting qa env from db: %v", err)
 		w.WriteHeader(http.StatusInternalServerError)
-		return
+		return nil, false
 	}
-	if len(existingKeys) >= MaxAPIKeysLimit {
-		api.rlogger(r).Logf("error api keys limit (%v) reached", MaxAPIKeysLimit)
-		w.WriteHeader(http.StatusTooManyRequests)
-		return
+	if qae == nil {
+		api.rlogger(r).Logf("qa env not found")
+		w.WriteHeader(http.StatusNotFound)
+		return nil, false
 	}
-	reqParams := v2CreateUserAPIKey{}
-	err = json.NewDecoder(r.Body).Decode(&reqParams)
+	if writable {
+		repos, err := userPermissionsClient(api.oauth, qae.Repo).GetUserWritableRepos(r.Context(), uis)
+		if err != nil {
+			api.rlogger(r).Logf("error getting user writable repos: %v", err)
+			w.WriteHeader(http.StatusInternalServerError)
+			return nil, false
+		}
+		if _, ok := repos[qae.Repo]; !ok {
+			api.rlogger(r).Logf("user writable repo not found")
+			w.WriteHeader(http.StatusForbidden)
+			return nil, false
+		}
+	} else {
+		repos, err := userPermissionsClient(api.oauth, qae.Repo).GetUserVisibleRepos(r.Context(), uis)
+		if err != nil {
+			api.rlogger(r).Logf("error getting user visible repos: %v", err)
+			w.WriteHeader(http.StatusInternalServerError)
+			return nil, false
+		}
+		if !repoInRepos(repos, qae.Repo) {
+			w.WriteHeader(http.StatusForbidden)
+			return nil, false
+		}
+	}
+	k8senv, err = api.dl.GetK8sEnv(r.Context(), envname)
 	if err != nil {
-		api.rlogger(r).Logf("error unmarshaling body: %v", err)
+		api.rlogger(r).Logf("error getting k8s env from db: %v", err)
 		w.WriteHeader(http.StatusInternalServerError)
-		return
-	}
-	if reqParams.Permission < MinAPIKeyPermissionLevel || reqParams.Permission > MaxAPIKeyPermissionLevel {
-		api.rlogger(r).Logf("error token permission level invalid")
-		w.WriteHeader(http.StatusBadRequest)
-		return
+		return nil, false
 	}
-	keyID, err := api.dl.CreateAPIKey(r.Context(), models.PermissionLevel(reqParams.Permission), reqParams.Description, uis.GitHubUser)
+	return k8senv, true
+}
+
+// writeJSON encodes out as the JSON response body. out is marshaled before anything is written so that a marshaling
+// error results in a 500 rather than a truncated body.
+func (api *v2api) writeJSON(w http.ResponseWriter, r *http.Request, out interface{}) {
+	b, err := json.Marshal(out)
 	if err != nil {
-		api.rlogger(r).Logf("error creating api key: %v", err)
+		api.rlogger(r).Logf("error marshaling response: %v", err)
 		w.WriteHeader(http.StatusInternalServerError)
 		return
 	}
-	resp := V2UserAPIKeyResponse{
-		User:  uis.GitHubUser,
-		Token: keyID,
-	}
-	w.WriteHeader(http.StatusCreated)
 	w.Header().Set("Content-Type", "application/json")
-	if err := json.NewEncoder(w).Encode(&resp); err != nil {
-		api.rlogger(r).Logf("error marshaling new user token: %v", err)
-		w.WriteHeader(http.StatusBadRequest)
-	}
+	w.WriteHeader(http.StatusOK)
+	w.Write(append(b, '\n'))
 }
 
-type V2UserAPIKeyData struct {
-	ID          uuid.UUID              `json:"id"`
-	Created     time.Time              `json:"created"`
-	LastUsed    pq.NullTime            `json:"last_used"`
-	Permission  models.PermissionLevel `json:"permission"`
-	Description string                 `json:"description"`
-	User        string                 `json:"user"`
+type V2EnvWorkload struct {
+	Name            string   `json:"name"`
+	Replicas        int32    `json:"replicas"`
+	ReadyReplicas   int32    `json:"ready_replicas"`
+	UpdatedReplicas int32    `json:"updated_replicas"`
+	Ready           bool     `json:"ready"`
+	Restarts        int32    `json:"restarts"`
+	Images          []string `json:"images"`
+	Age             string   `json:"age"`
 }
 
-func (api *v2api) apiKeysHandler(w http.ResponseWriter, r *http.Request) {
-	uis, err := getSessionFromContext(r.Context())
-	if err != nil {
-		api.rlogger(r).Logf("session missing from context")
-		w.WriteHeader(http.StatusBadRequest)
-		return
+func v2EnvWorkloadsFromK8sWorkloads(wl []metahelm.K8sWorkload) []V2EnvWorkload {
+	out := make([]V2EnvWorkload, 0, len(wl))
+	for _, w := range wl {
+		out = append(out, V2EnvWorkload{
+			Name:            w.Name,
+			Replicas:        w.Replicas,
+			ReadyReplicas:   w.ReadyReplicas,
+			UpdatedReplicas: w.UpdatedReplicas,
+			Ready:           w.Ready,
+			Restarts:        w.Restarts,
+			Images:          w.Images,
+			Age:             w.Age.Round(time.Second).String(),
+		})
 	}
-	apikeys, err := api.dl.GetAPIKeysByGithubUser(r.Context(), uis.GitHubUser)
-	if err != nil {
-		api.rlogger(r).Logf("error getting api keys from db: %v", err)
-		w.WriteHeader(http.StatusInternalServerError)
+	return out
+}
+
+// userEnvDeploymentsHandler returns the Deployments in the environment namespace
+func (api *v2api) userEnvDeploymentsHandler(w http.ResponseWriter, r *http.Request) {
+	k8senv, ok := api.userEnvK8sEnv(w, r)
+	if !ok {
 		return
 	}
-	if len(apikeys) == 0 {
-		w.WriteHeader(http.StatusNotFound)
-		return
+	out := []V2EnvWorkload{}
+	if k8senv != nil {
+		dl, err := api.kr.GetDeployments(r.Context(), k8senv.Namespace)
+		if err != nil {
+			api.rlogger(r).Logf("error getting deployments for k8s env: %v", err)
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		out = v2EnvWorkloadsFromK8sWorkloads(dl)
 	}
-	if uis.GitHubUser != apikeys[0].GitHubUser {
-		api.rlogger(r).Logf("action not authorized by user: %v", uis.GitHubUser)
-		w.WriteHeader(http.StatusUnauthorized)
+	api.writeJSON(w, r, &out)
+}
+
+// userEnvStatefulSetsHandler returns the StatefulSets in the environment namespace
+func (api *v2api) userEnvStatefulSetsHandler(w http.ResponseWriter, r *http.Request) {
+	k8senv, ok := api.userEnvK8sEnv(w, r)
+	if !ok {
 		return
 	}
-	v2uakds := make([]V2UserAPIKeyData, 0, len(apikeys))
-	for _, apikey := range apikeys {
-		v2uakds = append(v2uakds, V2UserAPIKeyData{
-			ID:          apikey.ID,
-			Created:     apikey.Created,
-			LastUsed:    apikey.LastUsed,
-			Permission:  apikey.PermissionLevel,
-			Description: apikey.Description,
-			User:        apikey.GitHubUser,
-		})
-	}
-	w.Header().Set("Content-Type", "application/json")
-	if err := json.NewEncoder(w).Encode(&v2uakds); err != nil {
-		api.rlogger(r).Logf("error marshaling new user token: %v", err)
-		w.WriteHeader(http.StatusInternalServerError)
+	out := []V2EnvWorkload{}
+	if k8senv != nil {
+		ssl, err := api.kr.GetStatefulSets(r.Context(), k8senv.Namespace)
+		if err != nil {
+			api.rlogger(r).Logf("error getting statefulsets for k8s env: %v", err)
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		out = v2EnvWorkloadsFromK8sWorkloads(ssl)
 	}
+	api.writeJSON(w, r, &out)
 }
 
-func (api *v2api) apiKeyDestroyHandler(w http.ResponseWriter, r *http.Request) {
-	uis, err := getSessionFromContext(r.Context())
-	if err != nil {
-		api.rlogger(r).Logf("session missing from context")
-		w.WriteHeader(http.StatusBadRequest)
+type V2EnvService struct {
+	Name              string   `json:"name"`
+	Type              string   `json:"type"`
+	ClusterIP         string   `json:"cluster_ip"`
+	Ports             []string `json:"ports"`
+	ReadyEndpoints    int      `json:"ready_endpoints"`
+	NotReadyEndpoints int      `json:"not_ready_endpoints"`
+	Ready             bool     `json:"ready"`
+	Age               string   `json:"age"`
+}
+
+// userEnvServicesHandler returns the Services in the environment namespace
+func (api *v2api) userEnvServicesHandler(w http.ResponseWriter, r *http.Request) {
+	k8senv, ok := api.userEnvK8sEnv(w, r)
+	if !ok {
 		return
 	}
-	id := mux.Vars(r)["id"]
-	if id == "" {
-		api.rlogger(r).Logf("error token id required")
-		w.WriteHeader(http.StatusBadRequest)
-		return
+	out := []V2EnvService{}
+	if k8senv != nil {
+		sl, err := api.kr.GetServices(r.Context(), k8senv.Namespace)
+		if err != nil {
+			api.rlogger(r).Logf("error getting services for k8s env: %v", err)
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		for _, s := range sl {
+			out = append(out, V2EnvService{
+				Name:              s.Name,
+				Type:              s.Type,
+				ClusterIP:         s.ClusterIP,
+				Ports:             s.Ports,
+				ReadyEndpoints:    s.ReadyEndpoints,
+				NotReadyEndpoints: s.NotReadyEndpoints,
+				Ready:             s.Ready,
+				Age:               s.Age.Round(time.Second).String(),
+			})
+		}
 	}
-	keyID, err := uuid.Parse(id)
-	if err != nil {
-		api.rlogger(r).Logf("error parsing user token: %v", err)
-		w.WriteHeader(http.StatusForbidden)
+	api.writeJSON(w, r, &out)
+}
+
+type V2EnvIngress struct {
+	Name      string   `json:"name"`
+	Hosts     []string `json:"hosts"`
+	Addresses []string `json:"addresses"`
+	Ready     bool     `json:"ready"`
+	Age       string   `json:"age"`
+}
+
+// userEnvIngressesHandler returns the Ingresses in the environment namespace
+func (api *v2api) userEnvIngressesHandler(w http.ResponseWriter, r *http.Request) {
+	k8senv, ok := api.userEnvK8sEnv(w, r)
+	if !ok {
 		return
 	}
-	apikey, err := api.dl.GetAPIKeyByID(r.Context(), keyID)
-	if err != nil {
+	out := []V2EnvIngress{}
+	if k8senv != nil {
+		il, err := api.kr.GetIngresses(r.Context(), k8senv.Namespace)
+		if err != nil {
+			api.rlogger(r).Logf("error getting ingresses for k8s env: %v", err)
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		for _, i := range il {
+			out = append(out, V2EnvIngress{
+				Name:      i.Name,
+				Hosts:     i.Hosts,
+				Addresses: i.Addresses,
+				Ready:     i.Ready,
+				Age:       i.Age.Round(time.Second).String(),
+			})
+		}
+	}
+	api.writeJSON(w, r, &out)
+}
+
+type V2EnvJob struct {
+	Name        string `json:"name"`
+	Completions int32  `json:"completions"`
+	Active      int32  `json:"active"`
+	Succeeded   int32  `json:"succeeded"`
+	Failed      int32  `json:"failed"`
+	Ready       bool   `json:"ready"`
+	Restarts    int32  `json:"restarts"`
+	Age         string `json:"age"`
+}
+
+// userEnvJobsHandler returns the Jobs in the environment namespace. A job is reported as ready once it has completed.
+func (api *v2api) userEnvJobsHandler(w http.ResponseWriter, r *http.Request) {
+	k8senv, ok := api.userEnvK8sEnv(w, r)
+	if !ok {
+		return
+	}
+	out := []V2EnvJob{}
+	if k8senv != nil {
+		jl, err := api.kr.GetJobs(r.Context(), k8senv.Namespace)
+		if err != nil {
+			api.rlogger(r).Logf("error getting jobs for k8s env: %v", err)
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		for _, j := range jl {
+			out = append(out, V2EnvJob{
+				Name:        j.Name,
+				Completions: j.Completions,
+				Active:      j.Active,
+				Succeeded:   j.Succeeded,
+				Failed:      j.Failed,
+				Ready:       j.Complete,
+				Restarts:    j.Restarts,
+				Age:         j.Age.Round(time.Second).String(),
+			})
+		}
+	}
+	api.writeJSON(w, r, &out)
+}
+
+type V2EnvEvent struct {
+	Type      string     `json:"type"`
+	Reason    string     `json:"reason"`
+	Object    string     `json:"object"`
+	Message   string     `json:"message"`
+	Count     int32      `json:"count"`
+	FirstSeen *time.Time `json:"first_seen"`
+	LastSeen  *time.Time `json:"last_seen"`
+}
+
+// userEnvEventsHandler returns the Events in the environment namespace, most recent first.
+// The optional "type" query parameter filters by event type (ex: "Warning").
+func (api *v2api) userEnvEventsHandler(w http.ResponseWriter, r *http.Request) {
+	k8senv, ok := api.userEnvK8sEnv(w, r)
+	if !ok {
+		return
+	}
+	out := []V2EnvEvent{}
+	if k8senv != nil {
+		el, err := api.kr.GetEvents(r.Context(), k8senv.Namespace)
+		if err != nil {
+			api.rlogger(r).Logf("error getting events for k8s env: %v", err)
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		etype := r.URL.Query().Get("type")
+		for _, e := range el {
+			if etype != "" && e.Type != etype {
+				continue
+			}
+			out = append(out, V2EnvEvent{
+				Type:      e.Type,
+				Reason:    e.Reason,
+				Object:    e.Object,
+				Message:   e.Message,
+				Count:     e.Count,
+				FirstSeen: timeOrNil(e.FirstSeen),
+				LastSeen:  timeOrNil(e.LastSeen),
+			})
+		}
+	}
+	api.writeJSON(w, r, &out)
+}
+
+type V2PodLogStreamLine struct {
+	Container string `json:"container"`
+	Line      string `json:"line,omitempty"`
+	Error     string `json:"error,omitempty"`
+}
+
+// writeSSEEvent writes a single Server-Sent Event with a JSON data payload and flushes it to the client
+func writeSSEEvent(w http.ResponseWriter, f http.Flusher, event string, data interface{}) error {
+	j, err := json.Marshal(data)
+	if err != nil {
+		return errors.Wrap(err, "error marshaling event data")
+	}
+	if _, err := fmt.Fprintf(w, "event: %v\ndata: %s\n\n", event, j); err != nil {
+		return errors.Wrap(err, "error writing event")
+	}
+	f.Flush()
+	return nil
+}
+
+// userEnvPodLogsStreamHandler streams logs for the specified env and pod name as Server-Sent Events.
+// Query parameters:
+// container: container name (may be repeated; default is all containers in the pod)
+// lines: number of existing lines to return per container before following
+// timestamps: "true" to prefix lines with timestamps
+// previous: "true" to return logs from the previous (crashed) container instance
+// follow: "false" to close the stream after the existing lines are returned
+func (api *v2api) userEnvPodLogsStreamHandler(w http.ResponseWriter, r *http.Request) {
+	podname := mux.Vars(r)["pod"]
+	if podname == "" {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		api.rlogger(r).Logf("response writer does not support streaming")
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	k8senv, ok := api.userEnvK8sEnv(w, r)
+	if !ok {
+		return
+	}
+	if k8senv == nil {
+		api.rlogger(r).Logf("k8s env not found")
+		w.WriteHeader(http.StatusPreconditionFailed)
+		return
+	}
+	opts := metahelm.PodLogStreamOptions{
+		Containers: r.URL.Query()["container"],
+		Lines:      DefaultPodContainerLogLines,
+		Timestamps: r.URL.Query().Get("timestamps") == "true",
+		Previous:   r.URL.Query().Get("previous") == "true",
+		Follow:     r.URL.Query().Get("follow") != "false",
+	}
+	if l := r.URL.Query().Get("lines"); l != "" {
+		i, err := strconv.Atoi(l)
+		if err != nil {
+			api.rlogger(r).Logf("error converting line to integer: %v", err)
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		if i < 0 || i > metahelm.MaxPodContainerLogLines {
+			api.rlogger(r).Logf("error requested lines exceed limit: %v", i)
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		opts.Lines = uint(i)
+	}
+	// the request context is cancelled when the client disconnects
+	ctx, cf := context.WithTimeout(r.Context(), MaxPodLogStreamDuration)
+	defer cf()
+	lines, err := api.kr.StreamPodLogs(ctx, k8senv.Namespace, podname, opts)
+	if err != nil {
+		api.rlogger(r).Logf("error streaming logs for pod %v: %v", podname, err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Connection", "keep-alive")
+	w.Header().Set("X-Accel-Buffering", "no")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+	keepalive := time.NewTicker(PodLogStreamKeepaliveInterval)
+	defer keepalive.Stop()
+	for {
+		select {
+		case l, ok := <-lines:
+			if !ok {
+				writeSSEEvent(w, flusher, "end", struct{}{})
+				return
+			}
+			event, data := "log", V2PodLogStreamLine{Container: l.Container, Line: l.Line}
+			if l.Err != nil {
+				event, data = "stream_error", V2PodLogStreamLine{Container: l.Container, Error: l.Err.Error()}
+			}
+			if err := writeSSEEvent(w, flusher, event, data); err != nil {
+				api.rlogger(r).Logf("error writing pod log stream: %v", err)
+				return
+			}
+		case <-keepalive.C:
+			if _, err := io.WriteString(w, ": keepalive\n\n"); err != nil {
+				api.rlogger(r).Logf("error writing pod log stream keepalive: %v", err)
+				return
+			}
+			flusher.Flush()
+		case <-ctx.Done():
+			if ctx.Err() == context.DeadlineExceeded {
+				writeSSEEvent(w, flusher, "timeout", struct{}{})
+			}
+			return
+		}
+	}
+}
+
+type v2CreateUserAPIKey struct {
+	Permission  models.PermissionLevel `json:"permission"`
+	Description string                 `json:"description"`
+}
+
+type V2UserAPIKeyResponse struct {
+	User  string    `json:"user"`
+	Token uuid.UUID `json:"token"`
+}
+
+func (api *v2api) apiKeyCreateHandler(w http.ResponseWriter, r *http.Request) {
+	uis, err := getSessionFromContext(r.Context())
+	if err != nil {
+		api.rlogger(r).Logf("session missing from context")
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	existingKeys, err := api.dl.GetAPIKeysByGithubUser(r.Context(), uis.GitHubUser)
+	if err != nil {
+		api.rlogger(r).Logf("error getting api keys from db: %v", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	if len(existingKeys) >= MaxAPIKeysLimit {
+		api.rlogger(r).Logf("error api keys limit (%v) reached", MaxAPIKeysLimit)
+		w.WriteHeader(http.StatusTooManyRequests)
+		return
+	}
+	reqParams := v2CreateUserAPIKey{}
+	err = json.NewDecoder(r.Body).Decode(&reqParams)
+	if err != nil {
+		api.rlogger(r).Logf("error unmarshaling body: %v", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	if reqParams.Permission < MinAPIKeyPermissionLevel || reqParams.Permission > MaxAPIKeyPermissionLevel {
+		api.rlogger(r).Logf("error token permission level invalid")
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	keyID, err := api.dl.CreateAPIKey(r.Context(), models.PermissionLevel(reqParams.Permission), reqParams.Description, uis.GitHubUser)
+	if err != nil {
+		api.rlogger(r).Logf("error creating api key: %v", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	resp := V2UserAPIKeyResponse{
+		User:  uis.GitHubUser,
+		Token: keyID,
+	}
+	w.WriteHeader(http.StatusCreated)
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(&resp); err != nil {
+		api.rlogger(r).Logf("error marshaling new user token: %v", err)
+		w.WriteHeader(http.StatusBadRequest)
+	}
+}
+
+type V2UserAPIKeyData struct {
+	ID          uuid.UUID              `json:"id"`
+	Created     time.Time              `json:"created"`
+	LastUsed    pq.NullTime            `json:"last_used"`
+	Permission  models.PermissionLevel `json:"permission"`
+	Description string                 `json:"description"`
+	User        string                 `json:"user"`
+}
+
+func (api *v2api) apiKeysHandler(w http.ResponseWriter, r *http.Request) {
+	uis, err := getSessionFromContext(r.Context())
+	if err != nil {
+		api.rlogger(r).Logf("session missing from context")
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	apikeys, err := api.dl.GetAPIKeysByGithubUser(r.Context(), uis.GitHubUser)
+	if err != nil {
+		api.rlogger(r).Logf("error getting api keys from db: %v", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	if len(apikeys) == 0 {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	if uis.GitHubUser != apikeys[0].GitHubUser {
+		api.rlogger(r).Logf("action not authorized by user: %v", uis.GitHubUser)
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+	v2uakds := make([]V2UserAPIKeyData, 0, len(apikeys))
+	for _, apikey := range apikeys {
+		v2uakds = append(v2uakds, V2UserAPIKeyData{
+			ID:          apikey.ID,
+			Created:     apikey.Created,
+			LastUsed:    apikey.LastUsed,
+			Permission:  apikey.PermissionLevel,
+			Description: apikey.Description,
+			User:        apikey.GitHubUser,
+		})
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(&v2uakds); err != nil {
+		api.rlogger(r).Logf("error marshaling new user token: %v", err)
+		w.WriteHeader(http.StatusInternalServerError)
+	}
+}
+
+func (api *v2api) apiKeyDestroyHandler(w http.ResponseWriter, r *http.Request) {
+	uis, err := getSessionFromContext(r.Context())
+	if err != nil {
+		api.rlogger(r).Logf("session missing from context")
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	id := mux.Vars(r)["id"]
+	if id == "" {
+		api.rlogger(r).Logf("error token id required")
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	keyID, err := uuid.Parse(id)
+	if err != nil {
+		api.rlogger(r).Logf("error parsing user token: %v", err)
+		w.WriteHeader(http.StatusForbidden)
+		return
+	}
+	apikey, err := api.dl.GetAPIKeyByID(r.Context(), keyID)
+	if err != nil {
 		api.rlogger(r).Logf("error getting api key from db: %v", err)
 		w.WriteHeader(http.StatusInternalServerError)
 		return
@@ -1242,3 +1959,948 @@ func (api *v2api) apiKeyDestroyHandler(w http.ResponseWriter, r *http.Request) {
 	}
 	w.WriteHeader(http.StatusNoContent)
 }
+
+// proxyToService proxies the request to the service and port in the request route within the k8s env namespace.
+// The route path variable is used as the path on the service.
+func (api *v2api) proxyToService(w http.ResponseWriter, r *http.Request, k8senv *models.KubernetesEnvironment) {
+	if k8senv == nil {
+		api.rlogger(r).Logf("k8s env not found")
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	vars := mux.Vars(r)
+	h, err := api.kr.ServiceProxy(k8senv.Namespace, vars["service"], vars["port"])
+	if err != nil {
+		api.rlogger(r).Logf("error getting service proxy: %v", err)
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	r2 := r.Clone(r.Context())
+	r2.URL.Path = "/" + vars["path"]
+	r2.URL.RawPath = ""
+	api.rlogger(r).Logf("proxying %v request to %v/%v:%v", r.Method, k8senv.Namespace, vars["service"], vars["port"])
+	h.ServeHTTP(w, r2)
+}
+
+func (api *v2api) envServiceProxyHandler(w http.ResponseWriter, r *http.Request) {
+	qa, ok := r.Context().Value(qaEnvCtxKey).(models.QAEnvironment)
+	if !ok {
+		api.internalError(w, fmt.Errorf("unexpected qa env type from context: %T", qa))
+		return
+	}
+	k8senv, err := api.dl.GetK8sEnv(r.Context(), qa.Name)
+	if err != nil {
+		api.rlogger(r).Logf("error getting k8s env from db: %v", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	api.proxyToService(w, r, k8senv)
+}
+
+func (api *v2api) userEnvServiceProxyHandler(w http.ResponseWriter, r *http.Request) {
+	k8senv, ok := api.userEnvK8sEnvWithAccess(w, r, true)
+	if !ok {
+		return
+	}
+	api.proxyToService(w, r, k8senv)
+}
+
+// envAction runs the hibernate, wake, retry or destroy action asynchronously for qae with a new event log, writing 201 if the action was started.
+// If qae doesn't have status from, 409 is written.
+func (api *v2api) envAction(w http.ResponseWriter, r *http.Request, qae *models.QAEnvironment, action string, from models.EnvironmentStatus) {
+	var af func(context.Context, string) error
+	op := models.QueuedOperation{}
+	switch action {
+	case "hibernate":
+		af = api.es.Hibernate
+		op.Action = models.HibernateOperationAction
+	case "wake":
+		af = api.es.Wake
+		op.Action = models.WakeOperationAction
+	case "retry":
+		af = api.es.RetryFailed
+		op.Action = models.RetryFailedOperationAction
+	case "destroy":
+		af = func(ctx context.Context, _ string) error {
+			return api.es.DestroyExplicitly(ctx, qae, models.DestroyApiRequest)
+		}
+		op.Action = models.DestroyOperationAction
+	default:
+		api.rlogger(r).Logf("unknown env action: %v", action)
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	if qae.Status != from {
+		api.rlogger(r).Logf("cannot %v env with status %v", action, qae.Status)
+		w.WriteHeader(http.StatusConflict)
+		return
+	}
+	api.startEnvAction(w, r, qae, action, op, af)
+}
+
+// startEnvAction runs the operation op (or af, if the durable operation queue is disabled) asynchronously for qae with a
+// new event log, writing 201 with the event log ID
+func (api *v2api) startEnvAction(w http.ResponseWriter, r *http.Request, qae *models.QAEnvironment, action string, op models.QueuedOperation, af func(context.Context, string) error) {
+	id, err := uuid.NewRandom()
+	if err != nil {
+		api.rlogger(r).Logf("error getting random UUID: %v", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	elogger := &eventlogger.Logger{
+		ID:         id,
+		DeliveryID: uuid.Nil,
+		DL:         api.dl,
+		Sink:       os.Stdout,
+	}
+	if err := elogger.Init([]byte{}, qae.Repo, qae.PullRequest); err != nil {
+		api.rlogger(r).Logf("error initializing event logger: %v", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	if err := elogger.SetEnvName(qae.Name); err != nil {
+		api.rlogger(r).Logf("error setting event logger name: %v", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	ctx := eventlogger.NewEventLoggerContext(context.Background(), elogger)
+	ctx = ncontext.NewCancelFuncContext(context.WithCancel(ctx))
+	span := tracer.StartSpan("actions_" + action)
+	span.SetTag(ext.SamplingPriority, ext.PriorityUserKeep)
+	ctx = tracer.ContextWithSpan(ctx, span)
+
+	op.RepoRevisionData = *qae.RepoRevisionDataFromQA()
+	op.Params.EnvName = qae.Name
+	if err := api.startOperation(ctx, span, &op, func(ctx context.Context) error {
+		return af(ctx, qae.Name)
+	}); err != nil {
+		api.internalError(w, err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(map[string]string{"event_id": id.String()})
+}
+
+func (api *v2api) envActionsHibernateHandler(w http.ResponseWriter, r *http.Request) {
+	qa, ok := r.Context().Value(qaEnvCtxKey).(models.QAEnvironment)
+	if !ok {
+		api.internalError(w, fmt.Errorf("unexpected qa env type from context: %T", qa))
+		return
+	}
+	api.envAction(w, r, &qa, "hibernate", models.Success)
+}
+
+func (api *v2api) envActionsWakeHandler(w http.ResponseWriter, r *http.Request) {
+	qa, ok := r.Context().Value(qaEnvCtxKey).(models.QAEnvironment)
+	if !ok {
+		api.internalError(w, fmt.Errorf("unexpected qa env type from context: %T", qa))
+		return
+	}
+	api.envAction(w, r, &qa, "wake", models.Hibernated)
+}
+
+// envActionsRetryHandler retries the failed charts of a failed environment
+func (api *v2api) envActionsRetryHandler(w http.ResponseWriter, r *http.Request) {
+	qa, ok := r.Context().Value(qaEnvCtxKey).(models.QAEnvironment)
+	if !ok {
+		api.internalError(w, fmt.Errorf("unexpected qa env type from context: %T", qa))
+		return
+	}
+	api.envAction(w, r, &qa, "retry", models.Failure)
+}
+
+// V2EnvRevision models a previous successful deployment of an environment
+type V2EnvRevision struct {
+	ID           int64                       `json:"id"`
+	Created      time.Time                   `json:"created"`
+	Current      bool                        `json:"current"` // whether the commits of the revision are currently deployed
+	RefMap       map[string]string           `json:"ref_map"`
+	CommitSHAMap map[string]string           `json:"commit_sha_map"`
+	HelmReleases models.HelmReleaseRevisions `json:"helm_releases"`
+}
+
+func (api *v2api) envRevisionsHandler(w http.ResponseWriter, r *http.Request) {
+	qa, ok := r.Context().Value(qaEnvCtxKey).(models.QAEnvironment)
+	if !ok {
+		api.internalError(w, fmt.Errorf("unexpected qa env type from context: %T", qa))
+		return
+	}
+	revs, err := api.dl.GetEnvironmentRevisions(r.Context(), qa.Name)
+	if err != nil {
+		api.internalError(w, fmt.Errorf("error getting environment revisions: %w", err))
+		return
+	}
+	out := make([]V2EnvRevision, len(revs))
+	for i, rev := range revs {
+		out[i] = V2EnvRevision{
+			ID:           rev.ID,
+			Created:      rev.Created,
+			Current:      rev.Matches(qa.CommitSHAMap),
+			RefMap:       rev.RefMap,
+			CommitSHAMap: rev.CommitSHAMap,
+			HelmReleases: rev.HelmReleases,
+		}
+	}
+	api.writeJSON(w, r, &out)
+}
+
+// rollbackEnv asynchronously rolls back qae to the revision in the optional "revision" query parameter, or to the previous
+// successful revision if it is omitted. 404 is written if the requested revision doesn't exist and 409 if the environment
+// can't be rolled back in its current status or has no previous revision.
+func (api *v2api) rollbackEnv(w http.ResponseWriter, r *http.Request, qae *models.QAEnvironment) {
+	var id int64
+	if rs := r.URL.Query().Get("revision"); rs != "" {
+		var err error
+		id, err = strconv.ParseInt(rs, 10, 64)
+		if err != nil || id < 1 {
+			api.badRequestError(w, fmt.Errorf("invalid revision: %v", rs))
+			return
+		}
+	}
+	switch qae.Status {
+	case models.Success, models.Failure, models.Hibernated:
+	default:
+		api.rlogger(r).Logf("cannot roll back env with status %v", qae.Status)
+		w.WriteHeader(http.StatusConflict)
+		return
+	}
+	revs, err := api.dl.GetEnvironmentRevisions(r.Context(), qae.Name)
+	if err != nil {
+		api.internalError(w, fmt.Errorf("error getting environment revisions: %w", err))
+		return
+	}
+	rev, err := models.RollbackRevision(revs, qae.CommitSHAMap, id)
+	if err != nil {
+		api.rlogger(r).Logf("error selecting rollback revision: %v", err)
+		if id != 0 {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		w.WriteHeader(http.StatusConflict)
+		return
+	}
+	op := models.QueuedOperation{
+		Action: models.RollbackOperationAction,
+		Params: models.OperationParams{Revision: rev.ID},
+	}
+	api.startEnvAction(w, r, qae, "rollback", op, func(ctx context.Context, name string) error {
+		return api.es.Rollback(ctx, name, rev.ID)
+	})
+}
+
+func (api *v2api) envActionsRollbackHandler(w http.ResponseWriter, r *http.Request) {
+	qa, ok := r.Context().Value(qaEnvCtxKey).(models.QAEnvironment)
+	if !ok {
+		api.internalError(w, fmt.Errorf("unexpected qa env type from context: %T", qa))
+		return
+	}
+	api.rollbackEnv(w, r, &qa)
+}
+
+// userEnvActionsRollbackHandler rolls back the environment from the UI
+func (api *v2api) userEnvActionsRollbackHandler(w http.ResponseWriter, r *http.Request) {
+	qae, ok := api.userEnvWritable(w, r)
+	if !ok {
+		return
+	}
+	api.rollbackEnv(w, r, qae)
+}
+
+// userEnvWritable returns the QA environment for the env name in the request route if the session user has write access
+// to the env repo. If ok is false, an error status code has already been written to w.
+func (api *v2api) userEnvWritable(w http.ResponseWriter, r *http.Request) (qae *models.QAEnvironment, ok bool) {
+	return api.userEnvWritableByName(w, r, mux.Vars(r)["name"])
+}
+
+// userEnvWritableByName is userEnvWritable for the env envname
+func (api *v2api) userEnvWritableByName(w http.ResponseWriter, r *http.Request, envname string) (qae *models.QAEnvironment, ok bool) {
+	uis, err := getSessionFromContext(r.Context())
+	if err != nil {
+		api.rlogger(r).Logf("session missing from context")
+		w.WriteHeader(http.StatusBadRequest)
+		return nil, false
+	}
+	if envname == "" {
+		w.WriteHeader(http.StatusBadRequest)
+		return nil, false
+	}
+	qae, err = api.dl.GetQAEnvironment(r.Context(), envname)
+	if err != nil {
+		api.rlogger(r).Logf("error getting qa env from db: %v", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return nil, false
+	}
+	if qae == nil {
+		api.rlogger(r).Logf("qa env not found")
+		w.WriteHeader(http.StatusNotFound)
+		return nil, false
+	}
+	repos, err := userPermissionsClient(api.oauth, qae.Repo).GetUserWritableRepos(r.Context(), uis)
+	if err != nil {
+		api.rlogger(r).Logf("error getting user writable repos: %v", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return nil, false
+	}
+	if _, ok := repos[qae.Repo]; !ok {
+		api.rlogger(r).Logf("user writable repo not found")
+		w.WriteHeader(http.StatusForbidden)
+		return nil, false
+	}
+	return qae, true
+}
+
+// apiKeyRepoAccess checks that the GitHub user of the API key in the request context has pull permissions on repo (push permissions
+// if write is set), writing 403 and returning false otherwise. Admin keys have access to all repos.
+func (api *v2api) apiKeyRepoAccess(w http.ResponseWriter, r *http.Request, repo string, write bool) bool {
+	apikey, ok := r.Context().Value(apiKeyCtxKey).(models.APIKey)
+	if !ok {
+		api.internalError(w, fmt.Errorf("unexpected api key type from context: %T", apikey))
+		return false
+	}
+	if apikey.PermissionLevel == models.AdminPermission {
+		return true
+	}
+	if api.rpc == nil || apikey.GitHubUser == "" {
+		api.rlogger(r).Logf("repo permissions unavailable for api key user")
+		w.WriteHeader(http.StatusForbidden)
+		return false
+	}
+	perms, err := api.rpc.GetUserRepoPermissions(r.Context(), repo, apikey.GitHubUser)
+	if err != nil {
+		api.rlogger(r).Logf("error getting user repo permissions: %v", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return false
+	}
+	if !perms.Pull || (write && !perms.Push) {
+		api.rlogger(r).Logf("user %v lacks access to repo %v (write: %v)", apikey.GitHubUser, repo, write)
+		w.WriteHeader(http.StatusForbidden)
+		return false
+	}
+	return true
+}
+
+// userEnvActionsRetryHandler retries the failed charts of a failed environment from the UI
+func (api *v2api) userEnvActionsRetryHandler(w http.ResponseWriter, r *http.Request) {
+	qae, ok := api.userEnvWritable(w, r)
+	if !ok {
+		return
+	}
+	api.envAction(w, r, qae, "retry", models.Failure)
+}
+
+// userEnvActionsHibernateHandler scales the environment to zero from the UI
+func (api *v2api) userEnvActionsHibernateHandler(w http.ResponseWriter, r *http.Request) {
+	qae, ok := api.userEnvWritable(w, r)
+	if !ok {
+		return
+	}
+	api.envAction(w, r, qae, "hibernate", models.Success)
+}
+
+// userEnvActionsWakeHandler restores a hibernated environment from the UI
+func (api *v2api) userEnvActionsWakeHandler(w http.ResponseWriter, r *http.Request) {
+	qae, ok := api.userEnvWritable(w, r)
+	if !ok {
+		return
+	}
+	api.envAction(w, r, qae, "wake", models.Hibernated)
+}
+
+// defaultExpirationExtension is used if the extend request doesn't specify a duration
+var defaultExpirationExtension = 24 * time.Hour
+
+type V2ExpirationExtension struct {
+	ExpiresAt time.Time `json:"expires_at"`
+}
+
+// extendExpiration postpones the expiration of qae by the duration in the "duration" query parameter (default 24h) and writes the new expiration
+func (api *v2api) extendExpiration(w http.ResponseWriter, r *http.Request, qae *models.QAEnvironment) {
+	d := defaultExpirationExtension
+	if ds := r.URL.Query().Get("duration"); ds != "" {
+		pd, err := time.ParseDuration(ds)
+		if err != nil || pd <= 0 {
+			api.rlogger(r).Logf("invalid duration: %v", ds)
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		d = pd
+	}
+	expires, err := api.es.ExtendExpiration(r.Context(), qae.Name, d)
+	if err != nil {
+		api.rlogger(r).Logf("error extending expiration: %v", err)
+		if nitroerrors.IsUserError(err) {
+			w.WriteHeader(http.StatusConflict)
+			return
+		}
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	api.rlogger(r).Logf("extended expiration of %v by %v to %v", qae.Name, d, expires)
+	api.writeJSON(w, r, V2ExpirationExtension{ExpiresAt: expires})
+}
+
+func (api *v2api) envActionsExtendHandler(w http.ResponseWriter, r *http.Request) {
+	qa, ok := r.Context().Value(qaEnvCtxKey).(models.QAEnvironment)
+	if !ok {
+		api.internalError(w, fmt.Errorf("unexpected qa env type from context: %T", qa))
+		return
+	}
+	api.extendExpiration(w, r, &qa)
+}
+
+// userEnvActionsExtendHandler postpones the expiration of the environment from the UI
+func (api *v2api) userEnvActionsExtendHandler(w http.ResponseWriter, r *http.Request) {
+	qae, ok := api.userEnvWritable(w, r)
+	if !ok {
+		return
+	}
+	api.extendExpiration(w, r, qae)
+}
+
+type V2PinStatus struct {
+	Pinned      bool       `json:"pinned"`
+	PinReason   string     `json:"pin_reason"`
+	PinnedUntil *time.Time `json:"pinned_until"`
+}
+
+// setPin pins (with the optional "reason" and "duration" query parameters) or unpins qae and writes the resulting pin status
+func (api *v2api) setPin(w http.ResponseWriter, r *http.Request, qae *models.QAEnvironment, pin bool) {
+	var err error
+	if pin {
+		var until *time.Time
+		if ds := r.URL.Query().Get("duration"); ds != "" {
+			d, err := time.ParseDuration(ds)
+			if err != nil || d <= 0 {
+				api.rlogger(r).Logf("invalid duration: %v", ds)
+				w.WriteHeader(http.StatusBadRequest)
+				return
+			}
+			t := time.Now().UTC().Add(d)
+			until = &t
+		}
+		err = api.es.Pin(r.Context(), qae.Name, r.URL.Query().Get("reason"), until)
+	} else {
+		err = api.es.Unpin(r.Context(), qae.Name)
+	}
+	if err != nil {
+		api.rlogger(r).Logf("error setting pin: %v", err)
+		if nitroerrors.IsUserError(err) {
+			w.WriteHeader(http.StatusConflict)
+			return
+		}
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	qae, err = api.dl.GetQAEnvironment(r.Context(), qae.Name)
+	if err != nil || qae == nil {
+		api.rlogger(r).Logf("error getting qa env from db: %v", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	api.writeJSON(w, r, V2PinStatus{Pinned: qae.Pinned, PinReason: qae.PinReason, PinnedUntil: qae.PinnedUntil})
+}
+
+func (api *v2api) envActionsPinHandler(w http.ResponseWriter, r *http.Request) {
+	qa, ok := r.Context().Value(qaEnvCtxKey).(models.QAEnvironment)
+	if !ok {
+		api.internalError(w, fmt.Errorf("unexpected qa env type from context: %T", qa))
+		return
+	}
+	api.setPin(w, r, &qa, true)
+}
+
+func (api *v2api) envActionsUnpinHandler(w http.ResponseWriter, r *http.Request) {
+	qa, ok := r.Context().Value(qaEnvCtxKey).(models.QAEnvironment)
+	if !ok {
+		api.internalError(w, fmt.Errorf("unexpected qa env type from context: %T", qa))
+		return
+	}
+	api.setPin(w, r, &qa, false)
+}
+
+// userEnvActionsPinHandler pins the environment from the UI
+func (api *v2api) userEnvActionsPinHandler(w http.ResponseWriter, r *http.Request) {
+	qae, ok := api.userEnvWritable(w, r)
+	if !ok {
+		return
+	}
+	api.setPin(w, r, qae, true)
+}
+
+// userEnvActionsUnpinHandler unpins the environment from the UI
+func (api *v2api) userEnvActionsUnpinHandler(w http.ResponseWriter, r *http.Request) {
+	qae, ok := api.userEnvWritable(w, r)
+	if !ok {
+		return
+	}
+	api.setPin(w, r, qae, false)
+}
+
+type V2QuotaUsage struct {
+	Scope       string `json:"scope"`
+	Name        string `json:"name"`
+	MaxRunning  uint   `json:"max_running"`
+	MaxBuilding uint   `json:"max_building"`
+	Running     uint   `json:"running"`
+	Building    uint   `json:"building"`
+}
+
+// quotasHandler returns current usage against all configured quotas (admin only)
+func (api *v2api) quotasHandler(w http.ResponseWriter, r *http.Request) {
+	envs, err := api.dl.GetRunningQAEnvironments(r.Context())
+	if err != nil {
+		api.internalError(w, fmt.Errorf("error getting running environments: %v", err))
+		return
+	}
+	var tm models.TeamMembers
+	if len(api.quotas.Teams) > 0 {
+		if api.tmc == nil {
+			api.internalError(w, fmt.Errorf("team quotas are not supported by the GitHub client"))
+			return
+		}
+		tm, err = api.quotas.TeamMembers(r.Context(), api.tmc.GetTeamMembers)
+		if err != nil {
+			api.internalError(w, err)
+			return
+		}
+	}
+	out := []V2QuotaUsage{}
+	for _, qu := range api.quotas.Usage(envs, tm) {
+		out = append(out, V2QuotaUsage{
+			Scope:       qu.Scope,
+			Name:        qu.Name,
+			MaxRunning:  qu.Quota.MaxRunning,
+			MaxBuilding: qu.Quota.MaxBuilding,
+			Running:     qu.Running,
+			Building:    qu.Building,
+		})
+	}
+	api.writeJSON(w, r, &out)
+}
+
+// locksHandler returns the env locks that are held or waited for, along with the requests for them (admin only)
+func (api *v2api) locksHandler(w http.ResponseWriter, r *http.Request) {
+	if api.li == nil {
+		api.rlogger(r).Logf("lock inspection is not supported by the lock provider")
+		w.WriteHeader(http.StatusNotImplemented)
+		return
+	}
+	locks, err := api.li.EnvLocks(r.Context())
+	if err != nil {
+		api.internalError(w, fmt.Errorf("error getting locks: %w", err))
+		return
+	}
+	api.writeJSON(w, r, &locks)
+}
+
+// V2LockReleaseRequest models a request to force-release a stuck env lock
+type V2LockReleaseRequest struct {
+	Repo        string `json:"repo"`
+	PullRequest uint   `json:"pull_request"`
+	Reason      string `json:"reason"`
+}
+
+// lockReleaseHandler forcibly releases the env lock for a repo and pull request, recording an audit record with the
+// API key user (admin only)
+func (api *v2api) lockReleaseHandler(w http.ResponseWriter, r *http.Request) {
+	apikey, ok := r.Context().Value(apiKeyCtxKey).(models.APIKey)
+	if !ok {
+		api.internalError(w, fmt.Errorf("unexpected api key type from context: %T", apikey))
+		return
+	}
+	if api.li == nil {
+		api.rlogger(r).Logf("lock inspection is not supported by the lock provider")
+		w.WriteHeader(http.StatusNotImplemented)
+		return
+	}
+	req := V2LockReleaseRequest{}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		api.badRequestError(w, fmt.Errorf("error unmarshaling body: %w", err))
+		return
+	}
+	if req.Repo == "" || req.PullRequest == 0 || req.Reason == "" {
+		api.badRequestError(w, fmt.Errorf("repo, pull_request and reason are required"))
+		return
+	}
+	lfr, err := api.li.ForceRelease(r.Context(), req.Repo, req.PullRequest, apikey.GitHubUser, req.Reason)
+	if err != nil {
+		if err == locker.ErrLockNotHeld {
+			api.rlogger(r).Logf("lock for %v/%v is not held", req.Repo, req.PullRequest)
+			w.WriteHeader(http.StatusConflict)
+			return
+		}
+		api.internalError(w, fmt.Errorf("error force releasing lock: %w", err))
+		return
+	}
+	api.rlogger(r).Logf("lock for %v/%v (holder: %q) force-released by %v: %v", req.Repo, req.PullRequest, lfr.HolderEvent, lfr.User, lfr.Reason)
+	api.writeJSON(w, r, lfr)
+}
+
+// lockReleasesHandler returns the audit records of the most recent forced releases of env locks (admin only)
+func (api *v2api) lockReleasesHandler(w http.ResponseWriter, r *http.Request) {
+	if api.li == nil {
+		api.rlogger(r).Logf("lock inspection is not supported by the lock provider")
+		w.WriteHeader(http.StatusNotImplemented)
+		return
+	}
+	limit := uint64(100)
+	if ls := r.URL.Query().Get("limit"); ls != "" {
+		l, err := strconv.ParseUint(ls, 10, 32)
+		if err != nil || l == 0 {
+			api.badRequestError(w, fmt.Errorf("invalid limit: %v", ls))
+			return
+		}
+		limit = l
+	}
+	releases, err := api.li.ForceReleases(r.Context(), uint(limit))
+	if err != nil {
+		api.internalError(w, fmt.Errorf("error getting force releases: %w", err))
+		return
+	}
+	api.writeJSON(w, r, &releases)
+}
+
+// reapDryRunHandler returns the environments the reaper would destroy and the destroyed environment records it would
+// prune if it ran now, and why (admin only)
+func (api *v2api) reapDryRunHandler(w http.ResponseWriter, r *http.Request) {
+	if api.rp == nil {
+		api.rlogger(r).Logf("reaper is disabled")
+		w.WriteHeader(http.StatusNotImplemented)
+		return
+	}
+	actions, err := api.rp.DryRun(r.Context())
+	if err != nil {
+		api.internalError(w, fmt.Errorf("error running reaper dry run: %w", err))
+		return
+	}
+	api.writeJSON(w, r, &actions)
+}
+
+// V2ManualEnvRequest models a request to create a manual (non-PR) environment
+type V2ManualEnvRequest struct {
+	Repo         string            `json:"repo"`
+	Ref          string            `json:"ref"`
+	RefOverrides map[string]string `json:"ref_overrides"`
+	TTL          string            `json:"ttl"`
+	User         string            `json:"user"` // owner (admin API keys only, otherwise the owner is the requesting user)
+}
+
+type V2ManualEnvResponse struct {
+	EnvName string `json:"env_name"`
+	EventID string `json:"event_id"`
+}
+
+// parseManualEnvTTL parses an optional requested environment TTL, writing 400 if it is invalid
+func (api *v2api) parseManualEnvTTL(w http.ResponseWriter, r *http.Request, ttlstr string) (ttl time.Duration, ok bool) {
+	if ttlstr == "" {
+		return 0, true
+	}
+	ttl, err := time.ParseDuration(ttlstr)
+	if err != nil || ttl <= 0 {
+		api.rlogger(r).Logf("invalid ttl: %v", ttlstr)
+		w.WriteHeader(http.StatusBadRequest)
+		return 0, false
+	}
+	return ttl, true
+}
+
+// createManualEnv validates req and asynchronously creates a manual environment owned by user with a new event log, writing 201 if the create was started
+func (api *v2api) createManualEnv(w http.ResponseWriter, r *http.Request, req V2ManualEnvRequest, user string) {
+	rd := models.RepoRevisionData{
+		User:         user,
+		Repo:         req.Repo,
+		SourceBranch: req.Ref,
+		RefOverrides: req.RefOverrides,
+	}
+	ttl, ok := api.parseManualEnvTTL(w, r, req.TTL)
+	if !ok {
+		return
+	}
+	rd.TTL = ttl
+	if err := api.es.PrepareManual(r.Context(), &rd); err != nil {
+		api.rlogger(r).Logf("error preparing manual environment: %v", err)
+		if nitroerrors.IsUserError(err) {
+			api.badRequestError(w, err)
+			return
+		}
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	api.startManualEnv(w, r, rd)
+}
+
+// startManualEnv asynchronously creates the prepared manual environment rd with a new event log, writing 201 with the environment name
+func (api *v2api) startManualEnv(w http.ResponseWriter, r *http.Request, rd models.RepoRevisionData) {
+	id, err := uuid.NewRandom()
+	if err != nil {
+		api.rlogger(r).Logf("error getting random UUID: %v", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	elogger := &eventlogger.Logger{
+		ID:         id,
+		DeliveryID: uuid.Nil,
+		DL:         api.dl,
+		Sink:       os.Stdout,
+	}
+	if err := elogger.Init([]byte{}, rd.Repo, rd.PullRequest); err != nil {
+		api.rlogger(r).Logf("error initializing event logger: %v", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	ctx := eventlogger.NewEventLoggerContext(context.Background(), elogger)
+	ctx = ncontext.NewCancelFuncContext(context.WithCancel(ctx))
+	span := tracer.StartSpan("manual_create")
+	span.SetTag(ext.SamplingPriority, ext.PriorityUserKeep)
+	setTagsForGithubWebhookHandler(span, rd)
+	ctx = tracer.ContextWithSpan(ctx, span)
+	logger := eventlogger.GetLogger(ctx).Printf
+
+	if rd.CloneOf != "" {
+		logger("starting manual create of clone of %v (owner: %v)", rd.CloneOf, rd.User)
+	} else {
+		logger("starting manual create of %v@%v (owner: %v)", rd.Repo, rd.SourceBranch, rd.User)
+	}
+	op := &models.QueuedOperation{
+		Action:           models.CreateOperationAction,
+		RepoRevisionData: rd,
+		Params:           models.OperationParams{EnvName: rd.EnvName},
+	}
+	if err := api.startOperation(ctx, span, op, func(ctx context.Context) error {
+		_, err := api.es.Create(ctx, rd)
+		return err
+	}); err != nil {
+		api.internalError(w, err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(V2ManualEnvResponse{EnvName: rd.EnvName, EventID: id.String()})
+}
+
+// envCreateHandler creates a manual environment owned by the API key user (or the requested user, for admin keys)
+func (api *v2api) envCreateHandler(w http.ResponseWriter, r *http.Request) {
+	apikey, ok := r.Context().Value(apiKeyCtxKey).(models.APIKey)
+	if !ok {
+		api.internalError(w, fmt.Errorf("unexpected api key type from context: %T", apikey))
+		return
+	}
+	req := V2ManualEnvRequest{}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		api.badRequestError(w, fmt.Errorf("error unmarshaling body: %w", err))
+		return
+	}
+	if !api.apiKeyRepoAccess(w, r, req.Repo, true) {
+		return
+	}
+	user := apikey.GitHubUser
+	if apikey.PermissionLevel == models.AdminPermission && req.User != "" {
+		user = req.User
+	}
+	api.createManualEnv(w, r, req, user)
+}
+
+// userEnvCreateHandler creates a manual environment owned by the session user from the UI
+func (api *v2api) userEnvCreateHandler(w http.ResponseWriter, r *http.Request) {
+	uis, err := getSessionFromContext(r.Context())
+	if err != nil {
+		api.rlogger(r).Logf("session missing from context")
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	req := V2ManualEnvRequest{}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		api.badRequestError(w, fmt.Errorf("error unmarshaling body: %w", err))
+		return
+	}
+	repos, err := userPermissionsClient(api.oauth, req.Repo).GetUserWritableRepos(r.Context(), uis)
+	if err != nil {
+		api.rlogger(r).Logf("error getting user writable repos: %v", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	if _, ok := repos[req.Repo]; !ok {
+		api.rlogger(r).Logf("user writable repo not found")
+		w.WriteHeader(http.StatusForbidden)
+		return
+	}
+	api.createManualEnv(w, r, req, uis.GitHubUser)
+}
+
+// V2CloneEnvRequest models a request to clone an existing environment
+type V2CloneEnvRequest struct {
+	RefOverrides map[string]string `json:"ref_overrides"` // map of repo name to branch for repos that should differ from the source environment
+	TTL          string            `json:"ttl"`
+	User         string            `json:"user"` // owner (admin API keys only, otherwise the owner is the requesting user)
+}
+
+// cloneEnv validates req and asynchronously creates a manual environment owned by user that reproduces the environment named source,
+// writing 201 if the create was started
+func (api *v2api) cloneEnv(w http.ResponseWriter, r *http.Request, source string, req V2CloneEnvRequest, user string) {
+	rd := models.RepoRevisionData{
+		User:         user,
+		RefOverrides: req.RefOverrides,
+	}
+	ttl, ok := api.parseManualEnvTTL(w, r, req.TTL)
+	if !ok {
+		return
+	}
+	rd.TTL = ttl
+	if err := api.es.PrepareClone(r.Context(), source, &rd); err != nil {
+		api.rlogger(r).Logf("error preparing environment clone: %v", err)
+		if nitroerrors.IsUserError(err) {
+			api.badRequestError(w, err)
+			return
+		}
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	api.startManualEnv(w, r, rd)
+}
+
+// envActionsCloneHandler clones an existing environment owned by the API key user, or in a repo the user has write access to
+// (any environment for admin keys). The clone is owned by the API key user (or the requested user, for admin keys).
+func (api *v2api) envActionsCloneHandler(w http.ResponseWriter, r *http.Request) {
+	apikey, ok := r.Context().Value(apiKeyCtxKey).(models.APIKey)
+	if !ok {
+		api.internalError(w, fmt.Errorf("unexpected api key type from context: %T", apikey))
+		return
+	}
+	name := mux.Vars(r)["name"]
+	qae, err := api.dl.GetQAEnvironment(r.Context(), name)
+	if err != nil {
+		api.internalError(w, fmt.Errorf("error getting env: %w", err))
+		return
+	}
+	if qae == nil {
+		api.rlogger(r).Logf("env not found: %v", name)
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	// like authorizeEnv, the owner may always clone the env, otherwise its refs and branches are only available to repo writers
+	if apikey.GitHubUser != qae.User && !api.apiKeyRepoAccess(w, r, qae.Repo, true) {
+		return
+	}
+	req := V2CloneEnvRequest{}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		api.badRequestError(w, fmt.Errorf("error unmarshaling body: %w", err))
+		return
+	}
+	user := apikey.GitHubUser
+	if apikey.PermissionLevel == models.AdminPermission && req.User != "" {
+		user = req.User
+	}
+	api.cloneEnv(w, r, qae.Name, req, user)
+}
+
+// userEnvActionsCloneHandler clones the environment from the UI, owned by the session user
+func (api *v2api) userEnvActionsCloneHandler(w http.ResponseWriter, r *http.Request) {
+	qae, ok := api.userEnvWritable(w, r)
+	if !ok {
+		return
+	}
+	uis, err := getSessionFromContext(r.Context())
+	if err != nil {
+		api.rlogger(r).Logf("session missing from context")
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	req := V2CloneEnvRequest{}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		api.badRequestError(w, fmt.Errorf("error unmarshaling body: %w", err))
+		return
+	}
+	api.cloneEnv(w, r, qae.Name, req, uis.GitHubUser)
+}
+
+// V2PlanRequest models a request to plan an environment for a branch of a repo
+type V2PlanRequest struct {
+	Repo         string            `json:"repo"`
+	Ref          string            `json:"ref"`          // branch
+	BaseRef      string            `json:"base_ref"`     // base branch for branch matching (defaults to ref)
+	PullRequest  uint              `json:"pull_request"` // if set, the plan is compared against the extant environment for the PR
+	RefOverrides map[string]string `json:"ref_overrides"`
+}
+
+// planEnv synchronously plans the environment for rd, writing the plan or 400 if rd or the environment config is invalid
+func (api *v2api) planEnv(w http.ResponseWriter, r *http.Request, rd models.RepoRevisionData) {
+	plan, err := api.es.Plan(r.Context(), rd)
+	if err != nil {
+		api.rlogger(r).Logf("error planning environment: %v", err)
+		if nitroerrors.IsUserError(err) {
+			api.badRequestError(w, err)
+			return
+		}
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	api.writeJSON(w, r, plan)
+}
+
+// planHandler plans an environment for an arbitrary branch of a repo the API key user can read, without building images or modifying the cluster
+func (api *v2api) planHandler(w http.ResponseWriter, r *http.Request) {
+	req := V2PlanRequest{}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		api.badRequestError(w, fmt.Errorf("error unmarshaling body: %w", err))
+		return
+	}
+	// the plan includes the resolved configuration and chart values of the repo (and of its env for pull_request, if any)
+	if !api.apiKeyRepoAccess(w, r, req.Repo, false) {
+		return
+	}
+	api.planEnv(w, r, models.RepoRevisionData{
+		Repo:         req.Repo,
+		PullRequest:  req.PullRequest,
+		SourceBranch: req.Ref,
+		BaseBranch:   req.BaseRef,
+		RefOverrides: req.RefOverrides,
+	})
+}
+
+// envPlanHandler plans an update of an existing environment to the current head of its branch, or the branch in the optional
+// "ref" query parameter
+func (api *v2api) envPlanHandler(w http.ResponseWriter, r *http.Request) {
+	qa, ok := r.Context().Value(qaEnvCtxKey).(models.QAEnvironment)
+	if !ok {
+		api.internalError(w, fmt.Errorf("unexpected qa env type from context: %T", qa))
+		return
+	}
+	rd := *qa.RepoRevisionDataFromQA()
+	rd.EnvName = qa.Name
+	rd.SourceSHA = ""
+	if ref := r.URL.Query().Get("ref"); ref != "" {
+		rd.SourceBranch = ref
+	}
+	api.planEnv(w, r, rd)
+}
+
+// destroyEnv asynchronously destroys qae, writing 409 if it is already destroyed
+func (api *v2api) destroyEnv(w http.ResponseWriter, r *http.Request, qae *models.QAEnvironment) {
+	if qae.Status == models.Destroyed {
+		api.rlogger(r).Logf("env is already destroyed")
+		w.WriteHeader(http.StatusConflict)
+		return
+	}
+	api.envAction(w, r, qae, "destroy", qae.Status)
+}
+
+func (api *v2api) envDestroyHandler(w http.ResponseWriter, r *http.Request) {
+	qa, ok := r.Context().Value(qaEnvCtxKey).(models.QAEnvironment)
+	if !ok {
+		api.internalError(w, fmt.Errorf("unexpected qa env type from context: %T", qa))
+		return
+	}
+	api.destroyEnv(w, r, &qa)
+}
+
+// userEnvActionsDestroyHandler destroys the environment from the UI
+func (api *v2api) userEnvActionsDestroyHandler(w http.ResponseWriter, r *http.Request) {
+	qae, ok := api.userEnvWritable(w, r)
+	if !ok {
+		return
+	}
+	api.destroyEnv(w, r, qae)
+}
@@ -11,6 +11,7 @@ import (
 	"net/http"
 	"net/http/httptest"
 	"os"
+	"strings"
 	"testing"
 	"time"
 
@@ -22,8 +23,11 @@ import (
 	muxtrace "gopkg.in/DataDog/dd-trace-go.v1/contrib/gorilla/mux"
 
 	"github.com/dollarshaveclub/acyl/pkg/config"
+	"github.com/dollarshaveclub/acyl/pkg/eventlogger"
 	"github.com/dollarshaveclub/acyl/pkg/ghclient"
+	"github.com/dollarshaveclub/acyl/pkg/locker"
 	"github.com/dollarshaveclub/acyl/pkg/models"
+	"github.com/dollarshaveclub/acyl/pkg/persistence"
 	"github.com/dollarshaveclub/acyl/pkg/testhelper/testdatalayer"
 )
 
@@ -375,6 +379,46 @@ func TestAPIv2HealthCheck(t *testing.T) {
 	}
 }
 
+type fakeLeaderElector struct {
+	replica, leader string
+}
+
+func (fle fakeLeaderElector) Replica() string { return fle.replica }
+func (fle fakeLeaderElector) Leader(ctx context.Context) (string, error) {
+	return fle.leader, nil
+}
+
+func TestAPIv2HealthCheckLeader(t *testing.T) {
+	apiv2, err := newV2API(persistence.NewFakeDataLayer(), nil, nil, config.ServerConfig{}, OAuthConfig{}, testlogger, nil)
+	if err != nil {
+		t.Fatalf("error creating api: %v", err)
+	}
+	apiv2.le = fakeLeaderElector{replica: "acyl-1", leader: "acyl-2"}
+
+	r := muxtrace.NewRouter()
+	apiv2.register(r)
+	ts := httptest.NewServer(r)
+	defer ts.Close()
+
+	resp, err := http.Get(ts.URL + "/v2/health-check")
+	if err != nil {
+		t.Fatalf("error executing request: %v", err)
+	}
+	bb, _ := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("should have succeeded: %v: %v", resp.StatusCode, string(bb))
+	}
+	msg := map[string]string{}
+	if err := json.Unmarshal(bb, &msg); err != nil {
+		t.Fatalf("error unmarshalling health check response: %v\n", err)
+	}
+	if msg["message"] != "Todo es bueno!" || msg["replica"] != "acyl-1" || msg["leader"] != "acyl-2" {
+		t.Fatalf("incorrect health check response: %+v", msg)
+	}
+}
+
 func TestAPIv2EventLog(t *testing.T) {
 	dl, tdl := testdatalayer.New(testlogger, t)
 	if err := tdl.Setup(testDataPath); err != nil {
@@ -668,6 +712,32 @@ func TestAPIv2UserEnvActionsRebuild(t *testing.T) {
 	if res.StatusCode != http.StatusCreated {
 		t.Fatalf("bad status code: %v", res.StatusCode)
 	}
+
+	// with the durable queue the update is queued for a worker rather than run in the server process
+	apiv2.sc.DurableOperationQueue = true
+	apiv2.es = &spawner.FakeEnvironmentSpawner{
+		UpdateFunc: func(ctx context.Context, rd models.RepoRevisionData) (string, error) {
+			t.Errorf("update should not have been run in the server process")
+			return "", nil
+		},
+	}
+	rc = httptest.NewRecorder()
+	apiv2.userEnvActionsRebuildHandler(rc, req)
+	res = rc.Result()
+	if res.StatusCode != http.StatusCreated {
+		t.Fatalf("bad status code: %v", res.StatusCode)
+	}
+	out := map[string]string{}
+	if err := json.NewDecoder(res.Body).Decode(&out); err != nil {
+		t.Fatalf("error decoding response: %v", err)
+	}
+	ops, err := dl.GetOperations(context.Background(), models.OperationPending)
+	if err != nil || len(ops) != 1 {
+		t.Fatalf("expected a pending operation: %v: %v", len(ops), err)
+	}
+	if ops[0].Action != models.UpdateOperationAction || ops[0].Params.EnvName != "foo-bar" || ops[0].EventID.String() != out["event_id"] {
+		t.Fatalf("bad operation: %+v (response: %v)", ops[0], out)
+	}
 }
 
 func TestAPIv2UserEnvNamePods(t *testing.T) {
@@ -915,6 +985,296 @@ func TestAPIv2UserEnvNamePodLogs(t *testing.T) {
 	}
 }
 
+func TestAPIv2UserEnvNamePodLogsStream(t *testing.T) {
+	dl, tdl := testdatalayer.New(testlogger, t)
+	if err := tdl.Setup(testDataPath); err != nil {
+		t.Fatalf("error setting up test database: %v", err)
+	}
+	defer tdl.TearDown()
+
+	logger := log.New(os.Stdout, "", log.LstdFlags)
+	k8senv := &models.KubernetesEnvironment{
+		Created: time.Now(),
+		Updated: pq.NullTime{
+			Time:  time.Now(),
+			Valid: true,
+		},
+		EnvName:         "foo-bar",
+		Namespace:       "nitro-1234-foo-bar",
+		ConfigSignature: []byte("0f0o0o0b0a0r00000000000000000000"),
+	}
+	dl.CreateK8sEnv(context.Background(), k8senv)
+	oauthcfg := OAuthConfig{
+		AppGHClientFactoryFunc: func(_ string) ghclient.GitHubAppInstallationClient {
+			return &ghclient.FakeRepoClient{
+				GetUserAppRepoPermissionsFunc: func(_ context.Context, _ int64) (map[string]ghclient.AppRepoPermissions, error) {
+					return map[string]ghclient.AppRepoPermissions{
+						"dollarshaveclub/foo-bar": ghclient.AppRepoPermissions{
+							Repo: "dollarshaveclub/foo-bar",
+							Pull: true,
+						},
+					}, nil
+				},
+			}
+		},
+	}
+	copy(oauthcfg.UserTokenEncKey[:], []byte("00000000000000000000000000000000"))
+	apiv2, err := newV2API(dl, nil, nil, config.ServerConfig{APIKeys: []string{"foo"}}, oauthcfg, logger, metahelm.FakeKubernetesReporter{FakePodLogFilePath: "../nitro/metahelm/testdata/pod_logs.log"})
+	if err != nil {
+		t.Fatalf("error creating api: %v", err)
+	}
+
+	uis := models.UISession{
+		Authenticated: true,
+		GitHubUser:    "bobsmith",
+	}
+	uis.EncryptandSetUserToken([]byte("foo"), oauthcfg.UserTokenEncKey)
+
+	// test line request maximum
+	req, _ := http.NewRequest("GET", fmt.Sprintf("https://foo.com/v2/userenvs/foo-bar/namespace/pod/foo-app-abc123/logs/stream?lines=%v", metahelm.MaxPodContainerLogLines+1), nil)
+	req = mux.SetURLVars(req, map[string]string{"name": "foo-bar", "pod": "foo-app-abc123"})
+	req = req.Clone(withSession(req.Context(), uis))
+
+	rc := httptest.NewRecorder()
+	apiv2.userEnvPodLogsStreamHandler(rc, req)
+	res := rc.Result()
+	if res.StatusCode != http.StatusBadRequest {
+		t.Fatalf("bad status code: %v", res.StatusCode)
+	}
+	res.Body.Close()
+
+	// test non-follow stream of all containers
+	nLogLines := 10
+	req, _ = http.NewRequest("GET", fmt.Sprintf("https://foo.com/v2/userenvs/foo-bar/namespace/pod/foo-app-abc123/logs/stream?lines=%v&follow=false&timestamps=true", nLogLines), nil)
+	req = mux.SetURLVars(req, map[string]string{"name": "foo-bar", "pod": "foo-app-abc123"})
+	req = req.Clone(withSession(req.Context(), uis))
+
+	rc = httptest.NewRecorder()
+	apiv2.userEnvPodLogsStreamHandler(rc, req)
+	res = rc.Result()
+	if res.StatusCode != http.StatusOK {
+		t.Fatalf("bad status code: %v", res.StatusCode)
+	}
+	defer res.Body.Close()
+	if ct := res.Header.Get("Content-Type"); ct != "text/event-stream" {
+		t.Fatalf("unexpected content type: %v", ct)
+	}
+	var logEvents, endEvents int
+	containers := map[string]struct{}{}
+	scanner := bufio.NewScanner(res.Body)
+	var event string
+	for scanner.Scan() {
+		line := scanner.Text()
+		switch {
+		case strings.HasPrefix(line, "event: "):
+			event = strings.TrimPrefix(line, "event: ")
+		case strings.HasPrefix(line, "data: "):
+			switch event {
+			case "log":
+				logEvents++
+				pll := V2PodLogStreamLine{}
+				if err := json.Unmarshal([]byte(strings.TrimPrefix(line, "data: ")), &pll); err != nil {
+					t.Fatalf("error unmarshaling log line: %v", err)
+				}
+				containers[pll.Container] = struct{}{}
+			case "end":
+				endEvents++
+			}
+		}
+	}
+	if logEvents != 2*nLogLines {
+		t.Fatalf("expected %v log events, got %v", 2*nLogLines, logEvents)
+	}
+	if len(containers) != 2 {
+		t.Fatalf("expected lines from 2 containers, got %v", len(containers))
+	}
+	if endEvents != 1 {
+		t.Fatalf("expected one end event, got %v", endEvents)
+	}
+}
+
+func TestAPIv2UserEnvNamespaceResources(t *testing.T) {
+	dl, tdl := testdatalayer.New(testlogger, t)
+	if err := tdl.Setup(testDataPath); err != nil {
+		t.Fatalf("error setting up test database: %v", err)
+	}
+	defer tdl.TearDown()
+
+	logger := log.New(os.Stdout, "", log.LstdFlags)
+	k8senv := &models.KubernetesEnvironment{
+		Created: time.Now(),
+		Updated: pq.NullTime{
+			Time:  time.Now(),
+			Valid: true,
+		},
+		EnvName:         "foo-bar",
+		Namespace:       "nitro-1234-foo-bar",
+		ConfigSignature: []byte("0f0o0o0b0a0r00000000000000000000"),
+	}
+	dl.CreateK8sEnv(context.Background(), k8senv)
+	oauthcfg := OAuthConfig{
+		AppGHClientFactoryFunc: func(_ string) ghclient.GitHubAppInstallationClient {
+			return &ghclient.FakeRepoClient{
+				GetUserAppRepoPermissionsFunc: func(_ context.Context, _ int64) (map[string]ghclient.AppRepoPermissions, error) {
+					return map[string]ghclient.AppRepoPermissions{
+						"dollarshaveclub/foo-bar": ghclient.AppRepoPermissions{
+							Repo: "dollarshaveclub/foo-bar",
+							Pull: true,
+						},
+					}, nil
+				},
+			}
+		},
+	}
+	copy(oauthcfg.UserTokenEncKey[:], []byte("00000000000000000000000000000000"))
+	apiv2, err := newV2API(dl, nil, nil, config.ServerConfig{APIKeys: []string{"foo"}}, oauthcfg, logger, metahelm.FakeKubernetesReporter{})
+	if err != nil {
+		t.Fatalf("error creating api: %v", err)
+	}
+
+	uis := models.UISession{
+		Authenticated: true,
+		GitHubUser:    "bobsmith",
+	}
+	uis.EncryptandSetUserToken([]byte("foo"), oauthcfg.UserTokenEncKey)
+
+	tests := []struct {
+		resource string
+		handler  http.HandlerFunc
+		count    int
+	}{
+		{"deployments", apiv2.userEnvDeploymentsHandler, 2},
+		{"statefulsets", apiv2.userEnvStatefulSetsHandler, 1},
+		{"services", apiv2.userEnvServicesHandler, 2},
+		{"ingresses", apiv2.userEnvIngressesHandler, 1},
+		{"jobs", apiv2.userEnvJobsHandler, 1},
+		{"events", apiv2.userEnvEventsHandler, 1},
+	}
+	for _, test := range tests {
+		req, _ := http.NewRequest("GET", "https://foo.com/v2/userenvs/foo-bar/namespace/"+test.resource, nil)
+		req = mux.SetURLVars(req, map[string]string{"name": "foo-bar"})
+		req = req.Clone(withSession(req.Context(), uis))
+
+		rc := httptest.NewRecorder()
+		test.handler(rc, req)
+		res := rc.Result()
+		if res.StatusCode != http.StatusOK {
+			t.Fatalf("%v: bad status code: %v", test.resource, res.StatusCode)
+		}
+		out := []map[string]interface{}{}
+		if err := json.NewDecoder(res.Body).Decode(&out); err != nil {
+			t.Fatalf("%v: error decoding response: %v", test.resource, err)
+		}
+		res.Body.Close()
+		if len(out) != test.count {
+			t.Fatalf("%v: expected %v items, got %v", test.resource, test.count, len(out))
+		}
+	}
+
+	// user without repo visibility
+	apiv2.oauth.Enforce = true
+	req, _ := http.NewRequest("GET", "https://foo.com/v2/userenvs/foo-bar/namespace/deployments", nil)
+	req = mux.SetURLVars(req, map[string]string{"name": "foo-bar"})
+	req = req.Clone(withSession(req.Context(), uis))
+	apiv2.oauth.AppGHClientFactoryFunc = func(_ string) ghclient.GitHubAppInstallationClient {
+		return &ghclient.FakeRepoClient{
+			GetUserAppRepoPermissionsFunc: func(_ context.Context, _ int64) (map[string]ghclient.AppRepoPermissions, error) {
+				return map[string]ghclient.AppRepoPermissions{}, nil
+			},
+		}
+	}
+	rc := httptest.NewRecorder()
+	apiv2.userEnvDeploymentsHandler(rc, req)
+	if rc.Result().StatusCode != http.StatusForbidden {
+		t.Fatalf("expected forbidden, got: %v", rc.Result().StatusCode)
+	}
+}
+
+func TestAPIv2UserEnvServiceProxy(t *testing.T) {
+	dl, tdl := testdatalayer.New(testlogger, t)
+	if err := tdl.Setup(testDataPath); err != nil {
+		t.Fatalf("error setting up test database: %v", err)
+	}
+	defer tdl.TearDown()
+
+	logger := log.New(os.Stdout, "", log.LstdFlags)
+	k8senv := &models.KubernetesEnvironment{
+		Created: time.Now(),
+		Updated: pq.NullTime{
+			Time:  time.Now(),
+			Valid: true,
+		},
+		EnvName:         "foo-bar",
+		Namespace:       "nitro-1234-foo-bar",
+		ConfigSignature: []byte("0f0o0o0b0a0r00000000000000000000"),
+	}
+	dl.CreateK8sEnv(context.Background(), k8senv)
+	perms := ghclient.AppRepoPermissions{
+		Repo: "dollarshaveclub/foo-bar",
+		Pull: true,
+		Push: true,
+	}
+	oauthcfg := OAuthConfig{
+		Enforce: true,
+		AppGHClientFactoryFunc: func(_ string) ghclient.GitHubAppInstallationClient {
+			return &ghclient.FakeRepoClient{
+				GetUserAppRepoPermissionsFunc: func(_ context.Context, _ int64) (map[string]ghclient.AppRepoPermissions, error) {
+					return map[string]ghclient.AppRepoPermissions{perms.Repo: perms}, nil
+				},
+			}
+		},
+	}
+	copy(oauthcfg.UserTokenEncKey[:], []byte("00000000000000000000000000000000"))
+	apiv2, err := newV2API(dl, nil, nil, config.ServerConfig{APIKeys: []string{"foo"}}, oauthcfg, logger, metahelm.FakeKubernetesReporter{})
+	if err != nil {
+		t.Fatalf("error creating api: %v", err)
+	}
+
+	uis := models.UISession{
+		Authenticated: true,
+		GitHubUser:    "bobsmith",
+	}
+	uis.EncryptandSetUserToken([]byte("foo"), oauthcfg.UserTokenEncKey)
+
+	newReq := func(service, port string) *http.Request {
+		req, _ := http.NewRequest("GET", "https://foo.com/v2/userenvs/foo-bar/namespace/service/"+service+"/port/"+port+"/proxy/admin/status?verbose=1", nil)
+		req = mux.SetURLVars(req, map[string]string{"name": "foo-bar", "service": service, "port": port, "path": "admin/status"})
+		return req.Clone(withSession(req.Context(), uis))
+	}
+
+	rc := httptest.NewRecorder()
+	apiv2.userEnvServiceProxyHandler(rc, newReq("bar", "http"))
+	if rc.Result().StatusCode != http.StatusOK {
+		t.Fatalf("bad status code: %v", rc.Result().StatusCode)
+	}
+	if body := rc.Body.String(); body != "nitro-1234-foo-bar/bar:http GET /admin/status?verbose=1" {
+		t.Fatalf("unexpected proxied request: %v", body)
+	}
+
+	rc = httptest.NewRecorder()
+	apiv2.userEnvServiceProxyHandler(rc, newReq("Not_A_Service", "http"))
+	if rc.Result().StatusCode != http.StatusBadRequest {
+		t.Fatalf("expected bad request, got: %v", rc.Result().StatusCode)
+	}
+
+	// API key access, env already authorized by middleware
+	req := newReq("bar", "8080")
+	req = req.Clone(context.WithValue(req.Context(), qaEnvCtxKey, models.QAEnvironment{Name: "foo-bar"}))
+	rc = httptest.NewRecorder()
+	apiv2.envServiceProxyHandler(rc, req)
+	if rc.Result().StatusCode != http.StatusOK {
+		t.Fatalf("api key: bad status code: %v", rc.Result().StatusCode)
+	}
+
+	// read-only users may not proxy
+	perms.Push = false
+	rc = httptest.NewRecorder()
+	apiv2.userEnvServiceProxyHandler(rc, newReq("bar", "http"))
+	if rc.Result().StatusCode != http.StatusForbidden {
+		t.Fatalf("expected forbidden, got: %v", rc.Result().StatusCode)
+	}
+}
+
 func TestAPIv2UserTokenCreate(t *testing.T) {
 	dl, tdl := testdatalayer.New(testlogger, t)
 	if err := tdl.Setup(testDataPath); err != nil {
@@ -1355,3 +1715,398 @@ func TestAPIv2UserTokenDestroy(t *testing.T) {
 		t.Fatalf("bad status code: %v", res.StatusCode)
 	}
 }
+
+func TestAPIv2Locks(t *testing.T) {
+	dl := persistence.NewFakeDataLayer()
+	lp, err := locker.NewLockProvider(locker.FakeLockProviderKind, locker.WithLockTimeout(time.Second))
+	if err != nil {
+		t.Fatalf("error creating lock provider: %v", err)
+	}
+	apiv2, err := newV2API(dl, nil, nil, config.ServerConfig{}, OAuthConfig{}, testlogger, nil)
+	if err != nil {
+		t.Fatalf("error creating api: %v", err)
+	}
+	apiv2.li = lp.(locker.LockInspector)
+	id, err := dl.CreateAPIKey(context.Background(), models.AdminPermission, "admin", "john.smith")
+	if err != nil {
+		t.Fatalf("api key creation should have succeeded: %v", err)
+	}
+	authMiddleware.DL = dl
+
+	key, err := lp.LockKey(context.Background(), "foo/bar", 1)
+	if err != nil {
+		t.Fatalf("error getting lock key: %v", err)
+	}
+	lock, err := lp.New(context.Background(), key, "update foo/bar/1")
+	if err != nil {
+		t.Fatalf("error creating lock: %v", err)
+	}
+	preempt, err := lock.Lock(context.Background())
+	if err != nil {
+		t.Fatalf("error locking: %v", err)
+	}
+	defer lock.Unlock(context.Background())
+
+	r := muxtrace.NewRouter()
+	apiv2.register(r)
+	ts := httptest.NewServer(r)
+	defer ts.Close()
+	do := func(method, path string, body []byte) (int, []byte) {
+		req, _ := http.NewRequest(method, ts.URL+path, bytes.NewBuffer(body))
+		req.Header.Set(apiKeyHeader, id.String())
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("error executing request: %v", err)
+		}
+		defer resp.Body.Close()
+		bb, _ := ioutil.ReadAll(resp.Body)
+		return resp.StatusCode, bb
+	}
+
+	code, bb := do("GET", "/v2/locks", nil)
+	if code != http.StatusOK {
+		t.Fatalf("should have succeeded: %v: %v", code, string(bb))
+	}
+	locks := []locker.EnvLock{}
+	if err := json.Unmarshal(bb, &locks); err != nil {
+		t.Fatalf("error unmarshaling locks: %v", err)
+	}
+	if len(locks) != 1 || locks[0].Repo != "foo/bar" || locks[0].PullRequest != 1 {
+		t.Fatalf("bad locks: %+v", locks)
+	}
+	if h := locks[0].Holder(); h == nil || h.Event != "update foo/bar/1" {
+		t.Fatalf("bad holder: %+v", h)
+	}
+
+	if code, bb := do("POST", "/v2/locks/release", []byte(`{"repo": "foo/bar", "pull_request": 1}`)); code != http.StatusBadRequest {
+		t.Fatalf("release without reason should have failed: %v: %v", code, string(bb))
+	}
+	if code, bb := do("POST", "/v2/locks/release", []byte(`{"repo": "foo/bar", "pull_request": 2, "reason": "stuck"}`)); code != http.StatusConflict {
+		t.Fatalf("release of unheld lock should have conflicted: %v: %v", code, string(bb))
+	}
+	code, bb = do("POST", "/v2/locks/release", []byte(`{"repo": "foo/bar", "pull_request": 1, "reason": "stuck"}`))
+	if code != http.StatusOK {
+		t.Fatalf("release should have succeeded: %v: %v", code, string(bb))
+	}
+	select {
+	case <-preempt:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("holder should have been preempted")
+	}
+
+	code, bb = do("GET", "/v2/locks/releases", nil)
+	if code != http.StatusOK {
+		t.Fatalf("should have succeeded: %v: %v", code, string(bb))
+	}
+	releases := []locker.LockForceRelease{}
+	if err := json.Unmarshal(bb, &releases); err != nil {
+		t.Fatalf("error unmarshaling releases: %v", err)
+	}
+	if len(releases) != 1 || releases[0].User != "john.smith" || releases[0].Reason != "stuck" || releases[0].HolderEvent != "update foo/bar/1" {
+		t.Fatalf("bad releases: %+v", releases)
+	}
+}
+
+type fakeReapPlanner []models.ReapAction
+
+func (frp fakeReapPlanner) DryRun(ctx context.Context) ([]models.ReapAction, error) {
+	return frp, nil
+}
+
+func TestAPIv2ReapDryRun(t *testing.T) {
+	dl := persistence.NewFakeDataLayer()
+	apiv2, err := newV2API(dl, nil, nil, config.ServerConfig{}, OAuthConfig{}, testlogger, nil)
+	if err != nil {
+		t.Fatalf("error creating api: %v", err)
+	}
+	id, err := dl.CreateAPIKey(context.Background(), models.AdminPermission, "admin", "john.smith")
+	if err != nil {
+		t.Fatalf("api key creation should have succeeded: %v", err)
+	}
+	authMiddleware.DL = dl
+	r := muxtrace.NewRouter()
+	apiv2.register(r)
+	ts := httptest.NewServer(r)
+	defer ts.Close()
+	do := func() (int, []byte) {
+		req, _ := http.NewRequest("GET", ts.URL+"/v2/reap/dry-run", nil)
+		req.Header.Set(apiKeyHeader, id.String())
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("error executing request: %v", err)
+		}
+		defer resp.Body.Close()
+		bb, _ := ioutil.ReadAll(resp.Body)
+		return resp.StatusCode, bb
+	}
+	if code, bb := do(); code != http.StatusNotImplemented {
+		t.Fatalf("should have been not implemented without reaper: %v: %v", code, string(bb))
+	}
+	apiv2.rp = fakeReapPlanner{{EnvName: "foo-bar", Repo: "acme/api", PullRequest: 1, Status: "Failure", Action: models.ReapActionDestroy, Reason: models.ReapAgeFailure.String()}}
+	code, bb := do()
+	if code != http.StatusOK {
+		t.Fatalf("should have succeeded: %v: %v", code, string(bb))
+	}
+	actions := []models.ReapAction{}
+	if err := json.Unmarshal(bb, &actions); err != nil {
+		t.Fatalf("error unmarshaling actions: %v", err)
+	}
+	if len(actions) != 1 || actions[0].EnvName != "foo-bar" || actions[0].Reason != "ReapAgeFailure" {
+		t.Fatalf("bad actions: %+v", actions)
+	}
+}
+
+func TestAPIv2EnvCreateRepoAccess(t *testing.T) {
+	dl := persistence.NewFakeDataLayer()
+	es := &spawner.FakeEnvironmentSpawner{
+		PrepareManualFunc: func(ctx context.Context, rd *models.RepoRevisionData) error {
+			rd.EnvName = "manual-env"
+			return nil
+		},
+		CreateFunc: func(ctx context.Context, rd models.RepoRevisionData) (string, error) { return rd.EnvName, nil },
+	}
+	apiv2, err := newV2API(dl, nil, es, config.ServerConfig{}, OAuthConfig{}, testlogger, nil)
+	if err != nil {
+		t.Fatalf("error creating api: %v", err)
+	}
+	apiv2.rpc = &ghclient.FakeRepoClient{
+		GetUserRepoPermissionsFunc: func(ctx context.Context, repo, user string) (ghclient.AppRepoPermissions, error) {
+			return ghclient.AppRepoPermissions{Repo: repo, Pull: true, Push: repo == "acme/writable"}, nil
+		},
+	}
+	id, err := dl.CreateAPIKey(context.Background(), models.WritePermission, "user", "john.smith")
+	if err != nil {
+		t.Fatalf("api key creation should have succeeded: %v", err)
+	}
+	authMiddleware.DL = dl
+	r := muxtrace.NewRouter()
+	apiv2.register(r)
+	ts := httptest.NewServer(r)
+	defer ts.Close()
+	do := func(repo string) (int, []byte) {
+		body, _ := json.Marshal(V2ManualEnvRequest{Repo: repo, Ref: "master"})
+		req, _ := http.NewRequest("POST", ts.URL+"/v2/envs", bytes.NewBuffer(body))
+		req.Header.Set(apiKeyHeader, id.String())
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("error executing request: %v", err)
+		}
+		defer resp.Body.Close()
+		bb, _ := ioutil.ReadAll(resp.Body)
+		return resp.StatusCode, bb
+	}
+	if code, bb := do("acme/readonly"); code != http.StatusForbidden {
+		t.Fatalf("should have been forbidden without repo write access: %v: %v", code, string(bb))
+	}
+	if code, bb := do("acme/writable"); code != http.StatusCreated {
+		t.Fatalf("should have succeeded: %v: %v", code, string(bb))
+	}
+}
+
+func TestAPIv2EnvCloneRepoAccess(t *testing.T) {
+	dl := persistence.NewFakeDataLayer()
+	for _, qae := range []models.QAEnvironment{
+		{Name: "private-env", Repo: "acme/readonly", User: "jane.doe", Status: models.Success},
+		{Name: "shared-env", Repo: "acme/writable", User: "jane.doe", Status: models.Success},
+		{Name: "own-env", Repo: "acme/readonly", User: "john.smith", Status: models.Success},
+	} {
+		qae := qae
+		if err := dl.CreateQAEnvironment(context.Background(), &qae); err != nil {
+			t.Fatalf("error creating env: %v", err)
+		}
+	}
+	es := &spawner.FakeEnvironmentSpawner{
+		PrepareCloneFunc: func(ctx context.Context, source string, rd *models.RepoRevisionData) error {
+			rd.EnvName = source + "-clone"
+			rd.CloneOf = source
+			return nil
+		},
+		CreateFunc: func(ctx context.Context, rd models.RepoRevisionData) (string, error) { return rd.EnvName, nil },
+	}
+	apiv2, err := newV2API(dl, nil, es, config.ServerConfig{}, OAuthConfig{}, testlogger, nil)
+	if err != nil {
+		t.Fatalf("error creating api: %v", err)
+	}
+	apiv2.rpc = &ghclient.FakeRepoClient{
+		GetUserRepoPermissionsFunc: func(ctx context.Context, repo, user string) (ghclient.AppRepoPermissions, error) {
+			return ghclient.AppRepoPermissions{Repo: repo, Pull: true, Push: repo == "acme/writable"}, nil
+		},
+	}
+	id, err := dl.CreateAPIKey(context.Background(), models.WritePermission, "user", "john.smith")
+	if err != nil {
+		t.Fatalf("api key creation should have succeeded: %v", err)
+	}
+	authMiddleware.DL = dl
+	r := muxtrace.NewRouter()
+	apiv2.register(r)
+	ts := httptest.NewServer(r)
+	defer ts.Close()
+	do := func(name string) (int, []byte) {
+		req, _ := http.NewRequest("POST", ts.URL+"/v2/envs/"+name+"/actions/clone", bytes.NewBufferString("{}"))
+		req.Header.Set(apiKeyHeader, id.String())
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("error executing request: %v", err)
+		}
+		defer resp.Body.Close()
+		bb, _ := ioutil.ReadAll(resp.Body)
+		return resp.StatusCode, bb
+	}
+	if code, bb := do("private-env"); code != http.StatusForbidden {
+		t.Fatalf("should have been forbidden for another user's env without repo write access: %v: %v", code, string(bb))
+	}
+	if code, bb := do("shared-env"); code != http.StatusCreated {
+		t.Fatalf("should have succeeded with repo write access: %v: %v", code, string(bb))
+	}
+	if code, bb := do("own-env"); code != http.StatusCreated {
+		t.Fatalf("should have succeeded for the owner: %v: %v", code, string(bb))
+	}
+}
+
+func TestAPIv2PlanRepoAccess(t *testing.T) {
+	dl := persistence.NewFakeDataLayer()
+	es := &spawner.FakeEnvironmentSpawner{
+		PlanFunc: func(ctx context.Context, rd models.RepoRevisionData) (*models.EnvironmentPlan, error) {
+			return &models.EnvironmentPlan{}, nil
+		},
+	}
+	apiv2, err := newV2API(dl, nil, es, config.ServerConfig{}, OAuthConfig{}, testlogger, nil)
+	if err != nil {
+		t.Fatalf("error creating api: %v", err)
+	}
+	apiv2.rpc = &ghclient.FakeRepoClient{
+		GetUserRepoPermissionsFunc: func(ctx context.Context, repo, user string) (ghclient.AppRepoPermissions, error) {
+			return ghclient.AppRepoPermissions{Repo: repo, Pull: repo == "acme/visible"}, nil
+		},
+	}
+	id, err := dl.CreateAPIKey(context.Background(), models.ReadOnlyPermission, "user", "john.smith")
+	if err != nil {
+		t.Fatalf("api key creation should have succeeded: %v", err)
+	}
+	authMiddleware.DL = dl
+	r := muxtrace.NewRouter()
+	apiv2.register(r)
+	ts := httptest.NewServer(r)
+	defer ts.Close()
+	do := func(repo string) (int, []byte) {
+		body, _ := json.Marshal(V2PlanRequest{Repo: repo, Ref: "master", PullRequest: 1})
+		req, _ := http.NewRequest("POST", ts.URL+"/v2/plan", bytes.NewBuffer(body))
+		req.Header.Set(apiKeyHeader, id.String())
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("error executing request: %v", err)
+		}
+		defer resp.Body.Close()
+		bb, _ := ioutil.ReadAll(resp.Body)
+		return resp.StatusCode, bb
+	}
+	if code, bb := do("acme/private"); code != http.StatusForbidden {
+		t.Fatalf("should have been forbidden without repo read access: %v: %v", code, string(bb))
+	}
+	if code, bb := do("acme/visible"); code != http.StatusOK {
+		t.Fatalf("should have succeeded: %v: %v", code, string(bb))
+	}
+}
+
+func TestAPIv2CancelQueuedCreate(t *testing.T) {
+	dl := persistence.NewFakeDataLayer()
+	// a webhook create waiting in the operation queue has an event, but no environment yet
+	el := &eventlogger.Logger{DL: dl}
+	el.ID, _ = uuid.NewRandom()
+	if err := el.Init([]byte{}, "acme/api", 1); err != nil {
+		t.Fatalf("error initializing event log: %v", err)
+	}
+	el.SetNewStatus(models.UnknownEventStatusType, "<undefined>", models.RepoRevisionData{Repo: "acme/api", PullRequest: 1, User: "jane.doe"})
+	var cancelled []string
+	es := &spawner.FakeEnvironmentSpawner{
+		CancelQueuedFunc: func(ctx context.Context, eventID uuid.UUID, reason string) (*models.QueuedOperation, error) {
+			if eventID != el.ID {
+				t.Errorf("bad event id: %v", eventID)
+			}
+			cancelled = append(cancelled, reason)
+			return &models.QueuedOperation{Action: models.CreateOperationAction, EventID: eventID}, nil
+		},
+	}
+	oauthcfg := OAuthConfig{
+		AppGHClientFactoryFunc: func(_ string) ghclient.GitHubAppInstallationClient {
+			return &ghclient.FakeRepoClient{}
+		},
+	}
+	copy(oauthcfg.UserTokenEncKey[:], []byte("00000000000000000000000000000000"))
+	apiv2, err := newV2API(dl, nil, es, config.ServerConfig{}, oauthcfg, testlogger, nil)
+	if err != nil {
+		t.Fatalf("error creating api: %v", err)
+	}
+	rpc := &ghclient.FakeRepoClient{
+		GetUserRepoPermissionsFunc: func(ctx context.Context, repo, user string) (ghclient.AppRepoPermissions, error) {
+			return ghclient.AppRepoPermissions{Repo: repo, Pull: true, Push: user == "repo.writer"}, nil
+		},
+	}
+	authMiddleware.DL = dl
+	authMiddleware.rpc = rpc
+	defer func() { authMiddleware.rpc = nil }()
+	r := muxtrace.NewRouter()
+	apiv2.register(r)
+	ts := httptest.NewServer(r)
+	defer ts.Close()
+	do := func(user string) (int, []byte) {
+		id, err := dl.CreateAPIKey(context.Background(), models.WritePermission, "user", user)
+		if err != nil {
+			t.Fatalf("api key creation should have succeeded: %v", err)
+		}
+		req, _ := http.NewRequest("POST", ts.URL+"/v2/eventlog/"+el.ID.String()+"/cancel", nil)
+		req.Header.Set(apiKeyHeader, id.String())
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("error executing request: %v", err)
+		}
+		defer resp.Body.Close()
+		bb, _ := ioutil.ReadAll(resp.Body)
+		return resp.StatusCode, bb
+	}
+	if code, bb := do("john.smith"); code != http.StatusForbidden || len(cancelled) != 0 {
+		t.Fatalf("should have been forbidden for another user without repo write access: %v: %v", code, string(bb))
+	}
+	if code, bb := do("jane.doe"); code != http.StatusAccepted || len(cancelled) != 1 {
+		t.Fatalf("should have cancelled the queued create for the event user: %v: %v", code, string(bb))
+	}
+	if code, bb := do("repo.writer"); code != http.StatusAccepted || len(cancelled) != 2 {
+		t.Fatalf("should have cancelled the queued create for a repo writer: %v: %v", code, string(bb))
+	}
+
+	// from the UI
+	cancel := func(user string) int {
+		uis := models.UISession{Authenticated: true, GitHubUser: user}
+		uis.EncryptandSetUserToken([]byte("foo"), oauthcfg.UserTokenEncKey)
+		req, _ := http.NewRequest("POST", "https://foo.com/v2/event/"+el.ID.String()+"/cancel", nil)
+		req = mux.SetURLVars(req, map[string]string{"id": el.ID.String()})
+		req = req.Clone(withSession(req.Context(), uis))
+		rc := httptest.NewRecorder()
+		apiv2.eventCancelHandler(rc, req)
+		return rc.Code
+	}
+	apiv2.oauth.Enforce = true
+	if code := cancel("john.smith"); code != http.StatusForbidden || len(cancelled) != 2 {
+		t.Fatalf("should have been forbidden for another user without repo write access: %v", code)
+	}
+	if code := cancel("jane.doe"); code != http.StatusAccepted || len(cancelled) != 3 {
+		t.Fatalf("should have cancelled the queued create for the event user: %v", code)
+	}
+}
+
+func TestAPIv2WriteJSONError(t *testing.T) {
+	apiv2, err := newV2API(persistence.NewFakeDataLayer(), nil, nil, config.ServerConfig{}, OAuthConfig{}, testlogger, nil)
+	if err != nil {
+		t.Fatalf("error creating api: %v", err)
+	}
+	req, _ := http.NewRequest("GET", "https://foo.com/v2/foo", nil)
+	rc := httptest.NewRecorder()
+	apiv2.writeJSON(rc, req, map[string]interface{}{"foo": "bar", "bad": make(chan int)})
+	res := rc.Result()
+	if res.StatusCode != http.StatusInternalServerError {
+		t.Fatalf("bad status code: %v", res.StatusCode)
+	}
+	if rc.Body.Len() != 0 {
+		t.Fatalf("body should be empty: %v", rc.Body.String())
+	}
+}
@@ -42,6 +42,8 @@ var authMiddleware = reqAuthorizor{}
 type reqAuthorizor struct {
 	apiKeys []string
 	DL      persistence.DataLayer
+	// rpc checks the repo permissions of the GitHub users of non-admin API keys, for events without an environment (optional)
+	rpc ghclient.RepoPermissionsClient
 }
 
 func (ra reqAuthorizor) tokenAuth(f http.HandlerFunc, minPermission models.PermissionLevel) http.HandlerFunc {
@@ -151,18 +153,27 @@ func (ra reqAuthorizor) authorizeEventLog(f http.HandlerFunc) http.HandlerFunc {
 			w.WriteHeader(http.StatusNotFound)
 			return
 		}
-		qa, err := ra.DL.GetQAEnvironment(r.Context(), el.EnvName)
-		if err != nil {
-			log("error getting environment: %v", err)
-			w.WriteHeader(http.StatusInternalServerError)
-			return
-		}
-		if qa == nil {
-			w.WriteHeader(http.StatusNotFound)
-			return
+		var qa *models.QAEnvironment
+		if el.EnvName != "" {
+			qa, err = ra.DL.GetQAEnvironment(r.Context(), el.EnvName)
+			if err != nil {
+				log("error getting environment: %v", err)
+				w.WriteHeader(http.StatusInternalServerError)
+				return
+			}
 		}
 		if apikey.PermissionLevel != models.AdminPermission {
-			if apikey.GitHubUser != qa.User {
+			ok := qa != nil && apikey.GitHubUser == qa.User
+			if qa == nil {
+				// the event has no environment yet (eg, a create waiting in the operation queue)
+				ok, err = ra.envlessEventAuthorized(r.Context(), apikey, el)
+				if err != nil {
+					log("error authorizing event: %v", err)
+					w.WriteHeader(http.StatusInternalServerError)
+					return
+				}
+			}
+			if !ok {
 				log("request not authorized")
 				w.WriteHeader(http.StatusForbidden)
 				return
@@ -172,6 +183,29 @@ func (ra reqAuthorizor) authorizeEventLog(f http.HandlerFunc) http.HandlerFunc {
 	}
 }
 
+// envlessEventAuthorized returns whether the GitHub user of the non-admin apikey may access el, which has no environment:
+// the user must be the event's user or have write access to the event's repo
+func (ra reqAuthorizor) envlessEventAuthorized(ctx context.Context, apikey models.APIKey, el *models.EventLog) (bool, error) {
+	if apikey.GitHubUser == "" {
+		return false, nil
+	}
+	es, err := ra.DL.GetEventStatus(el.ID)
+	if err != nil {
+		return false, errors.Wrap(err, "error getting event status")
+	}
+	if es != nil && es.Config.GitHubUser == apikey.GitHubUser {
+		return true, nil
+	}
+	if ra.rpc == nil || el.Repo == "" {
+		return false, nil
+	}
+	perms, err := ra.rpc.GetUserRepoPermissions(ctx, el.Repo, apikey.GitHubUser)
+	if err != nil {
+		return false, errors.Wrap(err, "error getting user repo permissions")
+	}
+	return perms.Push, nil
+}
+
 // authorize() requires tokenAuth to be called first or will fail
 // does not validate the user name, just that its present or admin token
 func (ra reqAuthorizor) authorize(f http.HandlerFunc) http.HandlerFunc {
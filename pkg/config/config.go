@@ -26,6 +26,18 @@ type ServerConfig struct {
 	ReaperIntervalSecs         uint
 	EventRateLimitPerSecond    uint
 	GlobalEnvironmentLimit     uint
+	GlobalLimitPolicy          string
+	QueuePriorities            []string
+	EnvironmentTTL             time.Duration
+	EnvironmentTTLWarning      time.Duration
+	ManualEnvironmentTTL       time.Duration
+	MaxPinnedPerRepo           uint
+	QuotasJSON                 string
+	ReaperPoliciesJSON         string
+	HibernationIdleDuration    time.Duration
+	HibernationWindow          string
+	HibernationWeekends        bool
+	HibernationTimezone        string
 	HostnameTemplate           string
 	DatadogServiceName         string
 	DebugEndpoints             bool
@@ -33,12 +45,58 @@ type ServerConfig struct {
 	NitroFeatureFlag           bool
 	NotificationsDefaultsJSON  string
 	OperationTimeoutOverride   time.Duration
+	RetryMaxAttempts           uint
+	RetryBackoff               time.Duration
+	RetryMaxBackoff            time.Duration
+	DurableOperationQueue      bool
+	DisableWorker              bool
+	WorkerConcurrency          uint
+	WorkerLeaseDuration        time.Duration
+	WorkerMaxAttempts          uint
+	WorkerRetryBackoff         time.Duration
+	DebounceWindow             time.Duration
+	DebounceWindows            map[string]time.Duration
+	LockProvider               string
+	LockNamespace              string
+	LockLeaseDuration          time.Duration
+	ReplicaID                  string
+	LeaderLeaseDuration        time.Duration
+	LeaderRetryPeriod          time.Duration
+	DataCleanupInterval        time.Duration
 	UIBaseURL                  string
 	UIPath                     string
 	UIBaseRoute                string
 	UIBrandingJSON             string
 }
 
+// ProcessDebounceWindows takes a list of per-repo debounce windows in REPO=DURATION format and populates the DebounceWindows field
+func (sc *ServerConfig) ProcessDebounceWindows(windows []string) error {
+	sc.DebounceWindows = make(map[string]time.Duration)
+	for i, w := range windows {
+		wsl := strings.Split(w, "=")
+		if len(wsl) != 2 {
+			return fmt.Errorf("malformed debounce window at offset %v: %v", i, w)
+		}
+		if rsl := strings.Split(wsl[0], "/"); len(rsl) != 2 {
+			return fmt.Errorf("malformed repo in debounce window at offset %v: %v", i, w)
+		}
+		d, err := time.ParseDuration(wsl[1])
+		if err != nil || d < 0 {
+			return fmt.Errorf("invalid duration in debounce window at offset %v: %v", i, w)
+		}
+		sc.DebounceWindows[wsl[0]] = d
+	}
+	return nil
+}
+
+// DebounceWindowForRepo returns the debounce window for pushes to pull requests of repo
+func (sc ServerConfig) DebounceWindowForRepo(repo string) time.Duration {
+	if d, ok := sc.DebounceWindows[repo]; ok {
+		return d
+	}
+	return sc.DebounceWindow
+}
+
 type PGConfig struct {
 	PostgresURI            string
 	PostgresMigrationsPath string
@@ -132,6 +190,8 @@ func (kc *K8sConfig) ProcessSecretInjections(sf SecretFetcher, injstr string) er
 type HelmClientConfig struct {
 	HelmDriver  string
 	KubeContext string
+	// PostRenderDefaultsJSON is a JSON-encoded post-render config applied to every environment (acyl.yml post_render takes precedence)
+	PostRenderDefaultsJSON string
 }
 
 type ConsulConfig struct {
@@ -22,6 +22,10 @@ func (l *Logger) SetNewStatus(etype models.EventStatusType, envName string, rrd
 			Started:        time.Now().UTC(),
 		},
 	}
+	// retries of the same event are performed with the same logger, so keep the failed attempts recorded so far
+	if s, err := l.DL.GetEventStatus(l.ID); err == nil && s != nil {
+		summary.Config.Retries = s.Config.Retries
+	}
 	if err := l.DL.SetEventStatus(l.ID, summary); err != nil {
 		l.Printf("error setting event status in db: %v", err)
 	}
@@ -118,6 +122,26 @@ func (l *Logger) SetChartCompleted(name string, status models.NodeChartStatus) {
 	}
 }
 
+// SetChartDiff records the rendered manifest diff of the upgrade of the named dependency (name is assumed to exist)
+func (l *Logger) SetChartDiff(name string, diff string) {
+	if err := l.DL.SetEventStatusChartDiff(l.ID, name, diff); err != nil {
+		l.Printf("error setting chart diff: %v: %v", name, err)
+	}
+}
+
+// AddRetry records a failed attempt of the event that will be retried after backoff
+func (l *Logger) AddRetry(attempt uint, err error, backoff time.Duration) {
+	retry := models.EventStatusRetry{
+		Attempt: attempt,
+		Error:   err.Error(),
+		Failed:  time.Now().UTC(),
+		Backoff: backoff,
+	}
+	if err := l.DL.AddEventStatusRetry(l.ID, retry); err != nil {
+		l.Printf("error adding event status retry: %v", err)
+	}
+}
+
 // SetCompletedStatus marks the entire event as completed with status. This is intended to be called once at the end of event processing.
 func (l *Logger) SetCompletedStatus(status models.EventStatus) {
 	if err := l.DL.SetEventStatusCompleted(l.ID, status); err != nil {
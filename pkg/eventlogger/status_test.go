@@ -1,6 +1,7 @@
 package eventlogger
 
 import (
+	"errors"
 	"os"
 	"testing"
 	"time"
@@ -248,6 +249,52 @@ func TestSetChartCompleted(t *testing.T) {
 	}
 }
 
+func TestSetChartDiff(t *testing.T) {
+	dl := persistence.NewFakeDataLayer()
+	id, _ := uuid.NewRandom()
+	elog := Logger{DL: dl, ID: id, Sink: os.Stderr}
+	elog.Init([]byte{}, "foo/bar", 99)
+
+	rrd := models.RepoRevisionData{Repo: "foo/bar", PullRequest: 12, User: "john.doe", SourceBranch: "feature-foo", SourceSHA: "asdf"}
+	elog.SetNewStatus(models.UpdateEvent, "some-name", rrd)
+
+	elog.SetInitialStatus(&testRC, 10*time.Millisecond)
+
+	elog.SetChartDiff("something", "image tag changed: quay.io/foo/something:1234 => quay.io/foo/something:5678")
+
+	el2, err := dl.GetEventStatus(id)
+	if err != nil {
+		t.Fatalf("error getting event status: %v", err)
+	}
+
+	if diff := el2.Tree["something"].Chart.Diff; diff != "image tag changed: quay.io/foo/something:1234 => quay.io/foo/something:5678" {
+		t.Fatalf("unexpected diff: %v", diff)
+	}
+}
+
+func TestAddRetry(t *testing.T) {
+	dl := persistence.NewFakeDataLayer()
+	id, _ := uuid.NewRandom()
+	elog := Logger{DL: dl, ID: id, Sink: os.Stderr}
+	elog.Init([]byte{}, "foo/bar", 99)
+
+	rrd := models.RepoRevisionData{Repo: "foo/bar", PullRequest: 12, User: "john.doe", SourceBranch: "feature-foo", SourceSHA: "asdf"}
+	elog.SetNewStatus(models.CreateEvent, "some-name", rrd)
+
+	elog.AddRetry(1, errors.New("api server timeout"), time.Second)
+
+	// the next attempt starts a new status, retaining the retries
+	elog.SetNewStatus(models.CreateEvent, "some-name", rrd)
+
+	el2, err := dl.GetEventStatus(id)
+	if err != nil {
+		t.Fatalf("error getting event status: %v", err)
+	}
+	if len(el2.Config.Retries) != 1 || el2.Config.Retries[0].Attempt != 1 || el2.Config.Retries[0].Error != "api server timeout" || el2.Config.Retries[0].Backoff != time.Second {
+		t.Fatalf("unexpected retries: %+v", el2.Config.Retries)
+	}
+}
+
 func TestSetCompletedStatus(t *testing.T) {
 	dl := persistence.NewFakeDataLayer()
 	id, _ := uuid.NewRandom()
@@ -60,12 +60,36 @@ func NewGitHubApp(privateKeyPEM []byte, appID uint, webhookSecret string, suppor
 	for _, a := range supportedPRActions {
 		sa[a] = struct{}{}
 	}
+	c := appConfig(privateKeyPEM, appID)
+	c.App.WebhookSecret = webhookSecret
+	cc, err := newClientCreator(c)
+	if err != nil {
+		return nil, err
+	}
+	return &GitHubApp{
+		prh: &prEventHandler{
+			ClientCreator:      cc,
+			dl:                 dl,
+			supportedPRActions: sa,
+			RRDCallback:        prcb,
+		},
+		ch: &checksEventHandler{
+			ClientCreator: cc,
+		},
+		cfg: c,
+	}, nil
+}
+
+func appConfig(privateKeyPEM []byte, appID uint) githubapp.Config {
 	c := githubapp.Config{}
 	c.V3APIURL = GitHubV3APIURL
 	c.V4APIURL = GitHubV4APIURL
 	c.App.IntegrationID = int64(appID)
 	c.App.PrivateKey = string(privateKeyPEM)
-	c.App.WebhookSecret = webhookSecret
+	return c
+}
+
+func newClientCreator(c githubapp.Config) (githubapp.ClientCreator, error) {
 	tr := &http.Transport{
 		DialContext: (&net.Dialer{
 			Timeout: 60 * time.Second,
@@ -78,18 +102,19 @@ func NewGitHubApp(privateKeyPEM []byte, appID uint, webhookSecret string, suppor
 	if err != nil {
 		return nil, errors.Wrap(err, "error initializing github app default client")
 	}
-	return &GitHubApp{
-		prh: &prEventHandler{
-			ClientCreator:      cc,
-			dl:                 dl,
-			supportedPRActions: sa,
-			RRDCallback:        prcb,
-		},
-		ch: &checksEventHandler{
-			ClientCreator: cc,
-		},
-		cfg: c,
-	}, nil
+	return cc, nil
+}
+
+// NewClientFactory returns a GithubAppClientFactory for the app with the given private key and app ID, for processing
+// webhook events outside of the webhook request (see NewGitHubClientContext)
+func NewClientFactory(privateKeyPEM []byte, appID uint) (GithubAppClientFactory, error) {
+	if len(privateKeyPEM) == 0 {
+		return nil, errors.New("invalid private key")
+	}
+	if appID == 0 {
+		return nil, errors.New("invalid app ID")
+	}
+	return newClientCreator(appConfig(privateKeyPEM, appID))
 }
 
 // Handler returns the http.Handler that should handle the webhook HTTP endpoint
@@ -141,6 +141,69 @@ func (ghc *GitHubClient) GetUserAppRepoPermissions(ctx context.Context, instID i
 	return out, nil
 }
 
+// RepoPermissionsClient describes a GitHub client that returns the permissions of any user on a repo
+type RepoPermissionsClient interface {
+	GetUserRepoPermissions(ctx context.Context, repo, user string) (AppRepoPermissions, error)
+}
+
+// GetUserRepoPermissions gets the permissions of user on repo ("owner/repo"), as seen by the client's token
+func (ghc *GitHubClient) GetUserRepoPermissions(ctx context.Context, repo, user string) (AppRepoPermissions, error) {
+	rs := strings.Split(repo, "/")
+	if len(rs) != 2 {
+		return AppRepoPermissions{}, fmt.Errorf("malformed repo: %v", repo)
+	}
+	ctx, cf := context.WithTimeout(ctx, ghTimeout)
+	defer cf()
+	pl, _, err := ghc.getClient(ctx).Repositories.GetPermissionLevel(ctx, rs[0], rs[1], user)
+	if err != nil {
+		return AppRepoPermissions{}, fmt.Errorf("error getting user permission level: %v", err)
+	}
+	out := AppRepoPermissions{Repo: repo}
+	// the permission level is one of "admin", "write", "read" or "none"
+	switch pl.GetPermission() {
+	case "admin":
+		out.Admin = true
+		fallthrough
+	case "write":
+		out.Push = true
+		fallthrough
+	case "read":
+		out.Pull = true
+	}
+	return out, nil
+}
+
+// TeamMembersClient describes a GitHub client that lists the members of teams
+type TeamMembersClient interface {
+	GetTeamMembers(ctx context.Context, team string) ([]string, error)
+}
+
+// GetTeamMembers gets the logins of all members of team ("org/team-slug"), including members of child teams.
+// The client's token requires read access to the org's members.
+func (ghc *GitHubClient) GetTeamMembers(ctx context.Context, team string) ([]string, error) {
+	ts := strings.Split(team, "/")
+	if len(ts) != 2 {
+		return nil, fmt.Errorf("malformed team (expected org/team-slug): %v", team)
+	}
+	lopt := &github.TeamListTeamMembersOptions{ListOptions: github.ListOptions{PerPage: 100}}
+	out := []string{}
+	for {
+		ctx, cf := context.WithTimeout(ctx, ghTimeout)
+		defer cf()
+		users, resp, err := ghc.getClient(ctx).Teams.ListTeamMembersBySlug(ctx, ts[0], ts[1], lopt)
+		if err != nil {
+			return nil, fmt.Errorf("error listing team members: %v", err)
+		}
+		for _, u := range users {
+			out = append(out, u.GetLogin())
+		}
+		if resp.NextPage == 0 {
+			return out, nil
+		}
+		lopt.Page = resp.NextPage
+	}
+}
+
 type RepoAppClient interface {
 	GetInstallationTokenForRepo(ctx context.Context, instID int64, reponame string) (string, error)
 }
@@ -9,6 +9,7 @@ type FakeRepoClient struct {
 	GetTagsFunc                   func(context.Context, string) ([]BranchInfo, error)
 	SetStatusFunc                 func(context.Context, string, string, *CommitStatus) error
 	GetPRStatusFunc               func(context.Context, string, uint) (string, error)
+	GetPRLabelsFunc               func(ctx context.Context, repo string, pr uint) ([]string, error)
 	GetCommitMessageFunc          func(context.Context, string, string) (string, error)
 	GetFileContentsFunc           func(ctx context.Context, repo string, path string, ref string) ([]byte, error)
 	GetDirectoryContentsFunc      func(ctx context.Context, repo, path, ref string) (map[string]FileContents, error)
@@ -17,10 +18,14 @@ type FakeRepoClient struct {
 	GetUserFunc                   func(ctx context.Context) (string, error)
 	GetUserAppRepoPermissionsFunc func(ctx context.Context, instID int64) (map[string]AppRepoPermissions, error)
 	GetRepoArchiveFunc            func(ctx context.Context, repo, ref string) (string, error)
+	GetUserRepoPermissionsFunc    func(ctx context.Context, repo, user string) (AppRepoPermissions, error)
+	GetTeamMembersFunc            func(ctx context.Context, team string) ([]string, error)
 }
 
 var _ RepoClient = &FakeRepoClient{}
 var _ GitHubAppInstallationClient = &FakeRepoClient{}
+var _ RepoPermissionsClient = &FakeRepoClient{}
+var _ TeamMembersClient = &FakeRepoClient{}
 
 func (frc *FakeRepoClient) GetBranch(ctx context.Context, repo string, branch string) (BranchInfo, error) {
 	if frc.GetBranchFunc != nil {
@@ -52,6 +57,12 @@ func (frc *FakeRepoClient) GetPRStatus(ctx context.Context, repo string, pr uint
 	}
 	return "", nil
 }
+func (frc *FakeRepoClient) GetPRLabels(ctx context.Context, repo string, pr uint) ([]string, error) {
+	if frc.GetPRLabelsFunc != nil {
+		return frc.GetPRLabelsFunc(ctx, repo, pr)
+	}
+	return []string{}, nil
+}
 func (frc *FakeRepoClient) GetCommitMessage(ctx context.Context, repo string, sha string) (string, error) {
 	if frc.GetCommitMessageFunc != nil {
 		return frc.GetCommitMessageFunc(ctx, repo, sha)
@@ -106,6 +117,20 @@ func (frc *FakeRepoClient) GetRepoArchive(ctx context.Context, repo, ref string)
 	return "foo.tar.gz", nil
 }
 
+func (frc *FakeRepoClient) GetUserRepoPermissions(ctx context.Context, repo, user string) (AppRepoPermissions, error) {
+	if frc.GetUserRepoPermissionsFunc != nil {
+		return frc.GetUserRepoPermissionsFunc(ctx, repo, user)
+	}
+	return AppRepoPermissions{Repo: repo}, nil
+}
+
+func (frc *FakeRepoClient) GetTeamMembers(ctx context.Context, team string) ([]string, error) {
+	if frc.GetTeamMembersFunc != nil {
+		return frc.GetTeamMembersFunc(ctx, team)
+	}
+	return []string{}, nil
+}
+
 type FakeRepoAppClient struct {
 	GetInstallationTokenForRepoFunc func(ctx context.Context, instID int64, reponame string) (string, error)
 }
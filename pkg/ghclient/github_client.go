@@ -44,6 +44,7 @@ type RepoClient interface {
 	GetTags(context.Context, string) ([]BranchInfo, error)
 	SetStatus(context.Context, string, string, *CommitStatus) error
 	GetPRStatus(context.Context, string, uint) (string, error)
+	GetPRLabels(ctx context.Context, repo string, pr uint) ([]string, error)
 	GetCommitMessage(context.Context, string, string) (string, error)
 	GetFileContents(ctx context.Context, repo string, path string, ref string) ([]byte, error)
 	GetDirectoryContents(ctx context.Context, repo, path, ref string) (map[string]FileContents, error)
@@ -210,6 +211,28 @@ func (ghc *GitHubClient) GetPRStatus(ctx context.Context, repo string, pr uint)
 	return *pullreq.State, nil
 }
 
+// GetPRLabels returns the names of the labels applied to a PR on a repo
+func (ghc *GitHubClient) GetPRLabels(ctx context.Context, repo string, pr uint) ([]string, error) {
+	rs := strings.Split(repo, "/")
+	if len(rs) != 2 {
+		return nil, fmt.Errorf("malformed repo: %v", repo)
+	}
+	ctx, cf := context.WithTimeout(ctx, ghTimeout)
+	defer cf()
+	pullreq, _, err := ghc.getClient(ctx).PullRequests.Get(ctx, rs[0], rs[1], int(pr))
+	if err != nil {
+		return nil, err
+	}
+	if pullreq == nil {
+		return nil, fmt.Errorf("pull request is nil")
+	}
+	out := make([]string, 0, len(pullreq.Labels))
+	for _, l := range pullreq.Labels {
+		out = append(out, l.GetName())
+	}
+	return out, nil
+}
+
 // GetCommitMessage returns the git message associated with a particular commit
 func (ghc *GitHubClient) GetCommitMessage(ctx context.Context, repo string, sha string) (string, error) {
 	rs := strings.Split(repo, "/")
@@ -484,5 +484,6 @@ func (lw *LocalWrapper) SetStatus(ctx context.Context, repo string, sha string,
 }
 
 // stubs to satisfy the interface
-func (lw *LocalWrapper) GetTags(context.Context, string) ([]BranchInfo, error)     { return nil, nil }
-func (lw *LocalWrapper) GetPRStatus(context.Context, string, uint) (string, error) { return "", nil }
+func (lw *LocalWrapper) GetTags(context.Context, string) ([]BranchInfo, error)       { return nil, nil }
+func (lw *LocalWrapper) GetPRStatus(context.Context, string, uint) (string, error)   { return "", nil }
+func (lw *LocalWrapper) GetPRLabels(context.Context, string, uint) ([]string, error) { return nil, nil }
@@ -256,7 +256,7 @@ func TestGenerateRepoMetadata(t *testing.T) {
 	}
 	rrd := hook.generateRepoMetadataPR(event)
 
-	if *rrd != expected {
+	if !reflect.DeepEqual(*rrd, expected) {
 		t.Fatalf("Expected %v but received %v", expected, rrd)
 	}
 }
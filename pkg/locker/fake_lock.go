@@ -5,6 +5,9 @@ import (
 	"fmt"
 	"log"
 	"math/rand"
+	"sort"
+	"strconv"
+	"strings"
 	"sync"
 	"time"
 
@@ -13,6 +16,7 @@ import (
 
 type fakeLockStoreEntry struct {
 	lock       chan struct{}
+	holder     uuid.UUID
 	contenders []*FakePreemptableLock
 }
 
@@ -20,6 +24,7 @@ type fakeLockStoreEntry struct {
 type fakeLockStore struct {
 	envToLockKey map[string]int64
 	locks        map[int64]*fakeLockStoreEntry
+	releases     []LockForceRelease
 	mutex        sync.Mutex
 }
 
@@ -37,14 +42,22 @@ func (fls *fakeLockStore) store(key int64, lock *FakePreemptableLock) {
 	fls.locks[key].contenders = append(fls.locks[key].contenders, lock)
 }
 
-func (fls *fakeLockStore) lock(ctx context.Context, key int64) error {
+func (fls *fakeLockStore) lock(ctx context.Context, key int64, id uuid.UUID) error {
 	fls.mutex.Lock()
-	defer fls.mutex.Unlock()
 	entry := fls.locks[key]
+	fls.mutex.Unlock()
 	select {
 	case <-ctx.Done():
 		return ctx.Err()
 	case entry.lock <- struct{}{}:
+		fls.mutex.Lock()
+		entry.holder = id
+		for _, lock := range entry.contenders {
+			if lock.id == id {
+				lock.acquired = time.Now().UTC()
+			}
+		}
+		fls.mutex.Unlock()
 		return nil
 	}
 }
@@ -59,18 +72,25 @@ func (fls *fakeLockStore) unlock(ctx context.Context, key int64, id uuid.UUID) e
 	}
 
 	// remove the key from the slice of lock contenders
-	var index int
+	index := -1
 	for i, lock := range fls.locks[key].contenders {
 		if lock.id == id {
 			index = i
 			break
 		}
 	}
+	if index == -1 {
+		return nil
+	}
 
 	fls.locks[key].contenders[index] = fls.locks[key].contenders[length-1]
 	fls.locks[key].contenders[length-1] = nil
 	fls.locks[key].contenders = fls.locks[key].contenders[:length-1]
-	go func() { <-entry.lock }()
+	// only the holder releases the lock, a contender that never acquired it (or was preempted) just stops contending
+	if entry.holder == id {
+		entry.holder = uuid.Nil
+		go func() { <-entry.lock }()
+	}
 	return nil
 }
 
@@ -80,14 +100,23 @@ func (fls *fakeLockStore) notify(ctx context.Context, key int64, id uuid.UUID) e
 	if _, ok := fls.locks[key]; !ok {
 		return nil
 	}
+	// like the postgres lock, the notification carries the event of the notifying lock
+	var message string
+	for _, lock := range fls.locks[key].contenders {
+		if lock.id == id {
+			message = lock.event
+		}
+	}
 	for _, lock := range fls.locks[key].contenders {
 		if lock.id == id {
 			continue
 		}
+		lock.preempted = time.Now().UTC()
+		lock.preemptedBy = message
 		np := NotificationPayload{
 			LockKey: key,
 			ID:      lock.id,
-			Message: lock.event,
+			Message: message,
 		}
 		go lock.handleNotification(np)
 	}
@@ -141,6 +170,116 @@ func (flp *FakeLockProvider) New(ctx context.Context, key int64, event string) (
 	return l, nil
 }
 
+var _ LockInspector = &FakeLockProvider{}
+var _ LockHolderInspector = &FakeLockProvider{}
+
+// HolderEvent returns the event of the holder of the lock for key, or the empty string if it isn't held
+func (flp *FakeLockProvider) HolderEvent(ctx context.Context, key int64) (string, error) {
+	return envLockHolderEvent(ctx, flp, key)
+}
+
+// EnvLocks returns the env locks that are held or waited for
+func (flp *FakeLockProvider) EnvLocks(ctx context.Context) ([]EnvLock, error) {
+	flp.store.mutex.Lock()
+	defer flp.store.mutex.Unlock()
+	out := []EnvLock{}
+	for envKey, key := range flp.store.envToLockKey {
+		entry, ok := flp.store.locks[key]
+		if !ok {
+			continue
+		}
+		el := EnvLock{Key: key, Requests: []LockRequest{}}
+		i := strings.LastIndex(envKey, "/")
+		el.Repo = envKey[:i]
+		pr, _ := strconv.Atoi(envKey[i+1:])
+		el.PullRequest = uint(pr)
+		for _, lock := range entry.contenders {
+			if lock.requested.IsZero() {
+				continue
+			}
+			lr := LockRequest{
+				Event:       lock.event,
+				Requested:   lock.requested,
+				Preempted:   lock.preempted,
+				PreemptedBy: lock.preemptedBy,
+			}
+			if entry.holder == lock.id {
+				lr.Acquired = lock.acquired
+			}
+			lr.State = lockRequestState(lr.Acquired, lr.Preempted)
+			el.Requests = append(el.Requests, lr)
+		}
+		if len(el.Requests) == 0 {
+			continue
+		}
+		sort.Slice(el.Requests, func(i, j int) bool {
+			if el.Requests[i].Acquired.IsZero() != el.Requests[j].Acquired.IsZero() {
+				return !el.Requests[i].Acquired.IsZero()
+			}
+			return el.Requests[i].Requested.Before(el.Requests[j].Requested)
+		})
+		out = append(out, el)
+	}
+	sort.Slice(out, func(i, j int) bool {
+		if out[i].Repo != out[j].Repo {
+			return out[i].Repo < out[j].Repo
+		}
+		return out[i].PullRequest < out[j].PullRequest
+	})
+	return out, nil
+}
+
+// ForceRelease releases the env lock for repo and pr and notifies the holder that it was preempted
+func (flp *FakeLockProvider) ForceRelease(ctx context.Context, repo string, pr uint, user, reason string) (*LockForceRelease, error) {
+	flp.store.mutex.Lock()
+	key, ok := flp.store.envToLockKey[fmt.Sprintf("%s/%d", repo, pr)]
+	var holder *FakePreemptableLock
+	if entry := flp.store.locks[key]; ok && entry != nil {
+		for _, lock := range entry.contenders {
+			if lock.id == entry.holder {
+				holder = lock
+			}
+		}
+	}
+	flp.store.mutex.Unlock()
+	if holder == nil {
+		return nil, ErrLockNotHeld
+	}
+	if err := holder.Unlock(ctx); err != nil {
+		return nil, fmt.Errorf("error unlocking holder: %v", err)
+	}
+	go holder.handleNotification(NotificationPayload{
+		ID:      holder.id,
+		LockKey: key,
+		Message: fmt.Sprintf("lock force-released by %v: %v", user, reason),
+	})
+	lfr := LockForceRelease{
+		ID:          uuid.New(),
+		Created:     time.Now().UTC(),
+		Key:         key,
+		Repo:        repo,
+		PullRequest: pr,
+		HolderEvent: holder.event,
+		User:        user,
+		Reason:      reason,
+	}
+	flp.store.mutex.Lock()
+	flp.store.releases = append(flp.store.releases, lfr)
+	flp.store.mutex.Unlock()
+	return &lfr, nil
+}
+
+// ForceReleases returns the most recent forced releases of locks, newest first
+func (flp *FakeLockProvider) ForceReleases(ctx context.Context, limit uint) ([]LockForceRelease, error) {
+	flp.store.mutex.Lock()
+	defer flp.store.mutex.Unlock()
+	out := []LockForceRelease{}
+	for i := len(flp.store.releases) - 1; i >= 0 && uint(len(out)) < limit; i-- {
+		out = append(out, flp.store.releases[i])
+	}
+	return out, nil
+}
+
 var _ PreemptableLock = &FakePreemptableLock{}
 
 type FakePreemptableLock struct {
@@ -150,12 +289,19 @@ type FakePreemptableLock struct {
 	key     int64
 	preempt chan NotificationPayload
 	conf    LockProviderConfig
+
+	// the request state is guarded by the store mutex
+	requested, acquired, preempted time.Time
+	preemptedBy                    string
 }
 
 func (fpl *FakePreemptableLock) Lock(ctx context.Context) (<-chan NotificationPayload, error) {
+	fpl.store.mutex.Lock()
+	fpl.requested = time.Now().UTC()
+	fpl.store.mutex.Unlock()
 	lockCtx, cancel := context.WithTimeout(ctx, fpl.conf.lockTimeout)
 	defer cancel()
-	err := fpl.store.lock(lockCtx, fpl.key)
+	err := fpl.store.lock(lockCtx, fpl.key, fpl.id)
 	if err != nil {
 		return nil, fmt.Errorf("unable to lock fake preemptable lock: %v", err)
 	}
@@ -0,0 +1,136 @@
+package locker
+
+import (
+	"context"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/pkg/errors"
+)
+
+// LockRequestState enumerates the states of a request for a lock
+type LockRequestState string
+
+const (
+	// LockRequestWaiting means the requester is blocked waiting for the lock to be released
+	LockRequestWaiting LockRequestState = "waiting"
+	// LockRequestHeld means the requester holds the lock
+	LockRequestHeld LockRequestState = "held"
+	// LockRequestPreempted means the requester was signalled to release the lock (or stop waiting for it) but hasn't done so yet
+	LockRequestPreempted LockRequestState = "preempted"
+)
+
+// LockRequest models a request for a lock by a locker that is either waiting for the lock or holding it
+type LockRequest struct {
+	// Event is the event of the locker, which describes the operation that requested the lock
+	Event string           `json:"event"`
+	State LockRequestState `json:"state"`
+	// Requested is when the lock was requested
+	Requested time.Time `json:"requested"`
+	// Acquired is when the lock was acquired (zero if it hasn't been)
+	Acquired time.Time `json:"acquired"`
+	// Preempted is when the requester was signalled to release the lock (zero if it hasn't been) and PreemptedBy is the event of the locker that signalled it
+	Preempted   time.Time `json:"preempted"`
+	PreemptedBy string    `json:"preempted_by"`
+	// PID is the process ID of the Postgres session of the request (zero for other lock providers)
+	PID int `json:"pid"`
+}
+
+// EnvLock models the lock for a repo and pull request and the current requests for it
+type EnvLock struct {
+	Key         int64         `json:"key"`
+	Repo        string        `json:"repo"`
+	PullRequest uint          `json:"pull_request"`
+	Requests    []LockRequest `json:"requests"`
+}
+
+// Holder returns the request that holds the lock, or nil if the lock isn't held
+func (el EnvLock) Holder() *LockRequest {
+	for i := range el.Requests {
+		if !el.Requests[i].Acquired.IsZero() {
+			return &el.Requests[i]
+		}
+	}
+	return nil
+}
+
+// LockForceRelease is the audit record of an env lock that was forcibly released by an admin
+type LockForceRelease struct {
+	ID          uuid.UUID `json:"id"`
+	Created     time.Time `json:"created"`
+	Key         int64     `json:"key"`
+	Repo        string    `json:"repo"`
+	PullRequest uint      `json:"pull_request"`
+	HolderEvent string    `json:"holder_event"`
+	HolderPID   int       `json:"holder_pid"`
+	User        string    `json:"user"`
+	Reason      string    `json:"reason"`
+}
+
+// ErrLockNotHeld is returned when attempting to force-release a lock that isn't held
+var ErrLockNotHeld = errors.New("lock is not held")
+
+// LockInspector describes an object that can list env locks and the requests for them, and forcibly release stuck locks.
+// Forcibly releasing a lock signals the holder that it was preempted like a newer request would, but releases the lock
+// without waiting for the holder, so it should only be used if the holder is stuck.
+type LockInspector interface {
+	EnvLocks(ctx context.Context) ([]EnvLock, error)
+	ForceRelease(ctx context.Context, repo string, pr uint, user, reason string) (*LockForceRelease, error)
+	ForceReleases(ctx context.Context, limit uint) ([]LockForceRelease, error)
+}
+
+// ErrHolderUnknown is returned when the lock provider can't report the holder of a lock
+var ErrHolderUnknown = errors.New("lock provider doesn't support inspecting the lock holder")
+
+// LockHolderInspector describes a LockProvider that can report the event of the holder of a lock, so that a specific
+// operation can be preempted only if it holds the lock
+type LockHolderInspector interface {
+	// HolderEvent returns the event of the holder of the lock for key, or the empty string if it isn't held
+	HolderEvent(ctx context.Context, key int64) (string, error)
+}
+
+// LockGarbageCollector describes a LockProvider that stores an object for every lock key, which must be deleted once the
+// lock is no longer used
+type LockGarbageCollector interface {
+	// CollectGarbage deletes the objects of locks that aren't held and haven't been used within maxAge, returning the number deleted
+	CollectGarbage(ctx context.Context, maxAge time.Duration) (int, error)
+}
+
+// envLockHolderEvent returns the event of the holder of the lock for key among the env locks of li
+func envLockHolderEvent(ctx context.Context, li LockInspector, key int64) (string, error) {
+	locks, err := li.EnvLocks(ctx)
+	if err != nil {
+		return "", errors.Wrap(err, "error getting locks")
+	}
+	for _, el := range locks {
+		if el.Key != key {
+			continue
+		}
+		if h := el.Holder(); h != nil {
+			return h.Event, nil
+		}
+	}
+	return "", nil
+}
+
+// findEnvLock returns the lock for repo and pr in locks, or nil if there are no requests for it
+func findEnvLock(locks []EnvLock, repo string, pr uint) *EnvLock {
+	for i := range locks {
+		if locks[i].Repo == repo && locks[i].PullRequest == pr {
+			return &locks[i]
+		}
+	}
+	return nil
+}
+
+// lockRequestState returns the state of a request
+func lockRequestState(acquired, preempted time.Time) LockRequestState {
+	switch {
+	case !preempted.IsZero():
+		return LockRequestPreempted
+	case !acquired.IsZero():
+		return LockRequestHeld
+	default:
+		return LockRequestWaiting
+	}
+}
@@ -0,0 +1,617 @@
+package locker
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"hash/fnv"
+	"math"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/dollarshaveclub/acyl/pkg/eventlogger"
+	"github.com/google/uuid"
+	"github.com/pkg/errors"
+	coordinationv1 "k8s.io/api/coordination/v1"
+	kerrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/fields"
+	"k8s.io/apimachinery/pkg/watch"
+	coordinationv1client "k8s.io/client-go/kubernetes/typed/coordination/v1"
+)
+
+const (
+	// kubernetesLockRetryPeriod is how often a waiting lock attempts to acquire the Lease if it hasn't seen it change
+	kubernetesLockRetryPeriod = time.Second
+
+	leaseNamePrefix = "acyl-lock-"
+
+	// LockLeaseLabel is the label of the Leases created by the Kubernetes lock provider
+	LockLeaseLabel = "acyl.io/lock"
+
+	// Lease annotations
+	repoAnnotation        = "acyl.io/repo"
+	pullRequestAnnotation = "acyl.io/pull-request"
+	holderEventAnnotation = "acyl.io/holder-event"
+	// releasedAnnotation is the time the Lease was last released, since releasing it clears the renew time
+	releasedAnnotation = "acyl.io/released"
+	// preemptAnnotation contains the JSON encoded NotificationPayload of the most recent notification
+	preemptAnnotation = "acyl.io/preempt"
+)
+
+// errLeaseLost is sent to the holder if the Lease was acquired by another lock (because it expired) or released
+var errLeaseLost = errors.New("lease is no longer held")
+
+var _ LockProvider = &KubernetesLockProvider{}
+
+// KubernetesLockProvider provides PreemptableLocks backed by coordination.k8s.io Leases, one per lock key.
+// The holder of a lock renews its Lease periodically, so if the holder dies the lock is released once the Lease expires.
+// Notifications are sent by writing them to an annotation of the Lease, which is watched by the holder and waiters.
+// Unlike the Postgres lock provider, it does not depend on long-lived database sessions.
+type KubernetesLockProvider struct {
+	conf LockProviderConfig
+}
+
+// newKubernetesLockProvider returns a KubernetesLockProvider, which implements the LockProvider interface
+func newKubernetesLockProvider(conf LockProviderConfig) *KubernetesLockProvider {
+	return &KubernetesLockProvider{conf: conf}
+}
+
+func (klp *KubernetesLockProvider) leases() coordinationv1client.LeaseInterface {
+	return klp.conf.kubernetesClient.CoordinationV1().Leases(klp.conf.kubernetesNamespace)
+}
+
+// LockKey returns the lock key for repo and pullRequest, which is derived from them, and ensures the Lease for the key exists
+func (klp *KubernetesLockProvider) LockKey(ctx context.Context, repo string, pullRequest uint) (int64, error) {
+	h := fnv.New64a()
+	fmt.Fprintf(h, "%s/%d", repo, pullRequest)
+	key := int64(h.Sum64() & math.MaxInt64)
+	_, err := ensureLease(ctx, klp.leases(), key, map[string]string{
+		repoAnnotation:        repo,
+		pullRequestAnnotation: strconv.Itoa(int(pullRequest)),
+	})
+	if err != nil {
+		return 0, errors.Wrap(err, "unable to ensure lease exists")
+	}
+	return key, nil
+}
+
+func (klp *KubernetesLockProvider) New(ctx context.Context, key int64, event string) (PreemptableLock, error) {
+	return NewKubernetesLock(ctx, klp.leases(), key, event, klp.conf)
+}
+
+var _ LockHolderInspector = &KubernetesLockProvider{}
+
+// HolderEvent returns the event of the holder of the Lease for key, or the empty string if it isn't held or has expired
+func (klp *KubernetesLockProvider) HolderEvent(ctx context.Context, key int64) (string, error) {
+	lease, err := klp.leases().Get(ctx, leaseName(key), metav1.GetOptions{})
+	if err != nil {
+		if kerrors.IsNotFound(err) {
+			return "", nil
+		}
+		return "", errors.Wrap(err, "error getting lease")
+	}
+	if leaseHolder(lease) == "" || leaseExpired(lease) {
+		return "", nil
+	}
+	return lease.Annotations[holderEventAnnotation], nil
+}
+
+var _ LockGarbageCollector = &KubernetesLockProvider{}
+
+// CollectGarbage deletes the Leases of locks that aren't held and haven't been used within maxAge, since a Lease is
+// created for every repo and pull request. It returns the number of Leases deleted.
+func (klp *KubernetesLockProvider) CollectGarbage(ctx context.Context, maxAge time.Duration) (int, error) {
+	leases, err := klp.leases().List(ctx, metav1.ListOptions{LabelSelector: LockLeaseLabel + "=true"})
+	if err != nil {
+		return 0, errors.Wrap(err, "error listing leases")
+	}
+	var n int
+	for i := range leases.Items {
+		lease := &leases.Items[i]
+		if leaseHolder(lease) != "" && !leaseExpired(lease) {
+			continue
+		}
+		if time.Since(leaseLastUsed(lease)) < maxAge {
+			continue
+		}
+		// the precondition ensures the Lease wasn't acquired since it was listed
+		err := klp.leases().Delete(ctx, lease.Name, metav1.DeleteOptions{
+			Preconditions: &metav1.Preconditions{ResourceVersion: &lease.ResourceVersion},
+		})
+		if err != nil {
+			if kerrors.IsNotFound(err) || kerrors.IsConflict(err) {
+				continue
+			}
+			return n, errors.Wrapf(err, "error deleting lease: %v", lease.Name)
+		}
+		n++
+	}
+	return n, nil
+}
+
+// leaseLastUsed returns the last time lease was created, acquired, renewed or released
+func leaseLastUsed(lease *coordinationv1.Lease) time.Time {
+	last := lease.CreationTimestamp.Time
+	for _, mt := range []*metav1.MicroTime{lease.Spec.AcquireTime, lease.Spec.RenewTime} {
+		if mt != nil && mt.Time.After(last) {
+			last = mt.Time
+		}
+	}
+	if released, err := time.Parse(time.RFC3339, lease.Annotations[releasedAnnotation]); err == nil && released.After(last) {
+		last = released
+	}
+	return last
+}
+
+// leaseName returns the name of the Lease for key
+func leaseName(key int64) string {
+	return fmt.Sprintf("%s%d", leaseNamePrefix, key)
+}
+
+// ensureLease returns the Lease for key, creating it with annotations if it doesn't exist
+func ensureLease(ctx context.Context, leases coordinationv1client.LeaseInterface, key int64, annotations map[string]string) (*coordinationv1.Lease, error) {
+	lease, err := leases.Get(ctx, leaseName(key), metav1.GetOptions{})
+	if err == nil {
+		return lease, nil
+	}
+	if !kerrors.IsNotFound(err) {
+		return nil, errors.Wrap(err, "error getting lease")
+	}
+	lease, err = leases.Create(ctx, &coordinationv1.Lease{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:        leaseName(key),
+			Labels:      map[string]string{LockLeaseLabel: "true"},
+			Annotations: annotations,
+		},
+	}, metav1.CreateOptions{})
+	if err != nil {
+		if kerrors.IsAlreadyExists(err) {
+			// created concurrently by another lock
+			lease, err = leases.Get(ctx, leaseName(key), metav1.GetOptions{})
+			return lease, errors.Wrap(err, "error getting lease")
+		}
+		return nil, errors.Wrap(err, "error creating lease")
+	}
+	return lease, nil
+}
+
+// leaseHolder returns the holder identity of lease, or the empty string if it isn't held
+func leaseHolder(lease *coordinationv1.Lease) string {
+	if lease.Spec.HolderIdentity == nil {
+		return ""
+	}
+	return *lease.Spec.HolderIdentity
+}
+
+// leaseExpired returns whether lease hasn't been renewed by its holder within the lease duration
+func leaseExpired(lease *coordinationv1.Lease) bool {
+	if lease.Spec.RenewTime == nil || lease.Spec.LeaseDurationSeconds == nil {
+		return true
+	}
+	return lease.Spec.RenewTime.Add(time.Duration(*lease.Spec.LeaseDurationSeconds) * time.Second).Before(time.Now())
+}
+
+var _ PreemptableLock = &KubernetesLock{}
+
+type KubernetesLock struct {
+	// id is a unique identifier for this lock, which is the holder identity of the Lease while the lock is held.
+	// This way, we can also determine if the notifications we receive are from other locks
+	id uuid.UUID
+
+	// key used to obtain the lock
+	key int64
+
+	// name is the name of the Lease for the key
+	name string
+
+	leases coordinationv1client.LeaseInterface
+
+	// preempted is the channel over which notifications are sent to the holder
+	preempted chan NotificationPayload
+
+	// waitPreempted receives notifications while the lock is waiting to be acquired
+	waitPreempted chan NotificationPayload
+
+	// changed is signalled when the Lease is modified, so that a waiting lock attempts to acquire it immediately
+	changed chan struct{}
+
+	// stop is closed when the lock is unlocked, which stops the watch and keepalive goroutines
+	stop     chan struct{}
+	stopOnce sync.Once
+
+	// message represents a descriptive reason to communicate to other lock holders why their operation was preempted, optional
+	message string
+
+	elog *eventlogger.Logger
+	conf LockProviderConfig
+
+	mu sync.Mutex
+	// lastNotification is the value of the preempt annotation when last seen. A notification is only received if the annotation changes.
+	lastNotification string
+	started, held    bool
+	// notified is set once a notification has been sent to the holder, since like the postgres lock, the holder only receives one
+	notified bool
+}
+
+// NewKubernetesLock returns a lock for key backed by a Lease accessed with leases, creating the Lease if it doesn't exist
+func NewKubernetesLock(ctx context.Context, leases coordinationv1client.LeaseInterface, key int64, message string, conf LockProviderConfig) (*KubernetesLock, error) {
+	id, err := uuid.NewUUID()
+	if err != nil {
+		return nil, errors.Wrap(err, "unable to create new UUID")
+	}
+	lease, err := ensureLease(ctx, leases, key, nil)
+	if err != nil {
+		return nil, errors.Wrap(err, "unable to ensure lease exists")
+	}
+	return &KubernetesLock{
+		id:               id,
+		key:              key,
+		name:             lease.Name,
+		leases:           leases,
+		preempted:        make(chan NotificationPayload),
+		waitPreempted:    make(chan NotificationPayload, 1),
+		changed:          make(chan struct{}, 1),
+		stop:             make(chan struct{}),
+		message:          message,
+		elog:             eventlogger.GetLogger(ctx),
+		conf:             conf,
+		lastNotification: lease.Annotations[preemptAnnotation],
+	}, nil
+}
+
+func (kl *KubernetesLock) log(msg string, args ...interface{}) {
+	kl.elog.Printf("kubernetes lock: "+msg, args...)
+}
+
+// Lock blocks until the Lease is acquired, the lock timeout is reached or the lock is preempted while waiting.
+func (kl *KubernetesLock) Lock(ctx context.Context) (<-chan NotificationPayload, error) {
+	kl.mu.Lock()
+	if kl.started {
+		kl.mu.Unlock()
+		return nil, errors.New("single use lock attempted to be reused")
+	}
+	kl.started = true
+	kl.mu.Unlock()
+
+	// the watch is started before the Lease is read, so that no notifications are missed
+	w, cf, err := kl.startWatch()
+	if err != nil {
+		return nil, errors.Wrap(err, "unable to watch lease")
+	}
+	go kl.watch(w, cf)
+	lockCtx, cancel := context.WithTimeout(ctx, kl.conf.lockTimeout)
+	defer cancel()
+	for {
+		acquired, err := kl.tryAcquire(lockCtx)
+		if err != nil {
+			kl.destroy()
+			return nil, errors.Wrap(err, "unable to acquire lease")
+		}
+		if acquired {
+			go kl.keepalive()
+			return kl.preempted, nil
+		}
+		select {
+		case <-lockCtx.Done():
+			kl.destroy()
+			return nil, errors.Wrap(lockCtx.Err(), "unable to acquire lease")
+		case np := <-kl.waitPreempted:
+			kl.destroy()
+			return nil, errors.Errorf("preempted while waiting for lease: %v", np.Message)
+		case <-kl.changed:
+		case <-time.After(kubernetesLockRetryPeriod):
+		}
+	}
+}
+
+// tryAcquire attempts to acquire the Lease, returning false if it's held by another lock or was modified concurrently
+func (kl *KubernetesLock) tryAcquire(ctx context.Context) (bool, error) {
+	// the Lease may have been garbage collected since the lock was created
+	lease, err := ensureLease(ctx, kl.leases, kl.key, nil)
+	if err != nil {
+		return false, errors.Wrap(err, "unable to ensure lease exists")
+	}
+	// the watch may have missed a notification, and the lock must not be acquired if it was preempted while waiting
+	kl.handleLease(lease)
+	if len(kl.waitPreempted) > 0 {
+		return false, nil
+	}
+	holder := leaseHolder(lease)
+	if holder != "" && holder != kl.id.String() && !leaseExpired(lease) {
+		return false, nil
+	}
+	id := kl.id.String()
+	secs := int32(kl.conf.leaseDuration / time.Second)
+	if secs < 1 {
+		secs = 1
+	}
+	now := metav1.NewMicroTime(time.Now().UTC())
+	lease.Spec.HolderIdentity = &id
+	lease.Spec.LeaseDurationSeconds = &secs
+	lease.Spec.AcquireTime = &now
+	lease.Spec.RenewTime = &now
+	if holder != id {
+		transitions := int32(1)
+		if lease.Spec.LeaseTransitions != nil {
+			transitions = *lease.Spec.LeaseTransitions + 1
+		}
+		lease.Spec.LeaseTransitions = &transitions
+	}
+	if lease.Annotations == nil {
+		lease.Annotations = map[string]string{}
+	}
+	lease.Annotations[holderEventAnnotation] = kl.message
+	kl.mu.Lock()
+	kl.held = true
+	kl.mu.Unlock()
+	if _, err := kl.leases.Update(ctx, lease, metav1.UpdateOptions{}); err != nil {
+		kl.mu.Lock()
+		kl.held = false
+		kl.mu.Unlock()
+		if kerrors.IsConflict(err) {
+			return false, nil
+		}
+		return false, errors.Wrap(err, "error updating lease")
+	}
+	return true, nil
+}
+
+// keepalive renews the Lease until the lock is unlocked. If the Lease can't be renewed within 2/3 of the lease duration
+// since the last successful renewal, the holder is notified while the Lease is still held, so that it can stop before the
+// Lease expires and is acquired by another lock.
+func (kl *KubernetesLock) keepalive() {
+	ticker := time.NewTicker(kl.conf.leaseDuration / 3)
+	defer ticker.Stop()
+	maxDuration := time.NewTimer(kl.conf.maxLockDuration)
+	defer maxDuration.Stop()
+	renewed := time.Now()
+	for {
+		select {
+		case <-kl.stop:
+			return
+		case <-maxDuration.C:
+			// keep renewing while the holder releases the lock
+			go kl.handleNotification(NotificationPayload{
+				ID:      kl.id,
+				Message: "reached max lock duration",
+				LockKey: kl.key,
+			})
+		case <-ticker.C:
+			start := time.Now()
+			err := kl.renew()
+			if err == nil {
+				renewed = start
+				continue
+			}
+			if err != errLeaseLost {
+				kl.log("error renewing lease (%v): %v", kl.name, err)
+				if time.Since(renewed) < kl.conf.leaseDuration*2/3 {
+					continue
+				}
+				err = errors.Wrap(err, "unable to renew lease before the renewal deadline")
+			}
+			// the holder must stop before the Lease expires, so don't wait for the full preemption timeout
+			timeout := kl.conf.leaseDuration - time.Since(renewed)
+			if timeout > kl.conf.preemptionTimeout {
+				timeout = kl.conf.preemptionTimeout
+			}
+			go kl.notifyHolder(NotificationPayload{
+				ID:      kl.id,
+				Message: err.Error(),
+				LockKey: kl.key,
+			}, timeout)
+			return
+		}
+	}
+}
+
+// renew updates the renew time of the Lease, returning errLeaseLost if it is no longer held by the lock
+func (kl *KubernetesLock) renew() error {
+	ctx, cancel := context.WithTimeout(context.Background(), kl.conf.leaseDuration/3)
+	defer cancel()
+	lease, err := kl.leases.Get(ctx, kl.name, metav1.GetOptions{})
+	if err != nil {
+		return errors.Wrap(err, "error getting lease")
+	}
+	kl.handleLease(lease)
+	if leaseHolder(lease) != kl.id.String() {
+		return errLeaseLost
+	}
+	now := metav1.NewMicroTime(time.Now().UTC())
+	lease.Spec.RenewTime = &now
+	_, err = kl.leases.Update(ctx, lease, metav1.UpdateOptions{})
+	return errors.Wrap(err, "error updating lease")
+}
+
+// startWatch starts a watch of the Lease, which is stopped by calling the returned function
+func (kl *KubernetesLock) startWatch() (watch.Interface, context.CancelFunc, error) {
+	ctx, cancel := context.WithCancel(context.Background())
+	w, err := kl.leases.Watch(ctx, metav1.ListOptions{FieldSelector: fields.OneTermEqualSelector("metadata.name", kl.name).String()})
+	if err != nil {
+		cancel()
+		return nil, nil, err
+	}
+	return w, func() {
+		w.Stop()
+		cancel()
+	}, nil
+}
+
+// watch handles the events of w until the lock is unlocked, restarting the watch if it ends
+func (kl *KubernetesLock) watch(w watch.Interface, cf context.CancelFunc) {
+	for {
+		stopped := kl.handleEvents(w)
+		cf()
+		if stopped {
+			return
+		}
+		var err error
+		for w, cf, err = kl.startWatch(); err != nil; w, cf, err = kl.startWatch() {
+			kl.log("error watching lease (%v): %v", kl.name, err)
+			select {
+			case <-kl.stop:
+				return
+			case <-time.After(kubernetesLockRetryPeriod):
+			}
+		}
+		// a notification may have been sent while the watch was restarted
+		if lease, err := kl.leases.Get(context.Background(), kl.name, metav1.GetOptions{}); err == nil {
+			kl.handleLease(lease)
+		}
+	}
+}
+
+// handleEvents handles the watch events of w until the watch ends or the lock is unlocked, returning true in the latter case
+func (kl *KubernetesLock) handleEvents(w watch.Interface) bool {
+	for {
+		select {
+		case <-kl.stop:
+			return true
+		case event, ok := <-w.ResultChan():
+			if !ok {
+				return false
+			}
+			if event.Type != watch.Added && event.Type != watch.Modified {
+				continue
+			}
+			if lease, ok := event.Object.(*coordinationv1.Lease); ok && lease.Name == kl.name {
+				kl.handleLease(lease)
+			}
+		}
+	}
+}
+
+// handleLease signals waiters that the Lease changed and delivers a notification from another lock, if there is a new one
+func (kl *KubernetesLock) handleLease(lease *coordinationv1.Lease) {
+	select {
+	case kl.changed <- struct{}{}:
+	default:
+	}
+	payload := lease.Annotations[preemptAnnotation]
+	kl.mu.Lock()
+	if payload == "" || payload == kl.lastNotification {
+		kl.mu.Unlock()
+		return
+	}
+	kl.lastNotification = payload
+	held := kl.held
+	kl.mu.Unlock()
+	np := NotificationPayload{}
+	if err := json.Unmarshal([]byte(payload), &np); err != nil {
+		kl.log("could not unmarshal notification payload: %v", err)
+		// like the postgres lock, an unknown notification payload releases the lock
+		np = NotificationPayload{
+			Message: "received unknown notification payload",
+			LockKey: kl.key,
+		}
+	}
+	if np.ID == kl.id {
+		return
+	}
+	if held {
+		go kl.handleNotification(np)
+		return
+	}
+	select {
+	case kl.waitPreempted <- np:
+	default:
+	}
+}
+
+func (kl *KubernetesLock) handleNotification(np NotificationPayload) {
+	kl.notifyHolder(np, kl.conf.preemptionTimeout)
+}
+
+// notifyHolder sends np to the holder (once), unlocking if the holder doesn't receive it within timeout
+func (kl *KubernetesLock) notifyHolder(np NotificationPayload, timeout time.Duration) {
+	kl.mu.Lock()
+	if kl.notified {
+		kl.mu.Unlock()
+		return
+	}
+	kl.notified = true
+	kl.mu.Unlock()
+	select {
+	case kl.preempted <- np:
+		return
+	case <-time.After(timeout):
+		kl.log("lock (%v): preemption timeout reached (%v), unlocking", kl.key, timeout)
+		kl.Unlock(context.Background())
+	}
+}
+
+// Notify lets other locks know that they should release the lock by writing the notification to the preempt annotation of the Lease.
+// It is up to the other locks to watch the Lease and release the lock accordingly.
+func (kl *KubernetesLock) Notify(ctx context.Context) error {
+	b, err := json.Marshal(NotificationPayload{
+		ID:      kl.id,
+		Message: kl.message,
+		LockKey: kl.key,
+	})
+	if err != nil {
+		return errors.Wrap(err, "unable to encode NotificationPayload")
+	}
+	return kl.updateLease(ctx, func(lease *coordinationv1.Lease) bool {
+		if lease.Annotations == nil {
+			lease.Annotations = map[string]string{}
+		}
+		lease.Annotations[preemptAnnotation] = string(b)
+		return true
+	})
+}
+
+// updateLease gets the Lease and updates it if f modifies it (returns true), retrying if the Lease was modified concurrently
+func (kl *KubernetesLock) updateLease(ctx context.Context, f func(lease *coordinationv1.Lease) bool) error {
+	for {
+		lease, err := kl.leases.Get(ctx, kl.name, metav1.GetOptions{})
+		if err != nil {
+			return errors.Wrap(err, "error getting lease")
+		}
+		if !f(lease) {
+			return nil
+		}
+		_, err = kl.leases.Update(ctx, lease, metav1.UpdateOptions{})
+		if err == nil {
+			return nil
+		}
+		if !kerrors.IsConflict(err) {
+			return errors.Wrap(err, "error updating lease")
+		}
+	}
+}
+
+// Unlock is an idempotent method that releases the Lease if it is still held by the lock.
+func (kl *KubernetesLock) Unlock(ctx context.Context) error {
+	kl.destroy()
+	kl.mu.Lock()
+	held := kl.held
+	kl.held = false
+	kl.mu.Unlock()
+	if !held {
+		return nil
+	}
+	releaseCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	err := kl.updateLease(releaseCtx, func(lease *coordinationv1.Lease) bool {
+		if leaseHolder(lease) != kl.id.String() {
+			return false
+		}
+		lease.Spec.HolderIdentity = nil
+		lease.Spec.AcquireTime = nil
+		lease.Spec.RenewTime = nil
+		delete(lease.Annotations, holderEventAnnotation)
+		if lease.Annotations == nil {
+			lease.Annotations = map[string]string{}
+		}
+		lease.Annotations[releasedAnnotation] = time.Now().UTC().Format(time.RFC3339)
+		return true
+	})
+	return errors.Wrap(err, "unable to release lease")
+}
+
+// destroy stops the watch and keepalive goroutines
+func (kl *KubernetesLock) destroy() {
+	kl.stopOnce.Do(func() { close(kl.stop) })
+}
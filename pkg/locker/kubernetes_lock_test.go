@@ -0,0 +1,304 @@
+package locker
+
+import (
+	"context"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/kubernetes/fake"
+	ktesting "k8s.io/client-go/testing"
+)
+
+func newTestKubernetesLockProvider(t *testing.T, options ...LockProviderOption) (*KubernetesLockProvider, *fake.Clientset) {
+	kc := fake.NewSimpleClientset()
+	opts := append([]LockProviderOption{WithKubernetesBackend(kc, "acyl"), WithLockTimeout(5 * time.Second)}, options...)
+	lp, err := NewLockProvider(KubernetesLockProviderKind, opts...)
+	if err != nil {
+		t.Fatalf("error creating lock provider: %v", err)
+	}
+	return lp.(*KubernetesLockProvider), kc
+}
+
+func TestKubernetesLockProviderRequiresBackend(t *testing.T) {
+	if _, err := NewLockProvider(KubernetesLockProviderKind); err == nil {
+		t.Fatalf("expected error without kubernetes backend")
+	}
+}
+
+func TestKubernetesLockLease(t *testing.T) {
+	lp, kc := newTestKubernetesLockProvider(t)
+	key, err := lp.LockKey(context.Background(), "foo/bar", 12)
+	if err != nil {
+		t.Fatalf("error getting lock key: %v", err)
+	}
+	if key2, _ := lp.LockKey(context.Background(), "foo/bar", 12); key2 != key {
+		t.Fatalf("lock key should be stable: %v, %v", key, key2)
+	}
+	lock, err := lp.New(context.Background(), key, "update foo/bar/12")
+	if err != nil {
+		t.Fatalf("error creating lock: %v", err)
+	}
+	if _, err := lock.Lock(context.Background()); err != nil {
+		t.Fatalf("error locking: %v", err)
+	}
+	lease, err := kc.CoordinationV1().Leases("acyl").Get(context.Background(), leaseName(key), metav1.GetOptions{})
+	if err != nil {
+		t.Fatalf("error getting lease: %v", err)
+	}
+	if lease.Labels[LockLeaseLabel] != "true" || lease.Annotations[repoAnnotation] != "foo/bar" || lease.Annotations[pullRequestAnnotation] != "12" {
+		t.Errorf("bad lease metadata: %+v", lease.ObjectMeta)
+	}
+	if leaseHolder(lease) != lock.(*KubernetesLock).id.String() || lease.Annotations[holderEventAnnotation] != "update foo/bar/12" {
+		t.Errorf("bad lease holder: %v: %v", leaseHolder(lease), lease.Annotations[holderEventAnnotation])
+	}
+	if lease.Spec.LeaseDurationSeconds == nil || *lease.Spec.LeaseDurationSeconds != int32(defaultLeaseDuration/time.Second) {
+		t.Errorf("bad lease duration: %v", lease.Spec.LeaseDurationSeconds)
+	}
+	if event, err := lp.HolderEvent(context.Background(), key); err != nil || event != "update foo/bar/12" {
+		t.Errorf("bad holder event: %v: %v", event, err)
+	}
+	if err := lock.Unlock(context.Background()); err != nil {
+		t.Fatalf("error unlocking: %v", err)
+	}
+	lease, err = kc.CoordinationV1().Leases("acyl").Get(context.Background(), leaseName(key), metav1.GetOptions{})
+	if err != nil {
+		t.Fatalf("error getting lease: %v", err)
+	}
+	if leaseHolder(lease) != "" {
+		t.Fatalf("lease should have been released: %v", leaseHolder(lease))
+	}
+	if event, err := lp.HolderEvent(context.Background(), key); err != nil || event != "" {
+		t.Fatalf("released lock should have no holder: %v: %v", event, err)
+	}
+	// unlocking is idempotent
+	if err := lock.Unlock(context.Background()); err != nil {
+		t.Fatalf("error unlocking again: %v", err)
+	}
+}
+
+func TestKubernetesLockExpiredLease(t *testing.T) {
+	lp, kc := newTestKubernetesLockProvider(t)
+	key, err := lp.LockKey(context.Background(), "foo/bar", 1)
+	if err != nil {
+		t.Fatalf("error getting lock key: %v", err)
+	}
+	// a holder that died without releasing the lease
+	lease, err := kc.CoordinationV1().Leases("acyl").Get(context.Background(), leaseName(key), metav1.GetOptions{})
+	if err != nil {
+		t.Fatalf("error getting lease: %v", err)
+	}
+	holder, secs := "crashed", int32(1)
+	renewed := metav1.NewMicroTime(time.Now().UTC().Add(-2 * time.Second))
+	lease.Spec.HolderIdentity, lease.Spec.LeaseDurationSeconds, lease.Spec.RenewTime = &holder, &secs, &renewed
+	if _, err := kc.CoordinationV1().Leases("acyl").Update(context.Background(), lease, metav1.UpdateOptions{}); err != nil {
+		t.Fatalf("error updating lease: %v", err)
+	}
+	lock, err := lp.New(context.Background(), key, "update")
+	if err != nil {
+		t.Fatalf("error creating lock: %v", err)
+	}
+	if _, err := lock.Lock(context.Background()); err != nil {
+		t.Fatalf("expired lease should have been acquired: %v", err)
+	}
+	lock.Unlock(context.Background())
+}
+
+func TestKubernetesLockLeaseLost(t *testing.T) {
+	lp, kc := newTestKubernetesLockProvider(t, WithLeaseDuration(300*time.Millisecond))
+	key, err := lp.LockKey(context.Background(), "foo/bar", 1)
+	if err != nil {
+		t.Fatalf("error getting lock key: %v", err)
+	}
+	lock, err := lp.New(context.Background(), key, "update")
+	if err != nil {
+		t.Fatalf("error creating lock: %v", err)
+	}
+	preempt, err := lock.Lock(context.Background())
+	if err != nil {
+		t.Fatalf("error locking: %v", err)
+	}
+	defer lock.Unlock(context.Background())
+	// the lease is renewed by the holder
+	time.Sleep(time.Second)
+	select {
+	case np := <-preempt:
+		t.Fatalf("should not have been preempted: %v", np.Message)
+	default:
+	}
+	// another holder took the lease
+	lease, err := kc.CoordinationV1().Leases("acyl").Get(context.Background(), leaseName(key), metav1.GetOptions{})
+	if err != nil {
+		t.Fatalf("error getting lease: %v", err)
+	}
+	holder := "other"
+	lease.Spec.HolderIdentity = &holder
+	if _, err := kc.CoordinationV1().Leases("acyl").Update(context.Background(), lease, metav1.UpdateOptions{}); err != nil {
+		t.Fatalf("error updating lease: %v", err)
+	}
+	select {
+	case np := <-preempt:
+		if np.Message != errLeaseLost.Error() {
+			t.Fatalf("unexpected message: %v", np.Message)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("holder should have been notified that the lease was lost")
+	}
+}
+
+func TestKubernetesLockRenewalFailure(t *testing.T) {
+	leaseDuration := 900 * time.Millisecond
+	lp, kc := newTestKubernetesLockProvider(t, WithLeaseDuration(leaseDuration))
+	// the reactor chain isn't safe to modify while the keepalive is using the client, so the failing reactor is installed
+	// up front and enabled once the lock is held
+	var unavailable int32
+	kc.PrependReactor("update", "leases", func(action ktesting.Action) (bool, runtime.Object, error) {
+		if atomic.LoadInt32(&unavailable) == 1 {
+			return true, nil, errors.New("unavailable")
+		}
+		return false, nil, nil
+	})
+	key, err := lp.LockKey(context.Background(), "foo/bar", 1)
+	if err != nil {
+		t.Fatalf("error getting lock key: %v", err)
+	}
+	lock, err := lp.New(context.Background(), key, "update")
+	if err != nil {
+		t.Fatalf("error creating lock: %v", err)
+	}
+	preempt, err := lock.Lock(context.Background())
+	if err != nil {
+		t.Fatalf("error locking: %v", err)
+	}
+	defer func() {
+		atomic.StoreInt32(&unavailable, 0)
+		lock.Unlock(context.Background())
+	}()
+	// the API server is unavailable, so the lease can't be renewed
+	failed := time.Now()
+	atomic.StoreInt32(&unavailable, 1)
+	select {
+	case np := <-preempt:
+		if !strings.Contains(np.Message, "renewal deadline") {
+			t.Fatalf("unexpected message: %v", np.Message)
+		}
+		if time.Since(failed) >= leaseDuration {
+			t.Fatalf("holder should have been notified before the lease expired")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("holder should have been notified that the lease couldn't be renewed")
+	}
+}
+
+func TestKubernetesLockCollectGarbage(t *testing.T) {
+	lp, kc := newTestKubernetesLockProvider(t)
+	leases := kc.CoordinationV1().Leases("acyl")
+	held, err := lp.LockKey(context.Background(), "foo/bar", 1)
+	if err != nil {
+		t.Fatalf("error getting lock key: %v", err)
+	}
+	released, err := lp.LockKey(context.Background(), "foo/bar", 2)
+	if err != nil {
+		t.Fatalf("error getting lock key: %v", err)
+	}
+	unused, err := lp.LockKey(context.Background(), "foo/bar", 3)
+	if err != nil {
+		t.Fatalf("error getting lock key: %v", err)
+	}
+	lock, err := lp.New(context.Background(), held, "update")
+	if err != nil {
+		t.Fatalf("error creating lock: %v", err)
+	}
+	if _, err := lock.Lock(context.Background()); err != nil {
+		t.Fatalf("error locking: %v", err)
+	}
+	defer lock.Unlock(context.Background())
+	lock2, err := lp.New(context.Background(), released, "update")
+	if err != nil {
+		t.Fatalf("error creating lock: %v", err)
+	}
+	if _, err := lock2.Lock(context.Background()); err != nil {
+		t.Fatalf("error locking: %v", err)
+	}
+	lock2.Unlock(context.Background())
+	if _, err := leases.Get(context.Background(), leaseName(released), metav1.GetOptions{}); err != nil {
+		t.Fatalf("error getting lease: %v", err)
+	}
+	n, err := lp.CollectGarbage(context.Background(), time.Hour)
+	if err != nil {
+		t.Fatalf("error collecting garbage: %v", err)
+	}
+	if n != 1 {
+		t.Fatalf("expected only the unused lease to be deleted: %v", n)
+	}
+	if _, err := leases.Get(context.Background(), leaseName(unused), metav1.GetOptions{}); err == nil {
+		t.Fatalf("unused lease should have been deleted")
+	}
+	n, err = lp.CollectGarbage(context.Background(), 0)
+	if err != nil {
+		t.Fatalf("error collecting garbage: %v", err)
+	}
+	if n != 1 {
+		t.Fatalf("expected only the released lease to be deleted: %v", n)
+	}
+	if _, err := leases.Get(context.Background(), leaseName(held), metav1.GetOptions{}); err != nil {
+		t.Fatalf("held lease should not have been deleted: %v", err)
+	}
+	// a lock for a deleted lease recreates it
+	lock3, err := lp.New(context.Background(), released, "update")
+	if err != nil {
+		t.Fatalf("error creating lock: %v", err)
+	}
+	if err := leases.Delete(context.Background(), leaseName(released), metav1.DeleteOptions{}); err != nil {
+		t.Fatalf("error deleting lease: %v", err)
+	}
+	if _, err := lock3.Lock(context.Background()); err != nil {
+		t.Fatalf("error locking after lease was deleted: %v", err)
+	}
+	lock3.Unlock(context.Background())
+}
+
+func TestKubernetesLockPreemptedWhileWaiting(t *testing.T) {
+	lp, _ := newTestKubernetesLockProvider(t)
+	key, err := lp.LockKey(context.Background(), "foo/bar", 1)
+	if err != nil {
+		t.Fatalf("error getting lock key: %v", err)
+	}
+	lock, err := lp.New(context.Background(), key, "update 1")
+	if err != nil {
+		t.Fatalf("error creating lock: %v", err)
+	}
+	if _, err := lock.Lock(context.Background()); err != nil {
+		t.Fatalf("error locking: %v", err)
+	}
+	defer lock.Unlock(context.Background())
+	waiter, err := lp.New(context.Background(), key, "update 2")
+	if err != nil {
+		t.Fatalf("error creating lock: %v", err)
+	}
+	locked := make(chan error, 1)
+	go func() {
+		_, err := waiter.Lock(context.Background())
+		locked <- err
+	}()
+	time.Sleep(100 * time.Millisecond)
+	lock3, err := lp.New(context.Background(), key, "update 3")
+	if err != nil {
+		t.Fatalf("error creating lock: %v", err)
+	}
+	if err := lock3.Notify(context.Background()); err != nil {
+		t.Fatalf("error notifying: %v", err)
+	}
+	select {
+	case err := <-locked:
+		if err == nil || !strings.Contains(err.Error(), "update 3") {
+			t.Fatalf("waiter should have been preempted by update 3: %v", err)
+		}
+	case <-time.After(3 * time.Second):
+		t.Fatalf("waiter should have been preempted")
+	}
+}
@@ -11,6 +11,7 @@ import (
 
 	"github.com/google/uuid"
 	"github.com/pkg/errors"
+	"k8s.io/client-go/kubernetes"
 )
 
 // LockProviderOptions allows clients to configure different aspects for the LockProvider return from NewLockProvider
@@ -21,6 +22,7 @@ var (
 	defaultLockTimeout       = 20 * time.Second
 	defaultLockDelay         = 10 * time.Second
 	defaultMaxLockDuration   = 30*time.Minute + 30*time.Second // global async timeout is 30 minutes
+	defaultLeaseDuration     = 15 * time.Second
 )
 
 // WithMaxLockDuration sets the duration for which the lock will wait before automatically unlocking the lock.
@@ -56,6 +58,22 @@ func WithPostgresBackend(postgresURI string, apmServiceName string) LockProvider
 	}
 }
 
+// WithKubernetesBackend allows for a distributed lock provider backed by coordination.k8s.io Leases in namespace.
+func WithKubernetesBackend(client kubernetes.Interface, namespace string) LockProviderOption {
+	return func(config *LockProviderConfig) {
+		config.kubernetesClient = client
+		config.kubernetesNamespace = namespace
+	}
+}
+
+// WithLeaseDuration sets the duration of the Lease held by the holder of a Kubernetes lock, which is renewed at a third of the duration.
+// If the holder dies, the lock is released once the Lease expires.
+func WithLeaseDuration(duration time.Duration) LockProviderOption {
+	return func(config *LockProviderConfig) {
+		config.leaseDuration = duration
+	}
+}
+
 // LockProviderConfig sets configuration values that can be shared between LockProvider implementations.
 type LockProviderConfig struct {
 	lockTimeout       time.Duration
@@ -63,6 +81,10 @@ type LockProviderConfig struct {
 	preemptionTimeout time.Duration
 	postgresURI       string
 	apmServiceName    string
+
+	kubernetesClient    kubernetes.Interface
+	kubernetesNamespace string
+	leaseDuration       time.Duration
 }
 
 // LockProvider describes an object capable of creating distributed locks. You may provide your own int64 key or obtain one for a given Repo/PR.
@@ -83,6 +105,9 @@ const (
 
 	// FakeLockProviderKind represents an implementation of the LockProvider interfaces that uses an in-memory store, suitable for tests
 	FakeLockProviderKind
+
+	// KubernetesLockProviderKind represents an implementation of the LockProvider interface that uses coordination.k8s.io Leases as the underlying store
+	KubernetesLockProviderKind
 )
 
 // NewLockProvider returns an implementation of the LockProvider interface.
@@ -109,6 +134,14 @@ func NewLockProvider(kind LockProviderKind, options ...LockProviderOption) (Lock
 		return newPostgresLockProvider(*config)
 	case FakeLockProviderKind:
 		return newFakeLockProvider(*config), nil
+	case KubernetesLockProviderKind:
+		if config.kubernetesClient == nil || config.kubernetesNamespace == "" {
+			return nil, errors.New("must provide kubernetes client and namespace for kubernetes lock provider")
+		}
+		if config.leaseDuration == 0 {
+			config.leaseDuration = defaultLeaseDuration
+		}
+		return newKubernetesLockProvider(*config), nil
 	case UnknownLockProviderKind:
 		fallthrough
 	default:
@@ -308,6 +341,47 @@ func (p *PreemptiveLocker) Lock(ctx context.Context) (ch <-chan NotificationPayl
 	}
 }
 
+// Preempt signals the current holder of the lock (if any) that it should release the lock as soon as possible, without
+// acquiring the lock. The event of the locker is sent to the holder as the reason. Unlike Lock, the PreemptiveLocker may be
+// reused afterward.
+func (p *PreemptiveLocker) Preempt(ctx context.Context) (err error) {
+	span, ctx := p.startSpanFromContext(ctx, "preempt")
+	defer func() {
+		span.Finish(tracer.WithError(err))
+	}()
+	key, err := p.lp.LockKey(ctx, p.repo, p.pr)
+	if err != nil {
+		return errors.Wrap(err, "unable to obtain lock key")
+	}
+	span.SetTag("lock_key", key)
+	p.log(ctx, "preempting holder of key: %d for repo: %s, pr: %d", key, p.repo, p.pr)
+	lock, err := p.lp.New(ctx, key, p.event)
+	if err != nil {
+		return errors.Wrap(err, "unable to instantiate a preemptable lock")
+	}
+	defer func() {
+		// the lock was never locked so this only cleans up the underlying resources
+		if err := lock.Unlock(context.Background()); err != nil {
+			p.log(ctx, "error cleaning up preempting lock: %v", err)
+		}
+	}()
+	return errors.Wrap(lock.Notify(ctx), "unable to notify lock holder")
+}
+
+// HolderEvent returns the event of the current holder of the lock, or the empty string if it isn't held. ErrHolderUnknown
+// is returned if the lock provider doesn't support inspecting the holder.
+func (p *PreemptiveLocker) HolderEvent(ctx context.Context) (string, error) {
+	lhi, ok := p.lp.(LockHolderInspector)
+	if !ok {
+		return "", ErrHolderUnknown
+	}
+	key, err := p.lp.LockKey(ctx, p.repo, p.pr)
+	if err != nil {
+		return "", errors.Wrap(err, "unable to obtain lock key")
+	}
+	return lhi.HolderEvent(ctx, key)
+}
+
 // Release releases the lock. It is recommended to pass in a different context than the one provided for Lock, since that context could be canceled.
 func (p *PreemptiveLocker) Release(ctx context.Context) (err error) {
 	span, ctx := p.startSpanFromContext(ctx, "release")
@@ -7,6 +7,8 @@ import (
 	"os"
 	"testing"
 	"time"
+
+	"k8s.io/client-go/kubernetes/fake"
 )
 
 const (
@@ -41,6 +43,14 @@ func TestFakePreemptiveLocker(t *testing.T) {
 	})
 }
 
+func TestKubernetesPreemptiveLocker(t *testing.T) {
+	runPreemptiveLockerTests(t, func(t *testing.T, options ...LockProviderOption) (LockProvider, error) {
+		opts := []LockProviderOption{WithKubernetesBackend(fake.NewSimpleClientset(), "acyl")}
+		opts = append(opts, options...)
+		return NewLockProvider(KubernetesLockProviderKind, opts...)
+	})
+}
+
 func runPreemptiveLockerTests(t *testing.T, lpFunc lpFactoryFunc) {
 	if lpFunc == nil {
 		t.Fatalf("plfunc cannot be nil")
@@ -69,6 +79,16 @@ func runPreemptiveLockerTests(t *testing.T, lpFunc lpFactoryFunc) {
 			tfunc:   testPreemptiveLockerLockDelay,
 			options: []LockProviderOption{WithLockTimeout(defaultPostgresLockWaitTime)},
 		},
+		{
+			name:    "preempt signals the holder without locking",
+			tfunc:   testPreemptiveLockerPreempt,
+			options: []LockProviderOption{WithLockTimeout(defaultPostgresLockWaitTime)},
+		},
+		{
+			name:    "holder event reports the event of the holder",
+			tfunc:   testPreemptiveLockerHolderEvent,
+			options: []LockProviderOption{WithLockTimeout(defaultPostgresLockWaitTime)},
+		},
 		{
 			name:    "new preemptive locker should respect canceled context",
 			tfunc:   testNewPreemptiveLockerCancelledContext,
@@ -230,3 +250,64 @@ func testNewPreemptiveLockerCancelledContext(t *testing.T, lp LockProvider) {
 	}
 	defer pl.Release(context.Background())
 }
+
+func testPreemptiveLockerPreempt(t *testing.T, lp LockProvider) {
+	plf, err := NewPreemptiveLockerFactory(
+		lp,
+		WithLockDelay(time.Millisecond),
+	)
+	if err != nil {
+		t.Fatalf("error creating new preemptive locker factory: %v", err)
+	}
+	repo := "foo/bar"
+	pr := uint(rand.Intn(math.MaxInt32))
+	// preempting without a holder is a no-op
+	if err := plf(repo, pr, "cancel").Preempt(context.Background()); err != nil {
+		t.Fatalf("preempt without holder should have succeeded: %v", err)
+	}
+	pl := plf(repo, pr, "update")
+	preempt, err := pl.Lock(context.Background())
+	if err != nil {
+		t.Fatalf("unexpected error when locking: %v", err)
+	}
+	if err := plf(repo, pr, "cancel").Preempt(context.Background()); err != nil {
+		t.Fatalf("preempt should have succeeded: %v", err)
+	}
+	select {
+	case np := <-preempt:
+		if np.Message != "cancel" {
+			t.Fatalf("unexpected preemption message: %v", np.Message)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("lock was not preempted")
+	}
+	if err := pl.Release(context.Background()); err != nil {
+		t.Fatalf("error releasing the lock: %v", err)
+	}
+	// the key must be lockable again, the preempting lock never held it
+	pl2 := plf(repo, pr, "update")
+	if _, err := pl2.Lock(context.Background()); err != nil {
+		t.Fatalf("should have been able to lock the key: %v", err)
+	}
+	pl2.Release(context.Background())
+}
+
+func testPreemptiveLockerHolderEvent(t *testing.T, lp LockProvider) {
+	plf, err := NewPreemptiveLockerFactory(lp, WithLockDelay(time.Millisecond))
+	if err != nil {
+		t.Fatalf("error creating new preemptive locker factory: %v", err)
+	}
+	repo := "foo/bar"
+	pr := uint(rand.Intn(math.MaxInt32))
+	if event, err := plf(repo, pr, "cancel").HolderEvent(context.Background()); err != nil || event != "" {
+		t.Fatalf("unheld lock should have no holder: %v: %v", event, err)
+	}
+	pl := plf(repo, pr, "update 1")
+	if _, err := pl.Lock(context.Background()); err != nil {
+		t.Fatalf("unexpected error when locking: %v", err)
+	}
+	defer pl.Release(context.Background())
+	if event, err := plf(repo, pr, "cancel").HolderEvent(context.Background()); err != nil || event != "update 1" {
+		t.Fatalf("bad holder event: %v: %v", event, err)
+	}
+}
@@ -102,6 +102,9 @@ type PostgresLock struct {
 	// conn is the single connection to postgres that will be used for the lock
 	conn *sql.Conn
 
+	// db is the connection pool used to record the lock request for introspection, since conn blocks while waiting for the lock
+	db *sqlx.DB
+
 	// postgresURI stores the postgres connection string.
 	postgresURI string
 
@@ -146,6 +149,7 @@ func NewPostgresLock(ctx context.Context, db *sqlx.DB, key int64, connInfo, mess
 		psc:         psc,
 		key:         key,
 		conn:        conn,
+		db:          db,
 		postgresURI: connInfo,
 		preempted:   make(chan NotificationPayload),
 		message:     message,
@@ -199,6 +203,7 @@ func (pl *PostgresLock) handleEvents(ctx context.Context, listener *pq.Listener)
 
 			// If we have received a notification that is not our own, send it over the channel and return
 			if np.ID != pl.id {
+				pl.recordPreemption(np.Message)
 				pl.handleNotification(np)
 				return
 			}
@@ -274,6 +279,7 @@ func (pl *PostgresLock) Lock(ctx context.Context) (<-chan NotificationPayload, e
 		pl.handleEvents(ctx, pl.listener)
 	}()
 
+	pl.recordRequest(ctx)
 	query := `SELECT pg_advisory_lock($1)`
 	advLockContext, cancel := context.WithTimeout(ctx, pl.conf.lockTimeout)
 	defer cancel()
@@ -281,11 +287,38 @@ func (pl *PostgresLock) Lock(ctx context.Context) (<-chan NotificationPayload, e
 	if err != nil {
 		return nil, errors.Wrap(err, "unable to create pg advisory lock")
 	}
+	pl.recordAcquisition()
 
 	return pl.preempted, nil
 }
 
+// recordRequest records the lock request along with the process ID of the lock session so that it can be matched to the
+// advisory lock in pg_locks by EnvLocks. Errors are logged and otherwise ignored since the lock works without the record.
+func (pl *PostgresLock) recordRequest(ctx context.Context) {
+	q := `INSERT INTO lock_requests (id, lock_key, event, pid) VALUES ($1, $2, $3, pg_backend_pid());`
+	if _, err := pl.conn.ExecContext(ctx, q, pl.id, pl.key, pl.message); err != nil {
+		pl.log(ctx, "error recording lock request: %v", err)
+	}
+}
+
+func (pl *PostgresLock) recordAcquisition() {
+	q := `UPDATE lock_requests SET acquired = now() WHERE id = $1;`
+	if _, err := pl.db.Exec(q, pl.id); err != nil {
+		pl.log(context.Background(), "error recording lock acquisition: %v", err)
+	}
+}
+
+func (pl *PostgresLock) recordPreemption(by string) {
+	q := `UPDATE lock_requests SET preempted = now(), preempted_by = $2 WHERE id = $1;`
+	if _, err := pl.db.Exec(q, pl.id, by); err != nil {
+		pl.log(context.Background(), "error recording lock preemption: %v", err)
+	}
+}
+
 func (pl *PostgresLock) destroy(ctx context.Context) {
+	if _, err := pl.db.ExecContext(ctx, `DELETE FROM lock_requests WHERE id = $1;`, pl.id); err != nil {
+		pl.log(ctx, "unable to delete lock request: %v", err)
+	}
 	if pl.listener != nil {
 		err := pl.listener.Close()
 		if err != nil {
@@ -385,3 +418,119 @@ func (plp *PostgresLockProvider) LockKey(ctx context.Context, repo string, pullR
 func (plp *PostgresLockProvider) log(ctx context.Context, msg string, args ...interface{}) {
 	eventlogger.GetLogger(ctx).Printf("postgres lock provider: "+msg, args...)
 }
+
+var _ LockInspector = &PostgresLockProvider{}
+var _ LockHolderInspector = &PostgresLockProvider{}
+
+// HolderEvent returns the event of the holder of the lock for key, or the empty string if it isn't held
+func (plp *PostgresLockProvider) HolderEvent(ctx context.Context, key int64) (string, error) {
+	return envLockHolderEvent(ctx, plp, key)
+}
+
+// EnvLocks returns the env locks that are held or waited for, by inspecting the advisory locks in pg_locks. The
+// requests of each lock are ordered with the holder first, followed by the waiting requests in the order they were made.
+func (plp *PostgresLockProvider) EnvLocks(ctx context.Context) ([]EnvLock, error) {
+	// the classid and objid of an advisory lock on a bigint key are its high and low 32 bits
+	q := `SELECT el.lock_key, el.repo, el.pull_request, l.pid, l.granted,
+		COALESCE(r.event, ''), COALESCE(r.requested, a.query_start, now()), r.acquired, r.preempted, COALESCE(r.preempted_by, '')
+	FROM pg_locks l
+	JOIN env_locks el ON ((l.classid::bigint << 32) | l.objid::bigint) = el.lock_key
+	LEFT JOIN pg_stat_activity a ON a.pid = l.pid
+	LEFT JOIN LATERAL (
+		SELECT event, requested, acquired, preempted, preempted_by FROM lock_requests
+		WHERE lock_requests.lock_key = el.lock_key AND lock_requests.pid = l.pid
+		ORDER BY requested DESC
+		LIMIT 1
+	) r ON true
+	WHERE l.locktype = 'advisory' AND l.objsubid = 1 AND l.database = (SELECT oid FROM pg_database WHERE datname = current_database())
+	ORDER BY el.repo, el.pull_request, l.granted DESC, 7 ASC;`
+	rows, err := plp.db.QueryContext(ctx, q)
+	if err != nil {
+		return nil, errors.Wrap(err, "error querying locks")
+	}
+	defer rows.Close()
+	out := []EnvLock{}
+	for rows.Next() {
+		var el EnvLock
+		var lr LockRequest
+		var granted bool
+		var acquired, preempted pq.NullTime
+		if err := rows.Scan(&el.Key, &el.Repo, &el.PullRequest, &lr.PID, &granted, &lr.Event, &lr.Requested, &acquired, &preempted, &lr.PreemptedBy); err != nil {
+			return nil, errors.Wrap(err, "error scanning row")
+		}
+		if granted {
+			lr.Acquired = lr.Requested
+			if acquired.Valid {
+				lr.Acquired = acquired.Time
+			}
+		}
+		if preempted.Valid {
+			lr.Preempted = preempted.Time
+		}
+		lr.State = lockRequestState(lr.Acquired, lr.Preempted)
+		if n := len(out); n > 0 && out[n-1].Key == el.Key {
+			out[n-1].Requests = append(out[n-1].Requests, lr)
+			continue
+		}
+		el.Requests = []LockRequest{lr}
+		out = append(out, el)
+	}
+	return out, rows.Err()
+}
+
+// ForceRelease releases the env lock for repo and pr by terminating the Postgres session of the holder, which releases
+// the advisory lock immediately. The holder detects the terminated session and is preempted. An audit record of the
+// release by user is persisted and returned.
+func (plp *PostgresLockProvider) ForceRelease(ctx context.Context, repo string, pr uint, user, reason string) (*LockForceRelease, error) {
+	locks, err := plp.EnvLocks(ctx)
+	if err != nil {
+		return nil, errors.Wrap(err, "error getting locks")
+	}
+	el := findEnvLock(locks, repo, pr)
+	if el == nil || el.Holder() == nil {
+		return nil, ErrLockNotHeld
+	}
+	holder := el.Holder()
+	var terminated bool
+	if err := plp.db.QueryRowContext(ctx, `SELECT pg_terminate_backend($1);`, holder.PID).Scan(&terminated); err != nil {
+		return nil, errors.Wrap(err, "error terminating holder session")
+	}
+	if !terminated {
+		return nil, fmt.Errorf("holder session (pid %v) could not be terminated", holder.PID)
+	}
+	plp.log(ctx, "lock %v for %v/%v force-released by %v: terminated session of holder %q (pid %v)", el.Key, repo, pr, user, holder.Event, holder.PID)
+	lfr := &LockForceRelease{
+		ID:          uuid.New(),
+		Key:         el.Key,
+		Repo:        repo,
+		PullRequest: pr,
+		HolderEvent: holder.Event,
+		HolderPID:   holder.PID,
+		User:        user,
+		Reason:      reason,
+	}
+	q := `INSERT INTO lock_force_releases (id, lock_key, repo, pull_request, holder_event, holder_pid, username, reason) VALUES ($1, $2, $3, $4, $5, $6, $7, $8) RETURNING created;`
+	if err := plp.db.QueryRowContext(ctx, q, lfr.ID, lfr.Key, lfr.Repo, lfr.PullRequest, lfr.HolderEvent, lfr.HolderPID, lfr.User, lfr.Reason).Scan(&lfr.Created); err != nil {
+		return nil, errors.Wrap(err, "lock was released but there was an error inserting the audit record")
+	}
+	return lfr, nil
+}
+
+// ForceReleases returns the audit records of the most recent forced releases of locks, newest first
+func (plp *PostgresLockProvider) ForceReleases(ctx context.Context, limit uint) ([]LockForceRelease, error) {
+	q := `SELECT id, created, lock_key, repo, pull_request, holder_event, holder_pid, username, reason FROM lock_force_releases ORDER BY created DESC LIMIT $1;`
+	rows, err := plp.db.QueryContext(ctx, q, limit)
+	if err != nil {
+		return nil, errors.Wrap(err, "error querying force releases")
+	}
+	defer rows.Close()
+	out := []LockForceRelease{}
+	for rows.Next() {
+		lfr := LockForceRelease{}
+		if err := rows.Scan(&lfr.ID, &lfr.Created, &lfr.Key, &lfr.Repo, &lfr.PullRequest, &lfr.HolderEvent, &lfr.HolderPID, &lfr.User, &lfr.Reason); err != nil {
+			return nil, errors.Wrap(err, "error scanning row")
+		}
+		out = append(out, lfr)
+	}
+	return out, rows.Err()
+}
@@ -109,6 +109,21 @@ func (mr *MockRepoClientMockRecorder) GetFileContents(arg0, arg1, arg2, arg3 int
 	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "GetFileContents", reflect.TypeOf((*MockRepoClient)(nil).GetFileContents), arg0, arg1, arg2, arg3)
 }
 
+// GetPRLabels mocks base method
+func (m *MockRepoClient) GetPRLabels(arg0 context.Context, arg1 string, arg2 uint) ([]string, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "GetPRLabels", arg0, arg1, arg2)
+	ret0, _ := ret[0].([]string)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// GetPRLabels indicates an expected call of GetPRLabels
+func (mr *MockRepoClientMockRecorder) GetPRLabels(arg0, arg1, arg2 interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "GetPRLabels", reflect.TypeOf((*MockRepoClient)(nil).GetPRLabels), arg0, arg1, arg2)
+}
+
 // GetPRStatus mocks base method
 func (m *MockRepoClient) GetPRStatus(arg0 context.Context, arg1 string, arg2 uint) (string, error) {
 	m.ctrl.T.Helper()
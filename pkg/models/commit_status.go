@@ -20,6 +20,14 @@ const (
 	// CommitStatusFailure occurs when an unrecoverable error has occured during
 	// the creation or update of an environment
 	CommitStatusFailure
+	// CommitStatusQueued occurs when the creation of a Nitro environment is
+	// waiting for capacity under the global environment limit
+	CommitStatusQueued
+	// CommitStatusCoalesced occurs when an update was superseded by a newer
+	// push to the same pull request (or its closing) before it started, so it
+	// will not be processed. It is final: the result of the deployment is
+	// reported on the superseding commit.
+	CommitStatusCoalesced
 )
 
 func (ncs CommitStatus) Key() string {
@@ -30,11 +38,28 @@ func (ncs CommitStatus) Key() string {
 		return "pending"
 	case CommitStatusFailure:
 		return "failure"
+	case CommitStatusQueued:
+		return "queued"
+	case CommitStatusCoalesced:
+		return "coalesced"
 	default:
 		return "failure: unknown status"
 	}
 }
 
+// State returns the GitHub commit status state for ncs
+func (ncs CommitStatus) State() string {
+	switch ncs {
+	case CommitStatusQueued:
+		return "pending"
+	case CommitStatusCoalesced:
+		// the commit will never be deployed, so it gets a final state that isn't successful (the result is reported on the superseding commit)
+		return "error"
+	default:
+		return ncs.Key()
+	}
+}
+
 // CommitStatuses models the configuration that Nitro supports for setting
 // commit statuses. Users can specify templates for each valid commit status.
 type CommitStatuses struct {
@@ -93,4 +118,12 @@ var DefaultCommitStatusTemplates = map[string]CommitStatusTemplate{
 		Description: "The Acyl environment {{ .EnvName }} failed.",
 		TargetURL:   "https://media.giphy.com/media/pyFsc5uv5WPXN9Ocki/giphy.gif",
 	},
+	"queued": CommitStatusTemplate{
+		Description: "The Acyl environment {{ .EnvName }} is queued (position {{ .QueuePosition }}).",
+		TargetURL:   "https://media.giphy.com/media/oiymhxu13VYEo/giphy.gif",
+	},
+	"coalesced": CommitStatusTemplate{
+		Description: "Not deployed: superseded by {{ .SupersededBy }} before processing started.",
+		TargetURL:   "https://media.giphy.com/media/oiymhxu13VYEo/giphy.gif",
+	},
 }
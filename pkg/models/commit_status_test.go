@@ -56,3 +56,22 @@ func TestRenderCommitStatusTemplates(t *testing.T) {
 	}
 
 }
+
+func TestCommitStatusState(t *testing.T) {
+	cases := []struct {
+		cs    CommitStatus
+		state string
+	}{
+		{CommitStatusSuccess, "success"},
+		{CommitStatusPending, "pending"},
+		{CommitStatusFailure, "failure"},
+		{CommitStatusQueued, "pending"},
+		// a coalesced commit is never deployed, so it must be final without being reported as successful
+		{CommitStatusCoalesced, "error"},
+	}
+	for _, c := range cases {
+		if state := c.cs.State(); state != c.state {
+			t.Errorf("%v: expected %v, got %v", c.cs.Key(), c.state, state)
+		}
+	}
+}
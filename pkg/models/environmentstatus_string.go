@@ -15,11 +15,13 @@ func _() {
 	_ = x[Destroyed-4]
 	_ = x[Updating-5]
 	_ = x[Cancelled-6]
+	_ = x[Hibernated-7]
+	_ = x[Queued-8]
 }
 
-const _EnvironmentStatus_name = "UnknownStatusSpawnedSuccessFailureDestroyedUpdatingCancelled"
+const _EnvironmentStatus_name = "UnknownStatusSpawnedSuccessFailureDestroyedUpdatingCancelledHibernatedQueued"
 
-var _EnvironmentStatus_index = [...]uint8{0, 13, 20, 27, 34, 43, 51, 60}
+var _EnvironmentStatus_index = [...]uint8{0, 13, 20, 27, 34, 43, 51, 60, 70, 76}
 
 func (i EnvironmentStatus) String() string {
 	if i < 0 || i >= EnvironmentStatus(len(_EnvironmentStatus_index)-1) {
@@ -86,6 +86,7 @@ const (
 	DoneStatus
 	FailedStatus
 	CancelledStatus
+	CoalescedStatus
 )
 
 type EventStatusType int
@@ -155,6 +156,15 @@ type EventStatusSummaryConfig struct {
 	Started         time.Time                `json:"started"`
 	Completed       time.Time                `json:"completed"`
 	RefMap          map[string]string        `json:"ref_map"`
+	Retries         []EventStatusRetry       `json:"retries,omitempty"`
+}
+
+// EventStatusRetry records a failed attempt of an operation that was automatically retried after a system error
+type EventStatusRetry struct {
+	Attempt uint          `json:"attempt"`
+	Error   string        `json:"error"`
+	Failed  time.Time     `json:"failed"`
+	Backoff time.Duration `json:"backoff"`
 }
 
 type EventStatusTreeNodeImage struct {
@@ -168,6 +178,7 @@ type EventStatusTreeNodeChart struct {
 	Status    NodeChartStatus `json:"status"`
 	Started   time.Time       `json:"started"`
 	Completed time.Time       `json:"completed"`
+	Diff      string          `json:"diff,omitempty"` // redacted rendered manifest diff of an in-place upgrade
 }
 
 type EventStatusTreeNode struct {
@@ -13,11 +13,12 @@ func _() {
 	_ = x[DoneStatus-2]
 	_ = x[FailedStatus-3]
 	_ = x[CancelledStatus-4]
+	_ = x[CoalescedStatus-5]
 }
 
-const _EventStatus_name = "UnknownEventStatusPendingStatusDoneStatusFailedStatusCancelledStatus"
+const _EventStatus_name = "UnknownEventStatusPendingStatusDoneStatusFailedStatusCancelledStatusCoalescedStatus"
 
-var _EventStatus_index = [...]uint8{0, 18, 31, 41, 53, 68}
+var _EventStatus_index = [...]uint8{0, 18, 31, 41, 53, 68, 83}
 
 func (i EventStatus) String() string {
 	if i < 0 || i >= EventStatus(len(_EventStatus_index)-1) {
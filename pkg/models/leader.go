@@ -0,0 +1,26 @@
+package models
+
+import (
+	"strings"
+	"time"
+)
+
+// LeaderLease models the lease held by the replica that is the elected leader for a role (such as periodic maintenance).
+// The holder renews the lease before it expires, and any replica may acquire it once it has expired.
+type LeaderLease struct {
+	// Name identifies the role the leader is elected for
+	Name string `json:"name"`
+	// Holder is the ID of the replica holding the lease
+	Holder   string    `json:"holder"`
+	Acquired time.Time `json:"acquired"`
+	Renewed  time.Time `json:"renewed"`
+	Expires  time.Time `json:"expires"`
+}
+
+func (ll LeaderLease) Columns() string {
+	return strings.Join([]string{"name", "holder", "acquired", "renewed", "expires"}, ",")
+}
+
+func (ll *LeaderLease) ScanValues() []interface{} {
+	return []interface{}{&ll.Name, &ll.Holder, &ll.Acquired, &ll.Renewed, &ll.Expires}
+}
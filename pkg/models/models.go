@@ -31,6 +31,8 @@ const (
 	Destroyed                              // Destroyed means the environment was destroyed explicitly or as part of a PR synchronize or close
 	Updating                               // Updating means an existing env is being updated (replaced behind the scenes)
 	Cancelled                              // Cancelled means an environment has been cancelled via a context.
+	Hibernated                             // Hibernated means all workloads in the environment have been scaled to zero and may be woken on demand
+	Queued                                 // Queued means the environment is waiting for capacity under the global environment limit before it is created
 )
 
 // EnvironmentStatusFromString returns the EnvironmentStatus constant for a string or error if unknown
@@ -49,6 +51,10 @@ func EnvironmentStatusFromString(es string) (EnvironmentStatus, error) {
 		return Updating, nil
 	case "cancelled":
 		return Cancelled, nil
+	case "hibernated":
+		return Hibernated, nil
+	case "queued":
+		return Queued, nil
 	default:
 		return UnknownStatus, fmt.Errorf("unknown status")
 	}
@@ -65,6 +71,9 @@ const (
 	CreateFoundStale                                    // The environment is a stale environment associated with a PR that we are executing a create for
 	DestroyApiRequest                                   // Explicit API destroy request
 	EnvironmentLimitExceeded                            // Environment destroyed by a new environment create request to bring environment count into compliance with the global limit
+	ReapExpired                                         // Environment destroyed by Reaper because its expiration (TTL) has passed
+	ReapMaxAge                                          // Environment destroyed by Reaper because it exceeds the max age of its reaper policy
+	ReapAgeUpdating                                     // Environment has been in state Updating for too long
 )
 
 // RefMap is a mapping of Github repository to a ref.
@@ -81,6 +90,18 @@ type RepoRevisionData struct {
 	BaseBranch   string `json:"base_branch"`
 	SourceRef    string `json:"source_ref"` // if environment is not based on a PR
 	IsFork       bool   `json:"is_fork"`    // set if PR head is from a different repo (fork) from base
+	// The following are only used for manual (non-PR) environments
+	EnvName      string            `json:"env_name,omitempty"`      // manual environments are identified by name rather than repo and PR
+	RefOverrides map[string]string `json:"ref_overrides,omitempty"` // map of dependency repo name to branch, instead of branch matching
+	TTL          time.Duration     `json:"ttl,omitempty"`           // requested environment lifetime
+	// The following are only used for environments cloned from another environment
+	CommitSHAOverrides map[string]string `json:"commit_sha_overrides,omitempty"` // map of dependency repo name to exact commit SHA, used with RefOverrides
+	CloneOf            string            `json:"clone_of,omitempty"`             // name of the environment this one was cloned from
+}
+
+// Manual returns whether rd is for a manual environment created from an arbitrary ref rather than a PR
+func (rd RepoRevisionData) Manual() bool {
+	return rd.PullRequest == 0 && rd.EnvName != ""
 }
 
 // QAEnvironment describes an individual QA environment
@@ -111,6 +132,12 @@ type QAEnvironment struct {
 	AminoKubernetesNamespace string               `json:"amino_kubernetes_namespace"`
 	AminoEnvironmentID       int                  `json:"amino_environment_id"`
 	EventIDs                 []uuid.UUID          `json:"event_ids"`
+	ExpiresAt                *time.Time           `json:"expires_at"`
+	ExpirationWarned         bool                 `json:"expiration_warned"`
+	Pinned                   bool                 `json:"pinned"`
+	PinReason                string               `json:"pin_reason"`
+	PinnedUntil              *time.Time           `json:"pinned_until"`
+	ReaperPolicy             ReaperPolicy         `json:"reaper_policy"` // reaper policy overrides from acyl.yml
 
 	rmapHS  hstore.Hstore
 	csmapHS hstore.Hstore
@@ -119,11 +146,11 @@ type QAEnvironment struct {
 
 // Columns returns a comma-separated string of column names suitable for a SELECT
 func (qae QAEnvironment) Columns() string {
-	return "id, name, created, raw_events, hostname, qa_type, username, repo, pull_request, source_sha, base_sha, source_branch, base_branch, source_ref, status, ref_map, commit_sha_map, amino_service_to_port, amino_kubernetes_namespace, amino_environment_id"
+	return "id, name, created, raw_events, hostname, qa_type, username, repo, pull_request, source_sha, base_sha, source_branch, base_branch, source_ref, status, ref_map, commit_sha_map, amino_service_to_port, amino_kubernetes_namespace, amino_environment_id, expires_at, expiration_warned, pinned, pin_reason, pinned_until, reaper_policy"
 }
 
 func (qae QAEnvironment) InsertColumns() string {
-	return "name, created, raw_events, hostname, qa_type, username, repo, pull_request, source_sha, base_sha, source_branch, base_branch, source_ref, status, ref_map, commit_sha_map, amino_service_to_port, amino_kubernetes_namespace, amino_environment_id"
+	return "name, created, raw_events, hostname, qa_type, username, repo, pull_request, source_sha, base_sha, source_branch, base_branch, source_ref, status, ref_map, commit_sha_map, amino_service_to_port, amino_kubernetes_namespace, amino_environment_id, expires_at, expiration_warned, pinned, pin_reason, pinned_until, reaper_policy"
 }
 
 // InsertParams returns the query placeholder params for a full model insert
@@ -137,11 +164,11 @@ func (qae QAEnvironment) InsertParams() string {
 
 // ScanValues returns a slice of values suitable for a query Scan()
 func (qae *QAEnvironment) ScanValues() []interface{} {
-	return []interface{}{&qae.ID, &qae.Name, &qae.Created, pq.Array(&qae.RawEvents), &qae.Hostname, &qae.QAType, &qae.User, &qae.Repo, &qae.PullRequest, &qae.SourceSHA, &qae.BaseSHA, &qae.SourceBranch, &qae.BaseBranch, &qae.SourceRef, &qae.Status, qae.RefMapHStore(), qae.CommitSHAMapHStore(), qae.AminoServiceToPortHStore(), &qae.AminoKubernetesNamespace, &qae.AminoEnvironmentID}
+	return []interface{}{&qae.ID, &qae.Name, &qae.Created, pq.Array(&qae.RawEvents), &qae.Hostname, &qae.QAType, &qae.User, &qae.Repo, &qae.PullRequest, &qae.SourceSHA, &qae.BaseSHA, &qae.SourceBranch, &qae.BaseBranch, &qae.SourceRef, &qae.Status, qae.RefMapHStore(), qae.CommitSHAMapHStore(), qae.AminoServiceToPortHStore(), &qae.AminoKubernetesNamespace, &qae.AminoEnvironmentID, &qae.ExpiresAt, &qae.ExpirationWarned, &qae.Pinned, &qae.PinReason, &qae.PinnedUntil, &qae.ReaperPolicy}
 }
 
 func (qae *QAEnvironment) InsertValues() []interface{} {
-	return []interface{}{&qae.Name, &qae.Created, pq.Array(&qae.RawEvents), &qae.Hostname, &qae.QAType, &qae.User, &qae.Repo, &qae.PullRequest, &qae.SourceSHA, &qae.BaseSHA, &qae.SourceBranch, &qae.BaseBranch, &qae.SourceRef, &qae.Status, qae.RefMapHStore(), qae.CommitSHAMapHStore(), qae.AminoServiceToPortHStore(), &qae.AminoKubernetesNamespace, &qae.AminoEnvironmentID}
+	return []interface{}{&qae.Name, &qae.Created, pq.Array(&qae.RawEvents), &qae.Hostname, &qae.QAType, &qae.User, &qae.Repo, &qae.PullRequest, &qae.SourceSHA, &qae.BaseSHA, &qae.SourceBranch, &qae.BaseBranch, &qae.SourceRef, &qae.Status, qae.RefMapHStore(), qae.CommitSHAMapHStore(), qae.AminoServiceToPortHStore(), &qae.AminoKubernetesNamespace, &qae.AminoEnvironmentID, &qae.ExpiresAt, &qae.ExpirationWarned, &qae.Pinned, &qae.PinReason, &qae.PinnedUntil, &qae.ReaperPolicy}
 }
 
 // RefMapHStore returns the HStore struct suitable for scanning during queries
@@ -233,7 +260,7 @@ func (qae *QAEnvironment) AfterSelect(db orm.DB) error {
 
 // RepoRevisionDataFromQA returns a RepoRevisionData from a QAEnvironment
 func (qa QAEnvironment) RepoRevisionDataFromQA() *RepoRevisionData {
-	return &RepoRevisionData{
+	rd := &RepoRevisionData{
 		User:         qa.User,
 		Repo:         qa.Repo,
 		PullRequest:  qa.PullRequest,
@@ -243,6 +270,38 @@ func (qa QAEnvironment) RepoRevisionDataFromQA() *RepoRevisionData {
 		BaseBranch:   qa.BaseBranch,
 		SourceRef:    qa.SourceRef,
 	}
+	if qa.IsManual() {
+		// keep the dependency branches calculated when the environment was created
+		rd.EnvName = qa.Name
+		rd.RefOverrides = map[string]string{}
+		for repo, ref := range qa.RefMap {
+			if repo != qa.Repo {
+				rd.RefOverrides[repo] = ref
+			}
+		}
+	}
+	return rd
+}
+
+// IsManual returns whether the environment was created manually from an arbitrary ref rather than from a PR
+func (qa QAEnvironment) IsManual() bool {
+	return qa.PullRequest == 0
+}
+
+// IsPinned returns whether the environment is pinned at t. Pinned environments are protected from global limit enforcement and age-based reaping.
+func (qa QAEnvironment) IsPinned(t time.Time) bool {
+	return qa.Pinned && (qa.PinnedUntil == nil || qa.PinnedUntil.After(t))
+}
+
+// UnpinnedQAEnvironments returns the environments in qas that are not pinned at t, preserving order
+func UnpinnedQAEnvironments(qas []QAEnvironment, t time.Time) []QAEnvironment {
+	out := make([]QAEnvironment, 0, len(qas))
+	for _, qa := range qas {
+		if !qa.IsPinned(t) {
+			out = append(out, qa)
+		}
+	}
+	return out
 }
 
 // QAEnvironments is a slice of QAEnvironment to allow sorting by Created timestamp
@@ -1,8 +1,10 @@
 package models
 
 import (
+	"context"
 	"strings"
 	"testing"
+	"time"
 )
 
 func TestDependencyDeclarationValidateNames(t *testing.T) {
@@ -219,3 +221,366 @@ func TestRepoConfigRefMap(t *testing.T) {
 		t.Fatalf("biz/baz missing")
 	}
 }
+
+func TestPostRenderConfigMerge(t *testing.T) {
+	defaults := PostRenderConfig{
+		Labels:              map[string]string{"team": "platform", "env": "qa"},
+		ImagePullPolicy:     "IfNotPresent",
+		StripKinds:          []string{"PodDisruptionBudget"},
+		MaxResourceRequests: map[string]string{"cpu": "200m", "memory": "256Mi"},
+	}
+	prc := defaults.Merge(PostRenderConfig{
+		Labels:              map[string]string{"team": "foo", "app": "bar"},
+		Annotations:         map[string]string{"example.com/owner": "foo"},
+		ImagePullPolicy:     "Always",
+		StripKinds:          []string{"PodDisruptionBudget", "HorizontalPodAutoscaler"},
+		MaxResourceRequests: map[string]string{"cpu": "100m", "memory": "1Gi", "ephemeral-storage": "1Gi"},
+	})
+	if prc.Labels["team"] != "platform" || prc.Labels["env"] != "qa" || prc.Labels["app"] != "bar" {
+		t.Errorf("bad labels: %v", prc.Labels)
+	}
+	if prc.Annotations["example.com/owner"] != "foo" {
+		t.Errorf("bad annotations: %v", prc.Annotations)
+	}
+	if prc.ImagePullPolicy != "IfNotPresent" {
+		t.Errorf("bad image pull policy: %v", prc.ImagePullPolicy)
+	}
+	if len(prc.StripKinds) != 2 {
+		t.Errorf("bad strip kinds: %v", prc.StripKinds)
+	}
+	if mrr := prc.MaxResourceRequests; len(mrr) != 3 || mrr["cpu"] != "100m" || mrr["memory"] != "256Mi" || mrr["ephemeral-storage"] != "1Gi" {
+		t.Errorf("bad max resource requests: %v", prc.MaxResourceRequests)
+	}
+	if defaults.Labels["team"] != "platform" || defaults.MaxResourceRequests["cpu"] != "200m" {
+		t.Errorf("defaults should not have been modified: %v", defaults)
+	}
+	if prc := (PostRenderConfig{}).Merge(PostRenderConfig{ImagePullPolicy: "Always"}); prc.ImagePullPolicy != "Always" {
+		t.Errorf("image pull policy should be used without a default: %v", prc.ImagePullPolicy)
+	}
+	if !(PostRenderConfig{}).Merge(PostRenderConfig{}).Empty() {
+		t.Errorf("merge of empty configs should be empty")
+	}
+}
+
+func TestRepoConfigTTLDuration(t *testing.T) {
+	cases := []struct {
+		ttl     string
+		out     time.Duration
+		isError bool
+	}{
+		{"", 0, false},
+		{"72h", 72 * time.Hour, false},
+		{"90m", 90 * time.Minute, false},
+		{"3 days", 0, true},
+		{"-1h", 0, true},
+		{"0s", 0, true},
+	}
+	for _, c := range cases {
+		d, err := RepoConfig{TTL: c.ttl}.TTLDuration()
+		if err != nil {
+			if !c.isError {
+				t.Errorf("%q: should have succeeded: %v", c.ttl, err)
+			}
+			continue
+		}
+		if c.isError {
+			t.Errorf("%q: should have failed", c.ttl)
+		}
+		if d != c.out {
+			t.Errorf("%q: expected %v, got %v", c.ttl, c.out, d)
+		}
+	}
+}
+
+func TestQAEnvironmentIsPinned(t *testing.T) {
+	now := time.Now().UTC()
+	past, future := now.Add(-time.Hour), now.Add(time.Hour)
+	qas := []QAEnvironment{
+		{Name: "unpinned"},
+		{Name: "pinned", Pinned: true},
+		{Name: "pinned-until-future", Pinned: true, PinnedUntil: &future},
+		{Name: "pinned-until-past", Pinned: true, PinnedUntil: &past},
+	}
+	out := UnpinnedQAEnvironments(qas, now)
+	if len(out) != 2 || out[0].Name != "unpinned" || out[1].Name != "pinned-until-past" {
+		t.Fatalf("unexpected unpinned environments: %+v", out)
+	}
+}
+
+func TestQuotasUsage(t *testing.T) {
+	envs := []QAEnvironment{
+		{Name: "a", Repo: "acme/api", User: "alice", Status: Success},
+		{Name: "b", Repo: "acme/api", User: "bob", Status: Spawned},
+		{Name: "c", Repo: "acme/web", User: "alice", Status: Updating},
+		{Name: "d", Repo: "other/api", User: "alice", Status: Destroyed},
+	}
+	q := Quotas{
+		Repos: map[string]Quota{"acme/api": {MaxRunning: 3, MaxBuilding: 1}},
+		Orgs:  map[string]Quota{"acme": {MaxRunning: 3}},
+		Teams: map[string]Quota{"acme/backend": {MaxRunning: 4}},
+		Users: map[string]Quota{"alice": {MaxRunning: 5}},
+	}
+	tm := TeamMembers{"acme/backend": {"Bob", "carol"}}
+	usage := q.Usage(envs, tm)
+	if len(usage) != 4 {
+		t.Fatalf("expected 4 usages: %+v", usage)
+	}
+	for i, want := range []QuotaUsage{
+		{Scope: QuotaScopeRepo, Name: "acme/api", Quota: q.Repos["acme/api"], Running: 2, Building: 1},
+		{Scope: QuotaScopeOrg, Name: "acme", Quota: q.Orgs["acme"], Running: 3, Building: 2},
+		{Scope: QuotaScopeTeam, Name: "acme/backend", Quota: q.Teams["acme/backend"], Running: 1, Building: 1},
+		{Scope: QuotaScopeUser, Name: "alice", Quota: q.Users["alice"], Running: 2, Building: 1},
+	} {
+		if usage[i] != want {
+			t.Fatalf("usage %v: expected %+v, got %+v", i, want, usage[i])
+		}
+	}
+	if err := usage[0].Exceeded(); err == nil || !strings.Contains(err.Error(), "concurrent environment builds") {
+		t.Fatalf("expected repo build quota to be exceeded: %v", err)
+	}
+	if err := usage[1].Exceeded(); err == nil || !strings.Contains(err.Error(), "running environments") {
+		t.Fatalf("expected org running quota to be exceeded: %v", err)
+	}
+	if err := usage[2].Exceeded(); err != nil {
+		t.Fatalf("team quota should not be exceeded: %v", err)
+	}
+	if err := usage[3].Exceeded(); err != nil {
+		t.Fatalf("user quota should not be exceeded: %v", err)
+	}
+	if forrd := q.UsageFor("other/api", "dave", envs, tm); len(forrd) != 0 {
+		t.Fatalf("expected no applicable quotas: %+v", forrd)
+	}
+	if forrd := q.UsageFor("acme/web", "alice", envs, tm); len(forrd) != 2 {
+		t.Fatalf("expected org and user quotas to apply: %+v", forrd)
+	}
+	if forrd := q.UsageFor("other/api", "bob", envs, tm); len(forrd) != 1 || forrd[0].Scope != QuotaScopeTeam || forrd[0].Running != 1 {
+		t.Fatalf("expected the team quota of a team member to apply: %+v", forrd)
+	}
+	got, err := q.TeamMembers(context.Background(), func(ctx context.Context, team string) ([]string, error) {
+		return tm[team], nil
+	})
+	if err != nil || len(got) != 1 || len(got["acme/backend"]) != 2 {
+		t.Fatalf("bad team members: %+v: %v", got, err)
+	}
+}
+
+func TestRepoRevisionDataFromQAManual(t *testing.T) {
+	qa := QAEnvironment{Name: "foo-bar", Repo: "acme/api", SourceBranch: "feature", RefMap: RefMap{"acme/api": "feature", "acme/db": "fix"}}
+	rd := qa.RepoRevisionDataFromQA()
+	if !rd.Manual() || rd.EnvName != "foo-bar" {
+		t.Fatalf("expected manual revision data: %+v", rd)
+	}
+	if len(rd.RefOverrides) != 1 || rd.RefOverrides["acme/db"] != "fix" {
+		t.Fatalf("dependency branches should be kept as overrides: %+v", rd.RefOverrides)
+	}
+	qa.PullRequest = 1
+	if rd := qa.RepoRevisionDataFromQA(); rd.Manual() || rd.RefOverrides != nil {
+		t.Fatalf("PR environment should not be manual: %+v", rd)
+	}
+}
+
+func TestEnvironmentRevisionRollback(t *testing.T) {
+	revs := []EnvironmentRevision{
+		{ID: 3, CommitSHAMap: RefMap{"acme/api": "ccc", "acme/db": "111"}},
+		{ID: 2, CommitSHAMap: RefMap{"acme/api": "bbb", "acme/db": "111"}},
+		{ID: 1, CommitSHAMap: RefMap{"acme/api": "aaa", "acme/db": "111"}},
+	}
+	cases := []struct {
+		name    string
+		current RefMap
+		id      int64
+		want    int64
+		isError bool
+	}{
+		{"failed push", RefMap{"acme/api": "ddd", "acme/db": "111"}, 0, 3, false},
+		{"successful but broken push", RefMap{"acme/api": "ccc", "acme/db": "111"}, 0, 2, false},
+		{"explicit", RefMap{"acme/api": "ccc", "acme/db": "111"}, 1, 1, false},
+		{"missing", RefMap{"acme/api": "ccc", "acme/db": "111"}, 99, 0, true},
+	}
+	for _, c := range cases {
+		rev, err := RollbackRevision(revs, c.current, c.id)
+		if err != nil {
+			if !c.isError {
+				t.Fatalf("%v: should have succeeded: %v", c.name, err)
+			}
+			continue
+		}
+		if c.isError || rev.ID != c.want {
+			t.Fatalf("%v: bad revision: %+v (error expected: %v)", c.name, rev, c.isError)
+		}
+	}
+	if _, err := RollbackRevision(revs[:1], revs[0].CommitSHAMap, 0); err == nil {
+		t.Fatalf("should have failed with no previous revision")
+	}
+
+	rev := EnvironmentRevision{
+		K8sNamespace:    "nitro-1234-foo-bar",
+		RefMap:          RefMap{"acme/api": "feature", "acme/db": "master"},
+		CommitSHAMap:    RefMap{"acme/api": "aaa", "acme/db": "111"},
+		ConfigSignature: []byte("sig"),
+		HelmReleases:    HelmReleaseRevisions{{Name: "acme-api", Release: "api-release", Revision: 2, RevisionSHA: "aaa"}},
+	}
+	rd := rev.RepoRevisionData(QAEnvironment{Name: "foo-bar", Repo: "acme/api", PullRequest: 1, SourceSHA: "bbb"})
+	if rd.SourceSHA != "aaa" || rd.SourceBranch != "feature" || rd.RefOverrides["acme/db"] != "master" || rd.CommitSHAOverrides["acme/db"] != "111" || len(rd.CommitSHAOverrides) != 1 {
+		t.Fatalf("bad revision data: %+v", rd)
+	}
+	k8senv := &KubernetesEnvironment{Namespace: "nitro-1234-foo-bar", ConfigSignature: []byte("sig")}
+	releases := []HelmRelease{{Name: "acme-api", Release: "api-release"}}
+	if !rev.HelmRollbackPossible(k8senv, releases) {
+		t.Fatalf("helm rollback should be possible")
+	}
+	if rev.HelmRollbackPossible(&KubernetesEnvironment{Namespace: "nitro-1234-foo-bar", ConfigSignature: []byte("other")}, releases) {
+		t.Fatalf("helm rollback should not be possible with a different config signature")
+	}
+	if rev.HelmRollbackPossible(&KubernetesEnvironment{Namespace: "nitro-5678-foo-bar", ConfigSignature: []byte("sig")}, releases) {
+		t.Fatalf("helm rollback should not be possible in a different namespace")
+	}
+	if rev.HelmRollbackPossible(k8senv, []HelmRelease{{Name: "acme-api", Release: "other-release"}}) {
+		t.Fatalf("helm rollback should not be possible with different releases")
+	}
+}
+
+func TestEnvironmentPlanDiff(t *testing.T) {
+	newPlan := func() *EnvironmentPlan {
+		return &EnvironmentPlan{
+			RefMap:       RefMap{"acme/api": "feature", "acme/db": "master"},
+			CommitSHAMap: RefMap{"acme/api": "bbb", "acme/db": "111"},
+			Charts: []PlannedChart{
+				{Name: "acme-api", Repo: "acme/api", RevisionSHA: "bbb"},
+				{Name: "acme-db", Repo: "acme/db", RevisionSHA: "111"},
+			},
+		}
+	}
+	sig := [32]byte{1}
+	env := &QAEnvironment{
+		Name:         "foo-bar",
+		Status:       Success,
+		RefMap:       RefMap{"acme/api": "feature", "acme/db": "master", "acme/cache": "master"},
+		CommitSHAMap: RefMap{"acme/api": "aaa", "acme/db": "111", "acme/cache": "222"},
+	}
+	k8senv := &KubernetesEnvironment{EnvName: "foo-bar", Namespace: "nitro-1234-foo-bar", ConfigSignature: sig[:]}
+	releases := []HelmRelease{
+		{Name: "acme-api", Release: "api-release", RevisionSHA: "aaa"},
+		{Name: "acme-db", Release: "db-release", RevisionSHA: "111"},
+		{Name: "acme-cache", Release: "cache-release", RevisionSHA: "222"},
+	}
+
+	plan := newPlan()
+	plan.Diff(nil, nil, nil, sig)
+	if plan.Operation != PlanCreate || plan.EnvName != "" || plan.Charts[0].Action != PlanInstall || !plan.Charts[1].Changed {
+		t.Fatalf("bad create plan: %+v", plan)
+	}
+
+	plan = newPlan()
+	plan.Diff(env, k8senv, releases, sig)
+	if plan.Operation != PlanUpgrade || plan.EnvName != "foo-bar" || plan.ConfigSignatureChanged {
+		t.Fatalf("bad upgrade plan: %+v", plan)
+	}
+	api, db := plan.Charts[0], plan.Charts[1]
+	if api.Action != PlanUpdate || api.Release != "api-release" || api.CurrentRevisionSHA != "aaa" || !api.Changed {
+		t.Fatalf("bad upgraded chart: %+v", api)
+	}
+	if db.Action != PlanUpdate || db.Changed {
+		t.Fatalf("bad unchanged chart: %+v", db)
+	}
+	if len(plan.RemovedReleases) != 1 || plan.RemovedReleases[0] != "cache-release" {
+		t.Fatalf("bad removed releases: %v", plan.RemovedReleases)
+	}
+	if len(plan.RefChanges) != 2 || plan.RefChanges[0].Repo != "acme/api" || plan.RefChanges[0].CurrentSHA != "aaa" || plan.RefChanges[1].Repo != "acme/cache" || plan.RefChanges[1].Ref != "" {
+		t.Fatalf("bad ref changes: %+v", plan.RefChanges)
+	}
+
+	plan = newPlan()
+	plan.Diff(env, k8senv, releases, [32]byte{2})
+	if plan.Operation != PlanRedeploy || !plan.ConfigSignatureChanged || plan.Charts[0].Action != PlanInstall || plan.Charts[0].Release != "" {
+		t.Fatalf("bad redeploy plan: %+v", plan)
+	}
+	if len(plan.RemovedReleases) != 3 {
+		t.Fatalf("redeploy should delete all releases: %v", plan.RemovedReleases)
+	}
+
+	env.Status = Failure
+	plan = newPlan()
+	plan.Diff(env, k8senv, releases, sig)
+	if plan.Operation != PlanRedeploy || plan.ConfigSignatureChanged {
+		t.Fatalf("failed environment should be redeployed: %+v", plan)
+	}
+}
+
+func TestReaperPolicyConfigPolicy(t *testing.T) {
+	cases := []struct {
+		name    string
+		rpc     ReaperPolicyConfig
+		out     ReaperPolicy
+		isError bool
+	}{
+		{"empty", ReaperPolicyConfig{}, ReaperPolicy{}, false},
+		{"all", ReaperPolicyConfig{MaxAge: "336h", MaxFailure: "2h", MaxBuilding: "90m", PruneDelay: "168h"}, ReaperPolicy{MaxAge: 336 * time.Hour, MaxFailure: 2 * time.Hour, MaxBuilding: 90 * time.Minute, PruneDelay: 168 * time.Hour}, false},
+		{"partial", ReaperPolicyConfig{MaxFailure: "30m"}, ReaperPolicy{MaxFailure: 30 * time.Minute}, false},
+		{"invalid", ReaperPolicyConfig{MaxAge: "2 weeks"}, ReaperPolicy{}, true},
+		{"negative", ReaperPolicyConfig{PruneDelay: "-1h"}, ReaperPolicy{}, true},
+	}
+	for _, c := range cases {
+		rp, err := c.rpc.Policy()
+		if err != nil {
+			if !c.isError {
+				t.Errorf("%v: should have succeeded: %v", c.name, err)
+			}
+			continue
+		}
+		if c.isError {
+			t.Errorf("%v: should have failed", c.name)
+		}
+		if rp != c.out {
+			t.Errorf("%v: expected %+v, got %+v", c.name, c.out, rp)
+		}
+	}
+}
+
+func TestParseReaperPolicies(t *testing.T) {
+	rps, err := ParseReaperPolicies(`{"default": {"max_age": "336h"}, "repos": {"acme/api": {"max_failure": "4h"}}, "min": {"max_failure": "30m"}, "max": {"max_age": "720h", "max_failure": "8h"}}`)
+	if err != nil {
+		t.Fatalf("should have succeeded: %v", err)
+	}
+	if rps.Default.MaxAge != 336*time.Hour || rps.Repos["acme/api"].MaxFailure != 4*time.Hour || rps.Min.MaxFailure != 30*time.Minute || rps.Max.MaxAge != 720*time.Hour {
+		t.Fatalf("bad policies: %+v", rps)
+	}
+	if _, err := ParseReaperPolicies(`{}`); err != nil {
+		t.Fatalf("empty policies should have succeeded: %v", err)
+	}
+	if _, err := ParseReaperPolicies(`{"repos": {"acme/api": {"max_age": "foo"}}}`); err == nil {
+		t.Fatalf("invalid duration should have failed")
+	}
+	if _, err := ParseReaperPolicies(`{"min": {"max_age": "48h"}, "max": {"max_age": "24h"}}`); err == nil {
+		t.Fatalf("minimum greater than maximum should have failed")
+	}
+}
+
+func TestReaperPoliciesFor(t *testing.T) {
+	rps := ReaperPolicies{
+		Default: ReaperPolicy{MaxAge: 336 * time.Hour},
+		Repos:   map[string]ReaperPolicy{"acme/api": {MaxFailure: 4 * time.Hour}},
+		Min:     ReaperPolicy{MaxFailure: 30 * time.Minute},
+		Max:     ReaperPolicy{MaxAge: 720 * time.Hour, MaxFailure: 8 * time.Hour},
+	}
+	cases := []struct {
+		name      string
+		repo      string
+		overrides ReaperPolicy
+		out       ReaperPolicy
+	}{
+		{"defaults", "acme/web", ReaperPolicy{}, ReaperPolicy{MaxAge: 336 * time.Hour, MaxFailure: time.Hour, MaxBuilding: time.Hour, PruneDelay: 730 * time.Hour}},
+		{"repo", "acme/api", ReaperPolicy{}, ReaperPolicy{MaxAge: 336 * time.Hour, MaxFailure: 4 * time.Hour, MaxBuilding: time.Hour, PruneDelay: 730 * time.Hour}},
+		{"overrides", "acme/api", ReaperPolicy{MaxFailure: 2 * time.Hour, PruneDelay: time.Hour}, ReaperPolicy{MaxAge: 336 * time.Hour, MaxFailure: 2 * time.Hour, MaxBuilding: time.Hour, PruneDelay: time.Hour}},
+		{"bounded overrides", "acme/api", ReaperPolicy{MaxAge: 8760 * time.Hour, MaxFailure: time.Minute}, ReaperPolicy{MaxAge: 720 * time.Hour, MaxFailure: 30 * time.Minute, MaxBuilding: time.Hour, PruneDelay: 730 * time.Hour}},
+	}
+	for _, c := range cases {
+		if rp := rps.For(c.repo, c.overrides); rp != c.out {
+			t.Errorf("%v: expected %+v, got %+v", c.name, c.out, rp)
+		}
+	}
+	_, adjusted := ReaperPolicy{MaxAge: 8760 * time.Hour, MaxFailure: time.Minute, MaxBuilding: time.Hour}.Bound(rps.Min, rps.Max)
+	if len(adjusted) != 2 {
+		t.Fatalf("expected max_age and max_failure to be adjusted: %v", adjusted)
+	}
+}
@@ -12,6 +12,7 @@ import (
 	nitroerrors "github.com/dollarshaveclub/acyl/pkg/nitro/errors"
 	"github.com/pkg/errors"
 	"golang.org/x/crypto/sha3"
+	"k8s.io/apimachinery/pkg/api/resource"
 )
 
 // RepoConfigDependency models a dependency repo for an environment
@@ -22,6 +23,8 @@ type RepoConfigDependency struct {
 	ChartRepoPath      string                `yaml:"chart_repo_path" json:"chart_repo_path"` // GitHub repo and path to chart (no acyl.yml)
 	ChartVarsPath      string                `yaml:"chart_vars_path" json:"chart_vars_path"`
 	ChartVarsRepoPath  string                `yaml:"chart_vars_repo_path" json:"chart_vars_repo_path"`
+	ManifestsPath      string                `yaml:"manifests_path" json:"manifests_path"` // Path to a directory of raw Kubernetes manifests within the triggering repository
+	KustomizePath      string                `yaml:"kustomize_path" json:"kustomize_path"` // Path to a directory containing a kustomization within the triggering repository
 	DisableBranchMatch bool                  `yaml:"disable_branch_match" json:"disable_branch_match"`
 	DefaultBranch      string                `yaml:"default_branch" json:"default_branch"`
 	Requires           []string              `yaml:"requires" json:"requires"`
@@ -32,7 +35,12 @@ type RepoConfigDependency struct {
 
 // BranchMatchable indicates whether the depencency can participate in branch matching and can be found in RefMap
 func (rcd RepoConfigDependency) BranchMatchable() bool {
-	return rcd.Repo != "" && rcd.ChartPath == "" && rcd.ChartRepoPath == ""
+	return rcd.Repo != "" && rcd.ChartPath == "" && rcd.ChartRepoPath == "" && !rcd.Manifests()
+}
+
+// Manifests indicates whether the dependency is sourced from raw manifests or a kustomization rather than a Helm chart
+func (rcd RepoConfigDependency) Manifests() bool {
+	return rcd.ManifestsPath != "" || rcd.KustomizePath != ""
 }
 
 func truncateString(s string, n uint) string {
@@ -60,6 +68,8 @@ type RepoConfigAppMetadata struct {
 	ChartRepoPath     string   `yaml:"chart_repo_path" json:"chart_repo_path"`
 	ChartVarsPath     string   `yaml:"chart_vars_path" json:"chart_vars_path"`
 	ChartVarsRepoPath string   `yaml:"chart_vars_repo_path" json:"chart_vars_repo_path"`
+	ManifestsPath     string   `yaml:"-" json:"manifests_path"` // set by nitro
+	KustomizePath     string   `yaml:"-" json:"kustomize_path"` // set by nitro
 	Image             string   `yaml:"image" json:"image"`
 	DockerfilePath    string   `yaml:"dockerfile_path" json:"dockerfile_path"`
 	ChartTagValue     string   `yaml:"image_tag_value" json:"image_tag_value"`
@@ -99,6 +109,24 @@ type RepoConfig struct {
 	Application    RepoConfigAppMetadata `yaml:"application" json:"application"`
 	Dependencies   DependencyDeclaration `yaml:"dependencies" json:"dependencies"`
 	Notifications  Notifications         `yaml:"notifications" json:"notifications"`
+	PostRender     PostRenderConfig      `yaml:"post_render" json:"post_render"`
+	TTL            string                `yaml:"ttl" json:"ttl"`       // Environment lifetime after creation (ex: 72h), overrides the server default
+	Reaper         ReaperPolicyConfig    `yaml:"reaper" json:"reaper"` // Reaper policy thresholds, override the server policy within its bounds
+}
+
+// TTLDuration parses TTL, returning zero if it is not set
+func (rc RepoConfig) TTLDuration() (time.Duration, error) {
+	if rc.TTL == "" {
+		return 0, nil
+	}
+	d, err := time.ParseDuration(rc.TTL)
+	if err != nil {
+		return 0, nitroerrors.User(fmt.Errorf("invalid ttl: %v: %w", rc.TTL, err))
+	}
+	if d <= 0 {
+		return 0, nitroerrors.User(fmt.Errorf("ttl must be positive: %v", rc.TTL))
+	}
+	return d, nil
 }
 
 // RefMap generates RefMap for a particular environment
@@ -229,6 +257,8 @@ func (rc RepoConfig) ConfigSignature() [32]byte {
 		buf.Write([]byte(d.Repo))
 		buf.Write([]byte(d.ChartPath))
 		buf.Write([]byte(d.ChartRepoPath))
+		buf.Write([]byte(d.ManifestsPath))
+		buf.Write([]byte(d.KustomizePath))
 		buf.Write([]byte(strings.Join(d.Requires, "")))
 	}
 	for _, d := range rc.Dependencies.Direct {
@@ -237,6 +267,10 @@ func (rc RepoConfig) ConfigSignature() [32]byte {
 	for _, d := range rc.Dependencies.Environment {
 		hashDep(d)
 	}
+	// stripped kinds are never seen by Helm, so changing them requires a rebuild to add or remove the objects
+	if len(rc.PostRender.StripKinds) > 0 {
+		buf.Write([]byte(strings.Join(rc.PostRender.StripKinds, "")))
+	}
 	return sha3.Sum256(buf.Bytes())
 }
 
@@ -346,6 +380,78 @@ func (n *Notifications) FillMissingTemplates() {
 	}
 }
 
+// PostRenderConfig models transforms applied to the rendered manifests of every chart release in an environment,
+// either in acyl.yml v2 (triggering repo only) or as server defaults
+type PostRenderConfig struct {
+	// Labels are added to every object and pod template
+	Labels map[string]string `yaml:"labels" json:"labels"`
+	// Annotations are added to every object and pod template
+	Annotations map[string]string `yaml:"annotations" json:"annotations"`
+	// ImagePullPolicy, if set, overrides the imagePullPolicy of every container and init container
+	ImagePullPolicy string `yaml:"image_pull_policy" json:"image_pull_policy"`
+	// StripKinds is a list of object kinds (ex: PodDisruptionBudget) that are removed entirely
+	StripKinds []string `yaml:"strip_kinds" json:"strip_kinds"`
+	// MaxResourceRequests is a map of resource name to quantity (ex: cpu: 100m). Container requests greater than the quantity are reduced to it.
+	MaxResourceRequests map[string]string `yaml:"max_resource_requests" json:"max_resource_requests"`
+}
+
+// Empty returns whether prc contains no transforms
+func (prc PostRenderConfig) Empty() bool {
+	return len(prc.Labels) == 0 && len(prc.Annotations) == 0 && prc.ImagePullPolicy == "" && len(prc.StripKinds) == 0 && len(prc.MaxResourceRequests) == 0
+}
+
+// Merge returns a new PostRenderConfig containing the transforms of both the server defaults prc and the acyl.yml config repo.
+// The server defaults are enforced: repo may only add labels, annotations and strip kinds, the lower of the two max resource
+// requests is used, and the image pull policy of repo is only used if prc doesn't set one.
+func (prc PostRenderConfig) Merge(repo PostRenderConfig) PostRenderConfig {
+	// addMissing returns a with the keys of b that aren't in a
+	addMissing := func(a, b map[string]string) map[string]string {
+		if len(a) == 0 && len(b) == 0 {
+			return nil
+		}
+		out := make(map[string]string, len(a)+len(b))
+		for k, v := range b {
+			out[k] = v
+		}
+		for k, v := range a {
+			out[k] = v
+		}
+		return out
+	}
+	out := PostRenderConfig{
+		Labels:              addMissing(prc.Labels, repo.Labels),
+		Annotations:         addMissing(prc.Annotations, repo.Annotations),
+		ImagePullPolicy:     prc.ImagePullPolicy,
+		MaxResourceRequests: addMissing(prc.MaxResourceRequests, repo.MaxResourceRequests),
+	}
+	if out.ImagePullPolicy == "" {
+		out.ImagePullPolicy = repo.ImagePullPolicy
+	}
+	for k, v := range repo.MaxResourceRequests {
+		sv, ok := prc.MaxResourceRequests[k]
+		if !ok {
+			continue
+		}
+		// invalid quantities are rejected by the post-renderer, and an invalid server default must not be replaced
+		rq, err := resource.ParseQuantity(v)
+		if err != nil {
+			continue
+		}
+		if sq, err := resource.ParseQuantity(sv); err == nil && rq.Cmp(sq) < 0 {
+			out.MaxResourceRequests[k] = v
+		}
+	}
+	seen := map[string]struct{}{}
+	for _, k := range append(append([]string{}, prc.StripKinds...), repo.StripKinds...) {
+		if _, ok := seen[k]; ok {
+			continue
+		}
+		seen[k] = struct{}{}
+		out.StripKinds = append(out.StripKinds, k)
+	}
+	return out
+}
+
 // GitHubNotifications models GitHub notification options
 type GitHubNotifications struct {
 	PRComments     bool           `yaml:"pr_comments" json:"pr_comments"`
@@ -420,6 +526,26 @@ var DefaultNotificationTemplates = map[string]NotificationTemplate{
 			},
 		},
 	},
+	"expiring": NotificationTemplate{
+		Title: "⏳ Environment Expiring",
+		Sections: []NotificationTemplateSection{
+			NotificationTemplateSection{
+				Title: "{{ .EnvName }}",
+				Text:  "{{ .Repo }}\nPR #{{ .PullRequest }}: {{ .SourceBranch }} ➡️ {{ .BaseBranch }}\nThis environment will be destroyed at {{ .ExpiresAt }} unless its expiration is extended.",
+				Style: "warning",
+			},
+		},
+	},
+	"queued": NotificationTemplate{
+		Title: "🚦 Environment Queued",
+		Sections: []NotificationTemplateSection{
+			NotificationTemplateSection{
+				Title: "{{ .EnvName }}",
+				Text:  "{{ .Repo }}\nPR #{{ .PullRequest }}: {{ .SourceBranch }} ➡️ {{ .BaseBranch }}\nThe global environment limit has been reached. This environment is queued at position {{ .QueuePosition }} and will be created when capacity is available.",
+				Style: "warning",
+			},
+		},
+	},
 }
 
 // NotificationTemplate models a notification template for an event
@@ -432,6 +558,9 @@ type NotificationTemplate struct {
 type NotificationData struct {
 	EnvName, Repo, SourceBranch, SourceSHA, BaseBranch, BaseSHA, CommitMessage, ErrorMessage, User, K8sNamespace, Event string
 	PullRequest                                                                                                         uint
+	ExpiresAt                                                                                                           string // RFC 3339, empty if the environment doesn't expire
+	QueuePosition                                                                                                       uint   // position in the create queue (starting at 1), zero if the environment isn't queued
+	SupersededBy                                                                                                        string // SHA of the commit that superseded a coalesced commit, empty otherwise
 }
 
 func (nt NotificationTemplate) Render(d NotificationData) (*RenderedNotification, error) {
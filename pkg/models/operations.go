@@ -0,0 +1,125 @@
+package models
+
+import (
+	"database/sql/driver"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/lib/pq"
+)
+
+// OperationStatus is the processing status of a QueuedOperation
+type OperationStatus string
+
+const (
+	// OperationPending means the operation is waiting to be leased by a worker (including failed operations waiting to be retried)
+	OperationPending OperationStatus = "pending"
+	// OperationRunning means a worker holds the lease on the operation and is processing it
+	OperationRunning OperationStatus = "running"
+	// OperationDone means the operation was processed, successfully or with an error that isn't retried
+	OperationDone OperationStatus = "done"
+	// OperationDead means the operation failed too many times and will not be retried (dead-lettered)
+	OperationDead OperationStatus = "dead"
+	// OperationCoalesced means the operation was superseded by a newer operation for the same pull request before it was processed
+	OperationCoalesced OperationStatus = "coalesced"
+	// OperationCancelled means the operation was cancelled by a user before it was processed
+	OperationCancelled OperationStatus = "cancelled"
+)
+
+// Actions of operations that aren't PR webhook events: environment creates admitted from the environment queue and
+// operations requested via the API
+const (
+	// CreateOperationAction creates the environment for the RepoRevisionData (admitted from the environment queue, or a manual environment or clone)
+	CreateOperationAction = "create"
+	// UpdateOperationAction updates (rebuilds) the environment Params.EnvName to the RepoRevisionData
+	UpdateOperationAction = "update"
+	// HibernateOperationAction hibernates the environment Params.EnvName
+	HibernateOperationAction = "hibernate"
+	// WakeOperationAction wakes the hibernated environment Params.EnvName
+	WakeOperationAction = "wake"
+	// RetryFailedOperationAction retries the failed charts of the environment Params.EnvName
+	RetryFailedOperationAction = "retry_failed"
+	// RollbackOperationAction rolls back the environment Params.EnvName to Params.Revision
+	RollbackOperationAction = "rollback"
+	// DestroyOperationAction destroys the environment Params.EnvName
+	DestroyOperationAction = "destroy"
+)
+
+// OperationParams are the parameters of an operation other than its RepoRevisionData
+type OperationParams struct {
+	// EnvName is the name of the environment of operations requested via the API
+	EnvName string `json:"env_name,omitempty"`
+	// Revision is the environment revision of a rollback
+	Revision int64 `json:"revision,omitempty"`
+	// QueueAdmitted means the environment create was started from the environment queue and must not be queued again
+	QueueAdmitted bool `json:"queue_admitted,omitempty"`
+}
+
+// Value implements database/sql/driver Valuer interface.
+func (p OperationParams) Value() (driver.Value, error) {
+	return json.Marshal(p)
+}
+
+// Scan implements database/sql Scanner interface.
+func (p *OperationParams) Scan(value interface{}) error {
+	if value == nil {
+		return nil
+	}
+	b, ok := value.([]byte)
+	if !ok {
+		return fmt.Errorf("unexpected type for value: %T (wanted []byte)", value)
+	}
+	return json.Unmarshal(b, &p)
+}
+
+// QueuedOperation models an accepted webhook event (an environment create, update or destroy), or an environment operation
+// requested via the API or admitted from the environment queue, that is persisted until it has been processed by a worker,
+// so that it survives process crashes and restarts
+type QueuedOperation struct {
+	ID      uuid.UUID `json:"id"`
+	Created time.Time `json:"created"`
+	// Action is the PR webhook action ("opened", "reopened", "synchronize" or "closed") or one of the other operation actions
+	Action           string           `json:"action"`
+	RepoRevisionData RepoRevisionData `json:"repo_revision_data"`
+	Params           OperationParams  `json:"params"`
+	// EventID is the ID of the event log of the webhook event
+	EventID uuid.UUID `json:"event_id"`
+	// InstallationID is the GitHub app installation that sent the event (zero for legacy webhooks)
+	InstallationID int64           `json:"installation_id"`
+	Status         OperationStatus `json:"status"`
+	// Attempts is the number of times the operation has been leased
+	Attempts uint `json:"attempts"`
+	// NotBefore is the earliest time the operation may be leased
+	NotBefore    time.Time   `json:"not_before"`
+	LeaseOwner   string      `json:"lease_owner"`
+	LeaseExpires pq.NullTime `json:"lease_expires"`
+	LastError    string      `json:"last_error"`
+	Completed    pq.NullTime `json:"completed"`
+}
+
+func (qo QueuedOperation) Columns() string {
+	return strings.Join([]string{"id", "created", "action", "repo_revision_data", "params", "event_id", "installation_id", "status", "attempts", "not_before", "lease_owner", "lease_expires", "last_error", "completed"}, ",")
+}
+
+func (qo *QueuedOperation) ScanValues() []interface{} {
+	return []interface{}{&qo.ID, &qo.Created, &qo.Action, &qo.RepoRevisionData, &qo.Params, &qo.EventID, &qo.InstallationID, &qo.Status, &qo.Attempts, &qo.NotBefore, &qo.LeaseOwner, &qo.LeaseExpires, &qo.LastError, &qo.Completed}
+}
+
+func (qo QueuedOperation) InsertColumns() string {
+	return strings.Join([]string{"id", "created", "action", "repo_revision_data", "params", "event_id", "installation_id", "status", "not_before"}, ",")
+}
+
+func (qo *QueuedOperation) InsertValues() []interface{} {
+	return []interface{}{&qo.ID, &qo.Created, &qo.Action, &qo.RepoRevisionData, &qo.Params, &qo.EventID, &qo.InstallationID, &qo.Status, &qo.NotBefore}
+}
+
+func (qo QueuedOperation) InsertParams() string {
+	params := []string{}
+	for i := range strings.Split(qo.InsertColumns(), ",") {
+		params = append(params, fmt.Sprintf("$%v", i+1))
+	}
+	return strings.Join(params, ", ")
+}
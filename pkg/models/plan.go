@@ -0,0 +1,140 @@
+package models
+
+import (
+	"bytes"
+	"sort"
+)
+
+// PlanOperation enumerates what an environment operation would do as a whole
+type PlanOperation string
+
+const (
+	// PlanCreate means a new environment would be created
+	PlanCreate PlanOperation = "create"
+	// PlanUpgrade means the existing Helm releases would be upgraded in place
+	PlanUpgrade PlanOperation = "upgrade"
+	// PlanRedeploy means the existing namespace would be torn down and all charts installed from scratch
+	PlanRedeploy PlanOperation = "redeploy"
+)
+
+// PlanAction enumerates what an environment operation would do with a single chart
+type PlanAction string
+
+const (
+	PlanInstall PlanAction = "install"
+	PlanUpdate  PlanAction = "upgrade"
+)
+
+// PlannedChart models a chart as it would be installed or upgraded
+type PlannedChart struct {
+	Name               string     `json:"name"`                           // chart title (dependency name)
+	Repo               string     `json:"repo,omitempty"`                 // empty for chart-only dependencies
+	Action             PlanAction `json:"action"`                         // set by Diff
+	Release            string     `json:"release,omitempty"`              // existing release that would be upgraded
+	CurrentRevisionSHA string     `json:"current_revision_sha,omitempty"` // commit SHA deployed by the existing release
+	RevisionSHA        string     `json:"revision_sha"`                   // commit SHA that would be deployed
+	Changed            bool       `json:"changed"`                        // whether the deployed commit would change
+	Requires           []string   `json:"requires"`
+	Values             string     `json:"values"` // final merged values YAML
+}
+
+// PlannedRefChange models a repo whose branch or commit would change
+type PlannedRefChange struct {
+	Repo       string `json:"repo"`
+	CurrentRef string `json:"current_ref,omitempty"`
+	Ref        string `json:"ref,omitempty"`
+	CurrentSHA string `json:"current_sha,omitempty"`
+	SHA        string `json:"sha,omitempty"`
+}
+
+// EnvironmentPlan models what creating or updating an environment would do, calculated without building images or
+// modifying the cluster
+type EnvironmentPlan struct {
+	EnvName                string             `json:"env_name,omitempty"` // extant environment the plan is relative to, if any
+	Operation              PlanOperation      `json:"operation"`
+	RefMap                 RefMap             `json:"ref_map"`
+	CommitSHAMap           RefMap             `json:"commit_sha_map"`
+	ConfigSignatureChanged bool               `json:"config_signature_changed"`
+	InstallOrder           [][]string         `json:"install_order"` // chart names in install stages, charts within a stage are installed concurrently
+	Charts                 []PlannedChart     `json:"charts"`
+	RemovedReleases        []string           `json:"removed_releases"` // extant releases that would be deleted
+	RefChanges             []PlannedRefChange `json:"ref_changes"`
+}
+
+// InPlaceUpgradePossible returns whether an update of env to a configuration with signature sig would upgrade the extant
+// Helm releases rather than tearing down the namespace and installing from scratch
+func InPlaceUpgradePossible(env *QAEnvironment, k8senv *KubernetesEnvironment, sig [32]byte) bool {
+	if env == nil || k8senv == nil {
+		return false
+	}
+	return bytes.Equal(k8senv.ConfigSignature, sig[:]) && (env.Status == Success || env.Status == Hibernated)
+}
+
+// Diff calculates the operation and per-chart actions of the plan relative to the extant environment env (which may be nil),
+// its k8s environment and Helm releases. sig is the config signature of the planned configuration.
+func (ep *EnvironmentPlan) Diff(env *QAEnvironment, k8senv *KubernetesEnvironment, releases []HelmRelease, sig [32]byte) {
+	ep.RemovedReleases = []string{}
+	ep.RefChanges = []PlannedRefChange{}
+	if env != nil {
+		ep.EnvName = env.Name
+	}
+	if env == nil || k8senv == nil {
+		ep.Operation = PlanCreate
+		for i := range ep.Charts {
+			ep.Charts[i].Action = PlanInstall
+			ep.Charts[i].Changed = true
+		}
+		return
+	}
+	ep.ConfigSignatureChanged = !bytes.Equal(k8senv.ConfigSignature, sig[:])
+	ep.Operation = PlanRedeploy
+	if InPlaceUpgradePossible(env, k8senv, sig) {
+		ep.Operation = PlanUpgrade
+	}
+	current := make(map[string]HelmRelease, len(releases))
+	for _, r := range releases {
+		current[r.Name] = r
+	}
+	planned := make(map[string]struct{}, len(ep.Charts))
+	for i := range ep.Charts {
+		c := &ep.Charts[i]
+		planned[c.Name] = struct{}{}
+		r, ok := current[c.Name]
+		if ok {
+			c.CurrentRevisionSHA = r.RevisionSHA
+		}
+		c.Changed = !ok || r.RevisionSHA != c.RevisionSHA
+		if ok && ep.Operation == PlanUpgrade {
+			c.Action = PlanUpdate
+			c.Release = r.Release
+			continue
+		}
+		c.Action = PlanInstall
+	}
+	for _, r := range releases { // a redeploy deletes the namespace and therefore all extant releases
+		if _, ok := planned[r.Name]; !ok || ep.Operation == PlanRedeploy {
+			ep.RemovedReleases = append(ep.RemovedReleases, r.Release)
+		}
+	}
+	sort.Strings(ep.RemovedReleases)
+	repos := map[string]struct{}{}
+	for repo := range env.RefMap {
+		repos[repo] = struct{}{}
+	}
+	for repo := range ep.RefMap {
+		repos[repo] = struct{}{}
+	}
+	for repo := range repos {
+		rc := PlannedRefChange{
+			Repo:       repo,
+			CurrentRef: env.RefMap[repo],
+			Ref:        ep.RefMap[repo],
+			CurrentSHA: env.CommitSHAMap[repo],
+			SHA:        ep.CommitSHAMap[repo],
+		}
+		if rc.CurrentRef != rc.Ref || rc.CurrentSHA != rc.SHA {
+			ep.RefChanges = append(ep.RefChanges, rc)
+		}
+	}
+	sort.Slice(ep.RefChanges, func(i, j int) bool { return ep.RefChanges[i].Repo < ep.RefChanges[j].Repo })
+}
@@ -0,0 +1,66 @@
+package models
+
+import (
+	"database/sql"
+	"database/sql/driver"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// QueuedEnvironment models an environment create that is waiting for capacity under the global environment limit
+type QueuedEnvironment struct {
+	EnvName          string           `json:"env_name"`
+	Enqueued         time.Time        `json:"enqueued"`
+	Priority         int              `json:"priority"`
+	RepoRevisionData RepoRevisionData `json:"repo_revision_data"`
+	EventID          uuid.UUID        `json:"event_id"`
+	// InstallationID is the GitHub app installation that sent the event of the create (zero for legacy webhooks and API requests)
+	InstallationID int64 `json:"installation_id"`
+}
+
+func (qe QueuedEnvironment) Columns() string {
+	return strings.Join([]string{"env_name", "enqueued", "priority", "repo_revision_data", "event_id", "installation_id"}, ",")
+}
+
+func (qe *QueuedEnvironment) ScanValues() []interface{} {
+	return []interface{}{&qe.EnvName, &qe.Enqueued, &qe.Priority, &qe.RepoRevisionData, &qe.EventID, &qe.InstallationID}
+}
+
+func (qe *QueuedEnvironment) InsertValues() []interface{} {
+	return []interface{}{&qe.EnvName, &qe.Enqueued, &qe.Priority, &qe.RepoRevisionData, &qe.EventID, &qe.InstallationID}
+}
+
+func (qe QueuedEnvironment) InsertParams() string {
+	params := []string{}
+	for i := range strings.Split(qe.Columns(), ",") {
+		params = append(params, fmt.Sprintf("$%v", i+1))
+	}
+	return strings.Join(params, ", ")
+}
+
+// Value implements database/sql/driver Valuer interface.
+func (rd RepoRevisionData) Value() (driver.Value, error) {
+	return json.Marshal(rd)
+}
+
+// Scan implements database/sql Scanner interface.
+func (rd *RepoRevisionData) Scan(value interface{}) error {
+	if value == nil {
+		return nil
+	}
+	b, ok := value.([]byte)
+	if !ok {
+		return fmt.Errorf("unexpected type for value: %T (wanted []byte)", value)
+	}
+	return json.Unmarshal(b, &rd)
+}
+
+// check interfaces
+var (
+	_ driver.Valuer = RepoRevisionData{}
+	_ sql.Scanner   = &RepoRevisionData{}
+)
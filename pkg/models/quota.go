@@ -0,0 +1,175 @@
+package models
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// Quota models the environment limits for a single repo, org, team or user. Zero values mean no limit.
+type Quota struct {
+	MaxRunning  uint `json:"max_running"`  // maximum running environments
+	MaxBuilding uint `json:"max_building"` // maximum environments concurrently being built (created or updated)
+}
+
+// Quotas models environment quotas by repo ("owner/name"), GitHub org (repo owner), GitHub team ("org/team-slug") and GitHub user.
+// A team quota applies to the environments of all members of the team.
+type Quotas struct {
+	Repos map[string]Quota `json:"repos"`
+	Orgs  map[string]Quota `json:"orgs"`
+	Teams map[string]Quota `json:"teams"`
+	Users map[string]Quota `json:"users"`
+}
+
+// TeamMembers maps GitHub teams ("org/team-slug") to the logins of their members
+type TeamMembers map[string][]string
+
+// member returns whether user is a member of team
+func (tm TeamMembers) member(team, user string) bool {
+	for _, m := range tm[team] {
+		if strings.EqualFold(m, user) {
+			return true
+		}
+	}
+	return false
+}
+
+// TeamMembers returns the members of the teams with quotas, using getMembers to list the members of each team
+func (q Quotas) TeamMembers(ctx context.Context, getMembers func(ctx context.Context, team string) ([]string, error)) (TeamMembers, error) {
+	out := make(TeamMembers, len(q.Teams))
+	for team := range q.Teams {
+		members, err := getMembers(ctx, team)
+		if err != nil {
+			return nil, fmt.Errorf("error getting members of team %v: %w", team, err)
+		}
+		out[team] = members
+	}
+	return out, nil
+}
+
+// Quota scopes
+const (
+	QuotaScopeRepo = "repo"
+	QuotaScopeOrg  = "org"
+	QuotaScopeTeam = "team"
+	QuotaScopeUser = "user"
+)
+
+// Empty returns whether no quotas are configured
+func (q Quotas) Empty() bool {
+	return len(q.Repos) == 0 && len(q.Orgs) == 0 && len(q.Teams) == 0 && len(q.Users) == 0
+}
+
+// QuotaUsage models the current usage against a configured quota
+type QuotaUsage struct {
+	Scope    string `json:"scope"`
+	Name     string `json:"name"`
+	Quota    Quota  `json:"quota"`
+	Running  uint   `json:"running"`
+	Building uint   `json:"building"`
+}
+
+// Exceeded returns an error describing the exhausted limit if one more environment would exceed the quota, or nil otherwise
+func (qu QuotaUsage) Exceeded() error {
+	if qu.Quota.MaxRunning > 0 && qu.Running >= qu.Quota.MaxRunning {
+		return fmt.Errorf("%v %v has %v of %v allowed running environments", qu.Scope, qu.Name, qu.Running, qu.Quota.MaxRunning)
+	}
+	return qu.BuildingExceeded()
+}
+
+// BuildingExceeded returns an error if building one more environment would exceed the quota, or nil otherwise.
+// Updates of running environments are only limited by the building quota.
+func (qu QuotaUsage) BuildingExceeded() error {
+	if qu.Quota.MaxBuilding > 0 && qu.Building >= qu.Quota.MaxBuilding {
+		return fmt.Errorf("%v %v has %v of %v allowed concurrent environment builds", qu.Scope, qu.Name, qu.Building, qu.Quota.MaxBuilding)
+	}
+	return nil
+}
+
+// RepoOrg returns the org (owner) portion of a repo name ("owner/name")
+func RepoOrg(repo string) string {
+	return strings.SplitN(repo, "/", 2)[0]
+}
+
+// inQuotaScope returns whether env counts against the quota for name within scope
+func inQuotaScope(scope, name string, env QAEnvironment, tm TeamMembers) bool {
+	switch scope {
+	case QuotaScopeRepo:
+		return env.Repo == name
+	case QuotaScopeOrg:
+		return RepoOrg(env.Repo) == name
+	case QuotaScopeTeam:
+		return tm.member(name, env.User)
+	default:
+		return env.User == name
+	}
+}
+
+// usage calculates usage against quota for name within scope from envs
+func usage(scope, name string, quota Quota, envs []QAEnvironment, tm TeamMembers) QuotaUsage {
+	qu := QuotaUsage{Scope: scope, Name: name, Quota: quota}
+	for _, env := range envs {
+		if !inQuotaScope(scope, name, env, tm) {
+			continue
+		}
+		switch env.Status {
+		case Spawned, Updating:
+			qu.Building++
+			qu.Running++
+		case Success:
+			qu.Running++
+		}
+	}
+	return qu
+}
+
+// Usage calculates usage against all configured quotas from envs and the members of teams with quotas, ordered by scope and name
+func (q Quotas) Usage(envs []QAEnvironment, tm TeamMembers) []QuotaUsage {
+	out := []QuotaUsage{}
+	for _, s := range []struct {
+		scope  string
+		quotas map[string]Quota
+	}{
+		{scope: QuotaScopeRepo, quotas: q.Repos},
+		{scope: QuotaScopeOrg, quotas: q.Orgs},
+		{scope: QuotaScopeTeam, quotas: q.Teams},
+		{scope: QuotaScopeUser, quotas: q.Users},
+	} {
+		names := make([]string, 0, len(s.quotas))
+		for name := range s.quotas {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			out = append(out, usage(s.scope, name, s.quotas[name], envs, tm))
+		}
+	}
+	return out
+}
+
+// UsageFor calculates usage from envs against the quotas that apply to an environment triggered by user for repo,
+// including the quotas of the teams (per tm) that user is a member of
+func (q Quotas) UsageFor(repo, user string, envs []QAEnvironment, tm TeamMembers) []QuotaUsage {
+	out := []QuotaUsage{}
+	if quota, ok := q.Repos[repo]; ok {
+		out = append(out, usage(QuotaScopeRepo, repo, quota, envs, tm))
+	}
+	if quota, ok := q.Orgs[RepoOrg(repo)]; ok {
+		out = append(out, usage(QuotaScopeOrg, RepoOrg(repo), quota, envs, tm))
+	}
+	teams := make([]string, 0, len(q.Teams))
+	for team := range q.Teams {
+		if tm.member(team, user) {
+			teams = append(teams, team)
+		}
+	}
+	sort.Strings(teams)
+	for _, team := range teams {
+		out = append(out, usage(QuotaScopeTeam, team, q.Teams[team], envs, tm))
+	}
+	if quota, ok := q.Users[user]; ok {
+		out = append(out, usage(QuotaScopeUser, user, quota, envs, tm))
+	}
+	return out
+}
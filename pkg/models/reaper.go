@@ -0,0 +1,193 @@
+package models
+
+import (
+	"database/sql"
+	"database/sql/driver"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	nitroerrors "github.com/dollarshaveclub/acyl/pkg/nitro/errors"
+)
+
+// ReaperPolicy models the thresholds at which the reaper destroys environments and prunes the records of destroyed
+// environments. Zero durations are unset.
+type ReaperPolicy struct {
+	// MaxAge is the maximum age of an environment, after which it is destroyed regardless of status (unset for no maximum)
+	MaxAge time.Duration `json:"max_age,omitempty"`
+	// MaxFailure is the maximum time an environment may remain in Failure
+	MaxFailure time.Duration `json:"max_failure,omitempty"`
+	// MaxBuilding is the maximum time an environment may remain in Spawned or Updating
+	MaxBuilding time.Duration `json:"max_building,omitempty"`
+	// PruneDelay is how long the record of a destroyed environment is kept
+	PruneDelay time.Duration `json:"prune_delay,omitempty"`
+}
+
+// DefaultReaperPolicy provides the thresholds that are set by neither the server config nor acyl.yml
+var DefaultReaperPolicy = ReaperPolicy{
+	MaxFailure:  time.Hour,
+	MaxBuilding: time.Hour,
+	PruneDelay:  730 * time.Hour, // one month
+}
+
+// reaperPolicyFields are the names of the ReaperPolicy thresholds in acyl.yml and the server config, in the order returned by durations
+var reaperPolicyFields = []string{"max_age", "max_failure", "max_building", "prune_delay"}
+
+func (rp *ReaperPolicy) durations() []*time.Duration {
+	return []*time.Duration{&rp.MaxAge, &rp.MaxFailure, &rp.MaxBuilding, &rp.PruneDelay}
+}
+
+// Merge returns rp with the thresholds that are set in o taking precedence
+func (rp ReaperPolicy) Merge(o ReaperPolicy) ReaperPolicy {
+	od := o.durations()
+	for i, d := range rp.durations() {
+		if *od[i] > 0 {
+			*d = *od[i]
+		}
+	}
+	return rp
+}
+
+// Bound returns rp with each threshold that is set limited to the range between the corresponding thresholds of min and
+// max (where those are set), and a description of each threshold that was adjusted
+func (rp ReaperPolicy) Bound(min, max ReaperPolicy) (ReaperPolicy, []string) {
+	var adjusted []string
+	mind, maxd := min.durations(), max.durations()
+	for i, d := range rp.durations() {
+		switch {
+		case *d == 0:
+		case *mind[i] > 0 && *d < *mind[i]:
+			adjusted = append(adjusted, fmt.Sprintf("%v %v is less than the minimum, using %v", reaperPolicyFields[i], *d, *mind[i]))
+			*d = *mind[i]
+		case *maxd[i] > 0 && *d > *maxd[i]:
+			adjusted = append(adjusted, fmt.Sprintf("%v %v is greater than the maximum, using %v", reaperPolicyFields[i], *d, *maxd[i]))
+			*d = *maxd[i]
+		}
+	}
+	return rp, adjusted
+}
+
+// Value implements the driver.Valuer interface.
+func (rp ReaperPolicy) Value() (driver.Value, error) {
+	return json.Marshal(rp)
+}
+
+// Scan implements database/sql Scanner interface.
+func (rp *ReaperPolicy) Scan(value interface{}) error {
+	if value == nil {
+		return nil
+	}
+	b, ok := value.([]byte)
+	if !ok {
+		return fmt.Errorf("unexpected type for value: %T (wanted []byte)", value)
+	}
+	return json.Unmarshal(b, &rp)
+}
+
+// check interfaces
+var (
+	_ driver.Valuer = ReaperPolicy{}
+	_ sql.Scanner   = &ReaperPolicy{}
+)
+
+// ReaperPolicyConfig is the configuration of a ReaperPolicy in acyl.yml or the server config, with durations in Go
+// duration format (ex: 72h). Empty durations are unset.
+type ReaperPolicyConfig struct {
+	MaxAge      string `yaml:"max_age" json:"max_age"`
+	MaxFailure  string `yaml:"max_failure" json:"max_failure"`
+	MaxBuilding string `yaml:"max_building" json:"max_building"`
+	PruneDelay  string `yaml:"prune_delay" json:"prune_delay"`
+}
+
+// Policy parses the durations of rpc
+func (rpc ReaperPolicyConfig) Policy() (ReaperPolicy, error) {
+	rp := ReaperPolicy{}
+	durations := rp.durations()
+	for i, s := range []string{rpc.MaxAge, rpc.MaxFailure, rpc.MaxBuilding, rpc.PruneDelay} {
+		if s == "" {
+			continue
+		}
+		d, err := time.ParseDuration(s)
+		if err != nil {
+			return ReaperPolicy{}, nitroerrors.User(fmt.Errorf("invalid reaper %v: %v: %w", reaperPolicyFields[i], s, err))
+		}
+		if d <= 0 {
+			return ReaperPolicy{}, nitroerrors.User(fmt.Errorf("reaper %v must be positive: %v", reaperPolicyFields[i], s))
+		}
+		*durations[i] = d
+	}
+	return rp, nil
+}
+
+// ReaperPolicies models the reaper policy configured in the server: the default thresholds, per-repo thresholds, and
+// the bounds within which the thresholds may be overridden by acyl.yml
+type ReaperPolicies struct {
+	Default ReaperPolicy
+	Repos   map[string]ReaperPolicy
+	Min     ReaperPolicy
+	Max     ReaperPolicy
+}
+
+// ParseReaperPolicies parses JSON-encoded reaper policies, in the form
+// {"default": {"max_age": "336h"}, "repos": {"acme/api": {"max_failure": "4h"}}, "min": {...}, "max": {...}}
+func ParseReaperPolicies(js string) (ReaperPolicies, error) {
+	cfg := struct {
+		Default ReaperPolicyConfig            `json:"default"`
+		Repos   map[string]ReaperPolicyConfig `json:"repos"`
+		Min     ReaperPolicyConfig            `json:"min"`
+		Max     ReaperPolicyConfig            `json:"max"`
+	}{}
+	if err := json.Unmarshal([]byte(js), &cfg); err != nil {
+		return ReaperPolicies{}, fmt.Errorf("error unmarshaling reaper policies: %w", err)
+	}
+	rps := ReaperPolicies{Repos: make(map[string]ReaperPolicy, len(cfg.Repos))}
+	var err error
+	if rps.Default, err = cfg.Default.Policy(); err != nil {
+		return ReaperPolicies{}, fmt.Errorf("invalid default policy: %w", err)
+	}
+	for repo, rpc := range cfg.Repos {
+		if rps.Repos[repo], err = rpc.Policy(); err != nil {
+			return ReaperPolicies{}, fmt.Errorf("invalid policy for %v: %w", repo, err)
+		}
+	}
+	if rps.Min, err = cfg.Min.Policy(); err != nil {
+		return ReaperPolicies{}, fmt.Errorf("invalid minimum policy: %w", err)
+	}
+	if rps.Max, err = cfg.Max.Policy(); err != nil {
+		return ReaperPolicies{}, fmt.Errorf("invalid maximum policy: %w", err)
+	}
+	mind, maxd := rps.Min.durations(), rps.Max.durations()
+	for i := range mind {
+		if *mind[i] > 0 && *maxd[i] > 0 && *mind[i] > *maxd[i] {
+			return ReaperPolicies{}, fmt.Errorf("minimum %v is greater than the maximum: %v > %v", reaperPolicyFields[i], *mind[i], *maxd[i])
+		}
+	}
+	return rps, nil
+}
+
+// For returns the policy for an environment of repo with the acyl.yml overrides, which are limited to the configured bounds
+func (rps ReaperPolicies) For(repo string, overrides ReaperPolicy) ReaperPolicy {
+	overrides, _ = overrides.Bound(rps.Min, rps.Max)
+	return DefaultReaperPolicy.Merge(rps.Default).Merge(rps.Repos[repo]).Merge(overrides)
+}
+
+// Reap actions
+const (
+	ReapActionDestroy = "destroy"
+	ReapActionPrune   = "prune"
+)
+
+// ReapAction models an environment destroyed, or the record of a destroyed environment deleted (pruned), by the reaper,
+// or that would be in a dry run
+type ReapAction struct {
+	EnvName     string `json:"env_name"`
+	Repo        string `json:"repo"`
+	PullRequest uint   `json:"pull_request"`
+	Status      string `json:"status"`
+	// Action is ReapActionDestroy or ReapActionPrune
+	Action string `json:"action"`
+	// Reason is the destroy reason (empty for prunes)
+	Reason string `json:"reason"`
+	// Detail describes why the action is taken
+	Detail string `json:"detail"`
+}
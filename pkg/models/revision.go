@@ -0,0 +1,179 @@
+package models
+
+import (
+	"bytes"
+	"database/sql"
+	"database/sql/driver"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// MaxEnvironmentRevisions is the number of environment revisions retained per environment
+const MaxEnvironmentRevisions = 10
+
+// HelmReleaseRevision models the state of a single Helm release as of an EnvironmentRevision
+type HelmReleaseRevision struct {
+	Name        string `json:"name"`         // chart title (dependency name)
+	Release     string `json:"release"`      // Helm release name
+	Revision    int    `json:"revision"`     // Helm release revision (version) number
+	RevisionSHA string `json:"revision_sha"` // commit SHA deployed by the release
+}
+
+// HelmReleaseRevisions is a list of HelmReleaseRevision
+type HelmReleaseRevisions []HelmReleaseRevision
+
+// EnvironmentRevision models a successful deployment of an environment, recorded so that the environment can be rolled
+// back to a known-good state
+type EnvironmentRevision struct {
+	ID              int64                `json:"id"`
+	EnvName         string               `json:"env_name"`
+	Created         time.Time            `json:"created"`
+	K8sNamespace    string               `json:"k8s_namespace"`
+	RefMap          RefMap               `json:"ref_map"`
+	CommitSHAMap    RefMap               `json:"commit_sha_map"`
+	ConfigSignature []byte               `json:"config_signature"`
+	HelmReleases    HelmReleaseRevisions `json:"helm_releases"`
+}
+
+func (er EnvironmentRevision) Columns() string {
+	return strings.Join([]string{"id", "env_name", "created", "k8s_namespace", "ref_map", "commit_sha_map", "config_signature", "helm_releases"}, ",")
+}
+
+func (er EnvironmentRevision) InsertColumns() string {
+	return strings.Join([]string{"env_name", "created", "k8s_namespace", "ref_map", "commit_sha_map", "config_signature", "helm_releases"}, ",")
+}
+
+func (er *EnvironmentRevision) ScanValues() []interface{} {
+	return []interface{}{&er.ID, &er.EnvName, &er.Created, &er.K8sNamespace, &er.RefMap, &er.CommitSHAMap, &er.ConfigSignature, &er.HelmReleases}
+}
+
+func (er *EnvironmentRevision) InsertValues() []interface{} {
+	return []interface{}{&er.EnvName, &er.Created, &er.K8sNamespace, &er.RefMap, &er.CommitSHAMap, &er.ConfigSignature, &er.HelmReleases}
+}
+
+func (er EnvironmentRevision) InsertParams() string {
+	params := []string{}
+	for i := range strings.Split(er.InsertColumns(), ",") {
+		params = append(params, fmt.Sprintf("$%v", i+1))
+	}
+	return strings.Join(params, ", ")
+}
+
+// Matches returns whether the revision deployed exactly the commits in csm
+func (er EnvironmentRevision) Matches(csm RefMap) bool {
+	if len(er.CommitSHAMap) != len(csm) {
+		return false
+	}
+	for repo, sha := range er.CommitSHAMap {
+		if csm[repo] != sha {
+			return false
+		}
+	}
+	return true
+}
+
+// RepoRevisionData returns the revision data needed to redeploy the revision for env: the triggering repo and all
+// dependencies are pinned to the commits deployed by the revision
+func (er EnvironmentRevision) RepoRevisionData(env QAEnvironment) *RepoRevisionData {
+	rd := env.RepoRevisionDataFromQA()
+	rd.SourceBranch = er.RefMap[env.Repo]
+	rd.SourceSHA = er.CommitSHAMap[env.Repo]
+	rd.RefOverrides = map[string]string{}
+	rd.CommitSHAOverrides = map[string]string{}
+	for repo, ref := range er.RefMap {
+		if repo == env.Repo {
+			continue
+		}
+		rd.RefOverrides[repo] = ref
+		if sha, ok := er.CommitSHAMap[repo]; ok {
+			rd.CommitSHAOverrides[repo] = sha
+		}
+	}
+	return rd
+}
+
+// HelmRollbackPossible returns whether the environment can be returned to the revision with Helm rollbacks of the existing
+// releases, which is the case if the revision was deployed into the current namespace with the same config signature and releases
+func (er EnvironmentRevision) HelmRollbackPossible(k8senv *KubernetesEnvironment, releases []HelmRelease) bool {
+	if k8senv == nil || k8senv.Namespace != er.K8sNamespace || !bytes.Equal(k8senv.ConfigSignature, er.ConfigSignature) {
+		return false
+	}
+	if len(er.HelmReleases) == 0 || len(er.HelmReleases) != len(releases) {
+		return false
+	}
+	current := make(map[string]string, len(releases))
+	for _, r := range releases {
+		current[r.Name] = r.Release
+	}
+	for _, hrr := range er.HelmReleases {
+		if current[hrr.Name] != hrr.Release || hrr.Revision < 1 {
+			return false
+		}
+	}
+	return true
+}
+
+// RollbackRevision selects the revision to roll back to from revs (ordered newest first). If id is zero, the most recent
+// revision that deployed different commits than csm (the currently deployed commits) is selected. Otherwise the revision
+// with that ID is selected. An error is returned if there is no matching revision.
+func RollbackRevision(revs []EnvironmentRevision, csm RefMap, id int64) (*EnvironmentRevision, error) {
+	for i := range revs {
+		if id != 0 {
+			if revs[i].ID == id {
+				return &revs[i], nil
+			}
+			continue
+		}
+		if !revs[i].Matches(csm) {
+			return &revs[i], nil
+		}
+	}
+	if id != 0 {
+		return nil, fmt.Errorf("revision not found: %v", id)
+	}
+	return nil, fmt.Errorf("no previous successful revision found")
+}
+
+// Value implements database/sql/driver Valuer interface.
+func (rm RefMap) Value() (driver.Value, error) {
+	return json.Marshal(rm)
+}
+
+// Scan implements database/sql Scanner interface.
+func (rm *RefMap) Scan(value interface{}) error {
+	if value == nil {
+		return nil
+	}
+	b, ok := value.([]byte)
+	if !ok {
+		return fmt.Errorf("unexpected type for value: %T (wanted []byte)", value)
+	}
+	return json.Unmarshal(b, rm)
+}
+
+// Value implements database/sql/driver Valuer interface.
+func (hrr HelmReleaseRevisions) Value() (driver.Value, error) {
+	return json.Marshal(hrr)
+}
+
+// Scan implements database/sql Scanner interface.
+func (hrr *HelmReleaseRevisions) Scan(value interface{}) error {
+	if value == nil {
+		return nil
+	}
+	b, ok := value.([]byte)
+	if !ok {
+		return fmt.Errorf("unexpected type for value: %T (wanted []byte)", value)
+	}
+	return json.Unmarshal(b, hrr)
+}
+
+// check interfaces
+var (
+	_ driver.Valuer = RefMap{}
+	_ sql.Scanner   = &RefMap{}
+	_ driver.Valuer = HelmReleaseRevisions{}
+	_ sql.Scanner   = &HelmReleaseRevisions{}
+)
@@ -24,3 +24,17 @@ func GetCancelFunc(ctx context.Context) context.CancelFunc {
 	}
 	return cf
 }
+
+type queueAdmittedContextKey struct{}
+
+// NewQueueAdmittedContext returns a context that marks an environment create as started from the environment queue, so
+// that it is not queued again
+func NewQueueAdmittedContext(ctx context.Context) context.Context {
+	return context.WithValue(ctx, queueAdmittedContextKey{}, true)
+}
+
+// IsQueueAdmitted returns whether ctx belongs to an environment create that was started from the environment queue
+func IsQueueAdmitted(ctx context.Context) bool {
+	admitted, _ := ctx.Value(queueAdmittedContextKey{}).(bool)
+	return admitted
+}
@@ -0,0 +1,94 @@
+package env
+
+import (
+	"context"
+	"time"
+
+	"github.com/dollarshaveclub/acyl/pkg/eventlogger"
+	nitroerrors "github.com/dollarshaveclub/acyl/pkg/nitro/errors"
+)
+
+// RetryPolicy determines how creates and updates that fail with system errors (API server timeouts, registry errors,
+// GitHub rate limits, etc) are automatically retried. Operations that fail with user errors are never retried.
+type RetryPolicy struct {
+	// MaxAttempts is the maximum number of attempts of an operation including the first (zero or one to disable retries)
+	MaxAttempts uint
+	// Backoff is the delay before the first retry, which doubles with each subsequent retry
+	Backoff time.Duration
+	// MaxBackoff is the maximum delay between attempts (zero for no maximum)
+	MaxBackoff time.Duration
+}
+
+// DefaultRetryBackoff is the delay before the first retry if RetryPolicy.Backoff is zero
+var DefaultRetryBackoff = 30 * time.Second
+
+// backoff returns the delay after the failed attempt (starting at 1)
+func (rp RetryPolicy) backoff(attempt uint) time.Duration {
+	d := rp.Backoff
+	if d <= 0 {
+		d = DefaultRetryBackoff
+	}
+	for i := uint(1); i < attempt; i++ {
+		d *= 2
+		if rp.MaxBackoff > 0 && d >= rp.MaxBackoff {
+			break
+		}
+	}
+	if rp.MaxBackoff > 0 && d > rp.MaxBackoff {
+		return rp.MaxBackoff
+	}
+	return d
+}
+
+type retryAttemptKey struct{}
+
+// retryAttempt is the attempt number and maximum number of attempts of the operation
+type retryAttempt struct {
+	n, max uint
+}
+
+// willRetry returns whether the operation running with ctx that failed with err will be retried by withRetries
+func willRetry(ctx context.Context, err error) bool {
+	ra, ok := ctx.Value(retryAttemptKey{}).(retryAttempt)
+	if !ok || err == nil || ra.n >= ra.max || nitroerrors.IsUserError(err) {
+		return false
+	}
+	select {
+	case <-ctx.Done():
+		return false
+	default:
+		return true
+	}
+}
+
+// withRetries calls f until it succeeds, fails with a user error or ctx is cancelled, up to m.RetryPolicy.MaxAttempts times
+// with exponential backoff between attempts. Each failed attempt is recorded in the event log and status. If the final
+// attempt fails with a system error after retries, the error is annotated with nitroerrors.RetriesExhausted so that
+// callers (the worker) don't retry the operation again.
+// f must check willRetry before reporting a failure (notifications, commit statuses, event status) so that only the final
+// failure is reported.
+func (m *Manager) withRetries(ctx context.Context, op, repo string, f func(ctx context.Context) error) error {
+	max := m.RetryPolicy.MaxAttempts
+	if max == 0 {
+		max = 1
+	}
+	for n := uint(1); ; n++ {
+		actx := context.WithValue(ctx, retryAttemptKey{}, retryAttempt{n: n, max: max})
+		err := f(actx)
+		if !willRetry(actx, err) {
+			if n > 1 && n >= max && nitroerrors.IsSystemError(err) {
+				return nitroerrors.RetriesExhausted(err)
+			}
+			return err
+		}
+		backoff := m.RetryPolicy.backoff(n)
+		m.log(ctx, "%v attempt %v of %v failed with system error, retrying in %v: %v", op, n, max, backoff, err)
+		m.MC.Increment(mpfx+op+"_retries", "triggering_repo:"+repo)
+		eventlogger.GetLogger(ctx).AddRetry(n, err, backoff)
+		select {
+		case <-ctx.Done():
+			return err
+		case <-time.After(backoff):
+		}
+	}
+}
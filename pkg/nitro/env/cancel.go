@@ -0,0 +1,131 @@
+package env
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+
+	"github.com/dollarshaveclub/acyl/pkg/eventlogger"
+	"github.com/dollarshaveclub/acyl/pkg/locker"
+	"github.com/dollarshaveclub/acyl/pkg/models"
+	nitroerrors "github.com/dollarshaveclub/acyl/pkg/nitro/errors"
+	"github.com/dollarshaveclub/acyl/pkg/nitro/notifier"
+	"github.com/google/uuid"
+	"gopkg.in/DataDog/dd-trace-go.v1/ddtrace/tracer"
+)
+
+// Cancel cancels the operation in progress for the environment (if any) by preempting the holder of its lock with reason.
+// If eventID is not uuid.Nil, the holder is only preempted if it is the operation of that event, so that a newer operation
+// isn't cancelled in its place (a user error is returned instead). The cancelled operation stops any running image builds
+// and leaves the environment with status Cancelled. Cancel returns without waiting for the operation to stop.
+func (m *Manager) Cancel(ctx context.Context, name string, eventID uuid.UUID, reason string) (err error) {
+	span, ctx := tracer.StartSpanFromContext(ctx, "cancel")
+	defer func() {
+		span.Finish(tracer.WithError(err))
+	}()
+	env, err := m.DL.GetQAEnvironment(ctx, name)
+	if err != nil {
+		return fmt.Errorf("error getting environment: %w", err)
+	}
+	if env == nil {
+		return nitroerrors.User(fmt.Errorf("environment not found: %v", name))
+	}
+	if env.Status == models.Queued {
+		return nitroerrors.User(fmt.Errorf("environment is queued and has no operation in progress: destroy it to remove it from the queue"))
+	}
+	lock := m.PLF(lockRepo(env.Repo, env.PullRequest, env.Name), env.PullRequest, reason)
+	if eventID != uuid.Nil {
+		holder, err := lock.HolderEvent(ctx)
+		switch {
+		case errors.Is(err, locker.ErrHolderUnknown):
+			// the lock provider can't tell which operation holds the lock, so preempt whichever does
+		case err != nil:
+			return fmt.Errorf("error getting lock holder: %w", err)
+		case holder != lockEvent(eventID):
+			return nitroerrors.User(fmt.Errorf("operation of event %v is not in progress", eventID))
+		}
+	}
+	m.MC.Increment(mpfx+"cancel", "triggering_repo:"+env.Repo)
+	m.DL.AddEvent(ctx, env.Name, "cancellation requested: "+reason)
+	if err := lock.Preempt(ctx); err != nil {
+		return fmt.Errorf("error preempting operation: %w", err)
+	}
+	return nil
+}
+
+// CancelQueued cancels the operation of the event eventID if it is still waiting in the durable operation queue, so that
+// it is never processed. Like an operation that is cancelled while in progress, the failure commit status is set and a
+// failure notification is sent with reason. It returns the cancelled operation, or nil if the event has no queued operation.
+func (m *Manager) CancelQueued(ctx context.Context, eventID uuid.UUID, reason string) (_ *models.QueuedOperation, err error) {
+	span, ctx := tracer.StartSpanFromContext(ctx, "cancel_queued")
+	defer func() {
+		span.Finish(tracer.WithError(err))
+	}()
+	op, err := m.DL.CancelPendingOperation(ctx, eventID, reason)
+	if err != nil {
+		return nil, fmt.Errorf("error cancelling queued operation: %w", err)
+	}
+	if op == nil {
+		return nil, nil
+	}
+	m.MC.Increment(mpfx+"cancel_queued", "triggering_repo:"+op.RepoRevisionData.Repo, "action:"+op.Action)
+	ctx = eventlogger.NewEventLoggerContext(ctx, &eventlogger.Logger{ID: eventID, DL: m.DL, Sink: os.Stdout})
+	msg := fmt.Sprintf("queued %v cancelled before processing started: %v", op.Action, reason)
+	m.log(ctx, "%v (operation: %v)", msg, op.ID)
+	eventlogger.GetLogger(ctx).SetCompletedStatus(models.CancelledStatus)
+	rd := op.RepoRevisionData
+	env, err := m.queuedOperationEnv(ctx, op)
+	if err != nil {
+		m.log(ctx, "error getting environment of cancelled operation: %v", err)
+	}
+	if env == nil {
+		// the create hasn't generated the environment yet
+		env = &models.QAEnvironment{
+			Name:         rd.EnvName,
+			Repo:         rd.Repo,
+			PullRequest:  rd.PullRequest,
+			SourceSHA:    rd.SourceSHA,
+			SourceBranch: rd.SourceBranch,
+			BaseSHA:      rd.BaseSHA,
+			BaseBranch:   rd.BaseBranch,
+			User:         rd.User,
+		}
+	} else {
+		m.setloggername(ctx, env.Name)
+		m.DL.AddEvent(ctx, env.Name, msg)
+		if rd.Repo == "" {
+			// operations requested by environment name don't have revision data
+			rd = *env.RepoRevisionDataFromQA()
+		}
+		if op.Action == models.CreateOperationAction && env.Status == models.Spawned {
+			// a create admitted from the environment queue had already been marked as spawned
+			if err := m.DL.SetQAEnvironmentStatus(ctx, env.Name, models.Cancelled); err != nil {
+				m.log(ctx, "error setting environment status to cancelled: %v", err)
+			}
+			m.processQueueAsync(ctx)
+		}
+	}
+	ne := &newEnv{env: env}
+	m.pushNotification(ctx, ne, notifier.Failure, msg)
+	if rd.Repo != "" && rd.SourceSHA != "" {
+		m.setGithubCommitStatus(ctx, &rd, ne, models.CommitStatusFailure, msg)
+	}
+	return op, nil
+}
+
+// queuedOperationEnv returns the environment of the queued operation op, or nil if it doesn't exist yet
+func (m *Manager) queuedOperationEnv(ctx context.Context, op *models.QueuedOperation) (*models.QAEnvironment, error) {
+	name := op.Params.EnvName
+	if name == "" {
+		name = op.RepoRevisionData.EnvName
+	}
+	if name != "" {
+		return m.DL.GetQAEnvironment(ctx, name)
+	}
+	env, err := m.getenv(ctx, &op.RepoRevisionData)
+	if err == extantEnvsErr {
+		return nil, nil
+	}
+	return env, err
+}
@@ -0,0 +1,106 @@
+package env
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/dollarshaveclub/acyl/pkg/models"
+	nitroerrors "github.com/dollarshaveclub/acyl/pkg/nitro/errors"
+)
+
+// PrepareClone fills in rd for a manual environment that reproduces the environment named source: the triggering repo and
+// every dependency are pinned to the branches and commits recorded for source, except for the repos in rd.RefOverrides,
+// which use the head of the chosen branch instead. rd.User must be set to the owner of the new environment. rd can then be passed to Create.
+func (m *Manager) PrepareClone(ctx context.Context, source string, rd *models.RepoRevisionData) error {
+	switch {
+	case source == "":
+		return nitroerrors.User(fmt.Errorf("source environment is required"))
+	case rd.User == "":
+		return nitroerrors.User(fmt.Errorf("owner is required"))
+	case rd.TTL < 0:
+		return nitroerrors.User(fmt.Errorf("ttl must be positive: %v", rd.TTL))
+	}
+	src, err := m.DL.GetQAEnvironment(ctx, source)
+	if err != nil {
+		return fmt.Errorf("error getting source environment: %w", err)
+	}
+	if src == nil {
+		return nitroerrors.User(fmt.Errorf("source environment not found: %v", source))
+	}
+	if len(src.RefMap) == 0 {
+		return nitroerrors.User(fmt.Errorf("source environment has no recorded refs (was it ever successfully configured?): %v", source))
+	}
+	overrides := rd.RefOverrides
+	for repo, branch := range overrides {
+		if _, ok := src.RefMap[repo]; !ok {
+			return nitroerrors.User(fmt.Errorf("ref override repo is not part of the source environment: %v", repo))
+		}
+		if _, err := m.RC.GetBranch(ctx, repo, branch); err != nil {
+			return nitroerrors.User(fmt.Errorf("error getting ref override branch: %v: %v: %w", repo, branch, err))
+		}
+	}
+	rd.Repo = src.Repo
+	rd.SourceBranch = src.SourceBranch
+	rd.SourceSHA = src.SourceSHA
+	rd.SourceRef = src.SourceRef
+	rd.BaseBranch = src.BaseBranch
+	rd.BaseSHA = src.BaseSHA
+	if branch, ok := overrides[src.Repo]; ok {
+		bi, err := m.RC.GetBranch(ctx, src.Repo, branch)
+		if err != nil {
+			return nitroerrors.User(fmt.Errorf("error getting branch: %v: %v: %w", src.Repo, branch, err))
+		}
+		rd.SourceBranch = branch
+		rd.SourceSHA = bi.SHA
+		rd.SourceRef = branch
+	}
+	rd.RefOverrides = map[string]string{}
+	rd.CommitSHAOverrides = map[string]string{}
+	for repo, ref := range src.RefMap {
+		if repo == src.Repo {
+			continue
+		}
+		if branch, ok := overrides[repo]; ok {
+			rd.RefOverrides[repo] = branch
+			continue
+		}
+		rd.RefOverrides[repo] = ref
+		if sha, ok := src.CommitSHAMap[repo]; ok {
+			rd.CommitSHAOverrides[repo] = sha
+		}
+	}
+	name, err := m.NG.New()
+	if err != nil {
+		return fmt.Errorf("error generating name: %w", err)
+	}
+	rd.PullRequest = 0
+	rd.EnvName = name
+	rd.CloneOf = src.Name
+	return nil
+}
+
+// checkCloneSignature records an event on the environment if the acyl.yml configuration of a cloned environment differs
+// from that of the source environment it was cloned from
+func (m *Manager) checkCloneSignature(ctx context.Context, rd *models.RepoRevisionData, ne *newEnv) {
+	if rd.CloneOf == "" {
+		return
+	}
+	k8senv, err := m.DL.GetK8sEnv(ctx, rd.CloneOf)
+	if err != nil {
+		m.log(ctx, "error getting k8s environment for clone source: %v: %v", rd.CloneOf, err)
+		return
+	}
+	if k8senv == nil {
+		m.log(ctx, "clone source k8s environment not found (destroyed?), not comparing config signatures: %v", rd.CloneOf)
+		return
+	}
+	var sig [32]byte
+	copy(sig[:], k8senv.ConfigSignature)
+	if ne.rc.ConfigSignature() == sig {
+		m.log(ctx, "config signature matches clone source environment: %v", rd.CloneOf)
+		return
+	}
+	msg := fmt.Sprintf("warning: acyl.yml configuration differs from clone source environment %v (overridden dependencies or upstream changes)", rd.CloneOf)
+	m.log(ctx, "%v", msg)
+	m.DL.AddEvent(ctx, ne.env.Name, msg)
+}
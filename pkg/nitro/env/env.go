@@ -5,6 +5,7 @@ import (
 	stdliberrors "errors"
 	"fmt"
 	"sort"
+	"sync"
 	"time"
 
 	"github.com/dollarshaveclub/acyl/pkg/ghapp"
@@ -52,8 +53,23 @@ type Manager struct {
 	CI                   metahelm.Installer
 	PLF                  locker.PreemptiveLockerFactory
 	GlobalLimit          uint
+	GlobalLimitPolicy    GlobalLimitPolicy     // What happens to creates when the global limit has been reached
+	QueuePriorities      QueuePriorities       // Create queue priorities (only used with QueuePolicy)
+	DefaultTTL           time.Duration         // Environment lifetime after creation if acyl.yml doesn't set ttl (zero for no expiration)
+	MaxPinnedPerRepo     uint                  // Maximum number of pinned environments per repo (zero for no limit)
+	ManualTTL            time.Duration         // Manual (non-PR) environment lifetime if neither the request nor acyl.yml set ttl (zero to use DefaultTTL)
+	Quotas               models.Quotas         // Per-repo, per-org, per-team and per-user environment quotas
+	ReaperPolicies       models.ReaperPolicies // Server reaper policies, which bound the reaper overrides in acyl.yml
+	RetryPolicy          RetryPolicy           // Automatic retries of creates and updates that fail with system errors
+	DurableQueue         bool                  // Start creates dequeued from the environment queue via the durable operation queue (processed by workers)
 	OperationTimeout     time.Duration
 	UIBaseURL            string
+
+	queueMtx sync.Mutex
+
+	teamsMtx     sync.Mutex
+	teams        models.TeamMembers // cached members of the teams with quotas
+	teamsFetched time.Time
 }
 
 var DefaultOperationTimeout = 30 * time.Minute
@@ -120,6 +136,8 @@ func (m *Manager) pushNotification(ctx context.Context, env *newEnv, event notif
 			CommitMessage: cmsg,
 			ErrorMessage:  errmsg,
 			Event:         event.String(),
+			ExpiresAt:     expiresAt(env.env),
+			QueuePosition: env.queuePosition,
 		},
 		Event:    event,
 		Template: env.rc.Notifications.Templates[event.Key()],
@@ -160,16 +178,17 @@ func (m *Manager) setGithubCommitStatus(ctx context.Context, rd *models.RepoRevi
 		cst = models.DefaultCommitStatusTemplates[ncs.Key()]
 	}
 	csData := models.NotificationData{
-		EnvName:      env.env.Name,
-		Repo:         env.env.Repo,
-		SourceBranch: env.env.SourceBranch,
-		SourceSHA:    env.env.SourceSHA,
-		BaseBranch:   env.env.BaseBranch,
-		BaseSHA:      env.env.BaseSHA,
-		User:         env.env.User,
-		PullRequest:  env.env.PullRequest,
-		K8sNamespace: m.getKubernetesNamespaceName(ctx, env.env.Name),
-		ErrorMessage: errmsg,
+		EnvName:       env.env.Name,
+		Repo:          env.env.Repo,
+		SourceBranch:  env.env.SourceBranch,
+		SourceSHA:     env.env.SourceSHA,
+		BaseBranch:    env.env.BaseBranch,
+		BaseSHA:       env.env.BaseSHA,
+		User:          env.env.User,
+		PullRequest:   env.env.PullRequest,
+		K8sNamespace:  m.getKubernetesNamespaceName(ctx, env.env.Name),
+		ErrorMessage:  errmsg,
+		QueuePosition: env.queuePosition,
 	}
 	renderedCSTemplate, err := cst.Render(csData)
 	if err != nil {
@@ -188,7 +207,7 @@ func (m *Manager) setGithubCommitStatus(ctx context.Context, rd *models.RepoRevi
 	}
 	cs := &ghclient.CommitStatus{
 		Context:     "Acyl",
-		Status:      ncs.Key(),
+		Status:      ncs.State(),
 		Description: renderedCSTemplate.Description,
 		TargetURL:   turl,
 	}
@@ -201,12 +220,30 @@ func (m *Manager) setGithubCommitStatus(ctx context.Context, rd *models.RepoRevi
 	return cs, nil
 }
 
-// lockingOperation sets up the lock and if successful executes f, releasing the lock afterward
-func (m *Manager) lockingOperation(ctx context.Context, repo string, pr uint, f func(ctx context.Context) error) (err error) {
+// lockRepo returns the repo used for the lock of operations on the environment (envname is only used by manual environments)
+func lockRepo(repo string, pr uint, envname string) string {
+	if pr == 0 && envname != "" {
+		// manual environments for the same repo must not preempt each other
+		return repo + "#" + envname
+	}
+	return repo
+}
+
+// lockEvent returns the lock event of operations for the event eventID, which identifies the holder of the lock so that
+// the operation of a specific event can be cancelled
+func lockEvent(eventID uuid.UUID) string {
+	if eventID == uuid.Nil {
+		return "a newer operation"
+	}
+	return "event " + eventID.String()
+}
+
+// lockingOperation sets up the lock for the repo and PR (or the environment name, for manual environments without a PR) and if successful executes f, releasing the lock afterward
+func (m *Manager) lockingOperation(ctx context.Context, repo string, pr uint, envname string, f func(ctx context.Context) error) (err error) {
 	ctx, cf := context.WithCancel(ctx)
 	defer cf()
 	end := m.MC.Timing(mpfx+"lock_wait", "triggering_repo:"+repo)
-	lock := m.PLF(repo, pr, "event") // TODO: consider adding more detailed event information
+	lock := m.PLF(lockRepo(repo, pr, envname), pr, lockEvent(eventlogger.GetLogger(ctx).ID))
 	preempt, err := lock.Lock(ctx)
 	if err != nil {
 		end("success:false")
@@ -220,11 +257,13 @@ func (m *Manager) lockingOperation(ctx context.Context, repo string, pr uint, f
 	}()
 	stop := make(chan struct{})
 	defer close(stop)
+	preemptedBy := make(chan string, 1)
 	go func() {
 		select {
 		case np := <-preempt: // Lock got preempted, cancel action
 			m.MC.Increment(mpfx+"lock_preempt", "triggering_repo:"+repo)
 			m.log(ctx, "operation preempted: %v: %v, %v", repo, pr, np)
+			preemptedBy <- np.Message
 		case <-stop:
 		}
 		cf()
@@ -251,7 +290,13 @@ func (m *Manager) lockingOperation(ctx context.Context, repo string, pr uint, f
 	switch {
 	case cancelled:
 		eventlogger.GetLogger(ctx).SetCompletedStatus(models.CancelledStatus)
-		err = nitroerrors.Cancelled(ctx.Err())
+		err = ctx.Err()
+		select {
+		case msg := <-preemptedBy:
+			err = fmt.Errorf("preempted by %v: %w", msg, err)
+		default:
+		}
+		err = nitroerrors.Cancelled(err)
 	case err != nil:
 		var ce metahelmlib.ChartError
 		if stdliberrors.As(err, &ce) {
@@ -268,9 +313,11 @@ func (m *Manager) lockingOperation(ctx context.Context, repo string, pr uint, f
 func (m *Manager) Create(ctx context.Context, rd models.RepoRevisionData) (string, error) {
 	var err error
 	var name string
-	err = m.lockingOperation(ctx, rd.Repo, rd.PullRequest, func(ctx context.Context) error {
-		name, err = m.create(ctx, &rd)
-		return err
+	err = m.lockingOperation(ctx, rd.Repo, rd.PullRequest, rd.EnvName, func(ctx context.Context) error {
+		return m.withRetries(ctx, "create", rd.Repo, func(ctx context.Context) error {
+			name, err = m.create(ctx, &rd)
+			return err
+		})
 	})
 	if nitroerrors.IsCancelledError(err) {
 		env, envErr := m.getenv(context.Background(), &rd)
@@ -280,21 +327,35 @@ func (m *Manager) Create(ctx context.Context, rd models.RepoRevisionData) (strin
 		if err := m.DL.SetQAEnvironmentStatus(context.Background(), env.Name, models.Cancelled); err != nil {
 			m.log(ctx, "error persisting cancelled status after cancellation: %v", err)
 		}
+		m.DL.AddEvent(context.Background(), env.Name, "operation cancelled: "+err.Error())
 	}
+	// a failed create frees capacity and a queued create may be startable immediately
+	m.processQueueAsync(ctx)
 	return name, err
 }
 
 // enforceGlobalLimit checks existing environments against the configured global limit.
 // If necessary, kill oldest environments to bring the environment count into compliance with the limit.
+// Pinned environments are neither counted nor destroyed.
 func (m *Manager) enforceGlobalLimit(ctx context.Context) error {
 	if m.GlobalLimit == 0 {
 		return nil
 	}
-	limit := int(m.GlobalLimit)
-	qae, err := m.DL.GetRunningQAEnvironments(ctx)
+	return m.evictOverLimit(ctx, int(m.GlobalLimit), "")
+}
+
+// evictOverLimit destroys the oldest unpinned running environments other than exclude until there are no more than limit
+func (m *Manager) evictOverLimit(ctx context.Context, limit int, exclude string) error {
+	running, err := m.DL.GetRunningQAEnvironments(ctx)
 	if err != nil {
 		return fmt.Errorf("error getting running environments: %v", err)
 	}
+	qae := []models.QAEnvironment{}
+	for _, qa := range models.UnpinnedQAEnvironments(running, time.Now().UTC()) {
+		if qa.Name != exclude {
+			qae = append(qae, qa)
+		}
+	}
 	extant := len(qae)
 	if extant > limit {
 		kill := extant - limit
@@ -325,8 +386,9 @@ func (m *Manager) enforceGlobalLimit(ctx context.Context) error {
 
 // newEnv contains all the information required for construction of a new environment
 type newEnv struct {
-	env *models.QAEnvironment
-	rc  *models.RepoConfig
+	env           *models.QAEnvironment
+	rc            *models.RepoConfig
+	queuePosition uint // nonzero if the create is queued
 }
 
 func (m *Manager) getRepoConfig(ctx context.Context, rd *models.RepoRevisionData) (rc *models.RepoConfig, err error) {
@@ -355,7 +417,7 @@ func (m *Manager) generateNewEnv(ctx context.Context, rd *models.RepoRevisionDat
 	defer func() {
 		span.Finish(tracer.WithError(err))
 	}()
-	envs, err := m.DL.GetQAEnvironmentsByRepoAndPR(ctx, rd.Repo, rd.PullRequest)
+	envs, err := m.revisionEnvs(ctx, rd)
 	if err != nil {
 		return nil, fmt.Errorf("error checking for existing environment record: %w", err)
 	}
@@ -380,10 +442,13 @@ func (m *Manager) generateNewEnv(ctx context.Context, rd *models.RepoRevisionDat
 			return nil, fmt.Errorf("error getting updated, reused environment record: %w", err)
 		}
 	} else {
-		// no record exists, create a new one
-		name, err := m.NG.New()
-		if err != nil {
-			return nil, fmt.Errorf("error generating name: %w", err)
+		// no record exists, create a new one (manual environments already have a name)
+		name := rd.EnvName
+		if name == "" {
+			name, err = m.NG.New()
+			if err != nil {
+				return nil, fmt.Errorf("error generating name: %w", err)
+			}
 		}
 		m.log(ctx, "generating new environment record: %v", name)
 		env = &models.QAEnvironment{
@@ -418,6 +483,9 @@ func (m *Manager) processEnvConfig(ctx context.Context, env *models.QAEnvironmen
 		return ne, fmt.Errorf("error validating environment config: %w", err)
 	}
 	ne.rc = rc
+	if err := m.setReaperPolicy(ctx, env, rc); err != nil {
+		return ne, err
+	}
 	rm, err := rc.RefMap()
 	if err != nil {
 		return ne, fmt.Errorf("error generating ref map: %w", err)
@@ -501,6 +569,10 @@ func (m *Manager) create(ctx context.Context, rd *models.RepoRevisionData) (envn
 			if err := m.DL.SetQAEnvironmentStatus(tracer.ContextWithSpan(context.Background(), span), env.Name, models.Failure); err != nil {
 				m.log(ctx, "error setting environment status to failed: %v", err)
 			}
+			if willRetry(ctx, err) {
+				// the failure is reported if the final attempt fails
+				return
+			}
 			errmsg := "error creating: " + err.Error()
 			m.pushNotification(ctx, newenv, notifier.Failure, errmsg)
 			m.setGithubCommitStatus(ctx, rd, newenv, models.CommitStatusFailure, errmsg)
@@ -508,6 +580,10 @@ func (m *Manager) create(ctx context.Context, rd *models.RepoRevisionData) (envn
 			m.MC.Increment(mpfx+"create_errors", "triggering_repo:"+rd.Repo)
 			return
 		}
+		if newenv.queuePosition > 0 {
+			// the create will be resumed by ProcessQueue when capacity is available
+			return
+		}
 		// metahelm.Manager sets the success status on QAEnvironment
 		m.pushNotification(ctx, newenv, notifier.Success, "")
 		m.setGithubCommitStatus(ctx, rd, newenv, models.CommitStatusSuccess, "")
@@ -520,6 +596,23 @@ func (m *Manager) create(ctx context.Context, rd *models.RepoRevisionData) (envn
 	}
 	elapsed := time.Since(start)
 	eventlogger.GetLogger(ctx).SetInitialStatus(newenv.rc, elapsed)
+	m.checkCloneSignature(ctx, rd, newenv)
+	switch {
+	case m.GlobalLimitPolicy == QueuePolicy && !ncontext.IsQueueAdmitted(ctx):
+		if _, err = m.queueIfAtLimit(ctx, rd, newenv); err != nil {
+			return "", fmt.Errorf("error checking global limit: %w", err)
+		}
+		if newenv.queuePosition > 0 {
+			return newenv.env.Name, nil
+		}
+	case m.GlobalLimitPolicy == EvictOldestPolicy:
+		if err = m.checkQuotas(ctx, rd, newenv.env.Name); err != nil {
+			return "", fmt.Errorf("error checking quotas: %w", err)
+		}
+	}
+	if err = m.setInitialExpiration(ctx, rd, newenv); err != nil {
+		return "", fmt.Errorf("error setting expiration: %w", err)
+	}
 	select {
 	case <-ctx.Done():
 		return "", nitroerrors.User(fmt.Errorf("context was cancelled in create"))
@@ -541,8 +634,10 @@ func (m *Manager) create(ctx context.Context, rd *models.RepoRevisionData) (envn
 		}
 	}
 
-	if err = m.enforceGlobalLimit(ctx); err != nil {
-		return "", fmt.Errorf("error enforcing global limit: %w", err)
+	if m.GlobalLimitPolicy == EvictOldestPolicy {
+		if err = m.enforceGlobalLimit(ctx); err != nil {
+			return "", fmt.Errorf("error enforcing global limit: %w", err)
+		}
 	}
 
 	chartSpan, ctx := tracer.StartSpanFromContext(ctx, "build_and_install_charts")
@@ -557,7 +652,7 @@ func (m *Manager) create(ctx context.Context, rd *models.RepoRevisionData) (envn
 // Delete destroys an environment in k8s and marks it as such in the DB
 func (m *Manager) Delete(ctx context.Context, rd *models.RepoRevisionData, reason models.QADestroyReason) error {
 	var err error
-	err = m.lockingOperation(ctx, rd.Repo, rd.PullRequest, func(ctx context.Context) error {
+	err = m.lockingOperation(ctx, rd.Repo, rd.PullRequest, rd.EnvName, func(ctx context.Context) error {
 		return m.delete(ctx, rd, reason)
 	})
 	if nitroerrors.IsCancelledError(err) {
@@ -568,15 +663,38 @@ func (m *Manager) Delete(ctx context.Context, rd *models.RepoRevisionData, reaso
 		if err := m.DL.SetQAEnvironmentStatus(context.Background(), env.Name, models.Cancelled); err != nil {
 			m.log(ctx, "error persisting cancelled status after cancellation: %v", err)
 		}
+		m.DL.AddEvent(context.Background(), env.Name, "operation cancelled: "+err.Error())
 	}
+	m.processQueueAsync(ctx)
 	return err
 }
 
 var extantEnvsErr = errors.New("did not find exactly one extant environment")
 
+// revisionEnvs returns all environment records (of any status) for the repo and PR of rd, or the named environment record if rd is manual
+func (m *Manager) revisionEnvs(ctx context.Context, rd *models.RepoRevisionData) ([]models.QAEnvironment, error) {
+	if !rd.Manual() {
+		return m.DL.GetQAEnvironmentsByRepoAndPR(ctx, rd.Repo, rd.PullRequest)
+	}
+	env, err := m.DL.GetQAEnvironment(ctx, rd.EnvName)
+	if err != nil || env == nil {
+		return []models.QAEnvironment{}, err
+	}
+	return []models.QAEnvironment{*env}, nil
+}
+
 // getenv returns the extant environment for rd or error
 func (m *Manager) getenv(ctx context.Context, rd *models.RepoRevisionData) (*models.QAEnvironment, error) {
-	envs, err := m.DL.GetExtantQAEnvironments(ctx, rd.Repo, rd.PullRequest)
+	var envs []models.QAEnvironment
+	var err error
+	if rd.Manual() {
+		envs, err = m.revisionEnvs(ctx, rd)
+		if len(envs) == 1 && (envs[0].Status == models.Destroyed || envs[0].Status == models.Failure) {
+			envs = nil
+		}
+	} else {
+		envs, err = m.DL.GetExtantQAEnvironments(ctx, rd.Repo, rd.PullRequest)
+	}
 	if err != nil {
 		return nil, fmt.Errorf("error getting extant environments: %w", err)
 	}
@@ -601,7 +719,7 @@ func (m *Manager) delete(ctx context.Context, rd *models.RepoRevisionData, reaso
 		if err == extantEnvsErr {
 			// if there's no extant envs, set all associated with the repo & PR to status destroyed
 			m.log(ctx, "no extant envs for destroy request")
-			envs, err := m.DL.GetQAEnvironmentsByRepoAndPR(ctx, rd.Repo, rd.PullRequest)
+			envs, err := m.revisionEnvs(ctx, rd)
 			if err != nil {
 				return fmt.Errorf("error getting environments associated with the repo (%v) and PR (%v): %w", rd.Repo, rd.PullRequest, err)
 			}
@@ -643,6 +761,16 @@ func (m *Manager) delete(ctx context.Context, rd *models.RepoRevisionData, reaso
 		break
 	}
 	m.pushNotification(ctx, ne, notifier.DestroyEnvironment, "")
+	if env.Status == models.Queued {
+		// queued environments don't have any k8s resources yet
+		if _, err = m.DL.DequeueEnvironment(ctx, env.Name); err != nil {
+			return fmt.Errorf("error removing environment from queue: %w", err)
+		}
+		if err = m.DL.SetQAEnvironmentStatus(tracer.ContextWithSpan(context.Background(), span), env.Name, models.Destroyed); err != nil {
+			return fmt.Errorf("error setting environment status: %w", err)
+		}
+		return nil
+	}
 	k8senv, err := m.DL.GetK8sEnv(ctx, env.Name)
 	if err != nil {
 		return fmt.Errorf("error getting k8s environment: %w", err)
@@ -695,9 +823,11 @@ func (m *Manager) deleteNamespace(ctx context.Context, k8senv *models.Kubernetes
 func (m *Manager) Update(ctx context.Context, rd models.RepoRevisionData) (string, error) {
 	var err error
 	var name string
-	err = m.lockingOperation(ctx, rd.Repo, rd.PullRequest, func(ctx context.Context) error {
-		name, err = m.update(ctx, &rd)
-		return err
+	err = m.lockingOperation(ctx, rd.Repo, rd.PullRequest, rd.EnvName, func(ctx context.Context) error {
+		return m.withRetries(ctx, "update", rd.Repo, func(ctx context.Context) error {
+			name, err = m.update(ctx, &rd)
+			return err
+		})
 	})
 	if nitroerrors.IsCancelledError(err) {
 		env, envErr := m.getenv(context.Background(), &rd)
@@ -707,6 +837,7 @@ func (m *Manager) Update(ctx context.Context, rd models.RepoRevisionData) (strin
 		if err := m.DL.SetQAEnvironmentStatus(context.Background(), env.Name, models.Cancelled); err != nil {
 			m.log(ctx, "error persisting cancelled status after cancellation: %v", err)
 		}
+		m.DL.AddEvent(context.Background(), env.Name, "operation cancelled: "+err.Error())
 	}
 	return name, err
 }
@@ -728,12 +859,37 @@ func (m *Manager) update(ctx context.Context, rd *models.RepoRevisionData) (envn
 			m.MC.Increment(mpfx+"update_create", "triggering_repo:"+rd.Repo)
 			return m.create(ctx, rd)
 		}
-		eventlogger.GetLogger(ctx).SetCompletedStatus(models.FailedStatus)
-		return "", fmt.Errorf("error getting extant environment: %w", err)
+		err = fmt.Errorf("error getting extant environment: %w", err)
+		if !willRetry(ctx, err) {
+			eventlogger.GetLogger(ctx).SetCompletedStatus(models.FailedStatus)
+		}
+		return "", err
+	}
+	if env.Status == models.Queued {
+		// the environment hasn't been created yet, so requeue the create with the new revision (retaining its place in the queue)
+		m.log(ctx, "environment is queued, updating queued create")
+		return m.create(ctx, rd)
 	}
 	eventlogger.GetLogger(ctx).SetNewStatus(models.UpdateEvent, env.Name, *rd)
 	m.setloggername(ctx, env.Name)
 	ne := &newEnv{env: env}
+	// the update is rejected without changing the status of the environment, which is left as it was
+	admit := func() error {
+		if env.Status == models.Hibernated {
+			// the update wakes the environment
+			return m.admitWake(ctx, env)
+		}
+		return m.checkBuildingQuota(ctx, rd, env.Name)
+	}
+	if err := admit(); err != nil {
+		err = fmt.Errorf("error admitting update: %w", err)
+		if !willRetry(ctx, err) {
+			m.pushNotification(ctx, ne, notifier.Failure, err.Error())
+			m.setGithubCommitStatus(ctx, rd, ne, models.CommitStatusFailure, err.Error())
+			eventlogger.GetLogger(ctx).SetCompletedStatus(models.FailedStatus)
+		}
+		return "", err
+	}
 	ctx, cf := context.WithCancel(ctx)
 	defer cf()
 	go m.enforceTimeout(ctx, cf, ne)
@@ -742,6 +898,10 @@ func (m *Manager) update(ctx context.Context, rd *models.RepoRevisionData) (envn
 			if err := m.DL.SetQAEnvironmentStatus(tracer.ContextWithSpan(context.Background(), span), env.Name, models.Failure); err != nil {
 				m.log(ctx, "error setting environment status to failed: %v", err)
 			}
+			if willRetry(ctx, err) {
+				// the failure is reported if the final attempt fails
+				return
+			}
 			m.pushNotification(ctx, ne, notifier.Failure, err.Error())
 			m.setGithubCommitStatus(ctx, rd, ne, models.CommitStatusFailure, err.Error())
 			eventlogger.GetLogger(ctx).SetCompletedStatus(models.FailedStatus)
@@ -789,9 +949,16 @@ func (m *Manager) update(ctx context.Context, rd *models.RepoRevisionData) (envn
 	envinfo := &metahelm.EnvInfo{Env: env, RC: ne.rc}
 	var sig [32]byte
 	copy(sig[:], k8senv.ConfigSignature)
-	if ne.rc.ConfigSignature() == sig && env.Status == models.Success {
+	if ne.rc.ConfigSignature() == sig && (env.Status == models.Success || env.Status == models.Hibernated) {
 		m.log(ctx, "config signature matches previous successful environment: performing helm release upgrades")
 		m.MC.Increment(mpfx+"update_in_place", "triggering_repo:"+rd.Repo)
+		if env.Status == models.Hibernated {
+			// an update is activity, so wake the environment rather than upgrading workloads that are scaled to zero
+			m.log(ctx, "environment is hibernated: waking before upgrade")
+			if err := m.CI.WakeNamespace(ctx, k8senv); err != nil {
+				return "", fmt.Errorf("error waking hibernated environment: %w", err)
+			}
+		}
 		releases, err := m.DL.GetHelmReleasesForEnv(ctx, env.Name)
 		if err != nil {
 			return "", fmt.Errorf("error getting helm releases for env: %w", err)
@@ -802,7 +969,7 @@ func (m *Manager) update(ctx context.Context, rd *models.RepoRevisionData) (envn
 		}
 		envinfo.Releases = rsls
 		if err := m.CI.BuildAndUpgradeCharts(ctx, envinfo, k8senv, mcloc); err != nil {
-			return envinfo.Env.Name, fmt.Errorf("error upgrading charts: %w", nitroerrors.User(err))
+			return envinfo.Env.Name, fmt.Errorf("error upgrading charts: %w", err)
 		}
 		return envinfo.Env.Name, nil
 	}
@@ -814,7 +981,7 @@ func (m *Manager) update(ctx context.Context, rd *models.RepoRevisionData) (envn
 	chartSpan, ctx := tracer.StartSpanFromContext(ctx, "build_and_install_charts")
 	if err = m.CI.BuildAndInstallCharts(ctx, &metahelm.EnvInfo{Env: ne.env, RC: ne.rc}, mcloc); err != nil {
 		chartSpan.Finish(tracer.WithError(err))
-		return "", fmt.Errorf("error installing charts: %w", nitroerrors.User(err))
+		return "", fmt.Errorf("error installing charts: %w", err)
 	}
 	chartSpan.Finish()
 
@@ -83,7 +83,7 @@ func TestLockingOperation(t *testing.T) {
 	}
 
 	ctx := eventlogger.NewEventLoggerContext(context.Background(), el)
-	err = m.lockingOperation(ctx, repo, pr, preemptedFunc)
+	err = m.lockingOperation(ctx, repo, pr, "", preemptedFunc)
 	cancelled := nitroerrors.IsCancelledError(err)
 	if err == nil {
 		t.Fatalf("expected preemption error")
@@ -97,7 +97,7 @@ func TestLockingOperation(t *testing.T) {
 
 	pr++
 	ctx2 := eventlogger.NewEventLoggerContext(context.Background(), el)
-	err = m.lockingOperation(ctx2, repo, pr, longOpFunc)
+	err = m.lockingOperation(ctx2, repo, pr, "", longOpFunc)
 	if err == nil {
 		t.Fatalf("should have timed out")
 	}
@@ -107,7 +107,7 @@ func TestLockingOperation(t *testing.T) {
 
 	pr++
 	ctx3 := eventlogger.NewEventLoggerContext(context.Background(), el)
-	err = m.lockingOperation(ctx3, repo, pr, hangingOpFunc)
+	err = m.lockingOperation(ctx3, repo, pr, "", hangingOpFunc)
 	if err == nil {
 		t.Fatalf("expected error from lockingOperation due to hanging operation function")
 	}
@@ -1510,3 +1510,1517 @@ func TestCreateEnvStatusUnknown(t *testing.T) {
 		t.Fatalf("bad status: %v", env.Config.Status)
 	}
 }
+
+func TestHibernateAndWake(t *testing.T) {
+	dl := persistence.NewFakeDataLayer()
+	env := models.QAEnvironment{Name: "some-name", Repo: "foo/bar", PullRequest: 1, Status: models.Success}
+	dl.CreateQAEnvironment(context.Background(), &env)
+	dl.CreateK8sEnv(context.Background(), &models.KubernetesEnvironment{EnvName: env.Name, Namespace: "nitro-1234-some-name"})
+	plf, err := locker.NewFakePreemptiveLockerFactory(
+		[]locker.LockProviderOption{locker.WithLockTimeout(time.Second)},
+		locker.WithLockDelay(time.Millisecond),
+	)
+	if err != nil {
+		t.Fatalf("error creating new preemptive locker factory: %v", err)
+	}
+	m := Manager{
+		DL:  dl,
+		PLF: plf,
+		MC:  &metrics.FakeCollector{},
+		CI:  &metahelm.FakeInstaller{DL: dl, KC: k8sfake.NewSimpleClientset()},
+	}
+	el := &eventlogger.Logger{DL: dl}
+	el.Init([]byte{}, env.Repo, env.PullRequest)
+	ctx := eventlogger.NewEventLoggerContext(context.Background(), el)
+	status := func() models.EnvironmentStatus {
+		qa, _ := dl.GetQAEnvironment(context.Background(), env.Name)
+		return qa.Status
+	}
+	if err := m.Wake(ctx, env.Name); err == nil || !nitroerrors.IsUserError(err) {
+		t.Fatalf("wake of non-hibernated env should have failed with user error: %v", err)
+	}
+	if err := m.Hibernate(ctx, env.Name); err != nil {
+		t.Fatalf("hibernate should have succeeded: %v", err)
+	}
+	if s := status(); s != models.Hibernated {
+		t.Fatalf("expected status hibernated: %v", s)
+	}
+	if err := m.Hibernate(ctx, env.Name); err == nil || !nitroerrors.IsUserError(err) {
+		t.Fatalf("hibernate of hibernated env should have failed with user error: %v", err)
+	}
+	if err := m.Wake(ctx, env.Name); err != nil {
+		t.Fatalf("wake should have succeeded: %v", err)
+	}
+	if s := status(); s != models.Success {
+		t.Fatalf("expected status success: %v", s)
+	}
+	if err := m.Hibernate(ctx, "does-not-exist"); err == nil {
+		t.Fatalf("hibernate of missing env should have failed")
+	}
+}
+
+func TestExpiration(t *testing.T) {
+	dl := persistence.NewFakeDataLayer()
+	env := models.QAEnvironment{Name: "some-name", Repo: "foo/bar", PullRequest: 1, Status: models.Success}
+	dl.CreateQAEnvironment(context.Background(), &env)
+	nt := newNotificationTracker()
+	m := Manager{
+		DL:         dl,
+		MC:         &metrics.FakeCollector{},
+		DefaultTTL: 48 * time.Hour,
+		MG: &meta.FakeGetter{
+			GetFunc: func(ctx context.Context, rd models.RepoRevisionData) (*models.RepoConfig, error) {
+				return &models.RepoConfig{}, nil
+			},
+		},
+		RC: &ghclient.FakeRepoClient{
+			GetCommitMessageFunc: func(context.Context, string, string) (string, error) { return "", nil },
+		},
+		NF: nt.sender,
+	}
+	ctx := context.Background()
+	if _, err := m.ExtendExpiration(ctx, env.Name, time.Hour); err == nil || !nitroerrors.IsUserError(err) {
+		t.Fatalf("extending environment without expiration should have failed with user error: %v", err)
+	}
+
+	// acyl.yml ttl overrides the default
+	rd := env.RepoRevisionDataFromQA()
+	ne := &newEnv{env: &env, rc: &models.RepoConfig{TTL: "72h"}}
+	if err := m.setInitialExpiration(ctx, rd, ne); err != nil {
+		t.Fatalf("set initial expiration should have succeeded: %v", err)
+	}
+	qa, _ := dl.GetQAEnvironment(ctx, env.Name)
+	if qa.ExpiresAt == nil || time.Until(*qa.ExpiresAt) < 71*time.Hour {
+		t.Fatalf("bad expiration with acyl.yml ttl: %v", qa.ExpiresAt)
+	}
+	ne = &newEnv{env: &env, rc: &models.RepoConfig{}}
+	if err := m.setInitialExpiration(ctx, rd, ne); err != nil {
+		t.Fatalf("set initial expiration should have succeeded: %v", err)
+	}
+	qa, _ = dl.GetQAEnvironment(ctx, env.Name)
+	if qa.ExpiresAt == nil || time.Until(*qa.ExpiresAt) > 48*time.Hour {
+		t.Fatalf("bad expiration with default ttl: %v", qa.ExpiresAt)
+	}
+	prev := *qa.ExpiresAt
+
+	if err := m.WarnExpiration(ctx, env.Name); err != nil {
+		t.Fatalf("warn should have succeeded: %v", err)
+	}
+	qa, _ = dl.GetQAEnvironment(ctx, env.Name)
+	if !qa.ExpirationWarned {
+		t.Fatalf("expiration warned should have been set")
+	}
+	sent := nt.get()
+	if len(sent) != 1 || sent[0].Event != notifier.ExpirationWarning {
+		t.Fatalf("expected an expiration warning notification: %+v", sent)
+	}
+	if sent[0].Data.ExpiresAt == "" {
+		t.Fatalf("notification should include expiration")
+	}
+
+	exp, err := m.ExtendExpiration(ctx, env.Name, 24*time.Hour)
+	if err != nil {
+		t.Fatalf("extend should have succeeded: %v", err)
+	}
+	if !exp.Equal(prev.Add(24 * time.Hour)) {
+		t.Fatalf("expected expiration to be extended from the previous expiration: %v (previous: %v)", exp, prev)
+	}
+	qa, _ = dl.GetQAEnvironment(ctx, env.Name)
+	if qa.ExpirationWarned {
+		t.Fatalf("expiration warned should have been reset by extension")
+	}
+	if _, err := m.ExtendExpiration(ctx, env.Name, -time.Hour); err == nil {
+		t.Fatalf("negative extension should have failed")
+	}
+}
+
+func TestPin(t *testing.T) {
+	dl := persistence.NewFakeDataLayer()
+	for _, name := range []string{"env-1", "env-2", "env-3"} {
+		dl.CreateQAEnvironment(context.Background(), &models.QAEnvironment{Name: name, Repo: "foo/bar", Status: models.Success})
+	}
+	dl.CreateQAEnvironment(context.Background(), &models.QAEnvironment{Name: "env-other", Repo: "foo/other", Status: models.Success})
+	m := Manager{DL: dl, MC: &metrics.FakeCollector{}, MaxPinnedPerRepo: 2}
+	ctx := context.Background()
+	until := time.Now().UTC().Add(time.Hour)
+	if err := m.Pin(ctx, "env-1", "demo", nil); err != nil {
+		t.Fatalf("pin should have succeeded: %v", err)
+	}
+	if err := m.Pin(ctx, "env-2", "", &until); err != nil {
+		t.Fatalf("pin should have succeeded: %v", err)
+	}
+	// re-pinning an already pinned env doesn't count against the limit
+	if err := m.Pin(ctx, "env-1", "release candidate", nil); err != nil {
+		t.Fatalf("re-pin should have succeeded: %v", err)
+	}
+	if err := m.Pin(ctx, "env-3", "", nil); err == nil || !nitroerrors.IsUserError(err) {
+		t.Fatalf("pin exceeding the per-repo limit should have failed with user error: %v", err)
+	}
+	if err := m.Pin(ctx, "env-other", "", nil); err != nil {
+		t.Fatalf("pin in another repo should have succeeded: %v", err)
+	}
+	past := time.Now().UTC().Add(-time.Hour)
+	if err := m.Pin(ctx, "env-3", "", &past); err == nil {
+		t.Fatalf("pin with expiration in the past should have failed")
+	}
+	qa, _ := dl.GetQAEnvironment(ctx, "env-1")
+	if !qa.IsPinned(time.Now().UTC()) || qa.PinReason != "release candidate" {
+		t.Fatalf("env-1 should be pinned with updated reason: %+v", qa)
+	}
+	qa, _ = dl.GetQAEnvironment(ctx, "env-2")
+	if !qa.IsPinned(time.Now().UTC()) || qa.IsPinned(until.Add(time.Second)) {
+		t.Fatalf("env-2 should be pinned until %v: %v", until, qa.PinnedUntil)
+	}
+	if err := m.Unpin(ctx, "env-1"); err != nil {
+		t.Fatalf("unpin should have succeeded: %v", err)
+	}
+	qa, _ = dl.GetQAEnvironment(ctx, "env-1")
+	if qa.Pinned || qa.PinReason != "" {
+		t.Fatalf("env-1 should be unpinned: %+v", qa)
+	}
+	if err := m.Pin(ctx, "env-3", "", nil); err != nil {
+		t.Fatalf("pin should have succeeded after unpin: %v", err)
+	}
+}
+
+func TestEnforceGlobalLimitSkipsPinned(t *testing.T) {
+	dl := persistence.NewFakeDataLayer()
+	now := time.Now().UTC()
+	for i, name := range []string{"oldest-pinned", "older", "newer"} {
+		dl.CreateQAEnvironment(context.Background(), &models.QAEnvironment{
+			Created:     now.Add(time.Duration(i) * time.Minute),
+			Name:        name,
+			Repo:        "foo/bar",
+			PullRequest: uint(i + 1),
+			Status:      models.Success,
+		})
+		dl.CreateK8sEnv(context.Background(), &models.KubernetesEnvironment{EnvName: name})
+	}
+	dl.SetQAEnvironmentPin(context.Background(), "oldest-pinned", true, "demo", nil)
+	plf, err := locker.NewFakePreemptiveLockerFactory(
+		[]locker.LockProviderOption{locker.WithLockTimeout(time.Second)},
+		locker.WithLockDelay(time.Millisecond),
+	)
+	if err != nil {
+		t.Fatalf("error creating new preemptive locker factory: %v", err)
+	}
+	m := Manager{
+		DL:  dl,
+		PLF: plf,
+		NF:  testNF,
+		MC:  &metrics.FakeCollector{},
+		MG: &meta.FakeGetter{
+			GetFunc: func(ctx context.Context, rd models.RepoRevisionData) (*models.RepoConfig, error) {
+				return &models.RepoConfig{}, nil
+			},
+		},
+		RC: &ghclient.FakeRepoClient{
+			GetCommitMessageFunc: func(context.Context, string, string) (string, error) { return "", nil },
+		},
+		CI:          &metahelm.FakeInstaller{DL: dl},
+		GlobalLimit: 1,
+	}
+	el := &eventlogger.Logger{DL: dl}
+	el.Init([]byte{}, "foo/bar", 1)
+	ctx := eventlogger.NewEventLoggerContext(context.Background(), el)
+	if err := m.enforceGlobalLimit(ctx); err != nil {
+		t.Fatalf("should have succeeded: %v", err)
+	}
+	time.Sleep(10 * time.Millisecond) // give time for async delete to complete
+	for name, status := range map[string]models.EnvironmentStatus{"oldest-pinned": models.Success, "older": models.Destroyed, "newer": models.Success} {
+		qa, _ := dl.GetQAEnvironment(context.Background(), name)
+		if qa.Status != status {
+			t.Errorf("%v: expected status %v, got %v", name, status, qa.Status)
+		}
+	}
+}
+
+func TestAdmitWake(t *testing.T) {
+	dl := persistence.NewFakeDataLayer()
+	now := time.Now().UTC()
+	for i, name := range []string{"hibernated", "older", "newer"} {
+		status := models.Success
+		if name == "hibernated" {
+			status = models.Hibernated
+		}
+		dl.CreateQAEnvironment(context.Background(), &models.QAEnvironment{
+			Created:     now.Add(time.Duration(i) * time.Minute),
+			Name:        name,
+			Repo:        "foo/bar",
+			PullRequest: uint(i + 1),
+			User:        "alice",
+			Status:      status,
+		})
+		dl.CreateK8sEnv(context.Background(), &models.KubernetesEnvironment{EnvName: name})
+	}
+	plf, err := locker.NewFakePreemptiveLockerFactory(
+		[]locker.LockProviderOption{locker.WithLockTimeout(time.Second)},
+		locker.WithLockDelay(time.Millisecond),
+	)
+	if err != nil {
+		t.Fatalf("error creating new preemptive locker factory: %v", err)
+	}
+	m := Manager{
+		DL:  dl,
+		PLF: plf,
+		NF:  testNF,
+		MC:  &metrics.FakeCollector{},
+		MG: &meta.FakeGetter{
+			GetFunc: func(ctx context.Context, rd models.RepoRevisionData) (*models.RepoConfig, error) {
+				return &models.RepoConfig{}, nil
+			},
+		},
+		RC: &ghclient.FakeRepoClient{
+			GetCommitMessageFunc: func(context.Context, string, string) (string, error) { return "", nil },
+		},
+		CI:                &metahelm.FakeInstaller{DL: dl},
+		GlobalLimit:       2,
+		GlobalLimitPolicy: QueuePolicy,
+		Quotas:            models.Quotas{Users: map[string]models.Quota{"alice": {MaxRunning: 2}}},
+	}
+	el := &eventlogger.Logger{DL: dl}
+	el.Init([]byte{}, "foo/bar", 1)
+	ctx := eventlogger.NewEventLoggerContext(context.Background(), el)
+	hibernated, _ := dl.GetQAEnvironment(ctx, "hibernated")
+	status := func(name string) models.EnvironmentStatus {
+		qa, _ := dl.GetQAEnvironment(context.Background(), name)
+		return qa.Status
+	}
+
+	// wakes aren't queued, so without capacity the wake is rejected
+	if err := m.admitWake(ctx, hibernated); err == nil || !nitroerrors.IsUserError(err) {
+		t.Fatalf("wake at the global limit should have been rejected with user error: %v", err)
+	}
+	m.GlobalLimit = 3
+	if err := m.admitWake(ctx, hibernated); err == nil || !nitroerrors.IsUserError(err) || !strings.Contains(err.Error(), "quota") {
+		t.Fatalf("wake over quota should have been rejected with user error: %v", err)
+	}
+	m.Quotas = models.Quotas{}
+	dl.EnqueueEnvironment(ctx, &models.QueuedEnvironment{EnvName: "queued", Enqueued: now, RepoRevisionData: models.RepoRevisionData{Repo: "foo/other", PullRequest: 1}})
+	if err := m.admitWake(ctx, hibernated); err == nil || !nitroerrors.IsUserError(err) {
+		t.Fatalf("wake should not have jumped the create queue: %v", err)
+	}
+	dl.DequeueEnvironment(ctx, "queued")
+	if err := m.admitWake(ctx, hibernated); err != nil {
+		t.Fatalf("wake with capacity should have been admitted: %v", err)
+	}
+
+	// with the evict policy, the oldest environment is destroyed to make room
+	m.GlobalLimit = 2
+	m.GlobalLimitPolicy = EvictOldestPolicy
+	if err := m.admitWake(ctx, hibernated); err != nil {
+		t.Fatalf("wake should have been admitted: %v", err)
+	}
+	time.Sleep(10 * time.Millisecond) // give time for async delete to complete
+	for name, s := range map[string]models.EnvironmentStatus{"hibernated": models.Hibernated, "older": models.Destroyed, "newer": models.Success} {
+		if st := status(name); st != s {
+			t.Errorf("%v: expected status %v, got %v", name, s, st)
+		}
+	}
+	m.Quotas = models.Quotas{Repos: map[string]models.Quota{"foo/bar": {MaxRunning: 1}}}
+	if err := m.admitWake(ctx, hibernated); err == nil || !nitroerrors.IsUserError(err) {
+		t.Fatalf("wake over quota should have been rejected with user error: %v", err)
+	}
+}
+
+func TestParseQueuePriorities(t *testing.T) {
+	qp, err := ParseQueuePriorities([]string{"repo:foo/bar=5", "label:urgent=10", "user:alice=-1", "label:a=b=2"})
+	if err != nil {
+		t.Fatalf("should have succeeded: %v", err)
+	}
+	cases := []struct {
+		name   string
+		rd     models.RepoRevisionData
+		labels []string
+		want   int
+	}{
+		{"no match", models.RepoRevisionData{Repo: "foo/other", User: "bob"}, nil, 0},
+		{"repo", models.RepoRevisionData{Repo: "foo/bar", User: "bob"}, nil, 5},
+		{"negative user", models.RepoRevisionData{Repo: "foo/other", User: "alice"}, nil, -1},
+		{"highest wins", models.RepoRevisionData{Repo: "foo/bar", User: "alice"}, []string{"urgent"}, 10},
+		{"label containing equals", models.RepoRevisionData{Repo: "foo/other"}, []string{"a=b"}, 2},
+	}
+	for _, c := range cases {
+		if p := qp.priority(&c.rd, c.labels); p != c.want {
+			t.Errorf("%v: expected %v, got %v", c.name, c.want, p)
+		}
+	}
+	for _, bad := range []string{"repo:foo/bar", "label:urgent=high", "team:foo=1", "repo:=1"} {
+		if _, err := ParseQueuePriorities([]string{bad}); err == nil {
+			t.Errorf("%v: should have failed", bad)
+		}
+	}
+}
+
+func TestQueue(t *testing.T) {
+	dl := persistence.NewFakeDataLayer()
+	ctx := context.Background()
+	dl.CreateQAEnvironment(ctx, &models.QAEnvironment{Name: "running", Repo: "foo/bar", PullRequest: 1, Status: models.Success})
+	var csmtx sync.Mutex
+	commitStatuses := map[string]*ghclient.CommitStatus{}
+	frc := &ghclient.FakeRepoClient{
+		GetCommitMessageFunc: func(context.Context, string, string) (string, error) { return "", nil },
+		SetStatusFunc: func(ctx context.Context, repo string, sha string, cs *ghclient.CommitStatus) error {
+			csmtx.Lock()
+			defer csmtx.Unlock()
+			commitStatuses[sha] = cs
+			return nil
+		},
+		GetPRLabelsFunc: func(ctx context.Context, repo string, pr uint) ([]string, error) {
+			if pr == 3 {
+				return []string{"urgent"}, nil
+			}
+			return []string{}, nil
+		},
+	}
+	getCommitStatus := func(sha string) ghclient.CommitStatus {
+		csmtx.Lock()
+		defer csmtx.Unlock()
+		if cs := commitStatuses[sha]; cs != nil {
+			return *cs
+		}
+		return ghclient.CommitStatus{}
+	}
+	qp, err := ParseQueuePriorities([]string{"label:urgent=10"})
+	if err != nil {
+		t.Fatalf("error parsing queue priorities: %v", err)
+	}
+	nt := newNotificationTracker()
+	m := Manager{
+		DL:                dl,
+		MC:                &metrics.FakeCollector{},
+		RC:                frc,
+		NF:                nt.sender,
+		GlobalLimit:       1,
+		GlobalLimitPolicy: QueuePolicy,
+		QueuePriorities:   qp,
+	}
+	queue := func(name string, pr uint) uint {
+		rd := models.RepoRevisionData{Repo: "foo/bar", PullRequest: pr, SourceSHA: name}
+		env := &models.QAEnvironment{Name: name, Repo: rd.Repo, PullRequest: pr, SourceSHA: rd.SourceSHA, Status: models.Spawned}
+		dl.CreateQAEnvironment(ctx, env)
+		pos, err := m.queueIfAtLimit(ctx, &rd, &newEnv{env: env, rc: &models.RepoConfig{}})
+		if err != nil {
+			t.Fatalf("queue should have succeeded: %v", err)
+		}
+		return pos
+	}
+	if pos := queue("queued", 2); pos != 1 {
+		t.Fatalf("expected queue position 1, got %v", pos)
+	}
+	if cs := getCommitStatus("queued"); cs.Status != "pending" || !strings.Contains(cs.Description, "position 1") {
+		t.Fatalf("bad commit status: %+v", cs)
+	}
+	// higher priority creates jump ahead in the queue
+	if pos := queue("queued-urgent", 3); pos != 1 {
+		t.Fatalf("expected urgent queue position 1, got %v", pos)
+	}
+	if cs := getCommitStatus("queued"); !strings.Contains(cs.Description, "position 2") {
+		t.Fatalf("queue position should have been refreshed: %+v", cs)
+	}
+	for _, name := range []string{"queued", "queued-urgent"} {
+		if qa, _ := dl.GetQAEnvironment(ctx, name); qa.Status != models.Queued {
+			t.Fatalf("%v: expected status queued: %v", name, qa.Status)
+		}
+	}
+	if sent := nt.get(); len(sent) != 2 || sent[0].Event != notifier.EnvironmentQueued || sent[1].Data.QueuePosition != 1 {
+		t.Fatalf("expected two queued notifications: %+v", sent)
+	}
+
+	// no capacity yet
+	if err := m.ProcessQueue(ctx); err != nil {
+		t.Fatalf("process queue should have succeeded: %v", err)
+	}
+	if queued, _ := dl.GetQueuedEnvironments(ctx); len(queued) != 2 {
+		t.Fatalf("nothing should have been dequeued: %+v", queued)
+	}
+
+	dl.SetQAEnvironmentStatus(ctx, "running", models.Destroyed)
+	plf, err := locker.NewFakePreemptiveLockerFactory([]locker.LockProviderOption{locker.WithLockTimeout(time.Second)})
+	if err != nil {
+		t.Fatalf("error creating new preemptive locker factory: %v", err)
+	}
+	// block the started create so it doesn't free capacity by failing
+	release := make(chan struct{})
+	defer close(release)
+	m.PLF = plf
+	m.MG = &meta.FakeGetter{
+		GetFunc: func(ctx context.Context, rd models.RepoRevisionData) (*models.RepoConfig, error) {
+			<-release
+			return nil, errors.New("released")
+		},
+	}
+	if err := m.ProcessQueue(ctx); err != nil {
+		t.Fatalf("process queue should have succeeded: %v", err)
+	}
+	queued, _ := dl.GetQueuedEnvironments(ctx)
+	if len(queued) != 1 || queued[0].EnvName != "queued" {
+		t.Fatalf("only the urgent env should have been dequeued: %+v", queued)
+	}
+	if qa, _ := dl.GetQAEnvironment(ctx, "queued-urgent"); qa.Status != models.Spawned {
+		t.Fatalf("dequeued env should be spawned: %v", qa.Status)
+	}
+	if cs := getCommitStatus("queued"); !strings.Contains(cs.Description, "position 1") {
+		t.Fatalf("queue position should have been refreshed after dequeue: %+v", cs)
+	}
+}
+
+func TestProcessQueueDurable(t *testing.T) {
+	dl := persistence.NewFakeDataLayer()
+	ctx := context.Background()
+	rd := models.RepoRevisionData{Repo: "foo/bar", PullRequest: 1, SourceSHA: "asdf"}
+	eventID := uuid.New()
+	dl.CreateQAEnvironment(ctx, &models.QAEnvironment{Name: "queued", Repo: rd.Repo, PullRequest: rd.PullRequest, Status: models.Queued})
+	dl.EnqueueEnvironment(ctx, &models.QueuedEnvironment{EnvName: "queued", Enqueued: time.Now().UTC(), RepoRevisionData: rd, EventID: eventID, InstallationID: 123})
+	m := Manager{
+		DL:                dl,
+		MC:                &metrics.FakeCollector{},
+		GlobalLimit:       1,
+		GlobalLimitPolicy: QueuePolicy,
+		DurableQueue:      true,
+	}
+	if err := m.ProcessQueue(ctx); err != nil {
+		t.Fatalf("process queue should have succeeded: %v", err)
+	}
+	if queued, _ := dl.GetQueuedEnvironments(ctx); len(queued) != 0 {
+		t.Fatalf("queue should be empty: %+v", queued)
+	}
+	if qa, _ := dl.GetQAEnvironment(ctx, "queued"); qa.Status != models.Spawned {
+		t.Fatalf("dequeued env should be spawned: %v", qa.Status)
+	}
+	ops, err := dl.GetOperations(ctx, models.OperationPending)
+	if err != nil || len(ops) != 1 {
+		t.Fatalf("expected a pending operation: %v: %v", len(ops), err)
+	}
+	op := ops[0]
+	if op.Action != models.CreateOperationAction || !op.Params.QueueAdmitted || op.EventID != eventID || op.InstallationID != 123 || op.RepoRevisionData.Repo != rd.Repo {
+		t.Fatalf("bad operation: %+v", op)
+	}
+}
+
+func TestDeleteQueued(t *testing.T) {
+	dl := persistence.NewFakeDataLayer()
+	ctx := context.Background()
+	rd := models.RepoRevisionData{Repo: "foo/bar", PullRequest: 1, SourceSHA: "asdf"}
+	dl.CreateQAEnvironment(ctx, &models.QAEnvironment{Name: "queued", Repo: rd.Repo, PullRequest: rd.PullRequest, Status: models.Queued})
+	dl.EnqueueEnvironment(ctx, &models.QueuedEnvironment{EnvName: "queued", Enqueued: time.Now().UTC(), RepoRevisionData: rd})
+	plf, err := locker.NewFakePreemptiveLockerFactory([]locker.LockProviderOption{locker.WithLockTimeout(time.Second)})
+	if err != nil {
+		t.Fatalf("error creating new preemptive locker factory: %v", err)
+	}
+	m := Manager{
+		DL:  dl,
+		PLF: plf,
+		NF:  testNF,
+		MC:  &metrics.FakeCollector{},
+		MG: &meta.FakeGetter{
+			GetFunc: func(ctx context.Context, rd models.RepoRevisionData) (*models.RepoConfig, error) {
+				return &models.RepoConfig{}, nil
+			},
+		},
+		RC: &ghclient.FakeRepoClient{
+			GetCommitMessageFunc: func(context.Context, string, string) (string, error) { return "", nil },
+		},
+		GlobalLimit:       1,
+		GlobalLimitPolicy: QueuePolicy,
+	}
+	if err := m.Delete(ctx, &rd, models.DestroyApiRequest); err != nil {
+		t.Fatalf("delete should have succeeded: %v", err)
+	}
+	if qa, _ := dl.GetQAEnvironment(ctx, "queued"); qa.Status != models.Destroyed {
+		t.Fatalf("expected status destroyed: %v", qa.Status)
+	}
+	if queued, _ := dl.GetQueuedEnvironments(ctx); len(queued) != 0 {
+		t.Fatalf("queue should be empty: %+v", queued)
+	}
+}
+
+func TestQuotas(t *testing.T) {
+	dl := persistence.NewFakeDataLayer()
+	ctx := context.Background()
+	dl.CreateQAEnvironment(ctx, &models.QAEnvironment{Name: "running", Repo: "foo/bar", PullRequest: 1, User: "alice", Status: models.Success})
+	m := Manager{
+		DL: dl,
+		MC: &metrics.FakeCollector{},
+		NF: testNF,
+		RC: &ghclient.FakeRepoClient{
+			GetCommitMessageFunc: func(context.Context, string, string) (string, error) { return "", nil },
+			SetStatusFunc:        func(context.Context, string, string, *ghclient.CommitStatus) error { return nil },
+		},
+		Quotas: models.Quotas{
+			Repos: map[string]models.Quota{"foo/bar": {MaxRunning: 1}},
+			Users: map[string]models.Quota{"bob": {MaxBuilding: 1}},
+		},
+	}
+	if err := m.checkQuotas(ctx, &models.RepoRevisionData{Repo: "foo/bar", PullRequest: 2}, "new"); err == nil || !nitroerrors.IsUserError(err) {
+		t.Fatalf("expected repo quota user error: %v", err)
+	}
+	if err := m.checkQuotas(ctx, &models.RepoRevisionData{Repo: "foo/bar", PullRequest: 1}, "running"); err != nil {
+		t.Fatalf("the environment itself shouldn't count against the quota: %v", err)
+	}
+	if err := m.checkQuotas(ctx, &models.RepoRevisionData{Repo: "foo/other", PullRequest: 1, User: "bob"}, "new"); err != nil {
+		t.Fatalf("other repo should be under quota: %v", err)
+	}
+	dl.CreateQAEnvironment(ctx, &models.QAEnvironment{Name: "building", Repo: "foo/baz", PullRequest: 1, User: "bob", Status: models.Spawned})
+	if err := m.checkQuotas(ctx, &models.RepoRevisionData{Repo: "foo/other", PullRequest: 1, User: "bob"}, "new"); err == nil {
+		t.Fatalf("expected user build quota error")
+	}
+	// updates of running environments are only limited by the building quota
+	if err := m.checkBuildingQuota(ctx, &models.RepoRevisionData{Repo: "foo/bar", PullRequest: 1, User: "alice"}, "running"); err != nil {
+		t.Fatalf("update should not be limited by the running quota: %v", err)
+	}
+	if err := m.checkBuildingQuota(ctx, &models.RepoRevisionData{Repo: "foo/other", PullRequest: 1, User: "bob"}, "other"); err == nil || !nitroerrors.IsUserError(err) {
+		t.Fatalf("expected user build quota error for update: %v", err)
+	}
+	if err := m.checkBuildingQuota(ctx, &models.RepoRevisionData{Repo: "foo/baz", PullRequest: 1, User: "bob"}, "building"); err != nil {
+		t.Fatalf("the environment itself shouldn't count against the building quota: %v", err)
+	}
+
+	// with the queue policy, creates over quota are queued without blocking creates that are under quota
+	m.GlobalLimitPolicy = QueuePolicy
+	queue := func(name, repo string) uint {
+		rd := models.RepoRevisionData{Repo: repo, PullRequest: 10, SourceSHA: name}
+		env := &models.QAEnvironment{Name: name, Repo: rd.Repo, PullRequest: rd.PullRequest, SourceSHA: rd.SourceSHA, Status: models.Spawned}
+		dl.CreateQAEnvironment(ctx, env)
+		pos, err := m.queueIfAtLimit(ctx, &rd, &newEnv{env: env, rc: &models.RepoConfig{}})
+		if err != nil {
+			t.Fatalf("queue should have succeeded: %v", err)
+		}
+		return pos
+	}
+	if pos := queue("over-quota", "foo/bar"); pos != 1 {
+		t.Fatalf("expected queue position 1, got %v", pos)
+	}
+	if pos := queue("under-quota", "foo/other"); pos != 0 {
+		t.Fatalf("create under quota should not have been queued: %v", pos)
+	}
+	if err := m.ProcessQueue(ctx); err != nil {
+		t.Fatalf("process queue should have succeeded: %v", err)
+	}
+	if queued, _ := dl.GetQueuedEnvironments(ctx); len(queued) != 1 || queued[0].EnvName != "over-quota" {
+		t.Fatalf("over quota env should remain queued: %+v", queued)
+	}
+}
+
+func TestTeamQuotas(t *testing.T) {
+	dl := persistence.NewFakeDataLayer()
+	ctx := context.Background()
+	dl.CreateQAEnvironment(ctx, &models.QAEnvironment{Name: "alice-env", Repo: "foo/bar", PullRequest: 1, User: "alice", Status: models.Success})
+	var lookups int
+	members := []string{"alice", "bob"}
+	m := Manager{
+		DL: dl,
+		MC: &metrics.FakeCollector{},
+		RC: &ghclient.FakeRepoClient{
+			GetTeamMembersFunc: func(ctx context.Context, team string) ([]string, error) {
+				lookups++
+				if team != "foo/backend" {
+					return nil, fmt.Errorf("unknown team: %v", team)
+				}
+				return members, nil
+			},
+		},
+		Quotas: models.Quotas{
+			Teams: map[string]models.Quota{"foo/backend": {MaxRunning: 1}},
+		},
+	}
+	if err := m.checkQuotas(ctx, &models.RepoRevisionData{Repo: "foo/other", PullRequest: 1, User: "bob"}, "new"); err == nil || !nitroerrors.IsUserError(err) || !strings.Contains(err.Error(), "team foo/backend") {
+		t.Fatalf("expected team quota user error for a team member: %v", err)
+	}
+	if err := m.checkQuotas(ctx, &models.RepoRevisionData{Repo: "foo/other", PullRequest: 1, User: "carol"}, "new"); err != nil {
+		t.Fatalf("team quota should not apply to non-members: %v", err)
+	}
+	if lookups != 1 {
+		t.Fatalf("team members should have been cached: %v lookups", lookups)
+	}
+	// membership changes are picked up once the cache expires
+	members = []string{"alice"}
+	m.teamsFetched = time.Now().Add(-teamMembersTTL)
+	if err := m.checkQuotas(ctx, &models.RepoRevisionData{Repo: "foo/other", PullRequest: 1, User: "bob"}, "new"); err != nil {
+		t.Fatalf("team quota should not apply to former members: %v", err)
+	}
+	// failing to resolve team members is a system error, so the operation can be retried
+	m.Quotas.Teams["foo/unknown"] = models.Quota{MaxRunning: 1}
+	m.teams = nil
+	if err := m.checkQuotas(ctx, &models.RepoRevisionData{Repo: "foo/other", PullRequest: 1, User: "bob"}, "new"); err == nil || nitroerrors.IsUserError(err) {
+		t.Fatalf("expected system error resolving team members: %v", err)
+	}
+}
+
+func TestManualEnvironment(t *testing.T) {
+	dl := persistence.NewFakeDataLayer()
+	ctx := context.Background()
+	plf, err := locker.NewFakePreemptiveLockerFactory([]locker.LockProviderOption{locker.WithLockTimeout(time.Second)})
+	if err != nil {
+		t.Fatalf("error creating new preemptive locker factory: %v", err)
+	}
+	m := Manager{
+		DL:  dl,
+		MC:  &metrics.FakeCollector{},
+		NG:  &namegen.FakeNameGenerator{Unique: true},
+		PLF: plf,
+		RC: &ghclient.FakeRepoClient{
+			GetBranchFunc: func(ctx context.Context, repo, branch string) (ghclient.BranchInfo, error) {
+				if (repo == "foo/bar" && branch == "feature") || (repo == "foo/dep" && branch == "fix") {
+					return ghclient.BranchInfo{Name: branch, SHA: repo + "-sha"}, nil
+				}
+				return ghclient.BranchInfo{}, errors.New("404 Not Found")
+			},
+		},
+		ManualTTL: 72 * time.Hour,
+	}
+	for _, rd := range []models.RepoRevisionData{
+		{Repo: "foo/bar", User: "alice"},
+		{Repo: "foo/bar", SourceBranch: "missing", User: "alice"},
+		{Repo: "foo/bar", SourceBranch: "feature", User: "alice", RefOverrides: map[string]string{"foo/dep": "missing"}},
+		{Repo: "foo/bar", SourceBranch: "feature"},
+	} {
+		if err := m.PrepareManual(ctx, &rd); err == nil || !nitroerrors.IsUserError(err) {
+			t.Fatalf("expected user error for %+v: %v", rd, err)
+		}
+	}
+	prepare := func(ttl time.Duration) *models.RepoRevisionData {
+		rd := &models.RepoRevisionData{Repo: "foo/bar", SourceBranch: "feature", User: "alice", RefOverrides: map[string]string{"foo/dep": "fix"}, TTL: ttl}
+		if err := m.PrepareManual(ctx, rd); err != nil {
+			t.Fatalf("prepare should have succeeded: %v", err)
+		}
+		if !rd.Manual() || rd.SourceSHA != "foo/bar-sha" {
+			t.Fatalf("bad manual revision data: %+v", rd)
+		}
+		return rd
+	}
+	rd1, rd2 := prepare(0), prepare(time.Hour)
+	if rd1.EnvName == rd2.EnvName {
+		t.Fatalf("manual environments should have unique names: %v", rd1.EnvName)
+	}
+
+	// manual environments for the same repo get separate records
+	env1, err := m.generateNewEnv(ctx, rd1)
+	if err != nil {
+		t.Fatalf("generate should have succeeded: %v", err)
+	}
+	env2, err := m.generateNewEnv(ctx, rd2)
+	if err != nil {
+		t.Fatalf("generate should have succeeded: %v", err)
+	}
+	if env1.Name != rd1.EnvName || env2.Name != rd2.EnvName || env1.PullRequest != 0 {
+		t.Fatalf("bad environments: %+v, %+v", env1, env2)
+	}
+	if env, err := m.getenv(ctx, rd2); err != nil || env.Name != env2.Name {
+		t.Fatalf("getenv should have returned the named environment: %v: %v", env, err)
+	}
+
+	// manual environments always expire
+	for _, c := range []struct {
+		rd  *models.RepoRevisionData
+		env *models.QAEnvironment
+		ttl time.Duration
+	}{{rd1, env1, 72 * time.Hour}, {rd2, env2, time.Hour}} {
+		if err := m.setInitialExpiration(ctx, c.rd, &newEnv{env: c.env, rc: &models.RepoConfig{}}); err != nil {
+			t.Fatalf("set initial expiration should have succeeded: %v", err)
+		}
+		if d := time.Until(*c.env.ExpiresAt); d > c.ttl || d < c.ttl-time.Minute {
+			t.Fatalf("bad expiration for %v: %v (expected ttl %v)", c.env.Name, c.env.ExpiresAt, c.ttl)
+		}
+	}
+
+	// deleting one manual environment doesn't affect others for the same repo
+	dl.SetQAEnvironmentStatus(ctx, env1.Name, models.Failure)
+	if err := m.Delete(ctx, rd1, models.DestroyApiRequest); err != nil {
+		t.Fatalf("delete should have succeeded: %v", err)
+	}
+	if qa, _ := dl.GetQAEnvironment(ctx, env1.Name); qa.Status != models.Destroyed {
+		t.Fatalf("expected destroyed: %v", qa.Status)
+	}
+	if qa, _ := dl.GetQAEnvironment(ctx, env2.Name); qa.Status != models.Spawned {
+		t.Fatalf("other manual environment should be unaffected: %v", qa.Status)
+	}
+}
+
+func TestCloneEnvironment(t *testing.T) {
+	dl := persistence.NewFakeDataLayer()
+	ctx := context.Background()
+	m := Manager{
+		DL: dl,
+		MC: &metrics.FakeCollector{},
+		NG: &namegen.FakeNameGenerator{Unique: true},
+		RC: &ghclient.FakeRepoClient{
+			GetBranchFunc: func(ctx context.Context, repo, branch string) (ghclient.BranchInfo, error) {
+				if branch == "feature" {
+					return ghclient.BranchInfo{Name: branch, SHA: repo + "-feature-sha"}, nil
+				}
+				return ghclient.BranchInfo{}, errors.New("404 Not Found")
+			},
+		},
+	}
+	source := &models.QAEnvironment{
+		Name:         "source-env",
+		User:         "bob",
+		Repo:         "foo/bar",
+		PullRequest:  5,
+		SourceSHA:    "aaa",
+		BaseSHA:      "bbb",
+		SourceBranch: "bob-feature",
+		BaseBranch:   "master",
+		Status:       models.Success,
+		RefMap:       models.RefMap{"foo/bar": "bob-feature", "foo/backend": "bob-feature", "foo/db": "master"},
+		CommitSHAMap: models.RefMap{"foo/bar": "aaa", "foo/backend": "ccc", "foo/db": "ddd"},
+	}
+	dl.CreateQAEnvironment(ctx, source)
+	dl.CreateQAEnvironment(ctx, &models.QAEnvironment{Name: "new-env", Repo: "foo/bar", PullRequest: 6})
+	for _, c := range []struct {
+		source string
+		rd     models.RepoRevisionData
+	}{
+		{"missing-env", models.RepoRevisionData{User: "alice"}},
+		{"new-env", models.RepoRevisionData{User: "alice"}},
+		{"source-env", models.RepoRevisionData{}},
+		{"source-env", models.RepoRevisionData{User: "alice", RefOverrides: map[string]string{"foo/other": "feature"}}},
+		{"source-env", models.RepoRevisionData{User: "alice", RefOverrides: map[string]string{"foo/backend": "missing"}}},
+	} {
+		if err := m.PrepareClone(ctx, c.source, &c.rd); err == nil || !nitroerrors.IsUserError(err) {
+			t.Fatalf("expected user error for %v: %+v: %v", c.source, c.rd, err)
+		}
+	}
+
+	// exact clone
+	rd := &models.RepoRevisionData{User: "alice"}
+	if err := m.PrepareClone(ctx, "source-env", rd); err != nil {
+		t.Fatalf("prepare should have succeeded: %v", err)
+	}
+	if !rd.Manual() || rd.CloneOf != "source-env" || rd.EnvName == "source-env" || rd.User != "alice" {
+		t.Fatalf("bad clone revision data: %+v", rd)
+	}
+	if rd.Repo != "foo/bar" || rd.SourceSHA != "aaa" || rd.SourceBranch != "bob-feature" || rd.BaseBranch != "master" {
+		t.Fatalf("bad clone triggering repo: %+v", rd)
+	}
+	if !cmp.Equal(rd.RefOverrides, map[string]string{"foo/backend": "bob-feature", "foo/db": "master"}) {
+		t.Fatalf("bad ref overrides: %v", rd.RefOverrides)
+	}
+	if !cmp.Equal(rd.CommitSHAOverrides, map[string]string{"foo/backend": "ccc", "foo/db": "ddd"}) {
+		t.Fatalf("bad commit sha overrides: %v", rd.CommitSHAOverrides)
+	}
+
+	// clone with overridden dependency and triggering repo
+	rd = &models.RepoRevisionData{User: "alice", RefOverrides: map[string]string{"foo/backend": "feature", "foo/bar": "feature"}}
+	if err := m.PrepareClone(ctx, "source-env", rd); err != nil {
+		t.Fatalf("prepare should have succeeded: %v", err)
+	}
+	if rd.SourceSHA != "foo/bar-feature-sha" || rd.SourceBranch != "feature" {
+		t.Fatalf("bad clone triggering repo: %+v", rd)
+	}
+	if !cmp.Equal(rd.RefOverrides, map[string]string{"foo/backend": "feature", "foo/db": "master"}) {
+		t.Fatalf("bad ref overrides: %v", rd.RefOverrides)
+	}
+	if !cmp.Equal(rd.CommitSHAOverrides, map[string]string{"foo/db": "ddd"}) {
+		t.Fatalf("bad commit sha overrides: %v", rd.CommitSHAOverrides)
+	}
+
+	// a warning is recorded if the config differs from the source
+	rc := &models.RepoConfig{Application: models.RepoConfigAppMetadata{Repo: "foo/bar"}}
+	sig := rc.ConfigSignature()
+	dl.CreateK8sEnv(ctx, &models.KubernetesEnvironment{EnvName: "source-env", Namespace: "nitro-1234-source-env", ConfigSignature: sig[:]})
+	clone := &models.QAEnvironment{Name: rd.EnvName}
+	dl.CreateQAEnvironment(ctx, clone)
+	m.checkCloneSignature(ctx, rd, &newEnv{env: clone, rc: rc})
+	if qa, _ := dl.GetQAEnvironment(ctx, clone.Name); len(qa.Events) != 0 {
+		t.Fatalf("expected no events for matching signature: %+v", qa.Events)
+	}
+	rc.Dependencies.Direct = []models.RepoConfigDependency{{Name: "foo-backend", Repo: "foo/backend"}}
+	m.checkCloneSignature(ctx, rd, &newEnv{env: clone, rc: rc})
+	if qa, _ := dl.GetQAEnvironment(ctx, clone.Name); len(qa.Events) != 1 || !strings.Contains(qa.Events[0].Message, "differs from clone source") {
+		t.Fatalf("expected warning event for differing signature: %+v", qa.Events)
+	}
+}
+
+func TestRollback(t *testing.T) {
+	dl := persistence.NewFakeDataLayer()
+	ctx := context.Background()
+	env := models.QAEnvironment{
+		Name:         "some-name",
+		User:         "alice",
+		Repo:         "foo/bar",
+		PullRequest:  1,
+		SourceSHA:    "ccc",
+		BaseSHA:      "master-sha",
+		SourceBranch: "feature",
+		BaseBranch:   "master",
+		Status:       models.Queued,
+		RefMap:       models.RefMap{"foo/bar": "feature", "foo/db": "master"},
+		CommitSHAMap: models.RefMap{"foo/bar": "ccc", "foo/db": "111"},
+	}
+	dl.CreateQAEnvironment(ctx, &env)
+	sig := []byte("sig")
+	dl.CreateK8sEnv(ctx, &models.KubernetesEnvironment{EnvName: env.Name, Namespace: "nitro-1234-some-name", ConfigSignature: sig})
+	dl.CreateHelmReleasesForEnv(ctx, []models.HelmRelease{
+		{EnvName: env.Name, Name: "foo-bar", Release: "foo-bar-release", RevisionSHA: "ccc"},
+		{EnvName: env.Name, Name: "foo-db", Release: "foo-db-release", RevisionSHA: "111"},
+	})
+	for i, sha := range []string{"aaa", "bbb", "ccc"} {
+		dl.CreateEnvironmentRevision(ctx, &models.EnvironmentRevision{
+			EnvName:         env.Name,
+			Created:         time.Now().UTC().Add(time.Duration(i) * time.Minute),
+			K8sNamespace:    "nitro-1234-some-name",
+			RefMap:          env.RefMap,
+			CommitSHAMap:    models.RefMap{"foo/bar": sha, "foo/db": "111"},
+			ConfigSignature: sig,
+			HelmReleases: models.HelmReleaseRevisions{
+				{Name: "foo-bar", Release: "foo-bar-release", Revision: i + 1, RevisionSHA: sha},
+				{Name: "foo-db", Release: "foo-db-release", Revision: i + 1, RevisionSHA: "111"},
+			},
+		})
+	}
+	plf, err := locker.NewFakePreemptiveLockerFactory([]locker.LockProviderOption{locker.WithLockTimeout(time.Second)})
+	if err != nil {
+		t.Fatalf("error creating new preemptive locker factory: %v", err)
+	}
+	rollbacks := map[string]int{}
+	m := Manager{
+		DL:  dl,
+		PLF: plf,
+		MC:  &metrics.FakeCollector{},
+		CI: &metahelm.FakeInstaller{
+			DL: dl,
+			ChartRollbackFunc: func(release string, revision int) error {
+				rollbacks[release] = revision
+				return nil
+			},
+		},
+	}
+	if err := m.Rollback(ctx, env.Name, 0); err == nil || !nitroerrors.IsUserError(err) {
+		t.Fatalf("rollback of queued env should have failed with user error: %v", err)
+	}
+	dl.SetQAEnvironmentStatus(ctx, env.Name, models.Success)
+	if err := m.Rollback(ctx, env.Name, 99); err == nil || !nitroerrors.IsUserError(err) {
+		t.Fatalf("rollback to missing revision should have failed with user error: %v", err)
+	}
+
+	// the current commits are those of the latest revision, so the previous revision (2) is used
+	if err := m.Rollback(ctx, env.Name, 0); err != nil {
+		t.Fatalf("rollback should have succeeded: %v", err)
+	}
+	if rollbacks["foo-bar-release"] != 2 || rollbacks["foo-db-release"] != 2 {
+		t.Fatalf("bad helm rollbacks: %v", rollbacks)
+	}
+	qa, _ := dl.GetQAEnvironment(ctx, env.Name)
+	if qa.Status != models.Success || qa.SourceSHA != "bbb" || qa.CommitSHAMap["foo/bar"] != "bbb" {
+		t.Fatalf("bad environment after rollback: %v, %v, %v", qa.Status, qa.SourceSHA, qa.CommitSHAMap)
+	}
+	releases, _ := dl.GetHelmReleasesForEnv(ctx, env.Name)
+	for _, r := range releases {
+		if r.Name == "foo-bar" && r.RevisionSHA != "bbb" {
+			t.Fatalf("bad helm release revision sha: %v", r.RevisionSHA)
+		}
+	}
+
+	// explicit revision
+	if err := m.Rollback(ctx, env.Name, 1); err != nil {
+		t.Fatalf("rollback should have succeeded: %v", err)
+	}
+	if rollbacks["foo-bar-release"] != 1 {
+		t.Fatalf("bad helm rollbacks: %v", rollbacks)
+	}
+	if qa, _ := dl.GetQAEnvironment(ctx, env.Name); qa.SourceSHA != "aaa" {
+		t.Fatalf("bad source sha after rollback: %v", qa.SourceSHA)
+	}
+}
+
+func TestPlan(t *testing.T) {
+	dl := persistence.NewFakeDataLayer()
+	ctx := context.Background()
+	newRC := func(sha string) *models.RepoConfig {
+		rc := &models.RepoConfig{
+			Application: models.RepoConfigAppMetadata{Repo: "foo/bar", Ref: sha, Branch: "feature"},
+			Dependencies: models.DependencyDeclaration{
+				Direct: []models.RepoConfigDependency{
+					models.RepoConfigDependency{
+						Name:        "foo-db",
+						Repo:        "foo/db",
+						AppMetadata: models.RepoConfigAppMetadata{Repo: "foo/db", Ref: "111", Branch: "master"},
+					},
+				},
+			},
+		}
+		rc.Application.SetValueDefaults()
+		rc.Dependencies.Direct[0].AppMetadata.SetValueDefaults()
+		return rc
+	}
+	m := Manager{
+		DL: dl,
+		MC: &metrics.FakeCollector{},
+		FS: memfs.New(),
+		MG: &meta.FakeGetter{
+			GetFunc: func(ctx context.Context, rd models.RepoRevisionData) (*models.RepoConfig, error) {
+				return newRC(rd.SourceSHA), nil
+			},
+			FetchChartsFunc: func(ctx context.Context, rc *models.RepoConfig, basePath string) (meta.ChartLocations, error) {
+				return meta.ChartLocations{
+					"foo-bar": meta.ChartLocation{ChartPath: "/tmp/foo-bar"},
+					"foo-db":  meta.ChartLocation{ChartPath: "/tmp/foo-db"},
+				}, nil
+			},
+		},
+		CI: &metahelm.FakeInstaller{DL: dl},
+		RC: &ghclient.FakeRepoClient{
+			GetBranchFunc: func(ctx context.Context, repo, branch string) (ghclient.BranchInfo, error) {
+				if repo == "foo/bar" && branch == "feature" {
+					return ghclient.BranchInfo{Name: branch, SHA: "bbb"}, nil
+				}
+				return ghclient.BranchInfo{}, errors.New("404 Not Found")
+			},
+		},
+	}
+	for _, rd := range []models.RepoRevisionData{
+		{SourceBranch: "feature"},
+		{Repo: "foo/bar", SourceBranch: "missing"},
+		{Repo: "foo/bar", SourceBranch: "feature", EnvName: "missing-env"},
+	} {
+		if _, err := m.Plan(ctx, rd); err == nil || !nitroerrors.IsUserError(err) {
+			t.Fatalf("expected user error for %+v: %v", rd, err)
+		}
+	}
+
+	plan, err := m.Plan(ctx, models.RepoRevisionData{Repo: "foo/bar", PullRequest: 1, SourceBranch: "feature"})
+	if err != nil {
+		t.Fatalf("plan should have succeeded: %v", err)
+	}
+	if plan.Operation != models.PlanCreate || plan.CommitSHAMap["foo/bar"] != "bbb" || fmt.Sprint(plan.InstallOrder) != "[[foo-db] [foo-bar]]" {
+		t.Fatalf("bad create plan: %+v", plan)
+	}
+
+	env := models.QAEnvironment{
+		Name:         "some-name",
+		Repo:         "foo/bar",
+		PullRequest:  1,
+		SourceSHA:    "aaa",
+		SourceBranch: "feature",
+		BaseBranch:   "master",
+		Status:       models.Success,
+		RefMap:       models.RefMap{"foo/bar": "feature", "foo/db": "master"},
+		CommitSHAMap: models.RefMap{"foo/bar": "aaa", "foo/db": "111"},
+	}
+	dl.CreateQAEnvironment(ctx, &env)
+	sig := newRC("aaa").ConfigSignature()
+	dl.CreateK8sEnv(ctx, &models.KubernetesEnvironment{EnvName: env.Name, Namespace: "nitro-1234-some-name", ConfigSignature: sig[:]})
+	dl.CreateHelmReleasesForEnv(ctx, []models.HelmRelease{
+		{EnvName: env.Name, Name: "foo-bar", Release: "foo-bar-release", RevisionSHA: "aaa"},
+		{EnvName: env.Name, Name: "foo-db", Release: "foo-db-release", RevisionSHA: "111"},
+	})
+	plan, err = m.Plan(ctx, models.RepoRevisionData{Repo: "foo/bar", PullRequest: 1, SourceBranch: "feature"})
+	if err != nil {
+		t.Fatalf("plan should have succeeded: %v", err)
+	}
+	if plan.Operation != models.PlanUpgrade || plan.EnvName != env.Name || len(plan.RefChanges) != 1 || plan.RefChanges[0].SHA != "bbb" {
+		t.Fatalf("bad upgrade plan: %+v", plan)
+	}
+	for _, c := range plan.Charts {
+		if c.Action != models.PlanUpdate || c.Release != c.Name+"-release" || c.Changed != (c.Name == "foo-bar") {
+			t.Fatalf("bad planned chart: %+v", c)
+		}
+		if !strings.Contains(c.Values, "nitro-1234-some-name") {
+			t.Fatalf("values should use the extant namespace: %v", c.Values)
+		}
+	}
+	if qa, _ := dl.GetQAEnvironment(ctx, env.Name); qa.SourceSHA != "aaa" || qa.Status != models.Success {
+		t.Fatalf("plan should not modify the environment: %+v", qa)
+	}
+}
+
+func TestRetryFailed(t *testing.T) {
+	dl := persistence.NewFakeDataLayer()
+	ctx := context.Background()
+	rc := &models.RepoConfig{
+		Application: models.RepoConfigAppMetadata{Repo: "foo/bar", Ref: "aaa", Branch: "feature"},
+		Dependencies: models.DependencyDeclaration{
+			Direct: []models.RepoConfigDependency{
+				models.RepoConfigDependency{
+					Name:        "foo-db",
+					Repo:        "foo/db",
+					AppMetadata: models.RepoConfigAppMetadata{Repo: "foo/db", Ref: "111", Branch: "master"},
+				},
+			},
+		},
+	}
+	rc.Application.SetValueDefaults()
+	rc.Dependencies.Direct[0].AppMetadata.SetValueDefaults()
+	env := models.QAEnvironment{
+		Name:         "some-name",
+		Repo:         "foo/bar",
+		PullRequest:  1,
+		SourceSHA:    "aaa",
+		SourceBranch: "feature",
+		BaseBranch:   "master",
+		Status:       models.Success,
+		RefMap:       models.RefMap{"foo/bar": "feature", "foo/db": "master"},
+		CommitSHAMap: models.RefMap{"foo/bar": "aaa", "foo/db": "111"},
+	}
+	dl.CreateQAEnvironment(ctx, &env)
+	plf, err := locker.NewFakePreemptiveLockerFactory([]locker.LockProviderOption{locker.WithLockTimeout(time.Second)})
+	if err != nil {
+		t.Fatalf("error creating new preemptive locker factory: %v", err)
+	}
+	retried := map[string]string{}
+	var retryErr error
+	m := Manager{
+		DL:  dl,
+		PLF: plf,
+		NF:  newNotificationTracker().sender,
+		MC:  &metrics.FakeCollector{},
+		FS:  memfs.New(),
+		MG: &meta.FakeGetter{
+			GetFunc: func(ctx context.Context, rd models.RepoRevisionData) (*models.RepoConfig, error) {
+				return rc, nil
+			},
+			FetchChartsFunc: func(ctx context.Context, rc *models.RepoConfig, basePath string) (meta.ChartLocations, error) {
+				return meta.ChartLocations{
+					"foo-bar": meta.ChartLocation{ChartPath: "/tmp/foo-bar"},
+					"foo-db":  meta.ChartLocation{ChartPath: "/tmp/foo-db"},
+				}, nil
+			},
+		},
+		RC: &ghclient.FakeRepoClient{
+			GetCommitMessageFunc: func(ctx context.Context, repo string, ref string) (string, error) { return "commit msg", nil },
+			SetStatusFunc:        func(context.Context, string, string, *ghclient.CommitStatus) error { return nil },
+		},
+		CI: &metahelm.FakeInstaller{
+			DL: dl,
+			ChartRetryFunc: func(repo string, k8senv *models.KubernetesEnvironment, location metahelm.ChartLocation) error {
+				retried[repo] = k8senv.Namespace
+				return retryErr
+			},
+		},
+	}
+	if err := m.RetryFailed(ctx, "missing"); err == nil || !nitroerrors.IsUserError(err) {
+		t.Fatalf("retry of missing env should have failed with user error: %v", err)
+	}
+	if err := m.RetryFailed(ctx, env.Name); err == nil || !nitroerrors.IsUserError(err) {
+		t.Fatalf("retry of successful env should have failed with user error: %v", err)
+	}
+	dl.SetQAEnvironmentStatus(ctx, env.Name, models.Failure)
+	if err := m.RetryFailed(ctx, env.Name); err == nil || !nitroerrors.IsUserError(err) {
+		t.Fatalf("retry without namespace should have failed with user error: %v", err)
+	}
+	dl.CreateK8sEnv(ctx, &models.KubernetesEnvironment{EnvName: env.Name, Namespace: "nitro-1234-some-name", ConfigSignature: []byte("other")})
+	if err := m.RetryFailed(ctx, env.Name); err == nil || !nitroerrors.IsUserError(err) {
+		t.Fatalf("retry with changed config should have failed with user error: %v", err)
+	}
+	sig := rc.ConfigSignature()
+	dl.UpdateK8sEnvConfigSignature(ctx, env.Name, sig)
+
+	retryErr = errors.New("chart failed again")
+	if err := m.RetryFailed(ctx, env.Name); err == nil || nitroerrors.IsUserError(err) {
+		t.Fatalf("retry should have failed with system error: %v", err)
+	}
+	if qa, _ := dl.GetQAEnvironment(ctx, env.Name); qa.Status != models.Failure {
+		t.Fatalf("bad status after failed retry: %v", qa.Status)
+	}
+
+	retryErr = nil
+	if err := m.RetryFailed(ctx, env.Name); err != nil {
+		t.Fatalf("retry should have succeeded: %v", err)
+	}
+	if len(retried) != 2 || retried["foo-bar"] != "nitro-1234-some-name" {
+		t.Fatalf("bad retried charts: %v", retried)
+	}
+	if qa, _ := dl.GetQAEnvironment(ctx, env.Name); qa.Status != models.Success {
+		t.Fatalf("bad status after retry: %v", qa.Status)
+	}
+
+	rc.Application.Ref = "bbb"
+	dl.SetQAEnvironmentStatus(ctx, env.Name, models.Failure)
+	if err := m.RetryFailed(ctx, env.Name); err == nil || !nitroerrors.IsUserError(err) {
+		t.Fatalf("retry with changed commit should have failed with user error: %v", err)
+	}
+}
+
+func TestRetryPolicyBackoff(t *testing.T) {
+	rp := RetryPolicy{MaxAttempts: 5, Backoff: time.Second, MaxBackoff: 5 * time.Second}
+	for i, expected := range []time.Duration{time.Second, 2 * time.Second, 4 * time.Second, 5 * time.Second, 5 * time.Second} {
+		if d := rp.backoff(uint(i + 1)); d != expected {
+			t.Errorf("bad backoff for attempt %v: %v (expected %v)", i+1, d, expected)
+		}
+	}
+	if d := (RetryPolicy{}).backoff(2); d != 2*DefaultRetryBackoff {
+		t.Errorf("bad default backoff: %v", d)
+	}
+}
+
+func TestCreateRetries(t *testing.T) {
+	dl := persistence.NewFakeDataLayer()
+	rd := models.RepoRevisionData{Repo: "foo/bar", PullRequest: 1, SourceSHA: "asdf", SourceBranch: "feature", BaseSHA: "1234", BaseBranch: "master"}
+	rc := models.RepoConfig{
+		Application: models.RepoConfigAppMetadata{Repo: "foo/bar", Ref: "asdf", Branch: "feature", ChartPath: ".chart/bar", Image: "foo/bar"},
+	}
+	var attempts int
+	installErrs := []error{}
+	nt := newNotificationTracker()
+	plf, err := locker.NewFakePreemptiveLockerFactory(
+		[]locker.LockProviderOption{locker.WithLockTimeout(time.Second)},
+		locker.WithLockDelay(time.Millisecond),
+	)
+	if err != nil {
+		t.Fatalf("error creating new preemptive locker factory: %v", err)
+	}
+	m := Manager{
+		DL:  dl,
+		PLF: plf,
+		NF:  nt.sender,
+		MC:  &metrics.FakeCollector{},
+		NG:  &namegen.FakeNameGenerator{},
+		FS:  memfs.New(),
+		MG: &meta.FakeGetter{
+			GetFunc: func(ctx context.Context, rd models.RepoRevisionData) (*models.RepoConfig, error) {
+				return &rc, nil
+			},
+			FetchChartsFunc: func(ctx context.Context, rc *models.RepoConfig, basePath string) (meta.ChartLocations, error) {
+				return meta.ChartLocations{"foo-bar": meta.ChartLocation{ChartPath: "/tmp/foo/bar"}}, nil
+			},
+		},
+		RC: &ghclient.FakeRepoClient{
+			GetBranchesFunc: func(ctx context.Context, name string) ([]ghclient.BranchInfo, error) {
+				return []ghclient.BranchInfo{ghclient.BranchInfo{Name: "feature"}, ghclient.BranchInfo{Name: "master"}}, nil
+			},
+			GetCommitMessageFunc: func(ctx context.Context, repo string, ref string) (string, error) { return "commit msg", nil },
+			SetStatusFunc:        func(context.Context, string, string, *ghclient.CommitStatus) error { return nil },
+		},
+		CI: &metahelm.FakeInstaller{
+			DL: dl,
+			ChartInstallFunc: func(repo string, location metahelm.ChartLocation) error {
+				attempts++
+				if len(installErrs) > 0 {
+					err := installErrs[0]
+					installErrs = installErrs[1:]
+					return err
+				}
+				return nil
+			},
+		},
+		RetryPolicy: RetryPolicy{MaxAttempts: 3, Backoff: time.Millisecond},
+	}
+	failures := func() int {
+		var n int
+		for _, n2 := range nt.get() {
+			if n2.Event == notifier.Failure {
+				n++
+			}
+		}
+		return n
+	}
+	create := func() (*models.EventStatusSummary, error) {
+		el := &eventlogger.Logger{DL: dl}
+		el.ID, _ = uuid.NewRandom()
+		el.Init([]byte{}, rd.Repo, rd.PullRequest)
+		_, err := m.Create(eventlogger.NewEventLoggerContext(context.Background(), el), rd)
+		s, _ := dl.GetEventStatus(el.ID)
+		return s, err
+	}
+
+	// system errors are retried
+	installErrs = []error{errors.New("api server timeout"), errors.New("registry error")}
+	s, err := create()
+	if err != nil {
+		t.Fatalf("create should have succeeded after retries: %v", err)
+	}
+	if attempts != 3 || len(s.Config.Retries) != 2 || s.Config.Retries[1].Attempt != 2 || s.Config.Retries[1].Error != "error installing charts: install aborted: registry error" {
+		t.Fatalf("bad attempts (%v) or retries: %+v", attempts, s.Config.Retries)
+	}
+	if s.Config.Status != models.DoneStatus || failures() != 0 {
+		t.Fatalf("intermediate failures should not have been reported: %v: %+v", s.Config.Status, nt.get())
+	}
+
+	// the final failure is reported
+	attempts = 0
+	installErrs = []error{errors.New("timeout"), errors.New("timeout"), errors.New("timeout")}
+	s, err = create()
+	if err == nil || attempts != 3 || len(s.Config.Retries) != 2 {
+		t.Fatalf("create should have failed after 3 attempts: %v: %v", attempts, err)
+	}
+	if !nitroerrors.IsRetriesExhaustedError(err) || nitroerrors.IsUserError(err) {
+		t.Fatalf("final failure should have been annotated as retried: %v", err)
+	}
+	if s.Config.Status != models.FailedStatus || failures() != 1 {
+		t.Fatalf("final failure should have been reported: %v: %v", s.Config.Status, failures())
+	}
+
+	// user errors are not retried
+	attempts = 0
+	installErrs = []error{nitroerrors.User(errors.New("bad chart"))}
+	s, err = create()
+	if err == nil || !nitroerrors.IsUserError(err) || nitroerrors.IsRetriesExhaustedError(err) || attempts != 1 || len(s.Config.Retries) != 0 {
+		t.Fatalf("user error should not have been retried: %v: %v", attempts, err)
+	}
+}
+
+func TestUpdateRetries(t *testing.T) {
+	dl := persistence.NewFakeDataLayer()
+	rd := models.RepoRevisionData{Repo: "foo/bar", PullRequest: 1, SourceSHA: "asdf", SourceBranch: "feature", BaseSHA: "1234", BaseBranch: "master"}
+	rc := models.RepoConfig{
+		Application: models.RepoConfigAppMetadata{Repo: "foo/bar", Ref: "asdf", Branch: "feature", ChartPath: ".chart/bar", Image: "foo/bar"},
+	}
+	env := models.QAEnvironment{
+		Name:         "some-name",
+		Repo:         rd.Repo,
+		PullRequest:  rd.PullRequest,
+		Status:       models.Success,
+		RefMap:       models.RefMap{"foo/bar": "feature"},
+		CommitSHAMap: models.RefMap{"foo/bar": "1111"},
+	}
+	sig := rc.ConfigSignature()
+	k8senv := models.KubernetesEnvironment{EnvName: env.Name, Namespace: "nitro-1234-" + env.Name, ConfigSignature: sig[:]}
+	dl.CreateQAEnvironment(context.Background(), &env)
+	dl.CreateK8sEnv(context.Background(), &k8senv)
+	dl.CreateHelmReleasesForEnv(context.Background(), []models.HelmRelease{{EnvName: env.Name, Name: "foo-bar", RevisionSHA: "1111", Release: "foo-bar"}})
+	var attempts int
+	upgradeErrs := []error{}
+	// a failed environment is rebuilt from scratch rather than upgraded, so installs and upgrades fail alike
+	chartErr := func() error {
+		attempts++
+		if len(upgradeErrs) > 0 {
+			err := upgradeErrs[0]
+			upgradeErrs = upgradeErrs[1:]
+			return err
+		}
+		return nil
+	}
+	nt := newNotificationTracker()
+	plf, err := locker.NewFakePreemptiveLockerFactory(
+		[]locker.LockProviderOption{locker.WithLockTimeout(time.Second)},
+		locker.WithLockDelay(time.Millisecond),
+	)
+	if err != nil {
+		t.Fatalf("error creating new preemptive locker factory: %v", err)
+	}
+	m := Manager{
+		DL:  dl,
+		PLF: plf,
+		NF:  nt.sender,
+		MC:  &metrics.FakeCollector{},
+		NG:  &namegen.FakeNameGenerator{},
+		FS:  memfs.New(),
+		MG: &meta.FakeGetter{
+			GetFunc: func(ctx context.Context, rd models.RepoRevisionData) (*models.RepoConfig, error) {
+				return &rc, nil
+			},
+			FetchChartsFunc: func(ctx context.Context, rc *models.RepoConfig, basePath string) (meta.ChartLocations, error) {
+				return meta.ChartLocations{"foo-bar": meta.ChartLocation{ChartPath: "/tmp/foo/bar"}}, nil
+			},
+		},
+		RC: &ghclient.FakeRepoClient{
+			GetBranchesFunc: func(ctx context.Context, name string) ([]ghclient.BranchInfo, error) {
+				return []ghclient.BranchInfo{ghclient.BranchInfo{Name: "feature"}, ghclient.BranchInfo{Name: "master"}}, nil
+			},
+			GetCommitMessageFunc: func(ctx context.Context, repo string, ref string) (string, error) { return "commit msg", nil },
+			SetStatusFunc:        func(context.Context, string, string, *ghclient.CommitStatus) error { return nil },
+		},
+		CI: &metahelm.FakeInstaller{
+			DL:           dl,
+			HelmReleases: []string{"foo-bar"},
+			KC:           k8sfake.NewSimpleClientset(&corev1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: k8senv.Namespace}}),
+			ChartUpgradeFunc: func(repo string, k8senv *models.KubernetesEnvironment, location metahelm.ChartLocation) error {
+				return chartErr()
+			},
+			ChartInstallFunc: func(repo string, location metahelm.ChartLocation) error { return chartErr() },
+		},
+		RetryPolicy: RetryPolicy{MaxAttempts: 3, Backoff: time.Millisecond},
+	}
+	failures := func() int {
+		var n int
+		for _, n2 := range nt.get() {
+			if n2.Event == notifier.Failure {
+				n++
+			}
+		}
+		return n
+	}
+	update := func() (*models.EventStatusSummary, error) {
+		el := &eventlogger.Logger{DL: dl}
+		el.ID, _ = uuid.NewRandom()
+		el.Init([]byte{}, rd.Repo, rd.PullRequest)
+		_, err := m.Update(eventlogger.NewEventLoggerContext(context.Background(), el), rd)
+		s, _ := dl.GetEventStatus(el.ID)
+		return s, err
+	}
+
+	// system errors are retried
+	upgradeErrs = []error{errors.New("api server timeout"), errors.New("registry error")}
+	s, err := update()
+	if err != nil {
+		t.Fatalf("update should have succeeded after retries: %v", err)
+	}
+	if attempts != 3 || len(s.Config.Retries) != 2 {
+		t.Fatalf("bad attempts (%v) or retries: %+v", attempts, s.Config.Retries)
+	}
+	if s.Config.Status != models.DoneStatus || failures() != 0 {
+		t.Fatalf("intermediate failures should not have been reported: %v: %+v", s.Config.Status, nt.get())
+	}
+
+	// the final failure is reported
+	attempts = 0
+	upgradeErrs = []error{errors.New("timeout"), errors.New("timeout"), errors.New("timeout")}
+	s, err = update()
+	if err == nil || attempts != 3 || len(s.Config.Retries) != 2 {
+		t.Fatalf("update should have failed after 3 attempts: %v: %v", attempts, err)
+	}
+	if !nitroerrors.IsRetriesExhaustedError(err) || nitroerrors.IsUserError(err) {
+		t.Fatalf("final failure should have been annotated as retried: %v", err)
+	}
+	if s.Config.Status != models.FailedStatus || failures() != 1 {
+		t.Fatalf("final failure should have been reported: %v: %v", s.Config.Status, failures())
+	}
+
+	// user errors are not retried
+	attempts = 0
+	upgradeErrs = []error{nitroerrors.User(errors.New("bad chart"))}
+	s, err = update()
+	if err == nil || !nitroerrors.IsUserError(err) || nitroerrors.IsRetriesExhaustedError(err) || attempts != 1 || len(s.Config.Retries) != 0 {
+		t.Fatalf("user error should not have been retried: %v: %v", attempts, err)
+	}
+}
+
+func TestCancel(t *testing.T) {
+	dl := persistence.NewFakeDataLayer()
+	rd := models.RepoRevisionData{Repo: "foo/bar", PullRequest: 1, SourceSHA: "asdf", SourceBranch: "feature", BaseSHA: "1234", BaseBranch: "master"}
+	rc := models.RepoConfig{
+		Application: models.RepoConfigAppMetadata{Repo: "foo/bar", Ref: "asdf", Branch: "feature", ChartPath: ".chart/bar", Image: "foo/bar"},
+	}
+	started, release := make(chan struct{}), make(chan struct{})
+	defer close(release)
+	plf, err := locker.NewFakePreemptiveLockerFactory(
+		[]locker.LockProviderOption{locker.WithLockTimeout(time.Second)},
+		locker.WithLockDelay(time.Millisecond),
+	)
+	if err != nil {
+		t.Fatalf("error creating new preemptive locker factory: %v", err)
+	}
+	m := Manager{
+		DL:  dl,
+		PLF: plf,
+		NF:  newNotificationTracker().sender,
+		MC:  &metrics.FakeCollector{},
+		NG:  &namegen.FakeNameGenerator{},
+		FS:  memfs.New(),
+		MG: &meta.FakeGetter{
+			GetFunc: func(ctx context.Context, rd models.RepoRevisionData) (*models.RepoConfig, error) {
+				return &rc, nil
+			},
+			FetchChartsFunc: func(ctx context.Context, rc *models.RepoConfig, basePath string) (meta.ChartLocations, error) {
+				return meta.ChartLocations{"foo-bar": meta.ChartLocation{ChartPath: "/tmp/foo/bar"}}, nil
+			},
+		},
+		RC: &ghclient.FakeRepoClient{
+			GetBranchesFunc: func(ctx context.Context, name string) ([]ghclient.BranchInfo, error) {
+				return []ghclient.BranchInfo{ghclient.BranchInfo{Name: "feature"}, ghclient.BranchInfo{Name: "master"}}, nil
+			},
+			GetCommitMessageFunc: func(ctx context.Context, repo string, ref string) (string, error) { return "commit msg", nil },
+			SetStatusFunc:        func(context.Context, string, string, *ghclient.CommitStatus) error { return nil },
+		},
+		CI: &metahelm.FakeInstaller{
+			DL: dl,
+			ChartInstallFunc: func(repo string, location metahelm.ChartLocation) error {
+				close(started)
+				<-release
+				return nil
+			},
+		},
+	}
+	if err := m.Cancel(context.Background(), "does-not-exist", uuid.Nil, "cancel requested by john.smith"); err == nil || !nitroerrors.IsUserError(err) {
+		t.Fatalf("cancelling a missing environment should have returned a user error: %v", err)
+	}
+	el := &eventlogger.Logger{DL: dl}
+	el.ID, _ = uuid.NewRandom()
+	el.Init([]byte{}, rd.Repo, rd.PullRequest)
+	errs := make(chan error)
+	go func() {
+		_, err := m.Create(eventlogger.NewEventLoggerContext(context.Background(), el), rd)
+		errs <- err
+	}()
+	select {
+	case <-started:
+	case <-time.After(10 * time.Second):
+		t.Fatalf("timeout waiting for chart install")
+	}
+	envs, err := dl.GetQAEnvironmentsByRepoAndPR(context.Background(), rd.Repo, rd.PullRequest)
+	if err != nil || len(envs) != 1 {
+		t.Fatalf("error getting environment: %v: %v", len(envs), err)
+	}
+	name := envs[0].Name
+	if err := m.Cancel(context.Background(), name, uuid.New(), "cancel requested by john.smith"); err == nil || !nitroerrors.IsUserError(err) {
+		t.Fatalf("cancelling the operation of another event should have returned a user error: %v", err)
+	}
+	if err := m.Cancel(context.Background(), name, el.ID, "cancel requested by john.smith"); err != nil {
+		t.Fatalf("error cancelling: %v", err)
+	}
+	select {
+	case err = <-errs:
+	case <-time.After(10 * time.Second):
+		t.Fatalf("timeout waiting for create to be cancelled")
+	}
+	if !nitroerrors.IsCancelledError(err) || !strings.Contains(err.Error(), "preempted by cancel requested by john.smith") {
+		t.Fatalf("create should have been cancelled with the reason: %v", err)
+	}
+	env, err := dl.GetQAEnvironment(context.Background(), name)
+	if err != nil || env == nil {
+		t.Fatalf("error getting environment: %v", err)
+	}
+	if env.Status != models.Cancelled {
+		t.Fatalf("bad status: %v", env.Status)
+	}
+	var requested, cancelled bool
+	for _, e := range env.Events {
+		requested = requested || e.Message == "cancellation requested: cancel requested by john.smith"
+		cancelled = cancelled || strings.HasPrefix(e.Message, "operation cancelled: preempted by cancel requested by john.smith")
+	}
+	if !requested || !cancelled {
+		t.Fatalf("missing cancellation events: %+v", env.Events)
+	}
+	s, _ := dl.GetEventStatus(el.ID)
+	if s == nil || s.Config.Status != models.CancelledStatus {
+		t.Fatalf("bad event status: %+v", s)
+	}
+}
+
+func TestCancelQueued(t *testing.T) {
+	dl := persistence.NewFakeDataLayer()
+	ctx := context.Background()
+	rd := models.RepoRevisionData{Repo: "foo/bar", PullRequest: 1, SourceSHA: "asdf", SourceBranch: "feature", BaseSHA: "1234", BaseBranch: "master"}
+	dl.CreateQAEnvironment(ctx, &models.QAEnvironment{Name: "some-name", Repo: rd.Repo, PullRequest: rd.PullRequest, SourceSHA: rd.SourceSHA, Status: models.Spawned})
+	nt := newNotificationTracker()
+	var statuses []*ghclient.CommitStatus
+	m := Manager{
+		DL: dl,
+		NF: nt.sender,
+		MC: &metrics.FakeCollector{},
+		RC: &ghclient.FakeRepoClient{
+			GetCommitMessageFunc: func(ctx context.Context, repo string, ref string) (string, error) { return "commit msg", nil },
+			SetStatusFunc: func(ctx context.Context, repo string, sha string, cs *ghclient.CommitStatus) error {
+				statuses = append(statuses, cs)
+				return nil
+			},
+		},
+	}
+	el := &eventlogger.Logger{DL: dl}
+	el.ID, _ = uuid.NewRandom()
+	el.Init([]byte{}, rd.Repo, rd.PullRequest)
+	if op, err := m.CancelQueued(ctx, el.ID, "cancel requested by john.smith"); err != nil || op != nil {
+		t.Fatalf("there should be no queued operation to cancel: %v: %v", op, err)
+	}
+	if err := dl.EnqueueOperation(ctx, &models.QueuedOperation{ID: uuid.New(), Action: models.CreateOperationAction, RepoRevisionData: rd, EventID: el.ID}); err != nil {
+		t.Fatalf("error enqueueing operation: %v", err)
+	}
+	op, err := m.CancelQueued(ctx, el.ID, "cancel requested by john.smith")
+	if err != nil || op == nil {
+		t.Fatalf("queued operation should have been cancelled: %v: %v", op, err)
+	}
+	if s, _ := dl.GetEventStatus(el.ID); s == nil || s.Config.Status != models.CancelledStatus {
+		t.Fatalf("bad event status: %+v", s)
+	}
+	if env, _ := dl.GetQAEnvironment(ctx, "some-name"); env.Status != models.Cancelled {
+		t.Fatalf("spawned environment should have been cancelled: %v", env.Status)
+	}
+	if len(statuses) != 1 || statuses[0].Status != "failure" {
+		t.Fatalf("expected failure commit status: %+v", statuses)
+	}
+	if n := nt.get(); len(n) != 1 || n[0].Event != notifier.Failure || !strings.Contains(n[0].Data.ErrorMessage, "cancel requested by john.smith") {
+		t.Fatalf("expected failure notification with the reason: %+v", n)
+	}
+}
@@ -0,0 +1,126 @@
+package env
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/dollarshaveclub/acyl/pkg/models"
+	nitroerrors "github.com/dollarshaveclub/acyl/pkg/nitro/errors"
+	"github.com/dollarshaveclub/acyl/pkg/nitro/notifier"
+)
+
+// expiresAt returns the expiration of env formatted for notifications, or empty if it doesn't expire
+func expiresAt(env *models.QAEnvironment) string {
+	if env == nil || env.ExpiresAt == nil {
+		return ""
+	}
+	return env.ExpiresAt.UTC().Format(time.RFC3339)
+}
+
+// setInitialExpiration sets the expiration of a new environment from the acyl.yml ttl or the default TTL, if either is set.
+// Manual environments always expire, using the requested TTL if present or the manual environment TTL if nothing else is set.
+func (m *Manager) setInitialExpiration(ctx context.Context, rd *models.RepoRevisionData, ne *newEnv) error {
+	ttl := m.DefaultTTL
+	if rd.Manual() && m.ManualTTL > 0 {
+		ttl = m.ManualTTL
+	}
+	if ne.rc != nil {
+		d, err := ne.rc.TTLDuration()
+		if err != nil {
+			return err
+		}
+		if d > 0 {
+			ttl = d
+		}
+	}
+	if rd.Manual() && rd.TTL > 0 {
+		ttl = rd.TTL
+	}
+	if ttl <= 0 {
+		return nil
+	}
+	expires := time.Now().UTC().Add(ttl)
+	m.log(ctx, "environment will expire at %v (ttl: %v)", expires.Format(time.RFC3339), ttl)
+	if err := m.DL.SetQAEnvironmentExpiration(ctx, ne.env.Name, &expires); err != nil {
+		return fmt.Errorf("error setting environment expiration: %w", err)
+	}
+	ne.env.ExpiresAt = &expires
+	return nil
+}
+
+// setReaperPolicy records the reaper policy overrides in acyl.yml on env, limited to the bounds of the server reaper policies
+func (m *Manager) setReaperPolicy(ctx context.Context, env *models.QAEnvironment, rc *models.RepoConfig) error {
+	rp, err := rc.Reaper.Policy()
+	if err != nil {
+		return err
+	}
+	rp, adjusted := rp.Bound(m.ReaperPolicies.Min, m.ReaperPolicies.Max)
+	for _, msg := range adjusted {
+		m.log(ctx, "acyl.yml reaper policy: %v", msg)
+	}
+	if rp == env.ReaperPolicy {
+		return nil
+	}
+	if err := m.DL.SetQAEnvironmentReaperPolicy(ctx, env.Name, rp); err != nil {
+		return fmt.Errorf("error setting environment reaper policy: %w", err)
+	}
+	env.ReaperPolicy = rp
+	return nil
+}
+
+// ExtendExpiration postpones the expiration of an environment by d from its current expiration (or from now, if that has already passed)
+// and returns the new expiration. Environments that don't expire can't be extended.
+func (m *Manager) ExtendExpiration(ctx context.Context, name string, d time.Duration) (time.Time, error) {
+	if d <= 0 {
+		return time.Time{}, nitroerrors.User(fmt.Errorf("extension must be positive: %v", d))
+	}
+	env, err := m.DL.GetQAEnvironment(ctx, name)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("error getting environment: %w", err)
+	}
+	if env == nil {
+		return time.Time{}, nitroerrors.User(fmt.Errorf("environment not found: %v", name))
+	}
+	if env.Status == models.Destroyed {
+		return time.Time{}, nitroerrors.User(fmt.Errorf("environment is destroyed: %v", name))
+	}
+	if env.ExpiresAt == nil {
+		return time.Time{}, nitroerrors.User(fmt.Errorf("environment does not expire: %v", name))
+	}
+	base := time.Now().UTC()
+	if env.ExpiresAt.After(base) {
+		base = *env.ExpiresAt
+	}
+	expires := base.Add(d).UTC()
+	if err := m.DL.SetQAEnvironmentExpiration(ctx, name, &expires); err != nil {
+		return time.Time{}, fmt.Errorf("error setting environment expiration: %w", err)
+	}
+	return expires, nil
+}
+
+// WarnExpiration sends the expiration warning notification for an environment and records that it was sent
+func (m *Manager) WarnExpiration(ctx context.Context, name string) error {
+	env, err := m.DL.GetQAEnvironment(ctx, name)
+	if err != nil {
+		return fmt.Errorf("error getting environment: %w", err)
+	}
+	if env == nil {
+		return nitroerrors.User(fmt.Errorf("environment not found: %v", name))
+	}
+	if env.ExpiresAt == nil {
+		return nitroerrors.User(fmt.Errorf("environment does not expire: %v", name))
+	}
+	// the repo config is only needed for notification settings, so it isn't written back to the environment record
+	ne := &newEnv{env: env}
+	ne.rc, err = m.getRepoConfig(ctx, env.RepoRevisionDataFromQA())
+	if err != nil {
+		// continue with default notifications
+		m.log(ctx, "error getting environment config: %v", err)
+	}
+	m.pushNotification(ctx, ne, notifier.ExpirationWarning, "")
+	if err := m.DL.SetQAEnvironmentExpirationWarned(ctx, name); err != nil {
+		return fmt.Errorf("error setting expiration warned: %w", err)
+	}
+	return nil
+}
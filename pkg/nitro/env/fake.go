@@ -2,9 +2,11 @@ package env
 
 import (
 	"context"
+	"time"
 
 	"github.com/dollarshaveclub/acyl/pkg/models"
 	"github.com/dollarshaveclub/acyl/pkg/spawner"
+	"github.com/google/uuid"
 )
 
 // FakeManager stubs out a Manager, fulfilling the spawner.EnvironmentSpawner interface
@@ -17,6 +19,17 @@ func (fm *FakeManager) Create(context.Context, models.RepoRevisionData) (string,
 	return "", nil
 }
 
+func (fm *FakeManager) PrepareManual(_ context.Context, rd *models.RepoRevisionData) error {
+	rd.EnvName = "manual-env"
+	return nil
+}
+
+func (fm *FakeManager) PrepareClone(_ context.Context, source string, rd *models.RepoRevisionData) error {
+	rd.EnvName = "cloned-env"
+	rd.CloneOf = source
+	return nil
+}
+
 func (fm *FakeManager) Update(context.Context, models.RepoRevisionData) (string, error) {
 	return "", nil
 }
@@ -36,3 +49,51 @@ func (fm *FakeManager) Success(context.Context, string) error {
 func (fm *FakeManager) Failure(context.Context, string, string) error {
 	return nil
 }
+
+func (fm *FakeManager) Hibernate(context.Context, string) error {
+	return nil
+}
+
+func (fm *FakeManager) Wake(context.Context, string) error {
+	return nil
+}
+
+func (fm *FakeManager) ExtendExpiration(_ context.Context, _ string, d time.Duration) (time.Time, error) {
+	return time.Now().UTC().Add(d), nil
+}
+
+func (fm *FakeManager) WarnExpiration(context.Context, string) error {
+	return nil
+}
+
+func (fm *FakeManager) Pin(context.Context, string, string, *time.Time) error {
+	return nil
+}
+
+func (fm *FakeManager) Unpin(context.Context, string) error {
+	return nil
+}
+
+func (fm *FakeManager) ProcessQueue(context.Context) error {
+	return nil
+}
+
+func (fm *FakeManager) Rollback(context.Context, string, int64) error {
+	return nil
+}
+
+func (fm *FakeManager) Plan(context.Context, models.RepoRevisionData) (*models.EnvironmentPlan, error) {
+	return &models.EnvironmentPlan{}, nil
+}
+
+func (fm *FakeManager) RetryFailed(context.Context, string) error {
+	return nil
+}
+
+func (fm *FakeManager) Cancel(context.Context, string, uuid.UUID, string) error {
+	return nil
+}
+
+func (fm *FakeManager) CancelQueued(context.Context, uuid.UUID, string) (*models.QueuedOperation, error) {
+	return nil, nil
+}
@@ -0,0 +1,171 @@
+package env
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/dollarshaveclub/acyl/pkg/models"
+	nitroerrors "github.com/dollarshaveclub/acyl/pkg/nitro/errors"
+	"gopkg.in/DataDog/dd-trace-go.v1/ddtrace/tracer"
+)
+
+// getEnvWithStatus returns the environment or a user error if it doesn't exist or isn't in status
+func (m *Manager) getEnvWithStatus(ctx context.Context, name string, status models.EnvironmentStatus) (*models.QAEnvironment, error) {
+	env, err := m.DL.GetQAEnvironment(ctx, name)
+	if err != nil {
+		return nil, fmt.Errorf("error getting environment: %w", err)
+	}
+	if env == nil {
+		return nil, nitroerrors.User(fmt.Errorf("environment not found: %v", name))
+	}
+	if env.Status != status {
+		return nil, nitroerrors.User(fmt.Errorf("environment status must be %v (currently %v)", status, env.Status))
+	}
+	return env, nil
+}
+
+// Hibernate scales all workloads in an environment with status Success to zero replicas and marks it as Hibernated.
+// The previous replica counts are recorded so they can be restored by Wake.
+func (m *Manager) Hibernate(ctx context.Context, name string) error {
+	env, err := m.getEnvWithStatus(ctx, name, models.Success)
+	if err != nil {
+		return err
+	}
+	err = m.lockingOperation(ctx, env.Repo, env.PullRequest, env.Name, func(ctx context.Context) error {
+		return m.hibernate(ctx, name)
+	})
+	if err == nil {
+		// hibernated environments don't count against the global limit
+		m.processQueueAsync(ctx)
+	}
+	return err
+}
+
+func (m *Manager) hibernate(ctx context.Context, name string) (err error) {
+	span, ctx := tracer.StartSpanFromContext(ctx, "hibernate")
+	defer func() {
+		span.Finish(tracer.WithError(err))
+	}()
+	// check again now that we hold the lock, the environment may have changed while waiting
+	env, err := m.getEnvWithStatus(ctx, name, models.Success)
+	if err != nil {
+		return err
+	}
+	end := m.MC.Timing(mpfx+"hibernate", "triggering_repo:"+env.Repo)
+	defer func() {
+		end(fmt.Sprintf("success:%v", err == nil))
+	}()
+	m.setloggername(ctx, env.Name)
+	k8senv, err := m.DL.GetK8sEnv(ctx, env.Name)
+	if err != nil {
+		return fmt.Errorf("error getting k8s environment: %w", err)
+	}
+	if k8senv == nil {
+		return errors.New("missing k8s environment")
+	}
+	m.log(ctx, "hibernating environment: scaling workloads in namespace %v to zero", k8senv.Namespace)
+	if err := m.CI.HibernateNamespace(ctx, k8senv); err != nil {
+		// restore anything that was scaled down before the error
+		if err2 := m.CI.WakeNamespace(context.Background(), k8senv); err2 != nil {
+			m.log(ctx, "error restoring workloads after failed hibernation: %v", err2)
+		}
+		return fmt.Errorf("error hibernating namespace: %w", err)
+	}
+	if err := m.DL.SetQAEnvironmentStatus(tracer.ContextWithSpan(context.Background(), span), env.Name, models.Hibernated); err != nil {
+		return fmt.Errorf("error setting environment status: %w", err)
+	}
+	return nil
+}
+
+// Wake restores the workloads of a Hibernated environment to their previous replica counts and marks it as Success.
+// The environment counts against the global limit and quotas again once it's woken, so it's admitted like a create first.
+func (m *Manager) Wake(ctx context.Context, name string) error {
+	env, err := m.getEnvWithStatus(ctx, name, models.Hibernated)
+	if err != nil {
+		return err
+	}
+	return m.lockingOperation(ctx, env.Repo, env.PullRequest, env.Name, func(ctx context.Context) error {
+		return m.wake(ctx, name)
+	})
+}
+
+func (m *Manager) wake(ctx context.Context, name string) (err error) {
+	span, ctx := tracer.StartSpanFromContext(ctx, "wake")
+	defer func() {
+		span.Finish(tracer.WithError(err))
+	}()
+	env, err := m.getEnvWithStatus(ctx, name, models.Hibernated)
+	if err != nil {
+		return err
+	}
+	end := m.MC.Timing(mpfx+"wake", "triggering_repo:"+env.Repo)
+	defer func() {
+		end(fmt.Sprintf("success:%v", err == nil))
+	}()
+	m.setloggername(ctx, env.Name)
+	if err := m.admitWake(ctx, env); err != nil {
+		return err
+	}
+	k8senv, err := m.DL.GetK8sEnv(ctx, env.Name)
+	if err != nil {
+		return fmt.Errorf("error getting k8s environment: %w", err)
+	}
+	if k8senv == nil {
+		return errors.New("missing k8s environment")
+	}
+	m.log(ctx, "waking environment: restoring workloads in namespace %v", k8senv.Namespace)
+	if err := m.CI.WakeNamespace(ctx, k8senv); err != nil {
+		return fmt.Errorf("error waking namespace: %w", err)
+	}
+	if err := m.DL.SetQAEnvironmentStatus(tracer.ContextWithSpan(context.Background(), span), env.Name, models.Success); err != nil {
+		return fmt.Errorf("error setting environment status: %w", err)
+	}
+	return nil
+}
+
+// admitWake checks that waking the hibernated environment env is allowed under the global limit and quotas, like a create.
+// With EvictOldestPolicy, the wake is rejected with a user error if it would exceed a quota, and the oldest environments
+// are destroyed to make room for it under the global limit. Wakes aren't queued, so with QueuePolicy the wake is
+// rejected with a user error if there is no capacity or creates are queued waiting for it.
+func (m *Manager) admitWake(ctx context.Context, env *models.QAEnvironment) error {
+	rd := env.RepoRevisionDataFromQA()
+	if m.GlobalLimitPolicy != QueuePolicy {
+		if err := m.checkQuotas(ctx, rd, env.Name); err != nil {
+			return err
+		}
+		if m.GlobalLimit == 0 || env.IsPinned(time.Now().UTC()) {
+			return nil
+		}
+		if err := m.evictOverLimit(ctx, int(m.GlobalLimit)-1, env.Name); err != nil {
+			return fmt.Errorf("error enforcing global limit: %w", err)
+		}
+		return nil
+	}
+	if m.GlobalLimit == 0 && m.Quotas.Empty() {
+		return nil
+	}
+	queue, err := m.DL.GetQueuedEnvironments(ctx)
+	if err != nil {
+		return fmt.Errorf("error getting queued environments: %w", err)
+	}
+	envs, err := m.DL.GetRunningQAEnvironments(ctx)
+	if err != nil {
+		return fmt.Errorf("error getting running environments: %w", err)
+	}
+	tm, err := m.teamMembers(ctx)
+	if err != nil {
+		return err
+	}
+	if n := m.waitingCount(queue, envs, env.Name, tm); n > 0 {
+		return nitroerrors.User(fmt.Errorf("%v environment creates are queued waiting for capacity", n))
+	}
+	if running := runningCount(envs, env.Name); m.GlobalLimit > 0 && running >= int(m.GlobalLimit) && !env.IsPinned(time.Now().UTC()) {
+		return nitroerrors.User(fmt.Errorf("global environment limit reached (running: %v, limit: %v)", running, m.GlobalLimit))
+	}
+	if err := m.quotaExceeded(rd, envs, env.Name, tm); err != nil {
+		return nitroerrors.User(fmt.Errorf("quota exceeded: %w", err))
+	}
+	return nil
+}
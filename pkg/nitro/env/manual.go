@@ -0,0 +1,44 @@
+package env
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/dollarshaveclub/acyl/pkg/models"
+	nitroerrors "github.com/dollarshaveclub/acyl/pkg/nitro/errors"
+)
+
+// PrepareManual validates rd for a manual (non-PR) environment created from the branch rd.SourceBranch of rd.Repo, filling in
+// the revision data and generating the environment name so that rd can be passed to Create.
+func (m *Manager) PrepareManual(ctx context.Context, rd *models.RepoRevisionData) error {
+	switch {
+	case rd.Repo == "":
+		return nitroerrors.User(fmt.Errorf("repo is required"))
+	case rd.SourceBranch == "":
+		return nitroerrors.User(fmt.Errorf("ref is required"))
+	case rd.User == "":
+		return nitroerrors.User(fmt.Errorf("owner is required"))
+	case rd.TTL < 0:
+		return nitroerrors.User(fmt.Errorf("ttl must be positive: %v", rd.TTL))
+	}
+	bi, err := m.RC.GetBranch(ctx, rd.Repo, rd.SourceBranch)
+	if err != nil {
+		return nitroerrors.User(fmt.Errorf("error getting branch: %v: %v: %w", rd.Repo, rd.SourceBranch, err))
+	}
+	for repo, branch := range rd.RefOverrides {
+		if _, err := m.RC.GetBranch(ctx, repo, branch); err != nil {
+			return nitroerrors.User(fmt.Errorf("error getting ref override branch: %v: %v: %w", repo, branch, err))
+		}
+	}
+	name, err := m.NG.New()
+	if err != nil {
+		return fmt.Errorf("error generating name: %w", err)
+	}
+	rd.PullRequest = 0
+	rd.SourceSHA = bi.SHA
+	rd.SourceRef = rd.SourceBranch
+	rd.BaseBranch = rd.SourceBranch
+	rd.BaseSHA = bi.SHA
+	rd.EnvName = name
+	return nil
+}
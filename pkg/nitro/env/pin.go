@@ -0,0 +1,66 @@
+package env
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/dollarshaveclub/acyl/pkg/models"
+	nitroerrors "github.com/dollarshaveclub/acyl/pkg/nitro/errors"
+)
+
+// Pin protects an environment from global limit enforcement and age-based reaping, with an optional reason and expiration (nil for no expiration).
+// The number of pinned environments per repo is limited by MaxPinnedPerRepo.
+func (m *Manager) Pin(ctx context.Context, name, reason string, until *time.Time) error {
+	now := time.Now().UTC()
+	if until != nil && !until.After(now) {
+		return nitroerrors.User(fmt.Errorf("pin expiration must be in the future: %v", until))
+	}
+	env, err := m.DL.GetQAEnvironment(ctx, name)
+	if err != nil {
+		return fmt.Errorf("error getting environment: %w", err)
+	}
+	if env == nil {
+		return nitroerrors.User(fmt.Errorf("environment not found: %v", name))
+	}
+	if env.Status == models.Destroyed {
+		return nitroerrors.User(fmt.Errorf("environment is destroyed: %v", name))
+	}
+	if m.MaxPinnedPerRepo > 0 && !env.IsPinned(now) {
+		envs, err := m.DL.GetQAEnvironmentsByRepo(ctx, env.Repo)
+		if err != nil {
+			return fmt.Errorf("error getting environments for repo: %w", err)
+		}
+		var pinned uint
+		for _, e := range envs {
+			if e.Status != models.Destroyed && e.IsPinned(now) {
+				pinned++
+			}
+		}
+		if pinned >= m.MaxPinnedPerRepo {
+			return nitroerrors.User(fmt.Errorf("repo %v already has the maximum number of pinned environments (%v)", env.Repo, m.MaxPinnedPerRepo))
+		}
+	}
+	if err := m.DL.SetQAEnvironmentPin(ctx, name, true, reason, until); err != nil {
+		return fmt.Errorf("error pinning environment: %w", err)
+	}
+	return nil
+}
+
+// Unpin removes the pin from an environment
+func (m *Manager) Unpin(ctx context.Context, name string) error {
+	env, err := m.DL.GetQAEnvironment(ctx, name)
+	if err != nil {
+		return fmt.Errorf("error getting environment: %w", err)
+	}
+	if env == nil {
+		return nitroerrors.User(fmt.Errorf("environment not found: %v", name))
+	}
+	if !env.Pinned {
+		return nil
+	}
+	if err := m.DL.SetQAEnvironmentPin(ctx, name, false, "", nil); err != nil {
+		return fmt.Errorf("error unpinning environment: %w", err)
+	}
+	return nil
+}
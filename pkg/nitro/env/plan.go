@@ -0,0 +1,117 @@
+package env
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/dollarshaveclub/acyl/pkg/models"
+	nitroerrors "github.com/dollarshaveclub/acyl/pkg/nitro/errors"
+	"github.com/dollarshaveclub/acyl/pkg/nitro/metahelm"
+	"gopkg.in/DataDog/dd-trace-go.v1/ddtrace/tracer"
+	billyutil "gopkg.in/src-d/go-billy.v4/util"
+)
+
+// Placeholders used in chart values when planning a new environment, since the name and namespace aren't known until creation
+const (
+	PlanEnvNamePlaceholder   = "planned-env"
+	PlanNamespacePlaceholder = "nitro-planned-env"
+)
+
+// planEnv returns the extant environment that a create or update for rd would affect, or nil if there is none
+func (m *Manager) planEnv(ctx context.Context, rd *models.RepoRevisionData) (*models.QAEnvironment, error) {
+	if rd.EnvName != "" {
+		env, err := m.DL.GetQAEnvironment(ctx, rd.EnvName)
+		if err != nil {
+			return nil, fmt.Errorf("error getting environment: %w", err)
+		}
+		if env == nil {
+			return nil, nitroerrors.User(fmt.Errorf("environment not found: %v", rd.EnvName))
+		}
+		if env.Status == models.Destroyed {
+			return nil, nil
+		}
+		return env, nil
+	}
+	if rd.PullRequest == 0 {
+		return nil, nil
+	}
+	env, err := m.getenv(ctx, rd)
+	if err != nil {
+		if err == extantEnvsErr {
+			return nil, nil
+		}
+		return nil, err
+	}
+	return env, nil
+}
+
+// Plan calculates what creating or updating the environment for rd would do, without building images or touching the cluster:
+// the resolved refs, chart install order and final values of each chart, and how they differ from the extant environment (if any).
+// The extant environment is the one named rd.EnvName or, if that is empty, the environment for the repo and PR of rd.
+// If rd.SourceSHA is empty, the head of rd.SourceBranch is used.
+func (m *Manager) Plan(ctx context.Context, rd models.RepoRevisionData) (_ *models.EnvironmentPlan, err error) {
+	span, ctx := tracer.StartSpanFromContext(ctx, "plan")
+	defer func() {
+		span.Finish(tracer.WithError(err))
+	}()
+	switch {
+	case rd.Repo == "":
+		return nil, nitroerrors.User(fmt.Errorf("repo is required"))
+	case rd.SourceBranch == "":
+		return nil, nitroerrors.User(fmt.Errorf("ref is required"))
+	}
+	if rd.SourceSHA == "" {
+		bi, err := m.RC.GetBranch(ctx, rd.Repo, rd.SourceBranch)
+		if err != nil {
+			return nil, nitroerrors.User(fmt.Errorf("error getting branch: %v: %v: %w", rd.Repo, rd.SourceBranch, err))
+		}
+		rd.SourceSHA = bi.SHA
+	}
+	if rd.BaseBranch == "" {
+		rd.BaseBranch = rd.SourceBranch
+	}
+	env, err := m.planEnv(ctx, &rd)
+	if err != nil {
+		return nil, err
+	}
+	rc, err := m.getRepoConfig(ctx, &rd)
+	if err != nil {
+		return nil, nitroerrors.User(fmt.Errorf("error processing environment config: %w", err))
+	}
+	qa := &models.QAEnvironment{Name: PlanEnvNamePlaceholder, Repo: rd.Repo}
+	ns := PlanNamespacePlaceholder // a new namespace is created unless the releases are upgraded in place
+	var k8senv *models.KubernetesEnvironment
+	var releases []models.HelmRelease
+	if env != nil {
+		qa = env
+		k8senv, err = m.DL.GetK8sEnv(ctx, env.Name)
+		if err != nil {
+			return nil, fmt.Errorf("error getting k8s environment: %w", err)
+		}
+		if models.InPlaceUpgradePossible(env, k8senv, rc.ConfigSignature()) {
+			ns = k8senv.Namespace
+		}
+		releases, err = m.DL.GetHelmReleasesForEnv(ctx, env.Name)
+		if err != nil {
+			return nil, fmt.Errorf("error getting helm releases for env: %w", err)
+		}
+	}
+	td, cloc, err := m.fetchCharts(ctx, qa.Name, rc)
+	if err != nil {
+		return nil, fmt.Errorf("error fetching charts: %w", err)
+	}
+	defer billyutil.RemoveAll(m.FS, td)
+	mcloc := metahelm.ChartLocations{}
+	for k, v := range cloc {
+		mcloc[k] = metahelm.ChartLocation{
+			ChartPath:   v.ChartPath,
+			VarFilePath: v.VarFilePath,
+		}
+	}
+	plan, err := m.CI.PlanCharts(ctx, ns, &metahelm.EnvInfo{Env: qa, RC: rc}, mcloc)
+	if err != nil {
+		return nil, nitroerrors.User(fmt.Errorf("error planning charts: %w", err))
+	}
+	plan.Diff(env, k8senv, releases, rc.ConfigSignature())
+	return plan, nil
+}
@@ -0,0 +1,355 @@
+package env
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/dollarshaveclub/acyl/pkg/eventlogger"
+	"github.com/dollarshaveclub/acyl/pkg/ghapp"
+	"github.com/dollarshaveclub/acyl/pkg/models"
+	ncontext "github.com/dollarshaveclub/acyl/pkg/nitro/context"
+	"github.com/dollarshaveclub/acyl/pkg/nitro/notifier"
+	"github.com/google/uuid"
+)
+
+// GlobalLimitPolicy determines what happens to an environment create when the global environment limit has been reached
+type GlobalLimitPolicy int
+
+const (
+	// EvictOldestPolicy destroys the oldest running environments to make room for the new environment
+	EvictOldestPolicy GlobalLimitPolicy = iota
+	// QueuePolicy holds the create in a persistent, prioritized queue until capacity is available
+	QueuePolicy
+)
+
+// GlobalLimitPolicyFromString returns the GlobalLimitPolicy for s ("evict" or "queue")
+func GlobalLimitPolicyFromString(s string) (GlobalLimitPolicy, error) {
+	switch strings.ToLower(s) {
+	case "", "evict":
+		return EvictOldestPolicy, nil
+	case "queue":
+		return QueuePolicy, nil
+	default:
+		return EvictOldestPolicy, fmt.Errorf("unknown global limit policy: %v", s)
+	}
+}
+
+// QueuePriorities assigns create queue priorities by triggering repo, PR label or user. Higher priorities are dequeued first.
+type QueuePriorities struct {
+	Repos, Labels, Users map[string]int
+}
+
+// ParseQueuePriorities parses priority rules of the form "<repo|label|user>:<value>=<priority>" (ex: "label:urgent=10")
+func ParseQueuePriorities(rules []string) (QueuePriorities, error) {
+	qp := QueuePriorities{
+		Repos:  map[string]int{},
+		Labels: map[string]int{},
+		Users:  map[string]int{},
+	}
+	for _, r := range rules {
+		i := strings.LastIndex(r, "=")
+		if i == -1 {
+			return qp, fmt.Errorf("malformed queue priority (missing '='): %v", r)
+		}
+		p, err := strconv.Atoi(r[i+1:])
+		if err != nil {
+			return qp, fmt.Errorf("malformed queue priority (bad priority): %v: %w", r, err)
+		}
+		kv := strings.SplitN(r[:i], ":", 2)
+		if len(kv) != 2 || kv[1] == "" {
+			return qp, fmt.Errorf("malformed queue priority (expected <kind>:<value>): %v", r)
+		}
+		switch kv[0] {
+		case "repo":
+			qp.Repos[kv[1]] = p
+		case "label":
+			qp.Labels[kv[1]] = p
+		case "user":
+			qp.Users[kv[1]] = p
+		default:
+			return qp, fmt.Errorf("unknown queue priority kind (expected repo, label or user): %v", kv[0])
+		}
+	}
+	return qp, nil
+}
+
+// priority returns the highest priority of any rule matching rd or labels, or zero if none match
+func (qp QueuePriorities) priority(rd *models.RepoRevisionData, labels []string) int {
+	var matched bool
+	var out int
+	match := func(p int, ok bool) {
+		if ok && (!matched || p > out) {
+			matched = true
+			out = p
+		}
+	}
+	p, ok := qp.Repos[rd.Repo]
+	match(p, ok)
+	p, ok = qp.Users[rd.User]
+	match(p, ok)
+	for _, l := range labels {
+		p, ok = qp.Labels[l]
+		match(p, ok)
+	}
+	return out
+}
+
+// queuePriority calculates the create queue priority for rd, fetching PR labels only if there are label rules
+func (m *Manager) queuePriority(ctx context.Context, rd *models.RepoRevisionData) int {
+	var labels []string
+	if len(m.QueuePriorities.Labels) > 0 && rd.PullRequest > 0 {
+		l, err := m.RC.GetPRLabels(ctx, rd.Repo, rd.PullRequest)
+		if err != nil {
+			m.log(ctx, "error getting PR labels for queue priority (ignoring labels): %v", err)
+		}
+		labels = l
+	}
+	return m.QueuePriorities.priority(rd, labels)
+}
+
+// runningCount returns the number of running, unpinned environments in envs (which count against the global limit), not including exclude
+func runningCount(envs []models.QAEnvironment, exclude string) int {
+	var n int
+	for _, qa := range models.UnpinnedQAEnvironments(envs, time.Now().UTC()) {
+		if qa.Name != exclude {
+			n++
+		}
+	}
+	return n
+}
+
+// waitingCount returns the number of creates in queue (other than exclude) that are waiting for capacity under the global
+// limit, given the running environments envs and team members tm. Creates held back only by their own quotas aren't waiting for capacity.
+func (m *Manager) waitingCount(queue []models.QueuedEnvironment, envs []models.QAEnvironment, exclude string, tm models.TeamMembers) int {
+	var n int
+	for i := range queue {
+		if queue[i].EnvName != exclude && m.quotaExceeded(&queue[i].RepoRevisionData, envs, queue[i].EnvName, tm) == nil {
+			n++
+		}
+	}
+	return n
+}
+
+// queueIfAtLimit adds ne to the create queue if the global limit or an applicable quota has been reached or other creates
+// are already waiting, and returns the queue position (starting at 1), or zero if the create may proceed
+func (m *Manager) queueIfAtLimit(ctx context.Context, rd *models.RepoRevisionData, ne *newEnv) (uint, error) {
+	if m.GlobalLimit == 0 && m.Quotas.Empty() {
+		return 0, nil
+	}
+	queue, err := m.DL.GetQueuedEnvironments(ctx)
+	if err != nil {
+		return 0, fmt.Errorf("error getting queued environments: %w", err)
+	}
+	envs, err := m.DL.GetRunningQAEnvironments(ctx)
+	if err != nil {
+		return 0, fmt.Errorf("error getting running environments: %w", err)
+	}
+	tm, err := m.teamMembers(ctx)
+	if err != nil {
+		return 0, err
+	}
+	waiting := m.waitingCount(queue, envs, ne.env.Name, tm)
+	running := runningCount(envs, ne.env.Name)
+	atLimit := m.GlobalLimit > 0 && running >= int(m.GlobalLimit)
+	qerr := m.quotaExceeded(rd, envs, ne.env.Name, tm)
+	if !atLimit && qerr == nil && waiting == 0 {
+		// remove any stale entry left over from when this environment was previously queued
+		if _, err := m.DL.DequeueEnvironment(ctx, ne.env.Name); err != nil {
+			return 0, fmt.Errorf("error removing environment from queue: %w", err)
+		}
+		m.log(ctx, "global limit and quotas not reached: running: %v, limit: %v", running, m.GlobalLimit)
+		return 0, nil
+	}
+	prio := m.queuePriority(ctx, rd)
+	// the installation ID is missing (zero) for legacy webhooks and API requests
+	iid, _, _ := ghapp.GetGitHubClientValuesFromContext(ctx)
+	if err := m.DL.EnqueueEnvironment(ctx, &models.QueuedEnvironment{
+		EnvName:          ne.env.Name,
+		Enqueued:         time.Now().UTC(),
+		Priority:         prio,
+		RepoRevisionData: *rd,
+		EventID:          eventlogger.GetLogger(ctx).ID,
+		InstallationID:   iid,
+	}); err != nil {
+		return 0, fmt.Errorf("error enqueueing environment: %w", err)
+	}
+	if err := m.DL.SetQAEnvironmentStatus(ctx, ne.env.Name, models.Queued); err != nil {
+		return 0, fmt.Errorf("error setting environment status: %w", err)
+	}
+	queue, err = m.DL.GetQueuedEnvironments(ctx)
+	if err != nil {
+		return 0, fmt.Errorf("error getting queued environments: %w", err)
+	}
+	for i, qe := range queue {
+		if qe.EnvName == ne.env.Name {
+			ne.queuePosition = uint(i + 1)
+		}
+	}
+	if qerr != nil {
+		m.log(ctx, "quota exceeded (%v), queued at position %v with priority %v", qerr, ne.queuePosition, prio)
+		m.DL.AddEvent(ctx, ne.env.Name, fmt.Sprintf("queued at position %v (priority %v) until capacity is available under quota: %v", ne.queuePosition, prio, qerr))
+	} else {
+		m.log(ctx, "global limit reached (running: %v, limit: %v, waiting: %v), queued at position %v with priority %v", running, m.GlobalLimit, waiting, ne.queuePosition, prio)
+		m.DL.AddEvent(ctx, ne.env.Name, fmt.Sprintf("queued at position %v (priority %v) until capacity is available under the global limit", ne.queuePosition, prio))
+	}
+	m.pushNotification(ctx, ne, notifier.EnvironmentQueued, "")
+	m.setGithubCommitStatus(ctx, rd, ne, models.CommitStatusQueued, "")
+	// a higher priority create may have moved others back in the queue
+	m.refreshQueuePositions(ctx, ne.env.Name)
+	return ne.queuePosition, nil
+}
+
+// ProcessQueue starts queued environment creates in queue order while there is capacity under the global limit.
+// Creates that would exceed an applicable quota are skipped and remain queued.
+// It is a no-op unless the global limit policy is QueuePolicy.
+func (m *Manager) ProcessQueue(ctx context.Context) error {
+	if m.GlobalLimitPolicy != QueuePolicy {
+		return nil
+	}
+	m.queueMtx.Lock()
+	defer m.queueMtx.Unlock()
+	queue, err := m.DL.GetQueuedEnvironments(ctx)
+	if err != nil {
+		return fmt.Errorf("error getting queued environments: %w", err)
+	}
+	if len(queue) == 0 {
+		return nil
+	}
+	envs, err := m.DL.GetRunningQAEnvironments(ctx)
+	if err != nil {
+		return fmt.Errorf("error getting running environments: %w", err)
+	}
+	tm, err := m.teamMembers(ctx)
+	if err != nil {
+		return err
+	}
+	avail := len(queue)
+	if m.GlobalLimit > 0 {
+		avail = int(m.GlobalLimit) - runningCount(envs, "")
+	}
+	var started int
+	for _, qe := range queue {
+		if started >= avail {
+			break
+		}
+		if err := m.quotaExceeded(&qe.RepoRevisionData, envs, qe.EnvName, tm); err != nil {
+			m.log(ctx, "queued environment %v remains queued: quota exceeded: %v", qe.EnvName, err)
+			continue
+		}
+		ok, err := m.DL.DequeueEnvironment(ctx, qe.EnvName)
+		if err != nil {
+			return fmt.Errorf("error dequeueing environment: %v: %w", qe.EnvName, err)
+		}
+		if !ok {
+			// already dequeued by someone else
+			continue
+		}
+		// mark as spawned immediately so the environment counts against the limit before the create gets going
+		if err := m.DL.SetQAEnvironmentStatus(ctx, qe.EnvName, models.Spawned); err != nil {
+			return fmt.Errorf("error setting environment status: %v: %w", qe.EnvName, err)
+		}
+		if err := m.startQueued(ctx, qe); err != nil {
+			// put the environment back in the queue so that it is started later
+			if err2 := m.DL.EnqueueEnvironment(ctx, &qe); err2 != nil {
+				m.log(ctx, "error re-enqueueing environment: %v: %v", qe.EnvName, err2)
+			} else if err2 := m.DL.SetQAEnvironmentStatus(ctx, qe.EnvName, models.Queued); err2 != nil {
+				m.log(ctx, "error setting environment status: %v: %v", qe.EnvName, err2)
+			}
+			return fmt.Errorf("error starting queued environment: %v: %w", qe.EnvName, err)
+		}
+		started++
+		// count the started create against quotas for the rest of the queue
+		envs = append(envs, models.QAEnvironment{Name: qe.EnvName, Repo: qe.RepoRevisionData.Repo, User: qe.RepoRevisionData.User, Status: models.Spawned})
+	}
+	if started > 0 {
+		m.refreshQueuePositions(ctx, "")
+	}
+	return nil
+}
+
+// processQueueAsync runs ProcessQueue in the background, for use after an operation that may have freed capacity
+func (m *Manager) processQueueAsync(ctx context.Context) {
+	if m.GlobalLimitPolicy != QueuePolicy {
+		return
+	}
+	go func() {
+		if err := m.ProcessQueue(context.Background()); err != nil {
+			m.log(ctx, "error processing environment queue: %v", err)
+		}
+	}()
+}
+
+// queuedEventLoggerContext returns a context with an event logger that appends to the event log of the queued create
+func (m *Manager) queuedEventLoggerContext(ctx context.Context, qe models.QueuedEnvironment) context.Context {
+	return eventlogger.NewEventLoggerContext(ctx, &eventlogger.Logger{
+		ID:   qe.EventID,
+		DL:   m.DL,
+		Sink: os.Stdout,
+	})
+}
+
+// startQueued starts the create for a dequeued environment, continuing the event log of the original request. If the
+// durable operation queue is used, the create is enqueued for processing by a worker, so that it survives crashes and
+// restarts. Otherwise it is run asynchronously in this process.
+func (m *Manager) startQueued(ctx context.Context, qe models.QueuedEnvironment) error {
+	if m.DurableQueue {
+		op := &models.QueuedOperation{
+			ID:               uuid.New(),
+			Action:           models.CreateOperationAction,
+			RepoRevisionData: qe.RepoRevisionData,
+			Params:           models.OperationParams{QueueAdmitted: true},
+			EventID:          qe.EventID,
+			InstallationID:   qe.InstallationID,
+		}
+		if err := m.DL.EnqueueOperation(ctx, op); err != nil {
+			return fmt.Errorf("error enqueueing create operation: %w", err)
+		}
+		ctx = m.queuedEventLoggerContext(context.Background(), qe)
+		m.log(ctx, "capacity available, queued create of environment %v for processing by a worker (queued at %v, priority %v, operation: %v)", qe.EnvName, qe.Enqueued, qe.Priority, op.ID)
+		m.DL.AddEvent(ctx, qe.EnvName, "capacity available, starting queued create")
+		return nil
+	}
+	ctx = m.queuedEventLoggerContext(context.Background(), qe)
+	ctx = ncontext.NewQueueAdmittedContext(ctx)
+	ctx = ncontext.NewCancelFuncContext(context.WithCancel(ctx))
+	m.log(ctx, "capacity available, starting queued environment: %v (queued at %v, priority %v)", qe.EnvName, qe.Enqueued, qe.Priority)
+	m.DL.AddEvent(ctx, qe.EnvName, "capacity available, starting queued create")
+	go func() {
+		if _, err := m.Create(ctx, qe.RepoRevisionData); err != nil {
+			m.log(ctx, "error creating queued environment: %v", err)
+		}
+	}()
+	return nil
+}
+
+// refreshQueuePositions updates the commit and event statuses of all queued environments (other than exclude) with their current queue positions.
+// Statuses are rendered with the default templates since the repo config of each queued environment isn't available.
+func (m *Manager) refreshQueuePositions(ctx context.Context, exclude string) {
+	queue, err := m.DL.GetQueuedEnvironments(ctx)
+	if err != nil {
+		m.log(ctx, "error getting queued environments: %v", err)
+		return
+	}
+	for i := range queue {
+		qe := queue[i]
+		if qe.EnvName == exclude {
+			continue
+		}
+		env, err := m.DL.GetQAEnvironment(ctx, qe.EnvName)
+		if err != nil || env == nil {
+			m.log(ctx, "error getting queued environment: %v: %v", qe.EnvName, err)
+			continue
+		}
+		ne := &newEnv{
+			env:           env,
+			rc:            &models.RepoConfig{Notifications: m.DefaultNotifications},
+			queuePosition: uint(i + 1),
+		}
+		// use a fresh context so the GitHub client of the current request isn't used for other repos
+		m.setGithubCommitStatus(m.queuedEventLoggerContext(context.Background(), qe), &qe.RepoRevisionData, ne, models.CommitStatusQueued, "")
+	}
+}
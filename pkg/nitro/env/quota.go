@@ -0,0 +1,104 @@
+package env
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/dollarshaveclub/acyl/pkg/ghclient"
+	"github.com/dollarshaveclub/acyl/pkg/models"
+	nitroerrors "github.com/dollarshaveclub/acyl/pkg/nitro/errors"
+)
+
+// teamMembersTTL is how long the members of the teams with quotas are cached
+var teamMembersTTL = 5 * time.Minute
+
+// teamMembers returns the members of the teams with quotas (nil if there are no team quotas), cached for teamMembersTTL
+func (m *Manager) teamMembers(ctx context.Context) (models.TeamMembers, error) {
+	if len(m.Quotas.Teams) == 0 {
+		return nil, nil
+	}
+	m.teamsMtx.Lock()
+	defer m.teamsMtx.Unlock()
+	if m.teams != nil && time.Since(m.teamsFetched) < teamMembersTTL {
+		return m.teams, nil
+	}
+	tmc, ok := m.RC.(ghclient.TeamMembersClient)
+	if !ok {
+		return nil, fmt.Errorf("team quotas are not supported by the GitHub client")
+	}
+	tm, err := m.Quotas.TeamMembers(ctx, tmc.GetTeamMembers)
+	if err != nil {
+		return nil, fmt.Errorf("error getting quota team members: %w", err)
+	}
+	m.teams, m.teamsFetched = tm, time.Now()
+	return tm, nil
+}
+
+// quotaExceeded returns an error describing the first quota applicable to rd that has no room for another environment,
+// given the running environments envs (not including exclude) and team members tm, or nil if there is room under all applicable quotas
+func (m *Manager) quotaExceeded(rd *models.RepoRevisionData, envs []models.QAEnvironment, exclude string, tm models.TeamMembers) error {
+	return m.checkUsage(rd, envs, exclude, tm, models.QuotaUsage.Exceeded)
+}
+
+// checkUsage returns the first error returned by exceeded for the usage of the quotas applicable to rd, given the running
+// environments envs (not including exclude) and team members tm
+func (m *Manager) checkUsage(rd *models.RepoRevisionData, envs []models.QAEnvironment, exclude string, tm models.TeamMembers, exceeded func(models.QuotaUsage) error) error {
+	if m.Quotas.Empty() {
+		return nil
+	}
+	others := make([]models.QAEnvironment, 0, len(envs))
+	for _, env := range envs {
+		if env.Name != exclude {
+			others = append(others, env)
+		}
+	}
+	for _, qu := range m.Quotas.UsageFor(rd.Repo, rd.User, others, tm) {
+		m.MC.Gauge(mpfx+"quota_running", float64(qu.Running), "quota_scope:"+qu.Scope, "quota_name:"+qu.Name)
+		m.MC.Gauge(mpfx+"quota_building", float64(qu.Building), "quota_scope:"+qu.Scope, "quota_name:"+qu.Name)
+		if err := exceeded(qu); err != nil {
+			m.MC.Increment(mpfx+"quota_exceeded", "triggering_repo:"+rd.Repo, "quota_scope:"+qu.Scope)
+			return err
+		}
+	}
+	return nil
+}
+
+// checkQuotas returns a user error if creating the environment named name for rd would exceed any applicable quota
+func (m *Manager) checkQuotas(ctx context.Context, rd *models.RepoRevisionData, name string) error {
+	if m.Quotas.Empty() {
+		return nil
+	}
+	envs, err := m.DL.GetRunningQAEnvironments(ctx)
+	if err != nil {
+		return fmt.Errorf("error getting running environments: %w", err)
+	}
+	tm, err := m.teamMembers(ctx)
+	if err != nil {
+		return err
+	}
+	if err := m.quotaExceeded(rd, envs, name, tm); err != nil {
+		return nitroerrors.User(fmt.Errorf("quota exceeded: %w", err))
+	}
+	return nil
+}
+
+// checkBuildingQuota returns a user error if updating the environment named name for rd would exceed the building quota
+// of any applicable quota. The environment is already running, so the running quotas don't apply.
+func (m *Manager) checkBuildingQuota(ctx context.Context, rd *models.RepoRevisionData, name string) error {
+	if m.Quotas.Empty() {
+		return nil
+	}
+	envs, err := m.DL.GetRunningQAEnvironments(ctx)
+	if err != nil {
+		return fmt.Errorf("error getting running environments: %w", err)
+	}
+	tm, err := m.teamMembers(ctx)
+	if err != nil {
+		return err
+	}
+	if err := m.checkUsage(rd, envs, name, tm, models.QuotaUsage.BuildingExceeded); err != nil {
+		return nitroerrors.User(fmt.Errorf("quota exceeded: %w", err))
+	}
+	return nil
+}
@@ -0,0 +1,126 @@
+package env
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/dollarshaveclub/acyl/pkg/eventlogger"
+	"github.com/dollarshaveclub/acyl/pkg/models"
+	nitroerrors "github.com/dollarshaveclub/acyl/pkg/nitro/errors"
+	"github.com/dollarshaveclub/acyl/pkg/nitro/metahelm"
+	"github.com/dollarshaveclub/acyl/pkg/nitro/notifier"
+	"gopkg.in/DataDog/dd-trace-go.v1/ddtrace/tracer"
+	billyutil "gopkg.in/src-d/go-billy.v4/util"
+)
+
+// getRetryEnv returns the environment or a user error if it doesn't exist or hasn't failed
+func (m *Manager) getRetryEnv(ctx context.Context, name string) (*models.QAEnvironment, error) {
+	env, err := m.DL.GetQAEnvironment(ctx, name)
+	if err != nil {
+		return nil, fmt.Errorf("error getting environment: %w", err)
+	}
+	if env == nil {
+		return nil, nitroerrors.User(fmt.Errorf("environment not found: %v", name))
+	}
+	if env.Status != models.Failure {
+		return nil, nitroerrors.User(fmt.Errorf("environment status must be failure to retry failed charts (currently %v)", env.Status))
+	}
+	return env, nil
+}
+
+// RetryFailed retries the failed charts of a failed environment at the same revision, reusing the existing namespace and
+// the releases that were deployed successfully. Only the images that failed to build (or are missing) are rebuilt, the
+// images built by the failed operation are reused. If the environment configuration has changed since the failure the environment must be rebuilt instead.
+func (m *Manager) RetryFailed(ctx context.Context, name string) error {
+	env, err := m.getRetryEnv(ctx, name)
+	if err != nil {
+		return err
+	}
+	return m.lockingOperation(ctx, env.Repo, env.PullRequest, env.Name, func(ctx context.Context) error {
+		return m.retryFailed(ctx, name)
+	})
+}
+
+func (m *Manager) retryFailed(ctx context.Context, name string) (err error) {
+	span, ctx := tracer.StartSpanFromContext(ctx, "retry_failed")
+	defer func() {
+		span.Finish(tracer.WithError(err))
+	}()
+	// check again now that we hold the lock, the environment may have changed while waiting
+	env, err := m.getRetryEnv(ctx, name)
+	if err != nil {
+		return err
+	}
+	end := m.MC.Timing(mpfx+"retry_failed", "triggering_repo:"+env.Repo)
+	defer func() {
+		end(fmt.Sprintf("success:%v", err == nil))
+	}()
+	rd := env.RepoRevisionDataFromQA()
+	eventlogger.GetLogger(ctx).SetNewStatus(models.UpdateEvent, env.Name, *rd)
+	m.setloggername(ctx, env.Name)
+	ne := &newEnv{env: env}
+	ctx, cf := context.WithCancel(ctx)
+	defer cf()
+	go m.enforceTimeout(ctx, cf, ne)
+	defer func() {
+		if err != nil {
+			if err := m.DL.SetQAEnvironmentStatus(tracer.ContextWithSpan(context.Background(), span), env.Name, models.Failure); err != nil {
+				m.log(ctx, "error setting environment status to failed: %v", err)
+			}
+			m.pushNotification(ctx, ne, notifier.Failure, err.Error())
+			m.setGithubCommitStatus(ctx, rd, ne, models.CommitStatusFailure, err.Error())
+			eventlogger.GetLogger(ctx).SetCompletedStatus(models.FailedStatus)
+			return
+		}
+		// metahelm.Manager sets the success status on QAEnvironment
+		m.pushNotification(ctx, ne, notifier.Success, "")
+		m.setGithubCommitStatus(ctx, rd, ne, models.CommitStatusSuccess, "")
+		eventlogger.GetLogger(ctx).SetCompletedStatus(models.DoneStatus)
+	}()
+	rc, err := m.getRepoConfig(ctx, rd)
+	if err != nil {
+		return fmt.Errorf("error processing environment config: %w", err)
+	}
+	ne.rc = rc
+	eventlogger.GetLogger(ctx).SetInitialStatus(rc, 0)
+	// the retry must deploy the same commits as the failed operation, otherwise the deployed releases would be out of date
+	csm, err := rc.CommitSHAMap()
+	if err != nil {
+		return fmt.Errorf("error generating commit SHA map: %w", err)
+	}
+	for repo, sha := range csm {
+		if env.CommitSHAMap[repo] != sha {
+			return nitroerrors.User(fmt.Errorf("commit for %v has changed since the failure (%v => %v): the environment must be rebuilt", repo, env.CommitSHAMap[repo], sha))
+		}
+	}
+	k8senv, err := m.DL.GetK8sEnv(ctx, env.Name)
+	if err != nil {
+		return fmt.Errorf("error getting k8s environment: %w", err)
+	}
+	if k8senv == nil {
+		return nitroerrors.User(fmt.Errorf("environment has no namespace: the environment must be rebuilt"))
+	}
+	var sig [32]byte
+	copy(sig[:], k8senv.ConfigSignature)
+	if rc.ConfigSignature() != sig {
+		return nitroerrors.User(fmt.Errorf("environment configuration has changed since the failure: the environment must be rebuilt"))
+	}
+	m.pushNotification(ctx, ne, notifier.UpdateEnvironment, "")
+	m.setGithubCommitStatus(ctx, rd, ne, models.CommitStatusPending, "")
+	td, cloc, err := m.fetchCharts(ctx, env.Name, rc)
+	if err != nil {
+		return fmt.Errorf("error fetching charts: %w", err)
+	}
+	defer billyutil.RemoveAll(m.FS, td)
+	mcloc := metahelm.ChartLocations{}
+	for k, v := range cloc {
+		mcloc[k] = metahelm.ChartLocation{
+			ChartPath:   v.ChartPath,
+			VarFilePath: v.VarFilePath,
+		}
+	}
+	if err := m.CI.RetryFailedCharts(ctx, &metahelm.EnvInfo{Env: env, RC: rc}, k8senv, mcloc); err != nil {
+		return fmt.Errorf("error retrying failed charts: %w", err)
+	}
+	return nil
+}
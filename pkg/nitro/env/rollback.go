@@ -0,0 +1,131 @@
+package env
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/dollarshaveclub/acyl/pkg/models"
+	nitroerrors "github.com/dollarshaveclub/acyl/pkg/nitro/errors"
+	"gopkg.in/DataDog/dd-trace-go.v1/ddtrace/tracer"
+)
+
+// getRollbackEnv returns the environment or a user error if it doesn't exist or isn't in a status that can be rolled back
+func (m *Manager) getRollbackEnv(ctx context.Context, name string) (*models.QAEnvironment, error) {
+	env, err := m.DL.GetQAEnvironment(ctx, name)
+	if err != nil {
+		return nil, fmt.Errorf("error getting environment: %w", err)
+	}
+	if env == nil {
+		return nil, nitroerrors.User(fmt.Errorf("environment not found: %v", name))
+	}
+	switch env.Status {
+	case models.Success, models.Failure, models.Hibernated:
+		return env, nil
+	default:
+		return nil, nitroerrors.User(fmt.Errorf("environment status must be success, failure or hibernated to roll back (currently %v)", env.Status))
+	}
+}
+
+// Rollback returns an environment to a previous successful revision: the revision with ID revision or, if revision is zero,
+// the most recent revision that deployed different commits than are currently deployed. The Helm releases are rolled back if
+// the revision was deployed into the current namespace with the same configuration signature, otherwise the environment is
+// redeployed from the commits of the revision.
+func (m *Manager) Rollback(ctx context.Context, name string, revision int64) error {
+	env, err := m.getRollbackEnv(ctx, name)
+	if err != nil {
+		return err
+	}
+	return m.lockingOperation(ctx, env.Repo, env.PullRequest, env.Name, func(ctx context.Context) error {
+		return m.rollback(ctx, name, revision)
+	})
+}
+
+func (m *Manager) rollback(ctx context.Context, name string, revision int64) (err error) {
+	span, ctx := tracer.StartSpanFromContext(ctx, "rollback")
+	defer func() {
+		span.Finish(tracer.WithError(err))
+	}()
+	// check again now that we hold the lock, the environment may have changed while waiting
+	env, err := m.getRollbackEnv(ctx, name)
+	if err != nil {
+		return err
+	}
+	end := m.MC.Timing(mpfx+"rollback", "triggering_repo:"+env.Repo)
+	defer func() {
+		end(fmt.Sprintf("success:%v", err == nil))
+	}()
+	m.setloggername(ctx, env.Name)
+	revs, err := m.DL.GetEnvironmentRevisions(ctx, env.Name)
+	if err != nil {
+		return fmt.Errorf("error getting environment revisions: %w", err)
+	}
+	rev, err := models.RollbackRevision(revs, env.CommitSHAMap, revision)
+	if err != nil {
+		return nitroerrors.User(err)
+	}
+	rd := rev.RepoRevisionData(*env)
+	m.DL.AddEvent(ctx, env.Name, fmt.Sprintf("rolling back to revision %v (deployed %v, %v at %v)", rev.ID, rev.Created, rd.Repo, rd.SourceSHA))
+	k8senv, err := m.DL.GetK8sEnv(ctx, env.Name)
+	if err != nil {
+		return fmt.Errorf("error getting k8s environment: %w", err)
+	}
+	releases, err := m.DL.GetHelmReleasesForEnv(ctx, env.Name)
+	if err != nil {
+		return fmt.Errorf("error getting helm releases for env: %w", err)
+	}
+	if rev.HelmRollbackPossible(k8senv, releases) {
+		m.log(ctx, "revision %v was deployed into the current namespace with the same config signature: performing helm rollbacks", rev.ID)
+		err = m.helmRollback(ctx, env, k8senv, rev, rd)
+		if err == nil {
+			m.MC.Increment(mpfx+"rollback_helm", "triggering_repo:"+env.Repo)
+			return nil
+		}
+		m.log(ctx, "error performing helm rollbacks, redeploying revision instead: %v", err)
+	}
+	m.log(ctx, "redeploying revision %v", rev.ID)
+	m.MC.Increment(mpfx+"rollback_redeploy", "triggering_repo:"+env.Repo)
+	if _, err := m.update(ctx, rd); err != nil {
+		return fmt.Errorf("error redeploying revision: %w", err)
+	}
+	return nil
+}
+
+// helmRollback rolls back the Helm releases of env to rev and records the revision data rd as currently deployed
+func (m *Manager) helmRollback(ctx context.Context, env *models.QAEnvironment, k8senv *models.KubernetesEnvironment, rev *models.EnvironmentRevision, rd *models.RepoRevisionData) (err error) {
+	defer func() {
+		status := models.Success
+		if err != nil {
+			status = models.Failure
+		}
+		if err := m.DL.SetQAEnvironmentStatus(context.Background(), env.Name, status); err != nil {
+			m.log(ctx, "error setting environment status: %v", err)
+		}
+	}()
+	if err := m.DL.SetQAEnvironmentStatus(ctx, env.Name, models.Updating); err != nil {
+		return fmt.Errorf("error setting environment status: %w", err)
+	}
+	if env.Status == models.Hibernated {
+		m.log(ctx, "environment is hibernated: waking before rollback")
+		if err := m.CI.WakeNamespace(ctx, k8senv); err != nil {
+			return fmt.Errorf("error waking hibernated environment: %w", err)
+		}
+	}
+	if err := m.CI.RollbackCharts(ctx, k8senv, rev.HelmReleases); err != nil {
+		return fmt.Errorf("error rolling back charts: %w", err)
+	}
+	if err := m.DL.SetQAEnvironmentRepoData(ctx, env.Name, rd); err != nil {
+		return fmt.Errorf("error setting environment repo data: %w", err)
+	}
+	if err := m.DL.SetQAEnvironmentRefMap(ctx, env.Name, rev.RefMap); err != nil {
+		return fmt.Errorf("error setting environment ref map: %w", err)
+	}
+	if err := m.DL.SetQAEnvironmentCommitSHAMap(ctx, env.Name, rev.CommitSHAMap); err != nil {
+		return fmt.Errorf("error setting environment commit sha map: %w", err)
+	}
+	for _, hrr := range rev.HelmReleases {
+		if err := m.DL.UpdateHelmReleaseRevision(ctx, env.Name, hrr.Release, hrr.RevisionSHA); err != nil {
+			m.log(ctx, "error updating helm release revision: %v", err)
+		}
+	}
+	return nil
+}
@@ -53,6 +53,31 @@ func Cancelled(err error) error {
 	return CancelledError{User(err)}
 }
 
+// A RetriesExhaustedError wraps an underlying system error to annotate it as
+// the final failure of an operation that was already retried, so that it isn't
+// retried again by callers.
+type RetriesExhaustedError struct {
+	error
+}
+
+// Error returns err's underlying error string.
+func (err RetriesExhaustedError) Error() string {
+	return err.error.Error()
+}
+
+// Unwrap returns err's underlying error.
+func (err RetriesExhaustedError) Unwrap() error {
+	return err.error
+}
+
+// RetriesExhausted annotates err as the final failure of a retried operation.
+func RetriesExhausted(err error) error {
+	if err == nil {
+		return nil
+	}
+	return RetriesExhaustedError{err}
+}
+
 // IsUserError returns whether err is annotated as a user error.
 func IsUserError(err error) bool {
 	return errors.As(err, &UserError{})
@@ -67,3 +92,8 @@ func IsCancelledError(err error) bool {
 func IsSystemError(err error) bool {
 	return !errors.As(err, &UserError{})
 }
+
+// IsRetriesExhaustedError returns whether err is annotated as the final failure of a retried operation.
+func IsRetriesExhaustedError(err error) bool {
+	return errors.As(err, &RetriesExhaustedError{})
+}
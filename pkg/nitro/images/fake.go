@@ -49,7 +49,7 @@ func (fbb *FakeBuildBatch) Stop() {
 	}
 }
 
-func (fib *FakeImageBuilder) StartBuilds(ctx context.Context, envname string, rc *models.RepoConfig) (Batch, error) {
+func (fib *FakeImageBuilder) StartBuilds(ctx context.Context, envname string, rc *models.RepoConfig, names ...string) (Batch, error) {
 	return &FakeBuildBatch{fib.BatchCompletedFunc, fib.BatchStartedFunc, fib.BatchDoneFunc, fib.BatchStopFunc}, nil
 }
 
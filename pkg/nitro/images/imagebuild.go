@@ -29,7 +29,7 @@ type BuilderBackend interface {
 
 // Builder describes an object that builds a set of container images
 type Builder interface {
-	StartBuilds(ctx context.Context, envname string, rc *models.RepoConfig) (Batch, error)
+	StartBuilds(ctx context.Context, envname string, rc *models.RepoConfig, names ...string) (Batch, error)
 }
 
 // Batch describes a BuildBatch object
@@ -97,7 +97,8 @@ func (b *BuildBatch) Stop() {
 }
 
 // StartBuilds begins asynchronously building all container images according to rm, pushing to image repositories specified in rc.
-func (b *ImageBuilder) StartBuilds(ctx context.Context, envname string, rc *models.RepoConfig) (Batch, error) {
+// If names is not empty, only the images for those names (the application name or dependency names) are built.
+func (b *ImageBuilder) StartBuilds(ctx context.Context, envname string, rc *models.RepoConfig, names ...string) (Batch, error) {
 	batch := &BuildBatch{outcomes: &lockingOutcomes{started: make(map[string]struct{}), completed: make(map[string]error)}}
 	if envname == "" || rc == nil {
 		return batch, errors.New("at least one parameter is nil")
@@ -122,12 +123,25 @@ func (b *ImageBuilder) StartBuilds(ctx context.Context, envname string, rc *mode
 		batch.outcomes.completed[buildid(envname, name)] = nitroerrors.User(err)
 		batch.outcomes.Unlock()
 	}
+	build := func(name string) bool {
+		if len(names) == 0 {
+			return true
+		}
+		for _, n := range names {
+			if n == name {
+				return true
+			}
+		}
+		return false
+	}
 	cfs := []context.CancelFunc{}
-	ctx2, cf := context.WithTimeout(ctx, b.BuildTimeout)
-	cfs = append(cfs, cf)
-	go buildimage(ctx2, models.GetName(rc.Application.Repo), rc.Application.Repo, rc.Application.Image, rc.Application.Ref, rc.Application.DockerfilePath)
+	if build(models.GetName(rc.Application.Repo)) {
+		ctx2, cf := context.WithTimeout(ctx, b.BuildTimeout)
+		cfs = append(cfs, cf)
+		go buildimage(ctx2, models.GetName(rc.Application.Repo), rc.Application.Repo, rc.Application.Image, rc.Application.Ref, rc.Application.DockerfilePath)
+	}
 	for _, d := range rc.Dependencies.All() {
-		if d.Repo != "" { // only build images for Repo (branch-matched) dependencies
+		if d.Repo != "" && build(d.Name) { // only build images for Repo (branch-matched) dependencies
 			ctx3, cf := context.WithTimeout(ctx, b.BuildTimeout)
 			cfs = append(cfs, cf)
 			go buildimage(ctx3, d.Name, d.Repo, d.AppMetadata.Image, d.AppMetadata.Ref, d.AppMetadata.DockerfilePath)
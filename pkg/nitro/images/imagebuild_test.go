@@ -111,6 +111,52 @@ func TestImageBuilderStartBuildsError(t *testing.T) {
 	}
 }
 
+func TestImageBuilderStartBuildsNames(t *testing.T) {
+	f := func(ctx context.Context, envName, repo, imagerepo, ref string, ops BuildOptions) error {
+		return nil
+	}
+	ib := newTestBuilder(f)
+	rc := &models.RepoConfig{
+		Application: models.RepoConfigAppMetadata{
+			Repo:   "foo/bar",
+			Ref:    "abcdef",
+			Branch: "master",
+			Image:  "quay.io/foo/bar",
+		},
+		Dependencies: models.DependencyDeclaration{
+			Direct: []models.RepoConfigDependency{
+				models.RepoConfigDependency{
+					Name: "bar2",
+					Repo: "foo2/bar2",
+					AppMetadata: models.RepoConfigAppMetadata{
+						Repo:   "foo2/bar2",
+						Ref:    "abcdef",
+						Branch: "master",
+						Image:  "quay.io/foo2/bar2",
+					},
+				},
+			},
+		},
+	}
+	envname := "env-name"
+	b, err := ib.StartBuilds(context.Background(), envname, rc, "bar2")
+	if err != nil {
+		t.Fatalf("should have succeeded: %v", err)
+	}
+	defer b.Stop()
+	time.Sleep(5 * time.Millisecond)
+	if b.Started(envname, models.GetName(rc.Application.Repo)) {
+		t.Fatalf("application image should not have been built")
+	}
+	done, err := b.Completed(envname, "bar2")
+	if !done {
+		t.Fatalf("should be done")
+	}
+	if err != nil {
+		t.Fatalf("build should have succeeded: %v", err)
+	}
+}
+
 func TestImageBuilderStartBuildsDelay(t *testing.T) {
 	bc1, bc2 := make(chan struct{}), make(chan struct{})
 	f := func(ctx context.Context, envName, repo, imagerepo, ref string, ops BuildOptions) error {
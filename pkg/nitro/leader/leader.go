@@ -0,0 +1,183 @@
+package leader
+
+import (
+	"context"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/dollarshaveclub/acyl/pkg/nitro/metrics"
+	"github.com/dollarshaveclub/acyl/pkg/persistence"
+	"github.com/google/uuid"
+)
+
+// metrics prefix
+var mpfx = "leader."
+
+// Defaults for zero Elector fields
+var (
+	DefaultLeaseDuration = 30 * time.Second
+	DefaultRetryPeriod   = 10 * time.Second
+)
+
+// Elector elects a single leader among the replicas contending for the leader lease Name, and runs OnStartedLeading
+// on the leader. The leader renews the lease at a third of the lease duration and stops leading (cancelling the context
+// passed to OnStartedLeading) if the lease is lost or hasn't been renewed for two thirds of the lease duration, so that
+// it stops before another replica can acquire the expired lease. The other replicas attempt to acquire the lease every
+// RetryPeriod.
+type Elector struct {
+	DL persistence.LeaderElectionDataLayer
+	MC metrics.Collector
+	// Name identifies the lease, and therefore the role that the leader is elected for
+	Name string
+	// ID identifies the replica as the holder of the lease and must be unique among replicas (a random ID is used if empty)
+	ID string
+	// LeaseDuration is the duration of the leader lease, which is the maximum time without a leader if the leader crashes
+	LeaseDuration time.Duration
+	// RetryPeriod is the interval between attempts to acquire the lease by replicas that aren't the leader
+	RetryPeriod time.Duration
+	// OnStartedLeading is called when the replica becomes leader with a context that is cancelled when it stops leading.
+	// The replica doesn't contend for the lease again until it returns.
+	OnStartedLeading func(ctx context.Context)
+	// LogFunc is a function that logs a formatted string somewhere
+	LogFunc func(string, ...interface{})
+
+	leading int32
+	wg      sync.WaitGroup
+}
+
+func (e *Elector) log(msg string, args ...interface{}) {
+	if e.LogFunc != nil {
+		e.LogFunc("leader election: "+msg, args...)
+	}
+}
+
+func (e *Elector) setDefaults() {
+	if e.ID == "" {
+		e.ID = uuid.New().String()
+	}
+	if e.LeaseDuration == 0 {
+		e.LeaseDuration = DefaultLeaseDuration
+	}
+	if e.RetryPeriod == 0 {
+		e.RetryPeriod = DefaultRetryPeriod
+	}
+}
+
+// IsLeader returns whether this replica is currently the leader
+func (e *Elector) IsLeader() bool {
+	return atomic.LoadInt32(&e.leading) == 1
+}
+
+// Replica returns the ID of this replica
+func (e *Elector) Replica() string {
+	return e.ID
+}
+
+// Leader returns the ID of the replica that is currently the leader, or the empty string if there is no leader
+func (e *Elector) Leader(ctx context.Context) (string, error) {
+	ll, err := e.DL.GetLeaderLease(ctx, e.Name)
+	if err != nil || ll == nil {
+		return "", err
+	}
+	return ll.Holder, nil
+}
+
+// Run contends for the lease and leads while it's held until ctx is cancelled, then stops leading, waits for
+// OnStartedLeading to return and releases the lease so that another replica can take over immediately
+func (e *Elector) Run(ctx context.Context) {
+	e.setDefaults()
+	e.log("starting (id: %v, lease: %v)", e.ID, e.Name)
+	e.MC.Gauge(mpfx+"is_leader", 0, e.tags()...)
+	for {
+		if e.acquire(ctx) {
+			e.lead(ctx)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(e.RetryPeriod):
+		}
+	}
+}
+
+func (e *Elector) tags() []string {
+	return []string{"lease:" + e.Name, "replica:" + e.ID}
+}
+
+// acquire attempts to acquire or renew the lease, returning whether it's held
+func (e *Elector) acquire(ctx context.Context) bool {
+	actx, cf := context.WithTimeout(ctx, e.LeaseDuration/3)
+	defer cf()
+	ok, err := e.DL.AcquireLeaderLease(actx, e.Name, e.ID, e.LeaseDuration)
+	if err != nil {
+		if ctx.Err() == nil {
+			e.log("error acquiring lease: %v", err)
+		}
+		return false
+	}
+	return ok
+}
+
+// lead runs OnStartedLeading and renews the lease until it's lost or ctx is cancelled
+func (e *Elector) lead(ctx context.Context) {
+	e.log("acquired lease, started leading")
+	atomic.StoreInt32(&e.leading, 1)
+	e.MC.Increment(mpfx+"acquired", e.tags()...)
+	e.MC.Gauge(mpfx+"is_leader", 1, e.tags()...)
+	lctx, cf := context.WithCancel(ctx)
+	if e.OnStartedLeading != nil {
+		e.wg.Add(1)
+		go func() {
+			defer e.wg.Done()
+			e.OnStartedLeading(lctx)
+		}()
+	}
+	// the lease expires LeaseDuration after the renewal request at the earliest, so stepping down after two thirds of
+	// the duration without a successful renewal leaves a margin for OnStartedLeading to stop
+	renewed := time.Now()
+	ticker := time.NewTicker(e.LeaseDuration / 3)
+	defer ticker.Stop()
+	stop := func(reason string) {
+		cf()
+		e.wg.Wait()
+		atomic.StoreInt32(&e.leading, 0)
+		e.MC.Increment(mpfx+"lost", append(e.tags(), "reason:"+reason)...)
+		e.MC.Gauge(mpfx+"is_leader", 0, e.tags()...)
+	}
+	for {
+		select {
+		case <-ctx.Done():
+			e.log("stopping, releasing lease")
+			stop("shutdown")
+			rctx, rcf := context.WithTimeout(context.Background(), e.LeaseDuration/3)
+			defer rcf()
+			if err := e.DL.ReleaseLeaderLease(rctx, e.Name, e.ID); err != nil {
+				e.log("error releasing lease: %v", err)
+			}
+			return
+		case <-ticker.C:
+			attempt := time.Now()
+			// a hung renewal must not delay stepping down past the point where the lease may have expired
+			rctx, rcf := context.WithTimeout(ctx, e.LeaseDuration/3)
+			ok, err := e.DL.AcquireLeaderLease(rctx, e.Name, e.ID, e.LeaseDuration)
+			rcf()
+			switch {
+			case err == nil && ok:
+				renewed = attempt
+			case err == nil:
+				e.log("lease was acquired by another replica, stopped leading")
+				stop("lost")
+				return
+			case ctx.Err() != nil:
+				// shutting down
+			case time.Since(renewed) >= e.LeaseDuration*2/3:
+				e.log("lease could not be renewed, stopped leading: %v", err)
+				stop("renewal_failed")
+				return
+			default:
+				e.log("error renewing lease: %v", err)
+			}
+		}
+	}
+}
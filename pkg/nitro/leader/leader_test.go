@@ -0,0 +1,182 @@
+package leader
+
+import (
+	"context"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/dollarshaveclub/acyl/pkg/nitro/metrics"
+	"github.com/dollarshaveclub/acyl/pkg/persistence"
+)
+
+type countingCollector struct {
+	metrics.FakeCollector
+	sync.Mutex
+	counts map[string]int
+}
+
+func (cc *countingCollector) Increment(name string, tags ...string) {
+	cc.Lock()
+	defer cc.Unlock()
+	cc.counts[name]++
+}
+
+func (cc *countingCollector) count(name string) int {
+	cc.Lock()
+	defer cc.Unlock()
+	return cc.counts[name]
+}
+
+func newTestElector(dl persistence.LeaderElectionDataLayer, id string, leading chan string) *Elector {
+	return &Elector{
+		DL:            dl,
+		MC:            &countingCollector{counts: map[string]int{}},
+		Name:          "maintenance",
+		ID:            id,
+		LeaseDuration: 300 * time.Millisecond,
+		RetryPeriod:   10 * time.Millisecond,
+		OnStartedLeading: func(ctx context.Context) {
+			leading <- id
+			<-ctx.Done()
+		},
+	}
+}
+
+func waitForLeader(t *testing.T, leading chan string) string {
+	t.Helper()
+	select {
+	case id := <-leading:
+		return id
+	case <-time.After(5 * time.Second):
+		t.Fatalf("timeout waiting for leader")
+	}
+	return ""
+}
+
+func TestElectorHandover(t *testing.T) {
+	dl := persistence.NewFakeDataLayer()
+	leading := make(chan string, 2)
+	electors := map[string]*Elector{
+		"replica-1": newTestElector(dl, "replica-1", leading),
+		"replica-2": newTestElector(dl, "replica-2", leading),
+	}
+	cfs := map[string]context.CancelFunc{}
+	done := map[string]chan struct{}{}
+	for id, e := range electors {
+		ctx, cf := context.WithCancel(context.Background())
+		defer cf()
+		cfs[id], done[id] = cf, make(chan struct{})
+		go func(e *Elector, done chan struct{}) {
+			e.Run(ctx)
+			close(done)
+		}(e, done[id])
+	}
+	leader := waitForLeader(t, leading)
+	// the lease is renewed, so there is exactly one leader
+	time.Sleep(time.Second)
+	select {
+	case id := <-leading:
+		t.Fatalf("%v started leading while %v is leader", id, leader)
+	default:
+	}
+	for id, e := range electors {
+		if e.IsLeader() != (id == leader) {
+			t.Fatalf("bad leadership for %v: %v (leader: %v)", id, e.IsLeader(), leader)
+		}
+		if l, err := e.Leader(context.Background()); err != nil || l != leader {
+			t.Fatalf("bad leader reported by %v: %v: %v", id, l, err)
+		}
+	}
+	// the leader shuts down and releases the lease
+	cfs[leader]()
+	<-done[leader]
+	if electors[leader].IsLeader() {
+		t.Fatalf("stopped elector should not be leader")
+	}
+	next := waitForLeader(t, leading)
+	if next == leader {
+		t.Fatalf("leadership should have been handed over: %v", next)
+	}
+	mc := electors[leader].MC.(*countingCollector)
+	if mc.count(mpfx+"acquired") != 1 || mc.count(mpfx+"lost") != 1 {
+		t.Fatalf("bad leadership metrics: %+v", mc.counts)
+	}
+}
+
+func TestElectorLeaseLost(t *testing.T) {
+	dl := persistence.NewFakeDataLayer()
+	leading := make(chan string, 1)
+	stopped := make(chan struct{})
+	e := newTestElector(dl, "replica-1", leading)
+	e.OnStartedLeading = func(ctx context.Context) {
+		leading <- e.ID
+		<-ctx.Done()
+		close(stopped)
+	}
+	ctx, cf := context.WithCancel(context.Background())
+	defer cf()
+	go e.Run(ctx)
+	waitForLeader(t, leading)
+	// another replica takes over the lease (for example after this replica was paused for longer than the lease duration)
+	if err := dl.ReleaseLeaderLease(context.Background(), e.Name, e.ID); err != nil {
+		t.Fatalf("error releasing lease: %v", err)
+	}
+	if ok, err := dl.AcquireLeaderLease(context.Background(), e.Name, "replica-2", time.Minute); err != nil || !ok {
+		t.Fatalf("error acquiring lease: %v, %v", ok, err)
+	}
+	select {
+	case <-stopped:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("leader should have stopped leading")
+	}
+	if l, err := e.Leader(context.Background()); err != nil || l != "replica-2" {
+		t.Fatalf("bad leader: %v: %v", l, err)
+	}
+	time.Sleep(50 * time.Millisecond)
+	if e.IsLeader() {
+		t.Fatalf("should not be leader")
+	}
+}
+
+// hangingDataLayer blocks lease acquisitions until the context is cancelled once hang is set, like a database that
+// stopped responding
+type hangingDataLayer struct {
+	persistence.LeaderElectionDataLayer
+	hang int32
+}
+
+func (hdl *hangingDataLayer) AcquireLeaderLease(ctx context.Context, name, holder string, lease time.Duration) (bool, error) {
+	if atomic.LoadInt32(&hdl.hang) == 1 {
+		<-ctx.Done()
+		return false, ctx.Err()
+	}
+	return hdl.LeaderElectionDataLayer.AcquireLeaderLease(ctx, name, holder, lease)
+}
+
+func TestElectorRenewalHangs(t *testing.T) {
+	dl := &hangingDataLayer{LeaderElectionDataLayer: persistence.NewFakeDataLayer()}
+	leading := make(chan string, 1)
+	stopped := make(chan struct{})
+	e := newTestElector(dl, "replica-1", leading)
+	e.OnStartedLeading = func(ctx context.Context) {
+		leading <- e.ID
+		<-ctx.Done()
+		close(stopped)
+	}
+	ctx, cf := context.WithCancel(context.Background())
+	defer cf()
+	go e.Run(ctx)
+	waitForLeader(t, leading)
+	hung := time.Now()
+	atomic.StoreInt32(&dl.hang, 1)
+	select {
+	case <-stopped:
+		if time.Since(hung) >= e.LeaseDuration+e.LeaseDuration/3 {
+			t.Fatalf("leader should have stopped leading before the lease expired: %v", time.Since(hung))
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("leader should have stopped leading")
+	}
+}
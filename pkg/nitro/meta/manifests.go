@@ -0,0 +1,177 @@
+package meta
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/dollarshaveclub/acyl/pkg/ghclient"
+	"github.com/dollarshaveclub/acyl/pkg/models"
+	nitroerrors "github.com/dollarshaveclub/acyl/pkg/nitro/errors"
+	billy "gopkg.in/src-d/go-billy.v4"
+	yaml "gopkg.in/yaml.v2"
+	"sigs.k8s.io/kustomize/api/krusty"
+	"sigs.k8s.io/kustomize/kyaml/filesys"
+)
+
+// Substitution tokens that may be used within raw manifests and kustomizations.
+// They are replaced with the corresponding chart values at install/upgrade time.
+const (
+	ManifestNamespaceToken = "${ACYL_NAMESPACE}"
+	ManifestEnvNameToken   = "${ACYL_ENV_NAME}"
+	ManifestImageTagToken  = "${ACYL_IMAGE_TAG}"
+)
+
+// manifestsFile is the path within the generated chart of the rendered manifests
+const manifestsFile = "files/manifests.yaml"
+
+// manifestsChartTemplate renders the manifests file verbatim (no Helm templating is applied to the manifests themselves)
+// other than replacing the substitution tokens with the namespace, env name and image tag chart values
+var manifestsChartTemplate = `{{- .Files.Get "` + manifestsFile + `"` +
+	` | replace "` + ManifestNamespaceToken + `" (toString .Values.` + models.DefaultNamespaceValue + `)` +
+	` | replace "` + ManifestEnvNameToken + `" (toString .Values.` + models.DefaultEnvNameValue + `)` +
+	` | replace "` + ManifestImageTagToken + `" (toString .Values.` + models.DefaultChartTagValue + `) }}
+`
+
+const manifestsChartValues = models.DefaultNamespaceValue + `: ""
+` + models.DefaultEnvNameValue + `: ""
+image:
+  tag: ""
+`
+
+// fetchManifestsChart fetches the raw manifests or kustomization for d, renders them to a single YAML stream
+// and writes a generated Helm chart containing the result to cd. Wrapping manifests in a chart allows them to be
+// installed, upgraded, waited on and deleted exactly like any other chart in the environment.
+func (g DataGetter) fetchManifestsChart(ctx context.Context, d models.RepoConfigDependency, cd string) error {
+	mpath, kustomize := d.AppMetadata.ManifestsPath, false
+	if d.AppMetadata.KustomizePath != "" {
+		mpath, kustomize = d.AppMetadata.KustomizePath, true
+	}
+	log(ctx, "getting directory contents: %v@%v: %v", d.AppMetadata.Repo, d.AppMetadata.Ref, mpath)
+	dc, err := g.RC.GetDirectoryContents(ctx, d.AppMetadata.Repo, mpath, d.AppMetadata.Ref)
+	if err != nil {
+		return fmt.Errorf("error fetching manifests contents: %w", err)
+	}
+	var rendered []byte
+	if kustomize {
+		rendered, err = renderKustomization(dc, mpath)
+	} else {
+		rendered, err = renderManifests(dc)
+	}
+	if err != nil {
+		return fmt.Errorf("error rendering manifests: %v: %w", mpath, err)
+	}
+	if err := validateManifests(rendered); err != nil {
+		return fmt.Errorf("error validating manifests: %v: %w", mpath, err)
+	}
+	chartyaml := fmt.Sprintf("apiVersion: v2\nname: %v\nversion: 0.1.0\ndescription: generated by acyl from %v@%v:%v\n", d.Name, d.AppMetadata.Repo, d.AppMetadata.Ref, mpath)
+	for fp, contents := range map[string][]byte{
+		"Chart.yaml":               []byte(chartyaml),
+		"values.yaml":              []byte(manifestsChartValues),
+		"templates/manifests.yaml": []byte(manifestsChartTemplate),
+		manifestsFile:              rendered,
+	} {
+		if err := writeFile(g.FS, path.Join(cd, fp), contents); err != nil {
+			return fmt.Errorf("error writing generated chart file: %v: %w", fp, err)
+		}
+	}
+	return nil
+}
+
+func isManifestFile(name string) bool {
+	switch strings.ToLower(filepath.Ext(name)) {
+	case ".yaml", ".yml", ".json":
+		return true
+	}
+	return false
+}
+
+// renderManifests concatenates all YAML and JSON files in dc (in lexical path order) into a single YAML stream
+func renderManifests(dc map[string]ghclient.FileContents) ([]byte, error) {
+	paths := []string{}
+	for n, c := range dc {
+		if c.Symlink || !isManifestFile(n) {
+			continue
+		}
+		paths = append(paths, n)
+	}
+	if len(paths) == 0 {
+		return nil, nitroerrors.User(errors.New("no manifest files (.yaml, .yml or .json) found"))
+	}
+	sort.Strings(paths)
+	buf := &bytes.Buffer{}
+	for _, p := range paths {
+		buf.WriteString("---\n# Source: " + p + "\n")
+		buf.Write(bytes.TrimSpace(dc[p].Contents))
+		buf.WriteString("\n")
+	}
+	return buf.Bytes(), nil
+}
+
+// renderKustomization builds the kustomization at kpath using the contents of dc.
+// Only resources within the fetched directory are available; remote bases are not supported.
+func renderKustomization(dc map[string]ghclient.FileContents, kpath string) ([]byte, error) {
+	fs := filesys.MakeFsInMemory()
+	for n, c := range dc {
+		if c.Symlink {
+			continue
+		}
+		fp := path.Join("/", n)
+		if err := fs.MkdirAll(path.Dir(fp)); err != nil {
+			return nil, fmt.Errorf("error creating directory: %w", err)
+		}
+		if err := fs.WriteFile(fp, c.Contents); err != nil {
+			return nil, fmt.Errorf("error writing file: %w", err)
+		}
+	}
+	rm, err := krusty.MakeKustomizer(krusty.MakeDefaultOptions()).Run(fs, path.Join("/", kpath))
+	if err != nil {
+		return nil, nitroerrors.User(fmt.Errorf("error building kustomization: %w", err))
+	}
+	out, err := rm.AsYaml()
+	if err != nil {
+		return nil, fmt.Errorf("error serializing kustomization output: %w", err)
+	}
+	return out, nil
+}
+
+// validateManifests checks that b is a well-formed YAML stream
+func validateManifests(b []byte) error {
+	dec := yaml.NewDecoder(bytes.NewReader(b))
+	for {
+		var v interface{}
+		err := dec.Decode(&v)
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return nitroerrors.User(fmt.Errorf("malformed YAML: %w", err))
+		}
+	}
+}
+
+func writeFile(fs billy.Filesystem, fp string, contents []byte) error {
+	if err := fs.MkdirAll(path.Dir(fp), os.ModePerm); err != nil {
+		return fmt.Errorf("error creating directory: %w", err)
+	}
+	f, err := fs.Create(fp)
+	if err != nil {
+		return fmt.Errorf("error creating file: %w", err)
+	}
+	defer f.Close()
+	n, err := f.Write(contents)
+	if err != nil {
+		return fmt.Errorf("error writing to file: %w", err)
+	}
+	if n < len(contents) {
+		return io.ErrShortWrite
+	}
+	return nil
+}
@@ -63,6 +63,12 @@ func (g DataGetter) GetAcylYAML(ctx context.Context, rc *models.RepoConfig, repo
 	if rc.Version < 2 {
 		return nitroerrors.User(ErrUnsupportedVersion)
 	}
+	if _, err := rc.TTLDuration(); err != nil {
+		return err
+	}
+	if _, err := rc.Reaper.Policy(); err != nil {
+		return err
+	}
 	rc.Application.SetValueDefaults()
 	rc.Application.Repo = repo
 	rc.Application.Ref = ref
@@ -133,6 +139,10 @@ func (g DataGetter) getRefForRepoDependency(ctx context.Context, d *models.RepoC
 	if d == nil || d.Repo == "" {
 		return "", "", nitroerrors.User(errors.New("empty Repo field"))
 	}
+	// cloned environments pin dependencies to the exact commits of the source environment
+	if sha, ok := rd.CommitSHAOverrides[d.Repo]; ok {
+		return sha, rd.RefOverrides[d.Repo], nil
+	}
 	log(ctx, "fetching branches for %v", d.Repo)
 	branches, err := g.RC.GetBranches(ctx, d.Repo)
 	if err != nil {
@@ -142,6 +152,15 @@ func (g DataGetter) getRefForRepoDependency(ctx context.Context, d *models.RepoC
 	for i := range branches {
 		bi[i] = match.BranchInfo{Name: branches[i].Name, SHA: branches[i].SHA}
 	}
+	// manual environments may explicitly choose the dependency branch instead of using branch matching
+	if ob, ok := rd.RefOverrides[d.Repo]; ok {
+		for _, b := range bi {
+			if b.Name == ob {
+				return b.SHA, b.Name, nil
+			}
+		}
+		return "", "", nitroerrors.User(fmt.Errorf("ref override branch not found: %v: %v", d.Repo, ob))
+	}
 	defb := rd.BaseBranch
 	if d.DefaultBranch != "" {
 		defb = d.DefaultBranch
@@ -217,6 +236,8 @@ func (g DataGetter) Get(ctx context.Context, rd models.RepoRevisionData) (*model
 			break
 		}
 		switch {
+		case d.Manifests() && (d.Repo != "" || d.ChartPath != "" || d.ChartRepoPath != "" || (d.ManifestsPath != "" && d.KustomizePath != "")):
+			return nitroerrors.User(fmt.Errorf("dependency error: %v: only one of Repo, ChartPath, ChartRepoPath, ManifestsPath or KustomizePath may be used", d.Name))
 		case d.Repo != "" && (d.ChartPath != "" || d.ChartRepoPath != ""):
 			return nitroerrors.User(fmt.Errorf("dependency error: %v: only one of Repo, ChartPath, or ChartRepoPath may be used", d.Name))
 		case d.ChartPath != "" && d.ChartRepoPath != "":
@@ -301,8 +322,24 @@ func (g DataGetter) Get(ctx context.Context, rd models.RepoRevisionData) (*model
 				}
 				d.Name = name
 			}
+		case d.Manifests():
+			switch {
+			case d.Name == "":
+				return nitroerrors.User(errors.New("dependency error: name is required if ManifestsPath or KustomizePath is used"))
+			case d.DisableBranchMatch || d.DefaultBranch != "":
+				return nitroerrors.User(fmt.Errorf("branch matching and default branch not available if ManifestsPath or KustomizePath is used: %v", d.Name))
+			case d.ChartVarsPath != "" || d.ChartVarsRepoPath != "":
+				return nitroerrors.User(fmt.Errorf("chart vars not available if ManifestsPath or KustomizePath is used (use value_overrides): %v", d.Name))
+			}
+			d.AppMetadata = models.RepoConfigAppMetadata{
+				Repo:          parent.AppMetadata.Repo,
+				Ref:           parent.AppMetadata.Ref,
+				Branch:        parent.AppMetadata.Branch,
+				ManifestsPath: d.ManifestsPath,
+				KustomizePath: d.KustomizePath,
+			}
 		default:
-			return fmt.Errorf("dependency error: %v: exactly one of Repo, ChartPath, or ChartRepoPath must be used", d.Name)
+			return fmt.Errorf("dependency error: %v: exactly one of Repo, ChartPath, ChartRepoPath, ManifestsPath or KustomizePath must be used", d.Name)
 		}
 		d.AppMetadata.SetValueDefaults()
 		return nil
@@ -429,6 +466,14 @@ func (g DataGetter) FetchCharts(ctx context.Context, rc *models.RepoConfig, base
 		}()
 		log(ctx, "fetching chart and vars for dependency: %v", d.Name)
 		out := &ChartLocation{ValueOverrides: make(map[string]string)}
+		if d.AppMetadata.ManifestsPath != "" || d.AppMetadata.KustomizePath != "" {
+			cd := path.Join(basePath, strconv.Itoa(i), d.Name)
+			if err := g.fetchManifestsChart(ctx, d, cd); err != nil {
+				return nil, fmt.Errorf("error fetching manifests: %w", err)
+			}
+			out.ChartPath = cd
+			return out, nil
+		}
 		cloc, err := getChartLocation(d)
 		if err != nil {
 			return nil, fmt.Errorf("error getting chart location: %w", err)
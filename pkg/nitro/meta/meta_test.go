@@ -12,6 +12,9 @@ import (
 	"github.com/dollarshaveclub/acyl/pkg/memfs"
 	"github.com/dollarshaveclub/acyl/pkg/models"
 	"github.com/pkg/errors"
+	"helm.sh/helm/v3/pkg/chart/loader"
+	"helm.sh/helm/v3/pkg/chartutil"
+	"helm.sh/helm/v3/pkg/engine"
 )
 
 func readFiles() (map[string][]byte, error) {
@@ -165,6 +168,35 @@ func TestMetaGetterGetV2(t *testing.T) {
 	} else {
 		t.Fatalf("acme-sprockets-repo-transitive missing from deps")
 	}
+
+	// ref overrides (manual environments) replace branch matching
+	rd.RefOverrides = map[string]string{"acme/widgets": "master"}
+	rcfg, err = g.Get(context.Background(), rd)
+	if err != nil {
+		t.Fatalf("should have succeeded with ref override: %v", err)
+	}
+	for _, d := range rcfg.Dependencies.Direct {
+		if d.Repo == "acme/widgets" && (d.AppMetadata.Branch != "master" || d.AppMetadata.Ref != "1234") {
+			t.Fatalf("widgets: ref override not used: %v (%v)", d.AppMetadata.Branch, d.AppMetadata.Ref)
+		}
+	}
+	rd.RefOverrides = map[string]string{"acme/widgets": "missing"}
+	if _, err := g.Get(context.Background(), rd); err == nil {
+		t.Fatalf("should have failed with missing ref override branch")
+	}
+
+	// commit SHA overrides (cloned environments) pin the exact commit
+	rd.RefOverrides = map[string]string{"acme/widgets": "master"}
+	rd.CommitSHAOverrides = map[string]string{"acme/widgets": "5678"}
+	rcfg, err = g.Get(context.Background(), rd)
+	if err != nil {
+		t.Fatalf("should have succeeded with commit sha override: %v", err)
+	}
+	for _, d := range rcfg.Dependencies.Direct {
+		if d.Repo == "acme/widgets" && (d.AppMetadata.Branch != "master" || d.AppMetadata.Ref != "5678") {
+			t.Fatalf("widgets: commit sha override not used: %v (%v)", d.AppMetadata.Branch, d.AppMetadata.Ref)
+		}
+	}
 }
 
 func TestMetaGetterGetV1(t *testing.T) {
@@ -400,3 +432,194 @@ func TestMetaGetChartLocation(t *testing.T) {
 		})
 	}
 }
+
+func TestMetaGetterFetchManifests(t *testing.T) {
+	deployment := `apiVersion: apps/v1
+kind: Deployment
+metadata:
+  name: foo
+  labels:
+    env: ${ACYL_ENV_NAME}
+spec:
+  template:
+    spec:
+      containers:
+        - name: foo
+          image: "foo/bar:${ACYL_IMAGE_TAG}"
+`
+	service := `apiVersion: v1
+kind: Service
+metadata:
+  name: foo
+  annotations:
+    url: "http://foo.${ACYL_NAMESPACE}.svc"
+`
+	rc := &ghclient.FakeRepoClient{
+		GetDirectoryContentsFunc: func(ctx context.Context, repo string, path string, ref string) (map[string]ghclient.FileContents, error) {
+			switch path {
+			case ".chart/foo":
+				return map[string]ghclient.FileContents{
+					".chart/foo/Chart.yaml": ghclient.FileContents{Contents: []byte("name: foo")},
+				}, nil
+			case "k8s/raw":
+				return map[string]ghclient.FileContents{
+					"k8s/raw/b-service.yaml":    ghclient.FileContents{Contents: []byte(service)},
+					"k8s/raw/a-deployment.yaml": ghclient.FileContents{Contents: []byte(deployment)},
+					"k8s/raw/README.md":         ghclient.FileContents{Contents: []byte("not a manifest")},
+				}, nil
+			case "k8s/kustomize":
+				return map[string]ghclient.FileContents{
+					"k8s/kustomize/kustomization.yaml": ghclient.FileContents{Contents: []byte("namePrefix: kust-\nresources:\n- service.yaml\n")},
+					"k8s/kustomize/service.yaml":       ghclient.FileContents{Contents: []byte(service)},
+				}, nil
+			case "k8s/empty":
+				return map[string]ghclient.FileContents{}, nil
+			default:
+				t.Fatalf("bad path for repo: %v: %v", repo, path)
+			}
+			return nil, nil
+		},
+	}
+	bp := "/tmp/foo"
+	mfs := memfs.New()
+	g := DataGetter{
+		RC: rc,
+		FS: mfs,
+	}
+	pmd := models.RepoConfigAppMetadata{
+		Repo:      "foo/bar",
+		Ref:       "asdf",
+		ChartPath: ".chart/foo",
+	}
+	rcfg := &models.RepoConfig{
+		Application: pmd,
+		Dependencies: models.DependencyDeclaration{
+			Direct: []models.RepoConfigDependency{
+				models.RepoConfigDependency{
+					Name:          "raw",
+					ManifestsPath: "k8s/raw",
+					AppMetadata:   models.RepoConfigAppMetadata{Repo: "foo/bar", Ref: "asdf", ManifestsPath: "k8s/raw"},
+				},
+				models.RepoConfigDependency{
+					Name:          "kust",
+					KustomizePath: "k8s/kustomize",
+					AppMetadata:   models.RepoConfigAppMetadata{Repo: "foo/bar", Ref: "asdf", KustomizePath: "k8s/kustomize"},
+				},
+			},
+		},
+	}
+	d, err := g.FetchCharts(context.Background(), rcfg, bp)
+	if err != nil {
+		t.Fatalf("should have succeeded: %v", err)
+	}
+	if len(d) != 3 {
+		t.Fatalf("bad length (wanted 3): %v", len(d))
+	}
+
+	// the generated charts must render with the substitution tokens replaced
+	render := func(name string) string {
+		files := []*loader.BufferedFile{}
+		for _, fp := range []string{"Chart.yaml", "values.yaml", "templates/manifests.yaml", "files/manifests.yaml"} {
+			f, err := mfs.Open(d[name].ChartPath + "/" + fp)
+			if err != nil {
+				t.Fatalf("%v: error opening %v: %v", name, fp, err)
+			}
+			b, _ := ioutil.ReadAll(f)
+			f.Close()
+			files = append(files, &loader.BufferedFile{Name: fp, Data: b})
+		}
+		c, err := loader.LoadFiles(files)
+		if err != nil {
+			t.Fatalf("%v: error loading chart: %v", name, err)
+		}
+		vals := map[string]interface{}{"namespace": "nitro-1234-foo-bar", "env_name": "foo-bar", "image": map[string]interface{}{"tag": "asdf"}}
+		rv, err := chartutil.ToRenderValues(c, vals, chartutil.ReleaseOptions{Name: name, Namespace: "nitro-1234-foo-bar"}, nil)
+		if err != nil {
+			t.Fatalf("%v: error getting render values: %v", name, err)
+		}
+		out, err := engine.Render(c, rv)
+		if err != nil {
+			t.Fatalf("%v: error rendering chart: %v", name, err)
+		}
+		return out[name+"/templates/manifests.yaml"]
+	}
+	raw := render("raw")
+	for _, s := range []string{"env: foo-bar", `image: "foo/bar:asdf"`, `url: "http://foo.nitro-1234-foo-bar.svc"`} {
+		if !strings.Contains(raw, s) {
+			t.Fatalf("raw manifests missing %v: %v", s, raw)
+		}
+	}
+	if strings.Contains(raw, "not a manifest") {
+		t.Fatalf("non-manifest file should have been skipped: %v", raw)
+	}
+	if strings.Index(raw, "kind: Deployment") > strings.Index(raw, "kind: Service") {
+		t.Fatalf("manifests should be in path order: %v", raw)
+	}
+	kust := render("kust")
+	if !strings.Contains(kust, "name: kust-foo") || !strings.Contains(kust, "foo.nitro-1234-foo-bar.svc") {
+		t.Fatalf("bad kustomize output: %v", kust)
+	}
+
+	rcfg.Dependencies.Direct = []models.RepoConfigDependency{
+		models.RepoConfigDependency{
+			Name:          "empty",
+			ManifestsPath: "k8s/empty",
+			AppMetadata:   models.RepoConfigAppMetadata{Repo: "foo/bar", Ref: "asdf", ManifestsPath: "k8s/empty"},
+		},
+	}
+	if _, err := g.FetchCharts(context.Background(), rcfg, bp); err == nil || !strings.Contains(err.Error(), "no manifest files") {
+		t.Fatalf("should have failed with no manifests: %v", err)
+	}
+}
+
+func TestMetaGetterGetManifestDependencies(t *testing.T) {
+	cases := []struct {
+		name, deps, errContains string
+	}{
+		{"valid", "    - name: raw\n      manifests_path: k8s/raw\n    - name: kust\n      kustomize_path: k8s/overlays/qa\n      requires:\n        - raw\n", ""},
+		{"missing name", "    - manifests_path: k8s/raw\n", "name is required"},
+		{"manifests and chart", "    - name: raw\n      manifests_path: k8s/raw\n      chart_path: .charts/raw\n", "only one of"},
+		{"manifests and kustomize", "    - name: raw\n      manifests_path: k8s/raw\n      kustomize_path: k8s/raw\n", "only one of"},
+		{"chart vars", "    - name: raw\n      manifests_path: k8s/raw\n      chart_vars_path: vars.yml\n", "chart vars not available"},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			acylyml := "version: 2\napplication:\n  chart_path: .charts/foo\n  image: foo/bar\ndependencies:\n  direct:\n" + c.deps
+			g := DataGetter{
+				RC: &ghclient.FakeRepoClient{
+					GetFileContentsFunc: func(ctx context.Context, repo string, path string, ref string) ([]byte, error) {
+						if path == "acyl.yml" {
+							return []byte(acylyml), nil
+						}
+						return nil, fmt.Errorf("unexpected path: %v", path)
+					},
+				},
+			}
+			rd := models.RepoRevisionData{Repo: "foo/bar", SourceBranch: "foo", BaseBranch: "master", SourceSHA: "zzzzz", PullRequest: 1}
+			rcfg, err := g.Get(context.Background(), rd)
+			if c.errContains != "" {
+				if err == nil || !strings.Contains(err.Error(), c.errContains) {
+					t.Fatalf("should have failed with %v: %v", c.errContains, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("should have succeeded: %v", err)
+			}
+			for _, d := range rcfg.Dependencies.Direct {
+				if !d.Manifests() || d.BranchMatchable() {
+					t.Fatalf("%v: expected manifests dependency", d.Name)
+				}
+				if d.AppMetadata.Repo != "foo/bar" || d.AppMetadata.Ref != "zzzzz" || d.AppMetadata.Branch != "foo" {
+					t.Fatalf("%v: bad app metadata: %+v", d.Name, d.AppMetadata)
+				}
+				if d.AppMetadata.ManifestsPath != d.ManifestsPath || d.AppMetadata.KustomizePath != d.KustomizePath {
+					t.Fatalf("%v: paths not copied to app metadata: %+v", d.Name, d.AppMetadata)
+				}
+			}
+			if _, err := rcfg.RefMap(); err != nil {
+				t.Fatalf("refmap should have succeeded: %v", err)
+			}
+		})
+	}
+}
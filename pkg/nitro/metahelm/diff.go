@@ -0,0 +1,248 @@
+package metahelm
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"reflect"
+	"sort"
+	"strings"
+
+	"github.com/dollarshaveclub/acyl/pkg/eventlogger"
+	"github.com/dollarshaveclub/metahelm/pkg/metahelm"
+	"github.com/ghodss/yaml"
+	"github.com/pmezard/go-difflib/difflib"
+	"helm.sh/helm/v3/pkg/action"
+	"helm.sh/helm/v3/pkg/storage/driver"
+)
+
+const (
+	redactedValue        = "<redacted>"
+	redactedChangedValue = "<redacted, changed>"
+	// maxManifestDiffLen is the maximum length of a diff written to the event log and status, longer diffs are truncated
+	maxManifestDiffLen = 64 * 1024
+)
+
+// releaseManifestFunc returns the rendered manifest of the current Helm revision of a release
+type releaseManifestFunc func(release string) (string, error)
+
+// helmReleaseManifest returns a releaseManifestFunc that queries Helm using the configuration of mhm
+func helmReleaseManifest(mhm *metahelm.Manager) releaseManifestFunc {
+	return func(release string) (string, error) {
+		rel, err := action.NewGet(mhm.HCfg).Run(release)
+		if err != nil {
+			return "", err
+		}
+		return rel.Manifest, nil
+	}
+}
+
+// releaseManifests returns the current rendered manifests of releases (chart title to release name), keyed by chart title.
+// Releases for which the manifest cannot be retrieved (including releases that don't exist yet) are omitted.
+func (ci ChartInstaller) releaseManifests(ctx context.Context, releases map[string]string, manifest releaseManifestFunc) map[string]string {
+	out := make(map[string]string, len(releases))
+	for title, release := range releases {
+		m, err := manifest(release)
+		if errors.Is(err, driver.ErrReleaseNotFound) {
+			continue // it will be installed, so there's nothing to diff
+		}
+		if err != nil {
+			ci.log(ctx, "error getting manifest for release %v (%v), diff will not be available: %v", release, title, err)
+			continue
+		}
+		out[title] = m
+	}
+	return out
+}
+
+// logReleaseDiffs compares the current rendered manifests of releases with the manifests in before (chart title to manifest,
+// from prior to an upgrade) and writes the redacted diff for each release to the event log and event status
+func (ci ChartInstaller) logReleaseDiffs(ctx context.Context, releases map[string]string, before map[string]string, manifest releaseManifestFunc) {
+	titles := make([]string, 0, len(before))
+	for title := range before {
+		titles = append(titles, title)
+	}
+	sort.Strings(titles)
+	for _, title := range titles {
+		release := releases[title]
+		m, err := manifest(release)
+		if err != nil {
+			ci.log(ctx, "error getting manifest for release %v (%v), diff will not be available: %v", release, title, err)
+			continue
+		}
+		diff, err := manifestDiff(before[title], m)
+		if err != nil {
+			ci.log(ctx, "error calculating manifest diff for release %v (%v): %v", release, title, err)
+			continue
+		}
+		if len(diff) > maxManifestDiffLen {
+			diff = diff[:maxManifestDiffLen] + "\n... (diff truncated)\n"
+		}
+		ci.log(ctx, "release %v (%v) changes:\n%v", release, title, diff)
+		eventlogger.GetLogger(ctx).SetChartDiff(title, diff)
+	}
+}
+
+// manifestResource is a single object of a rendered release manifest
+type manifestResource struct {
+	id  string // kind/namespace/name
+	obj map[string]interface{}
+}
+
+// parseManifest splits a rendered release manifest into its objects
+func parseManifest(manifest string) ([]manifestResource, error) {
+	out := []manifestResource{}
+	for _, doc := range strings.Split("\n"+manifest, "\n---") {
+		obj := map[string]interface{}{}
+		if err := yaml.Unmarshal([]byte(doc), &obj); err != nil {
+			return nil, fmt.Errorf("error unmarshaling manifest object: %w", err)
+		}
+		if len(obj) == 0 {
+			continue
+		}
+		kind, _ := obj["kind"].(string)
+		var ns, name string
+		if md, ok := obj["metadata"].(map[string]interface{}); ok {
+			ns, _ = md["namespace"].(string)
+			name, _ = md["name"].(string)
+		}
+		out = append(out, manifestResource{id: kind + "/" + ns + "/" + name, obj: obj})
+	}
+	sort.SliceStable(out, func(i, j int) bool { return out[i].id < out[j].id })
+	return out, nil
+}
+
+// redactSecrets replaces the values of the data and stringData of Secret objects in resources. Values that differ from
+// the same key of the same Secret in old (if not nil) are marked as changed, so that a diff shows which keys changed.
+func redactSecrets(resources []manifestResource, old []manifestResource) {
+	oldobjs := make(map[string]map[string]interface{}, len(old))
+	for _, r := range old {
+		oldobjs[r.id] = r.obj
+	}
+	for _, r := range resources {
+		if r.obj["kind"] != "Secret" {
+			continue
+		}
+		for _, field := range []string{"data", "stringData"} {
+			data, ok := r.obj[field].(map[string]interface{})
+			if !ok {
+				continue
+			}
+			var olddata map[string]interface{}
+			if oo, ok := oldobjs[r.id]; ok {
+				olddata, _ = oo[field].(map[string]interface{})
+			}
+			for k, v := range data {
+				if ov, ok := olddata[k]; ok && !reflect.DeepEqual(ov, v) {
+					data[k] = redactedChangedValue
+					continue
+				}
+				data[k] = redactedValue
+			}
+		}
+	}
+}
+
+// stripImages removes all container image references from obj (in place) and returns them
+func stripImages(obj interface{}) []string {
+	images := []string{}
+	switch v := obj.(type) {
+	case map[string]interface{}:
+		for k, val := range v {
+			if s, ok := val.(string); ok && k == "image" {
+				images = append(images, s)
+				v[k] = ""
+				continue
+			}
+			images = append(images, stripImages(val)...)
+		}
+	case []interface{}:
+		for _, val := range v {
+			images = append(images, stripImages(val)...)
+		}
+	}
+	return images
+}
+
+// imageTagChanges returns a compact summary of the image changes between old and new if those are the only differences
+// between them, or an empty string otherwise. old and new are modified.
+func imageTagChanges(old, new []manifestResource) string {
+	if len(old) != len(new) {
+		return ""
+	}
+	changes := map[string]struct{}{}
+	for i := range old {
+		if old[i].id != new[i].id {
+			return ""
+		}
+		oi, ni := stripImages(old[i].obj), stripImages(new[i].obj)
+		if len(oi) != len(ni) || !reflect.DeepEqual(old[i].obj, new[i].obj) {
+			return ""
+		}
+		sort.Strings(oi)
+		sort.Strings(ni)
+		for j := range oi {
+			if oi[j] != ni[j] {
+				changes[fmt.Sprintf("image tag changed: %v => %v", oi[j], ni[j])] = struct{}{}
+			}
+		}
+	}
+	if len(changes) == 0 {
+		return ""
+	}
+	out := make([]string, 0, len(changes))
+	for c := range changes {
+		out = append(out, c)
+	}
+	sort.Strings(out)
+	return strings.Join(out, "\n") + "\n"
+}
+
+// marshalResources renders resources as a YAML stream with consistent key ordering
+func marshalResources(resources []manifestResource) (string, error) {
+	docs := make([]string, len(resources))
+	for i, r := range resources {
+		b, err := yaml.Marshal(r.obj)
+		if err != nil {
+			return "", fmt.Errorf("error marshaling manifest object: %v: %w", r.id, err)
+		}
+		docs[i] = "# " + r.id + "\n" + string(b)
+	}
+	return strings.Join(docs, "---\n"), nil
+}
+
+// manifestDiff returns a unified diff between the old and new rendered manifests of a release, with the values of Secrets
+// redacted. If only image references changed, a compact summary of the image changes is returned instead.
+func manifestDiff(old, new string) (string, error) {
+	oldres, err := parseManifest(old)
+	if err != nil {
+		return "", fmt.Errorf("error parsing old manifest: %w", err)
+	}
+	newres, err := parseManifest(new)
+	if err != nil {
+		return "", fmt.Errorf("error parsing new manifest: %w", err)
+	}
+	redactSecrets(newres, oldres)
+	redactSecrets(oldres, nil)
+	oldy, err := marshalResources(oldres)
+	if err != nil {
+		return "", err
+	}
+	newy, err := marshalResources(newres)
+	if err != nil {
+		return "", err
+	}
+	if oldy == newy {
+		return "no changes\n", nil
+	}
+	if summary := imageTagChanges(oldres, newres); summary != "" {
+		return summary, nil
+	}
+	return difflib.GetUnifiedDiffString(difflib.UnifiedDiff{
+		A:        difflib.SplitLines(oldy),
+		B:        difflib.SplitLines(newy),
+		FromFile: "deployed",
+		ToFile:   "upgraded",
+		Context:  3,
+	})
+}
@@ -8,15 +8,24 @@ import (
 	"io"
 	"io/ioutil"
 	"math/rand"
+	"net/http"
 	"strings"
 	"time"
 
 	"github.com/dollarshaveclub/acyl/pkg/models"
+	"github.com/dollarshaveclub/acyl/pkg/nitro/metrics"
 	"github.com/dollarshaveclub/acyl/pkg/persistence"
 	"github.com/dollarshaveclub/metahelm/pkg/metahelm"
 	"github.com/pkg/errors"
+	"gopkg.in/src-d/go-billy.v4"
+	appsv1 "k8s.io/api/apps/v1"
+	batchv1 "k8s.io/api/batch/v1"
 	v1 "k8s.io/api/core/v1"
+	networkingv1 "k8s.io/api/networking/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
 	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/kubernetes/fake"
 )
 
 // FakeInstaller satisfies the Installer interface but does nothing
@@ -27,6 +36,13 @@ type FakeInstaller struct {
 	DL               persistence.DataLayer
 	KC               kubernetes.Interface
 	HelmReleases     []string
+
+	// ChartRollbackFunc is called for each release rolled back, if set. Return an error to abort.
+	ChartRollbackFunc func(release string, revision int) error
+	// FS is used to read chart vars files when planning
+	FS billy.Filesystem
+	// ChartRetryFunc is called for each repo in chartLocations when retrying failed charts, if set. Return an error to abort.
+	ChartRetryFunc func(repo string, k8senv *models.KubernetesEnvironment, location ChartLocation) error
 }
 
 var _ Installer = &FakeInstaller{}
@@ -51,7 +67,11 @@ func (fi *FakeInstaller) BuildAndInstallCharts(ctx context.Context, newenv *EnvI
 			return err
 		}
 		releases := getReleases(chartsLocation)
-		return ci.writeReleaseNames(ctx, releases, "fake-namespace", newenv)
+		if err := ci.writeReleaseNames(ctx, releases, "fake-namespace", newenv); err != nil {
+			return err
+		}
+		// as with ChartInstaller, failing to record the revision doesn't fail the install
+		ci.writeEnvironmentRevision(ctx, newenv, "nitro-1234-"+newenv.Env.Name, releases, fi.releaseVersion(ctx, newenv.Env.Name))
 	}
 	return nil
 }
@@ -64,11 +84,58 @@ func (fi FakeInstaller) BuildAndUpgradeCharts(ctx context.Context, env *EnvInfo,
 	}
 	if fi.DL != nil {
 		ci := ChartInstaller{dl: fi.DL}
-		return ci.updateReleaseRevisions(ctx, env)
+		if err := ci.updateReleaseRevisions(ctx, env); err != nil {
+			return err
+		}
+		ci.writeEnvironmentRevision(ctx, env, k8senv.Namespace, env.Releases, fi.releaseVersion(ctx, env.Env.Name))
+	}
+	return nil
+}
+
+func (fi FakeInstaller) RetryFailedCharts(ctx context.Context, env *EnvInfo, k8senv *models.KubernetesEnvironment, cl ChartLocations) error {
+	if fi.ChartRetryFunc != nil {
+		for k, v := range cl {
+			if err := fi.ChartRetryFunc(k, k8senv, v); err != nil {
+				return fmt.Errorf("retry aborted: %w", err)
+			}
+		}
+	}
+	if fi.DL != nil {
+		ci := ChartInstaller{dl: fi.DL}
+		releases := getReleases(cl)
+		if err := ci.writeReleaseNames(ctx, releases, k8senv.Namespace, env); err != nil {
+			return err
+		}
+		ci.writeEnvironmentRevision(ctx, env, k8senv.Namespace, releases, fi.releaseVersion(ctx, env.Env.Name))
+		fi.DL.SetQAEnvironmentStatus(ctx, env.Env.Name, models.Success)
 	}
 	return nil
 }
 
+// releaseVersion returns a releaseVersionFunc that simulates Helm incrementing the release revision on each install or upgrade
+func (fi FakeInstaller) releaseVersion(ctx context.Context, envname string) releaseVersionFunc {
+	return func(string) (int, error) {
+		revs, err := fi.DL.GetEnvironmentRevisions(ctx, envname)
+		return len(revs) + 1, err
+	}
+}
+
+func (fi FakeInstaller) RollbackCharts(ctx context.Context, k8senv *models.KubernetesEnvironment, releases models.HelmReleaseRevisions) error {
+	if fi.ChartRollbackFunc == nil {
+		return nil
+	}
+	for _, hrr := range releases {
+		if err := fi.ChartRollbackFunc(hrr.Release, hrr.Revision); err != nil {
+			return fmt.Errorf("rollback aborted: %w", err)
+		}
+	}
+	return nil
+}
+
+func (fi FakeInstaller) PlanCharts(ctx context.Context, ns string, env *EnvInfo, cl ChartLocations) (*models.EnvironmentPlan, error) {
+	return NewChartPlanner(fi.FS, &metrics.FakeCollector{}).PlanCharts(ctx, ns, env, cl)
+}
+
 func (fi FakeInstaller) BuildAndInstallChartsIntoExisting(ctx context.Context, newenv *EnvInfo, k8senv *models.KubernetesEnvironment, cl ChartLocations) error {
 	for k, v := range cl {
 		if err := fi.ChartInstallFunc(k, v); err != nil {
@@ -90,6 +157,20 @@ func (fi FakeInstaller) DeleteNamespace(ctx context.Context, k8senv *models.Kube
 	return nil
 }
 
+func (fi FakeInstaller) HibernateNamespace(ctx context.Context, k8senv *models.KubernetesEnvironment) error {
+	if fi.KC != nil {
+		return ChartInstaller{kc: fi.KC}.HibernateNamespace(ctx, k8senv)
+	}
+	return nil
+}
+
+func (fi FakeInstaller) WakeNamespace(ctx context.Context, k8senv *models.KubernetesEnvironment) error {
+	if fi.KC != nil {
+		return ChartInstaller{kc: fi.KC}.WakeNamespace(ctx, k8senv)
+	}
+	return nil
+}
+
 // FakeKubernetesReporter satisfies the kubernetes reporter interface but does nothing
 type FakeKubernetesReporter struct {
 	FakePodLogFilePath string
@@ -273,3 +354,144 @@ func getFakePodLogs(path string, lines uint) ([]byte, error) {
 	}
 	return requestedLogs, nil
 }
+
+// StreamPodLogs returns lines from the fake pod log file for each requested container. If opts.Follow is set, the
+// returned channel stays open until ctx is cancelled.
+func (fkr FakeKubernetesReporter) StreamPodLogs(ctx context.Context, ns, podname string, opts PodLogStreamOptions) (out <-chan PodLogLine, err error) {
+	if opts.Lines > MaxPodContainerLogLines {
+		return nil, errors.Errorf("error line request exceeds limit")
+	}
+	containers := opts.Containers
+	if len(containers) == 0 {
+		pc, err := fkr.GetPodContainers(ctx, ns, podname)
+		if err != nil {
+			return nil, fmt.Errorf("error getting pod containers: %w", err)
+		}
+		containers = pc.Containers
+	}
+	streams := make([]io.ReadCloser, 0, len(containers))
+	for range containers {
+		body, err := getFakePodLogs(fkr.FakePodLogFilePath, opts.Lines)
+		if err != nil {
+			return nil, fmt.Errorf("error getting logs: %w", err)
+		}
+		streams = append(streams, ioutil.NopCloser(bytes.NewReader(body)))
+	}
+	lines := mergePodLogStreams(ctx, containers, streams)
+	if !opts.Follow {
+		return lines, nil
+	}
+	followed := make(chan PodLogLine)
+	go func() {
+		defer close(followed)
+		for l := range lines {
+			select {
+			case followed <- l:
+			case <-ctx.Done():
+				return
+			}
+		}
+		<-ctx.Done()
+	}()
+	return followed, nil
+}
+
+// stubResourceReporter returns a ChartInstaller backed by a fake clientset populated with stub namespace resources
+func stubResourceReporter(ns string) ChartInstaller {
+	created := metav1.NewTime(time.Now().UTC().Add(-3 * time.Hour))
+	replicas := int32(1)
+	objs := []runtime.Object{}
+	for _, p := range stubPodData(ns).Items {
+		p := p
+		objs = append(objs, &p)
+	}
+	for _, app := range []string{"foo-app", "bar-app"} {
+		selector := &metav1.LabelSelector{MatchLabels: map[string]string{"app": app}}
+		template := v1.PodTemplateSpec{Spec: v1.PodSpec{Containers: []v1.Container{{Name: app, Image: "acme/" + app + ":abc123"}}}}
+		objs = append(objs, &appsv1.Deployment{
+			ObjectMeta: metav1.ObjectMeta{Name: app, Namespace: ns, CreationTimestamp: created},
+			Spec:       appsv1.DeploymentSpec{Replicas: &replicas, Selector: selector, Template: template},
+			Status:     appsv1.DeploymentStatus{ReadyReplicas: 1, UpdatedReplicas: 1},
+		})
+		objs = append(objs, &v1.Service{
+			ObjectMeta: metav1.ObjectMeta{Name: app, Namespace: ns, CreationTimestamp: created},
+			Spec: v1.ServiceSpec{
+				Type:      v1.ServiceTypeClusterIP,
+				ClusterIP: "10.1.0.1",
+				Selector:  selector.MatchLabels,
+				Ports:     []v1.ServicePort{{Name: "http", Port: 80, Protocol: v1.ProtocolTCP}},
+			},
+		})
+		objs = append(objs, &v1.Endpoints{
+			ObjectMeta: metav1.ObjectMeta{Name: app, Namespace: ns},
+			Subsets:    []v1.EndpointSubset{{Addresses: []v1.EndpointAddress{{IP: "10.0.0.1"}}}},
+		})
+	}
+	objs = append(objs, &appsv1.StatefulSet{
+		ObjectMeta: metav1.ObjectMeta{Name: "foo-db", Namespace: ns, CreationTimestamp: created},
+		Spec: appsv1.StatefulSetSpec{
+			Replicas: &replicas,
+			Selector: &metav1.LabelSelector{MatchLabels: map[string]string{"app": "foo-db"}},
+			Template: v1.PodTemplateSpec{Spec: v1.PodSpec{Containers: []v1.Container{{Name: "postgres", Image: "postgres:12"}}}},
+		},
+	})
+	objs = append(objs, &networkingv1.Ingress{
+		ObjectMeta: metav1.ObjectMeta{Name: "foo-app", Namespace: ns, CreationTimestamp: created},
+		Spec:       networkingv1.IngressSpec{Rules: []networkingv1.IngressRule{{Host: "foo-app.example.com"}}},
+		Status:     networkingv1.IngressStatus{LoadBalancer: v1.LoadBalancerStatus{Ingress: []v1.LoadBalancerIngress{{IP: "1.2.3.4"}}}},
+	})
+	objs = append(objs, &batchv1.Job{
+		ObjectMeta: metav1.ObjectMeta{Name: "foo-migrations", Namespace: ns, CreationTimestamp: created},
+		Spec:       batchv1.JobSpec{Selector: &metav1.LabelSelector{MatchLabels: map[string]string{"job-name": "foo-migrations"}}},
+		Status: batchv1.JobStatus{
+			Succeeded:  1,
+			Conditions: []batchv1.JobCondition{{Type: batchv1.JobComplete, Status: v1.ConditionTrue}},
+		},
+	})
+	objs = append(objs, &v1.Event{
+		ObjectMeta:     metav1.ObjectMeta{Name: "bar-app-abc123.1", Namespace: ns},
+		InvolvedObject: v1.ObjectReference{Kind: "Pod", Name: "bar-app-abc123"},
+		Type:           v1.EventTypeWarning,
+		Reason:         "BackOff",
+		Message:        "Back-off restarting failed container",
+		Count:          4,
+		FirstTimestamp: created,
+		LastTimestamp:  metav1.NewTime(time.Now().UTC().Add(-1 * time.Minute)),
+	})
+	return ChartInstaller{kc: fake.NewSimpleClientset(objs...)}
+}
+
+func (fkr FakeKubernetesReporter) GetDeployments(ctx context.Context, ns string) (out []K8sWorkload, err error) {
+	return stubResourceReporter(ns).GetDeployments(ctx, ns)
+}
+
+func (fkr FakeKubernetesReporter) GetStatefulSets(ctx context.Context, ns string) (out []K8sWorkload, err error) {
+	return stubResourceReporter(ns).GetStatefulSets(ctx, ns)
+}
+
+func (fkr FakeKubernetesReporter) GetServices(ctx context.Context, ns string) (out []K8sService, err error) {
+	return stubResourceReporter(ns).GetServices(ctx, ns)
+}
+
+func (fkr FakeKubernetesReporter) GetIngresses(ctx context.Context, ns string) (out []K8sIngress, err error) {
+	return stubResourceReporter(ns).GetIngresses(ctx, ns)
+}
+
+func (fkr FakeKubernetesReporter) GetJobs(ctx context.Context, ns string) (out []K8sJob, err error) {
+	return stubResourceReporter(ns).GetJobs(ctx, ns)
+}
+
+func (fkr FakeKubernetesReporter) GetEvents(ctx context.Context, ns string) (out []K8sEvent, err error) {
+	return stubResourceReporter(ns).GetEvents(ctx, ns)
+}
+
+// ServiceProxy returns a handler that responds with the proxy target and request path instead of proxying anywhere
+func (fkr FakeKubernetesReporter) ServiceProxy(ns, service, port string) (http.Handler, error) {
+	if err := ValidateServiceProxyTarget(service, port); err != nil {
+		return nil, err
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain")
+		fmt.Fprintf(w, "%v/%v:%v %v %v", ns, service, port, r.Method, r.URL.RequestURI())
+	}), nil
+}
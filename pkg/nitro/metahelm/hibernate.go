@@ -0,0 +1,110 @@
+package metahelm
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+
+	"github.com/dollarshaveclub/acyl/pkg/models"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// HibernatedReplicasAnnotation is set on each workload scaled to zero by hibernation and records the replica count to restore on wake
+const HibernatedReplicasAnnotation = "acyl.dev/hibernated-replicas"
+
+// scaleFunc modifies the replica count and annotations of a workload, returning true if the workload should be updated
+type scaleFunc func(replicas **int32, annotations *map[string]string) (bool, error)
+
+// hibernateReplicas scales a workload to zero, recording the previous replica count in an annotation.
+// Workloads that are already scaled to zero are left unchanged.
+func hibernateReplicas(replicas **int32, annotations *map[string]string) (bool, error) {
+	n := int32(1) // unset replicas defaults to 1
+	if *replicas != nil {
+		n = **replicas
+	}
+	if n == 0 {
+		return false, nil
+	}
+	if *annotations == nil {
+		*annotations = map[string]string{}
+	}
+	(*annotations)[HibernatedReplicasAnnotation] = strconv.Itoa(int(n))
+	zero := int32(0)
+	*replicas = &zero
+	return true, nil
+}
+
+// wakeReplicas restores the replica count recorded by hibernateReplicas and removes the annotation.
+// Workloads that weren't hibernated are left unchanged.
+func wakeReplicas(replicas **int32, annotations *map[string]string) (bool, error) {
+	v, ok := (*annotations)[HibernatedReplicasAnnotation]
+	if !ok {
+		return false, nil
+	}
+	n, err := strconv.Atoi(v)
+	if err != nil || n < 0 {
+		return false, fmt.Errorf("invalid %v annotation: %v", HibernatedReplicasAnnotation, v)
+	}
+	delete(*annotations, HibernatedReplicasAnnotation)
+	n32 := int32(n)
+	*replicas = &n32
+	return true, nil
+}
+
+// HibernateNamespace scales all Deployments and StatefulSets in the environment namespace to zero replicas,
+// recording the previous replica count of each in an annotation so it can be restored by WakeNamespace
+func (ci ChartInstaller) HibernateNamespace(ctx context.Context, k8senv *models.KubernetesEnvironment) error {
+	if k8senv == nil {
+		return fmt.Errorf("k8s environment is nil")
+	}
+	return ci.scaleWorkloads(ctx, k8senv.Namespace, hibernateReplicas)
+}
+
+// WakeNamespace restores the replica counts of all workloads in the environment namespace that were scaled to zero by HibernateNamespace
+func (ci ChartInstaller) WakeNamespace(ctx context.Context, k8senv *models.KubernetesEnvironment) error {
+	if k8senv == nil {
+		return fmt.Errorf("k8s environment is nil")
+	}
+	return ci.scaleWorkloads(ctx, k8senv.Namespace, wakeReplicas)
+}
+
+// scaleWorkloads calls sf for each Deployment and StatefulSet in ns and updates the object if it returns true
+func (ci ChartInstaller) scaleWorkloads(ctx context.Context, ns string, sf scaleFunc) error {
+	dl, err := ci.kc.AppsV1().Deployments(ns).List(ctx, metav1.ListOptions{})
+	if err != nil {
+		return fmt.Errorf("error listing deployments: %w", err)
+	}
+	for i := range dl.Items {
+		d := &dl.Items[i]
+		ok, err := sf(&d.Spec.Replicas, &d.Annotations)
+		if err != nil {
+			return fmt.Errorf("deployment: %v: %w", d.Name, err)
+		}
+		if !ok {
+			continue
+		}
+		ci.log(ctx, "scaling deployment %v to %v replicas", d.Name, *d.Spec.Replicas)
+		if _, err := ci.kc.AppsV1().Deployments(ns).Update(ctx, d, metav1.UpdateOptions{}); err != nil {
+			return fmt.Errorf("error updating deployment: %v: %w", d.Name, err)
+		}
+	}
+	ssl, err := ci.kc.AppsV1().StatefulSets(ns).List(ctx, metav1.ListOptions{})
+	if err != nil {
+		return fmt.Errorf("error listing statefulsets: %w", err)
+	}
+	for i := range ssl.Items {
+		ss := &ssl.Items[i]
+		ok, err := sf(&ss.Spec.Replicas, &ss.Annotations)
+		if err != nil {
+			return fmt.Errorf("statefulset: %v: %w", ss.Name, err)
+		}
+		if !ok {
+			continue
+		}
+		ci.log(ctx, "scaling statefulset %v to %v replicas", ss.Name, *ss.Spec.Replicas)
+		if _, err := ci.kc.AppsV1().StatefulSets(ns).Update(ctx, ss, metav1.UpdateOptions{}); err != nil {
+			return fmt.Errorf("error updating statefulset: %v: %w", ss.Name, err)
+		}
+	}
+	return nil
+}
@@ -1,6 +1,7 @@
 package metahelm
 
 import (
+	"bufio"
 	"context"
 	"crypto/rand"
 	"encoding/json"
@@ -9,6 +10,7 @@ import (
 	"math/big"
 	"net/http"
 	"strings"
+	"sync"
 	"time"
 
 	kubernetestrace "gopkg.in/DataDog/dd-trace-go.v1/contrib/k8s.io/client-go/kubernetes"
@@ -60,6 +62,11 @@ type Installer interface {
 	BuildAndInstallChartsIntoExisting(ctx context.Context, newenv *EnvInfo, k8senv *models.KubernetesEnvironment, cl ChartLocations) error
 	BuildAndUpgradeCharts(ctx context.Context, env *EnvInfo, k8senv *models.KubernetesEnvironment, cl ChartLocations) error
 	DeleteNamespace(ctx context.Context, k8senv *models.KubernetesEnvironment) error
+	HibernateNamespace(ctx context.Context, k8senv *models.KubernetesEnvironment) error
+	WakeNamespace(ctx context.Context, k8senv *models.KubernetesEnvironment) error
+	RollbackCharts(ctx context.Context, k8senv *models.KubernetesEnvironment, releases models.HelmReleaseRevisions) error
+	PlanCharts(ctx context.Context, ns string, env *EnvInfo, cl ChartLocations) (*models.EnvironmentPlan, error)
+	RetryFailedCharts(ctx context.Context, env *EnvInfo, k8senv *models.KubernetesEnvironment, cl ChartLocations) error
 }
 
 // KubernetesReporter describes an object that returns k8s environment data
@@ -67,6 +74,14 @@ type KubernetesReporter interface {
 	GetPodList(ctx context.Context, ns string) (out []K8sPod, err error)
 	GetPodContainers(ctx context.Context, ns, podname string) (out K8sPodContainers, err error)
 	GetPodLogs(ctx context.Context, ns, podname, container string, lines uint) (out io.ReadCloser, err error)
+	StreamPodLogs(ctx context.Context, ns, podname string, opts PodLogStreamOptions) (out <-chan PodLogLine, err error)
+	GetDeployments(ctx context.Context, ns string) (out []K8sWorkload, err error)
+	GetStatefulSets(ctx context.Context, ns string) (out []K8sWorkload, err error)
+	GetServices(ctx context.Context, ns string) (out []K8sService, err error)
+	GetIngresses(ctx context.Context, ns string) (out []K8sIngress, err error)
+	GetJobs(ctx context.Context, ns string) (out []K8sJob, err error)
+	GetEvents(ctx context.Context, ns string) (out []K8sEvent, err error)
+	ServiceProxy(ns, service, port string) (http.Handler, error)
 }
 
 // metrics prefix
@@ -81,6 +96,10 @@ const (
 	MaxPodContainerLogLines = 1000
 	DefaultRestConfigQPS    = 100000
 	DefaultRestConfigBurst  = 100000
+	// PodLogStreamBufferLines is the number of log lines buffered between the pod log streams and the consumer
+	PodLogStreamBufferLines = 1000
+	// MaxPodLogLineBytes is the maximum length of a single streamed log line
+	MaxPodLogLineBytes = 1024 * 1024
 )
 
 // ChartInstaller is an object that manages namespaces and install/upgrades/deletes metahelm chart graphs
@@ -339,12 +358,15 @@ func (ci ChartInstaller) installOrUpgradeIntoExisting(ctx context.Context, env *
 		return errors.New("k8s client is nil")
 	}
 	ci.dl.SetQAEnvironmentStatus(tracer.ContextWithSpan(context.Background(), span), env.Env.Name, models.Updating)
+	var retainNamespace bool
 	defer func() {
 		if err != nil {
-			// clean up namespace on error
-			err2 := ci.cleanUpNamespace(ctx, k8senv.Namespace, env.Env.Name, ci.isRepoPrivileged(env.Env.Repo))
-			if err2 != nil {
-				ci.log(ctx, "error cleaning up namespace: %v", err2)
+			// clean up namespace on error, unless the failed charts may be retried
+			if !retainNamespace {
+				err2 := ci.cleanUpNamespace(ctx, k8senv.Namespace, env.Env.Name, ci.isRepoPrivileged(env.Env.Repo))
+				if err2 != nil {
+					ci.log(ctx, "error cleaning up namespace: %v", err2)
+				}
 			}
 			ci.dl.SetQAEnvironmentStatus(tracer.ContextWithSpan(context.Background(), span), env.Env.Name, models.Failure)
 			span.Finish(tracer.WithError(err))
@@ -366,6 +388,7 @@ func (ci ChartInstaller) installOrUpgradeIntoExisting(ctx context.Context, env *
 		err = fmt.Errorf("no extant k8s environment for env: %v", env.Env.Name)
 		return err
 	}
+	retainNamespace = true
 	err = ci.installOrUpgradeCharts(ctx, k8senv.Namespace, csl, env, b, upgrade)
 	return err
 }
@@ -379,6 +402,7 @@ func (ci ChartInstaller) BuildAndInstallCharts(ctx context.Context, newenv *EnvI
 		return errors.New("k8s client is nil")
 	}
 	var ns string
+	var retainNamespace bool
 	if overrideNamespace == "" {
 		ns, err = ci.createNamespace(ctx, newenv.Env.Name)
 		if err != nil {
@@ -389,10 +413,12 @@ func (ci ChartInstaller) BuildAndInstallCharts(ctx context.Context, newenv *EnvI
 	}
 	defer func() {
 		if err != nil {
-			// clean up namespace on error
-			err2 := ci.cleanUpNamespace(ctx, ns, newenv.Env.Name, ci.isRepoPrivileged(newenv.Env.Repo))
-			if err2 != nil {
-				ci.log(ctx, "error cleaning up namespace: %v", err2)
+			// clean up namespace on error, unless the failed charts may be retried
+			if !retainNamespace {
+				err2 := ci.cleanUpNamespace(ctx, ns, newenv.Env.Name, ci.isRepoPrivileged(newenv.Env.Repo))
+				if err2 != nil {
+					ci.log(ctx, "error cleaning up namespace: %v", err2)
+				}
 			}
 			ci.dl.SetQAEnvironmentStatus(context.Background(), newenv.Env.Name, models.Failure)
 		} else {
@@ -416,15 +442,41 @@ func (ci ChartInstaller) BuildAndInstallCharts(ctx context.Context, newenv *EnvI
 		return fmt.Errorf("error setting up namespace: %w", err)
 	}
 	endNamespaceSetup()
+	// from here on, a failed chart install or image build leaves the namespace and any installed releases in place so that the
+	// failed charts can be retried (see RetryFailedCharts), the namespace is deleted when the environment is destroyed or rebuilt
+	retainNamespace = true
 	return ci.installOrUpgradeCharts(ctx, ns, csl, newenv, b, false)
 }
 
 func (ci ChartInstaller) installOrUpgradeCharts(ctx context.Context, namespace string, csl []metahelm.Chart, env *EnvInfo, b images.Batch, upgrade bool) error {
 	eventlogger.GetLogger(ctx).SetK8sNamespace(namespace)
+	// stop running image builds as soon as the operation is cancelled, not when the chart installs return
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		select {
+		case <-ctx.Done():
+			ci.log(ctx, "metahelm: operation cancelled, stopping image builds")
+			b.Stop()
+		case <-done:
+		}
+	}()
 	mhm, err := ci.mhmf(ctx, ci.kc, ci.hccfg, namespace)
 	if err != nil || mhm == nil {
 		return fmt.Errorf("error getting helm client configuration: %w", err)
 	}
+	pr, err := ci.postRenderer(env)
+	if err != nil {
+		return fmt.Errorf("error getting post-renderer: %w", err)
+	}
+	if pr != nil && mhm.HCfg != nil && mhm.HCfg.KubeClient != nil {
+		ci.log(ctx, "metahelm: applying post-render transforms to all releases")
+		kc := mhm.HCfg.KubeClient
+		if prkc, ok := kc.(*postRenderKubeClient); ok { // don't stack post-renderers if the factory reuses a Helm configuration
+			kc = prkc.Interface
+		}
+		mhm.HCfg.KubeClient = &postRenderKubeClient{Interface: kc, pr: pr}
+	}
 	actStr, actingStr := "install", "install"
 	if upgrade {
 		actStr, actingStr = "upgrade", "upgrad"
@@ -490,6 +542,9 @@ func (ci ChartInstaller) install(ctx context.Context, mhm *metahelm.Manager, cb
 	if err := ci.writeReleaseNames(ctx, relmap, namespace, env); err != nil {
 		return fmt.Errorf("error writing release names: %w", err)
 	}
+	if err := ci.writeEnvironmentRevision(ctx, env, namespace, relmap, helmReleaseVersion(mhm)); err != nil {
+		ci.log(ctx, "error writing environment revision: %v", err)
+	}
 	return nil
 }
 
@@ -497,7 +552,13 @@ func (ci ChartInstaller) upgrade(ctx context.Context, mhm *metahelm.Manager, cb
 	defer ci.mc.Timing(mpfx+"upgrade", "triggering_repo:"+env.Env.Repo)()
 	ctx, cf := context.WithTimeout(ctx, 30*time.Minute)
 	defer cf()
+	upgrading := make(map[string]string, len(csl)) // env.Releases may include releases that aren't being upgraded
+	for _, c := range csl {
+		upgrading[c.Title] = env.Releases[c.Title]
+	}
+	manifests := ci.releaseManifests(ctx, upgrading, helmReleaseManifest(mhm))
 	err := mhm.Upgrade(ctx, env.Releases, csl, metahelm.WithK8sNamespace(namespace), metahelm.WithInstallCallback(cb), metahelm.WithCompletedCallback(func(c metahelm.Chart, err error) { completedCB(ctx, c, err) }), metahelm.WithTimeout(metahelmTimeout))
+	ci.logReleaseDiffs(ctx, upgrading, manifests, helmReleaseManifest(mhm)) // also on failure, the diff may explain it
 	if err != nil {
 		if _, ok := err.(metahelm.ChartError); ok {
 			return err
@@ -508,6 +569,9 @@ func (ci ChartInstaller) upgrade(ctx context.Context, mhm *metahelm.Manager, cb
 	if err := ci.updateReleaseRevisions(ctx, env); err != nil {
 		return fmt.Errorf("error updating release revisions: %w", err)
 	}
+	if err := ci.writeEnvironmentRevision(ctx, env, namespace, env.Releases, helmReleaseVersion(mhm)); err != nil {
+		ci.log(ctx, "error writing environment revision: %v", err)
+	}
 	return nil
 }
 
@@ -605,7 +669,7 @@ func (ci ChartInstaller) GenerateCharts(ctx context.Context, ns string, newenv *
 			ci.log(ctx, "chart generated for %v", label)
 		}()
 		out := metahelm.Chart{}
-		if rcd.Repo != "" {
+		if rcd.Repo != "" || rcd.Manifests() {
 			if rcd.AppMetadata.ChartTagValue == "" {
 				return out, fmt.Errorf("ChartTagValue is empty: offset: %v: %v", i, rcd.Name)
 			}
@@ -624,7 +688,7 @@ func (ci ChartInstaller) GenerateCharts(ctx context.Context, ns string, newenv *
 			rcd.AppMetadata.EnvNameValue:   newenv.Env.Name,
 			rcd.AppMetadata.NamespaceValue: ns,
 		}
-		if rcd.Repo != "" {
+		if rcd.Repo != "" || rcd.Manifests() {
 			overrides[rcd.AppMetadata.ChartTagValue] = rcd.AppMetadata.Ref
 		}
 		for i, lo := range rcd.AppMetadata.ValueOverrides {
@@ -1064,3 +1128,106 @@ func (ci ChartInstaller) GetPodLogs(ctx context.Context, ns, podname, container
 	}
 	return plRC, nil
 }
+
+// PodLogStreamOptions models the options for streaming pod container logs
+type PodLogStreamOptions struct {
+	// Containers are the containers to stream. If empty, all containers in the pod are streamed.
+	Containers []string
+	// Lines is the number of existing lines to return per container before following
+	Lines uint
+	// Timestamps prefixes each line with an RFC3339 timestamp
+	Timestamps bool
+	// Previous returns the logs of the previously terminated container instance (for crashed containers)
+	Previous bool
+	// Follow keeps the stream open and returns lines as they are written
+	Follow bool
+}
+
+// PodLogLine models a single log line from a pod container. If Err is set, the stream for Container failed.
+type PodLogLine struct {
+	Container string
+	Line      string
+	Err       error
+}
+
+// StreamPodLogs streams the logs of one or more containers in a pod. The returned channel is closed when all container
+// streams have ended or ctx is cancelled. Consumers must either drain the channel or cancel ctx.
+func (ci ChartInstaller) StreamPodLogs(ctx context.Context, ns, podname string, opts PodLogStreamOptions) (out <-chan PodLogLine, err error) {
+	if opts.Lines > MaxPodContainerLogLines {
+		return nil, errors.Errorf("error line request exceeds limit")
+	}
+	containers := opts.Containers
+	if len(containers) == 0 {
+		pc, err := ci.GetPodContainers(ctx, ns, podname)
+		if err != nil {
+			return nil, fmt.Errorf("error getting pod containers: %w", err)
+		}
+		containers = pc.Containers
+	}
+	if len(containers) == 0 {
+		return nil, errors.Errorf("no containers found for pod %v", podname)
+	}
+	streams := make([]io.ReadCloser, 0, len(containers))
+	closeStreams := func() {
+		for _, s := range streams {
+			s.Close()
+		}
+	}
+	for _, c := range containers {
+		tl := int64(opts.Lines)
+		plo := corev1.PodLogOptions{
+			Container:  c,
+			TailLines:  &tl,
+			Follow:     opts.Follow,
+			Timestamps: opts.Timestamps,
+			Previous:   opts.Previous,
+		}
+		req := ci.kc.CoreV1().Pods(ns).GetLogs(podname, &plo)
+		if req == nil {
+			closeStreams()
+			return nil, errors.Errorf("pod logs request is nil")
+		}
+		req.BackOff(nil)
+		rc, err := req.Stream(ctx)
+		if err != nil {
+			closeStreams()
+			return nil, fmt.Errorf("error getting request stream for container %v: %w", c, err)
+		}
+		streams = append(streams, rc)
+	}
+	return mergePodLogStreams(ctx, containers, streams), nil
+}
+
+// mergePodLogStreams reads lines from each container stream concurrently and multiplexes them onto a single channel.
+// Sends block when the buffer is full, which applies backpressure to the underlying streams.
+func mergePodLogStreams(ctx context.Context, containers []string, streams []io.ReadCloser) <-chan PodLogLine {
+	out := make(chan PodLogLine, PodLogStreamBufferLines)
+	var wg sync.WaitGroup
+	for i := range streams {
+		wg.Add(1)
+		go func(container string, rc io.ReadCloser) {
+			defer wg.Done()
+			defer rc.Close()
+			scanner := bufio.NewScanner(rc)
+			scanner.Buffer(make([]byte, 64*1024), MaxPodLogLineBytes)
+			for scanner.Scan() {
+				select {
+				case out <- PodLogLine{Container: container, Line: scanner.Text()}:
+				case <-ctx.Done():
+					return
+				}
+			}
+			if err := scanner.Err(); err != nil && ctx.Err() == nil {
+				select {
+				case out <- PodLogLine{Container: container, Err: err}:
+				case <-ctx.Done():
+				}
+			}
+		}(containers[i], streams[i])
+	}
+	go func() {
+		wg.Wait()
+		close(out)
+	}()
+	return out
+}
@@ -6,6 +6,9 @@ import (
 	"encoding/json"
 	"fmt"
 	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
 	"strings"
 	"testing"
 	"time"
@@ -19,12 +22,14 @@ import (
 	"github.com/dollarshaveclub/acyl/pkg/nitro/metrics"
 	"github.com/dollarshaveclub/acyl/pkg/persistence"
 	"github.com/dollarshaveclub/metahelm/pkg/metahelm"
+	"github.com/google/uuid"
 	"github.com/pkg/errors"
 	"gopkg.in/src-d/go-billy.v4/memfs"
 	"gopkg.in/yaml.v2"
 	"helm.sh/helm/v3/pkg/action"
 	"helm.sh/helm/v3/pkg/chartutil"
 	"helm.sh/helm/v3/pkg/kube"
+	"helm.sh/helm/v3/pkg/release"
 	"helm.sh/helm/v3/pkg/storage"
 	"helm.sh/helm/v3/pkg/storage/driver"
 	appsv1 "k8s.io/api/apps/v1"
@@ -37,6 +42,7 @@ import (
 	"k8s.io/client-go/discovery"
 	"k8s.io/client-go/kubernetes"
 	"k8s.io/client-go/kubernetes/fake"
+	"k8s.io/client-go/kubernetes/scheme"
 	"k8s.io/client-go/rest"
 	"k8s.io/client-go/tools/clientcmd"
 )
@@ -537,6 +543,88 @@ func TestMetahelmGenerateCharts(t *testing.T) {
 	}
 }
 
+func TestMetahelmPlanCharts(t *testing.T) {
+	rc := models.RepoConfig{
+		Application: models.RepoConfigAppMetadata{
+			ChartTagValue: "image.tag",
+			Repo:          "foo/bar",
+			Ref:           "aaaa",
+			Branch:        "feature",
+		},
+		Dependencies: models.DependencyDeclaration{
+			Direct: []models.RepoConfigDependency{
+				models.RepoConfigDependency{
+					Name:     "bar-baz",
+					Repo:     "bar/baz",
+					Requires: []string{"car-buz"},
+					AppMetadata: models.RepoConfigAppMetadata{
+						ChartTagValue: "image.tag",
+						Repo:          "bar/baz",
+						Ref:           "bbbb",
+						Branch:        "master",
+					},
+				},
+			},
+			Environment: []models.RepoConfigDependency{
+				models.RepoConfigDependency{
+					Name: "car-buz",
+					Repo: "car/buz",
+					AppMetadata: models.RepoConfigAppMetadata{
+						ChartTagValue: "image.tag",
+						Repo:          "car/buz",
+						Ref:           "cccc",
+						Branch:        "master",
+					},
+					ValueOverrides: []string{"replicas=2"},
+				},
+			},
+		},
+	}
+	rc.Application.SetValueDefaults()
+	for i := range rc.Dependencies.Direct {
+		rc.Dependencies.Direct[i].AppMetadata.SetValueDefaults()
+	}
+	for i := range rc.Dependencies.Environment {
+		rc.Dependencies.Environment[i].AppMetadata.SetValueDefaults()
+	}
+	cl := ChartLocations{
+		"foo-bar": ChartLocation{ChartPath: "testdata/chart"},
+		"bar-baz": ChartLocation{ChartPath: "testdata/chart"},
+		"car-buz": ChartLocation{ChartPath: "testdata/chart"},
+	}
+	newenv := &EnvInfo{Env: &models.QAEnvironment{Name: "foo-bar", Repo: "foo/bar"}, RC: &rc}
+	plan, err := NewChartPlanner(nil, &metrics.FakeCollector{}).PlanCharts(context.Background(), "nitro-1234-foo-bar", newenv, cl)
+	if err != nil {
+		t.Fatalf("should have succeeded: %v", err)
+	}
+	if fmt.Sprint(plan.InstallOrder) != "[[car-buz] [bar-baz] [foo-bar]]" {
+		t.Fatalf("bad install order: %v", plan.InstallOrder)
+	}
+	if plan.RefMap["bar/baz"] != "master" || plan.CommitSHAMap["car/buz"] != "cccc" {
+		t.Fatalf("bad ref maps: %v, %v", plan.RefMap, plan.CommitSHAMap)
+	}
+	if len(plan.Charts) != 3 {
+		t.Fatalf("bad charts: %+v", plan.Charts)
+	}
+	for _, c := range plan.Charts {
+		if c.Name != "car-buz" {
+			continue
+		}
+		if c.Repo != "car/buz" || c.RevisionSHA != "cccc" {
+			t.Fatalf("bad chart: %+v", c)
+		}
+		vals := map[string]interface{}{}
+		if err := yaml.Unmarshal([]byte(c.Values), &vals); err != nil {
+			t.Fatalf("error unmarshaling values: %v", err)
+		}
+		if vals["replicas"] != 2 || vals["namespace"] != "nitro-1234-foo-bar" || vals["image"].(map[interface{}]interface{})["tag"] != "cccc" {
+			t.Fatalf("bad values: %v", c.Values)
+		}
+		return
+	}
+	t.Fatalf("chart missing from plan: car-buz")
+}
+
 func TestMetahelmCreateNamespace(t *testing.T) {
 	fkc := fake.NewSimpleClientset()
 	dl := persistence.NewFakeDataLayer()
@@ -845,6 +933,245 @@ func TestMetahelmUpdateReleaseRevisions(t *testing.T) {
 	}
 }
 
+func TestMetahelmWriteEnvironmentRevision(t *testing.T) {
+	rmap := map[string]string{
+		"foo-bar":  "random",
+		"foo-bar2": "random2",
+	}
+	rc := models.RepoConfig{
+		Application: models.RepoConfigAppMetadata{Repo: "foo/bar", Ref: "asdf", Branch: "feature"},
+		Dependencies: models.DependencyDeclaration{
+			Direct: []models.RepoConfigDependency{
+				models.RepoConfigDependency{
+					Name: "foo-bar2",
+					Repo: "foo/bar2",
+					AppMetadata: models.RepoConfigAppMetadata{
+						Repo:   "foo/bar2",
+						Ref:    "1234",
+						Branch: "master",
+					},
+				},
+			},
+		},
+	}
+	newenv := &EnvInfo{Env: &models.QAEnvironment{Name: "foo-bar"}, RC: &rc}
+	dl := persistence.NewFakeDataLayer()
+	dl.CreateQAEnvironment(context.Background(), newenv.Env)
+	ci := ChartInstaller{dl: dl}
+	versions := map[string]int{"random": 3, "random2": 7}
+	version := func(release string) (int, error) {
+		v, ok := versions[release]
+		if !ok {
+			return 0, fmt.Errorf("release not found: %v", release)
+		}
+		return v, nil
+	}
+	if err := ci.writeEnvironmentRevision(context.Background(), newenv, "nitro-1234-foo-bar", rmap, version); err != nil {
+		t.Fatalf("should have succeeded: %v", err)
+	}
+	revs, err := dl.GetEnvironmentRevisions(context.Background(), "foo-bar")
+	if err != nil || len(revs) != 1 {
+		t.Fatalf("expected one revision: %v: %v", revs, err)
+	}
+	rev := revs[0]
+	sig := rc.ConfigSignature()
+	if rev.K8sNamespace != "nitro-1234-foo-bar" || string(rev.ConfigSignature) != string(sig[:]) {
+		t.Fatalf("bad revision: %+v", rev)
+	}
+	if rev.RefMap["foo/bar2"] != "master" || rev.CommitSHAMap["foo/bar"] != "asdf" || rev.CommitSHAMap["foo/bar2"] != "1234" {
+		t.Fatalf("bad revision maps: %v, %v", rev.RefMap, rev.CommitSHAMap)
+	}
+	if len(rev.HelmReleases) != 2 {
+		t.Fatalf("bad helm releases: %+v", rev.HelmReleases)
+	}
+	for _, hrr := range rev.HelmReleases {
+		if hrr.Revision != versions[hrr.Release] || hrr.RevisionSHA != rc.NameToRefMap()[hrr.Name] {
+			t.Fatalf("bad helm release revision: %+v", hrr)
+		}
+	}
+	versions = map[string]int{}
+	if err := ci.writeEnvironmentRevision(context.Background(), newenv, "nitro-1234-foo-bar", rmap, version); err == nil {
+		t.Fatalf("should have failed with missing release")
+	}
+}
+
+const testDiffManifest = `---
+# Source: foo/templates/secret.yaml
+apiVersion: v1
+kind: Secret
+metadata:
+  name: foo-secret
+data:
+  password: %v
+  username: YWRtaW4=
+---
+# Source: foo/templates/deployment.yaml
+apiVersion: apps/v1
+kind: Deployment
+metadata:
+  name: foo
+spec:
+  replicas: %v
+  template:
+    spec:
+      containers:
+      - name: foo
+        image: quay.io/foo/bar:%v
+`
+
+func TestMetahelmManifestDiff(t *testing.T) {
+	old := fmt.Sprintf(testDiffManifest, "c2VjcmV0MQ==", 1, "asdf")
+	diff, err := manifestDiff(old, old)
+	if err != nil {
+		t.Fatalf("should have succeeded: %v", err)
+	}
+	if diff != "no changes\n" {
+		t.Fatalf("unexpected diff for identical manifests: %v", diff)
+	}
+	diff, err = manifestDiff(old, fmt.Sprintf(testDiffManifest, "c2VjcmV0MQ==", 1, "1234"))
+	if err != nil {
+		t.Fatalf("should have succeeded: %v", err)
+	}
+	if diff != "image tag changed: quay.io/foo/bar:asdf => quay.io/foo/bar:1234\n" {
+		t.Fatalf("unexpected image tag summary: %v", diff)
+	}
+	diff, err = manifestDiff(old, fmt.Sprintf(testDiffManifest, "c2VjcmV0Mg==", 2, "1234"))
+	if err != nil {
+		t.Fatalf("should have succeeded: %v", err)
+	}
+	for _, s := range []string{"-  replicas: 1", "+  replicas: 2", "-      - image: quay.io/foo/bar:asdf", "+      - image: quay.io/foo/bar:1234", "-  password: <redacted>", "+  password: <redacted, changed>"} {
+		if !strings.Contains(diff, s) {
+			t.Fatalf("diff should have contained %q: %v", s, diff)
+		}
+	}
+	for _, s := range []string{"c2VjcmV0", "YWRtaW4="} {
+		if strings.Contains(diff, s) {
+			t.Fatalf("diff should not have contained %q: %v", s, diff)
+		}
+	}
+	if _, err := manifestDiff(old, "{{{"); err == nil {
+		t.Fatalf("should have failed with invalid manifest")
+	}
+}
+
+func TestMetahelmLogReleaseDiffs(t *testing.T) {
+	dl := persistence.NewFakeDataLayer()
+	id, _ := uuid.NewRandom()
+	elog := &eventlogger.Logger{DL: dl, ID: id, Sink: ioutil.Discard}
+	elog.Init([]byte{}, "foo/bar", 99)
+	elog.SetNewStatus(models.UpdateEvent, "foo-bar", models.RepoRevisionData{Repo: "foo/bar"})
+	dl.SetEventStatusTree(id, map[string]models.EventStatusTreeNode{"foo-bar": models.EventStatusTreeNode{}, "foo-bar2": models.EventStatusTreeNode{}})
+	ctx := eventlogger.NewEventLoggerContext(context.Background(), elog)
+	releases := map[string]string{"foo-bar": "random", "foo-bar2": "random2"}
+	manifests := map[string]string{
+		"random":  fmt.Sprintf(testDiffManifest, "c2VjcmV0MQ==", 1, "asdf"),
+		"random2": fmt.Sprintf(testDiffManifest, "c2VjcmV0MQ==", 1, "asdf"),
+	}
+	manifest := func(release string) (string, error) {
+		m, ok := manifests[release]
+		if !ok {
+			return "", fmt.Errorf("release not found: %v", release)
+		}
+		return m, nil
+	}
+	ci := ChartInstaller{dl: dl}
+	before := ci.releaseManifests(ctx, releases, manifest)
+	if len(before) != 2 {
+		t.Fatalf("expected two manifests: %v", before)
+	}
+	manifests["random"] = fmt.Sprintf(testDiffManifest, "c2VjcmV0MQ==", 1, "1234")
+	ci.logReleaseDiffs(ctx, releases, before, manifest)
+	s, err := dl.GetEventStatus(id)
+	if err != nil {
+		t.Fatalf("error getting event status: %v", err)
+	}
+	if diff := s.Tree["foo-bar"].Chart.Diff; diff != "image tag changed: quay.io/foo/bar:asdf => quay.io/foo/bar:1234\n" {
+		t.Fatalf("unexpected diff for foo-bar: %v", diff)
+	}
+	if diff := s.Tree["foo-bar2"].Chart.Diff; diff != "no changes\n" {
+		t.Fatalf("unexpected diff for foo-bar2: %v", diff)
+	}
+}
+
+func TestMetahelmRetryFailedCharts(t *testing.T) {
+	csl := []metahelm.Chart{
+		metahelm.Chart{Title: "foo-bar", DependencyList: []string{"foo-db", "foo-cache"}},
+		metahelm.Chart{Title: "foo-db"},
+		metahelm.Chart{Title: "foo-cache"},
+		metahelm.Chart{Title: "foo-worker", DependencyList: []string{"foo-db"}},
+	}
+	rels := []*release.Release{
+		&release.Release{Name: "foo-db", Namespace: "nitro-1234-some-name", Version: 2, Info: &release.Info{Status: release.StatusDeployed}},
+		&release.Release{Name: "foo-cache", Namespace: "nitro-1234-some-name", Version: 1, Info: &release.Info{Status: release.StatusPendingInstall}},
+		&release.Release{Name: "foo-worker", Namespace: "nitro-1234-some-name", Version: 1, Info: &release.Info{Status: release.StatusDeployed}},
+	}
+	fcr := retryFailedCharts(csl, rels)
+	if len(fcr.Charts) != 2 || fcr.Charts[0].Title != "foo-bar" || fcr.Charts[1].Title != "foo-cache" {
+		t.Fatalf("bad retried charts: %+v", fcr.Charts)
+	}
+	if deps := fcr.Charts[0].DependencyList; len(deps) != 1 || deps[0] != "foo-cache" {
+		t.Fatalf("dependencies on charts that aren't retried should have been removed: %v", deps)
+	}
+	if len(fcr.Skipped) != 2 || fcr.Skipped[0] != "foo-db" || fcr.Skipped[1] != "foo-worker" {
+		t.Fatalf("bad skipped charts: %v", fcr.Skipped)
+	}
+	if len(fcr.Uninstall) != 1 || fcr.Uninstall[0] != "foo-cache" {
+		t.Fatalf("bad uninstalled releases: %v", fcr.Uninstall)
+	}
+	if len(fcr.Releases) != 4 || fcr.Releases["foo-bar"] != "foo-bar" || fcr.Releases["foo-db"] != "foo-db" {
+		t.Fatalf("bad releases: %v", fcr.Releases)
+	}
+
+	// a failed upgrade of a previously deployed release is upgraded again rather than uninstalled
+	rels[1].Version = 3
+	rels[1].Info.Status = release.StatusFailed
+	if fcr := retryFailedCharts(csl, rels); len(fcr.Charts) != 2 || len(fcr.Uninstall) != 0 {
+		t.Fatalf("bad retry after failed upgrade: %+v", fcr)
+	}
+
+	rels[1].Info.Status = release.StatusDeployed
+	rels = append(rels, &release.Release{Name: "foo-bar", Namespace: "nitro-1234-some-name", Version: 1, Info: &release.Info{Status: release.StatusDeployed}})
+	if fcr := retryFailedCharts(csl, rels); len(fcr.Charts) != 0 || len(fcr.Skipped) != 4 {
+		t.Fatalf("there should be nothing to retry: %+v", fcr)
+	}
+}
+
+func TestMetahelmImagesToRebuild(t *testing.T) {
+	imageCharts := map[string]struct{}{"foo-bar": struct{}{}, "foo-cache": struct{}{}, "foo-worker": struct{}{}}
+	titles := []string{"foo-bar", "foo-cache", "foo-db", "foo-worker"}
+	now := time.Now().UTC()
+	failed := &models.EventLog{
+		Status: models.EventStatusSummary{
+			Tree: map[string]models.EventStatusTreeNode{
+				"foo-bar":    models.EventStatusTreeNode{Image: models.EventStatusTreeNodeImage{Started: now, Completed: now}},
+				"foo-cache":  models.EventStatusTreeNode{Image: models.EventStatusTreeNodeImage{Started: now, Completed: now, Error: true}},
+				"foo-db":     models.EventStatusTreeNode{},
+				"foo-worker": models.EventStatusTreeNode{Image: models.EventStatusTreeNodeImage{Started: now}},
+			},
+		},
+	}
+	if rb := imagesToRebuild(titles, imageCharts, failed); len(rb) != 2 || rb[0] != "foo-cache" || rb[1] != "foo-worker" {
+		t.Fatalf("only failed and missing images should be rebuilt: %v", rb)
+	}
+	if rb := imagesToRebuild(titles, imageCharts, nil); len(rb) != 3 {
+		t.Fatalf("all images should be rebuilt without the failed event: %v", rb)
+	}
+}
+
+func TestMetahelmChartRelease(t *testing.T) {
+	title := strings.Repeat("a", 60)
+	rels := []*release.Release{&release.Release{Name: "foo"}, &release.Release{Name: metahelm.ReleaseName(title)}}
+	if rel := chartRelease(title, rels); rel == nil || rel.Name != rels[1].Name {
+		t.Fatalf("truncated release name should have matched: %v", rel)
+	}
+	if rel := chartRelease("foo", rels); rel == nil || rel.Name != "foo" {
+		t.Fatalf("release should have matched: %v", rel)
+	}
+	if rel := chartRelease("bar", rels); rel != nil {
+		t.Fatalf("release should not have matched: %v", rel)
+	}
+}
+
 func TestMetahelmWriteK8sEnvironment(t *testing.T) {
 	name := "foo-bar"
 	rc := &models.RepoConfig{
@@ -1355,3 +1682,399 @@ func TestMetahelmGetK8sEnvPodLogs(t *testing.T) {
 		t.Fatalf("error lines returned exceeded expected %v, actual %v", nLogLines, lineCount)
 	}
 }
+
+func TestMetahelmStreamPodLogs(t *testing.T) {
+	pod := &v1.Pod{
+		ObjectMeta: metav1.ObjectMeta{Name: "foo-app-abc123", Namespace: "foo"},
+		Spec: v1.PodSpec{
+			Containers: []v1.Container{{Name: "foo-app"}, {Name: "foo-app-sidecar"}},
+		},
+	}
+	ci := ChartInstaller{kc: fake.NewSimpleClientset(pod)}
+	lines, err := ci.StreamPodLogs(context.Background(), "foo", "foo-app-abc123", PodLogStreamOptions{Lines: 10, Timestamps: true})
+	if err != nil {
+		t.Fatalf("should have succeeded: %v", err)
+	}
+	containers := map[string]int{}
+	for l := range lines {
+		if l.Err != nil {
+			t.Fatalf("unexpected stream error: %v", l.Err)
+		}
+		containers[l.Container]++
+	}
+	if len(containers) != 2 || containers["foo-app"] != 1 || containers["foo-app-sidecar"] != 1 {
+		t.Fatalf("expected one line from each container, got %+v", containers)
+	}
+	if _, err := ci.StreamPodLogs(context.Background(), "foo", "foo-app-abc123", PodLogStreamOptions{Lines: MaxPodContainerLogLines + 1}); err == nil {
+		t.Fatalf("should have failed with excessive lines")
+	}
+	if _, err := ci.StreamPodLogs(context.Background(), "foo", "missing", PodLogStreamOptions{}); err == nil {
+		t.Fatalf("should have failed with missing pod")
+	}
+}
+
+func TestMetahelmFakeStreamPodLogsFollow(t *testing.T) {
+	fkr := FakeKubernetesReporter{
+		FakePodLogFilePath: "testdata/pod_logs.log",
+	}
+	ctx, cf := context.WithCancel(context.Background())
+	lines, err := fkr.StreamPodLogs(ctx, "foo", "foo-app-abc123", PodLogStreamOptions{Containers: []string{"foo-app"}, Lines: 5, Follow: true})
+	if err != nil {
+		t.Fatalf("should have succeeded: %v", err)
+	}
+	for i := 0; i < 5; i++ {
+		l := <-lines
+		if l.Container != "foo-app" || l.Line == "" {
+			t.Fatalf("unexpected line: %+v", l)
+		}
+	}
+	select {
+	case l, ok := <-lines:
+		t.Fatalf("follow stream should have stayed open and idle: %+v (open: %v)", l, ok)
+	case <-time.After(10 * time.Millisecond):
+	}
+	cf()
+	if _, ok := <-lines; ok {
+		t.Fatalf("stream should have been closed after cancellation")
+	}
+}
+
+func TestMetahelmGetNamespaceResources(t *testing.T) {
+	ci := stubResourceReporter("foo")
+	ctx := context.Background()
+	dl, err := ci.GetDeployments(ctx, "foo")
+	if err != nil {
+		t.Fatalf("should have succeeded: %v", err)
+	}
+	if len(dl) != 2 {
+		t.Fatalf("expected 2 deployments, got %v", len(dl))
+	}
+	for _, d := range dl {
+		if !d.Ready {
+			t.Fatalf("expected deployment %v to be ready", d.Name)
+		}
+		// bar-app pod containers have 1 + 4 restarts
+		if d.Name == "bar-app" && d.Restarts != 5 {
+			t.Fatalf("expected 5 restarts for bar-app, got %v", d.Restarts)
+		}
+	}
+	ssl, err := ci.GetStatefulSets(ctx, "foo")
+	if err != nil {
+		t.Fatalf("should have succeeded: %v", err)
+	}
+	if len(ssl) != 1 || ssl[0].Ready {
+		t.Fatalf("expected 1 unready statefulset, got %+v", ssl)
+	}
+	sl, err := ci.GetServices(ctx, "foo")
+	if err != nil {
+		t.Fatalf("should have succeeded: %v", err)
+	}
+	if len(sl) != 2 || !sl[0].Ready || sl[0].ReadyEndpoints != 1 {
+		t.Fatalf("expected 2 ready services, got %+v", sl)
+	}
+	il, err := ci.GetIngresses(ctx, "foo")
+	if err != nil {
+		t.Fatalf("should have succeeded: %v", err)
+	}
+	if len(il) != 1 || !il[0].Ready || il[0].Hosts[0] != "foo-app.example.com" {
+		t.Fatalf("unexpected ingresses: %+v", il)
+	}
+	jl, err := ci.GetJobs(ctx, "foo")
+	if err != nil {
+		t.Fatalf("should have succeeded: %v", err)
+	}
+	if len(jl) != 1 || !jl[0].Complete {
+		t.Fatalf("expected 1 complete job, got %+v", jl)
+	}
+	el, err := ci.GetEvents(ctx, "foo")
+	if err != nil {
+		t.Fatalf("should have succeeded: %v", err)
+	}
+	if len(el) != 1 || el[0].Object != "Pod/bar-app-abc123" || el[0].Count != 4 {
+		t.Fatalf("unexpected events: %+v", el)
+	}
+}
+
+func TestMetahelmServiceProxy(t *testing.T) {
+	var gotPath, gotQuery, gotAuth, gotCookie string
+	apiserver := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		gotPath, gotQuery = r.URL.Path, r.URL.RawQuery
+		gotAuth, gotCookie = r.Header.Get("Authorization"), r.Header.Get("Cookie")
+		http.SetCookie(w, &http.Cookie{Name: "session", Value: "attacker", Path: "/"})
+		w.Header().Set("Content-Security-Policy", "default-src *")
+		w.Write([]byte("ok"))
+	}))
+	defer apiserver.Close()
+	ci := ChartInstaller{rcfg: &rest.Config{Host: apiserver.URL, BearerToken: "k8stoken"}}
+	if _, err := ci.ServiceProxy("foo", "Invalid_Service", "80"); err == nil {
+		t.Fatalf("should have failed with invalid service name")
+	}
+	if _, err := ci.ServiceProxy("foo", "bar", "999999"); err == nil {
+		t.Fatalf("should have failed with invalid port")
+	}
+	h, err := ci.ServiceProxy("foo", "bar", "http")
+	if err != nil {
+		t.Fatalf("should have succeeded: %v", err)
+	}
+	req := httptest.NewRequest("GET", "/admin/status?verbose=1", nil)
+	req.Header.Set("Cookie", "session=secret")
+	req.Header.Set("API-Key", "secret")
+	rc := httptest.NewRecorder()
+	h.ServeHTTP(rc, req)
+	if rc.Code != http.StatusOK || rc.Body.String() != "ok" {
+		t.Fatalf("bad response: %v: %v", rc.Code, rc.Body.String())
+	}
+	if gotPath != "/api/v1/namespaces/foo/services/bar:http/proxy/admin/status" {
+		t.Fatalf("bad proxied path: %v", gotPath)
+	}
+	if gotQuery != "verbose=1" {
+		t.Fatalf("bad proxied query: %v", gotQuery)
+	}
+	if gotAuth != "Bearer k8stoken" {
+		t.Fatalf("expected installer credentials to be used: %v", gotAuth)
+	}
+	if gotCookie != "" {
+		t.Fatalf("client cookies should not have been forwarded: %v", gotCookie)
+	}
+	if sc := rc.Header().Values("Set-Cookie"); len(sc) > 0 {
+		t.Fatalf("service cookies should not have reached the client: %v", sc)
+	}
+	if csp := rc.Header().Values("Content-Security-Policy"); len(csp) != 1 || csp[0] != "sandbox" {
+		t.Fatalf("expected sandbox content security policy: %v", csp)
+	}
+	if cto := rc.Header().Get("X-Content-Type-Options"); cto != "nosniff" {
+		t.Fatalf("expected nosniff: %v", cto)
+	}
+}
+
+const postRenderTestManifests = `---
+# Source: foo/templates/deployment.yaml
+apiVersion: apps/v1
+kind: Deployment
+metadata:
+  name: foo
+  labels:
+    app: foo
+spec:
+  selector:
+    matchLabels:
+      app: foo
+  template:
+    metadata:
+      labels:
+        app: foo
+    spec:
+      initContainers:
+      - name: init
+        image: busybox
+        resources:
+          limits:
+            cpu: "2"
+      containers:
+      - name: foo
+        image: foo:1234
+        imagePullPolicy: IfNotPresent
+        resources:
+          requests:
+            cpu: 500m
+            memory: 64Mi
+---
+# Source: foo/templates/pdb.yaml
+apiVersion: policy/v1beta1
+kind: PodDisruptionBudget
+metadata:
+  name: foo
+spec:
+  minAvailable: 1
+  selector:
+    matchLabels:
+      app: foo
+---
+# Source: foo/templates/service.yaml
+apiVersion: v1
+kind: Service
+metadata:
+  name: foo
+spec:
+  ports:
+  - port: 80
+`
+
+func TestMetahelmPostRenderer(t *testing.T) {
+	pr, err := NewPostRenderer(models.PostRenderConfig{
+		Labels:              map[string]string{"acyl.dev/env": "foo-bar"},
+		Annotations:         map[string]string{"acyl.dev/owner": "platform"},
+		ImagePullPolicy:     "Always",
+		StripKinds:          []string{"PodDisruptionBudget"},
+		MaxResourceRequests: map[string]string{"cpu": "100m", "memory": "128Mi"},
+	})
+	if err != nil {
+		t.Fatalf("error getting post-renderer: %v", err)
+	}
+	out, err := pr.Run(bytes.NewBufferString(postRenderTestManifests))
+	if err != nil {
+		t.Fatalf("error running post-renderer: %v", err)
+	}
+	var d *appsv1.Deployment
+	var svc *v1.Service
+	for _, doc := range strings.Split(out.String(), "---\n") {
+		if strings.TrimSpace(doc) == "" {
+			continue
+		}
+		obj, _, err := scheme.Codecs.UniversalDeserializer().Decode([]byte(doc), nil, nil)
+		if err != nil {
+			t.Fatalf("error decoding output: %v: %v", err, doc)
+		}
+		switch o := obj.(type) {
+		case *appsv1.Deployment:
+			d = o
+		case *v1.Service:
+			svc = o
+		default:
+			t.Fatalf("unexpected object in output: %T", obj)
+		}
+	}
+	if d == nil || svc == nil {
+		t.Fatalf("missing objects in output: %v", out.String())
+	}
+	for _, om := range []metav1.ObjectMeta{d.ObjectMeta, d.Spec.Template.ObjectMeta, svc.ObjectMeta} {
+		if om.Labels["acyl.dev/env"] != "foo-bar" || om.Annotations["acyl.dev/owner"] != "platform" {
+			t.Errorf("missing label or annotation: %+v", om)
+		}
+	}
+	if d.Labels["app"] != "foo" {
+		t.Errorf("existing label should have been preserved: %+v", d.Labels)
+	}
+	c := d.Spec.Template.Spec.Containers[0]
+	if c.ImagePullPolicy != v1.PullAlways {
+		t.Errorf("bad pull policy: %v", c.ImagePullPolicy)
+	}
+	if cpu := c.Resources.Requests[v1.ResourceCPU]; cpu.String() != "100m" {
+		t.Errorf("cpu request should have been reduced: %v", cpu.String())
+	}
+	if mem := c.Resources.Requests[v1.ResourceMemory]; mem.String() != "64Mi" {
+		t.Errorf("memory request should have been unchanged: %v", mem.String())
+	}
+	ic := d.Spec.Template.Spec.InitContainers[0]
+	if ic.ImagePullPolicy != v1.PullAlways {
+		t.Errorf("bad init container pull policy: %v", ic.ImagePullPolicy)
+	}
+	if cpu := ic.Resources.Requests[v1.ResourceCPU]; cpu.String() != "100m" {
+		t.Errorf("init container cpu request should have been set below the limit: %v", cpu.String())
+	}
+	if _, err := NewPostRenderer(models.PostRenderConfig{ImagePullPolicy: "Sometimes"}); err == nil {
+		t.Errorf("should have failed with invalid pull policy")
+	}
+	if _, err := NewPostRenderer(models.PostRenderConfig{MaxResourceRequests: map[string]string{"cpu": "lots"}}); err == nil {
+		t.Errorf("should have failed with invalid quantity")
+	}
+}
+
+// buildCaptureKubeClient records the manifests passed to Build
+type buildCaptureKubeClient struct {
+	testKubeClient
+	built []string
+}
+
+func (bc *buildCaptureKubeClient) Build(reader io.Reader, validate bool) (kube.ResourceList, error) {
+	b, err := io.ReadAll(reader)
+	if err != nil {
+		return nil, err
+	}
+	bc.built = append(bc.built, string(b))
+	return kube.ResourceList{}, nil
+}
+
+func TestMetahelmPostRenderKubeClient(t *testing.T) {
+	ci := ChartInstaller{
+		hccfg: config.HelmClientConfig{PostRenderDefaultsJSON: `{"strip_kinds":["PodDisruptionBudget"],"labels":{"team":"platform","env":"qa"}}`},
+	}
+	env := &EnvInfo{
+		Env: &models.QAEnvironment{Name: "foo-bar"},
+		RC: &models.RepoConfig{
+			PostRender: models.PostRenderConfig{
+				Labels: map[string]string{"team": "foo", "owner": "foo"},
+			},
+		},
+	}
+	pr, err := ci.postRenderer(env)
+	if err != nil {
+		t.Fatalf("error getting post-renderer: %v", err)
+	}
+	bc := &buildCaptureKubeClient{}
+	prkc := &postRenderKubeClient{Interface: bc, pr: pr}
+	if _, err := prkc.Build(strings.NewReader(postRenderTestManifests), true); err != nil {
+		t.Fatalf("error building: %v", err)
+	}
+	if len(bc.built) != 1 {
+		t.Fatalf("expected one build: %v", len(bc.built))
+	}
+	if strings.Contains(bc.built[0], "kind: PodDisruptionBudget") {
+		t.Errorf("PodDisruptionBudget should have been stripped: %v", bc.built[0])
+	}
+	if strings.Count(bc.built[0], "team: 'platform'") != 3 || strings.Count(bc.built[0], "env: 'qa'") != 3 || strings.Count(bc.built[0], "owner: 'foo'") != 3 {
+		t.Errorf("labels should have been applied with the server defaults taking precedence: %v", bc.built[0])
+	}
+	ci.hccfg.PostRenderDefaultsJSON = ""
+	env.RC.PostRender = models.PostRenderConfig{}
+	if pr, err := ci.postRenderer(env); err != nil || pr != nil {
+		t.Fatalf("expected no post-renderer: %v, %v", pr, err)
+	}
+}
+
+func TestMetahelmHibernateAndWakeNamespace(t *testing.T) {
+	ns := "nitro-1234-some-name"
+	three, zero := int32(3), int32(0)
+	fkc := fake.NewSimpleClientset(
+		&appsv1.Deployment{ObjectMeta: metav1.ObjectMeta{Name: "web", Namespace: ns}, Spec: appsv1.DeploymentSpec{Replicas: &three}},
+		&appsv1.Deployment{ObjectMeta: metav1.ObjectMeta{Name: "worker", Namespace: ns}},
+		&appsv1.Deployment{ObjectMeta: metav1.ObjectMeta{Name: "disabled", Namespace: ns}, Spec: appsv1.DeploymentSpec{Replicas: &zero}},
+		&appsv1.StatefulSet{ObjectMeta: metav1.ObjectMeta{Name: "db", Namespace: ns}, Spec: appsv1.StatefulSetSpec{Replicas: &three}},
+	)
+	ci := ChartInstaller{kc: fkc}
+	k8senv := &models.KubernetesEnvironment{Namespace: ns}
+	replicas := func() map[string]int32 {
+		out := map[string]int32{}
+		dl, _ := fkc.AppsV1().Deployments(ns).List(context.Background(), metav1.ListOptions{})
+		for _, d := range dl.Items {
+			out[d.Name] = 1
+			if d.Spec.Replicas != nil {
+				out[d.Name] = *d.Spec.Replicas
+			}
+		}
+		ssl, _ := fkc.AppsV1().StatefulSets(ns).List(context.Background(), metav1.ListOptions{})
+		for _, ss := range ssl.Items {
+			out[ss.Name] = *ss.Spec.Replicas
+		}
+		return out
+	}
+	if err := ci.HibernateNamespace(context.Background(), k8senv); err != nil {
+		t.Fatalf("hibernate should have succeeded: %v", err)
+	}
+	for k, v := range replicas() {
+		if v != 0 {
+			t.Errorf("expected %v to have zero replicas after hibernate: %v", k, v)
+		}
+	}
+	d, _ := fkc.AppsV1().Deployments(ns).Get(context.Background(), "disabled", metav1.GetOptions{})
+	if _, ok := d.Annotations[HibernatedReplicasAnnotation]; ok {
+		t.Errorf("workload already scaled to zero should not have been annotated")
+	}
+	// hibernating twice must not overwrite the recorded replica counts
+	if err := ci.HibernateNamespace(context.Background(), k8senv); err != nil {
+		t.Fatalf("second hibernate should have succeeded: %v", err)
+	}
+	if err := ci.WakeNamespace(context.Background(), k8senv); err != nil {
+		t.Fatalf("wake should have succeeded: %v", err)
+	}
+	expected := map[string]int32{"web": 3, "worker": 1, "disabled": 0, "db": 3}
+	for k, v := range replicas() {
+		if expected[k] != v {
+			t.Errorf("bad replicas after wake for %v: expected %v, got %v", k, expected[k], v)
+		}
+	}
+	d, _ = fkc.AppsV1().Deployments(ns).Get(context.Background(), "web", metav1.GetOptions{})
+	if _, ok := d.Annotations[HibernatedReplicasAnnotation]; ok {
+		t.Errorf("annotation should have been removed after wake")
+	}
+}
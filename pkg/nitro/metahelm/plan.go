@@ -0,0 +1,125 @@
+package metahelm
+
+import (
+	"context"
+	"fmt"
+	"sort"
+
+	"github.com/dollarshaveclub/acyl/pkg/models"
+	"github.com/dollarshaveclub/acyl/pkg/nitro/metrics"
+	"github.com/dollarshaveclub/metahelm/pkg/metahelm"
+	"gopkg.in/src-d/go-billy.v4"
+)
+
+// NewChartPlanner returns a ChartInstaller that may only be used to generate and plan charts (which require neither a k8s
+// client nor an image builder), reading chart vars files from fs
+func NewChartPlanner(fs billy.Filesystem, mc metrics.Collector) *ChartInstaller {
+	return &ChartInstaller{fs: fs, mc: mc}
+}
+
+// PlanCharts generates the charts for env as they would be installed into namespace ns and returns a plan containing the
+// resolved refs, install order and final values of each chart. No images are built and the cluster is not accessed.
+// The plan must be diffed against an extant environment (if any) to calculate chart actions.
+func (ci ChartInstaller) PlanCharts(ctx context.Context, ns string, env *EnvInfo, cl ChartLocations) (*models.EnvironmentPlan, error) {
+	rm, err := env.RC.RefMap()
+	if err != nil {
+		return nil, fmt.Errorf("error generating refmap from repoconfig: %w", err)
+	}
+	csm, err := env.RC.CommitSHAMap()
+	if err != nil {
+		return nil, fmt.Errorf("error generating commit sha map from repoconfig: %w", err)
+	}
+	csl, err := ci.GenerateCharts(ctx, ns, env, cl)
+	if err != nil {
+		return nil, fmt.Errorf("error generating metahelm charts: %w", err)
+	}
+	order, err := installOrder(csl)
+	if err != nil {
+		return nil, fmt.Errorf("error calculating install order: %w", err)
+	}
+	repos := map[string]string{models.GetName(env.RC.Application.Repo): env.RC.Application.Repo}
+	for _, d := range env.RC.Dependencies.All() {
+		repos[d.Name] = d.Repo
+	}
+	nrmap := env.RC.NameToRefMap()
+	plan := &models.EnvironmentPlan{
+		RefMap:       rm,
+		CommitSHAMap: csm,
+		InstallOrder: order,
+		Charts:       make([]models.PlannedChart, len(csl)),
+	}
+	for i, c := range csl {
+		plan.Charts[i] = models.PlannedChart{
+			Name:        c.Title,
+			Repo:        repos[c.Title],
+			RevisionSHA: nrmap[c.Title],
+			Requires:    c.DependencyList,
+			Values:      string(c.ValueOverrides),
+		}
+	}
+	return plan, nil
+}
+
+// installOrder returns the names of charts grouped by the stage in which metahelm would install them, in order. As in the metahelm
+// object graph, the level of a chart is the length of the longest path to it from a chart that nothing requires, and levels
+// are installed from the deepest up.
+func installOrder(charts []metahelm.Chart) ([][]string, error) {
+	requiredBy := make(map[string][]string, len(charts))
+	for _, c := range charts {
+		if _, ok := requiredBy[c.Title]; ok {
+			return nil, fmt.Errorf("duplicate chart: %v", c.Title)
+		}
+		requiredBy[c.Title] = []string{}
+	}
+	for _, c := range charts {
+		for _, d := range c.DependencyList {
+			if _, ok := requiredBy[d]; !ok {
+				return nil, fmt.Errorf("unknown dependency of %v: %v", c.Title, d)
+			}
+			requiredBy[d] = append(requiredBy[d], c.Title)
+		}
+	}
+	levels := make(map[string]int, len(charts))
+	visiting := map[string]bool{}
+	var level func(name string) (int, error)
+	level = func(name string) (int, error) {
+		if l, ok := levels[name]; ok {
+			return l, nil
+		}
+		if visiting[name] {
+			return 0, fmt.Errorf("dependency cycle including %v", name)
+		}
+		visiting[name] = true
+		l := 0
+		for _, p := range requiredBy[name] {
+			pl, err := level(p)
+			if err != nil {
+				return 0, err
+			}
+			if pl+1 > l {
+				l = pl + 1
+			}
+		}
+		visiting[name] = false
+		levels[name] = l
+		return l, nil
+	}
+	max := 0
+	for _, c := range charts {
+		l, err := level(c.Title)
+		if err != nil {
+			return nil, err
+		}
+		if l > max {
+			max = l
+		}
+	}
+	out := make([][]string, max+1)
+	for name, l := range levels {
+		out[max-l] = append(out[max-l], name)
+	}
+	for i := range out {
+		sort.Strings(out[i])
+	}
+	return out, nil
+}
@@ -0,0 +1,223 @@
+package metahelm
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"time"
+
+	"github.com/dollarshaveclub/acyl/pkg/models"
+	nitroerrors "github.com/dollarshaveclub/acyl/pkg/nitro/errors"
+	"helm.sh/helm/v3/pkg/kube"
+	"helm.sh/helm/v3/pkg/postrender"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
+	"sigs.k8s.io/kustomize/kyaml/kio"
+	"sigs.k8s.io/kustomize/kyaml/yaml"
+)
+
+// podTemplatePaths are the locations of pod templates within workload objects
+var podTemplatePaths = [][]string{
+	{"spec", "template"},                        // Deployment, StatefulSet, DaemonSet, ReplicaSet, Job, ReplicationController
+	{"spec", "jobTemplate", "spec", "template"}, // CronJob
+}
+
+// PostRenderer is a Helm post-renderer that applies the transforms in a PostRenderConfig to rendered chart manifests
+type PostRenderer struct {
+	cfg         models.PostRenderConfig
+	stripKinds  map[string]struct{}
+	maxRequests map[string]resource.Quantity
+}
+
+var _ postrender.PostRenderer = &PostRenderer{}
+
+// NewPostRenderer validates prc and returns a PostRenderer for it
+func NewPostRenderer(prc models.PostRenderConfig) (*PostRenderer, error) {
+	switch corev1.PullPolicy(prc.ImagePullPolicy) {
+	case "", corev1.PullAlways, corev1.PullIfNotPresent, corev1.PullNever:
+	default:
+		return nil, nitroerrors.User(fmt.Errorf("invalid post-render image pull policy: %v", prc.ImagePullPolicy))
+	}
+	pr := &PostRenderer{
+		cfg:         prc,
+		stripKinds:  make(map[string]struct{}, len(prc.StripKinds)),
+		maxRequests: make(map[string]resource.Quantity, len(prc.MaxResourceRequests)),
+	}
+	for _, k := range prc.StripKinds {
+		pr.stripKinds[k] = struct{}{}
+	}
+	for k, v := range prc.MaxResourceRequests {
+		q, err := resource.ParseQuantity(v)
+		if err != nil {
+			return nil, nitroerrors.User(fmt.Errorf("invalid post-render max resource request for %v: %v: %w", k, v, err))
+		}
+		pr.maxRequests[k] = q
+	}
+	return pr, nil
+}
+
+// Run applies the transforms to renderedManifests, a YAML stream of Kubernetes objects
+func (pr *PostRenderer) Run(renderedManifests *bytes.Buffer) (*bytes.Buffer, error) {
+	nodes, err := (&kio.ByteReader{Reader: renderedManifests, OmitReaderAnnotations: true, DisableUnwrapping: true}).Read()
+	if err != nil {
+		return nil, fmt.Errorf("error parsing manifests: %w", err)
+	}
+	out := make([]*yaml.RNode, 0, len(nodes))
+	for _, n := range nodes {
+		if _, ok := pr.stripKinds[n.GetKind()]; ok {
+			continue
+		}
+		if err := pr.transform(n); err != nil {
+			return nil, fmt.Errorf("error transforming %v %v: %w", n.GetKind(), n.GetName(), err)
+		}
+		out = append(out, n)
+	}
+	buf := &bytes.Buffer{}
+	if err := (kio.ByteWriter{Writer: buf}).Write(out); err != nil {
+		return nil, fmt.Errorf("error serializing manifests: %w", err)
+	}
+	return buf, nil
+}
+
+func (pr *PostRenderer) setMetadata(n *yaml.RNode) error {
+	for k, v := range pr.cfg.Labels {
+		if err := n.PipeE(yaml.SetLabel(k, v)); err != nil {
+			return fmt.Errorf("error setting label: %v: %w", k, err)
+		}
+	}
+	for k, v := range pr.cfg.Annotations {
+		if err := n.PipeE(yaml.SetAnnotation(k, v)); err != nil {
+			return fmt.Errorf("error setting annotation: %v: %w", k, err)
+		}
+	}
+	return nil
+}
+
+func (pr *PostRenderer) transform(n *yaml.RNode) error {
+	if err := pr.setMetadata(n); err != nil {
+		return err
+	}
+	if n.GetKind() == "Pod" {
+		return pr.transformPodSpec(n.Field("spec"))
+	}
+	for _, p := range podTemplatePaths {
+		tmpl, err := n.Pipe(yaml.Lookup(p...))
+		if err != nil {
+			return fmt.Errorf("error looking up pod template: %w", err)
+		}
+		if tmpl == nil || tmpl.Field("spec") == nil {
+			continue
+		}
+		if err := pr.setMetadata(tmpl); err != nil {
+			return fmt.Errorf("pod template: %w", err)
+		}
+		if err := pr.transformPodSpec(tmpl.Field("spec")); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (pr *PostRenderer) transformPodSpec(spec *yaml.MapNode) error {
+	if spec == nil {
+		return nil
+	}
+	for _, f := range []string{"containers", "initContainers"} {
+		cl := spec.Value.Field(f)
+		if cl == nil {
+			continue
+		}
+		elems, err := cl.Value.Elements()
+		if err != nil {
+			return fmt.Errorf("error getting %v: %w", f, err)
+		}
+		for _, c := range elems {
+			if err := pr.transformContainer(c); err != nil {
+				return fmt.Errorf("%v: %w", f, err)
+			}
+		}
+	}
+	return nil
+}
+
+func (pr *PostRenderer) transformContainer(c *yaml.RNode) error {
+	if pr.cfg.ImagePullPolicy != "" {
+		if err := c.PipeE(yaml.SetField("imagePullPolicy", yaml.NewScalarRNode(pr.cfg.ImagePullPolicy))); err != nil {
+			return fmt.Errorf("error setting image pull policy: %w", err)
+		}
+	}
+	for res, max := range pr.maxRequests {
+		// a container that sets a limit but no request gets a request equal to the limit
+		cur, err := c.Pipe(yaml.Lookup("resources", "requests", res))
+		if err != nil {
+			return fmt.Errorf("error getting resource request: %v: %w", res, err)
+		}
+		if cur == nil {
+			if cur, err = c.Pipe(yaml.Lookup("resources", "limits", res)); err != nil {
+				return fmt.Errorf("error getting resource limit: %v: %w", res, err)
+			}
+		}
+		if cur == nil {
+			continue
+		}
+		q, err := resource.ParseQuantity(cur.YNode().Value)
+		if err != nil {
+			return fmt.Errorf("invalid resource quantity for %v: %v: %w", res, cur.YNode().Value, err)
+		}
+		if q.Cmp(max) <= 0 {
+			continue
+		}
+		if err := c.PipeE(yaml.LookupCreate(yaml.MappingNode, "resources", "requests"), yaml.SetField(res, yaml.NewScalarRNode(max.String()))); err != nil {
+			return fmt.Errorf("error setting resource request: %v: %w", res, err)
+		}
+	}
+	return nil
+}
+
+// postRenderer returns the post-renderer for env, combining the server defaults with the triggering repo's acyl.yml post_render,
+// or nil if no transforms are configured
+func (ci ChartInstaller) postRenderer(env *EnvInfo) (*PostRenderer, error) {
+	prc := models.PostRenderConfig{}
+	if ci.hccfg.PostRenderDefaultsJSON != "" {
+		if err := json.Unmarshal([]byte(ci.hccfg.PostRenderDefaultsJSON), &prc); err != nil {
+			return nil, fmt.Errorf("error unmarshaling post-render defaults: %w", err)
+		}
+	}
+	if env != nil && env.RC != nil {
+		prc = prc.Merge(env.RC.PostRender)
+	}
+	if prc.Empty() {
+		return nil, nil
+	}
+	return NewPostRenderer(prc)
+}
+
+// postRenderKubeClient wraps a Helm kube client so that every manifest Helm builds for the cluster (release objects, hooks and CRDs)
+// is passed through a post-renderer first. The metahelm library creates its Helm install and upgrade actions internally without
+// exposing their PostRenderer option, so the hook is applied here instead.
+type postRenderKubeClient struct {
+	kube.Interface
+	pr postrender.PostRenderer
+}
+
+var _ kube.InterfaceExt = &postRenderKubeClient{}
+
+func (c *postRenderKubeClient) Build(reader io.Reader, validate bool) (kube.ResourceList, error) {
+	in := &bytes.Buffer{}
+	if _, err := in.ReadFrom(reader); err != nil {
+		return nil, fmt.Errorf("error reading manifests: %w", err)
+	}
+	out, err := c.pr.Run(in)
+	if err != nil {
+		return nil, fmt.Errorf("error post-rendering manifests: %w", err)
+	}
+	return c.Interface.Build(out, validate)
+}
+
+func (c *postRenderKubeClient) WaitForDelete(resources kube.ResourceList, timeout time.Duration) error {
+	if ie, ok := c.Interface.(kube.InterfaceExt); ok {
+		return ie.WaitForDelete(resources, timeout)
+	}
+	return nil
+}
@@ -0,0 +1,98 @@
+package metahelm
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"path"
+	"strconv"
+	"strings"
+
+	"k8s.io/apimachinery/pkg/util/validation"
+	"k8s.io/client-go/rest"
+)
+
+// proxyStrippedHeaders are client credentials that must never be forwarded to the API server or the proxied service
+var proxyStrippedHeaders = []string{"Authorization", "Cookie", "API-Key"}
+
+// proxyResponseHeaders are set on every proxied response. The service is built from arbitrary PR branches but is served
+// on acyl's origin, so its content is sandboxed (no scripts or same-origin access) and must not be content-sniffed.
+var proxyResponseHeaders = map[string]string{
+	"Content-Security-Policy": "sandbox",
+	"X-Content-Type-Options":  "nosniff",
+}
+
+// ValidateServiceProxyTarget checks that service and port are syntactically valid for a Kubernetes service proxy request.
+// port may be either a port number or a named service port.
+func ValidateServiceProxyTarget(service, port string) error {
+	if errs := validation.IsDNS1035Label(service); len(errs) > 0 {
+		return fmt.Errorf("invalid service name: %v", strings.Join(errs, ", "))
+	}
+	if n, err := strconv.Atoi(port); err == nil {
+		if len(validation.IsValidPortNum(n)) > 0 {
+			return fmt.Errorf("invalid port: %v", port)
+		}
+		return nil
+	}
+	if errs := validation.IsValidPortName(port); len(errs) > 0 {
+		return fmt.Errorf("invalid port name: %v", strings.Join(errs, ", "))
+	}
+	return nil
+}
+
+// newServiceProxy returns a reverse proxy that sends requests to the API server service proxy subresource
+// for service:port in namespace ns. The incoming request path is treated as relative to the service root.
+func newServiceProxy(apiserver *url.URL, rt http.RoundTripper, ns, service, port string) *httputil.ReverseProxy {
+	prefix := path.Join(apiserver.Path, "/api/v1/namespaces", ns, "services", service+":"+port, "proxy")
+	return &httputil.ReverseProxy{
+		Director: func(r *http.Request) {
+			rpath := r.URL.Path
+			r.URL.Scheme = apiserver.Scheme
+			r.URL.Host = apiserver.Host
+			r.URL.Path = prefix + "/" + strings.TrimPrefix(rpath, "/")
+			r.URL.RawPath = ""
+			r.Host = apiserver.Host
+			for _, h := range proxyStrippedHeaders {
+				r.Header.Del(h)
+			}
+			// don't add the client address to X-Forwarded-For, the service only ever sees the API server
+			r.Header["X-Forwarded-For"] = nil
+		},
+		// the service must not be able to set cookies on (or overwrite the session for) acyl's origin
+		ModifyResponse: func(resp *http.Response) error {
+			resp.Header.Del("Set-Cookie")
+			for k, v := range proxyResponseHeaders {
+				resp.Header.Set(k, v)
+			}
+			return nil
+		},
+		Transport: rt,
+	}
+}
+
+// ServiceProxy returns an http.Handler that proxies HTTP and WebSocket requests to port of service in namespace ns
+// via the Kubernetes API server, using the installer's credentials. The request URL path is used as the path on the service.
+func (ci ChartInstaller) ServiceProxy(ns, service, port string) (http.Handler, error) {
+	if err := ValidateServiceProxyTarget(service, port); err != nil {
+		return nil, err
+	}
+	if ci.rcfg == nil {
+		return nil, fmt.Errorf("kubernetes rest config is missing")
+	}
+	apiserver, err := url.Parse(ci.rcfg.Host)
+	if err != nil {
+		return nil, fmt.Errorf("error parsing api server host: %w", err)
+	}
+	if apiserver.Scheme == "" {
+		apiserver, err = url.Parse("https://" + ci.rcfg.Host)
+		if err != nil {
+			return nil, fmt.Errorf("error parsing api server host: %w", err)
+		}
+	}
+	rt, err := rest.TransportFor(ci.rcfg)
+	if err != nil {
+		return nil, fmt.Errorf("error getting api server transport: %w", err)
+	}
+	return newServiceProxy(apiserver, rt, ns, service, port), nil
+}
@@ -0,0 +1,298 @@
+package metahelm
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"time"
+
+	appsv1 "k8s.io/api/apps/v1"
+	batchv1 "k8s.io/api/batch/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+)
+
+// K8sWorkload models the returned Deployment or StatefulSet details
+type K8sWorkload struct {
+	Name, Kind                               string
+	Replicas, ReadyReplicas, UpdatedReplicas int32
+	Ready                                    bool
+	Restarts                                 int32
+	Images                                   []string
+	Age                                      time.Duration
+}
+
+// K8sService models the returned Service details
+type K8sService struct {
+	Name, Type, ClusterIP             string
+	Ports                             []string
+	ReadyEndpoints, NotReadyEndpoints int
+	Ready                             bool
+	Age                               time.Duration
+}
+
+// K8sIngress models the returned Ingress details
+type K8sIngress struct {
+	Name      string
+	Hosts     []string
+	Addresses []string
+	Ready     bool
+	Age       time.Duration
+}
+
+// K8sJob models the returned Job details
+type K8sJob struct {
+	Name                                   string
+	Completions, Active, Succeeded, Failed int32
+	Complete                               bool
+	Restarts                               int32
+	Age                                    time.Duration
+}
+
+// K8sEvent models the returned namespace Event details
+type K8sEvent struct {
+	Type, Reason, Object, Message string
+	Count                         int32
+	FirstSeen, LastSeen           time.Time
+}
+
+// podRestarts returns the total container restart count of the pods matched by selector
+func podRestarts(pods []corev1.Pod, selector *metav1.LabelSelector) int32 {
+	if selector == nil {
+		return 0
+	}
+	sel, err := metav1.LabelSelectorAsSelector(selector)
+	if err != nil || sel.Empty() {
+		return 0
+	}
+	var n int32
+	for _, p := range pods {
+		if !sel.Matches(labels.Set(p.Labels)) {
+			continue
+		}
+		for _, cs := range p.Status.ContainerStatuses {
+			n += cs.RestartCount
+		}
+	}
+	return n
+}
+
+func containerImages(spec corev1.PodSpec) []string {
+	out := make([]string, 0, len(spec.Containers))
+	for _, c := range spec.Containers {
+		out = append(out, c.Image)
+	}
+	return out
+}
+
+func replicasOrDefault(r *int32) int32 {
+	if r == nil {
+		return 1
+	}
+	return *r
+}
+
+func (ci ChartInstaller) listPods(ctx context.Context, ns string) ([]corev1.Pod, error) {
+	pl, err := ci.kc.CoreV1().Pods(ns).List(ctx, metav1.ListOptions{})
+	if err != nil {
+		return nil, fmt.Errorf("error unable to retrieve pods for namespace %v: %w", ns, err)
+	}
+	return pl.Items, nil
+}
+
+func deploymentsToWorkloads(dl []appsv1.Deployment, pods []corev1.Pod) []K8sWorkload {
+	out := []K8sWorkload{}
+	for _, d := range dl {
+		replicas := replicasOrDefault(d.Spec.Replicas)
+		out = append(out, K8sWorkload{
+			Name:            d.Name,
+			Kind:            "Deployment",
+			Replicas:        replicas,
+			ReadyReplicas:   d.Status.ReadyReplicas,
+			UpdatedReplicas: d.Status.UpdatedReplicas,
+			Ready:           d.Status.ReadyReplicas >= replicas && d.Status.UpdatedReplicas >= replicas,
+			Restarts:        podRestarts(pods, d.Spec.Selector),
+			Images:          containerImages(d.Spec.Template.Spec),
+			Age:             time.Since(d.CreationTimestamp.Time),
+		})
+	}
+	return out
+}
+
+func statefulSetsToWorkloads(ssl []appsv1.StatefulSet, pods []corev1.Pod) []K8sWorkload {
+	out := []K8sWorkload{}
+	for _, s := range ssl {
+		replicas := replicasOrDefault(s.Spec.Replicas)
+		out = append(out, K8sWorkload{
+			Name:            s.Name,
+			Kind:            "StatefulSet",
+			Replicas:        replicas,
+			ReadyReplicas:   s.Status.ReadyReplicas,
+			UpdatedReplicas: s.Status.UpdatedReplicas,
+			Ready:           s.Status.ReadyReplicas >= replicas,
+			Restarts:        podRestarts(pods, s.Spec.Selector),
+			Images:          containerImages(s.Spec.Template.Spec),
+			Age:             time.Since(s.CreationTimestamp.Time),
+		})
+	}
+	return out
+}
+
+// GetDeployments returns the Deployments in the namespace with readiness and pod restart counts
+func (ci ChartInstaller) GetDeployments(ctx context.Context, ns string) (out []K8sWorkload, err error) {
+	dl, err := ci.kc.AppsV1().Deployments(ns).List(ctx, metav1.ListOptions{})
+	if err != nil {
+		return []K8sWorkload{}, fmt.Errorf("error unable to retrieve deployments for namespace %v: %w", ns, err)
+	}
+	pods, err := ci.listPods(ctx, ns)
+	if err != nil {
+		return []K8sWorkload{}, err
+	}
+	return deploymentsToWorkloads(dl.Items, pods), nil
+}
+
+// GetStatefulSets returns the StatefulSets in the namespace with readiness and pod restart counts
+func (ci ChartInstaller) GetStatefulSets(ctx context.Context, ns string) (out []K8sWorkload, err error) {
+	ssl, err := ci.kc.AppsV1().StatefulSets(ns).List(ctx, metav1.ListOptions{})
+	if err != nil {
+		return []K8sWorkload{}, fmt.Errorf("error unable to retrieve statefulsets for namespace %v: %w", ns, err)
+	}
+	pods, err := ci.listPods(ctx, ns)
+	if err != nil {
+		return []K8sWorkload{}, err
+	}
+	return statefulSetsToWorkloads(ssl.Items, pods), nil
+}
+
+// GetServices returns the Services in the namespace. A Service is ready if it has at least one ready endpoint
+// or if it doesn't select any pods (ExternalName and selector-less services).
+func (ci ChartInstaller) GetServices(ctx context.Context, ns string) (out []K8sService, err error) {
+	sl, err := ci.kc.CoreV1().Services(ns).List(ctx, metav1.ListOptions{})
+	if err != nil {
+		return []K8sService{}, fmt.Errorf("error unable to retrieve services for namespace %v: %w", ns, err)
+	}
+	el, err := ci.kc.CoreV1().Endpoints(ns).List(ctx, metav1.ListOptions{})
+	if err != nil {
+		return []K8sService{}, fmt.Errorf("error unable to retrieve endpoints for namespace %v: %w", ns, err)
+	}
+	endpoints := make(map[string]corev1.Endpoints, len(el.Items))
+	for _, e := range el.Items {
+		endpoints[e.Name] = e
+	}
+	out = []K8sService{}
+	for _, s := range sl.Items {
+		svc := K8sService{
+			Name:      s.Name,
+			Type:      string(s.Spec.Type),
+			ClusterIP: s.Spec.ClusterIP,
+			Age:       time.Since(s.CreationTimestamp.Time),
+		}
+		for _, p := range s.Spec.Ports {
+			svc.Ports = append(svc.Ports, fmt.Sprintf("%v:%v/%v", p.Name, p.Port, p.Protocol))
+		}
+		for _, ss := range endpoints[s.Name].Subsets {
+			svc.ReadyEndpoints += len(ss.Addresses)
+			svc.NotReadyEndpoints += len(ss.NotReadyAddresses)
+		}
+		svc.Ready = svc.ReadyEndpoints > 0 || len(s.Spec.Selector) == 0
+		out = append(out, svc)
+	}
+	return out, nil
+}
+
+// GetIngresses returns the Ingresses in the namespace. An Ingress is ready once it has been assigned a load balancer address.
+func (ci ChartInstaller) GetIngresses(ctx context.Context, ns string) (out []K8sIngress, err error) {
+	il, err := ci.kc.NetworkingV1().Ingresses(ns).List(ctx, metav1.ListOptions{})
+	if err != nil {
+		return []K8sIngress{}, fmt.Errorf("error unable to retrieve ingresses for namespace %v: %w", ns, err)
+	}
+	out = []K8sIngress{}
+	for _, i := range il.Items {
+		ing := K8sIngress{
+			Name: i.Name,
+			Age:  time.Since(i.CreationTimestamp.Time),
+		}
+		for _, r := range i.Spec.Rules {
+			if r.Host != "" {
+				ing.Hosts = append(ing.Hosts, r.Host)
+			}
+		}
+		for _, lb := range i.Status.LoadBalancer.Ingress {
+			if lb.Hostname != "" {
+				ing.Addresses = append(ing.Addresses, lb.Hostname)
+			}
+			if lb.IP != "" {
+				ing.Addresses = append(ing.Addresses, lb.IP)
+			}
+		}
+		ing.Ready = len(ing.Addresses) > 0
+		out = append(out, ing)
+	}
+	return out, nil
+}
+
+func jobsToK8sJobs(jl []batchv1.Job, pods []corev1.Pod) []K8sJob {
+	out := []K8sJob{}
+	for _, j := range jl {
+		job := K8sJob{
+			Name:        j.Name,
+			Completions: replicasOrDefault(j.Spec.Completions),
+			Active:      j.Status.Active,
+			Succeeded:   j.Status.Succeeded,
+			Failed:      j.Status.Failed,
+			Restarts:    podRestarts(pods, j.Spec.Selector),
+			Age:         time.Since(j.CreationTimestamp.Time),
+		}
+		for _, c := range j.Status.Conditions {
+			if c.Type == batchv1.JobComplete && c.Status == corev1.ConditionTrue {
+				job.Complete = true
+			}
+		}
+		out = append(out, job)
+	}
+	return out
+}
+
+// GetJobs returns the Jobs in the namespace with completion status and pod restart counts
+func (ci ChartInstaller) GetJobs(ctx context.Context, ns string) (out []K8sJob, err error) {
+	jl, err := ci.kc.BatchV1().Jobs(ns).List(ctx, metav1.ListOptions{})
+	if err != nil {
+		return []K8sJob{}, fmt.Errorf("error unable to retrieve jobs for namespace %v: %w", ns, err)
+	}
+	pods, err := ci.listPods(ctx, ns)
+	if err != nil {
+		return []K8sJob{}, err
+	}
+	return jobsToK8sJobs(jl.Items, pods), nil
+}
+
+func eventsToK8sEvents(el []corev1.Event) []K8sEvent {
+	out := make([]K8sEvent, 0, len(el))
+	for _, e := range el {
+		last := e.LastTimestamp.Time
+		if last.IsZero() {
+			last = e.EventTime.Time
+		}
+		out = append(out, K8sEvent{
+			Type:      e.Type,
+			Reason:    e.Reason,
+			Object:    e.InvolvedObject.Kind + "/" + e.InvolvedObject.Name,
+			Message:   e.Message,
+			Count:     e.Count,
+			FirstSeen: e.FirstTimestamp.Time,
+			LastSeen:  last,
+		})
+	}
+	sort.SliceStable(out, func(i, j int) bool { return out[i].LastSeen.After(out[j].LastSeen) })
+	return out
+}
+
+// GetEvents returns the Events in the namespace, most recent first
+func (ci ChartInstaller) GetEvents(ctx context.Context, ns string) (out []K8sEvent, err error) {
+	el, err := ci.kc.CoreV1().Events(ns).List(ctx, metav1.ListOptions{})
+	if err != nil {
+		return []K8sEvent{}, fmt.Errorf("error unable to retrieve events for namespace %v: %w", ns, err)
+	}
+	return eventsToK8sEvents(el.Items), nil
+}
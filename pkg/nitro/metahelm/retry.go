@@ -0,0 +1,291 @@
+package metahelm
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/dollarshaveclub/acyl/pkg/eventlogger"
+	"github.com/dollarshaveclub/acyl/pkg/models"
+	nitroerrors "github.com/dollarshaveclub/acyl/pkg/nitro/errors"
+	"github.com/dollarshaveclub/acyl/pkg/nitro/images"
+	"github.com/dollarshaveclub/metahelm/pkg/metahelm"
+	"github.com/pkg/errors"
+	"gopkg.in/DataDog/dd-trace-go.v1/ddtrace/tracer"
+	"helm.sh/helm/v3/pkg/action"
+	"helm.sh/helm/v3/pkg/release"
+	k8serrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// namespaceReleasesFunc returns the latest revision of each Helm release in a namespace, of any status
+type namespaceReleasesFunc func() ([]*release.Release, error)
+
+// helmNamespaceReleases returns a namespaceReleasesFunc that queries Helm for the releases in ns using the configuration of mhm
+func helmNamespaceReleases(mhm *metahelm.Manager, ns string) namespaceReleasesFunc {
+	return func() ([]*release.Release, error) {
+		list := action.NewList(mhm.HCfg)
+		list.All = true
+		list.SetStateMask()
+		rels, err := list.Run()
+		if err != nil {
+			return nil, err
+		}
+		out := []*release.Release{}
+		for _, rel := range rels {
+			if rel.Namespace == ns {
+				out = append(out, rel)
+			}
+		}
+		return out, nil
+	}
+}
+
+// chartRelease returns the release of rels that metahelm installed for the chart title, or nil if there is none
+func chartRelease(title string, rels []*release.Release) *release.Release {
+	rsl := []rune(title)
+	for _, rel := range rels {
+		if rel.Name == title {
+			return rel
+		}
+		// long titles are truncated and suffixed with a random number (see metahelm.ReleaseName)
+		if len(rsl) > 53 && strings.HasPrefix(rel.Name, string(rsl[0:53-6])+"-") {
+			return rel
+		}
+	}
+	return nil
+}
+
+// failedChartRetry models the charts of a failed environment that must be retried
+type failedChartRetry struct {
+	// Charts are the failed charts and all charts that depend on them, with dependencies on charts that aren't retried removed
+	Charts []metahelm.Chart
+	// Skipped are the titles of successfully deployed charts that aren't retried
+	Skipped []string
+	// Releases is chart title to release name for all charts, with a new release name for charts that aren't installed
+	Releases metahelm.ReleaseMap
+	// Uninstall are the names of releases that were never successfully deployed and must be uninstalled before retrying
+	Uninstall []string
+}
+
+// retryFailedCharts calculates which of the charts in csl must be retried given the current Helm releases in the namespace rels.
+// A chart has failed if its release doesn't exist or if the latest revision isn't deployed.
+func retryFailedCharts(csl []metahelm.Chart, rels []*release.Release) failedChartRetry {
+	out := failedChartRetry{Charts: []metahelm.Chart{}, Skipped: []string{}, Releases: metahelm.ReleaseMap{}, Uninstall: []string{}}
+	requiredBy := make(map[string][]string, len(csl))
+	for _, c := range csl {
+		for _, d := range c.DependencyList {
+			requiredBy[d] = append(requiredBy[d], c.Title)
+		}
+	}
+	retry := map[string]bool{}
+	var addDependents func(title string)
+	addDependents = func(title string) {
+		if retry[title] {
+			return
+		}
+		retry[title] = true
+		for _, p := range requiredBy[title] {
+			addDependents(p)
+		}
+	}
+	for _, c := range csl {
+		rel := chartRelease(c.Title, rels)
+		if rel == nil {
+			out.Releases[c.Title] = metahelm.ReleaseName(c.Title)
+			addDependents(c.Title)
+			continue
+		}
+		out.Releases[c.Title] = rel.Name
+		if rel.Info == nil || rel.Info.Status != release.StatusDeployed {
+			if rel.Version <= 1 {
+				// Helm can't upgrade a release that was never deployed
+				out.Uninstall = append(out.Uninstall, rel.Name)
+			}
+			addDependents(c.Title)
+		}
+	}
+	for _, c := range csl {
+		if !retry[c.Title] {
+			out.Skipped = append(out.Skipped, c.Title)
+			continue
+		}
+		deps := []string{}
+		for _, d := range c.DependencyList {
+			if retry[d] {
+				deps = append(deps, d)
+			}
+		}
+		c.DependencyList = deps
+		out.Charts = append(out.Charts, c)
+	}
+	sort.Strings(out.Skipped)
+	sort.Strings(out.Uninstall)
+	return out
+}
+
+// RetryFailedCharts retries the charts of a failed environment within its existing namespace: the charts that failed to install
+// or upgrade (or whose image failed to build) are reinstalled or upgraded along with all charts that depend on them, after
+// rebuilding only the images that failed to build or are missing. Successfully deployed releases are left untouched.
+func (ci ChartInstaller) RetryFailedCharts(ctx context.Context, env *EnvInfo, k8senv *models.KubernetesEnvironment, cl ChartLocations) (err error) {
+	span, ctx := tracer.StartSpanFromContext(ctx, "chart_installer.retry_failed")
+	defer func() {
+		span.Finish(tracer.WithError(err))
+	}()
+	defer ci.mc.Timing(mpfx+"retry_failed", "triggering_repo:"+env.Env.Repo)()
+	if ci.kc == nil {
+		return errors.New("k8s client is nil")
+	}
+	if k8senv == nil {
+		return fmt.Errorf("no extant k8s environment for env: %v", env.Env.Name)
+	}
+	if _, err := ci.kc.CoreV1().Namespaces().Get(ctx, k8senv.Namespace, metav1.GetOptions{}); err != nil {
+		if k8serrors.IsNotFound(err) {
+			return nitroerrors.User(fmt.Errorf("namespace no longer exists, the environment must be rebuilt: %v", k8senv.Namespace))
+		}
+		return fmt.Errorf("error getting namespace: %w", err)
+	}
+	mhm, err := ci.mhmf(ctx, ci.kc, ci.hccfg, k8senv.Namespace)
+	if err != nil || mhm == nil {
+		return fmt.Errorf("error getting helm client configuration: %w", err)
+	}
+	return ci.retryFailedCharts(ctx, env, k8senv, cl, helmNamespaceReleases(mhm, k8senv.Namespace), func(release string) error {
+		_, err := action.NewUninstall(mhm.HCfg).Run(release)
+		return err
+	})
+}
+
+func (ci ChartInstaller) retryFailedCharts(ctx context.Context, env *EnvInfo, k8senv *models.KubernetesEnvironment, cl ChartLocations, releases namespaceReleasesFunc, uninstall func(release string) error) (err error) {
+	csl, err := ci.GenerateCharts(ctx, k8senv.Namespace, env, cl)
+	if err != nil {
+		return fmt.Errorf("error generating metahelm charts: %w", err)
+	}
+	rels, err := releases()
+	if err != nil {
+		return fmt.Errorf("error listing helm releases: %w", err)
+	}
+	fcr := retryFailedCharts(csl, rels)
+	if len(fcr.Charts) == 0 {
+		return nitroerrors.User(errors.New("there are no failed charts to retry"))
+	}
+	ci.dl.SetQAEnvironmentStatus(context.Background(), env.Env.Name, models.Updating)
+	defer func() {
+		// the namespace is retained on failure so that the charts may be retried again
+		status := models.Success
+		if err != nil {
+			status = models.Failure
+		}
+		ci.dl.SetQAEnvironmentStatus(context.Background(), env.Env.Name, status)
+	}()
+	titles := make([]string, len(fcr.Charts))
+	for i, c := range fcr.Charts {
+		titles[i] = c.Title
+	}
+	ci.dl.AddEvent(ctx, env.Env.Name, fmt.Sprintf("retrying failed charts and their dependents: %v; already deployed: %v", strings.Join(titles, ", "), strings.Join(fcr.Skipped, ", ")))
+	imageCharts := map[string]struct{}{models.GetName(env.RC.Application.Repo): struct{}{}}
+	for _, d := range env.RC.Dependencies.All() {
+		if d.Repo != "" {
+			imageCharts[d.Name] = struct{}{}
+		}
+	}
+	failed, err := ci.lastFailedEvent(ctx, env.Env.Name)
+	if err != nil {
+		return fmt.Errorf("error getting failed event: %w", err)
+	}
+	rebuild := imagesToRebuild(titles, imageCharts, failed)
+	rebuilt := make(map[string]struct{}, len(rebuild))
+	for _, title := range rebuild {
+		rebuilt[title] = struct{}{}
+	}
+	reused := []string{}
+	for _, title := range titles {
+		if _, ok := imageCharts[title]; !ok {
+			continue
+		}
+		if _, ok := rebuilt[title]; !ok {
+			reused = append(reused, title)
+		}
+	}
+	// record the images that aren't rebuilt as built, so that they're reused again if this retry fails
+	for _, title := range append(reused, fcr.Skipped...) {
+		if _, ok := imageCharts[title]; ok {
+			eventlogger.GetLogger(ctx).SetImageStarted(title)
+			eventlogger.GetLogger(ctx).SetImageCompleted(title, false)
+		}
+	}
+	for _, title := range fcr.Skipped {
+		eventlogger.GetLogger(ctx).SetChartStarted(title, models.InstallingChartStatus)
+		eventlogger.GetLogger(ctx).SetChartCompleted(title, models.DoneChartStatus)
+	}
+	if len(reused) > 0 {
+		ci.dl.AddEvent(ctx, env.Env.Name, fmt.Sprintf("reusing images built by the failed operation: %v", strings.Join(reused, ", ")))
+	}
+	for _, release := range fcr.Uninstall {
+		ci.log(ctx, "metahelm: uninstalling release that was never deployed: %v", release)
+		if err := uninstall(release); err != nil {
+			return fmt.Errorf("error uninstalling failed release: %v: %w", release, err)
+		}
+	}
+	// record all releases (there are none after a failed create) so that the revisions can be updated after the upgrade
+	if err := ci.writeReleaseNames(ctx, fcr.Releases, k8senv.Namespace, env); err != nil {
+		return fmt.Errorf("error writing release names: %w", err)
+	}
+	var b images.Batch = noBuilds{}
+	if len(rebuild) > 0 {
+		b, err = ci.ib.StartBuilds(ctx, env.Env.Name, env.RC, rebuild...)
+		if err != nil {
+			return fmt.Errorf("error starting image builds: %w", err)
+		}
+	}
+	defer b.Stop()
+	env.Releases = fcr.Releases
+	return ci.installOrUpgradeCharts(ctx, k8senv.Namespace, fcr.Charts, env, b, true)
+}
+
+// lastFailedEvent returns the most recent failed event of the environment name other than the event in ctx, or nil if there is none
+func (ci ChartInstaller) lastFailedEvent(ctx context.Context, name string) (*models.EventLog, error) {
+	elogs, err := ci.dl.GetEventLogsByEnvName(name)
+	if err != nil {
+		return nil, err
+	}
+	var out *models.EventLog
+	for i := range elogs {
+		el := &elogs[i]
+		if el.ID == eventlogger.GetLogger(ctx).ID || el.Status.Config.Status != models.FailedStatus {
+			continue
+		}
+		if out == nil || el.Created.After(out.Created) {
+			out = el
+		}
+	}
+	return out, nil
+}
+
+// imagesToRebuild returns the titles of the retried charts whose image must be built: those whose build failed or never
+// completed in the failed event, so that the image is missing. The images that were built by the failed event are at the
+// same commits, so their existing tags are reused. If the failed event is unknown, all images are rebuilt.
+func imagesToRebuild(titles []string, imageCharts map[string]struct{}, failed *models.EventLog) []string {
+	out := []string{}
+	for _, title := range titles {
+		if _, ok := imageCharts[title]; !ok {
+			continue
+		}
+		if failed != nil {
+			img := failed.Status.Tree[title].Image
+			if !img.Completed.IsZero() && !img.Error {
+				continue
+			}
+		}
+		out = append(out, title)
+	}
+	return out
+}
+
+// noBuilds is the Batch of a retry that doesn't build any images
+type noBuilds struct{}
+
+func (noBuilds) Completed(envname, name string) (bool, error) { return true, nil }
+func (noBuilds) Started(envname, name string) bool            { return false }
+func (noBuilds) Done() bool                                   { return true }
+func (noBuilds) Stop()                                        {}
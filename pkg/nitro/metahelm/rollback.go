@@ -0,0 +1,93 @@
+package metahelm
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/dollarshaveclub/acyl/pkg/models"
+	"github.com/dollarshaveclub/metahelm/pkg/metahelm"
+	"helm.sh/helm/v3/pkg/action"
+)
+
+// releaseVersionFunc returns the current Helm revision number of a release
+type releaseVersionFunc func(release string) (int, error)
+
+// helmReleaseVersion returns a releaseVersionFunc that queries Helm using the configuration of mhm
+func helmReleaseVersion(mhm *metahelm.Manager) releaseVersionFunc {
+	return func(release string) (int, error) {
+		rel, err := action.NewGet(mhm.HCfg).Run(release)
+		if err != nil {
+			return 0, err
+		}
+		return rel.Version, nil
+	}
+}
+
+// writeEnvironmentRevision records the successful deployment of env into namespace ns, including the current Helm revision of each
+// release in releases (chart title to release name), so that the environment can later be rolled back to it
+func (ci ChartInstaller) writeEnvironmentRevision(ctx context.Context, env *EnvInfo, ns string, releases map[string]string, version releaseVersionFunc) error {
+	rm, err := env.RC.RefMap()
+	if err != nil {
+		return fmt.Errorf("error generating refmap from repoconfig: %w", err)
+	}
+	csm, err := env.RC.CommitSHAMap()
+	if err != nil {
+		return fmt.Errorf("error generating commit sha map from repoconfig: %w", err)
+	}
+	sig := env.RC.ConfigSignature()
+	rev := &models.EnvironmentRevision{
+		EnvName:         env.Env.Name,
+		K8sNamespace:    ns,
+		RefMap:          rm,
+		CommitSHAMap:    csm,
+		ConfigSignature: sig[:],
+		HelmReleases:    models.HelmReleaseRevisions{},
+	}
+	nrmap := env.RC.NameToRefMap()
+	for title, release := range releases {
+		v, err := version(release)
+		if err != nil {
+			return fmt.Errorf("error getting helm release version: %v: %w", release, err)
+		}
+		rev.HelmReleases = append(rev.HelmReleases, models.HelmReleaseRevision{
+			Name:        title,
+			Release:     release,
+			Revision:    v,
+			RevisionSHA: nrmap[title],
+		})
+	}
+	if err := ci.dl.CreateEnvironmentRevision(ctx, rev); err != nil {
+		return fmt.Errorf("error creating environment revision: %w", err)
+	}
+	return nil
+}
+
+// RollbackCharts rolls back each release in the k8s environment namespace to the Helm revision in releases, waiting for the
+// rolled back resources to become ready
+func (ci ChartInstaller) RollbackCharts(ctx context.Context, k8senv *models.KubernetesEnvironment, releases models.HelmReleaseRevisions) error {
+	defer ci.mc.Timing(mpfx + "rollback")()
+	if ci.kc == nil {
+		return fmt.Errorf("k8s client is nil")
+	}
+	mhm, err := ci.mhmf(ctx, ci.kc, ci.hccfg, k8senv.Namespace)
+	if err != nil || mhm == nil {
+		return fmt.Errorf("error getting helm client configuration: %w", err)
+	}
+	for _, hrr := range releases {
+		select {
+		case <-ctx.Done():
+			return fmt.Errorf("context was cancelled in rollback")
+		default:
+		}
+		ci.log(ctx, "metahelm: rolling back release %v (%v) to revision %v", hrr.Release, hrr.Name, hrr.Revision)
+		rb := action.NewRollback(mhm.HCfg)
+		rb.Version = hrr.Revision
+		rb.Wait = true
+		rb.Timeout = metahelmTimeout
+		if err := rb.Run(hrr.Release); err != nil {
+			return fmt.Errorf("error rolling back release: %v: %w", hrr.Release, err)
+		}
+		ci.dl.AddEvent(ctx, k8senv.EnvName, fmt.Sprintf("rolled back release %v (%v) to revision %v", hrr.Release, hrr.Name, hrr.Revision))
+	}
+	return nil
+}
@@ -14,11 +14,13 @@ func _() {
 	_ = x[Success-3]
 	_ = x[Failure-4]
 	_ = x[EnvironmentLimitExceeded-5]
+	_ = x[ExpirationWarning-6]
+	_ = x[EnvironmentQueued-7]
 }
 
-const _NotificationEvent_name = "CreateEnvironmentUpdateEnvironmentDestroyEnvironmentSuccessFailureEnvironmentLimitExceeded"
+const _NotificationEvent_name = "CreateEnvironmentUpdateEnvironmentDestroyEnvironmentSuccessFailureEnvironmentLimitExceededExpirationWarningEnvironmentQueued"
 
-var _NotificationEvent_index = [...]uint8{0, 17, 34, 52, 59, 66, 90}
+var _NotificationEvent_index = [...]uint8{0, 17, 34, 52, 59, 66, 90, 107, 124}
 
 func (i NotificationEvent) String() string {
 	if i < 0 || i >= NotificationEvent(len(_NotificationEvent_index)-1) {
@@ -23,6 +23,10 @@ const (
 	Failure
 	// EnvironmentLimitExceeded occurs when an environment is destroyed due to the environment limit
 	EnvironmentLimitExceeded
+	// ExpirationWarning occurs when an environment will soon be destroyed because its expiration is approaching
+	ExpirationWarning
+	// EnvironmentQueued occurs when an environment create is queued because the global environment limit has been reached
+	EnvironmentQueued
 )
 
 // Key maps NotificationEvents to notification template names
@@ -40,6 +44,10 @@ func (ne NotificationEvent) Key() string {
 		return "failure"
 	case EnvironmentLimitExceeded:
 		return "destroy"
+	case ExpirationWarning:
+		return "expiring"
+	case EnvironmentQueued:
+		return "queued"
 	default:
 		return "<unknown>"
 	}
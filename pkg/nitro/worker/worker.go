@@ -0,0 +1,320 @@
+package worker
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/dollarshaveclub/acyl/pkg/eventlogger"
+	"github.com/dollarshaveclub/acyl/pkg/ghapp"
+	"github.com/dollarshaveclub/acyl/pkg/models"
+	ncontext "github.com/dollarshaveclub/acyl/pkg/nitro/context"
+	nitroerrors "github.com/dollarshaveclub/acyl/pkg/nitro/errors"
+	"github.com/dollarshaveclub/acyl/pkg/nitro/metrics"
+	"github.com/dollarshaveclub/acyl/pkg/persistence"
+	"github.com/dollarshaveclub/acyl/pkg/spawner"
+	"github.com/google/uuid"
+	"gopkg.in/DataDog/dd-trace-go.v1/ddtrace/ext"
+	"gopkg.in/DataDog/dd-trace-go.v1/ddtrace/tracer"
+)
+
+// metrics prefix
+var mpfx = "worker."
+
+// Defaults for zero Worker fields
+var (
+	DefaultConcurrency      uint = 10
+	DefaultLeaseDuration         = 2 * time.Minute
+	DefaultPollInterval          = 2 * time.Second
+	DefaultMaxAttempts      uint = 3
+	DefaultRetryBackoff          = time.Minute
+	DefaultOperationTimeout      = 32 * time.Minute
+)
+
+// Worker leases environment operations from the durable operation queue and processes them with an EnvironmentSpawner.
+// The lease on an operation is renewed while it is processed, so if the worker crashes the operation is leased again
+// (and resumed) by another worker, or the restarted worker, once the lease expires.
+// Operations that fail with errors other than user errors or cancellation are retried with backoff, up to MaxAttempts
+// attempts, after which they are dead-lettered. Operations that already failed after retries by the EnvironmentSpawner
+// are dead-lettered without being retried.
+type Worker struct {
+	DL persistence.DataLayer
+	ES spawner.EnvironmentSpawner
+	MC metrics.Collector
+	// GHCF is the GitHub app client factory for operations received by the GitHub app (optional)
+	GHCF ghapp.GithubAppClientFactory
+	// ID identifies the worker as the owner of leases and must be unique among running workers (a random ID is used if empty)
+	ID string
+	// Concurrency is the maximum number of operations processed simultaneously
+	Concurrency uint
+	// LeaseDuration is the duration of the lease on a running operation, which is renewed at a third of the duration
+	LeaseDuration time.Duration
+	// PollInterval is the interval between polls of the queue for new operations
+	PollInterval time.Duration
+	// MaxAttempts is the maximum number of attempts of an operation, including attempts interrupted by crashes
+	MaxAttempts uint
+	// RetryBackoff is the delay before the first retry of a failed operation, which doubles with each subsequent retry
+	RetryBackoff time.Duration
+	// OperationTimeout is the maximum duration of an operation
+	OperationTimeout time.Duration
+	// LogFunc is a function that logs a formatted string somewhere
+	LogFunc func(string, ...interface{})
+
+	wg sync.WaitGroup
+}
+
+func (w *Worker) log(msg string, args ...interface{}) {
+	if w.LogFunc != nil {
+		w.LogFunc("worker: "+msg, args...)
+	}
+}
+
+func (w *Worker) setDefaults() {
+	if w.ID == "" {
+		w.ID = uuid.New().String()
+	}
+	if w.Concurrency == 0 {
+		w.Concurrency = DefaultConcurrency
+	}
+	if w.LeaseDuration == 0 {
+		w.LeaseDuration = DefaultLeaseDuration
+	}
+	if w.PollInterval == 0 {
+		w.PollInterval = DefaultPollInterval
+	}
+	if w.MaxAttempts == 0 {
+		w.MaxAttempts = DefaultMaxAttempts
+	}
+	if w.RetryBackoff == 0 {
+		w.RetryBackoff = DefaultRetryBackoff
+	}
+	if w.OperationTimeout == 0 {
+		w.OperationTimeout = DefaultOperationTimeout
+	}
+}
+
+// Run leases and processes operations until ctx is cancelled, then waits for the running operations to finish.
+// Running operations are not cancelled along with ctx.
+func (w *Worker) Run(ctx context.Context) {
+	w.setDefaults()
+	w.log("starting (id: %v, concurrency: %v)", w.ID, w.Concurrency)
+	sem := make(chan struct{}, w.Concurrency)
+	ticker := time.NewTicker(w.PollInterval)
+	defer ticker.Stop()
+	for {
+		w.leaseAvailable(ctx, sem)
+		select {
+		case <-ctx.Done():
+			w.log("stopping, waiting for running operations to finish")
+			w.wg.Wait()
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// leaseAvailable leases and starts operations until there are none available or the worker is at capacity
+func (w *Worker) leaseAvailable(ctx context.Context, sem chan struct{}) {
+	for {
+		select {
+		case sem <- struct{}{}:
+		default:
+			return
+		}
+		op, err := w.DL.LeaseOperation(ctx, w.ID, w.LeaseDuration)
+		if err != nil || op == nil {
+			<-sem
+			if err != nil {
+				w.log("error leasing operation: %v", err)
+			}
+			return
+		}
+		w.wg.Add(1)
+		go func() {
+			defer func() { <-sem }()
+			defer w.wg.Done()
+			w.process(op)
+		}()
+	}
+}
+
+// keepalive renews the lease on op until stop is closed, calling cf if the lease is lost
+func (w *Worker) keepalive(ctx context.Context, cf context.CancelFunc, op *models.QueuedOperation, stop chan struct{}) {
+	ticker := time.NewTicker(w.LeaseDuration / 3)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+			if err := w.DL.RenewOperationLease(context.Background(), op.ID, w.ID, w.LeaseDuration); err != nil {
+				eventlogger.GetLogger(ctx).Printf("error renewing operation lease, aborting: %v", err)
+				w.MC.Increment(mpfx+"lease_lost", "triggering_repo:"+op.RepoRevisionData.Repo)
+				cf()
+				return
+			}
+		}
+	}
+}
+
+// backoff returns the delay before the retry of an operation that failed on attempt (starting at 1)
+func (w *Worker) backoff(attempt uint) time.Duration {
+	d := w.RetryBackoff
+	for i := uint(1); i < attempt; i++ {
+		d *= 2
+	}
+	return d
+}
+
+// process runs op and records the outcome in the queue
+func (w *Worker) process(op *models.QueuedOperation) {
+	ctx := eventlogger.NewEventLoggerContext(context.Background(), &eventlogger.Logger{
+		ID:   op.EventID,
+		DL:   w.DL,
+		Sink: os.Stdout,
+	})
+	if op.InstallationID != 0 && w.GHCF != nil {
+		ctx = ghapp.NewGitHubClientContext(ctx, op.InstallationID, w.GHCF)
+	}
+	ctx = ncontext.NewCancelFuncContext(context.WithCancel(ctx))
+	ctx, cf := context.WithTimeout(ctx, w.OperationTimeout)
+	defer cf()
+	log := eventlogger.GetLogger(ctx).Printf
+	tags := []string{"triggering_repo:" + op.RepoRevisionData.Repo, "action:" + op.Action}
+	if op.Attempts > w.MaxAttempts {
+		// the previous attempts were interrupted (the worker crashed or lost its lease), so the operation may be crashing workers
+		msg := fmt.Sprintf("operation interrupted too many times (attempts: %v)", op.Attempts-1)
+		log("dead-lettering operation %v: %v", op.ID, msg)
+		w.MC.Increment(mpfx+"dead_letter", tags...)
+		if err := w.DL.DeadLetterOperation(context.Background(), op.ID, w.ID, msg); err != nil {
+			w.log("error dead-lettering operation: %v: %v", op.ID, err)
+		}
+		return
+	}
+	if op.Attempts > 1 {
+		log("resuming operation %v for %v (attempt %v of %v)", op.ID, op.Action, op.Attempts, w.MaxAttempts)
+	}
+	stop := make(chan struct{})
+	go w.keepalive(ctx, cf, op, stop)
+	span := tracer.StartSpan("operation_worker")
+	span.SetTag(ext.SamplingPriority, ext.PriorityUserKeep)
+	span.SetTag("action", op.Action)
+	span.SetTag("attempt", op.Attempts)
+	span.SetTag("repo", op.RepoRevisionData.Repo)
+	span.SetTag("pull_request", op.RepoRevisionData.PullRequest)
+	ctx = tracer.ContextWithSpan(ctx, span)
+	end := w.MC.Timing(mpfx+"operation", tags...)
+	err := w.run(ctx, op)
+	close(stop)
+	end(fmt.Sprintf("success:%v", err == nil))
+	if nitroerrors.IsCancelledError(err) {
+		span.Finish()
+	} else {
+		span.Finish(tracer.WithError(err))
+	}
+	switch {
+	case err == nil || nitroerrors.IsUserError(err) || nitroerrors.IsCancelledError(err):
+		// user errors and cancellations (preemption by a newer event) have been reported and retrying won't help
+		err = w.DL.CompleteOperation(context.Background(), op.ID, w.ID)
+	case nitroerrors.IsRetriesExhaustedError(err):
+		// the environment manager already retried the operation with backoff, so retrying it again would multiply the attempts
+		log("operation %v failed after retries by the environment manager, dead-lettering: %v", op.ID, err)
+		w.MC.Increment(mpfx+"dead_letter", tags...)
+		err = w.DL.DeadLetterOperation(context.Background(), op.ID, w.ID, err.Error())
+	case op.Attempts >= w.MaxAttempts:
+		log("operation %v failed on the final attempt (%v), dead-lettering: %v", op.ID, op.Attempts, err)
+		w.MC.Increment(mpfx+"dead_letter", tags...)
+		err = w.DL.DeadLetterOperation(context.Background(), op.ID, w.ID, err.Error())
+	default:
+		backoff := w.backoff(op.Attempts)
+		log("operation %v failed (attempt %v of %v), retrying in %v: %v", op.ID, op.Attempts, w.MaxAttempts, backoff, err)
+		w.MC.Increment(mpfx+"retry", tags...)
+		err = w.DL.RetryOperation(context.Background(), op.ID, w.ID, err.Error(), time.Now().UTC().Add(backoff))
+	}
+	if err != nil {
+		w.log("error updating operation: %v: %v", op.ID, err)
+	}
+}
+
+// run performs the environment operation for the action of op
+func (w *Worker) run(ctx context.Context, op *models.QueuedOperation) error {
+	log := eventlogger.GetLogger(ctx).Printf
+	log("worker %v processing %v (operation: %v)", w.ID, op.Action, op.ID)
+	switch op.Action {
+	case "opened", "reopened":
+		name, err := w.ES.Create(ctx, op.RepoRevisionData)
+		if err != nil {
+			log("finished processing create with error: %v", err)
+			return err
+		}
+		log("success processing create event (env: %q); done", name)
+	case models.CreateOperationAction:
+		if op.Params.QueueAdmitted {
+			ctx = ncontext.NewQueueAdmittedContext(ctx)
+		}
+		name, err := w.ES.Create(ctx, op.RepoRevisionData)
+		if err != nil {
+			log("finished processing create with error: %v", err)
+			return err
+		}
+		log("success processing create (env: %q); done", name)
+	case models.UpdateOperationAction:
+		name, err := w.ES.Update(ctx, op.RepoRevisionData)
+		if err != nil {
+			log("finished processing update with error: %v", err)
+			return err
+		}
+		log("success processing update (env: %q); done", name)
+	case models.HibernateOperationAction, models.WakeOperationAction, models.RetryFailedOperationAction, models.RollbackOperationAction, models.DestroyOperationAction:
+		if err := w.runEnvAction(ctx, op); err != nil {
+			log("finished processing %v with error: %v", op.Action, err)
+			return err
+		}
+		log("success processing %v (env: %q); done", op.Action, op.Params.EnvName)
+	case "synchronize":
+		name, err := w.ES.Update(ctx, op.RepoRevisionData)
+		if err != nil {
+			log("finished processing update with error: %v", err)
+			return err
+		}
+		log("success processing update event (env: %q); done", name)
+	case "closed":
+		if err := w.ES.Destroy(ctx, op.RepoRevisionData, models.DestroyApiRequest); err != nil {
+			log("finished processing destroy with error: %v", err)
+			return err
+		}
+		log("success processing destroy event; done")
+	default:
+		// this can't succeed on retry
+		return nitroerrors.User(fmt.Errorf("unknown action type: %v", op.Action))
+	}
+	return nil
+}
+
+// runEnvAction performs the action of op, which was requested via the API, on the environment op.Params.EnvName
+func (w *Worker) runEnvAction(ctx context.Context, op *models.QueuedOperation) error {
+	name := op.Params.EnvName
+	switch op.Action {
+	case models.HibernateOperationAction:
+		return w.ES.Hibernate(ctx, name)
+	case models.WakeOperationAction:
+		return w.ES.Wake(ctx, name)
+	case models.RetryFailedOperationAction:
+		return w.ES.RetryFailed(ctx, name)
+	case models.RollbackOperationAction:
+		return w.ES.Rollback(ctx, name, op.Params.Revision)
+	case models.DestroyOperationAction:
+		env, err := w.DL.GetQAEnvironment(ctx, name)
+		if err != nil {
+			return fmt.Errorf("error getting environment: %w", err)
+		}
+		if env == nil {
+			return nitroerrors.User(fmt.Errorf("environment not found: %v", name))
+		}
+		return w.ES.DestroyExplicitly(ctx, env, models.DestroyApiRequest)
+	default:
+		return nitroerrors.User(fmt.Errorf("unknown action type: %v", op.Action))
+	}
+}
@@ -0,0 +1,228 @@
+package worker
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/dollarshaveclub/acyl/pkg/models"
+	ncontext "github.com/dollarshaveclub/acyl/pkg/nitro/context"
+	nitroerrors "github.com/dollarshaveclub/acyl/pkg/nitro/errors"
+	"github.com/dollarshaveclub/acyl/pkg/nitro/metrics"
+	"github.com/dollarshaveclub/acyl/pkg/persistence"
+	"github.com/dollarshaveclub/acyl/pkg/spawner"
+	"github.com/google/uuid"
+)
+
+func TestWorkerProcess(t *testing.T) {
+	rd := models.RepoRevisionData{Repo: "foo/bar", PullRequest: 1, SourceSHA: "asdf"}
+	tests := []struct {
+		name      string
+		action    string
+		err       error
+		attempts  uint // previous (interrupted) attempts
+		calls     int
+		status    models.OperationStatus
+		lastError string
+	}{
+		{name: "create", action: "opened", calls: 1, status: models.OperationDone},
+		{name: "update", action: "synchronize", calls: 1, status: models.OperationDone},
+		{name: "destroy", action: "closed", calls: 1, status: models.OperationDone},
+		{name: "user error", action: "opened", err: nitroerrors.User(errors.New("bad chart")), calls: 1, status: models.OperationDone},
+		{name: "cancelled", action: "synchronize", err: nitroerrors.Cancelled(context.Canceled), calls: 1, status: models.OperationDone},
+		{name: "system error", action: "opened", err: errors.New("timeout"), calls: 1, status: models.OperationPending, lastError: "timeout"},
+		{name: "retries exhausted", action: "opened", err: nitroerrors.RetriesExhausted(errors.New("timeout")), calls: 1, status: models.OperationDead, lastError: "timeout"},
+		{name: "final attempt", action: "opened", err: errors.New("timeout"), attempts: 2, calls: 1, status: models.OperationDead, lastError: "timeout"},
+		{name: "interrupted too many times", action: "opened", attempts: 3, calls: 0, status: models.OperationDead, lastError: "operation interrupted too many times (attempts: 3)"},
+		{name: "unknown action", action: "labeled", calls: 0, status: models.OperationDone},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dl := persistence.NewFakeDataLayer()
+			var calls int
+			f := func() error {
+				calls++
+				return tt.err
+			}
+			w := &Worker{
+				DL: dl,
+				ES: &spawner.FakeEnvironmentSpawner{
+					CreateFunc: func(ctx context.Context, rd models.RepoRevisionData) (string, error) { return "foo-bar", f() },
+					UpdateFunc: func(ctx context.Context, rd models.RepoRevisionData) (string, error) { return "foo-bar", f() },
+					DestroyFunc: func(ctx context.Context, rd models.RepoRevisionData, reason models.QADestroyReason) error {
+						return f()
+					},
+				},
+				MC:          &metrics.FakeCollector{},
+				ID:          "worker",
+				MaxAttempts: 3,
+			}
+			w.setDefaults()
+			op := &models.QueuedOperation{ID: uuid.New(), Action: tt.action, RepoRevisionData: rd, EventID: uuid.New()}
+			if err := dl.EnqueueOperation(context.Background(), op); err != nil {
+				t.Fatalf("error enqueueing: %v", err)
+			}
+			// simulate attempts interrupted by crashes
+			for i := uint(0); i < tt.attempts; i++ {
+				if _, err := dl.LeaseOperation(context.Background(), "crashed", time.Nanosecond); err != nil {
+					t.Fatalf("error leasing: %v", err)
+				}
+				time.Sleep(time.Millisecond)
+			}
+			w.leaseAvailable(context.Background(), make(chan struct{}, 1))
+			w.wg.Wait()
+			if calls != tt.calls {
+				t.Errorf("expected %v calls, got %v", tt.calls, calls)
+			}
+			ops, err := dl.GetOperations(context.Background(), tt.status)
+			if err != nil {
+				t.Fatalf("error getting operations: %v", err)
+			}
+			if len(ops) != 1 {
+				t.Fatalf("expected operation with status %v", tt.status)
+			}
+			if ops[0].LastError != tt.lastError {
+				t.Errorf("bad last error: %v", ops[0].LastError)
+			}
+			if tt.status == models.OperationPending && !ops[0].NotBefore.After(time.Now().UTC()) {
+				t.Errorf("retry should have been delayed by the backoff: %v", ops[0].NotBefore)
+			}
+		})
+	}
+}
+
+func TestWorkerQueueAdmittedCreate(t *testing.T) {
+	dl := persistence.NewFakeDataLayer()
+	var admitted []bool
+	w := &Worker{
+		DL: dl,
+		ES: &spawner.FakeEnvironmentSpawner{
+			CreateFunc: func(ctx context.Context, rd models.RepoRevisionData) (string, error) {
+				admitted = append(admitted, ncontext.IsQueueAdmitted(ctx))
+				return "foo-bar", nil
+			},
+		},
+		MC: &metrics.FakeCollector{},
+		ID: "worker",
+	}
+	w.setDefaults()
+	for _, op := range []*models.QueuedOperation{
+		{ID: uuid.New(), Action: "opened", EventID: uuid.New()},
+		{ID: uuid.New(), Action: models.CreateOperationAction, Params: models.OperationParams{QueueAdmitted: true}, EventID: uuid.New()},
+	} {
+		if err := dl.EnqueueOperation(context.Background(), op); err != nil {
+			t.Fatalf("error enqueueing: %v", err)
+		}
+		w.leaseAvailable(context.Background(), make(chan struct{}, 1))
+		w.wg.Wait()
+	}
+	if len(admitted) != 2 || admitted[0] || !admitted[1] {
+		t.Fatalf("only the queue admitted create should have been marked as admitted: %v", admitted)
+	}
+}
+
+func TestWorkerEnvActions(t *testing.T) {
+	dl := persistence.NewFakeDataLayer()
+	dl.CreateQAEnvironment(context.Background(), &models.QAEnvironment{Name: "foo-bar", Repo: "foo/bar", Status: models.Success})
+	var calls []string
+	call := func(action, name string) error {
+		calls = append(calls, action+" "+name)
+		return nil
+	}
+	w := &Worker{
+		DL: dl,
+		ES: &spawner.FakeEnvironmentSpawner{
+			HibernateFunc:   func(ctx context.Context, name string) error { return call("hibernate", name) },
+			WakeFunc:        func(ctx context.Context, name string) error { return call("wake", name) },
+			RetryFailedFunc: func(ctx context.Context, name string) error { return call("retry", name) },
+			RollbackFunc: func(ctx context.Context, name string, revision int64) error {
+				return call(fmt.Sprintf("rollback %v", revision), name)
+			},
+			DestroyExplicitlyFunc: func(ctx context.Context, env *models.QAEnvironment, reason models.QADestroyReason) error {
+				return call("destroy", env.Name)
+			},
+		},
+		MC: &metrics.FakeCollector{},
+		ID: "worker",
+	}
+	w.setDefaults()
+	for _, op := range []*models.QueuedOperation{
+		{Action: models.HibernateOperationAction},
+		{Action: models.WakeOperationAction},
+		{Action: models.RetryFailedOperationAction},
+		{Action: models.RollbackOperationAction, Params: models.OperationParams{Revision: 3}},
+		{Action: models.DestroyOperationAction},
+	} {
+		op.ID, op.EventID = uuid.New(), uuid.New()
+		op.Params.EnvName = "foo-bar"
+		if err := dl.EnqueueOperation(context.Background(), op); err != nil {
+			t.Fatalf("error enqueueing: %v", err)
+		}
+		w.leaseAvailable(context.Background(), make(chan struct{}, 1))
+		w.wg.Wait()
+	}
+	expected := []string{"hibernate foo-bar", "wake foo-bar", "retry foo-bar", "rollback 3 foo-bar", "destroy foo-bar"}
+	if strings.Join(calls, ",") != strings.Join(expected, ",") {
+		t.Fatalf("bad calls: %v", calls)
+	}
+	if ops, err := dl.GetOperations(context.Background(), models.OperationDone); err != nil || len(ops) != len(expected) {
+		t.Fatalf("operations should have completed: %v: %v", len(ops), err)
+	}
+}
+
+func TestWorkerRun(t *testing.T) {
+	dl := persistence.NewFakeDataLayer()
+	started, release := make(chan struct{}), make(chan struct{})
+	w := &Worker{
+		DL: dl,
+		ES: &spawner.FakeEnvironmentSpawner{
+			CreateFunc: func(ctx context.Context, rd models.RepoRevisionData) (string, error) {
+				close(started)
+				<-release
+				return "foo-bar", nil
+			},
+		},
+		MC:            &metrics.FakeCollector{},
+		LeaseDuration: 30 * time.Millisecond,
+		PollInterval:  time.Millisecond,
+	}
+	if err := dl.EnqueueOperation(context.Background(), &models.QueuedOperation{ID: uuid.New(), Action: "opened", EventID: uuid.New()}); err != nil {
+		t.Fatalf("error enqueueing: %v", err)
+	}
+	ctx, cf := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		w.Run(ctx)
+		close(done)
+	}()
+	select {
+	case <-started:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("timeout waiting for operation to start")
+	}
+	// the lease is renewed while the operation runs, so it isn't leased by another worker
+	time.Sleep(100 * time.Millisecond)
+	if op, err := dl.LeaseOperation(context.Background(), "other", time.Minute); err != nil || op != nil {
+		t.Fatalf("running operation should not have been leased: %+v: %v", op, err)
+	}
+	// stopping the worker waits for the running operation
+	cf()
+	select {
+	case <-done:
+		t.Fatalf("run should not have returned while an operation is running")
+	case <-time.After(50 * time.Millisecond):
+	}
+	close(release)
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("timeout waiting for run to return")
+	}
+	ops, err := dl.GetOperations(context.Background(), models.OperationDone)
+	if err != nil || len(ops) != 1 {
+		t.Fatalf("operation should have completed: %v: %v", len(ops), err)
+	}
+}
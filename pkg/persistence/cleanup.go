@@ -29,7 +29,7 @@ func (c *Cleaner) log(msg string, args ...interface{}) {
 
 // PruneDestroyedEnvRecords deletes all QAEnvironment records with status Destroyed or Failed with a Created timestamp earlier than time.Now() - olderThan.
 // olderThan must be > 0
-func (c *Cleaner) PruneDestroyedEnvRecords(olderThan time.Duration) (err error) {
+func (c *Cleaner) PruneDestroyedEnvRecords(ctx context.Context, olderThan time.Duration) (err error) {
 	if olderThan == 0 {
 		return errors.New("olderThan must be greater than zero")
 	}
@@ -48,7 +48,7 @@ func (c *Cleaner) PruneDestroyedEnvRecords(olderThan time.Duration) (err error)
 	} else {
 		temptable = fmt.Sprintf(temptable, int64(s), "seconds")
 	}
-	txn, err := c.DB.BeginTx(context.Background(), &sql.TxOptions{Isolation: sql.LevelSerializable})
+	txn, err := c.DB.BeginTx(ctx, &sql.TxOptions{Isolation: sql.LevelSerializable})
 	if err != nil {
 		return errors.Wrap(err, "error beginning txn")
 	}
@@ -57,11 +57,11 @@ func (c *Cleaner) PruneDestroyedEnvRecords(olderThan time.Duration) (err error)
 			txn.Rollback()
 		}
 	}()
-	if _, err := txn.Exec(temptable, models.Destroyed, models.Failure); err != nil {
+	if _, err := txn.ExecContext(ctx, temptable, models.Destroyed, models.Failure); err != nil {
 		return errors.Wrap(err, "error creating temp table")
 	}
 	q := "DELETE FROM kubernetes_environments WHERE env_name IN (SELECT name FROM old_envs);"
-	res, err := txn.Exec(q)
+	res, err := txn.ExecContext(ctx, q)
 	if err != nil {
 		return errors.Wrap(err, "error deleting from kubernetes_environments")
 	}
@@ -69,7 +69,7 @@ func (c *Cleaner) PruneDestroyedEnvRecords(olderThan time.Duration) (err error)
 	c.log("pruned %v rows from kubernetes_environment", n)
 
 	q = "DELETE FROM helm_releases WHERE env_name IN (SELECT name FROM old_envs);"
-	res, err = txn.Exec(q)
+	res, err = txn.ExecContext(ctx, q)
 	if err != nil {
 		return errors.Wrap(err, "error deleting from helm_releases")
 	}
@@ -77,7 +77,7 @@ func (c *Cleaner) PruneDestroyedEnvRecords(olderThan time.Duration) (err error)
 	c.log("pruned %v rows from helm_releases", n)
 
 	q = "DELETE FROM qa_environments WHERE name IN (SELECT name FROM old_envs);"
-	res, err = txn.Exec(q)
+	res, err = txn.ExecContext(ctx, q)
 	if err != nil {
 		return errors.Wrap(err, "error deleting from qa_environments")
 	}
@@ -89,7 +89,7 @@ func (c *Cleaner) PruneDestroyedEnvRecords(olderThan time.Duration) (err error)
 
 // PruneEventLogs deletes all EventLog records with a Created timestamp earlier than time.Now() - olderThan.
 // olderThan must be > 0
-func (c *Cleaner) PruneEventLogs(olderThan time.Duration) error {
+func (c *Cleaner) PruneEventLogs(ctx context.Context, olderThan time.Duration) error {
 	if olderThan == 0 {
 		return errors.New("olderThan must be greater than zero")
 	}
@@ -102,7 +102,7 @@ func (c *Cleaner) PruneEventLogs(olderThan time.Duration) error {
 	} else {
 		q = fmt.Sprintf(q, int64(s), "seconds")
 	}
-	res, err := c.DB.Exec(q)
+	res, err := c.DB.ExecContext(ctx, q)
 	if err != nil {
 		return errors.Wrap(err, "error deleting from event_logs")
 	}
@@ -111,12 +111,64 @@ func (c *Cleaner) PruneEventLogs(olderThan time.Duration) error {
 	return nil
 }
 
-// Clean runs all data cleanup operations
-func (c *Cleaner) Clean() {
-	if err := c.PruneDestroyedEnvRecords(c.DestroyedEnvRecordsMaxAge); err != nil {
-		c.log("error pruning destroyed env records: %v", err)
+// PruneCompletedOperations deletes all queued operations that were processed (status done), coalesced or cancelled earlier than
+// time.Now() - olderThan. Dead-lettered operations are retained. olderThan must be > 0
+func (c *Cleaner) PruneCompletedOperations(ctx context.Context, olderThan time.Duration) error {
+	if olderThan == 0 {
+		return errors.New("olderThan must be greater than zero")
+	}
+	if c.DB == nil {
+		return errors.New("database client is nil")
+	}
+	q := `DELETE FROM operation_queue WHERE status IN ($1, $2, $3) AND completed < (now() - interval '%v %v');`
+	if s := olderThan.Seconds(); s < 1 {
+		q = fmt.Sprintf(q, int64(s*1000), "milliseconds")
+	} else {
+		q = fmt.Sprintf(q, int64(s), "seconds")
+	}
+	res, err := c.DB.ExecContext(ctx, q, models.OperationDone, models.OperationCoalesced, models.OperationCancelled)
+	if err != nil {
+		return errors.Wrap(err, "error deleting from operation_queue")
+	}
+	n, _ := res.RowsAffected()
+	c.log("pruned %v rows from operation_queue", n)
+	return nil
+}
+
+// PruneOrphanedLockRequests deletes the lock requests recorded by lock sessions that no longer exist (the process holding
+// or waiting for the lock crashed before deleting its request)
+func (c *Cleaner) PruneOrphanedLockRequests(ctx context.Context) error {
+	if c.DB == nil {
+		return errors.New("database client is nil")
+	}
+	res, err := c.DB.ExecContext(ctx, `DELETE FROM lock_requests WHERE pid NOT IN (SELECT pid FROM pg_stat_activity WHERE pid IS NOT NULL);`)
+	if err != nil {
+		return errors.Wrap(err, "error deleting from lock_requests")
 	}
-	if err := c.PruneEventLogs(c.EventLogsMaxAge); err != nil {
-		c.log("error pruning event logs: %v", err)
+	n, _ := res.RowsAffected()
+	c.log("pruned %v rows from lock_requests", n)
+	return nil
+}
+
+// Clean runs all data cleanup operations, stopping if ctx is cancelled
+func (c *Cleaner) Clean(ctx context.Context) {
+	ops := []struct {
+		desc string
+		f    func(context.Context) error
+	}{
+		{"pruning destroyed env records", func(ctx context.Context) error { return c.PruneDestroyedEnvRecords(ctx, c.DestroyedEnvRecordsMaxAge) }},
+		{"pruning event logs", func(ctx context.Context) error { return c.PruneEventLogs(ctx, c.EventLogsMaxAge) }},
+		// operations reference event logs, so they are retained for the same period
+		{"pruning completed operations", func(ctx context.Context) error { return c.PruneCompletedOperations(ctx, c.EventLogsMaxAge) }},
+		{"pruning orphaned lock requests", c.PruneOrphanedLockRequests},
+	}
+	for _, op := range ops {
+		if err := ctx.Err(); err != nil {
+			c.log("stopping cleanup before %v: %v", op.desc, err)
+			return
+		}
+		if err := op.f(ctx); err != nil {
+			c.log("error %v: %v", op.desc, err)
+		}
 	}
 }
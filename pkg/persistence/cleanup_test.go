@@ -37,7 +37,7 @@ func TestCleanupPruneDestroyedEnvRecords(t *testing.T) {
 	dl.CreateK8sEnv(context.Background(), &models.KubernetesEnvironment{EnvName: "foo-bar"})
 	dl.CreateHelmReleasesForEnv(context.Background(), []models.HelmRelease{models.HelmRelease{EnvName: "foo-bar"}})
 	dl.SetQAEnvironmentCreated(context.Background(), "foo-bar-2", time.Now().UTC().Add(1*time.Hour))
-	if err := c.PruneDestroyedEnvRecords(expires); err != nil {
+	if err := c.PruneDestroyedEnvRecords(context.Background(), expires); err != nil {
 		t.Fatalf("prune should have succeeded: %v", err)
 	}
 	env, err := dl.GetQAEnvironment(context.Background(), "foo-bar")
@@ -98,7 +98,7 @@ func TestCleanupPruneEventLogs(t *testing.T) {
 	}
 	tdl.pgdb.Exec(`UPDATE event_logs SET created = $1 WHERE id = $2;`, time.Now().UTC().Add(-1*time.Hour), uuid1)
 	tdl.pgdb.Exec(`UPDATE event_logs SET created = $1 WHERE id = $2;`, time.Now().UTC().Add(1*time.Hour), uuid2)
-	if err := c.PruneEventLogs(expires); err != nil {
+	if err := c.PruneEventLogs(context.Background(), expires); err != nil {
 		t.Fatalf("prune should have succeeded: %v", err)
 	}
 	el, err := dl.GetEventLogByID(uuid1)
@@ -33,6 +33,11 @@ type DataLayer interface {
 	SetQAEnvironmentRefMap(context.Context, string, RefMap) error
 	SetQAEnvironmentCommitSHAMap(context.Context, string, RefMap) error
 	SetQAEnvironmentCreated(context.Context, string, time.Time) error
+	SetQAEnvironmentExpiration(ctx context.Context, name string, expires *time.Time) error
+	SetQAEnvironmentExpirationWarned(ctx context.Context, name string) error
+	GetQAEnvironmentsExpiringBefore(ctx context.Context, t time.Time) ([]QAEnvironment, error)
+	SetQAEnvironmentPin(ctx context.Context, name string, pinned bool, reason string, until *time.Time) error
+	SetQAEnvironmentReaperPolicy(ctx context.Context, name string, rp models.ReaperPolicy) error
 	GetExtantQAEnvironments(context.Context, string, uint) ([]QAEnvironment, error)
 	SetAminoEnvironmentID(ctx context.Context, name string, did int) error
 	SetAminoServiceToPort(ctx context.Context, name string, serviceToPort map[string]int64) error
@@ -48,6 +53,10 @@ type DataLayer interface {
 	EventLoggerDataLayer
 	UISessionsDataLayer
 	APIKeyDataLayer
+	QueueDataLayer
+	EnvironmentRevisionDataLayer
+	OperationQueueDataLayer
+	LeaderElectionDataLayer
 }
 
 // HelmDataLayer describes an object that stores data about Helm
@@ -88,6 +97,8 @@ type EventLoggerDataLayer interface {
 	SetEventStatusImageCompleted(id uuid.UUID, name string, err bool) error
 	SetEventStatusChartStarted(id uuid.UUID, name string, status models.NodeChartStatus) error
 	SetEventStatusChartCompleted(id uuid.UUID, name string, status models.NodeChartStatus) error
+	SetEventStatusChartDiff(id uuid.UUID, name string, diff string) error
+	AddEventStatusRetry(id uuid.UUID, retry models.EventStatusRetry) error
 	GetEventStatus(id uuid.UUID) (*models.EventStatusSummary, error)
 	SetEventStatusRenderedStatus(id uuid.UUID, rstatus models.RenderedEventStatus) error
 	SetEventStatusFailed(id uuid.UUID, ce metahelm.ChartError) error
@@ -109,3 +120,36 @@ type APIKeyDataLayer interface {
 	UpdateAPIKeyLastUsed(ctx context.Context, token uuid.UUID) error
 	DeleteAPIKeyByID(ctx context.Context, id uuid.UUID) error
 }
+
+// QueueDataLayer describes an object that stores environment creates waiting for capacity under the global environment limit
+type QueueDataLayer interface {
+	EnqueueEnvironment(ctx context.Context, qe *models.QueuedEnvironment) error
+	GetQueuedEnvironments(ctx context.Context) ([]models.QueuedEnvironment, error)
+	DequeueEnvironment(ctx context.Context, name string) (bool, error)
+}
+
+// OperationQueueDataLayer describes an object that durably stores accepted webhook operations until a worker has processed them
+type OperationQueueDataLayer interface {
+	EnqueueOperation(ctx context.Context, op *models.QueuedOperation) error
+	EnqueueSupersedingOperation(ctx context.Context, op *models.QueuedOperation, debounce time.Duration) ([]models.QueuedOperation, error)
+	LeaseOperation(ctx context.Context, owner string, lease time.Duration) (*models.QueuedOperation, error)
+	RenewOperationLease(ctx context.Context, id uuid.UUID, owner string, lease time.Duration) error
+	CompleteOperation(ctx context.Context, id uuid.UUID, owner string) error
+	RetryOperation(ctx context.Context, id uuid.UUID, owner, errmsg string, notBefore time.Time) error
+	DeadLetterOperation(ctx context.Context, id uuid.UUID, owner, errmsg string) error
+	CancelPendingOperation(ctx context.Context, eventID uuid.UUID, reason string) (*models.QueuedOperation, error)
+	GetOperations(ctx context.Context, status models.OperationStatus) ([]models.QueuedOperation, error)
+}
+
+// LeaderElectionDataLayer describes an object that stores the leases used to elect a single leader among server replicas
+type LeaderElectionDataLayer interface {
+	AcquireLeaderLease(ctx context.Context, name, holder string, lease time.Duration) (bool, error)
+	ReleaseLeaderLease(ctx context.Context, name, holder string) error
+	GetLeaderLease(ctx context.Context, name string) (*models.LeaderLease, error)
+}
+
+// EnvironmentRevisionDataLayer describes an object that stores the history of successful deployments of environments
+type EnvironmentRevisionDataLayer interface {
+	CreateEnvironmentRevision(ctx context.Context, rev *models.EnvironmentRevision) error
+	GetEnvironmentRevisions(ctx context.Context, name string) ([]models.EnvironmentRevision, error)
+}
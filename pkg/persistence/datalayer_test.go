@@ -374,6 +374,405 @@ func TestDataLayerSetQAEnvironmentCreated(t *testing.T) {
 	}
 }
 
+func TestDataLayerSetQAEnvironmentExpiration(t *testing.T) {
+	dl, tdl := NewTestDataLayer(t)
+	if err := tdl.Setup(testDataPath); err != nil {
+		t.Fatalf("error setting up test database: %v", err)
+	}
+	defer tdl.TearDown()
+	ts := time.Now().UTC().Add(time.Hour)
+	if err := dl.SetQAEnvironmentExpiration(context.Background(), "foo-bar", &ts); err != nil {
+		t.Fatalf("set should have succeeded: %v", err)
+	}
+	if err := dl.SetQAEnvironmentExpirationWarned(context.Background(), "foo-bar"); err != nil {
+		t.Fatalf("set warned should have succeeded: %v", err)
+	}
+	qae, err := dl.GetQAEnvironmentConsistently(context.Background(), "foo-bar")
+	if err != nil {
+		t.Fatalf("get should have succeeded: %v", err)
+	}
+	if qae.ExpiresAt == nil || !qae.ExpiresAt.Equal(ts.Truncate(1*time.Microsecond)) {
+		t.Fatalf("wrong expiration: %v (wanted: %v)", qae.ExpiresAt, ts)
+	}
+	if !qae.ExpirationWarned {
+		t.Fatalf("expiration warned should have been set")
+	}
+	qs, err := dl.GetQAEnvironmentsExpiringBefore(context.Background(), ts.Add(time.Minute))
+	if err != nil {
+		t.Fatalf("get expiring should have succeeded: %v", err)
+	}
+	if len(qs) != 1 || qs[0].Name != "foo-bar" {
+		t.Fatalf("expected only foo-bar to be expiring: %v", qs)
+	}
+	qs, err = dl.GetQAEnvironmentsExpiringBefore(context.Background(), ts.Add(-time.Minute))
+	if err != nil {
+		t.Fatalf("get expiring should have succeeded: %v", err)
+	}
+	if len(qs) != 0 {
+		t.Fatalf("expected no expiring environments: %v", qs)
+	}
+	if err := dl.SetQAEnvironmentExpiration(context.Background(), "foo-bar", nil); err != nil {
+		t.Fatalf("clear should have succeeded: %v", err)
+	}
+	qae, err = dl.GetQAEnvironmentConsistently(context.Background(), "foo-bar")
+	if err != nil {
+		t.Fatalf("get should have succeeded: %v", err)
+	}
+	if qae.ExpiresAt != nil || qae.ExpirationWarned {
+		t.Fatalf("expiration should have been cleared: %v, %v", qae.ExpiresAt, qae.ExpirationWarned)
+	}
+}
+
+func TestDataLayerSetQAEnvironmentPin(t *testing.T) {
+	dl, tdl := NewTestDataLayer(t)
+	if err := tdl.Setup(testDataPath); err != nil {
+		t.Fatalf("error setting up test database: %v", err)
+	}
+	defer tdl.TearDown()
+	until := time.Now().UTC().Add(time.Hour)
+	if err := dl.SetQAEnvironmentPin(context.Background(), "foo-bar", true, "demo", &until); err != nil {
+		t.Fatalf("pin should have succeeded: %v", err)
+	}
+	qae, err := dl.GetQAEnvironmentConsistently(context.Background(), "foo-bar")
+	if err != nil {
+		t.Fatalf("get should have succeeded: %v", err)
+	}
+	if !qae.Pinned || qae.PinReason != "demo" || qae.PinnedUntil == nil || !qae.PinnedUntil.Equal(until.Truncate(1*time.Microsecond)) {
+		t.Fatalf("bad pin: %v, %v, %v", qae.Pinned, qae.PinReason, qae.PinnedUntil)
+	}
+	if err := dl.SetQAEnvironmentPin(context.Background(), "foo-bar", false, "ignored", &until); err != nil {
+		t.Fatalf("unpin should have succeeded: %v", err)
+	}
+	qae, err = dl.GetQAEnvironmentConsistently(context.Background(), "foo-bar")
+	if err != nil {
+		t.Fatalf("get should have succeeded: %v", err)
+	}
+	if qae.Pinned || qae.PinReason != "" || qae.PinnedUntil != nil {
+		t.Fatalf("pin should have been cleared: %v, %v, %v", qae.Pinned, qae.PinReason, qae.PinnedUntil)
+	}
+}
+
+func TestDataLayerSetQAEnvironmentReaperPolicy(t *testing.T) {
+	dl, tdl := NewTestDataLayer(t)
+	if err := tdl.Setup(testDataPath); err != nil {
+		t.Fatalf("error setting up test database: %v", err)
+	}
+	defer tdl.TearDown()
+	rp := models.ReaperPolicy{MaxAge: 336 * time.Hour, MaxFailure: 2 * time.Hour}
+	if err := dl.SetQAEnvironmentReaperPolicy(context.Background(), "foo-bar", rp); err != nil {
+		t.Fatalf("set should have succeeded: %v", err)
+	}
+	qae, err := dl.GetQAEnvironmentConsistently(context.Background(), "foo-bar")
+	if err != nil {
+		t.Fatalf("get should have succeeded: %v", err)
+	}
+	if qae.ReaperPolicy != rp {
+		t.Fatalf("bad reaper policy: %+v", qae.ReaperPolicy)
+	}
+}
+
+func TestDataLayerEnvironmentQueue(t *testing.T) {
+	dl, tdl := NewTestDataLayer(t)
+	if err := tdl.Setup(testDataPath); err != nil {
+		t.Fatalf("error setting up test database: %v", err)
+	}
+	defer tdl.TearDown()
+	ctx := context.Background()
+	now := time.Now().UTC()
+	for i, qe := range []models.QueuedEnvironment{
+		{EnvName: "foo-bar", Enqueued: now, RepoRevisionData: models.RepoRevisionData{Repo: "foo/bar", PullRequest: 99, SourceSHA: "asdf"}},
+		{EnvName: "foo-baz", Enqueued: now.Add(time.Second), RepoRevisionData: models.RepoRevisionData{Repo: "foo/baz", PullRequest: 1}},
+		{EnvName: "biz-baz", Enqueued: now.Add(2 * time.Second), Priority: 10, RepoRevisionData: models.RepoRevisionData{Repo: "biz/baz", PullRequest: 1}},
+	} {
+		qe := qe
+		if err := dl.EnqueueEnvironment(ctx, &qe); err != nil {
+			t.Fatalf("enqueue %v should have succeeded: %v", i, err)
+		}
+	}
+	// re-enqueueing updates the entry but keeps its place in the queue
+	if err := dl.EnqueueEnvironment(ctx, &models.QueuedEnvironment{EnvName: "foo-bar", Enqueued: now.Add(time.Hour), RepoRevisionData: models.RepoRevisionData{Repo: "foo/bar", PullRequest: 99, SourceSHA: "1234"}}); err != nil {
+		t.Fatalf("re-enqueue should have succeeded: %v", err)
+	}
+	queue, err := dl.GetQueuedEnvironments(ctx)
+	if err != nil {
+		t.Fatalf("get should have succeeded: %v", err)
+	}
+	if len(queue) != 3 {
+		t.Fatalf("unexpected queue length: %v", len(queue))
+	}
+	if queue[0].EnvName != "biz-baz" || queue[1].EnvName != "foo-bar" || queue[2].EnvName != "foo-baz" {
+		t.Fatalf("bad queue order: %v, %v, %v", queue[0].EnvName, queue[1].EnvName, queue[2].EnvName)
+	}
+	if queue[1].RepoRevisionData.SourceSHA != "1234" {
+		t.Fatalf("repo revision data should have been updated: %+v", queue[1].RepoRevisionData)
+	}
+	ok, err := dl.DequeueEnvironment(ctx, "biz-baz")
+	if err != nil || !ok {
+		t.Fatalf("dequeue should have succeeded: %v, %v", ok, err)
+	}
+	ok, err = dl.DequeueEnvironment(ctx, "biz-baz")
+	if err != nil || ok {
+		t.Fatalf("second dequeue should have returned false: %v, %v", ok, err)
+	}
+}
+
+func TestDataLayerEnvironmentRevisions(t *testing.T) {
+	dl, tdl := NewTestDataLayer(t)
+	if err := tdl.Setup(testDataPath); err != nil {
+		t.Fatalf("error setting up test database: %v", err)
+	}
+	defer tdl.TearDown()
+	ctx := context.Background()
+	now := time.Now().UTC()
+	for i := 0; i < models.MaxEnvironmentRevisions+2; i++ {
+		rev := &models.EnvironmentRevision{
+			EnvName:         "foo-bar",
+			Created:         now.Add(time.Duration(i) * time.Second),
+			K8sNamespace:    "nitro-1234-foo-bar",
+			RefMap:          models.RefMap{"foo/bar": "feature"},
+			CommitSHAMap:    models.RefMap{"foo/bar": fmt.Sprintf("sha%v", i)},
+			ConfigSignature: []byte("sig"),
+			HelmReleases:    models.HelmReleaseRevisions{{Name: "foo-bar", Release: "foo-bar-release", Revision: i + 1, RevisionSHA: fmt.Sprintf("sha%v", i)}},
+		}
+		if err := dl.CreateEnvironmentRevision(ctx, rev); err != nil {
+			t.Fatalf("create %v should have succeeded: %v", i, err)
+		}
+		if rev.ID == 0 {
+			t.Fatalf("id should have been set")
+		}
+	}
+	revs, err := dl.GetEnvironmentRevisions(ctx, "foo-bar")
+	if err != nil {
+		t.Fatalf("get should have succeeded: %v", err)
+	}
+	if len(revs) != models.MaxEnvironmentRevisions {
+		t.Fatalf("old revisions should have been removed: %v", len(revs))
+	}
+	latest := models.MaxEnvironmentRevisions + 1
+	if revs[0].CommitSHAMap["foo/bar"] != fmt.Sprintf("sha%v", latest) || revs[0].RefMap["foo/bar"] != "feature" {
+		t.Fatalf("bad latest revision maps: %v, %v", revs[0].RefMap, revs[0].CommitSHAMap)
+	}
+	if len(revs[0].HelmReleases) != 1 || revs[0].HelmReleases[0].Revision != latest+1 || string(revs[0].ConfigSignature) != "sig" {
+		t.Fatalf("bad latest revision: %+v", revs[0])
+	}
+	if revs, err := dl.GetEnvironmentRevisions(ctx, "does-not-exist"); err != nil || len(revs) != 0 {
+		t.Fatalf("expected no revisions: %v, %v", revs, err)
+	}
+}
+
+func TestDataLayerOperationQueue(t *testing.T) {
+	dl, tdl := NewTestDataLayer(t)
+	if err := tdl.Setup(testDataPath); err != nil {
+		t.Fatalf("error setting up test database: %v", err)
+	}
+	defer tdl.TearDown()
+	ctx := context.Background()
+	now := time.Now().UTC()
+	ops := []models.QueuedOperation{
+		{ID: uuid.New(), Created: now, Action: "opened", RepoRevisionData: models.RepoRevisionData{Repo: "foo/bar", PullRequest: 1}, EventID: uuid.New(), InstallationID: 123},
+		{ID: uuid.New(), Created: now.Add(time.Second), Action: "synchronize", RepoRevisionData: models.RepoRevisionData{Repo: "foo/bar", PullRequest: 1}, EventID: uuid.New()},
+	}
+	for i := range ops {
+		if err := dl.EnqueueOperation(ctx, &ops[i]); err != nil {
+			t.Fatalf("enqueue %v should have succeeded: %v", i, err)
+		}
+	}
+	op, err := dl.LeaseOperation(ctx, "worker-1", time.Minute)
+	if err != nil || op == nil {
+		t.Fatalf("lease should have succeeded: %v, %v", op, err)
+	}
+	if op.ID != ops[0].ID || op.Status != models.OperationRunning || op.Attempts != 1 || op.InstallationID != 123 || op.RepoRevisionData.Repo != "foo/bar" {
+		t.Fatalf("bad leased operation: %+v", op)
+	}
+	op2, err := dl.LeaseOperation(ctx, "worker-2", time.Minute)
+	if err != nil || op2 == nil || op2.ID != ops[1].ID {
+		t.Fatalf("second lease should have returned the second operation: %+v, %v", op2, err)
+	}
+	if op3, err := dl.LeaseOperation(ctx, "worker-3", time.Minute); err != nil || op3 != nil {
+		t.Fatalf("lease should have returned nothing: %+v, %v", op3, err)
+	}
+	if err := dl.RenewOperationLease(ctx, op.ID, "worker-2", time.Minute); err != ErrOperationLeaseLost {
+		t.Fatalf("renew by a different owner should have failed: %v", err)
+	}
+	if err := dl.RenewOperationLease(ctx, op.ID, "worker-1", time.Minute); err != nil {
+		t.Fatalf("renew should have succeeded: %v", err)
+	}
+	if err := dl.CompleteOperation(ctx, op.ID, "worker-1"); err != nil {
+		t.Fatalf("complete should have succeeded: %v", err)
+	}
+	// retried operations aren't leased again until notBefore
+	if err := dl.RetryOperation(ctx, op2.ID, "worker-2", "timeout", time.Now().UTC().Add(time.Hour)); err != nil {
+		t.Fatalf("retry should have succeeded: %v", err)
+	}
+	if op3, err := dl.LeaseOperation(ctx, "worker-3", time.Minute); err != nil || op3 != nil {
+		t.Fatalf("lease should have returned nothing before notBefore: %+v, %v", op3, err)
+	}
+	pending, err := dl.GetOperations(ctx, models.OperationPending)
+	if err != nil || len(pending) != 1 || pending[0].LastError != "timeout" {
+		t.Fatalf("bad pending operations: %+v, %v", pending, err)
+	}
+	// operations with expired leases are leased again
+	op4 := models.QueuedOperation{ID: uuid.New(), Action: "closed", EventID: uuid.New()}
+	if err := dl.EnqueueOperation(ctx, &op4); err != nil {
+		t.Fatalf("enqueue should have succeeded: %v", err)
+	}
+	if op, err := dl.LeaseOperation(ctx, "worker-1", time.Millisecond); err != nil || op == nil || op.ID != op4.ID {
+		t.Fatalf("lease should have succeeded: %+v, %v", op, err)
+	}
+	time.Sleep(10 * time.Millisecond)
+	op, err = dl.LeaseOperation(ctx, "worker-2", time.Minute)
+	if err != nil || op == nil || op.ID != op4.ID || op.Attempts != 2 || op.LeaseOwner != "worker-2" {
+		t.Fatalf("expired lease should have been taken over: %+v, %v", op, err)
+	}
+	if err := dl.CompleteOperation(ctx, op.ID, "worker-1"); err != ErrOperationLeaseLost {
+		t.Fatalf("complete by the previous owner should have failed: %v", err)
+	}
+	if err := dl.DeadLetterOperation(ctx, op.ID, "worker-2", "too many attempts"); err != nil {
+		t.Fatalf("dead letter should have succeeded: %v", err)
+	}
+	dead, err := dl.GetOperations(ctx, models.OperationDead)
+	if err != nil || len(dead) != 1 || dead[0].ID != op4.ID || !dead[0].Completed.Valid {
+		t.Fatalf("bad dead operations: %+v, %v", dead, err)
+	}
+}
+
+func TestDataLayerEnqueueSupersedingOperation(t *testing.T) {
+	dl, tdl := NewTestDataLayer(t)
+	if err := tdl.Setup(testDataPath); err != nil {
+		t.Fatalf("error setting up test database: %v", err)
+	}
+	defer tdl.TearDown()
+	ctx := context.Background()
+	rd := models.RepoRevisionData{Repo: "foo/bar", PullRequest: 1}
+	op1 := models.QueuedOperation{ID: uuid.New(), Action: "synchronize", RepoRevisionData: rd, EventID: uuid.New()}
+	sup, err := dl.EnqueueSupersedingOperation(ctx, &op1, time.Hour)
+	if err != nil || len(sup) != 0 {
+		t.Fatalf("enqueue should have succeeded without superseding: %+v, %v", sup, err)
+	}
+	if !op1.NotBefore.After(time.Now().UTC().Add(59 * time.Minute)) {
+		t.Fatalf("operation should have been debounced: %v", op1.NotBefore)
+	}
+	// operations for other PRs aren't superseded
+	op2 := models.QueuedOperation{ID: uuid.New(), Action: "synchronize", RepoRevisionData: models.RepoRevisionData{Repo: "foo/bar", PullRequest: 2}, EventID: uuid.New()}
+	if sup, err := dl.EnqueueSupersedingOperation(ctx, &op2, time.Hour); err != nil || len(sup) != 0 {
+		t.Fatalf("enqueue should have succeeded without superseding: %+v, %v", sup, err)
+	}
+	// a newer push takes the place of the debounced operation
+	op3 := models.QueuedOperation{ID: uuid.New(), Action: "synchronize", RepoRevisionData: rd, EventID: uuid.New()}
+	sup, err = dl.EnqueueSupersedingOperation(ctx, &op3, time.Hour)
+	if err != nil || len(sup) != 1 || sup[0].ID != op1.ID || sup[0].EventID != op1.EventID {
+		t.Fatalf("enqueue should have superseded the first operation: %+v, %v", sup, err)
+	}
+	if !op3.NotBefore.Equal(op1.NotBefore) {
+		t.Fatalf("operation should have inherited the debounce deadline: %v (expected %v)", op3.NotBefore, op1.NotBefore)
+	}
+	// closing the PR supersedes pending pushes without debouncing
+	op4 := models.QueuedOperation{ID: uuid.New(), Action: "closed", RepoRevisionData: rd, EventID: uuid.New()}
+	sup, err = dl.EnqueueSupersedingOperation(ctx, &op4, 0)
+	if err != nil || len(sup) != 1 || sup[0].ID != op3.ID {
+		t.Fatalf("enqueue should have superseded the second push: %+v, %v", sup, err)
+	}
+	coalesced, err := dl.GetOperations(ctx, models.OperationCoalesced)
+	if err != nil || len(coalesced) != 2 || !coalesced[0].Completed.Valid {
+		t.Fatalf("bad coalesced operations: %+v, %v", coalesced, err)
+	}
+	op, err := dl.LeaseOperation(ctx, "worker-1", time.Minute)
+	if err != nil || op == nil || op.ID != op4.ID {
+		t.Fatalf("lease should have returned the close operation: %+v, %v", op, err)
+	}
+}
+
+func TestDataLayerCancelPendingOperation(t *testing.T) {
+	dl, tdl := NewTestDataLayer(t)
+	if err := tdl.Setup(testDataPath); err != nil {
+		t.Fatalf("error setting up test database: %v", err)
+	}
+	defer tdl.TearDown()
+	ctx := context.Background()
+	rd := models.RepoRevisionData{Repo: "foo/bar", PullRequest: 1}
+	op1 := models.QueuedOperation{ID: uuid.New(), Action: "opened", RepoRevisionData: rd, EventID: uuid.New()}
+	op2 := models.QueuedOperation{ID: uuid.New(), Action: "synchronize", RepoRevisionData: rd, EventID: uuid.New()}
+	for _, op := range []*models.QueuedOperation{&op1, &op2} {
+		if err := dl.EnqueueOperation(ctx, op); err != nil {
+			t.Fatalf("enqueue should have succeeded: %v", err)
+		}
+	}
+	if op, err := dl.LeaseOperation(ctx, "worker-1", time.Minute); err != nil || op == nil || op.ID != op1.ID {
+		t.Fatalf("lease should have returned the first operation: %+v, %v", op, err)
+	}
+	// running operations aren't cancelled
+	if op, err := dl.CancelPendingOperation(ctx, op1.EventID, "cancel requested"); err != nil || op != nil {
+		t.Fatalf("running operation should not have been cancelled: %+v, %v", op, err)
+	}
+	op, err := dl.CancelPendingOperation(ctx, op2.EventID, "cancel requested")
+	if err != nil || op == nil || op.ID != op2.ID || op.Status != models.OperationCancelled || op.LastError != "cancel requested" {
+		t.Fatalf("pending operation should have been cancelled: %+v, %v", op, err)
+	}
+	if op, err := dl.CancelPendingOperation(ctx, uuid.New(), "cancel requested"); err != nil || op != nil {
+		t.Fatalf("unknown event should have returned nil: %+v, %v", op, err)
+	}
+	if op, err := dl.LeaseOperation(ctx, "worker-2", time.Minute); err != nil || op != nil {
+		t.Fatalf("cancelled operation should not have been leased: %+v, %v", op, err)
+	}
+}
+
+func TestDataLayerLeaderLease(t *testing.T) {
+	dl, tdl := NewTestDataLayer(t)
+	if err := tdl.Setup(testDataPath); err != nil {
+		t.Fatalf("error setting up test database: %v", err)
+	}
+	defer tdl.TearDown()
+	ctx := context.Background()
+	if ll, err := dl.GetLeaderLease(ctx, "maintenance"); err != nil || ll != nil {
+		t.Fatalf("expected no leader: %+v: %v", ll, err)
+	}
+	if ok, err := dl.AcquireLeaderLease(ctx, "maintenance", "replica-1", time.Minute); err != nil || !ok {
+		t.Fatalf("replica-1 should have acquired the lease: %v, %v", ok, err)
+	}
+	if ok, err := dl.AcquireLeaderLease(ctx, "maintenance", "replica-2", time.Minute); err != nil || ok {
+		t.Fatalf("replica-2 should not have acquired the held lease: %v, %v", ok, err)
+	}
+	ll, err := dl.GetLeaderLease(ctx, "maintenance")
+	if err != nil || ll == nil {
+		t.Fatalf("expected leader: %+v: %v", ll, err)
+	}
+	if ll.Holder != "replica-1" {
+		t.Fatalf("unexpected holder: %v", ll.Holder)
+	}
+	// renewal keeps the acquisition time
+	if ok, err := dl.AcquireLeaderLease(ctx, "maintenance", "replica-1", time.Millisecond); err != nil || !ok {
+		t.Fatalf("replica-1 should have renewed the lease: %v, %v", ok, err)
+	}
+	ll2, err := dl.GetLeaderLease(ctx, "maintenance")
+	if err != nil {
+		t.Fatalf("error getting lease: %v", err)
+	}
+	if ll2 != nil && !ll2.Acquired.Equal(ll.Acquired) {
+		t.Fatalf("renewal should not change acquired: %v, %v", ll.Acquired, ll2.Acquired)
+	}
+	// the lease expires
+	time.Sleep(10 * time.Millisecond)
+	if ll, err := dl.GetLeaderLease(ctx, "maintenance"); err != nil || ll != nil {
+		t.Fatalf("expected no leader after expiration: %+v: %v", ll, err)
+	}
+	if ok, err := dl.AcquireLeaderLease(ctx, "maintenance", "replica-2", time.Minute); err != nil || !ok {
+		t.Fatalf("replica-2 should have acquired the expired lease: %v, %v", ok, err)
+	}
+	// releasing a lease held by another replica does nothing
+	if err := dl.ReleaseLeaderLease(ctx, "maintenance", "replica-1"); err != nil {
+		t.Fatalf("release should have succeeded: %v", err)
+	}
+	if ll, err := dl.GetLeaderLease(ctx, "maintenance"); err != nil || ll == nil || ll.Holder != "replica-2" {
+		t.Fatalf("replica-2 should still be leader: %+v: %v", ll, err)
+	}
+	if err := dl.ReleaseLeaderLease(ctx, "maintenance", "replica-2"); err != nil {
+		t.Fatalf("release should have succeeded: %v", err)
+	}
+	if ok, err := dl.AcquireLeaderLease(ctx, "maintenance", "replica-1", time.Minute); err != nil || !ok {
+		t.Fatalf("replica-1 should have acquired the released lease: %v, %v", ok, err)
+	}
+}
+
 func TestDataLayerGetExtantQAEnvironments(t *testing.T) {
 	dl, tdl := NewTestDataLayer(t)
 	if err := tdl.Setup(testDataPath); err != nil {
@@ -1955,6 +2354,46 @@ func TestDataLayerSetEventStatusChartCompleted(t *testing.T) {
 	}
 }
 
+func TestDataLayerSetEventStatusChartDiff(t *testing.T) {
+	dl, tdl := NewTestDataLayer(t)
+	if err := tdl.Setup(testDataPath); err != nil {
+		t.Fatalf("error setting up test database: %v", err)
+	}
+	defer tdl.TearDown()
+	id := uuid.Must(uuid.Parse("c1e1e229-86d8-4d99-a3d5-62b2f6390bbe"))
+	if err := dl.SetEventStatusChartDiff(id, "foo/bar", "--- old\n+++ new\n"); err != nil {
+		t.Fatalf("should have succeeded: %v", err)
+	}
+	s, err := dl.GetEventStatus(id)
+	if err != nil {
+		t.Fatalf("get should have succeeded: %v", err)
+	}
+	if diff := s.Tree["foo/bar"].Chart.Diff; diff != "--- old\n+++ new\n" {
+		t.Fatalf("unexpected chart diff: %v", diff)
+	}
+}
+
+func TestDataLayerAddEventStatusRetry(t *testing.T) {
+	dl, tdl := NewTestDataLayer(t)
+	if err := tdl.Setup(testDataPath); err != nil {
+		t.Fatalf("error setting up test database: %v", err)
+	}
+	defer tdl.TearDown()
+	id := uuid.Must(uuid.Parse("c1e1e229-86d8-4d99-a3d5-62b2f6390bbe"))
+	for i := uint(1); i <= 2; i++ {
+		if err := dl.AddEventStatusRetry(id, models.EventStatusRetry{Attempt: i, Error: "timeout", Backoff: time.Duration(i) * time.Second}); err != nil {
+			t.Fatalf("should have succeeded: %v", err)
+		}
+	}
+	s, err := dl.GetEventStatus(id)
+	if err != nil {
+		t.Fatalf("get should have succeeded: %v", err)
+	}
+	if len(s.Config.Retries) != 2 || s.Config.Retries[1].Attempt != 2 || s.Config.Retries[1].Backoff != 2*time.Second {
+		t.Fatalf("unexpected retries: %+v", s.Config.Retries)
+	}
+}
+
 func TestDataLayerGetEventStatus(t *testing.T) {
 	dl, tdl := NewTestDataLayer(t)
 	if err := tdl.Setup(testDataPath); err != nil {
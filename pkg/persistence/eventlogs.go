@@ -260,6 +260,26 @@ func (pg *PGLayer) SetEventStatusChartCompleted(id uuid.UUID, name string, statu
 	return errors.Wrap(err, "error setting event status chart status to completed")
 }
 
+func (pg *PGLayer) SetEventStatusChartDiff(id uuid.UUID, name string, diff string) error {
+	q := `UPDATE event_logs SET
+			status = jsonb_set(status, ARRAY['tree',$1,'chart','diff'], to_jsonb($2::text))
+		  WHERE id = $3;`
+	_, err := pg.db.Exec(q, name, diff, id)
+	return errors.Wrap(err, "error setting event status chart diff")
+}
+
+func (pg *PGLayer) AddEventStatusRetry(id uuid.UUID, retry models.EventStatusRetry) error {
+	j, err := json.Marshal([]models.EventStatusRetry{retry})
+	if err != nil {
+		return errors.Wrap(err, "error marshaling retry")
+	}
+	q := `UPDATE event_logs SET
+			status = jsonb_set(status, '{config,retries}', COALESCE(status->'config'->'retries', '[]'::jsonb) || $1::jsonb)
+		  WHERE id = $2;`
+	_, err = pg.db.Exec(q, string(j), id)
+	return errors.Wrap(err, "error adding event status retry")
+}
+
 func (pg *PGLayer) GetEventStatus(id uuid.UUID) (*models.EventStatusSummary, error) {
 	out := &models.EventStatusSummary{}
 	q := `SELECT status FROM event_logs WHERE id = $1;`
@@ -29,6 +29,10 @@ type lockingDataMap struct {
 	elogs      map[uuid.UUID]*models.EventLog
 	uisessions map[int]*models.UISession
 	apikeys    map[uuid.UUID]*models.APIKey
+	queue      map[string]*models.QueuedEnvironment
+	operations map[uuid.UUID]*models.QueuedOperation
+	revisions  map[string][]models.EnvironmentRevision
+	leases     map[string]*models.LeaderLease
 }
 
 // FakeDataLayer is a fake implementation of DataLayer that persists data in-memory, for testing purposes
@@ -48,6 +52,10 @@ func newLockingDataMap() *lockingDataMap {
 		elogs:      make(map[uuid.UUID]*models.EventLog),
 		uisessions: make(map[int]*models.UISession),
 		apikeys:    make(map[uuid.UUID]*models.APIKey),
+		queue:      make(map[string]*models.QueuedEnvironment),
+		operations: make(map[uuid.UUID]*models.QueuedOperation),
+		revisions:  make(map[string][]models.EnvironmentRevision),
+		leases:     make(map[string]*models.LeaderLease),
 	}
 }
 
@@ -504,6 +512,93 @@ func (fdl *FakeDataLayer) SetQAEnvironmentCreated(ctx context.Context, name stri
 	return errors.New("env not found")
 }
 
+func (fdl *FakeDataLayer) SetQAEnvironmentExpiration(ctx context.Context, name string, expires *time.Time) error {
+	if isCancelled(ctx) {
+		return ctx.Err()
+	}
+	fdl.doDelay()
+	fdl.data.Lock()
+	defer fdl.data.Unlock()
+	if v, ok := fdl.data.d[name]; ok {
+		if expires != nil {
+			t := *expires
+			expires = &t
+		}
+		v.ExpiresAt = expires
+		v.ExpirationWarned = false
+		return nil
+	}
+	return errors.New("env not found")
+}
+
+func (fdl *FakeDataLayer) SetQAEnvironmentExpirationWarned(ctx context.Context, name string) error {
+	if isCancelled(ctx) {
+		return ctx.Err()
+	}
+	fdl.doDelay()
+	fdl.data.Lock()
+	defer fdl.data.Unlock()
+	if v, ok := fdl.data.d[name]; ok {
+		v.ExpirationWarned = true
+		return nil
+	}
+	return errors.New("env not found")
+}
+
+func (fdl *FakeDataLayer) GetQAEnvironmentsExpiringBefore(ctx context.Context, t time.Time) ([]QAEnvironment, error) {
+	if isCancelled(ctx) {
+		return nil, ctx.Err()
+	}
+	fdl.doDelay()
+	out := []models.QAEnvironment{}
+	fdl.data.RLock()
+	defer fdl.data.RUnlock()
+	for _, v := range fdl.data.d {
+		if v.ExpiresAt != nil && v.ExpiresAt.Before(t) && v.Status != models.Destroyed {
+			out = append(out, *v)
+		}
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].ExpiresAt.Before(*out[j].ExpiresAt) })
+	return out, nil
+}
+
+func (fdl *FakeDataLayer) SetQAEnvironmentPin(ctx context.Context, name string, pinned bool, reason string, until *time.Time) error {
+	if isCancelled(ctx) {
+		return ctx.Err()
+	}
+	fdl.doDelay()
+	fdl.data.Lock()
+	defer fdl.data.Unlock()
+	if v, ok := fdl.data.d[name]; ok {
+		if !pinned {
+			reason, until = "", nil
+		}
+		if until != nil {
+			t := *until
+			until = &t
+		}
+		v.Pinned = pinned
+		v.PinReason = reason
+		v.PinnedUntil = until
+		return nil
+	}
+	return errors.New("env not found")
+}
+
+func (fdl *FakeDataLayer) SetQAEnvironmentReaperPolicy(ctx context.Context, name string, rp models.ReaperPolicy) error {
+	if isCancelled(ctx) {
+		return ctx.Err()
+	}
+	fdl.doDelay()
+	fdl.data.Lock()
+	defer fdl.data.Unlock()
+	if v, ok := fdl.data.d[name]; ok {
+		v.ReaperPolicy = rp
+		return nil
+	}
+	return errors.New("env not found")
+}
+
 func (fdl *FakeDataLayer) SetAminoEnvironmentID(ctx context.Context, name string, did int) error {
 	if isCancelled(ctx) {
 		return ctx.Err()
@@ -1191,6 +1286,35 @@ func (fdl *FakeDataLayer) SetEventStatusChartCompleted(id uuid.UUID, name string
 	return nil
 }
 
+func (fdl *FakeDataLayer) SetEventStatusChartDiff(id uuid.UUID, name string, diff string) error {
+	fdl.doDelay()
+	fdl.data.Lock()
+	defer fdl.data.Unlock()
+	elog := fdl.data.elogs[id]
+	if elog == nil {
+		return errors.New("eventlog not found")
+	}
+	tn, ok := elog.Status.Tree[name]
+	if !ok {
+		return fmt.Errorf("%v not found in tree", name)
+	}
+	tn.Chart.Diff = diff
+	elog.Status.Tree[name] = tn
+	return nil
+}
+
+func (fdl *FakeDataLayer) AddEventStatusRetry(id uuid.UUID, retry models.EventStatusRetry) error {
+	fdl.doDelay()
+	fdl.data.Lock()
+	defer fdl.data.Unlock()
+	elog := fdl.data.elogs[id]
+	if elog == nil {
+		return errors.New("eventlog not found")
+	}
+	elog.Status.Config.Retries = append(elog.Status.Config.Retries, retry)
+	return nil
+}
+
 func (fdl *FakeDataLayer) GetEventStatus(id uuid.UUID) (*models.EventStatusSummary, error) {
 	fdl.doDelay()
 	fdl.data.RLock()
@@ -1384,3 +1508,334 @@ func (fdl *FakeDataLayer) DeleteAPIKeyByID(ctx context.Context, id uuid.UUID) er
 	delete(fdl.data.apikeys, id)
 	return nil
 }
+
+func (fdl *FakeDataLayer) EnqueueEnvironment(ctx context.Context, qe *models.QueuedEnvironment) error {
+	if isCancelled(ctx) {
+		return ctx.Err()
+	}
+	fdl.doDelay()
+	fdl.data.Lock()
+	defer fdl.data.Unlock()
+	nqe := *qe
+	if existing, ok := fdl.data.queue[qe.EnvName]; ok {
+		nqe.Enqueued = existing.Enqueued
+	}
+	fdl.data.queue[qe.EnvName] = &nqe
+	return nil
+}
+
+func (fdl *FakeDataLayer) GetQueuedEnvironments(ctx context.Context) ([]models.QueuedEnvironment, error) {
+	if isCancelled(ctx) {
+		return nil, ctx.Err()
+	}
+	fdl.doDelay()
+	fdl.data.RLock()
+	defer fdl.data.RUnlock()
+	out := []models.QueuedEnvironment{}
+	for _, qe := range fdl.data.queue {
+		out = append(out, *qe)
+	}
+	sort.Slice(out, func(i, j int) bool {
+		if out[i].Priority != out[j].Priority {
+			return out[i].Priority > out[j].Priority
+		}
+		return out[i].Enqueued.Before(out[j].Enqueued)
+	})
+	return out, nil
+}
+
+func (fdl *FakeDataLayer) DequeueEnvironment(ctx context.Context, name string) (bool, error) {
+	if isCancelled(ctx) {
+		return false, ctx.Err()
+	}
+	fdl.doDelay()
+	fdl.data.Lock()
+	defer fdl.data.Unlock()
+	if _, ok := fdl.data.queue[name]; !ok {
+		return false, nil
+	}
+	delete(fdl.data.queue, name)
+	return true, nil
+}
+
+func (fdl *FakeDataLayer) CreateEnvironmentRevision(ctx context.Context, rev *models.EnvironmentRevision) error {
+	if isCancelled(ctx) {
+		return ctx.Err()
+	}
+	fdl.doDelay()
+	fdl.data.Lock()
+	defer fdl.data.Unlock()
+	var id int64
+	for _, revs := range fdl.data.revisions {
+		for _, r := range revs {
+			if r.ID > id {
+				id = r.ID
+			}
+		}
+	}
+	rev.ID = id + 1
+	if rev.Created.IsZero() {
+		rev.Created = time.Now().UTC()
+	}
+	revs := append([]models.EnvironmentRevision{*rev}, fdl.data.revisions[rev.EnvName]...)
+	if len(revs) > models.MaxEnvironmentRevisions {
+		revs = revs[:models.MaxEnvironmentRevisions]
+	}
+	fdl.data.revisions[rev.EnvName] = revs
+	return nil
+}
+
+func (fdl *FakeDataLayer) GetEnvironmentRevisions(ctx context.Context, name string) ([]models.EnvironmentRevision, error) {
+	if isCancelled(ctx) {
+		return nil, ctx.Err()
+	}
+	fdl.doDelay()
+	fdl.data.RLock()
+	defer fdl.data.RUnlock()
+	return append([]models.EnvironmentRevision{}, fdl.data.revisions[name]...), nil
+}
+
+func (fdl *FakeDataLayer) EnqueueOperation(ctx context.Context, op *models.QueuedOperation) error {
+	if isCancelled(ctx) {
+		return ctx.Err()
+	}
+	fdl.doDelay()
+	fdl.data.Lock()
+	defer fdl.data.Unlock()
+	now := time.Now().UTC()
+	if op.Created.IsZero() {
+		op.Created = now
+	}
+	if op.NotBefore.IsZero() {
+		op.NotBefore = now
+	}
+	op.Status = models.OperationPending
+	nop := *op
+	fdl.data.operations[op.ID] = &nop
+	return nil
+}
+
+func (fdl *FakeDataLayer) EnqueueSupersedingOperation(ctx context.Context, op *models.QueuedOperation, debounce time.Duration) ([]models.QueuedOperation, error) {
+	if isCancelled(ctx) {
+		return nil, ctx.Err()
+	}
+	fdl.doDelay()
+	fdl.data.Lock()
+	defer fdl.data.Unlock()
+	superseded := []models.QueuedOperation{}
+	for _, sop := range fdl.data.operations {
+		if sop.Status == models.OperationPending && sop.Action == SupersededOperationAction && sop.RepoRevisionData.Repo == op.RepoRevisionData.Repo && sop.RepoRevisionData.PullRequest == op.RepoRevisionData.PullRequest {
+			superseded = append(superseded, *sop)
+		}
+	}
+	sort.Slice(superseded, func(i, j int) bool { return superseded[i].Created.Before(superseded[j].Created) })
+	now := time.Now().UTC()
+	if op.Created.IsZero() {
+		op.Created = now
+	}
+	if op.NotBefore.IsZero() {
+		op.NotBefore = now
+		if debounce > 0 {
+			op.NotBefore = now.Add(debounce)
+		}
+	}
+	for _, sop := range superseded {
+		if debounce > 0 && sop.NotBefore.Before(op.NotBefore) {
+			op.NotBefore = sop.NotBefore
+		}
+		fdl.data.operations[sop.ID].Status = models.OperationCoalesced
+		fdl.data.operations[sop.ID].Completed = pq.NullTime{Time: now, Valid: true}
+	}
+	op.Status = models.OperationPending
+	nop := *op
+	fdl.data.operations[op.ID] = &nop
+	return superseded, nil
+}
+
+func (fdl *FakeDataLayer) LeaseOperation(ctx context.Context, owner string, lease time.Duration) (*models.QueuedOperation, error) {
+	if isCancelled(ctx) {
+		return nil, ctx.Err()
+	}
+	fdl.doDelay()
+	fdl.data.Lock()
+	defer fdl.data.Unlock()
+	now := time.Now().UTC()
+	var next *models.QueuedOperation
+	for _, op := range fdl.data.operations {
+		pending := op.Status == models.OperationPending && !op.NotBefore.After(now)
+		expired := op.Status == models.OperationRunning && op.LeaseExpires.Time.Before(now)
+		if (pending || expired) && (next == nil || op.Created.Before(next.Created)) {
+			next = op
+		}
+	}
+	if next == nil {
+		return nil, nil
+	}
+	next.Status = models.OperationRunning
+	next.Attempts++
+	next.LeaseOwner = owner
+	next.LeaseExpires.Time, next.LeaseExpires.Valid = now.Add(lease), true
+	out := *next
+	return &out, nil
+}
+
+// leasedOperation returns the running operation id if it's leased by owner. fdl.data must be locked.
+func (fdl *FakeDataLayer) leasedOperation(id uuid.UUID, owner string) (*models.QueuedOperation, error) {
+	op, ok := fdl.data.operations[id]
+	if !ok || op.Status != models.OperationRunning || op.LeaseOwner != owner {
+		return nil, ErrOperationLeaseLost
+	}
+	return op, nil
+}
+
+func (fdl *FakeDataLayer) RenewOperationLease(ctx context.Context, id uuid.UUID, owner string, lease time.Duration) error {
+	if isCancelled(ctx) {
+		return ctx.Err()
+	}
+	fdl.doDelay()
+	fdl.data.Lock()
+	defer fdl.data.Unlock()
+	op, err := fdl.leasedOperation(id, owner)
+	if err != nil {
+		return err
+	}
+	op.LeaseExpires.Time = time.Now().UTC().Add(lease)
+	return nil
+}
+
+func (fdl *FakeDataLayer) CompleteOperation(ctx context.Context, id uuid.UUID, owner string) error {
+	if isCancelled(ctx) {
+		return ctx.Err()
+	}
+	fdl.doDelay()
+	fdl.data.Lock()
+	defer fdl.data.Unlock()
+	op, err := fdl.leasedOperation(id, owner)
+	if err != nil {
+		return err
+	}
+	op.Status = models.OperationDone
+	op.Completed.Time, op.Completed.Valid = time.Now().UTC(), true
+	op.LeaseOwner, op.LeaseExpires.Valid = "", false
+	return nil
+}
+
+func (fdl *FakeDataLayer) RetryOperation(ctx context.Context, id uuid.UUID, owner, errmsg string, notBefore time.Time) error {
+	if isCancelled(ctx) {
+		return ctx.Err()
+	}
+	fdl.doDelay()
+	fdl.data.Lock()
+	defer fdl.data.Unlock()
+	op, err := fdl.leasedOperation(id, owner)
+	if err != nil {
+		return err
+	}
+	op.Status = models.OperationPending
+	op.NotBefore = notBefore
+	op.LastError = errmsg
+	op.LeaseOwner, op.LeaseExpires.Valid = "", false
+	return nil
+}
+
+func (fdl *FakeDataLayer) DeadLetterOperation(ctx context.Context, id uuid.UUID, owner, errmsg string) error {
+	if isCancelled(ctx) {
+		return ctx.Err()
+	}
+	fdl.doDelay()
+	fdl.data.Lock()
+	defer fdl.data.Unlock()
+	op, err := fdl.leasedOperation(id, owner)
+	if err != nil {
+		return err
+	}
+	op.Status = models.OperationDead
+	op.LastError = errmsg
+	op.Completed.Time, op.Completed.Valid = time.Now().UTC(), true
+	op.LeaseOwner, op.LeaseExpires.Valid = "", false
+	return nil
+}
+
+func (fdl *FakeDataLayer) CancelPendingOperation(ctx context.Context, eventID uuid.UUID, reason string) (*models.QueuedOperation, error) {
+	if isCancelled(ctx) {
+		return nil, ctx.Err()
+	}
+	fdl.doDelay()
+	fdl.data.Lock()
+	defer fdl.data.Unlock()
+	for _, op := range fdl.data.operations {
+		if op.EventID == eventID && op.Status == models.OperationPending {
+			op.Status = models.OperationCancelled
+			op.LastError = reason
+			op.Completed.Time, op.Completed.Valid = time.Now().UTC(), true
+			out := *op
+			return &out, nil
+		}
+	}
+	return nil, nil
+}
+
+func (fdl *FakeDataLayer) GetOperations(ctx context.Context, status models.OperationStatus) ([]models.QueuedOperation, error) {
+	if isCancelled(ctx) {
+		return nil, ctx.Err()
+	}
+	fdl.doDelay()
+	fdl.data.RLock()
+	defer fdl.data.RUnlock()
+	out := []models.QueuedOperation{}
+	for _, op := range fdl.data.operations {
+		if op.Status == status {
+			out = append(out, *op)
+		}
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].Created.Before(out[j].Created) })
+	return out, nil
+}
+
+func (fdl *FakeDataLayer) AcquireLeaderLease(ctx context.Context, name, holder string, lease time.Duration) (bool, error) {
+	if isCancelled(ctx) {
+		return false, ctx.Err()
+	}
+	fdl.doDelay()
+	fdl.data.Lock()
+	defer fdl.data.Unlock()
+	now := time.Now().UTC()
+	ll, ok := fdl.data.leases[name]
+	switch {
+	case !ok || ll.Expires.Before(now):
+		fdl.data.leases[name] = &models.LeaderLease{Name: name, Holder: holder, Acquired: now, Renewed: now, Expires: now.Add(lease)}
+	case ll.Holder == holder:
+		ll.Renewed, ll.Expires = now, now.Add(lease)
+	default:
+		return false, nil
+	}
+	return true, nil
+}
+
+func (fdl *FakeDataLayer) ReleaseLeaderLease(ctx context.Context, name, holder string) error {
+	if isCancelled(ctx) {
+		return ctx.Err()
+	}
+	fdl.doDelay()
+	fdl.data.Lock()
+	defer fdl.data.Unlock()
+	if ll, ok := fdl.data.leases[name]; ok && ll.Holder == holder {
+		delete(fdl.data.leases, name)
+	}
+	return nil
+}
+
+func (fdl *FakeDataLayer) GetLeaderLease(ctx context.Context, name string) (*models.LeaderLease, error) {
+	if isCancelled(ctx) {
+		return nil, ctx.Err()
+	}
+	fdl.doDelay()
+	fdl.data.RLock()
+	defer fdl.data.RUnlock()
+	ll, ok := fdl.data.leases[name]
+	if !ok || ll.Expires.Before(time.Now().UTC()) {
+		return nil, nil
+	}
+	out := *ll
+	return &out, nil
+}
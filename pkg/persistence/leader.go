@@ -0,0 +1,62 @@
+package persistence
+
+import (
+	"context"
+	"database/sql"
+	"time"
+
+	"github.com/pkg/errors"
+
+	"github.com/dollarshaveclub/acyl/pkg/models"
+)
+
+// AcquireLeaderLease acquires or renews the leader lease name for holder, so that it expires lease from now, if the lease
+// is free, expired or already held by holder. It returns whether holder holds the lease.
+func (p *PGLayer) AcquireLeaderLease(ctx context.Context, name, holder string, lease time.Duration) (bool, error) {
+	if isCancelled(ctx) {
+		return false, errors.Wrap(ctx.Err(), "error acquiring leader lease")
+	}
+	q := `INSERT INTO leader_leases (name, holder, acquired, renewed, expires) VALUES ($1, $2, now(), now(), now() + ($3 * interval '1 millisecond'))
+	ON CONFLICT (name) DO UPDATE SET
+		holder = EXCLUDED.holder,
+		acquired = CASE WHEN leader_leases.holder = EXCLUDED.holder THEN leader_leases.acquired ELSE now() END,
+		renewed = now(),
+		expires = EXCLUDED.expires
+	WHERE leader_leases.holder = EXCLUDED.holder OR leader_leases.expires < now()
+	RETURNING holder;`
+	var h string
+	if err := p.db.QueryRowContext(ctx, q, name, holder, lease.Milliseconds()).Scan(&h); err != nil {
+		if err == sql.ErrNoRows {
+			return false, nil
+		}
+		return false, errors.Wrap(err, "error acquiring leader lease")
+	}
+	return h == holder, nil
+}
+
+// ReleaseLeaderLease releases the leader lease name if it's held by holder, so that another replica may acquire it immediately
+func (p *PGLayer) ReleaseLeaderLease(ctx context.Context, name, holder string) error {
+	if isCancelled(ctx) {
+		return errors.Wrap(ctx.Err(), "error releasing leader lease")
+	}
+	if _, err := p.db.ExecContext(ctx, `DELETE FROM leader_leases WHERE name = $1 AND holder = $2;`, name, holder); err != nil {
+		return errors.Wrap(err, "error releasing leader lease")
+	}
+	return nil
+}
+
+// GetLeaderLease returns the unexpired leader lease name, or nil if there is currently no leader
+func (p *PGLayer) GetLeaderLease(ctx context.Context, name string) (*models.LeaderLease, error) {
+	if isCancelled(ctx) {
+		return nil, errors.Wrap(ctx.Err(), "error getting leader lease")
+	}
+	q := `SELECT ` + models.LeaderLease{}.Columns() + ` FROM leader_leases WHERE name = $1 AND expires >= now();`
+	ll := &models.LeaderLease{}
+	if err := p.db.QueryRowContext(ctx, q, name).Scan(ll.ScanValues()...); err != nil {
+		if err == sql.ErrNoRows {
+			return nil, nil
+		}
+		return nil, errors.Wrap(err, "error getting leader lease")
+	}
+	return ll, nil
+}
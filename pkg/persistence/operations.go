@@ -0,0 +1,215 @@
+package persistence
+
+import (
+	"context"
+	"database/sql"
+	"strconv"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/pkg/errors"
+
+	"github.com/dollarshaveclub/acyl/pkg/models"
+)
+
+// ErrOperationLeaseLost is returned when a worker attempts to update an operation for which it no longer holds the lease
+var ErrOperationLeaseLost = errors.New("operation lease is not held by owner")
+
+// EnqueueOperation persists a new pending operation. If op.Created or op.NotBefore are zero they are set to the current time.
+func (p *PGLayer) EnqueueOperation(ctx context.Context, op *models.QueuedOperation) error {
+	if isCancelled(ctx) {
+		return errors.Wrap(ctx.Err(), "error enqueueing operation")
+	}
+	now := time.Now().UTC()
+	if op.Created.IsZero() {
+		op.Created = now
+	}
+	if op.NotBefore.IsZero() {
+		op.NotBefore = now
+	}
+	op.Status = models.OperationPending
+	q := `INSERT INTO operation_queue (` + op.InsertColumns() + `) VALUES (` + op.InsertParams() + `);`
+	if _, err := p.db.ExecContext(ctx, q, op.InsertValues()...); err != nil {
+		return errors.Wrap(err, "error inserting operation")
+	}
+	return nil
+}
+
+// SupersededOperationAction is the action of the pending operations that are superseded by a newer operation for the same pull request
+const SupersededOperationAction = "synchronize"
+
+// EnqueueSupersedingOperation persists the new pending operation op like EnqueueOperation, and marks the pending
+// synchronize operations for the same repo and pull request, which op supersedes, as coalesced so that they are never
+// processed. If debounce is non-zero, op is delayed by debounce, or takes the place of the superseded operation that was
+// already delayed, so that a burst of pushes is processed once per debounce window. The superseded operations are returned.
+func (p *PGLayer) EnqueueSupersedingOperation(ctx context.Context, op *models.QueuedOperation, debounce time.Duration) ([]models.QueuedOperation, error) {
+	if isCancelled(ctx) {
+		return nil, errors.Wrap(ctx.Err(), "error enqueueing operation")
+	}
+	tx, err := p.db.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, errors.Wrap(err, "error beginning transaction")
+	}
+	defer tx.Rollback()
+	q := `SELECT ` + models.QueuedOperation{}.Columns() + ` FROM operation_queue
+	WHERE status = $1 AND action = $2 AND repo_revision_data->>'repo' = $3 AND repo_revision_data->>'pull_request' = $4
+	ORDER BY created ASC
+	FOR UPDATE;`
+	rows, err := tx.QueryContext(ctx, q, models.OperationPending, SupersededOperationAction, op.RepoRevisionData.Repo, strconv.Itoa(int(op.RepoRevisionData.PullRequest)))
+	if err != nil {
+		return nil, errors.Wrap(err, "error querying superseded operations")
+	}
+	superseded := []models.QueuedOperation{}
+	for rows.Next() {
+		sop := models.QueuedOperation{}
+		if err := rows.Scan(sop.ScanValues()...); err != nil {
+			rows.Close()
+			return nil, errors.Wrap(err, "error scanning row")
+		}
+		superseded = append(superseded, sop)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, errors.Wrap(err, "error reading superseded operations")
+	}
+	now := time.Now().UTC()
+	if op.Created.IsZero() {
+		op.Created = now
+	}
+	if op.NotBefore.IsZero() {
+		op.NotBefore = now
+		if debounce > 0 {
+			op.NotBefore = now.Add(debounce)
+		}
+	}
+	for _, sop := range superseded {
+		if debounce > 0 && sop.NotBefore.Before(op.NotBefore) {
+			op.NotBefore = sop.NotBefore
+		}
+		q = `UPDATE operation_queue SET status = $1, completed = now() WHERE id = $2;`
+		if _, err := tx.ExecContext(ctx, q, models.OperationCoalesced, sop.ID); err != nil {
+			return nil, errors.Wrap(err, "error updating superseded operation")
+		}
+	}
+	op.Status = models.OperationPending
+	q = `INSERT INTO operation_queue (` + op.InsertColumns() + `) VALUES (` + op.InsertParams() + `);`
+	if _, err := tx.ExecContext(ctx, q, op.InsertValues()...); err != nil {
+		return nil, errors.Wrap(err, "error inserting operation")
+	}
+	if err := tx.Commit(); err != nil {
+		return nil, errors.Wrap(err, "error committing transaction")
+	}
+	return superseded, nil
+}
+
+// LeaseOperation claims the oldest operation that is either pending (and not waiting to be retried) or running with an
+// expired lease (the worker processing it crashed or lost connectivity) for owner, incrementing its attempts. Concurrent
+// callers never receive the same operation. If there are no operations available, nil is returned.
+func (p *PGLayer) LeaseOperation(ctx context.Context, owner string, lease time.Duration) (*models.QueuedOperation, error) {
+	if isCancelled(ctx) {
+		return nil, errors.Wrap(ctx.Err(), "error leasing operation")
+	}
+	q := `UPDATE operation_queue SET status = $1, attempts = attempts + 1, lease_owner = $2, lease_expires = now() + ($3 * interval '1 millisecond')
+	WHERE id = (
+		SELECT id FROM operation_queue
+		WHERE (status = $4 AND not_before <= now()) OR (status = $1 AND lease_expires < now())
+		ORDER BY created ASC
+		LIMIT 1
+		FOR UPDATE SKIP LOCKED
+	)
+	RETURNING ` + models.QueuedOperation{}.Columns() + `;`
+	op := &models.QueuedOperation{}
+	err := p.db.QueryRowContext(ctx, q, models.OperationRunning, owner, lease.Milliseconds(), models.OperationPending).Scan(op.ScanValues()...)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return nil, nil
+		}
+		return nil, errors.Wrap(err, "error leasing operation")
+	}
+	return op, nil
+}
+
+// updateLeasedOperation executes the update q (with the operation ID and owner as the first two parameters) if owner
+// holds the lease on the running operation, returning ErrOperationLeaseLost otherwise
+func (p *PGLayer) updateLeasedOperation(ctx context.Context, q string, id uuid.UUID, owner string, args ...interface{}) error {
+	if isCancelled(ctx) {
+		return errors.Wrap(ctx.Err(), "error updating operation")
+	}
+	res, err := p.db.ExecContext(ctx, q, append([]interface{}{id, owner, models.OperationRunning}, args...)...)
+	if err != nil {
+		return errors.Wrap(err, "error updating operation")
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return errors.Wrap(err, "error getting rows affected")
+	}
+	if n != 1 {
+		return ErrOperationLeaseLost
+	}
+	return nil
+}
+
+// RenewOperationLease extends the lease of owner on the running operation to lease from now
+func (p *PGLayer) RenewOperationLease(ctx context.Context, id uuid.UUID, owner string, lease time.Duration) error {
+	q := `UPDATE operation_queue SET lease_expires = now() + ($4 * interval '1 millisecond') WHERE id = $1 AND lease_owner = $2 AND status = $3;`
+	return p.updateLeasedOperation(ctx, q, id, owner, lease.Milliseconds())
+}
+
+// CompleteOperation marks the running operation leased by owner as done
+func (p *PGLayer) CompleteOperation(ctx context.Context, id uuid.UUID, owner string) error {
+	q := `UPDATE operation_queue SET status = $4, completed = now(), lease_owner = '', lease_expires = NULL WHERE id = $1 AND lease_owner = $2 AND status = $3;`
+	return p.updateLeasedOperation(ctx, q, id, owner, models.OperationDone)
+}
+
+// RetryOperation releases the lease of owner on the failed running operation, which will be leased again at or after notBefore
+func (p *PGLayer) RetryOperation(ctx context.Context, id uuid.UUID, owner, errmsg string, notBefore time.Time) error {
+	q := `UPDATE operation_queue SET status = $4, not_before = $5, last_error = $6, lease_owner = '', lease_expires = NULL WHERE id = $1 AND lease_owner = $2 AND status = $3;`
+	return p.updateLeasedOperation(ctx, q, id, owner, models.OperationPending, notBefore, errmsg)
+}
+
+// DeadLetterOperation marks the failed running operation leased by owner as dead so that it will not be retried
+func (p *PGLayer) DeadLetterOperation(ctx context.Context, id uuid.UUID, owner, errmsg string) error {
+	q := `UPDATE operation_queue SET status = $4, last_error = $5, completed = now(), lease_owner = '', lease_expires = NULL WHERE id = $1 AND lease_owner = $2 AND status = $3;`
+	return p.updateLeasedOperation(ctx, q, id, owner, models.OperationDead, errmsg)
+}
+
+// CancelPendingOperation marks the pending operation of the event eventID as cancelled with reason so that it is never
+// processed, and returns it. If the event has no pending operation (a worker is processing it or it was completed), nil is returned.
+func (p *PGLayer) CancelPendingOperation(ctx context.Context, eventID uuid.UUID, reason string) (*models.QueuedOperation, error) {
+	if isCancelled(ctx) {
+		return nil, errors.Wrap(ctx.Err(), "error cancelling operation")
+	}
+	q := `UPDATE operation_queue SET status = $1, last_error = $2, completed = now() WHERE event_id = $3 AND status = $4
+	RETURNING ` + models.QueuedOperation{}.Columns() + `;`
+	op := &models.QueuedOperation{}
+	err := p.db.QueryRowContext(ctx, q, models.OperationCancelled, reason, eventID, models.OperationPending).Scan(op.ScanValues()...)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return nil, nil
+		}
+		return nil, errors.Wrap(err, "error cancelling operation")
+	}
+	return op, nil
+}
+
+// GetOperations returns all operations with status, oldest first
+func (p *PGLayer) GetOperations(ctx context.Context, status models.OperationStatus) ([]models.QueuedOperation, error) {
+	if isCancelled(ctx) {
+		return nil, errors.Wrap(ctx.Err(), "error getting operations")
+	}
+	q := `SELECT ` + models.QueuedOperation{}.Columns() + ` FROM operation_queue WHERE status = $1 ORDER BY created ASC;`
+	rows, err := p.db.QueryContext(ctx, q, status)
+	if err != nil {
+		return nil, errors.Wrap(err, "error querying operations")
+	}
+	defer rows.Close()
+	out := []models.QueuedOperation{}
+	for rows.Next() {
+		op := models.QueuedOperation{}
+		if err := rows.Scan(op.ScanValues()...); err != nil {
+			return nil, errors.Wrap(err, "error scanning row")
+		}
+		out = append(out, op)
+	}
+	return out, rows.Err()
+}
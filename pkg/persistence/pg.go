@@ -380,6 +380,82 @@ func (p *PGLayer) SetQAEnvironmentCreated(ctx context.Context, name string, crea
 	return err
 }
 
+// SetQAEnvironmentExpiration sets a specific QAEnvironment's expiration time (nil for no expiration) and clears the expiration warned flag.
+func (p *PGLayer) SetQAEnvironmentExpiration(ctx context.Context, name string, expires *time.Time) error {
+	if isCancelled(ctx) {
+		return errors.Wrap(ctx.Err(), "error setting qa environment expiration")
+	}
+	msg := "Expiration removed"
+	if expires != nil {
+		t := expires.UTC().Truncate(1 * time.Microsecond)
+		expires = &t
+		msg = fmt.Sprintf("Expiration set to %v", t.Format(time.RFC3339))
+	}
+	_, err := p.db.ExecContext(ctx, `UPDATE qa_environments SET expires_at = $1, expiration_warned = false WHERE name = $2;`, expires, name)
+	if err != nil {
+		return errors.Wrap(err, "error setting expiration")
+	}
+	if err := p.AddEvent(ctx, name, msg); err != nil {
+		return errors.Wrapf(err, "error setting event for QAEnvironment: %v ", name)
+	}
+	return nil
+}
+
+// SetQAEnvironmentExpirationWarned records that the expiration warning has been sent for a specific QAEnvironment.
+func (p *PGLayer) SetQAEnvironmentExpirationWarned(ctx context.Context, name string) error {
+	if isCancelled(ctx) {
+		return errors.Wrap(ctx.Err(), "error setting qa environment expiration warned")
+	}
+	_, err := p.db.ExecContext(ctx, `UPDATE qa_environments SET expiration_warned = true WHERE name = $1;`, name)
+	return err
+}
+
+// GetQAEnvironmentsExpiringBefore returns all environments that are not destroyed and have an expiration before t, in ascending order of expiration.
+func (p *PGLayer) GetQAEnvironmentsExpiringBefore(ctx context.Context, t time.Time) ([]QAEnvironment, error) {
+	if isCancelled(ctx) {
+		return nil, errors.Wrap(ctx.Err(), "error getting expiring qa environments")
+	}
+	return p.collectRows(p.db.QueryContext(ctx, `SELECT `+models.QAEnvironment{}.Columns()+` FROM qa_environments WHERE expires_at IS NOT NULL AND expires_at < $1 AND status != $2 ORDER BY expires_at ASC;`, t, models.Destroyed))
+}
+
+// SetQAEnvironmentPin sets or clears the pin on a specific QAEnvironment. until is the optional pin expiration.
+func (p *PGLayer) SetQAEnvironmentPin(ctx context.Context, name string, pinned bool, reason string, until *time.Time) error {
+	if isCancelled(ctx) {
+		return errors.Wrap(ctx.Err(), "error setting qa environment pin")
+	}
+	msg := "Unpinned"
+	if !pinned {
+		reason, until = "", nil
+	} else {
+		msg = "Pinned"
+		if reason != "" {
+			msg += ": " + reason
+		}
+		if until != nil {
+			t := until.UTC().Truncate(1 * time.Microsecond)
+			until = &t
+			msg += fmt.Sprintf(" (until %v)", t.Format(time.RFC3339))
+		}
+	}
+	_, err := p.db.ExecContext(ctx, `UPDATE qa_environments SET pinned = $1, pin_reason = $2, pinned_until = $3 WHERE name = $4;`, pinned, reason, until, name)
+	if err != nil {
+		return errors.Wrap(err, "error setting pin")
+	}
+	if err := p.AddEvent(ctx, name, msg); err != nil {
+		return errors.Wrapf(err, "error setting event for QAEnvironment: %v ", name)
+	}
+	return nil
+}
+
+// SetQAEnvironmentReaperPolicy sets the reaper policy overrides of a specific QAEnvironment.
+func (p *PGLayer) SetQAEnvironmentReaperPolicy(ctx context.Context, name string, rp models.ReaperPolicy) error {
+	if isCancelled(ctx) {
+		return errors.Wrap(ctx.Err(), "error setting qa environment reaper policy")
+	}
+	_, err := p.db.ExecContext(ctx, `UPDATE qa_environments SET reaper_policy = $1 WHERE name = $2;`, rp, name)
+	return errors.Wrap(err, "error setting reaper policy")
+}
+
 // GetExtantQAEnvironments finds any environments for the given repo/PR combination that
 // are not status Destroyed
 func (p *PGLayer) GetExtantQAEnvironments(ctx context.Context, repo string, pr uint) ([]QAEnvironment, error) {
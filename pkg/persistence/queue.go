@@ -0,0 +1,62 @@
+package persistence
+
+import (
+	"context"
+
+	"github.com/pkg/errors"
+
+	"github.com/dollarshaveclub/acyl/pkg/models"
+)
+
+// EnqueueEnvironment adds an environment to the create queue. If the environment is already queued, the priority, repo revision data
+// and event ID are updated but the original enqueued timestamp (and therefore its place in the queue) is retained.
+func (p *PGLayer) EnqueueEnvironment(ctx context.Context, qe *models.QueuedEnvironment) error {
+	if isCancelled(ctx) {
+		return errors.Wrap(ctx.Err(), "error enqueueing environment")
+	}
+	q := `INSERT INTO environment_queue (` + qe.Columns() + `) VALUES (` + qe.InsertParams() + `)
+	ON CONFLICT (env_name) DO UPDATE SET priority = EXCLUDED.priority, repo_revision_data = EXCLUDED.repo_revision_data, event_id = EXCLUDED.event_id, installation_id = EXCLUDED.installation_id;`
+	if _, err := p.db.ExecContext(ctx, q, qe.InsertValues()...); err != nil {
+		return errors.Wrap(err, "error inserting queued environment")
+	}
+	return nil
+}
+
+// GetQueuedEnvironments returns all queued environments in queue order (highest priority first, then oldest first)
+func (p *PGLayer) GetQueuedEnvironments(ctx context.Context) ([]models.QueuedEnvironment, error) {
+	if isCancelled(ctx) {
+		return nil, errors.Wrap(ctx.Err(), "error getting queued environments")
+	}
+	q := `SELECT ` + models.QueuedEnvironment{}.Columns() + ` FROM environment_queue ORDER BY priority DESC, enqueued ASC;`
+	rows, err := p.db.QueryContext(ctx, q)
+	if err != nil {
+		return nil, errors.Wrap(err, "error querying queued environments")
+	}
+	defer rows.Close()
+	out := []models.QueuedEnvironment{}
+	for rows.Next() {
+		qe := models.QueuedEnvironment{}
+		if err := rows.Scan(qe.ScanValues()...); err != nil {
+			return nil, errors.Wrap(err, "error scanning row")
+		}
+		out = append(out, qe)
+	}
+	return out, rows.Err()
+}
+
+// DequeueEnvironment removes the named environment from the queue and returns whether it was present.
+// Only one concurrent caller will receive true for a given queue entry.
+func (p *PGLayer) DequeueEnvironment(ctx context.Context, name string) (bool, error) {
+	if isCancelled(ctx) {
+		return false, errors.Wrap(ctx.Err(), "error dequeueing environment")
+	}
+	res, err := p.db.ExecContext(ctx, `DELETE FROM environment_queue WHERE env_name = $1;`, name)
+	if err != nil {
+		return false, errors.Wrap(err, "error deleting queued environment")
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return false, errors.Wrap(err, "error getting rows affected")
+	}
+	return n == 1, nil
+}
@@ -0,0 +1,61 @@
+package persistence
+
+import (
+	"context"
+	"time"
+
+	"github.com/pkg/errors"
+
+	"github.com/dollarshaveclub/acyl/pkg/models"
+)
+
+// CreateEnvironmentRevision records a successful deployment of an environment, removing the oldest revisions for the
+// environment beyond models.MaxEnvironmentRevisions. The ID of rev is set from the created record.
+func (p *PGLayer) CreateEnvironmentRevision(ctx context.Context, rev *models.EnvironmentRevision) error {
+	if isCancelled(ctx) {
+		return errors.Wrap(ctx.Err(), "error creating environment revision")
+	}
+	if rev.Created.IsZero() {
+		rev.Created = time.Now().UTC()
+	}
+	tx, err := p.db.BeginTx(ctx, nil)
+	if err != nil {
+		return errors.Wrap(err, "error opening txn")
+	}
+	defer tx.Rollback()
+	q := `INSERT INTO environment_revisions (` + rev.InsertColumns() + `) VALUES (` + rev.InsertParams() + `) RETURNING id;`
+	if err := tx.QueryRowContext(ctx, q, rev.InsertValues()...).Scan(&rev.ID); err != nil {
+		return errors.Wrap(err, "error inserting environment revision")
+	}
+	q = `DELETE FROM environment_revisions WHERE env_name = $1 AND id NOT IN
+	(SELECT id FROM environment_revisions WHERE env_name = $1 ORDER BY created DESC, id DESC LIMIT $2);`
+	if _, err := tx.ExecContext(ctx, q, rev.EnvName, models.MaxEnvironmentRevisions); err != nil {
+		return errors.Wrap(err, "error deleting old environment revisions")
+	}
+	if err := tx.Commit(); err != nil {
+		return errors.Wrap(err, "error committing txn")
+	}
+	return nil
+}
+
+// GetEnvironmentRevisions returns the recorded revisions for the named environment, newest first
+func (p *PGLayer) GetEnvironmentRevisions(ctx context.Context, name string) ([]models.EnvironmentRevision, error) {
+	if isCancelled(ctx) {
+		return nil, errors.Wrap(ctx.Err(), "error getting environment revisions")
+	}
+	q := `SELECT ` + models.EnvironmentRevision{}.Columns() + ` FROM environment_revisions WHERE env_name = $1 ORDER BY created DESC, id DESC;`
+	rows, err := p.db.QueryContext(ctx, q, name)
+	if err != nil {
+		return nil, errors.Wrap(err, "error querying environment revisions")
+	}
+	defer rows.Close()
+	out := []models.EnvironmentRevision{}
+	for rows.Next() {
+		rev := models.EnvironmentRevision{}
+		if err := rows.Scan(rev.ScanValues()...); err != nil {
+			return nil, errors.Wrap(err, "error scanning row")
+		}
+		out = append(out, rev)
+	}
+	return out, rows.Err()
+}
@@ -0,0 +1,48 @@
+package reap
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/dollarshaveclub/acyl/pkg/models"
+)
+
+// expireEnvironments destroys environments whose expiration has passed and warns about those that will expire within the warning period.
+// Pinned environments are skipped.
+func (r *Reaper) expireEnvironments(ctx context.Context) error {
+	now := time.Now().UTC()
+	qas, err := r.dl.GetQAEnvironmentsExpiringBefore(ctx, now.Add(r.ttlWarning))
+	if err != nil {
+		return fmt.Errorf("error getting expiring environments: %v", err)
+	}
+	for _, qa := range r.unplanned(qas) {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		qa := qa
+		if qa.IsPinned(now) {
+			continue
+		}
+		if !qa.ExpiresAt.After(now) {
+			if r.skipDryRun(&qa, models.ReapActionDestroy, models.ReapExpired.String(), fmt.Sprintf("expired at %v", qa.ExpiresAt.Format(time.RFC3339))) {
+				continue
+			}
+			r.logger.Printf("destroying environment %v: expired at %v", qa.Name, qa.ExpiresAt)
+			err := r.es.DestroyExplicitly(ctx, &qa, models.ReapExpired)
+			r.mc.Reaped(qa.Name, qa.Repo, models.ReapExpired, err)
+			if err != nil {
+				r.logger.Printf("error destroying expired environment %v: %v", qa.Name, err)
+			}
+			continue
+		}
+		if qa.ExpirationWarned || r.dryRun {
+			continue
+		}
+		r.logger.Printf("warning about expiration of environment %v: expires at %v", qa.Name, qa.ExpiresAt)
+		if err := r.es.WarnExpiration(ctx, qa.Name); err != nil {
+			r.logger.Printf("error warning about expiration of %v: %v", qa.Name, err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,156 @@
+package reap
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/dollarshaveclub/acyl/pkg/models"
+)
+
+// HibernationPolicy configures when the reaper hibernates environments with status Success.
+// An environment is only hibernated if there has been no activity on it since the policy applied (the start of the current
+// off-hours period, or the idle duration), so environments that were woken explicitly are left alone.
+type HibernationPolicy struct {
+	// IdleDuration hibernates environments with no activity for at least this long (zero disables)
+	IdleDuration time.Duration
+	// OffHours is a daily window in the form HH:MM-HH:MM during which environments are hibernated (empty disables). It may span midnight.
+	OffHours string
+	// Weekends hibernates environments on Saturdays and Sundays
+	Weekends bool
+	// Location is the time zone used for OffHours and Weekends (UTC if nil)
+	Location *time.Location
+}
+
+// Enabled returns whether any hibernation is configured
+func (hp HibernationPolicy) Enabled() bool {
+	return hp.IdleDuration > 0 || hp.OffHours != "" || hp.Weekends
+}
+
+// parseOffHours returns the start and end of the off-hours window as offsets from midnight
+func (hp HibernationPolicy) parseOffHours() (start, end time.Duration, err error) {
+	parse := func(s string) (time.Duration, error) {
+		t, err := time.Parse("15:04", strings.TrimSpace(s))
+		if err != nil {
+			return 0, fmt.Errorf("invalid time (expected HH:MM): %v", s)
+		}
+		return time.Duration(t.Hour())*time.Hour + time.Duration(t.Minute())*time.Minute, nil
+	}
+	parts := strings.Split(hp.OffHours, "-")
+	if len(parts) != 2 {
+		return 0, 0, fmt.Errorf("invalid off-hours window (expected HH:MM-HH:MM): %v", hp.OffHours)
+	}
+	if start, err = parse(parts[0]); err != nil {
+		return 0, 0, err
+	}
+	if end, err = parse(parts[1]); err != nil {
+		return 0, 0, err
+	}
+	if start == end {
+		return 0, 0, fmt.Errorf("off-hours window start and end must differ: %v", hp.OffHours)
+	}
+	return start, end, nil
+}
+
+// Validate checks that the policy is well-formed
+func (hp HibernationPolicy) Validate() error {
+	if hp.IdleDuration < 0 {
+		return fmt.Errorf("idle duration must not be negative: %v", hp.IdleDuration)
+	}
+	if hp.OffHours != "" {
+		if _, _, err := hp.parseOffHours(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// offHoursStart returns the start of the off-hours period that now falls within, or false if now isn't within one
+func (hp HibernationPolicy) offHoursStart(now time.Time) (time.Time, bool) {
+	loc := hp.Location
+	if loc == nil {
+		loc = time.UTC
+	}
+	now = now.In(loc)
+	midnight := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, loc)
+	var starts []time.Time
+	if hp.OffHours != "" {
+		if start, end, err := hp.parseOffHours(); err == nil {
+			ts, te := midnight.Add(start), midnight.Add(end)
+			switch {
+			case start < end && !now.Before(ts) && now.Before(te):
+				starts = append(starts, ts)
+			case start > end && !now.Before(ts):
+				starts = append(starts, ts)
+			case start > end && now.Before(te):
+				starts = append(starts, ts.AddDate(0, 0, -1))
+			}
+		}
+	}
+	if hp.Weekends {
+		switch now.Weekday() {
+		case time.Saturday:
+			starts = append(starts, midnight)
+		case time.Sunday:
+			starts = append(starts, midnight.AddDate(0, 0, -1))
+		}
+	}
+	if len(starts) == 0 {
+		return time.Time{}, false
+	}
+	earliest := starts[0]
+	for _, s := range starts[1:] {
+		if s.Before(earliest) {
+			earliest = s
+		}
+	}
+	return earliest, true
+}
+
+// shouldHibernate returns whether an environment whose last activity was at last should be hibernated at now, and the reason
+func (hp HibernationPolicy) shouldHibernate(now, last time.Time) (bool, string) {
+	if start, ok := hp.offHoursStart(now); ok && last.Before(start) {
+		return true, fmt.Sprintf("off-hours (since %v)", start)
+	}
+	if hp.IdleDuration > 0 && now.Sub(last) >= hp.IdleDuration {
+		return true, fmt.Sprintf("idle for longer than %v", hp.IdleDuration)
+	}
+	return false, ""
+}
+
+// lastActivity returns the timestamp of the most recent event for the environment, or the created timestamp if there are no events
+func lastActivity(qa models.QAEnvironment) time.Time {
+	last := qa.Created
+	for _, e := range qa.Events {
+		if e.Timestamp.After(last) {
+			last = e.Timestamp
+		}
+	}
+	return last
+}
+
+func (r *Reaper) hibernateEnvironments(ctx context.Context) error {
+	if !r.hp.Enabled() {
+		return nil
+	}
+	qas, err := r.dl.GetQAEnvironmentsByStatus(ctx, models.Success.String())
+	if err != nil {
+		return fmt.Errorf("error getting QA environments: %v", err)
+	}
+	now := time.Now().UTC()
+	for _, qa := range qas {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		ok, reason := r.hp.shouldHibernate(now, lastActivity(qa))
+		if !ok {
+			continue
+		}
+		r.logger.Printf("hibernating environment %v: %v", qa.Name, reason)
+		if err := r.es.Hibernate(ctx, qa.Name); err != nil {
+			r.logger.Printf("error hibernating %v: %v", qa.Name, err)
+		}
+	}
+	return nil
+}
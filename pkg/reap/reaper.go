@@ -18,12 +18,8 @@ import (
 )
 
 const (
-	lockWait                  = 5 * time.Second
-	deleteMaxCount            = 100
-	destroyedMaxDurationHours = 730 // one month
-	failedMaxDurationSecs     = 3600
-	spawnedMaxDurationSecs    = 3600
-	registeredMaxDurationSecs = 7200
+	lockWait       = 5 * time.Second
+	deleteMaxCount = 100
 )
 
 type ReaperMetricsCollector interface {
@@ -40,12 +36,20 @@ type Reaper struct {
 	rc          ghclient.RepoClient
 	mc          ReaperMetricsCollector
 	globalLimit uint
+	ttlWarning  time.Duration
+	hp          HibernationPolicy
+	policies    models.ReaperPolicies
 	logger      *log.Logger
 	lockKey     int64
+
+	// dryRun records the actions that would be taken in actions instead of taking them
+	dryRun  bool
+	actions []models.ReapAction
+	planned map[string]bool
 }
 
 // NewReaper returns a Reaper object using the supplied dependencies
-func NewReaper(lp locker.LockProvider, dl persistence.DataLayer, es spawner.EnvironmentSpawner, rc ghclient.RepoClient, mc ReaperMetricsCollector, globalLimit uint, logger *log.Logger, lockKey int64) *Reaper {
+func NewReaper(lp locker.LockProvider, dl persistence.DataLayer, es spawner.EnvironmentSpawner, rc ghclient.RepoClient, mc ReaperMetricsCollector, globalLimit uint, ttlWarning time.Duration, hp HibernationPolicy, policies models.ReaperPolicies, logger *log.Logger, lockKey int64) *Reaper {
 	return &Reaper{
 		lp:          lp,
 		dl:          dl,
@@ -53,18 +57,23 @@ func NewReaper(lp locker.LockProvider, dl persistence.DataLayer, es spawner.Envi
 		rc:          rc,
 		mc:          mc,
 		globalLimit: globalLimit,
+		ttlWarning:  ttlWarning,
+		hp:          hp,
+		policies:    policies,
 		lockKey:     lockKey,
 		logger:      logger,
 	}
 }
 
-// Reap is called periodically to do various cleanup tasks
-func (r *Reaper) Reap() {
+// Reap is called periodically to do various cleanup tasks. It stops as soon as ctx is cancelled (for example when the
+// replica stops being the leader), so that it never runs concurrently with the reaper of another replica.
+func (r *Reaper) Reap(ctx context.Context) {
 	var err error
-	reapSpan, ctx := tracer.StartSpanFromContext(context.Background(), "reap")
+	reapSpan, ctx := tracer.StartSpanFromContext(ctx, "reap")
 	defer func() {
 		reapSpan.Finish(tracer.WithError(err))
 	}()
+	// the server only reaps on the replica elected leader, but the lock prevents overlapping runs during a leadership transition
 	lock, err := r.lp.New(ctx, r.lockKey, "reap")
 	if err != nil || lock == nil {
 		r.logger.Printf("error trying to acquire lock: %v", err)
@@ -81,25 +90,101 @@ func (r *Reaper) Reap() {
 		unlockCancel()
 	}()
 
-	err = r.pruneDestroyedRecords(ctx)
-	if err != nil {
-		r.logger.Printf("error pruning destroyed records: %v", err)
+	steps := []struct {
+		desc string
+		f    func(context.Context) error
+	}{
+		{"pruning destroyed records", r.pruneDestroyedRecords},
+		{"destroying failed/stuck environments", r.destroyFailedOrStuckEnvironments},
+		{"destroying environments associated with closed PRs", r.destroyClosedPRs},
+		{"destroying expired environments", r.expireEnvironments},
+		{fmt.Sprintf("enforcing global limit (%v)", r.globalLimit), r.enforceGlobalLimit},
+		{"hibernating environments", r.hibernateEnvironments},
+		// start any queued creates for which capacity has become available
+		{"processing environment queue", r.es.ProcessQueue},
+		{"auditing qa envs", r.auditQaEnvs},
 	}
-	err = r.destroyFailedOrStuckEnvironments(ctx)
-	if err != nil {
-		r.logger.Printf("error destroying failed/stuck environments: %v", err)
+	for _, s := range steps {
+		if err = ctx.Err(); err != nil {
+			r.logger.Printf("reaper: stopping before %v: %v", s.desc, err)
+			return
+		}
+		if err = s.f(ctx); err != nil {
+			r.logger.Printf("error %v: %v", s.desc, err)
+		}
 	}
-	err = r.destroyClosedPRs(ctx)
-	if err != nil {
-		r.logger.Printf("error destroying environments associated with closed PRs: %v", err)
+}
+
+// DryRun returns the environments that would be destroyed and the destroyed environment records that would be pruned
+// by Reap, and why, without destroying or pruning anything. Hibernation and the processing of queued creates are skipped.
+func (r *Reaper) DryRun(ctx context.Context) ([]models.ReapAction, error) {
+	dr := *r
+	dr.dryRun = true
+	dr.actions = []models.ReapAction{}
+	dr.planned = map[string]bool{}
+	if err := dr.pruneDestroyedRecords(ctx); err != nil {
+		return nil, fmt.Errorf("error pruning destroyed records: %w", err)
 	}
-	err = r.enforceGlobalLimit(ctx)
-	if err != nil {
-		r.logger.Printf("error enforcing global limit (%v): %v", r.globalLimit, err)
+	if err := dr.destroyFailedOrStuckEnvironments(ctx); err != nil {
+		return nil, fmt.Errorf("error destroying failed/stuck environments: %w", err)
+	}
+	if err := dr.destroyClosedPRs(ctx); err != nil {
+		return nil, fmt.Errorf("error destroying environments associated with closed PRs: %w", err)
+	}
+	if err := dr.expireEnvironments(ctx); err != nil {
+		return nil, fmt.Errorf("error destroying expired environments: %w", err)
+	}
+	if err := dr.enforceGlobalLimit(ctx); err != nil {
+		return nil, fmt.Errorf("error enforcing global limit: %w", err)
+	}
+	return dr.actions, nil
+}
+
+// skipDryRun records action on qa for reason (described by detail) and returns true if this is a dry run, in which
+// case the action must not be taken
+func (r *Reaper) skipDryRun(qa *models.QAEnvironment, action, reason, detail string) bool {
+	if !r.dryRun {
+		return false
+	}
+	r.actions = append(r.actions, models.ReapAction{
+		EnvName:     qa.Name,
+		Repo:        qa.Repo,
+		PullRequest: qa.PullRequest,
+		Status:      qa.Status.String(),
+		Action:      action,
+		Reason:      reason,
+		Detail:      detail,
+	})
+	r.planned[qa.Name] = true
+	return true
+}
+
+// unplanned returns the environments in qas for which no action has been recorded by the dry run, since they would
+// have been destroyed by a previous step
+func (r *Reaper) unplanned(qas []models.QAEnvironment) []models.QAEnvironment {
+	if len(r.planned) == 0 {
+		return qas
+	}
+	out := []models.QAEnvironment{}
+	for _, qa := range qas {
+		if !r.planned[qa.Name] {
+			out = append(out, qa)
+		}
 	}
-	if err = r.auditQaEnvs(ctx); err != nil {
-		r.logger.Printf("reaper: audit qa envs: %v", err)
+	return out
+}
+
+// markedSince returns when qa was last marked with status according to its events, or false if that isn't recorded
+func markedSince(qa models.QAEnvironment, status models.EnvironmentStatus) (time.Time, bool) {
+	var ts time.Time
+	var found bool
+	for _, e := range qa.Events {
+		if strings.Contains(strings.ToLower(e.Message), strings.ToLower("marked as "+status.String())) {
+			found = true
+			ts = e.Timestamp
+		}
 	}
+	return ts, found
 }
 
 func (r *Reaper) auditQaEnvs(ctx context.Context) error {
@@ -132,15 +217,22 @@ func (r *Reaper) destroyClosedPRs(ctx context.Context) error {
 		return fmt.Errorf("error getting QA environments: %v", err)
 	}
 	var prs string
-	for _, qa := range qas {
-		if qa.Status != models.Destroyed {
-			prs, err = r.rc.GetPRStatus(context.Background(), qa.Repo, qa.PullRequest)
+	for _, qa := range r.unplanned(qas) {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		// manual environments have no PR and are cleaned up by expiration instead
+		if qa.Status != models.Destroyed && !qa.IsManual() {
+			prs, err = r.rc.GetPRStatus(ctx, qa.Repo, qa.PullRequest)
 			if err != nil {
 				return err
 			}
 			if prs == "closed" {
+				if r.skipDryRun(&qa, models.ReapActionDestroy, models.ReapPrClosed.String(), "PR is closed") {
+					continue
+				}
 				r.logger.Printf("destroying environment because PR is now closed: %v", qa.Name)
-				err = r.es.DestroyExplicitly(context.Background(), &qa, models.ReapPrClosed)
+				err = r.es.DestroyExplicitly(ctx, &qa, models.ReapPrClosed)
 				if err != nil {
 					r.logger.Printf("error destroying %v: %v", qa.Name, err)
 				}
@@ -155,22 +247,24 @@ func (r *Reaper) pruneDestroyedRecords(ctx context.Context) error {
 	if err != nil {
 		return fmt.Errorf("error getting QA environments: %v", err)
 	}
-	var found bool
-	var ts time.Time
 	var i int
 
-	defer func() { r.mc.Pruned(i) }()
+	defer func() {
+		if !r.dryRun {
+			r.mc.Pruned(i)
+		}
+	}()
 
 	for _, qa := range qas {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
 		if qa.Status == models.Destroyed && i < deleteMaxCount {
-			found = false
-			for _, e := range qa.Events { // get timestamp of destroyed event
-				if strings.Contains(strings.ToLower(e.Message), strings.ToLower("marked as "+models.Destroyed.String())) {
-					found = true
-					ts = e.Timestamp
-				}
-			}
+			ts, found := markedSince(qa, models.Destroyed)
 			if !found {
+				if r.skipDryRun(&qa, models.ReapActionPrune, "", "destroyed event not found") {
+					continue
+				}
 				r.logger.Printf("could not find destroyed event for %v", qa.Name)
 				err = r.dl.DeleteQAEnvironment(ctx, qa.Name)
 				if err != nil {
@@ -178,39 +272,77 @@ func (r *Reaper) pruneDestroyedRecords(ctx context.Context) error {
 				}
 				continue
 			}
-			if time.Since(ts) > (destroyedMaxDurationHours * time.Hour) {
+			delay := r.policies.For(qa.Repo, qa.ReaperPolicy).PruneDelay
+			if time.Since(ts) > delay {
+				i++
+				if r.skipDryRun(&qa, models.ReapActionPrune, "", fmt.Sprintf("destroyed at %v, longer ago than the prune delay (%v)", ts.Format(time.RFC3339), delay)) {
+					continue
+				}
 				r.logger.Printf("deleting destroyed environment: %v", qa.Name)
 				err = r.dl.DeleteQAEnvironment(ctx, qa.Name)
 				if err != nil {
 					r.logger.Printf("error deleting destroyed environment: %v", err)
 				}
-				i++
 			}
 		}
 	}
 	return nil
 }
 
-func (r *Reaper) destroyIfOlderThan(ctx context.Context, qa *models.QAEnvironment, d time.Duration, reason models.QADestroyReason) (err error) {
-	if time.Since(qa.Created) > d {
-		r.logger.Printf("destroying environment %v: in state %v greater than %v secs", qa.Name, qa.Status.String(), d.Seconds())
+// destroyIfLongerThan destroys qa for reason if it has been in the condition described by desc since since for longer than d
+func (r *Reaper) destroyIfLongerThan(ctx context.Context, qa *models.QAEnvironment, desc string, since time.Time, d time.Duration, reason models.QADestroyReason) (err error) {
+	if time.Since(since) > d {
+		detail := fmt.Sprintf("%v for longer than %v (since %v)", desc, d, since.Format(time.RFC3339))
+		if r.skipDryRun(qa, models.ReapActionDestroy, reason.String(), detail) {
+			return nil
+		}
+		r.logger.Printf("destroying environment %v: %v", qa.Name, detail)
 		defer func() { r.mc.Reaped(qa.Name, qa.Repo, reason, err) }()
 		return r.es.DestroyExplicitly(ctx, qa, reason)
 	}
 	return nil
 }
 
+// destroyFailedOrStuckEnvironments destroys environments that have exceeded the max age of their reaper policy, or
+// have been in Failure, Spawned or Updating for longer than their policy allows
 func (r *Reaper) destroyFailedOrStuckEnvironments(ctx context.Context) error {
 	qas, err := r.dl.GetQAEnvironments(ctx)
 	if err != nil {
 		return fmt.Errorf("error getting QA environments: %v", err)
 	}
-	for _, qa := range qas {
+	now := time.Now().UTC()
+	for _, qa := range r.unplanned(qas) {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		qa := qa
+		if qa.IsPinned(now) || qa.Status == models.Destroyed {
+			continue
+		}
+		policy := r.policies.For(qa.Repo, qa.ReaperPolicy)
+		if policy.MaxAge > 0 && now.Sub(qa.Created) > policy.MaxAge {
+			if err := r.destroyIfLongerThan(ctx, &qa, "existed", qa.Created, policy.MaxAge, models.ReapMaxAge); err != nil {
+				r.logger.Printf("error destroying environment exceeding max age: %v", err)
+			}
+			continue
+		}
+		desc := "in state " + qa.Status.String()
+		// the time the environment entered its status: new environments are created in Spawned, but the time any other
+		// status was entered is only known if the transition was recorded, otherwise the environment is skipped
+		since, ok := markedSince(qa, qa.Status)
+		if !ok {
+			if qa.Status != models.Spawned {
+				continue
+			}
+			since = qa.Created
+		}
 		switch qa.Status {
 		case models.Spawned:
-			err = r.destroyIfOlderThan(ctx, &qa, spawnedMaxDurationSecs*time.Second, models.ReapAgeSpawned)
+			err = r.destroyIfLongerThan(ctx, &qa, desc, since, policy.MaxBuilding, models.ReapAgeSpawned)
+		case models.Updating:
+			err = r.destroyIfLongerThan(ctx, &qa, desc, since, policy.MaxBuilding, models.ReapAgeUpdating)
 		case models.Failure:
-			err = r.destroyIfOlderThan(ctx, &qa, failedMaxDurationSecs*time.Second, models.ReapAgeFailure)
+			err = r.destroyIfLongerThan(ctx, &qa, desc, since, policy.MaxFailure, models.ReapAgeFailure)
 		default:
 			continue
 		}
@@ -229,15 +361,23 @@ func (r *Reaper) enforceGlobalLimit(ctx context.Context) error {
 	if err != nil {
 		return fmt.Errorf("error getting running environments: %v", err)
 	}
+	// pinned environments are neither counted nor destroyed
+	qae = models.UnpinnedQAEnvironments(r.unplanned(qae), time.Now().UTC())
 	if len(qae) > int(r.globalLimit) {
 		kc := len(qae) - int(r.globalLimit)
 		sort.Slice(qae, func(i int, j int) bool { return qae[i].Created.Before(qae[j].Created) })
 		kenvs := qae[0:kc]
 		r.logger.Printf("reaper: enforcing global limit: extant: %v, limit: %v, destroying: %v", len(qae), r.globalLimit, kc)
 		for _, e := range kenvs {
+			if err := ctx.Err(); err != nil {
+				return err
+			}
 			env := e
+			if r.skipDryRun(&env, models.ReapActionDestroy, models.ReapEnvironmentLimitExceeded.String(), fmt.Sprintf("one of the %v oldest of %v running environments, exceeding the global limit (%v)", kc, len(qae), r.globalLimit)) {
+				continue
+			}
 			r.logger.Printf("reaper: destroying: %v (created %v)", env.Name, env.Created)
-			err := r.es.DestroyExplicitly(context.Background(), &env, models.ReapEnvironmentLimitExceeded)
+			err := r.es.DestroyExplicitly(ctx, &env, models.ReapEnvironmentLimitExceeded)
 			if err != nil {
 				r.logger.Printf("error destroying environment for exceeding limit: %v", err)
 			}
@@ -0,0 +1,212 @@
+package reap
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"reflect"
+	"sort"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/dollarshaveclub/acyl/pkg/ghclient"
+	"github.com/dollarshaveclub/acyl/pkg/metrics"
+	"github.com/dollarshaveclub/acyl/pkg/models"
+	"github.com/dollarshaveclub/acyl/pkg/persistence"
+	"github.com/dollarshaveclub/acyl/pkg/spawner"
+)
+
+// fakeDestroyer records the environments destroyed by the reaper
+type fakeDestroyer struct {
+	sync.Mutex
+	destroyed []string
+}
+
+func (fd *fakeDestroyer) names() []string {
+	fd.Lock()
+	defer fd.Unlock()
+	out := append([]string{}, fd.destroyed...)
+	sort.Strings(out)
+	return out
+}
+
+func newTestReaper(dl persistence.DataLayer, rc ghclient.RepoClient, globalLimit uint, policies models.ReaperPolicies) (*Reaper, *fakeDestroyer) {
+	fd := &fakeDestroyer{}
+	es := &spawner.FakeEnvironmentSpawner{
+		DestroyExplicitlyFunc: func(ctx context.Context, env *models.QAEnvironment, reason models.QADestroyReason) error {
+			fd.Lock()
+			fd.destroyed = append(fd.destroyed, env.Name)
+			fd.Unlock()
+			return nil
+		},
+	}
+	if rc == nil {
+		rc = &ghclient.FakeRepoClient{}
+	}
+	return NewReaper(nil, dl, es, rc, &metrics.FakeCollector{}, globalLimit, time.Hour, HibernationPolicy{}, policies, log.New(ioutil.Discard, "", log.LstdFlags), 0), fd
+}
+
+// markedEvents returns the events recorded when an environment is marked as status at ts
+func markedEvents(status models.EnvironmentStatus, ts time.Time) []models.QAEnvironmentEvent {
+	return []models.QAEnvironmentEvent{{Timestamp: ts, Message: fmt.Sprintf("Marked as %v", status.String())}}
+}
+
+func createEnvs(t *testing.T, dl persistence.DataLayer, qas []models.QAEnvironment) {
+	for i := range qas {
+		if err := dl.CreateQAEnvironment(context.Background(), &qas[i]); err != nil {
+			t.Fatalf("error creating env: %v", err)
+		}
+	}
+}
+
+func TestReaperPolicyOverride(t *testing.T) {
+	now := time.Now().UTC()
+	failed := markedEvents(models.Failure, now.Add(-2*time.Hour))
+	dl := persistence.NewFakeDataLayer()
+	createEnvs(t, dl, []models.QAEnvironment{
+		{Name: "default", Repo: "acme/api", PullRequest: 1, Status: models.Failure, Created: now.Add(-3 * time.Hour), Events: failed},
+		{Name: "repo-policy", Repo: "acme/slow", PullRequest: 1, Status: models.Failure, Created: now.Add(-3 * time.Hour), Events: failed},
+		{Name: "override", Repo: "acme/slow", PullRequest: 2, Status: models.Failure, Created: now.Add(-3 * time.Hour), Events: failed, ReaperPolicy: models.ReaperPolicy{MaxFailure: 30 * time.Minute}},
+		{Name: "override-bounded", Repo: "acme/api", PullRequest: 2, Status: models.Failure, Created: now.Add(-3 * time.Hour), Events: failed, ReaperPolicy: models.ReaperPolicy{MaxFailure: 24 * time.Hour}},
+		{Name: "max-age", Repo: "acme/api", PullRequest: 3, Status: models.Success, Created: now.Add(-3 * time.Hour), ReaperPolicy: models.ReaperPolicy{MaxAge: 2 * time.Hour}},
+	})
+	policies := models.ReaperPolicies{
+		Default: models.ReaperPolicy{MaxFailure: time.Hour},
+		Repos:   map[string]models.ReaperPolicy{"acme/slow": {MaxFailure: 4 * time.Hour}},
+		Max:     models.ReaperPolicy{MaxFailure: 90 * time.Minute},
+	}
+	r, fd := newTestReaper(dl, nil, 0, policies)
+	if err := r.destroyFailedOrStuckEnvironments(context.Background()); err != nil {
+		t.Fatalf("should have succeeded: %v", err)
+	}
+	if want := []string{"default", "max-age", "override", "override-bounded"}; !reflect.DeepEqual(fd.names(), want) {
+		t.Fatalf("unexpected destroyed envs: %v (wanted %v)", fd.names(), want)
+	}
+}
+
+func TestReaperUnknownTransitionTime(t *testing.T) {
+	now := time.Now().UTC()
+	dl := persistence.NewFakeDataLayer()
+	createEnvs(t, dl, []models.QAEnvironment{
+		{Name: "failure-unknown", Repo: "acme/api", PullRequest: 1, Status: models.Failure, Created: now.Add(-48 * time.Hour)},
+		{Name: "updating-unknown", Repo: "acme/api", PullRequest: 2, Status: models.Updating, Created: now.Add(-48 * time.Hour)},
+		{Name: "updating-other-status", Repo: "acme/api", PullRequest: 3, Status: models.Updating, Created: now.Add(-48 * time.Hour), Events: markedEvents(models.Failure, now.Add(-24*time.Hour))},
+		{Name: "updating-recent", Repo: "acme/api", PullRequest: 4, Status: models.Updating, Created: now.Add(-48 * time.Hour), Events: markedEvents(models.Updating, now.Add(-time.Minute))},
+		{Name: "spawned-unknown", Repo: "acme/api", PullRequest: 5, Status: models.Spawned, Created: now.Add(-48 * time.Hour)},
+	})
+	r, fd := newTestReaper(dl, nil, 0, models.ReaperPolicies{})
+	if err := r.destroyFailedOrStuckEnvironments(context.Background()); err != nil {
+		t.Fatalf("should have succeeded: %v", err)
+	}
+	// environments are created in Spawned, so only spawned environments fall back to the creation time
+	if want := []string{"spawned-unknown"}; !reflect.DeepEqual(fd.names(), want) {
+		t.Fatalf("unexpected destroyed envs: %v (wanted %v)", fd.names(), want)
+	}
+}
+
+func TestReaperSkipPinned(t *testing.T) {
+	now := time.Now().UTC()
+	past, future := now.Add(-time.Hour), now.Add(time.Hour)
+	expired := now.Add(-time.Minute)
+	failed := markedEvents(models.Failure, now.Add(-2*time.Hour))
+	dl := persistence.NewFakeDataLayer()
+	createEnvs(t, dl, []models.QAEnvironment{
+		{Name: "failed-pinned", Repo: "acme/api", PullRequest: 1, Status: models.Failure, Created: now.Add(-3 * time.Hour), Events: failed, Pinned: true},
+		{Name: "failed-pin-expired", Repo: "acme/api", PullRequest: 2, Status: models.Failure, Created: now.Add(-3 * time.Hour), Events: failed, Pinned: true, PinnedUntil: &past},
+		{Name: "expired-pinned", Repo: "acme/api", PullRequest: 3, Status: models.Success, Created: now.Add(-3 * time.Hour), ExpiresAt: &expired, Pinned: true, PinnedUntil: &future},
+		{Name: "expired", Repo: "acme/api", PullRequest: 4, Status: models.Success, Created: now.Add(-3 * time.Hour), ExpiresAt: &expired},
+		{Name: "oldest-pinned", Repo: "acme/api", PullRequest: 5, Status: models.Success, Created: now.Add(-5 * time.Hour), Pinned: true},
+		{Name: "older", Repo: "acme/api", PullRequest: 6, Status: models.Success, Created: now.Add(-4 * time.Hour)},
+		{Name: "newer", Repo: "acme/api", PullRequest: 7, Status: models.Success, Created: now.Add(-time.Hour)},
+	})
+	ctx := context.Background()
+
+	r, fd := newTestReaper(dl, nil, 0, models.ReaperPolicies{})
+	if err := r.destroyFailedOrStuckEnvironments(ctx); err != nil {
+		t.Fatalf("failed/stuck should have succeeded: %v", err)
+	}
+	if want := []string{"failed-pin-expired"}; !reflect.DeepEqual(fd.names(), want) {
+		t.Fatalf("unexpected destroyed failed envs: %v (wanted %v)", fd.names(), want)
+	}
+
+	r, fd = newTestReaper(dl, nil, 0, models.ReaperPolicies{})
+	if err := r.expireEnvironments(ctx); err != nil {
+		t.Fatalf("expire should have succeeded: %v", err)
+	}
+	if want := []string{"expired"}; !reflect.DeepEqual(fd.names(), want) {
+		t.Fatalf("unexpected destroyed expired envs: %v (wanted %v)", fd.names(), want)
+	}
+
+	// of the running environments, the three unpinned ones count towards the limit
+	r, fd = newTestReaper(dl, nil, 1, models.ReaperPolicies{})
+	if err := r.enforceGlobalLimit(ctx); err != nil {
+		t.Fatalf("global limit should have succeeded: %v", err)
+	}
+	if want := []string{"expired", "older"}; !reflect.DeepEqual(fd.names(), want) {
+		t.Fatalf("unexpected destroyed envs over the global limit: %v (wanted %v)", fd.names(), want)
+	}
+}
+
+func TestReaperDryRun(t *testing.T) {
+	now := time.Now().UTC()
+	expired := now.Add(-time.Minute)
+	qas := []models.QAEnvironment{
+		{Name: "destroyed", Repo: "acme/api", PullRequest: 1, Status: models.Destroyed, Created: now.Add(-60 * 24 * time.Hour), Events: markedEvents(models.Destroyed, now.Add(-45*24*time.Hour))},
+		{Name: "destroyed-recent", Repo: "acme/api", PullRequest: 2, Status: models.Destroyed, Created: now.Add(-2 * time.Hour), Events: markedEvents(models.Destroyed, now.Add(-time.Hour))},
+		{Name: "failed", Repo: "acme/api", PullRequest: 3, Status: models.Failure, Created: now.Add(-3 * time.Hour), Events: markedEvents(models.Failure, now.Add(-2*time.Hour))},
+		{Name: "closed", Repo: "acme/api", PullRequest: 4, Status: models.Success, Created: now.Add(-3 * time.Hour)},
+		{Name: "expired", Repo: "acme/api", PullRequest: 5, Status: models.Success, Created: now.Add(-2 * time.Hour), ExpiresAt: &expired},
+		{Name: "limit", Repo: "acme/api", PullRequest: 6, Status: models.Success, Created: now.Add(-time.Hour)},
+		{Name: "running", Repo: "acme/api", PullRequest: 7, Status: models.Success, Created: now.Add(-time.Minute)},
+	}
+	dl := persistence.NewFakeDataLayer()
+	createEnvs(t, dl, qas)
+	rc := &ghclient.FakeRepoClient{
+		GetPRStatusFunc: func(ctx context.Context, repo string, pr uint) (string, error) {
+			if pr == 4 {
+				return "closed", nil
+			}
+			return "open", nil
+		},
+	}
+	r, fd := newTestReaper(dl, rc, 1, models.ReaperPolicies{})
+	actions, err := r.DryRun(context.Background())
+	if err != nil {
+		t.Fatalf("should have succeeded: %v", err)
+	}
+	if len(fd.names()) != 0 {
+		t.Fatalf("dry run should not have destroyed anything: %v", fd.names())
+	}
+	for _, qa := range qas {
+		qa2, err := dl.GetQAEnvironment(context.Background(), qa.Name)
+		if err != nil || qa2 == nil {
+			t.Fatalf("dry run should not have deleted %v: %v", qa.Name, err)
+		}
+		if qa2.Status != qa.Status {
+			t.Fatalf("dry run should not have changed the status of %v: %v", qa.Name, qa2.Status)
+		}
+	}
+	got := map[string]string{}
+	for _, a := range actions {
+		if _, ok := got[a.EnvName]; ok {
+			t.Fatalf("more than one action for %v", a.EnvName)
+		}
+		got[a.EnvName] = a.Action + ":" + a.Reason
+	}
+	want := map[string]string{
+		"destroyed": models.ReapActionPrune + ":",
+		"failed":    models.ReapActionDestroy + ":" + models.ReapAgeFailure.String(),
+		"closed":    models.ReapActionDestroy + ":" + models.ReapPrClosed.String(),
+		"expired":   models.ReapActionDestroy + ":" + models.ReapExpired.String(),
+		// the environments planned to be destroyed by previous steps don't count towards the global limit
+		"limit": models.ReapActionDestroy + ":" + models.ReapEnvironmentLimitExceeded.String(),
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("unexpected actions: %v (wanted %v)", got, want)
+	}
+	if r.dryRun || r.actions != nil {
+		t.Fatalf("dry run should not have modified the reaper")
+	}
+}
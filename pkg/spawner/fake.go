@@ -2,24 +2,46 @@ package spawner
 
 import (
 	"context"
+	"time"
 
 	"github.com/dollarshaveclub/acyl/pkg/models"
+	"github.com/google/uuid"
 )
 
 var _ EnvironmentSpawner = &FakeEnvironmentSpawner{}
 
 type FakeEnvironmentSpawner struct {
 	CreateFunc            func(ctx context.Context, rd models.RepoRevisionData) (string, error)
+	PrepareManualFunc     func(ctx context.Context, rd *models.RepoRevisionData) error
+	PrepareCloneFunc      func(ctx context.Context, source string, rd *models.RepoRevisionData) error
 	UpdateFunc            func(ctx context.Context, rd models.RepoRevisionData) (string, error)
 	DestroyFunc           func(ctx context.Context, rd models.RepoRevisionData, reason models.QADestroyReason) error
 	DestroyExplicitlyFunc func(ctx context.Context, env *models.QAEnvironment, reason models.QADestroyReason) error
 	SuccessFunc           func(ctx context.Context, name string) error
 	FailureFunc           func(ctx context.Context, name, msg string) error
+	HibernateFunc         func(ctx context.Context, name string) error
+	WakeFunc              func(ctx context.Context, name string) error
+	ExtendExpirationFunc  func(ctx context.Context, name string, d time.Duration) (time.Time, error)
+	WarnExpirationFunc    func(ctx context.Context, name string) error
+	PinFunc               func(ctx context.Context, name, reason string, until *time.Time) error
+	UnpinFunc             func(ctx context.Context, name string) error
+	ProcessQueueFunc      func(ctx context.Context) error
+	RollbackFunc          func(ctx context.Context, name string, revision int64) error
+	PlanFunc              func(ctx context.Context, rd models.RepoRevisionData) (*models.EnvironmentPlan, error)
+	RetryFailedFunc       func(ctx context.Context, name string) error
+	CancelFunc            func(ctx context.Context, name string, eventID uuid.UUID, reason string) error
+	CancelQueuedFunc      func(ctx context.Context, eventID uuid.UUID, reason string) (*models.QueuedOperation, error)
 }
 
 func (fes *FakeEnvironmentSpawner) Create(ctx context.Context, rd models.RepoRevisionData) (string, error) {
 	return fes.CreateFunc(ctx, rd)
 }
+func (fes *FakeEnvironmentSpawner) PrepareManual(ctx context.Context, rd *models.RepoRevisionData) error {
+	return fes.PrepareManualFunc(ctx, rd)
+}
+func (fes *FakeEnvironmentSpawner) PrepareClone(ctx context.Context, source string, rd *models.RepoRevisionData) error {
+	return fes.PrepareCloneFunc(ctx, source, rd)
+}
 func (fes *FakeEnvironmentSpawner) Update(ctx context.Context, rd models.RepoRevisionData) (string, error) {
 	return fes.UpdateFunc(ctx, rd)
 }
@@ -35,3 +57,42 @@ func (fes *FakeEnvironmentSpawner) Success(ctx context.Context, name string) err
 func (fes *FakeEnvironmentSpawner) Failure(ctx context.Context, name, msg string) error {
 	return fes.FailureFunc(ctx, name, msg)
 }
+func (fes *FakeEnvironmentSpawner) Hibernate(ctx context.Context, name string) error {
+	return fes.HibernateFunc(ctx, name)
+}
+func (fes *FakeEnvironmentSpawner) Wake(ctx context.Context, name string) error {
+	return fes.WakeFunc(ctx, name)
+}
+func (fes *FakeEnvironmentSpawner) ExtendExpiration(ctx context.Context, name string, d time.Duration) (time.Time, error) {
+	return fes.ExtendExpirationFunc(ctx, name, d)
+}
+func (fes *FakeEnvironmentSpawner) WarnExpiration(ctx context.Context, name string) error {
+	return fes.WarnExpirationFunc(ctx, name)
+}
+func (fes *FakeEnvironmentSpawner) Pin(ctx context.Context, name, reason string, until *time.Time) error {
+	return fes.PinFunc(ctx, name, reason, until)
+}
+func (fes *FakeEnvironmentSpawner) Unpin(ctx context.Context, name string) error {
+	return fes.UnpinFunc(ctx, name)
+}
+func (fes *FakeEnvironmentSpawner) ProcessQueue(ctx context.Context) error {
+	if fes.ProcessQueueFunc == nil {
+		return nil
+	}
+	return fes.ProcessQueueFunc(ctx)
+}
+func (fes *FakeEnvironmentSpawner) Rollback(ctx context.Context, name string, revision int64) error {
+	return fes.RollbackFunc(ctx, name, revision)
+}
+func (fes *FakeEnvironmentSpawner) Plan(ctx context.Context, rd models.RepoRevisionData) (*models.EnvironmentPlan, error) {
+	return fes.PlanFunc(ctx, rd)
+}
+func (fes *FakeEnvironmentSpawner) RetryFailed(ctx context.Context, name string) error {
+	return fes.RetryFailedFunc(ctx, name)
+}
+func (fes *FakeEnvironmentSpawner) Cancel(ctx context.Context, name string, eventID uuid.UUID, reason string) error {
+	return fes.CancelFunc(ctx, name, eventID, reason)
+}
+func (fes *FakeEnvironmentSpawner) CancelQueued(ctx context.Context, eventID uuid.UUID, reason string) (*models.QueuedOperation, error) {
+	return fes.CancelQueuedFunc(ctx, eventID, reason)
+}
@@ -1,16 +1,33 @@
 package spawner
 
 import (
+	"time"
+
 	"github.com/dollarshaveclub/acyl/pkg/models"
+	"github.com/google/uuid"
 	"golang.org/x/net/context"
 )
 
 // EnvironmentSpawner describes an object capable of managing environments
 type EnvironmentSpawner interface {
 	Create(context.Context, models.RepoRevisionData) (string, error)
+	PrepareManual(context.Context, *models.RepoRevisionData) error
+	PrepareClone(ctx context.Context, source string, rd *models.RepoRevisionData) error
 	Update(context.Context, models.RepoRevisionData) (string, error)
 	Destroy(context.Context, models.RepoRevisionData, models.QADestroyReason) error
 	DestroyExplicitly(context.Context, *models.QAEnvironment, models.QADestroyReason) error
 	Success(context.Context, string) error
 	Failure(context.Context, string, string) error
+	Hibernate(context.Context, string) error
+	Wake(context.Context, string) error
+	ExtendExpiration(context.Context, string, time.Duration) (time.Time, error)
+	WarnExpiration(context.Context, string) error
+	Pin(ctx context.Context, name, reason string, until *time.Time) error
+	Unpin(context.Context, string) error
+	ProcessQueue(context.Context) error
+	Rollback(ctx context.Context, name string, revision int64) error
+	Plan(context.Context, models.RepoRevisionData) (*models.EnvironmentPlan, error)
+	RetryFailed(ctx context.Context, name string) error
+	Cancel(ctx context.Context, name string, eventID uuid.UUID, reason string) error
+	CancelQueued(ctx context.Context, eventID uuid.UUID, reason string) (*models.QueuedOperation, error)
 }
@@ -35,6 +35,14 @@ function renderDetailTable(env) {
             envstatlabel = "Pending";
             envstatclasses = "badge badge-warning";
             break;
+        case "hibernated":
+            envstatlabel = "Hibernated";
+            envstatclasses = "badge badge-info";
+            break;
+        case "queued":
+            envstatlabel = "Queued";
+            envstatclasses = "badge badge-light";
+            break;
         case "destroyed":
             envstatlabel = "Destroyed";
             envstatclasses = "badge badge-secondary";
@@ -46,10 +54,37 @@ function renderDetailTable(env) {
     }
     document.getElementById("status-badge").innerHTML = envstatlabel;
     document.getElementById("status-badge").className = envstatclasses;
+    if (document.getElementById("actionsHibernate") !== null) {
+        document.getElementById("actionsHibernate").disabled = env.status !== "success";
+        document.getElementById("actionsWake").disabled = env.status !== "hibernated";
+        document.getElementById("actionsExtend").disabled = !env.expires_at || env.status === "destroyed";
+        document.getElementById("actionsPin").disabled = env.pinned || env.status === "destroyed";
+        document.getElementById("actionsUnpin").disabled = !env.pinned;
+        document.getElementById("actionsDestroy").disabled = env.status === "destroyed";
+        document.getElementById("actionsRollback").disabled = !["success", "failure", "hibernated"].includes(env.status);
+        document.getElementById("actionsRetry").disabled = env.status !== "failure";
+    }
+    document.getElementById("pinned-badge").classList.toggle("d-none", !env.pinned);
     document.getElementById("env-repo").innerHTML = `<a href="https://github.com/${env.repo}">https://github.com/${env.repo}</a>`;
-    document.getElementById("env-pr-link").innerHTML = `<a href="https://github.com/${env.repo}/pull/${env.pull_request}">https://github.com/${env.repo}/pull/${env.pull_request}</a>`;
+    if (env.pull_request === 0) {
+        document.getElementById("env-pr-link").innerHTML = "None (manual environment)";
+    } else {
+        document.getElementById("env-pr-link").innerHTML = `<a href="https://github.com/${env.repo}/pull/${env.pull_request}">https://github.com/${env.repo}/pull/${env.pull_request}</a>`;
+    }
     document.getElementById("env-user-link").innerHTML = `<a href="https://github.com/${env.github_user}">${env.github_user}</a>`;
     document.getElementById("trepo-branch").innerHTML = env.pr_head_branch;
+    document.getElementById("env-expires").innerHTML = env.expires_at ? new Date(env.expires_at).toLocaleString() : "Never";
+    let pinned = "No";
+    if (env.pinned) {
+        pinned = "Yes";
+        if (env.pin_reason) {
+            pinned += `: ${env.pin_reason}`;
+        }
+        if (env.pinned_until) {
+            pinned += ` (until ${new Date(env.pinned_until).toLocaleString()})`;
+        }
+    }
+    document.getElementById("env-pinned").textContent = pinned;
     updateNSCopyBtn(env.k8s_namespace);
 }
 
@@ -113,6 +148,10 @@ function eventrow(event) {
             tr.className = "table-light";
             tdstatus.innerHTML = `<span class="badge badge-dark">Cancelled</span>`;
             break;
+        case "coalesced":
+            tr.className = "table-light";
+            tdstatus.innerHTML = `<span class="badge badge-light">Coalesced</span>`;
+            break;
         default:
             tr.className = "table-active";
             tdstatus.innerHTML = `<span class="badge badge-secondary">Unknown</span>`;
@@ -144,6 +183,166 @@ function renderEnvDetail(env) {
     renderEventList(env.events);
 }
 
+// maximum number of tailed log lines kept in the DOM
+const maxTailedPodLogLines = 5000;
+const podLogTailLines = 100;
+let podLogTailStream = null;
+let podLogTailPod = "";
+
+function stopPodLogTail() {
+    if (podLogTailStream !== null) {
+        podLogTailStream.close();
+        podLogTailStream = null;
+    }
+    document.getElementById("podLogTailStop").disabled = true;
+}
+
+// tailPodLogs follows the logs of all containers in the pod via Server-Sent Events
+function tailPodLogs(pod) {
+    stopPodLogTail();
+    podLogTailPod = pod;
+    const timestamps = document.getElementById("podLogTailTimestamps").checked;
+    const previous = document.getElementById("podLogTailPrevious").checked;
+    let logs = document.getElementById("podLogTail");
+    logs.innerText = "";
+    document.getElementById("podLogTailHeading").innerText = `Logs: ${pod}`;
+    document.getElementById("podLogTailStop").disabled = false;
+    podLogTailStream = new EventSource(`${apiBaseURL}/v2/userenvs/${envName}/namespace/pod/${pod}/logs/stream?lines=${podLogTailLines}&timestamps=${timestamps}&previous=${previous}`);
+    podLogTailStream.addEventListener("log", function (e) {
+        const data = JSON.parse(e.data);
+        let line = document.createElement("div");
+        line.innerText = `[${data.container}] ${data.line}`;
+        logs.appendChild(line);
+        while (logs.childElementCount > maxTailedPodLogLines) {
+            logs.removeChild(logs.firstChild);
+        }
+        logs.scrollTop = logs.scrollHeight;
+    });
+    podLogTailStream.addEventListener("stream_error", function (e) {
+        const data = JSON.parse(e.data);
+        console.error(`pod log stream error for container ${data.container}: ${data.error}`);
+    });
+    podLogTailStream.addEventListener("end", stopPodLogTail);
+    podLogTailStream.addEventListener("timeout", stopPodLogTail);
+    podLogTailStream.onerror = function (e) {
+        console.error(`error tailing pod logs for ${pod}`);
+        stopPodLogTail();
+    };
+}
+
+function podrow(pod) {
+    let tr = document.createElement("tr");
+    let tdname = document.createElement("td");
+    tdname.className = "text-left";
+    let a = document.createElement("a");
+    a.href = "#";
+    a.innerText = pod.name;
+    a.addEventListener('click', function (e) {
+        e.preventDefault();
+        tailPodLogs(pod.name);
+    });
+    tdname.appendChild(a);
+    tr.appendChild(tdname);
+    for (const v of [pod.ready, pod.status, pod.restarts, pod.age]) {
+        let td = document.createElement("td");
+        td.className = "text-left";
+        td.innerText = v;
+        tr.appendChild(td);
+    }
+    return tr;
+}
+
+function renderPodList(pods) {
+    let tbody = document.createElement("tbody");
+    for (let i = 0; i < pods.length; i++) {
+        tbody.appendChild(podrow(pods[i]));
+    }
+    let oldtbody = document.getElementById("podlist-tbody");
+    oldtbody.parentNode.replaceChild(tbody, oldtbody);
+    tbody.id = "podlist-tbody";
+}
+
+function updatePods() {
+    let req = new XMLHttpRequest();
+
+    req.open('GET', `${apiBaseURL}/v2/userenvs/${envName}/namespace/pods`, true);
+    req.onload = function (e) {
+        if (req.status !== 200) {
+            console.log(`namespace pods request failed: ${req.status}: ${req.responseText}`);
+            return;
+        }
+        renderPodList(JSON.parse(req.response));
+    };
+    req.onerror = function (e) {
+        console.error(`error getting namespace pods endpoint: ${req.statusText}`);
+    };
+    req.send(null);
+}
+
+// resourceCell formats a resource field value for display
+function resourceCell(key, value) {
+    let td = document.createElement("td");
+    td.className = "text-left";
+    if (Array.isArray(value)) {
+        td.innerText = value.join(", ");
+    } else if (value === null) {
+        td.innerText = "";
+    } else if (key === "ready" || key === "type" && value === "Warning") {
+        const ok = value === true;
+        td.innerHTML = `<span class="badge ${ok ? "badge-success" : "badge-warning"}">${value}</span>`;
+    } else {
+        td.innerText = value;
+    }
+    return td;
+}
+
+// renderResourceList renders a table of namespace resources, using the keys of the first object as column headings
+function renderResourceList(resources) {
+    let thead = document.createElement("thead");
+    let tbody = document.createElement("tbody");
+    if (resources.length > 0) {
+        const keys = Object.keys(resources[0]);
+        let trHeading = document.createElement("tr");
+        for (const k of keys) {
+            let th = document.createElement("th");
+            th.scope = "col";
+            th.innerText = k.replace(/_/g, " ");
+            trHeading.appendChild(th);
+        }
+        thead.appendChild(trHeading);
+        for (const r of resources) {
+            let tr = document.createElement("tr");
+            for (const k of keys) {
+                tr.appendChild(resourceCell(k, r[k]));
+            }
+            tbody.appendChild(tr);
+        }
+    }
+    for (const [el, id] of [[thead, "resourcelist-thead"], [tbody, "resourcelist-tbody"]]) {
+        let old = document.getElementById(id);
+        old.parentNode.replaceChild(el, old);
+        el.id = id;
+    }
+}
+
+function updateResources() {
+    let req = new XMLHttpRequest();
+    const kind = document.getElementById("resourceKindMenu").value;
+
+    req.open('GET', `${apiBaseURL}/v2/userenvs/${envName}/namespace/${kind}`, true);
+    req.onload = function (e) {
+        if (req.status !== 200) {
+            console.log(`namespace ${kind} request failed: ${req.status}: ${req.responseText}`);
+            return;
+        }
+        renderResourceList(JSON.parse(req.response));
+    };
+    req.onerror = function (e) {
+        console.error(`error getting namespace ${kind} endpoint: ${req.statusText}`);
+    };
+    req.send(null);
+}
+
 function update() {
     let req = new XMLHttpRequest();
 
@@ -161,6 +360,8 @@ function update() {
         console.error(`error getting env detail endpoint: ${req.statusText}`);
     };
     req.send(null);
+    updateResources();
+    updatePods();
 }
 
 document.addEventListener("DOMContentLoaded", function(){
@@ -186,6 +387,83 @@ document.addEventListener("DOMContentLoaded", function(){
             });
         });
     }
+    for (const action of ["hibernate", "wake", "retry"]) {
+        const btn = document.getElementById(`actions${action.charAt(0).toUpperCase()}${action.slice(1)}`);
+        if (btn !== null) {
+            btn.addEventListener('click', function (e) {
+                e.preventDefault();
+                envAction(action);
+                update();
+            });
+        }
+    }
+    if (document.getElementById("actionsExtend") !== null) {
+        document.getElementById("actionsExtend").addEventListener('click', function (e) {
+            e.preventDefault();
+            extendExpiration("24h");
+            update();
+        });
+    }
+    if (document.getElementById("actionsPin") !== null) {
+        document.getElementById("actionsPin").addEventListener('click', function (e) {
+            e.preventDefault();
+            const reason = window.prompt("Reason for pinning this environment (optional):", "");
+            if (reason === null) {
+                return;
+            }
+            setPin(true, reason);
+            update();
+        });
+        document.getElementById("actionsUnpin").addEventListener('click', function (e) {
+            e.preventDefault();
+            setPin(false);
+            update();
+        });
+    }
+    if (document.getElementById("actionsRollback") !== null) {
+        document.getElementById("actionsRollback").addEventListener('click', function (e) {
+            e.preventDefault();
+            if (!window.confirm(`Roll back environment ${envName} to its previous successful revision?`)) {
+                return;
+            }
+            envAction("rollback");
+            update();
+        });
+    }
+    if (document.getElementById("actionsClone") !== null) {
+        document.getElementById("actionsClone").addEventListener('click', function (e) {
+            e.preventDefault();
+            const overrides = window.prompt("Clone this environment with the same branches and commits. Optionally use different branches for some repos (owner/name=branch, comma separated):", "");
+            if (overrides === null) {
+                return;
+            }
+            cloneEnv(overrides);
+        });
+    }
+    if (document.getElementById("actionsDestroy") !== null) {
+        document.getElementById("actionsDestroy").addEventListener('click', function (e) {
+            e.preventDefault();
+            if (!window.confirm(`Destroy environment ${envName}?`)) {
+                return;
+            }
+            envAction("destroy");
+            update();
+        });
+    }
+    document.getElementById("resourceKindMenu").addEventListener('change', function (e) {
+        updateResources();
+    });
+    document.getElementById("podLogTailStop").addEventListener('click', function (e) {
+        e.preventDefault();
+        stopPodLogTail();
+    });
+    for (const id of ["podLogTailTimestamps", "podLogTailPrevious"]) {
+        document.getElementById(id).addEventListener('change', function (e) {
+            if (podLogTailPod !== "") {
+                tailPodLogs(podLogTailPod);
+            }
+        });
+    }
     update();
 });
 
@@ -206,3 +484,88 @@ function rebuild(fullRebuild = false) {
     };
     req.send(null);
 }
+
+function envAction(action) {
+    let req = new XMLHttpRequest();
+    req.open('POST', `${apiBaseURL}/v2/userenvs/${envName}/actions/${action}`, false);
+    req.onload = function () {
+        if (req.status !== 201) {
+            console.log(`env ${action} request failed: ${req.status}: ${req.responseText}`);
+            if (action === "rollback" && req.status === 409) {
+                window.alert("Unable to roll back environment (there may be no previous successful revision)");
+            }
+            if (action === "retry" && req.status === 409) {
+                window.alert("Only failed environments can be retried");
+            }
+        }
+    };
+    req.onerror = function () {
+        console.error(`error performing ${action} on environment: ${req.statusText}`);
+    };
+    req.send(null);
+}
+
+function extendExpiration(duration) {
+    let req = new XMLHttpRequest();
+    req.open('POST', `${apiBaseURL}/v2/userenvs/${envName}/actions/extend?duration=${duration}`, false);
+    req.onload = function () {
+        if (req.status !== 200) {
+            console.log(`env extend request failed: ${req.status}: ${req.responseText}`);
+        }
+    };
+    req.onerror = function () {
+        console.error(`error extending environment expiration: ${req.statusText}`);
+    };
+    req.send(null);
+}
+
+function setPin(pin, reason = "") {
+    let req = new XMLHttpRequest();
+    let action = pin ? "pin" : "unpin";
+    req.open('POST', `${apiBaseURL}/v2/userenvs/${envName}/actions/${action}?reason=${encodeURIComponent(reason)}`, false);
+    req.onload = function () {
+        if (req.status !== 200) {
+            console.log(`env ${action} request failed: ${req.status}: ${req.responseText}`);
+            if (req.status === 409) {
+                window.alert(`Unable to ${action} environment (the repo may already have the maximum number of pinned environments)`);
+            }
+        }
+    };
+    req.onerror = function () {
+        console.error(`error performing ${action} on environment: ${req.statusText}`);
+    };
+    req.send(null);
+}
+
+// cloneEnv creates a copy of the environment with optional ref overrides (comma separated owner/name=branch) and navigates to it
+function cloneEnv(overrides) {
+    let body = {ref_overrides: {}};
+    for (const o of overrides.split(",")) {
+        const l = o.trim();
+        if (l === "") {
+            continue;
+        }
+        const i = l.lastIndexOf("=");
+        if (i <= 0) {
+            window.alert(`Malformed override (expected owner/name=branch): ${l}`);
+            return;
+        }
+        body.ref_overrides[l.slice(0, i).trim()] = l.slice(i + 1).trim();
+    }
+    let req = new XMLHttpRequest();
+    req.open('POST', `${apiBaseURL}/v2/userenvs/${envName}/actions/clone`, true);
+    req.setRequestHeader("Content-Type", "application/json");
+    req.onload = function () {
+        if (req.status !== 201) {
+            console.log(`env clone request failed: ${req.status}: ${req.responseText}`);
+            window.alert(req.status === 400 ? `Unable to clone environment: ${req.responseText}` : `Error cloning environment (${req.status})`);
+            return;
+        }
+        const data = JSON.parse(req.response);
+        window.location.href = `${apiBaseURL}/ui/env/${data.env_name}`;
+    };
+    req.onerror = function () {
+        console.error(`error cloning environment: ${req.statusText}`);
+    };
+    req.send(JSON.stringify(body));
+}
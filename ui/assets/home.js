@@ -18,7 +18,7 @@ function envrow(env) {
     tr.appendChild(tdrepo);
     let tdpr = document.createElement("td");
     tdpr.className = "text-left";
-    tdpr.innerHTML = env.pull_request;
+    tdpr.innerHTML = env.pull_request === 0 ? `<span class="badge badge-light">Manual</span>` : env.pull_request;
     tr.appendChild(tdpr);
     let tdname = document.createElement("td");
     tdname.className = "text-left";
@@ -44,6 +44,14 @@ function envrow(env) {
             tr.className = "table-warning";
             tdstatus.innerHTML = `<span class="badge badge-warning">Pending</span>`;
             break;
+        case "hibernated":
+            tr.className = "table-info";
+            tdstatus.innerHTML = `<span class="badge badge-info">Hibernated</span>`;
+            break;
+        case "queued":
+            tr.className = "table-warning";
+            tdstatus.innerHTML = `<span class="badge badge-light">Queued</span>`;
+            break;
         case "destroyed":
             tr.className = "table-active"; // "active" colors the row gray
             tdstatus.innerHTML = `<span class="badge badge-secondary">Destroyed</span>`;
@@ -53,6 +61,13 @@ function envrow(env) {
             tdstatus.innerHTML = `<span class="badge badge-secondary">Unknown</span>`;
             break;
     }
+    if (env.pinned) {
+        let pinned = document.createElement("span");
+        pinned.className = "badge badge-primary ml-1";
+        pinned.title = env.pin_reason;
+        pinned.textContent = "Pinned";
+        tdstatus.appendChild(pinned);
+    }
     return tr;
 }
 
@@ -143,8 +158,77 @@ function getallenvs() {
     return document.getElementById("envgroup").selectedIndex === 1;
 }
 
+// parseoverrides parses dependency branch overrides in "owner/name=branch" format, one per line
+function parseoverrides(text) {
+    let overrides = {};
+    for (const line of text.split("\n")) {
+        const l = line.trim();
+        if (l === "") {
+            continue;
+        }
+        const i = l.lastIndexOf("=");
+        if (i <= 0) {
+            throw `malformed override (expected owner/name=branch): ${l}`;
+        }
+        overrides[l.slice(0, i).trim()] = l.slice(i + 1).trim();
+    }
+    return overrides;
+}
+
+function newenverror(msg) {
+    let errdiv = document.getElementById("newenv-error");
+    errdiv.textContent = msg;
+    errdiv.classList.toggle("d-none", msg === "");
+}
+
+// createenv creates a manual environment and navigates to it
+function createenv() {
+    let body = {
+        repo: document.getElementById("newenv-repo").value.trim(),
+        ref: document.getElementById("newenv-ref").value.trim(),
+        ttl: document.getElementById("newenv-ttl").value.trim(),
+    };
+    try {
+        body.ref_overrides = parseoverrides(document.getElementById("newenv-overrides").value);
+    } catch (e) {
+        newenverror(e);
+        return;
+    }
+    let req = new XMLHttpRequest();
+    req.open('POST', `${apiBaseURL}/v2/userenvs`, true);
+    req.setRequestHeader("Content-Type", "application/json");
+    req.onload = function (e) {
+        if (req.status !== 201) {
+            console.log(`create env request failed: ${req.status}: ${req.responseText}`);
+            switch (req.status) {
+                case 400:
+                    newenverror(`Invalid request: ${req.responseText}`);
+                    break;
+                case 403:
+                    newenverror("You don't have write access to the repo");
+                    break;
+                default:
+                    newenverror(`Error creating environment (${req.status})`);
+                    break;
+            }
+            return;
+        }
+        newenverror("");
+        const data = JSON.parse(req.response);
+        window.location.href = `${apiBaseURL}/ui/env/${data.env_name}`;
+    };
+    req.onerror = function (e) {
+        console.error(`error creating environment: ${req.statusText}`);
+    };
+    req.send(JSON.stringify(body));
+}
+
 document.addEventListener("DOMContentLoaded", function(){
     getFormValues();
+    document.getElementById("newenv-form").addEventListener('submit', function(e){
+        e.preventDefault();
+        createenv();
+    });
     document.getElementById("refreshbtn").addEventListener('click', function(e){
         e.preventDefault();
         update(getallenvs(), gethistory(), getdestroyed());
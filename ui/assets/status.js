@@ -16,6 +16,9 @@ let env_name = "";
 let active_pod_name = "";
 let active_container = "";
 let pod_log_lines = 100;
+// maximum number of followed log lines kept in the DOM
+const maxFollowedPodLogLines = 5000;
+let pod_log_stream = null;
 
 // https://stackoverflow.com/questions/21294302/converting-milliseconds-to-minutes-and-seconds-with-javascript
 function millisToMinutesAndSeconds(millis) {
@@ -91,6 +94,11 @@ function updateConfig(cfg) {
         case "cancelled":
             slinkbtnclass = "btn-outline-light";
             sicon.innerHTML = "\uf05e";
+            break;
+        case "coalesced":
+            slinkbtnclass = "btn-outline-light";
+            sicon.innerHTML = "\uf101";
+            break;
         default:
             slinkbtnclass = "btn-warning";
             sicon.innerHTML = "";
@@ -112,6 +120,8 @@ function updateConfig(cfg) {
     document.getElementById("event-type").innerHTML = cfg.type;
     if (cfg.status === 'failed') {
         document.getElementById("event-status").innerHTML = `<span class="badge badge-danger acyl-status pl-2 pr-0 py-0" style="font-size: medium">${cfg.status} <a class="fas btn btn-sm btn-danger" title="View Chart Error" href="${apiBaseURL}/ui/event/status/failure_report?id=${event_id}" role="button">&#xf35d</a></span>`;
+    } else if (cfg.status === 'pending') {
+        document.getElementById("event-status").innerHTML = `${cfg.status} <button class="btn btn-sm btn-outline-danger ml-2 py-0" id="cancel-event-btn" type="button" onclick="cancelEvent()">Cancel</button>`;
     } else {
         document.getElementById("event-status").innerHTML = cfg.status;
     }
@@ -129,9 +139,53 @@ function updateConfig(cfg) {
 
     document.getElementById("event-elapsed").innerHTML = millisToMinutesAndSeconds(end - start);
     updateRefmap(cfg.ref_map);
+    updateRetries(cfg.retries);
     updateBreadcrumb(cfg);
 }
 
+// cancelEvent requests cancellation of the pending operation of the event
+function cancelEvent() {
+    if (!window.confirm("Cancel this operation? The environment will be left in the cancelled state.")) {
+        return;
+    }
+    let req = new XMLHttpRequest();
+    req.open('POST', `${apiBaseURL}/v2/event/${event_id}/cancel`, true);
+    req.onload = function () {
+        if (req.status !== 202) {
+            console.log(`cancel request failed: ${req.status}: ${req.responseText}`);
+            if (req.status === 409) {
+                window.alert("Only pending operations can be cancelled");
+            }
+            if (req.status === 403) {
+                window.alert("You must have write access to the repository to cancel this operation");
+            }
+            return;
+        }
+        document.getElementById("cancel-event-btn").disabled = true;
+    };
+    req.onerror = function () {
+        console.error(`error cancelling event: ${req.statusText}`);
+    };
+    req.send(null);
+}
+
+// updateRetries lists the failed attempts of the event that were automatically retried, if any
+function updateRetries(retries) {
+    if (!retries || retries.length === 0) {
+        return;
+    }
+    let container = document.getElementById("event-retries");
+    while (container.firstChild) {
+        container.removeChild(container.firstChild);
+    }
+    retries.forEach(function(retry) {
+        let div = document.createElement("div");
+        div.innerText = `attempt ${retry.attempt} failed at ${retry.failed} (retried after ${retry.backoff}): ${retry.error}`;
+        container.appendChild(div);
+    });
+    document.getElementById("event-retries-row").style.display = "";
+}
+
 let tree, svg, diagonal = null;
 
 function treeDimensions () {
@@ -559,6 +613,28 @@ function updateTree(treedata) {
 }
 
 
+// updateChartDiffs shows the rendered manifest changes of each upgraded release, if any
+function updateChartDiffs(treedata) {
+    const names = Object.keys(treedata).filter(name => treedata[name].chart.diff).sort();
+    if (names.length === 0) {
+        return;
+    }
+    let container = document.getElementById("chartDiffsContainer");
+    while (container.firstChild) {
+        container.removeChild(container.firstChild);
+    }
+    names.forEach(function(name) {
+        let heading = document.createElement("h6");
+        heading.innerText = name;
+        let pre = document.createElement("pre");
+        pre.className = "bg-dark text-light p-2";
+        pre.innerText = treedata[name].chart.diff;
+        container.appendChild(heading);
+        container.appendChild(pre);
+    });
+    document.getElementById("chartDiffsCard").style.display = "block";
+}
+
 function updateLogs(logs) {
     document.getElementById("logsContainer").innerHTML = logs.join("<br \>\n");
     let objDiv = document.getElementById("logsContainer");
@@ -647,30 +723,52 @@ function renderPodLogs(data) {
     setPodLogs(logs);
 }
 
-// getPodLogs gets and renders the logs for the specified parameters
-function getPodLogs(container) {
-    let req = new XMLHttpRequest();
+// podLogOptionsQuery returns the query string options selected in the pod log modal
+function podLogOptionsQuery() {
+    const follow = document.getElementById("podLogFollow").checked;
+    const timestamps = document.getElementById("podLogTimestamps").checked;
+    const previous = document.getElementById("podLogPrevious").checked;
+    return `container=${active_container}&lines=${pod_log_lines}&follow=${follow}&timestamps=${timestamps}&previous=${previous}`;
+}
+
+// stopPodLogStream closes any open pod log stream
+function stopPodLogStream() {
+    if (pod_log_stream !== null) {
+        pod_log_stream.close();
+        pod_log_stream = null;
+    }
+}
 
+// getPodLogs streams the logs for the specified parameters via Server-Sent Events, appending lines as they arrive
+// If follow is not selected the server closes the stream after returning the requested number of lines
+function getPodLogs(container) {
     if (container !== undefined) {
         active_container = container;
     }
-    req.open('GET', `${apiBaseURL}/v2/userenvs/${env_name}/namespace/pod/${active_pod_name}/logs?container=${active_container}&lines=${pod_log_lines}`, true);
-    req.onload = function (e) {
-        if (req.status !== 200) {
-            console.log(`pods logs request failed: ${req.status}: ${req.responseText}`);
-            return;
+    stopPodLogStream();
+    renderPodLogs("");
+    let logs = document.getElementById("podLogsBody");
+    pod_log_stream = new EventSource(`${apiBaseURL}/v2/userenvs/${env_name}/namespace/pod/${active_pod_name}/logs/stream?${podLogOptionsQuery()}`);
+    pod_log_stream.addEventListener("log", function (e) {
+        const data = JSON.parse(e.data);
+        let line = document.createElement("div");
+        line.innerText = data.line;
+        logs.appendChild(line);
+        while (logs.childElementCount > maxFollowedPodLogLines) {
+            logs.removeChild(logs.firstChild);
         }
-
-        let data = req.response;
-        if (data !== null) {
-            renderPodLogs(data);
-        }
-    };
-    req.onerror = function (e) {
-        console.error(`error getting pod logs endpoint for ${env_name}: ${req.statusText}`);
+        logs.parentNode.scrollTop = logs.parentNode.scrollHeight;
+    });
+    pod_log_stream.addEventListener("stream_error", function (e) {
+        const data = JSON.parse(e.data);
+        console.error(`pod log stream error for container ${data.container}: ${data.error}`);
+    });
+    pod_log_stream.addEventListener("end", stopPodLogStream);
+    pod_log_stream.addEventListener("timeout", stopPodLogStream);
+    pod_log_stream.onerror = function (e) {
+        console.error(`error streaming pod logs for ${env_name}`);
+        stopPodLogStream();
     };
-
-    req.send();
 }
 
 // podLogModalData manages the pod logs modal and fetches the containers and logs
@@ -802,6 +900,7 @@ async function update() {
         if (data.hasOwnProperty('tree')) {
             if (Object.keys(data.tree).length > 0) {
                 updateTree(data.tree);
+                updateChartDiffs(data.tree);
             }
         } else {
             console.log("event status missing tree element");
@@ -850,6 +949,7 @@ document.addEventListener("DOMContentLoaded", function(){
     update();
     if (document.getElementById('podLogModal') !== null) {
         $("#podLogModal").on('hidden.bs.modal', function (e) {
+            stopPodLogStream();
             active_pod_name = "";
             active_container = "";
             document.getElementById('podLogModalHeading').innerHTML = "Logs:";
@@ -860,5 +960,12 @@ document.addEventListener("DOMContentLoaded", function(){
             e.preventDefault();
             getPodLogs();
         });
+        for (const id of ["podLogFollow", "podLogTimestamps", "podLogPrevious"]) {
+            document.getElementById(id).addEventListener('change', function (e) {
+                if (active_container !== "") {
+                    getPodLogs();
+                }
+            });
+        }
     }
 });